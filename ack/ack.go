@@ -0,0 +1,264 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package ack implements at-least-once delivery over a pair of one-way
+// channels, typically PUSH/PULL.  Each message is given an ID and kept
+// in a Store until the receiver acknowledges it (over a second channel,
+// in the other direction); messages not acknowledged in time are sent
+// again.  With a persistent Store, messages in flight when the sending
+// process stops are sent again when it starts.
+//
+// Delivery is at least once, not exactly once.  A message may arrive
+// more than once (if its acknowledgment was lost, or the sender was
+// restarted), so receivers must be prepared to see duplicates, which
+// carry the same ID.
+//
+// On the wire, each message is an eight byte big-endian ID followed by
+// the payload, and each acknowledgment is just the ID.
+package ack
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// DefaultResendTime is how long a Sender waits for acknowledgment before
+// sending a message again.
+var DefaultResendTime = time.Second * 10
+
+// maxBackoff is the longest a Sender waits after failing to receive an
+// acknowledgment, before trying again.
+const maxBackoff = time.Millisecond * 100
+
+// Sender sends messages, and sends them again until acknowledged.
+type Sender struct {
+	sock    mangos.Socket
+	acks    mangos.Socket
+	store   Store
+	resend  time.Duration
+	pending map[uint64]time.Time // when last sent
+	epoch   uint64
+	next    uint64
+	closed  bool
+	closeq  chan struct{}
+	sync.Mutex
+}
+
+// NewSender returns a Sender sending on sock, and receiving
+// acknowledgments on acks.  The Sender owns both sockets, and closes
+// them when it is closed.  Any messages already in the store, left over
+// from an earlier run, are sent again promptly.
+func NewSender(sock, acks mangos.Socket, store Store) (*Sender, error) {
+	s := &Sender{
+		sock:    sock,
+		acks:    acks,
+		store:   store,
+		resend:  DefaultResendTime,
+		pending: make(map[uint64]time.Time),
+		closeq:  make(chan struct{}),
+	}
+	// IDs start with a random epoch, so that late acknowledgments meant
+	// for an earlier run are not mistaken for ours.
+	var epoch [4]byte
+	if _, err := rand.Read(epoch[:]); err != nil {
+		return nil, err
+	}
+	s.epoch = uint64(binary.BigEndian.Uint32(epoch[:])) << 32
+	var stale []uint64
+	err := store.Range(func(id uint64, _ []byte) error {
+		stale = append(stale, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range stale {
+		s.pending[id] = time.Time{}
+	}
+	go s.receiver()
+	go s.resender()
+	return s, nil
+}
+
+// SetResendTime sets how long to wait for acknowledgment before sending
+// a message again.  The default is DefaultResendTime.
+func (s *Sender) SetResendTime(d time.Duration) {
+	s.Lock()
+	s.resend = d
+	s.Unlock()
+}
+
+// Send stores the message, and sends it.  Once it returns without error
+// the message will be delivered, eventually, provided the store does not
+// lose it.  A failure to send is not an error, as the message will be
+// sent again later.
+func (s *Sender) Send(body []byte) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return mangos.ErrClosed
+	}
+	s.next++
+	id := s.epoch | (s.next & 0xffffffff)
+	s.Unlock()
+
+	if err := s.store.Put(id, body); err != nil {
+		return err
+	}
+	s.Lock()
+	s.pending[id] = time.Now()
+	s.Unlock()
+	s.transmit(id, body)
+	return nil
+}
+
+// Pending returns the number of messages not yet acknowledged.
+func (s *Sender) Pending() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.pending)
+}
+
+// Close stops the Sender, and closes its sockets.  Unacknowledged
+// messages remain in the store.
+func (s *Sender) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return mangos.ErrClosed
+	}
+	s.closed = true
+	close(s.closeq)
+	s.Unlock()
+	s.sock.Close()
+	s.acks.Close()
+	return nil
+}
+
+func (s *Sender) transmit(id uint64, body []byte) {
+	m := mangos.NewMessage(8 + len(body))
+	m.Body = m.Body[:8]
+	binary.BigEndian.PutUint64(m.Body, id)
+	m.Body = append(m.Body, body...)
+	if s.sock.SendMsg(m) != nil {
+		m.Free()
+	}
+}
+
+func (s *Sender) receiver() {
+	var delay time.Duration
+	for {
+		b, err := s.acks.Recv()
+		switch {
+		case err == mangos.ErrClosed:
+			return
+		case err != nil:
+			// Back off, so that an error that persists does not
+			// spin.
+			if delay *= 2; delay == 0 {
+				delay = time.Millisecond
+			} else if delay > maxBackoff {
+				delay = maxBackoff
+			}
+			select {
+			case <-s.closeq:
+				return
+			case <-time.After(delay):
+			}
+			continue
+		case len(b) != 8:
+			continue
+		}
+		delay = 0
+		id := binary.BigEndian.Uint64(b)
+		s.Lock()
+		_, ok := s.pending[id]
+		delete(s.pending, id)
+		s.Unlock()
+		if ok {
+			// If this fails the message is sent again after a
+			// restart, which at-least-once permits.
+			_ = s.store.Delete(id)
+		}
+	}
+}
+
+func (s *Sender) resender() {
+	tick := time.NewTicker(time.Millisecond * 100)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.closeq:
+			return
+		case now := <-tick.C:
+			var due []uint64
+			s.Lock()
+			for id, sent := range s.pending {
+				if now.Sub(sent) >= s.resend {
+					due = append(due, id)
+					s.pending[id] = now
+				}
+			}
+			s.Unlock()
+			for _, id := range due {
+				if body, err := s.store.Get(id); err == nil {
+					s.transmit(id, body)
+				}
+			}
+		}
+	}
+}
+
+// Receiver receives messages from a Sender, and acknowledges them.
+type Receiver struct {
+	sock mangos.Socket
+	acks mangos.Socket
+}
+
+// NewReceiver returns a Receiver receiving on sock, and sending
+// acknowledgments on acks.
+func NewReceiver(sock, acks mangos.Socket) *Receiver {
+	return &Receiver{sock: sock, acks: acks}
+}
+
+// Recv receives a message, returning its ID and payload.  The message
+// should be passed to Ack once it has been dealt with.
+func (r *Receiver) Recv() (uint64, []byte, error) {
+	b, err := r.sock.Recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < 8 {
+		return 0, nil, mangos.ErrTooShort
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+// Ack acknowledges the message with the given ID, so that the Sender
+// will not send it again.
+func (r *Receiver) Ack(id uint64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return r.acks.Send(b)
+}
+
+// Close closes the Receiver's sockets.
+func (r *Receiver) Close() error {
+	r.sock.Close()
+	r.acks.Close()
+	return nil
+}
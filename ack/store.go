@@ -0,0 +1,175 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ack
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Store keeps the messages that have yet to be acknowledged.  It is the
+// same as mangos.AckStore, so the stores here may be given to a PUSH
+// socket with mangos.OptionAckStore.
+type Store = mangos.AckStore
+
+// ErrNotFound is returned by Store.Get when there is no such message.
+var ErrNotFound = errors.New("message not found")
+
+// MemoryStore is a Store that keeps messages in memory.  It does not
+// survive a restart, but still gives redelivery after lost messages or
+// acknowledgments.
+type MemoryStore struct {
+	msgs map[uint64][]byte
+	sync.Mutex
+}
+
+// NewMemoryStore returns a new, empty, MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{msgs: make(map[uint64][]byte)}
+}
+
+// Put implements Store.
+func (ms *MemoryStore) Put(id uint64, body []byte) error {
+	ms.Lock()
+	ms.msgs[id] = append([]byte(nil), body...)
+	ms.Unlock()
+	return nil
+}
+
+// Get implements Store.
+func (ms *MemoryStore) Get(id uint64) ([]byte, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if b, ok := ms.msgs[id]; ok {
+		return b, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Delete implements Store.
+func (ms *MemoryStore) Delete(id uint64) error {
+	ms.Lock()
+	delete(ms.msgs, id)
+	ms.Unlock()
+	return nil
+}
+
+// Range implements Store.
+func (ms *MemoryStore) Range(f func(id uint64, body []byte) error) error {
+	ms.Lock()
+	ids := make([]uint64, 0, len(ms.msgs))
+	for id := range ms.msgs {
+		ids = append(ids, id)
+	}
+	ms.Unlock()
+	for _, id := range ids {
+		if b, err := ms.Get(id); err == nil {
+			if err = f(id, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DirStore is a Store keeping each message in a file of its own, in a
+// directory.  It survives restarts, but is only suitable for modest
+// message rates.
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore returns a DirStore using dir, creating it if necessary.
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+func (ds *DirStore) path(id uint64) string {
+	return filepath.Join(ds.dir, fmt.Sprintf("%016x.msg", id))
+}
+
+// Put implements Store.  The file is written under a temporary name and
+// then renamed, so that a crash does not leave a partial message.
+func (ds *DirStore) Put(id uint64, body []byte) error {
+	f, err := ioutil.TempFile(ds.dir, "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), ds.path(id))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Get implements Store.
+func (ds *DirStore) Get(id uint64) ([]byte, error) {
+	b, err := ioutil.ReadFile(ds.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+// Delete implements Store.
+func (ds *DirStore) Delete(id uint64) error {
+	if err := os.Remove(ds.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Range implements Store.
+func (ds *DirStore) Range(f func(id uint64, body []byte) error) error {
+	files, err := ioutil.ReadDir(ds.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".msg") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".msg"), 16, 64)
+		if err != nil {
+			continue
+		}
+		if b, err := ds.Get(id); err == nil {
+			if err = f(id, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
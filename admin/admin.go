@@ -0,0 +1,311 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin serves a description of every open mangos socket in the
+// process as JSON over HTTP: its protocol, the values of its options, its
+// dialers and listeners, each of its pipes with their counters, the
+// internal state of its protocol (as from Socket.Debug), and the
+// events and background errors that have most recently happened on it.
+// It is meant for operators, and for tools that poll it, and can be
+// mounted on an existing http.ServeMux:
+//
+//	admin.Mount(http.DefaultServeMux, "/sp/admin")
+//
+// after which GET /sp/admin/ lists the open sockets, and GET /sp/admin/3
+// describes the socket with ID 3 in full.
+//
+// The description includes the addresses of peers and the subjects of
+// their certificates, so it should not be served where untrusted clients
+// can reach it.  Options are shown as they are reported by GetOption,
+// except that durations are shown as strings, hooks (such as functions
+// and TLS configurations) only by their type, and channels not at all.
+package admin
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/internal/core"
+)
+
+// Summary describes one socket in the list served at the root.
+type Summary struct {
+	ID       uint64       `json:"id"`
+	Name     string       `json:"name,omitempty"`
+	Protocol string       `json:"protocol"`
+	Peer     string       `json:"peer"`
+	Pipes    int          `json:"pipes"` // the number connected
+	Stats    mangos.Stats `json:"stats"`
+}
+
+// Socket is the full description of one socket.
+type Socket struct {
+	ID        uint64                 `json:"id"`
+	Name      string                 `json:"name,omitempty"`
+	Protocol  string                 `json:"protocol"`
+	Peer      string                 `json:"peer"`
+	Raw       bool                   `json:"raw"`
+	Options   map[string]interface{} `json:"options"`
+	Endpoints []mangos.EndpointInfo  `json:"endpoints"`
+	Pipes     []Pipe                 `json:"pipes"`
+	Stats     mangos.Stats           `json:"stats"`
+	State     mangos.ProtocolState   `json:"state"`  // from Socket.Debug
+	Events    []mangos.Event         `json:"events"` // oldest first
+	Errors    []mangos.Event         `json:"errors"` // oldest first
+}
+
+// Pipe describes one pipe of a Socket, as reported by Socket.Pipes.
+type Pipe struct {
+	ID         uint32    `json:"id"`
+	Address    string    `json:"address"`
+	Role       string    `json:"role"` // "dialer" or "listener"
+	State      string    `json:"state"`
+	LocalAddr  string    `json:"local_addr,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	TLS        string    `json:"tls,omitempty"`      // version and cipher suite
+	TLSPeer    string    `json:"tls_peer,omitempty"` // subject of the peer's certificate
+	Connected  time.Time `json:"connected"`
+	LastActive time.Time `json:"last_active"`
+	MsgsSent   uint64    `json:"msgs_sent"`
+	MsgsRecv   uint64    `json:"msgs_recv"`
+	BytesSent  uint64    `json:"bytes_sent"`
+	BytesRecv  uint64    `json:"bytes_recv"`
+	Queued     uint64    `json:"queued"`
+	Dropped    uint64    `json:"dropped"`
+	SendCredit int       `json:"send_credit"` // -1 where there is no limit
+	RecvCredit int       `json:"recv_credit"`
+}
+
+// List returns a summary of every open socket, in order of creation.
+func List() []Summary {
+	states := core.Sockets()
+	list := make([]Summary, 0, len(states))
+	for _, st := range states {
+		list = append(list, Summary{
+			ID:       st.ID,
+			Name:     st.Name,
+			Protocol: st.Protocol,
+			Peer:     st.Peer,
+			Pipes:    len(st.Pipes),
+			Stats:    st.Stats,
+		})
+	}
+	return list
+}
+
+// Describe returns the full description of the open socket with the
+// given ID.  The second value is false if there is no such socket.
+func Describe(id uint64) (*Socket, bool) {
+	sock, st, ok := core.Lookup(id)
+	if !ok {
+		return nil, false
+	}
+	d := &Socket{
+		ID:        st.ID,
+		Name:      st.Name,
+		Protocol:  st.Protocol,
+		Peer:      st.Peer,
+		Options:   make(map[string]interface{}),
+		Endpoints: sock.Endpoints(),
+		Stats:     st.Stats,
+		State:     sock.Debug(),
+		Events:    st.Events,
+		Errors:    st.Errors,
+	}
+	if v, err := sock.GetOption(mangos.OptionRaw); err == nil {
+		d.Raw, _ = v.(bool)
+	}
+	for _, name := range optionNames(sock.Info().SelfName, d.Raw) {
+		v, err := sock.GetOption(name)
+		if err != nil {
+			continue
+		}
+		if v, ok := value(v); ok {
+			d.Options[name] = v
+		}
+	}
+	for _, info := range sock.Pipes() {
+		d.Pipes = append(d.Pipes, pipe(info))
+	}
+	return d, true
+}
+
+// Handler returns an http.Handler serving the list of sockets at the
+// root, and the description of each below it, by ID.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		path := strings.Trim(r.URL.Path, "/")
+		if path == "" {
+			write(w, http.StatusOK, List())
+			return
+		}
+		id, err := strconv.ParseUint(path, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "no such socket")
+			return
+		}
+		d, ok := Describe(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such socket")
+			return
+		}
+		write(w, http.StatusOK, d)
+	})
+}
+
+// Mount serves Handler on mux below prefix, such as "/sp/admin".
+func Mount(mux *http.ServeMux, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, Handler()))
+}
+
+func write(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(append(b, '\n'))
+}
+
+func writeError(w http.ResponseWriter, code int, text string) {
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{text})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(append(b, '\n'))
+}
+
+// optionNames returns the options to report for a socket of the named
+// protocol: those every socket has, and those of the protocol.
+func optionNames(proto string, raw bool) []string {
+	names := append([]string(nil), mangos.SocketOptions...)
+	if desc, ok := mangos.ProtocolByName(proto); ok {
+		if raw && desc.RawOptions != nil {
+			names = append(names, desc.RawOptions...)
+		} else {
+			names = append(names, desc.Options...)
+		}
+	}
+	seen := make(map[string]bool, len(names))
+	uniq := names[:0]
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			uniq = append(uniq, name)
+		}
+	}
+	return uniq
+}
+
+// value returns an option value as it is to be shown in JSON, or false
+// if it is not to be shown at all.
+func value(v interface{}) (interface{}, bool) {
+	if v == nil {
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Chan:
+		return nil, false
+	case reflect.Func, reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		if rv.IsNil() {
+			return nil, false
+		}
+	}
+	switch x := v.(type) {
+	case time.Duration:
+		return x.String(), true
+	case []byte:
+		return string(x), true
+	case []string:
+		return x, true
+	case fmt.Stringer:
+		return x.String(), true
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool(), true
+	case reflect.String:
+		return rv.String(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint(), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return fmt.Sprintf("(%T)", v), true
+}
+
+func pipe(info mangos.PipeInfo) Pipe {
+	p := Pipe{
+		ID:         info.ID,
+		Address:    info.Address,
+		Role:       info.Role,
+		State:      info.State,
+		Connected:  info.Connected,
+		LastActive: info.LastActive,
+		MsgsSent:   info.MsgsSent,
+		MsgsRecv:   info.MsgsRecv,
+		BytesSent:  info.BytesSent,
+		BytesRecv:  info.BytesRecv,
+		Queued:     info.Queued,
+		Dropped:    info.Dropped,
+		SendCredit: info.SendCredit,
+		RecvCredit: info.RecvCredit,
+	}
+	if info.LocalAddr != nil {
+		p.LocalAddr = info.LocalAddr.String()
+	}
+	if info.RemoteAddr != nil {
+		p.RemoteAddr = info.RemoteAddr.String()
+	}
+	if cs := info.TLS; cs != nil {
+		p.TLS = tlsVersion(cs.Version) + " " + tls.CipherSuiteName(cs.CipherSuite)
+		if len(cs.PeerCertificates) > 0 {
+			p.TLSPeer = cs.PeerCertificates[0].Subject.String()
+		}
+	}
+	return p
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
@@ -0,0 +1,467 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mqtt bridges SP publish/subscribe to an MQTT broker, so that
+// MQTT devices at the edge can exchange messages with SP applications
+// within.  It speaks MQTT 3.1.1 itself, needing no MQTT library.
+//
+// SP messages have no topic of their own; by convention the topic is
+// the start of the body, which subscribers match.  Here the topic runs
+// to the first separator byte (see Config.Separator), and what follows
+// is the payload.  Topics are translated by swapping a prefix: an SP
+// topic starting with Config.SPPrefix is published to MQTT with that
+// replaced by Config.MQTTPrefix, and MQTT messages received have the
+// reverse done.  Messages whose topics lack the prefix are not bridged.
+//
+// The bridge publishes upstream, to the broker, what an SP SUB socket
+// receives, and publishes downstream, on an SP PUB socket, what it
+// receives from the broker.  If messages published upstream can come
+// back downstream to the same SP subscribers, they will loop; the
+// prefixes and filters should be chosen to avoid that.
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// maxInflight is the number of QoS 1 messages sent upstream that may
+// await acknowledgement; beyond this, publishing waits.
+const maxInflight = 64
+
+var errNotConnected = errors.New("mqtt: not connected")
+
+// Config is the configuration of a Bridge.
+type Config struct {
+	// Broker is the address of the broker: tcp://host:port, or
+	// tls+tcp://host:port for TLS.
+	Broker string
+
+	// TLSConfig is used for TLS connections.
+	TLSConfig *tls.Config
+
+	// ClientID identifies the bridge to the broker.  If empty, the
+	// broker assigns one.  The session is always a clean one.
+	ClientID string
+
+	// Username and Password are sent to the broker if not empty.
+	Username string
+	Password string
+
+	// KeepAlive is the interval at which the broker is pinged.  The
+	// default is 30 seconds.
+	KeepAlive time.Duration
+
+	// ReconnectTime is how long to wait before connecting to the
+	// broker again, after the connection is lost.  The default is one
+	// second.
+	ReconnectTime time.Duration
+
+	// QoS is the MQTT quality of service, 0 (at most once) or 1 (at
+	// least once), for publishing and subscribing.
+	QoS byte
+
+	// SPPrefix and MQTTPrefix are the prefixes swapped to translate
+	// topics between SP and MQTT.  Either or both may be empty.
+	SPPrefix   string
+	MQTTPrefix string
+
+	// Separator ends the topic in SP messages.  The default, zero, is
+	// the NUL byte.
+	Separator byte
+
+	// Filters are the MQTT topic filters subscribed to downstream,
+	// following MQTTPrefix.  The default is "#", which is everything
+	// under the prefix.
+	Filters []string
+}
+
+// Bridge relays messages between SP sockets and an MQTT broker.
+type Bridge struct {
+	cfg  Config
+	up   mangos.Socket
+	down mangos.Socket
+	ctx  mangos.Context
+
+	sync.Mutex
+	cond     *sync.Cond
+	conn     net.Conn
+	inflight map[uint16]*packet
+	nextID   uint16
+	closeq   chan struct{}
+	closed   bool
+
+	wlock sync.Mutex // orders writes to conn
+}
+
+// Dial connects to the broker, and starts a Bridge publishing upstream
+// what the SUB socket up receives, and publishing downstream, on the
+// PUB socket down, what the broker sends.  Either may be nil, to bridge
+// in only one direction.  If the connection to the broker is lost, it
+// is made again in the background.
+func Dial(cfg Config, up mangos.Socket, down mangos.Socket) (*Bridge, error) {
+	if cfg.QoS > 1 {
+		return nil, mangos.ErrBadValue
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = time.Second * 30
+	}
+	if cfg.ReconnectTime <= 0 {
+		cfg.ReconnectTime = time.Second
+	}
+	if len(cfg.Filters) == 0 {
+		cfg.Filters = []string{"#"}
+	}
+	if up != nil && up.Info().Self != mangos.ProtoSub {
+		return nil, mangos.ErrBadProto
+	}
+	if down != nil && down.Info().Self != mangos.ProtoPub {
+		return nil, mangos.ErrBadProto
+	}
+	b := &Bridge{
+		cfg:      cfg,
+		up:       up,
+		down:     down,
+		inflight: make(map[uint16]*packet),
+		closeq:   make(chan struct{}),
+	}
+	b.cond = sync.NewCond(b)
+
+	c, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	if up != nil {
+		ctx, err := up.OpenContext()
+		if err != nil {
+			c.Close()
+			return nil, mangos.ErrBadProto
+		}
+		if err = ctx.SetOption(mangos.OptionSubscribe, []byte(cfg.SPPrefix)); err != nil {
+			ctx.Close()
+			c.Close()
+			return nil, err
+		}
+		b.ctx = ctx
+		go b.publisher()
+	}
+	go b.run(c)
+	return b, nil
+}
+
+// Close disconnects from the broker and stops the bridge.  It does not
+// close the sockets.
+func (b *Bridge) Close() error {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return mangos.ErrClosed
+	}
+	b.closed = true
+	c := b.conn
+	b.cond.Broadcast()
+	b.Unlock()
+	close(b.closeq)
+	if b.ctx != nil {
+		b.ctx.Close()
+	}
+	if c != nil {
+		b.write(&packet{kind: pktDisconnect})
+		c.Close()
+	}
+	return nil
+}
+
+// connect dials the broker and completes the MQTT handshake.
+func (b *Bridge) connect() (net.Conn, error) {
+	var c net.Conn
+	var err error
+	switch addr := b.cfg.Broker; {
+	case strings.HasPrefix(addr, "tcp://"):
+		c, err = net.Dial("tcp", addr[len("tcp://"):])
+	case strings.HasPrefix(addr, "tls+tcp://"):
+		c, err = tls.Dial("tcp", addr[len("tls+tcp://"):], b.cfg.TLSConfig)
+	default:
+		return nil, mangos.ErrBadTran
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0x02) // clean session
+	if b.cfg.Username != "" {
+		flags |= 0x80
+	}
+	if b.cfg.Password != "" {
+		flags |= 0x40
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags) // protocol level 3.1.1
+	body = appendUint16(body, uint16(b.cfg.KeepAlive/time.Second))
+	body = appendString(body, b.cfg.ClientID)
+	if b.cfg.Username != "" {
+		body = appendString(body, b.cfg.Username)
+	}
+	if b.cfg.Password != "" {
+		body = appendString(body, b.cfg.Password)
+	}
+	p := &packet{kind: pktConnect, body: body}
+
+	c.SetDeadline(time.Now().Add(b.cfg.KeepAlive))
+	if _, err = c.Write(p.encode()); err != nil {
+		c.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(c)
+	if p, err = readPacket(r); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if p.kind != pktConnack || len(p.body) != 2 {
+		c.Close()
+		return nil, errBadPacket
+	}
+	if p.body[1] != 0 {
+		c.Close()
+		return nil, errRefused
+	}
+	c.SetDeadline(time.Time{})
+	return &bufConn{Conn: c, r: r}, nil
+}
+
+// bufConn keeps the reader used for the handshake, which may have read
+// ahead.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// run serves connections to the broker until the bridge is closed.
+func (b *Bridge) run(c net.Conn) {
+	for {
+		if c != nil {
+			b.serve(c)
+		}
+		select {
+		case <-b.closeq:
+			return
+		case <-time.After(b.cfg.ReconnectTime):
+		}
+		c, _ = b.connect()
+	}
+}
+
+// serve subscribes, resends what is unacknowledged, and then handles
+// what the broker sends, until the connection is lost.
+func (b *Bridge) serve(c net.Conn) {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		c.Close()
+		return
+	}
+	b.conn = c
+	var resend []*packet
+	ids := make([]int, 0, len(b.inflight))
+	for id := range b.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		// A copy, as the publisher may be sending the original.
+		p := *b.inflight[uint16(id)]
+		p.flags |= 0x08 // DUP
+		resend = append(resend, &p)
+	}
+	b.Unlock()
+
+	defer func() {
+		b.Lock()
+		b.conn = nil
+		b.Unlock()
+		c.Close()
+	}()
+
+	if b.down != nil {
+		body := appendUint16(nil, 1)
+		for _, f := range b.cfg.Filters {
+			body = appendString(body, b.cfg.MQTTPrefix+f)
+			body = append(body, b.cfg.QoS)
+		}
+		if b.write(&packet{kind: pktSubscribe, flags: 0x02, body: body}) != nil {
+			return
+		}
+	}
+	for _, p := range resend {
+		if b.write(p) != nil {
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go b.pinger(done)
+
+	r := c.(*bufConn).r
+	for {
+		c.SetReadDeadline(time.Now().Add(b.cfg.KeepAlive * 3 / 2))
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.kind {
+		case pktPublish:
+			if b.deliver(p) != nil {
+				return
+			}
+		case pktPuback:
+			if len(p.body) != 2 {
+				return
+			}
+			b.Lock()
+			delete(b.inflight, binary.BigEndian.Uint16(p.body))
+			b.cond.Broadcast()
+			b.Unlock()
+		case pktSuback:
+			for _, code := range p.body[2:] {
+				if code == 0x80 {
+					// Without the subscription, there is no
+					// point staying connected.
+					b.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *Bridge) pinger(done chan struct{}) {
+	tick := time.NewTicker(b.cfg.KeepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if b.write(&packet{kind: pktPingreq}) != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (b *Bridge) write(p *packet) error {
+	b.Lock()
+	c := b.conn
+	b.Unlock()
+	if c == nil {
+		return errNotConnected
+	}
+	b.wlock.Lock()
+	defer b.wlock.Unlock()
+	_, err := c.Write(p.encode())
+	return err
+}
+
+// deliver publishes downstream a message from the broker, and then
+// acknowledges it if need be.
+func (b *Bridge) deliver(p *packet) error {
+	topic, id, payload, err := parsePublish(p)
+	if err != nil {
+		return err
+	}
+	if b.down != nil && strings.HasPrefix(topic, b.cfg.MQTTPrefix) {
+		topic = b.cfg.SPPrefix + topic[len(b.cfg.MQTTPrefix):]
+		body := make([]byte, 0, len(topic)+1+len(payload))
+		body = append(body, topic...)
+		body = append(body, b.cfg.Separator)
+		body = append(body, payload...)
+		if err = b.down.Send(body); err != nil {
+			return err
+		}
+	}
+	if (p.flags>>1)&3 > 0 {
+		return b.write(ack(pktPuback, id))
+	}
+	return nil
+}
+
+// publisher publishes upstream what the SUB socket receives.
+func (b *Bridge) publisher() {
+	for {
+		m, err := b.ctx.RecvMsg()
+		if err != nil {
+			return
+		}
+		topic, payload := m.Body, []byte(nil)
+		if i := bytes.IndexByte(m.Body, b.cfg.Separator); i >= 0 {
+			topic, payload = m.Body[:i], m.Body[i+1:]
+		}
+		if !bytes.HasPrefix(topic, []byte(b.cfg.SPPrefix)) {
+			m.Free()
+			continue
+		}
+		// MQTT does not allow wildcards in the topics published to.
+		name := b.cfg.MQTTPrefix + string(topic[len(b.cfg.SPPrefix):])
+		if name == "" || strings.ContainsAny(name, "#+\x00") {
+			m.Free()
+			continue
+		}
+		p := publish(name, payload, b.cfg.QoS, 0, false)
+		m.Free()
+		if b.cfg.QoS == 0 {
+			// At most once; if not connected, it is lost.
+			b.write(p)
+			continue
+		}
+		if !b.track(p) {
+			return
+		}
+		b.write(p)
+	}
+}
+
+// track assigns a QoS 1 message an id, and keeps it until acknowledged,
+// first waiting for room.  It returns false if the bridge is closed.
+func (b *Bridge) track(p *packet) bool {
+	b.Lock()
+	defer b.Unlock()
+	for len(b.inflight) >= maxInflight && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return false
+	}
+	for {
+		b.nextID++
+		if _, ok := b.inflight[b.nextID]; b.nextID != 0 && !ok {
+			break
+		}
+	}
+	// The id follows the topic.
+	n := 2 + int(binary.BigEndian.Uint16(p.body))
+	binary.BigEndian.PutUint16(p.body[n:], b.nextID)
+	b.inflight[b.nextID] = p
+	return true
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Packet types, from MQTT 3.1.1.
+const (
+	pktConnect    = 1
+	pktConnack    = 2
+	pktPublish    = 3
+	pktPuback     = 4
+	pktSubscribe  = 8
+	pktSuback     = 9
+	pktPingreq    = 12
+	pktPingresp   = 13
+	pktDisconnect = 14
+)
+
+var (
+	errBadPacket = errors.New("mqtt: bad packet")
+	errRefused   = errors.New("mqtt: connection refused by broker")
+	errSubFailed = errors.New("mqtt: subscription refused by broker")
+)
+
+// packet is an MQTT control packet, with the flags of the fixed header
+// and the rest of it undecoded.
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	p := &packet{kind: b >> 4, flags: b & 0x0f}
+	n := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, errBadPacket
+		}
+		if b, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	p.body = make([]byte, n)
+	if _, err = io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// encode returns the packet as sent.
+func (p *packet) encode() []byte {
+	b := []byte{p.kind<<4 | p.flags}
+	n := len(p.body)
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, p.body...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// readString returns a string from the start of b, and the rest of b.
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errBadPacket
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errBadPacket
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// publish returns a PUBLISH packet.  The id is used only for QoS 1.
+func publish(topic string, payload []byte, qos byte, id uint16, dup bool) *packet {
+	p := &packet{kind: pktPublish, flags: qos << 1}
+	if dup {
+		p.flags |= 0x08
+	}
+	p.body = appendString(nil, topic)
+	if qos > 0 {
+		p.body = appendUint16(p.body, id)
+	}
+	p.body = append(p.body, payload...)
+	return p
+}
+
+// parsePublish returns the topic, packet id and payload of a PUBLISH.
+func parsePublish(p *packet) (string, uint16, []byte, error) {
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	var id uint16
+	if (p.flags>>1)&3 > 0 {
+		if len(rest) < 2 {
+			return "", 0, nil, errBadPacket
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	return topic, id, rest, nil
+}
+
+// ack returns a packet holding just a packet id, such as PUBACK.
+func ack(kind byte, id uint16) *packet {
+	return &packet{kind: kind, body: appendUint16(nil, id)}
+}
@@ -0,0 +1,541 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package zmq bridges SP sockets to ZeroMQ, so that applications using
+// either can be mixed while migrating from one to the other.  It speaks
+// ZMTP 3.0 (the ZeroMQ wire protocol) itself, over tcp and ipc, so it
+// needs no ZeroMQ library.  Only the NULL security mechanism is
+// supported.
+//
+// A Bridge relays between a mangos socket and ZeroMQ peers, taking on
+// the ZeroMQ socket type that stands where the SP peers of the socket
+// would:
+//
+//   - For a SUB socket, the bridge is a ZeroMQ PUB, republishing what
+//     the socket receives to ZeroMQ subscribers.  The socket is
+//     subscribed to the topics those subscribers want.
+//   - For a PUB socket, the bridge is a ZeroMQ SUB, publishing on the
+//     socket what it receives from ZeroMQ publishers.  It subscribes to
+//     the topics wanted by the socket's subscribers, as far as they are
+//     known (see mangos.OptionSubscriptions).
+//   - For a REP socket, the bridge is a ZeroMQ REQ, passing the requests
+//     the socket receives to ZeroMQ servers, and returning their replies.
+//   - For a REQ socket, the bridge is a ZeroMQ REP, passing the requests
+//     of ZeroMQ clients to the socket's servers.
+//
+// Multipart ZeroMQ messages are joined into one.  As ZeroMQ REQ and REP
+// sockets take one request at a time, each connection carries just one
+// at a time; there can be several connections.  Requests in flight when
+// a connection is lost are dropped, and left to the requester to retry.
+//
+// The bridge uses contexts on SUB, REQ and REP sockets, which must not
+// be raw.  Closing the Bridge does not close the socket.
+package zmq
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// HandshakeTime limits the time taken to handshake with a ZeroMQ peer.
+var HandshakeTime = time.Second * 5
+
+// RedialTime is how long a dialing Bridge waits before dialing again,
+// after failing to connect or losing the connection.
+var RedialTime = time.Millisecond * 100
+
+// sendQLen is the number of messages queued for each ZeroMQ subscriber,
+// beyond which more are dropped, as PUB sockets do.
+const sendQLen = 128
+
+// Bridge relays messages between a mangos socket and ZeroMQ peers.
+type Bridge struct {
+	sock    mangos.Socket
+	self    string // our ZeroMQ socket type
+	ctx     mangos.Context
+	maxSize int
+
+	sync.Mutex
+	conns  map[*peer]struct{}
+	l      net.Listener
+	closeq chan struct{}
+	closed bool
+	have   map[string]bool // ZeroMQ subscriptions made on ctx
+
+	subLock sync.Mutex // orders sending our subscriptions
+}
+
+// peer is a connection to a ZeroMQ peer.
+type peer struct {
+	*conn
+	subs  [][]byte        // what a subscriber wants
+	sent  map[string]bool // what we subscribed to
+	sendq chan []byte
+}
+
+// newBridge returns a Bridge for the socket, without connections.
+func newBridge(sock mangos.Socket) (*Bridge, error) {
+	b := &Bridge{
+		sock:   sock,
+		conns:  make(map[*peer]struct{}),
+		closeq: make(chan struct{}),
+		have:   make(map[string]bool),
+	}
+	switch sock.Info().Self {
+	case mangos.ProtoSub:
+		b.self = "PUB"
+	case mangos.ProtoPub:
+		b.self = "SUB"
+	case mangos.ProtoRep:
+		b.self = "REQ"
+	case mangos.ProtoReq:
+		b.self = "REP"
+	default:
+		return nil, mangos.ErrBadProto
+	}
+	if v, err := sock.GetOption(mangos.OptionMaxRecvSize); err == nil {
+		b.maxSize, _ = v.(int)
+	}
+	if b.self == "PUB" {
+		ctx, err := sock.OpenContext()
+		if err != nil {
+			return nil, mangos.ErrBadProto
+		}
+		b.ctx = ctx
+		go b.publisher()
+	}
+	if b.self == "SUB" {
+		go b.subscriber()
+	}
+	return b, nil
+}
+
+// parseAddr returns the network and address to use for a ZeroMQ
+// address, which is tcp://host:port or ipc://path.
+func parseAddr(addr string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp", addr[len("tcp://"):], nil
+	case strings.HasPrefix(addr, "ipc://"):
+		return "unix", addr[len("ipc://"):], nil
+	}
+	return "", "", mangos.ErrBadTran
+}
+
+// Listen starts a Bridge between the socket and the ZeroMQ peers that
+// connect to the address, which is tcp://host:port or ipc://path.
+func Listen(sock mangos.Socket, addr string) (*Bridge, error) {
+	network, where, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(network, where)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBridge(sock)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	b.l = l
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				b.Close()
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b, nil
+}
+
+// Dial starts a Bridge between the socket and the ZeroMQ peer at the
+// address, which is tcp://host:port or ipc://path.  The connection is
+// made in the background, and made again if lost.
+func Dial(sock mangos.Socket, addr string) (*Bridge, error) {
+	network, where, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBridge(sock)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			if c, err := net.Dial(network, where); err == nil {
+				b.serve(c)
+			}
+			select {
+			case <-b.closeq:
+				return
+			case <-time.After(RedialTime):
+			}
+		}
+	}()
+	return b, nil
+}
+
+// Addr returns the address a listening Bridge listens on, which is
+// useful when the port was chosen by the system.  It is nil for a
+// dialing Bridge.
+func (b *Bridge) Addr() net.Addr {
+	if b.l == nil {
+		return nil
+	}
+	return b.l.Addr()
+}
+
+// Close stops the bridge, closing its connections.
+func (b *Bridge) Close() error {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return mangos.ErrClosed
+	}
+	b.closed = true
+	conns := b.conns
+	b.conns = nil
+	b.Unlock()
+	close(b.closeq)
+	if b.l != nil {
+		b.l.Close()
+	}
+	if b.ctx != nil {
+		b.ctx.Close()
+	}
+	for p := range conns {
+		p.Close()
+	}
+	return nil
+}
+
+// serve runs a connection until it is lost or the bridge closes.
+func (b *Bridge) serve(c net.Conn) {
+	zc, err := handshake(c, b.self, b.maxSize)
+	if err != nil {
+		c.Close()
+		return
+	}
+	p := &peer{conn: zc, sent: make(map[string]bool)}
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		c.Close()
+		return
+	}
+	b.conns[p] = struct{}{}
+	b.Unlock()
+
+	switch b.self {
+	case "PUB":
+		p.sendq = make(chan []byte, sendQLen)
+		go p.sender()
+		b.servePub(p)
+	case "SUB":
+		b.syncSubs(p)
+		b.serveSub(p)
+	case "REQ":
+		b.serveReq(p)
+	case "REP":
+		b.serveRep(p)
+	}
+
+	b.Lock()
+	delete(b.conns, p)
+	b.Unlock()
+	p.Close()
+	if p.sendq != nil {
+		close(p.sendq)
+	}
+	if b.self == "PUB" {
+		b.resubscribe()
+	}
+}
+
+// join returns the frames of a message as one body.
+func join(frames [][]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+// publisher sends what the socket receives to the subscribers.
+func (b *Bridge) publisher() {
+	for {
+		m, err := b.ctx.RecvMsg()
+		if err != nil {
+			return
+		}
+		b.Lock()
+		for p := range b.conns {
+			if !p.wants(m.Body) {
+				continue
+			}
+			select {
+			case p.sendq <- m.Body:
+			default:
+				// Too slow; drop it, as PUB sockets do.
+			}
+		}
+		b.Unlock()
+	}
+}
+
+// wants reports whether the subscriber wants the message.  The bridge
+// lock must be held.
+func (p *peer) wants(body []byte) bool {
+	for _, sub := range p.subs {
+		if bytes.HasPrefix(body, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *peer) sender() {
+	for body := range p.sendq {
+		if p.writeMsg(body) != nil {
+			p.Close()
+		}
+	}
+}
+
+// servePub reads the subscriptions of a ZeroMQ subscriber.
+func (b *Bridge) servePub(p *peer) {
+	for {
+		frames, err := p.readMsg()
+		if err != nil {
+			return
+		}
+		msg := join(frames)
+		if len(msg) == 0 || msg[0] > 1 {
+			continue
+		}
+		topic := msg[1:]
+		b.Lock()
+		for i, sub := range p.subs {
+			if bytes.Equal(sub, topic) {
+				p.subs = append(p.subs[:i], p.subs[i+1:]...)
+				break
+			}
+		}
+		if msg[0] == 1 {
+			p.subs = append(p.subs, topic)
+		}
+		b.Unlock()
+		b.resubscribe()
+	}
+}
+
+// resubscribe subscribes the context to the topics wanted by the ZeroMQ
+// subscribers.
+func (b *Bridge) resubscribe() {
+	b.Lock()
+	defer b.Unlock()
+	want := make(map[string]bool)
+	for p := range b.conns {
+		for _, sub := range p.subs {
+			want[string(sub)] = true
+		}
+	}
+	for topic := range want {
+		if !b.have[topic] &&
+			b.ctx.SetOption(mangos.OptionSubscribe, []byte(topic)) == nil {
+			b.have[topic] = true
+		}
+	}
+	for topic := range b.have {
+		if !want[topic] {
+			b.ctx.SetOption(mangos.OptionUnsubscribe, []byte(topic))
+			delete(b.have, topic)
+		}
+	}
+}
+
+// subscriber tells the ZeroMQ publishers what the socket's subscribers
+// want, whenever that changes.
+func (b *Bridge) subscriber() {
+	v, err := b.sock.GetOption(mangos.OptionSubscriptionsChanged)
+	if err != nil {
+		return
+	}
+	changed := v.(<-chan struct{})
+	for {
+		select {
+		case <-changed:
+		case <-b.closeq:
+			return
+		}
+		b.Lock()
+		conns := make([]*peer, 0, len(b.conns))
+		for p := range b.conns {
+			conns = append(conns, p)
+		}
+		b.Unlock()
+		for _, p := range conns {
+			b.syncSubs(p)
+		}
+	}
+}
+
+// syncSubs sends a ZeroMQ publisher the changes to what we want.  If
+// the socket cannot say, everything is wanted.
+func (b *Bridge) syncSubs(p *peer) {
+	b.subLock.Lock()
+	defer b.subLock.Unlock()
+	want := map[string]bool{"": true}
+	if v, err := b.sock.GetOption(mangos.OptionSubscriptions); err == nil {
+		want = make(map[string]bool)
+		for _, topic := range v.([][]byte) {
+			want[string(topic)] = true
+		}
+	}
+	for topic := range want {
+		if !p.sent[topic] {
+			if p.writeMsg(append([]byte{1}, topic...)) != nil {
+				return
+			}
+			p.sent[topic] = true
+		}
+	}
+	for topic := range p.sent {
+		if !want[topic] {
+			if p.writeMsg(append([]byte{0}, topic...)) != nil {
+				return
+			}
+			delete(p.sent, topic)
+		}
+	}
+}
+
+// serveSub publishes on the socket what a ZeroMQ publisher sends.
+func (b *Bridge) serveSub(p *peer) {
+	for {
+		frames, err := p.readMsg()
+		if err != nil {
+			return
+		}
+		if b.sock.Send(join(frames)) != nil {
+			return
+		}
+	}
+}
+
+// serveReq passes requests from the socket to a ZeroMQ server, one at
+// a time, and returns its replies.
+func (b *Bridge) serveReq(p *peer) {
+	ctx, err := b.sock.OpenContext()
+	if err != nil {
+		return
+	}
+	// Reading all the time notices a lost connection while waiting
+	// for a request, which closing the context then ends.
+	replies := make(chan [][]byte)
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+		for {
+			frames, err := p.readMsg()
+			if err != nil {
+				return
+			}
+			select {
+			case replies <- frames:
+			case <-b.closeq:
+				return
+			}
+		}
+	}()
+	go closeWhen(ctx, lost, b.closeq)
+	defer ctx.Close()
+
+	for {
+		m, err := ctx.RecvMsg()
+		if err != nil {
+			return
+		}
+		err = p.writeMsg([]byte{}, m.Body)
+		m.Free()
+		if err != nil {
+			return
+		}
+		var frames [][]byte
+		select {
+		case frames = <-replies:
+		case <-lost:
+			return
+		}
+		// The reply follows an empty delimiter.
+		if len(frames) == 0 || len(frames[0]) != 0 {
+			return
+		}
+		if ctx.Send(join(frames[1:])) != nil {
+			return
+		}
+	}
+}
+
+// serveRep passes requests from a ZeroMQ client to the socket, one at
+// a time, and returns the replies.
+func (b *Bridge) serveRep(p *peer) {
+	ctx, err := b.sock.OpenContext()
+	if err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go closeWhen(ctx, done, b.closeq)
+	defer close(done)
+
+	for {
+		frames, err := p.readMsg()
+		if err != nil {
+			return
+		}
+		// The envelope runs to the empty delimiter, and is returned
+		// with the reply.
+		n := 0
+		for n < len(frames) && len(frames[n]) != 0 {
+			n++
+		}
+		if n == len(frames) {
+			continue
+		}
+		if ctx.Send(join(frames[n+1:])) != nil {
+			return
+		}
+		reply, err := ctx.Recv()
+		if err != nil {
+			return
+		}
+		if p.writeMsg(append(frames[:n+1], reply)...) != nil {
+			return
+		}
+	}
+}
+
+// closeWhen closes the context when either channel is closed.
+func closeWhen(ctx mangos.Context, c1, c2 <-chan struct{}) {
+	select {
+	case <-c1:
+	case <-c2:
+	}
+	ctx.Close()
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zmq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Frame flags, from ZMTP 3.0 (RFC 23).
+const (
+	flagMore    = 0x01
+	flagLong    = 0x02
+	flagCommand = 0x04
+)
+
+// Errors for peers that do not speak ZMTP as we do.
+var (
+	errBadGreeting = errors.New("zmq: bad greeting")
+	errBadVersion  = errors.New("zmq: peer ZMTP version too old")
+	errBadMech     = errors.New("zmq: peer security mechanism unsupported")
+	errBadPeer     = errors.New("zmq: peer socket type incompatible")
+	errBadFrame    = errors.New("zmq: bad frame")
+	errTooLong     = errors.New("zmq: message too long")
+)
+
+// peers lists the socket types each may talk to.
+var peers = map[string][]string{
+	"PUB": {"SUB", "XSUB"},
+	"SUB": {"PUB", "XPUB"},
+	"REQ": {"REP", "ROUTER"},
+	"REP": {"REQ", "DEALER"},
+}
+
+// conn is a ZMTP 3.0 connection, using the NULL mechanism.
+type conn struct {
+	c        net.Conn
+	r        *bufio.Reader
+	wlock    sync.Mutex
+	maxSize  int
+	peerType string
+}
+
+// handshake exchanges greetings and READY commands with the peer, as
+// a socket of the type given.
+func handshake(c net.Conn, self string, maxSize int) (*conn, error) {
+	zc := &conn{c: c, r: bufio.NewReader(c), maxSize: maxSize}
+	if err := c.SetDeadline(time.Now().Add(HandshakeTime)); err != nil {
+		return nil, err
+	}
+
+	var g [64]byte
+	g[0] = 0xff
+	g[9] = 0x7f
+	g[10] = 3 // version 3.0
+	copy(g[12:32], "NULL")
+	if _, err := c.Write(g[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(zc.r, g[:]); err != nil {
+		return nil, err
+	}
+	if g[0] != 0xff || g[9]&1 != 1 {
+		return nil, errBadGreeting
+	}
+	if g[10] < 3 {
+		return nil, errBadVersion
+	}
+	if string(bytes.TrimRight(g[12:32], "\x00")) != "NULL" {
+		return nil, errBadMech
+	}
+
+	props := property("Socket-Type", self)
+	if self == "REQ" {
+		props = append(props, property("Identity", "")...)
+	}
+	if err := zc.writeFrame(flagCommand, command("READY", props)); err != nil {
+		return nil, err
+	}
+	flags, body, err := zc.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	name, peerProps, ok := parseCommand(body)
+	if flags&flagCommand == 0 || !ok || name != "READY" {
+		return nil, errBadGreeting
+	}
+	zc.peerType = peerProps["Socket-Type"]
+	compatible := false
+	for _, t := range peers[self] {
+		if zc.peerType == t {
+			compatible = true
+		}
+	}
+	if !compatible {
+		return nil, errBadPeer
+	}
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return zc, nil
+}
+
+// command returns the body of a command frame.
+func command(name string, data []byte) []byte {
+	b := append([]byte{byte(len(name))}, name...)
+	return append(b, data...)
+}
+
+// property returns a property of a READY command.
+func property(name string, value string) []byte {
+	b := append([]byte{byte(len(name))}, name...)
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(value)))
+	b = append(b, l[:]...)
+	return append(b, value...)
+}
+
+// parseCommand returns the name of a command, and its properties if
+// it is a READY command.
+func parseCommand(b []byte) (string, map[string]string, bool) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, false
+	}
+	name := string(b[1 : 1+b[0]])
+	b = b[1+b[0]:]
+	props := make(map[string]string)
+	if name != "READY" {
+		return name, props, true
+	}
+	for len(b) > 0 {
+		n := int(b[0])
+		if len(b) < 1+n+4 {
+			return "", nil, false
+		}
+		key := string(b[1 : 1+n])
+		b = b[1+n:]
+		v := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint64(v) > uint64(len(b)) {
+			return "", nil, false
+		}
+		props[key] = string(b[:v])
+		b = b[v:]
+	}
+	return name, props, true
+}
+
+func (zc *conn) readFrame() (byte, []byte, error) {
+	flags, err := zc.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if flags&^(flagMore|flagLong|flagCommand) != 0 {
+		return 0, nil, errBadFrame
+	}
+	var size uint64
+	if flags&flagLong != 0 {
+		var l [8]byte
+		if _, err = io.ReadFull(zc.r, l[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(l[:])
+	} else {
+		b, err := zc.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(b)
+	}
+	if zc.maxSize > 0 && size > uint64(zc.maxSize) {
+		return 0, nil, errTooLong
+	}
+	body := make([]byte, size)
+	if _, err = io.ReadFull(zc.r, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+func (zc *conn) writeFrame(flags byte, body []byte) error {
+	zc.wlock.Lock()
+	defer zc.wlock.Unlock()
+	return zc.writeFrameLocked(flags, body)
+}
+
+func (zc *conn) writeFrameLocked(flags byte, body []byte) error {
+	var hdr []byte
+	if len(body) > 255 {
+		hdr = make([]byte, 9)
+		hdr[0] = flags | flagLong
+		binary.BigEndian.PutUint64(hdr[1:], uint64(len(body)))
+	} else {
+		hdr = []byte{flags, byte(len(body))}
+	}
+	_, err := (&net.Buffers{hdr, body}).WriteTo(zc.c)
+	return err
+}
+
+// readMsg returns the frames of the next message.  Commands are dealt
+// with as they come, except that the SUBSCRIBE and CANCEL commands of
+// ZMTP 3.1 are returned as the messages ZMTP 3.0 uses for them.
+func (zc *conn) readMsg() ([][]byte, error) {
+	var frames [][]byte
+	size := 0
+	for {
+		flags, body, err := zc.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&flagCommand != 0 {
+			name, _, ok := parseCommand(body)
+			if !ok {
+				return nil, errBadFrame
+			}
+			arg := body[1+len(name):]
+			switch name {
+			case "SUBSCRIBE":
+				return [][]byte{append([]byte{1}, arg...)}, nil
+			case "CANCEL":
+				return [][]byte{append([]byte{0}, arg...)}, nil
+			case "PING":
+				// The context follows the TTL, and is echoed.
+				if len(arg) >= 2 {
+					arg = arg[2:]
+				}
+				if err = zc.writeFrame(flagCommand, command("PONG", arg)); err != nil {
+					return nil, err
+				}
+			case "ERROR":
+				return nil, errors.New("zmq: peer error: " + string(arg))
+			}
+			continue
+		}
+		size += len(body)
+		if zc.maxSize > 0 && size > zc.maxSize {
+			return nil, errTooLong
+		}
+		frames = append(frames, body)
+		if flags&flagMore == 0 {
+			return frames, nil
+		}
+	}
+}
+
+// writeMsg sends the frames as one message.
+func (zc *conn) writeMsg(frames ...[]byte) error {
+	zc.wlock.Lock()
+	defer zc.wlock.Unlock()
+	for i, f := range frames {
+		var flags byte
+		if i < len(frames)-1 {
+			flags = flagMore
+		}
+		if err := zc.writeFrameLocked(flags, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (zc *conn) Close() error {
+	return zc.c.Close()
+}
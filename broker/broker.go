@@ -0,0 +1,270 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package broker runs a set of devices, described in a configuration
+// file, as a central point for the peers of each to meet, with an HTTP
+// endpoint for watching them.  The spbroker command runs one.  A
+// description looks like this:
+//
+//	admin: 127.0.0.1:6680
+//	devices:
+//	  - name: rpc
+//	    kind: req-rep
+//	    front: { listen: [ "tcp://*:6601" ] }
+//	    back: { listen: [ "tcp://*:6602" ] }
+//	  - name: events
+//	    kind: pub-sub
+//	    front: { listen: [ "tcp://*:6611" ] }
+//	    back: { listen: [ "tcp://*:6612" ], options: { WRITEQ-LEN: 1024 } }
+//	  - name: chat
+//	    kind: bus
+//	    front: { listen: [ "tcp://*:6621" ] }
+//
+// The front of each device faces the peers that start things (REQ,
+// publishers, PUSH and surveyors), and the back those that answer or
+// take them.  The kinds are req-rep, pub-sub, push-pull,
+// surveyor-respondent, pair and bus.  A bus device with nothing for its
+// back is a hub, passing what each peer of its front sends to all the
+// others; with a back, it joins two bus segments.  A pub-sub device
+// subscribes upstream only to what its subscribers want, as
+// mangos.PubSubDevice does.  The front and back are described as for the
+// config package, except that the name, protocol and raw mode are set by
+// the broker.
+//
+// The admin endpoint serves the statistics of every socket as JSON at
+// /stats, the same for Prometheus at /metrics, and a simple check that
+// the broker is up at /healthz.
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.yaml.in/yaml/v3"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/config"
+	"nanomsg.org/go/mangos/v2/metrics"
+)
+
+// Config describes a broker.
+type Config struct {
+	// Admin is the address (host:port) for the admin endpoint.  If it
+	// is empty, there is none.
+	Admin string `yaml:"admin"`
+
+	// Devices are the devices to run.
+	Devices []DeviceSpec `yaml:"devices"`
+}
+
+// DeviceSpec describes a device.
+type DeviceSpec struct {
+	Name  string            `yaml:"name"`
+	Kind  string            `yaml:"kind"`
+	Front config.SocketSpec `yaml:"front"`
+	Back  config.SocketSpec `yaml:"back"`
+}
+
+// kinds gives the protocols of the front and back sockets of each kind of
+// device, and whether they are raw.
+var kinds = map[string]struct {
+	front, back string
+	raw         bool
+}{
+	"req-rep":             {"rep", "req", true},
+	"pub-sub":             {"sub", "pub", false},
+	"push-pull":           {"pull", "push", true},
+	"surveyor-respondent": {"respondent", "surveyor", true},
+	"pair":                {"pair", "pair", true},
+	"bus":                 {"bus", "bus", true},
+}
+
+// Parse reads the description of a broker, in YAML or JSON.
+func Parse(data []byte) (*Config, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	cfg := &Config{}
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Load reads the description of a broker from a file.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Broker runs the devices of a Config.
+type Broker struct {
+	sync.Mutex
+	socks  map[string]mangos.Socket // by device, then ".front" or ".back"
+	names  []string                 // of the devices, in order
+	reg    *prometheus.Registry
+	mux    *http.ServeMux
+	ln     net.Listener
+	srv    *http.Server
+	closed bool
+}
+
+// Start builds the sockets of the devices, and starts them, and the
+// admin endpoint.  If anything fails, nothing is left running.  Errors
+// concerning a socket are config.Errors, naming it as the device's name
+// followed by ".front" or ".back".
+func Start(cfg *Config) (*Broker, error) {
+	topo := &config.Topology{}
+	for _, d := range cfg.Devices {
+		k, ok := kinds[d.Kind]
+		if !ok || d.Name == "" {
+			return nil, &config.Error{Socket: d.Name + ".front",
+				Err: errors.New("unknown kind of device " + d.Kind)}
+		}
+		front := d.Front
+		front.Name, front.Protocol, front.Raw = d.Name+".front", k.front, k.raw
+		topo.Sockets = append(topo.Sockets, front)
+		if d.Kind == "bus" && len(d.Back.Listen) == 0 && len(d.Back.Dial) == 0 {
+			continue // a hub
+		}
+		back := d.Back
+		back.Name, back.Protocol, back.Raw = d.Name+".back", k.back, k.raw
+		topo.Sockets = append(topo.Sockets, back)
+	}
+	socks, err := topo.Build()
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		socks: socks,
+		reg:   prometheus.NewRegistry(),
+		mux:   http.NewServeMux(),
+	}
+	for _, d := range cfg.Devices {
+		front, back := socks[d.Name+".front"], socks[d.Name+".back"]
+		if d.Kind == "pub-sub" {
+			err = mangos.PubSubDevice(front, back)
+		} else {
+			err = mangos.Device(front, back)
+		}
+		if err != nil {
+			b.Close()
+			return nil, &config.Error{Socket: d.Name + ".front", Err: err}
+		}
+		b.names = append(b.names, d.Name)
+	}
+	for name, s := range socks {
+		if err = b.reg.Register(metrics.NewCollector(s, name)); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	b.mux.HandleFunc("/stats", b.serveStats)
+	b.mux.HandleFunc("/healthz", b.serveHealth)
+	b.mux.Handle("/metrics", promhttp.HandlerFor(b.reg, promhttp.HandlerOpts{}))
+	if cfg.Admin != "" {
+		if b.ln, err = net.Listen("tcp", cfg.Admin); err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.srv = &http.Server{Handler: b}
+		go b.srv.Serve(b.ln)
+	}
+	return b, nil
+}
+
+// Devices returns the names of the devices, in the order they were
+// described.
+func (b *Broker) Devices() []string {
+	return append([]string{}, b.names...)
+}
+
+// Socket returns the front or back socket of a device, so that it may be
+// watched or tuned, or nil if there is no such socket.
+func (b *Broker) Socket(device string, back bool) mangos.Socket {
+	if back {
+		return b.socks[device+".back"]
+	}
+	return b.socks[device+".front"]
+}
+
+// Stats returns the statistics of every socket, keyed by the device's
+// name followed by ".front" or ".back".
+func (b *Broker) Stats() map[string]mangos.Stats {
+	stats := make(map[string]mangos.Stats, len(b.socks))
+	for name, s := range b.socks {
+		stats[name] = s.Stats()
+	}
+	return stats
+}
+
+// AdminAddr returns the address the admin endpoint is listening on, or
+// nil if there is none.
+func (b *Broker) AdminAddr() net.Addr {
+	if b.ln == nil {
+		return nil
+	}
+	return b.ln.Addr()
+}
+
+// ServeHTTP serves the admin endpoint, so that it may be mounted in
+// another server instead.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mux.ServeHTTP(w, r)
+}
+
+func (b *Broker) serveStats(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(b.Stats())
+}
+
+func (b *Broker) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	b.Lock()
+	closed := b.closed
+	b.Unlock()
+	if closed {
+		http.Error(w, "closed", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Close stops the devices and the admin endpoint, closing every socket.
+func (b *Broker) Close() error {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return mangos.ErrClosed
+	}
+	b.closed = true
+	b.Unlock()
+	if b.srv != nil {
+		b.srv.Close()
+	}
+	for _, s := range b.socks {
+		s.Close()
+	}
+	return nil
+}
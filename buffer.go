@@ -0,0 +1,135 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BufferAccount counts the bytes held by messages in a socket's queues,
+// for OptionMaxBufferBytes.  A message charged to an account is credited
+// back when it is freed, or when Uncharge is called, as it is when the
+// message is handed to the application.  Sockets keep their own
+// accounts; applications have no need of these.
+type BufferAccount struct {
+	used    int64 // first, for alignment; both atomic
+	max     int64
+	waiting bool
+	roomq   chan struct{}
+	sync.Mutex
+}
+
+// NewBufferAccount returns an account with no limit.
+func NewBufferAccount() *BufferAccount {
+	return &BufferAccount{roomq: make(chan struct{})}
+}
+
+// SetLimit sets the number of bytes beyond which Wait waits, or none
+// if it is zero.
+func (a *BufferAccount) SetLimit(max int) {
+	a.Lock()
+	atomic.StoreInt64(&a.max, int64(max))
+	a.wake()
+	a.Unlock()
+}
+
+// Limit returns the limit set by SetLimit.
+func (a *BufferAccount) Limit() int {
+	return int(atomic.LoadInt64(&a.max))
+}
+
+// Used returns the number of bytes charged to the account.
+func (a *BufferAccount) Used() int64 {
+	return atomic.LoadInt64(&a.used)
+}
+
+// Full reports whether the account has reached its limit.
+func (a *BufferAccount) Full() bool {
+	max := atomic.LoadInt64(&a.max)
+	return max > 0 && atomic.LoadInt64(&a.used) >= max
+}
+
+// Wait waits until the account is below its limit.  It fails with
+// ErrClosed if closeq is closed first, or ErrSendTimeout if tq fires.
+func (a *BufferAccount) Wait(closeq <-chan struct{}, tq <-chan time.Time) error {
+	for {
+		a.Lock()
+		if !a.Full() {
+			a.Unlock()
+			return nil
+		}
+		a.waiting = true
+		roomq := a.roomq
+		a.Unlock()
+		select {
+		case <-roomq:
+		case <-closeq:
+			return ErrClosed
+		case <-tq:
+			return ErrSendTimeout
+		}
+	}
+}
+
+// credit returns n bytes to the account.
+func (a *BufferAccount) credit(n int64) {
+	if atomic.AddInt64(&a.used, -n) >= atomic.LoadInt64(&a.max) {
+		return
+	}
+	a.Lock()
+	a.wake()
+	a.Unlock()
+}
+
+// wake releases any waiters.  The caller must hold the lock.
+func (a *BufferAccount) wake() {
+	if a.waiting {
+		close(a.roomq)
+		a.roomq = make(chan struct{})
+		a.waiting = false
+	}
+}
+
+// Charge counts the message against the account, until it is freed or
+// uncharged.  A message is charged to at most one account; charging it
+// again first credits the one it was charged to.
+func (m *Message) Charge(a *BufferAccount) {
+	m.Uncharge()
+	m.charged = int64(len(m.Header) + m.BodyLen())
+	m.acct = a
+	atomic.AddInt64(&a.used, m.charged)
+}
+
+// Uncharge credits the account the message was charged to, if any,
+// and calls the function set by SetRelease.
+func (m *Message) Uncharge() {
+	if a := m.acct; a != nil {
+		m.acct = nil
+		a.credit(m.charged)
+	}
+	if fn := m.release; fn != nil {
+		m.release = nil
+		fn()
+	}
+}
+
+// SetRelease sets a function to be called once the message leaves the
+// socket's queues, when it is uncharged or freed, as for Charge.  It is
+// for pipes granting their peers credit (see OptionCreditWindow).
+func (m *Message) SetRelease(fn func()) {
+	m.release = fn
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capture records the frames a socket sends and receives, for
+// diagnosing protocol problems after the fact.  A Text writes a
+// readable dump, and a Pcapng writes a pcapng file, which can be read
+// back with ReadPcapng or looked at in Wireshark, and attached to a bug
+// report.  Either is given to a socket with OptionCapture:
+//
+//	f, _ := os.Create("sock.pcapng")
+//	c, _ := capture.NewPcapng(f)
+//	sock.SetOption(mangos.OptionCapture, c)
+//
+// Capturing copies every frame, and so is not for general use.
+package capture
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Text is a Capturer writing each frame as a line giving the time, the
+// pipe, the direction and the sizes, followed by a hex dump of the
+// header and the body.  The format is meant to be read, not parsed.
+type Text struct {
+	sync.Mutex
+	w   io.Writer
+	max int
+	err error
+}
+
+// NewText returns a Text writing to w.
+func NewText(w io.Writer) *Text {
+	return &Text{w: w}
+}
+
+// Limit sets the number of bytes of each body dumped, with zero (the
+// default) meaning all of it.  The sizes are always given in full.
+func (t *Text) Limit(n int) {
+	t.Lock()
+	t.max = n
+	t.Unlock()
+}
+
+// Capture writes the frame.
+func (t *Text) Capture(f *mangos.Frame) {
+	dir := "<"
+	if f.Sent {
+		dir = ">"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s pipe %d %s %s header %d body %d\n",
+		f.Time.Format("15:04:05.000000"), f.Pipe, dir, f.Address,
+		len(f.Header), len(f.Body))
+
+	t.Lock()
+	defer t.Unlock()
+	if len(f.Header) > 0 {
+		sb.WriteString("  header " + hex.EncodeToString(f.Header) + "\n")
+	}
+	body := f.Body
+	if t.max > 0 && len(body) > t.max {
+		body = body[:t.max]
+	}
+	if len(body) > 0 {
+		for _, line := range strings.SplitAfter(hex.Dump(body), "\n") {
+			if line != "" {
+				sb.WriteString("  " + line)
+			}
+		}
+	}
+	if t.err == nil {
+		_, t.err = io.WriteString(t.w, sb.String())
+	}
+}
+
+// Err returns the first error writing, if there was one.  Nothing more
+// is written after an error.
+func (t *Text) Err() error {
+	t.Lock()
+	defer t.Unlock()
+	return t.err
+}
@@ -0,0 +1,323 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// LinkType is the pcapng link type of the frames, LINKTYPE_USER0, which
+// is set aside for private use.  Wireshark can be told how to dissect
+// it, in its DLT_USER preferences.
+//
+// The packet data of each frame is a 12 byte pseudo-header, followed by
+// the SP header and the body.  The pseudo-header is a version byte
+// (one), a flags byte (with bit 0 set for frames sent), two reserved
+// bytes, and the pipe ID and the length of the SP header, as 32 bit
+// big-endian numbers.  The direction is also in the epb_flags option,
+// and the pipe's address in the comment.
+const LinkType = 147
+
+// ErrFormat is returned by ReadPcapng for data that is not a pcapng
+// file, or is one that is damaged.
+var ErrFormat = errors.New("capture: bad pcapng data")
+
+const (
+	blockSection   = 0x0a0d0d0a
+	blockInterface = 1
+	blockEnhanced  = 6
+	byteOrderMagic = 0x1a2b3c4d
+
+	optEnd     = 0
+	optComment = 1
+	optFlags   = 2 // epb_flags
+	optTSResol = 9 // if_tsresol
+
+	flagInbound  = 1
+	flagOutbound = 2
+
+	pseudoLen     = 12
+	pseudoVersion = 1
+	pseudoSent    = 1
+)
+
+// Pcapng is a Capturer writing a pcapng file.  All frames are recorded
+// on one interface, of type LinkType, with timestamps in nanoseconds.
+type Pcapng struct {
+	sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewPcapng returns a Pcapng writing to w, having written the file's
+// section and interface headers.
+func NewPcapng(w io.Writer) (*Pcapng, error) {
+	p := &Pcapng{w: w}
+
+	var shb []byte
+	shb = le.AppendUint32(shb, byteOrderMagic)
+	shb = le.AppendUint16(shb, 1) // major version
+	shb = le.AppendUint16(shb, 0) // minor version
+	shb = le.AppendUint64(shb, math.MaxUint64)
+	if err := p.block(blockSection, shb); err != nil {
+		return nil, err
+	}
+
+	var idb []byte
+	idb = le.AppendUint16(idb, LinkType)
+	idb = le.AppendUint16(idb, 0)
+	idb = le.AppendUint32(idb, 0) // no snapshot length limit
+	idb = option(idb, optTSResol, []byte{9})
+	idb = option(idb, optEnd, nil)
+	if err := p.block(blockInterface, idb); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+var le = binary.LittleEndian
+
+// pad rounds n up to a multiple of four, as pcapng needs.
+func pad(n int) int {
+	return (n + 3) &^ 3
+}
+
+func option(b []byte, code uint16, val []byte) []byte {
+	b = le.AppendUint16(b, code)
+	b = le.AppendUint16(b, uint16(len(val)))
+	b = append(b, val...)
+	return append(b, make([]byte, pad(len(val))-len(val))...)
+}
+
+// block writes a block, with the body given, which must be padded.
+func (p *Pcapng) block(kind uint32, body []byte) error {
+	size := uint32(len(body) + 12)
+	b := make([]byte, 0, size)
+	b = le.AppendUint32(b, kind)
+	b = le.AppendUint32(b, size)
+	b = append(b, body...)
+	b = le.AppendUint32(b, size)
+	_, err := p.w.Write(b)
+	return err
+}
+
+// Capture writes the frame as an enhanced packet block.
+func (p *Pcapng) Capture(f *mangos.Frame) {
+	data := make([]byte, pseudoLen, pseudoLen+len(f.Header)+len(f.Body))
+	data[0] = pseudoVersion
+	flags := uint32(flagInbound)
+	if f.Sent {
+		data[1] = pseudoSent
+		flags = flagOutbound
+	}
+	binary.BigEndian.PutUint32(data[4:], f.Pipe)
+	binary.BigEndian.PutUint32(data[8:], uint32(len(f.Header)))
+	data = append(data, f.Header...)
+	data = append(data, f.Body...)
+
+	ts := uint64(f.Time.UnixNano())
+	epb := make([]byte, 0, 20+pad(len(data))+len(f.Address)+24)
+	epb = le.AppendUint32(epb, 0) // interface
+	epb = le.AppendUint32(epb, uint32(ts>>32))
+	epb = le.AppendUint32(epb, uint32(ts))
+	epb = le.AppendUint32(epb, uint32(len(data)))
+	epb = le.AppendUint32(epb, uint32(len(data)))
+	epb = append(epb, data...)
+	epb = append(epb, make([]byte, pad(len(data))-len(data))...)
+	if f.Address != "" {
+		epb = option(epb, optComment, []byte(f.Address))
+	}
+	epb = option(epb, optFlags, le.AppendUint32(nil, flags))
+	epb = option(epb, optEnd, nil)
+
+	p.Lock()
+	defer p.Unlock()
+	if p.err == nil {
+		p.err = p.block(blockEnhanced, epb)
+	}
+}
+
+// Err returns the first error writing, if there was one.  Nothing more
+// is written after an error.
+func (p *Pcapng) Err() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
+
+// iface is what ReadPcapng keeps of an interface description.
+type iface struct {
+	ours bool          // of LinkType
+	unit time.Duration // timestamp resolution, if at least 1ns
+	div  uint64        // otherwise, ticks per nanosecond
+}
+
+// ReadPcapng reads the frames from a pcapng file, such as one written
+// by a Pcapng.  Packets on interfaces of a type other than LinkType,
+// and blocks of other kinds, are skipped.
+func ReadPcapng(r io.Reader) ([]mangos.Frame, error) {
+	var frames []mangos.Frame
+	var order binary.ByteOrder
+	var ifaces []iface
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err == io.EOF {
+			if order == nil {
+				return nil, ErrFormat
+			}
+			return frames, nil
+		} else if err != nil {
+			return nil, ErrFormat
+		}
+		if binary.LittleEndian.Uint32(hdr) == blockSection {
+			// The byte order can change with every section.
+			var magic [4]byte
+			if _, err := io.ReadFull(r, magic[:]); err != nil {
+				return nil, ErrFormat
+			}
+			switch {
+			case binary.LittleEndian.Uint32(magic[:]) == byteOrderMagic:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic[:]) == byteOrderMagic:
+				order = binary.BigEndian
+			default:
+				return nil, ErrFormat
+			}
+			ifaces = nil
+			size := order.Uint32(hdr[4:])
+			if size < 16 || size%4 != 0 {
+				return nil, ErrFormat
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(size-12)); err != nil {
+				return nil, ErrFormat
+			}
+			continue
+		}
+		if order == nil {
+			return nil, ErrFormat
+		}
+		kind, size := order.Uint32(hdr), order.Uint32(hdr[4:])
+		if size < 12 || size%4 != 0 || size > 1<<30 {
+			return nil, ErrFormat
+		}
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, ErrFormat
+		}
+		body = body[:len(body)-4]
+
+		switch kind {
+		case blockInterface:
+			if len(body) < 8 {
+				return nil, ErrFormat
+			}
+			ifc := iface{
+				ours: order.Uint16(body) == LinkType,
+				unit: time.Microsecond,
+			}
+			opts, err := options(order, body[8:])
+			if err != nil {
+				return nil, err
+			}
+			if v := opts[optTSResol]; len(v) == 1 {
+				ifc.unit, ifc.div = resolution(v[0])
+			}
+			ifaces = append(ifaces, ifc)
+
+		case blockEnhanced:
+			if len(body) < 20 {
+				return nil, ErrFormat
+			}
+			id := order.Uint32(body)
+			if int(id) >= len(ifaces) {
+				return nil, ErrFormat
+			}
+			if !ifaces[id].ours {
+				continue
+			}
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			n := int(order.Uint32(body[12:]))
+			if n > len(body)-20 || n < pseudoLen {
+				return nil, ErrFormat
+			}
+			data := body[20 : 20+n]
+			opts, err := options(order, body[20+pad(n):])
+			if err != nil {
+				return nil, err
+			}
+			hl := int(binary.BigEndian.Uint32(data[8:]))
+			if data[0] != pseudoVersion || hl > n-pseudoLen {
+				return nil, ErrFormat
+			}
+			var ns int64
+			if ifc := ifaces[id]; ifc.div != 0 {
+				ns = int64(ts / ifc.div)
+			} else {
+				ns = int64(ts) * int64(ifc.unit)
+			}
+			f := mangos.Frame{
+				Time:    time.Unix(0, ns),
+				Pipe:    binary.BigEndian.Uint32(data[4:]),
+				Address: string(opts[optComment]),
+				Sent:    data[1]&pseudoSent != 0,
+			}
+			data = data[pseudoLen:]
+			f.Header, f.Body = data[:hl:hl], data[hl:]
+			frames = append(frames, f)
+		}
+	}
+}
+
+// resolution decodes if_tsresol, as either the length of a tick, or
+// the number of ticks in a nanosecond.
+func resolution(v byte) (time.Duration, uint64) {
+	var ticks float64
+	if v&0x80 != 0 {
+		ticks = math.Pow(2, float64(v&0x7f))
+	} else {
+		ticks = math.Pow(10, float64(v))
+	}
+	if ticks <= 1e9 {
+		return time.Duration(1e9 / ticks), 0
+	}
+	return 0, uint64(ticks / 1e9)
+}
+
+// options decodes the options of a block, keeping the first of each.
+func options(order binary.ByteOrder, b []byte) (map[uint16][]byte, error) {
+	opts := make(map[uint16][]byte)
+	for len(b) >= 4 {
+		code, n := order.Uint16(b), int(order.Uint16(b[2:]))
+		b = b[4:]
+		if code == optEnd {
+			break
+		}
+		if pad(n) > len(b) {
+			return nil, ErrFormat
+		}
+		if _, ok := opts[code]; !ok {
+			opts[code] = b[:n:n]
+		}
+		b = b[pad(n):]
+	}
+	return opts, nil
+}
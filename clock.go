@@ -0,0 +1,62 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"time"
+)
+
+// Clock is the source of time for the timers that mangos runs on its
+// own: REQ resends and deadlines, SURVEYOR deadlines, dialer reconnect
+// backoff, and heartbeats.  It is set with OptionClock, so that tests
+// can supply one that they advance themselves, rather than sleeping.
+// The clock package has such a Clock.  Clocks must be safe to use from
+// many goroutines at once.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that is sent the time, once d has passed.
+	After(d time.Duration) <-chan time.Time
+
+	// AfterFunc calls f on its own goroutine once d has passed, unless
+	// the Timer returned is stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is returned by Clock.AfterFunc.  Stop returns false if the
+// function has already been called, or the Timer already stopped.  A
+// *time.Timer is a Timer.
+type Timer interface {
+	Stop() bool
+}
+
+// SystemClock is the Clock used unless another is set, and follows the
+// time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
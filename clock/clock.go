@@ -0,0 +1,157 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clock has a virtual mangos.Clock, for tests of timing (such
+// as REQ resends, survey deadlines, reconnect backoff and heartbeats)
+// that should run without sleeping.  Give one to a socket with
+// mangos.OptionClock, and step it forward with Advance:
+//
+//	vc := clock.NewVirtual(time.Time{})
+//	sock.SetOption(mangos.OptionClock, vc)
+//	...
+//	vc.WaitTimers(1)            // the resend timer is set
+//	vc.Advance(time.Minute)     // and the request goes again
+//
+// Only the timers that mangos runs itself follow the clock; see
+// mangos.OptionClock.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Virtual is a mangos.Clock whose time stands still, except when
+// Advance is called.  It is safe to use from many goroutines.
+type Virtual struct {
+	sync.Mutex
+	now    time.Time
+	timers []*timer // in order of when they are due
+	cv     *sync.Cond
+}
+
+type timer struct {
+	v    *Virtual
+	when time.Time
+	f    func() // called when due, on its own goroutine
+	c    chan time.Time
+}
+
+// NewVirtual returns a Virtual clock reading start.
+func NewVirtual(start time.Time) *Virtual {
+	v := &Virtual{now: start}
+	v.cv = sync.NewCond(v)
+	return v
+}
+
+// Now implements mangos.Clock.
+func (v *Virtual) Now() time.Time {
+	v.Lock()
+	defer v.Unlock()
+	return v.now
+}
+
+// After implements mangos.Clock.
+func (v *Virtual) After(d time.Duration) <-chan time.Time {
+	t := &timer{v: v, c: make(chan time.Time, 1)}
+	v.start(t, d)
+	return t.c
+}
+
+// AfterFunc implements mangos.Clock.
+func (v *Virtual) AfterFunc(d time.Duration, f func()) mangos.Timer {
+	t := &timer{v: v, f: f}
+	v.start(t, d)
+	return t
+}
+
+func (v *Virtual) start(t *timer, d time.Duration) {
+	v.Lock()
+	defer v.Unlock()
+	t.when = v.now.Add(d)
+	if d <= 0 {
+		t.fire(v.now)
+		return
+	}
+	i := sort.Search(len(v.timers), func(i int) bool {
+		return v.timers[i].when.After(t.when)
+	})
+	v.timers = append(v.timers, nil)
+	copy(v.timers[i+1:], v.timers[i:])
+	v.timers[i] = t
+	v.cv.Broadcast()
+}
+
+// Stop implements mangos.Timer.
+func (t *timer) Stop() bool {
+	v := t.v
+	v.Lock()
+	defer v.Unlock()
+	for i, x := range v.timers {
+		if x == t {
+			v.timers = append(v.timers[:i], v.timers[i+1:]...)
+			v.cv.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+func (t *timer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+	} else {
+		t.c <- now
+	}
+}
+
+// Advance moves the clock forward by d, firing the timers that come due
+// on the way, in order, each with the clock reading the time it was due.
+// Functions given to AfterFunc run on their own goroutines, as with
+// time.AfterFunc, so timers that they set are not fired by this call,
+// even if due.
+func (v *Virtual) Advance(d time.Duration) {
+	v.Lock()
+	defer v.Unlock()
+	end := v.now.Add(d)
+	for len(v.timers) > 0 && !v.timers[0].when.After(end) {
+		t := v.timers[0]
+		v.timers = v.timers[1:]
+		v.now = t.when
+		t.fire(t.when)
+	}
+	v.now = end
+	v.cv.Broadcast()
+}
+
+// Timers returns the number of timers waiting to fire.
+func (v *Virtual) Timers() int {
+	v.Lock()
+	defer v.Unlock()
+	return len(v.timers)
+}
+
+// WaitTimers waits until at least n timers are waiting to fire.  Tests
+// use it to be sure that the code under test has set the timer that
+// they mean to fire, before calling Advance.
+func (v *Virtual) WaitTimers(n int) {
+	v.Lock()
+	defer v.Unlock()
+	for len(v.timers) < n {
+		v.cv.Wait()
+	}
+}
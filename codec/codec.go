@@ -0,0 +1,188 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package codec sends and receives values, encoded as JSON, gob or
+// protocol buffers, as the bodies of messages.  Values are encoded
+// straight into the body of a Message from the pool, and decoded from
+// the body of the message received, which is then freed, so there is
+// no []byte to copy in either direction:
+//
+//	err := codec.SendJSON(sock, &Order{ID: 7})
+//
+//	var o Order
+//	err := codec.RecvJSON(sock, &o)
+//
+// Sockets and Contexts may both be used.  For other encodings, Send and
+// Recv take a Codec.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"google.golang.org/protobuf/proto"
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Sender is what Send sends with, a Socket or a Context.
+type Sender interface {
+	SendMsg(*mangos.Message) error
+}
+
+// Receiver is what Recv receives from, a Socket or a Context.
+type Receiver interface {
+	RecvMsg() (*mangos.Message, error)
+}
+
+// Codec encodes values into message bodies, and decodes them again.
+type Codec interface {
+	// Encode appends the encoding of v to the body of m.
+	Encode(m *mangos.Message, v interface{}) error
+
+	// Decode decodes the body of m into v, which must be a pointer
+	// (or, for protocol buffers, a proto.Message).
+	Decode(m *mangos.Message, v interface{}) error
+}
+
+// These are the Codecs provided.
+var (
+	// JSON encodes values as with json.Marshal.
+	JSON Codec = jsonCodec{}
+
+	// Gob encodes values with encoding/gob.  Each message carries the
+	// description of its type, so that it can be decoded on its own,
+	// which makes gob better suited to large values than small ones.
+	Gob Codec = gobCodec{}
+
+	// Proto encodes values that are a proto.Message, and fails with
+	// ErrBadValue for others.
+	Proto Codec = protoCodec{}
+)
+
+// Send sends v encoded with the codec.
+func Send(s Sender, c Codec, v interface{}) error {
+	m := mangos.NewMessage(0)
+	if err := c.Encode(m, v); err != nil {
+		m.Free()
+		return err
+	}
+	if err := s.SendMsg(m); err != nil {
+		m.Free()
+		return err
+	}
+	return nil
+}
+
+// Recv receives a message, and decodes it into v with the codec.  The
+// message is consumed even if it cannot be decoded.
+func Recv(r Receiver, c Codec, v interface{}) error {
+	m, err := r.RecvMsg()
+	if err != nil {
+		return err
+	}
+	err = c.Decode(m, v)
+	m.Free()
+	return err
+}
+
+// SendJSON sends v encoded as JSON.
+func SendJSON(s Sender, v interface{}) error {
+	return Send(s, JSON, v)
+}
+
+// RecvJSON receives a message, and decodes it as JSON into v.
+func RecvJSON(r Receiver, v interface{}) error {
+	return Recv(r, JSON, v)
+}
+
+// SendGob sends v encoded with encoding/gob.
+func SendGob(s Sender, v interface{}) error {
+	return Send(s, Gob, v)
+}
+
+// RecvGob receives a message, and decodes it with encoding/gob into v.
+func RecvGob(r Receiver, v interface{}) error {
+	return Recv(r, Gob, v)
+}
+
+// SendProto sends a protocol buffer.
+func SendProto(s Sender, v proto.Message) error {
+	return Send(s, Proto, v)
+}
+
+// RecvProto receives a message, and decodes it as a protocol buffer
+// into v.
+func RecvProto(r Receiver, v proto.Message) error {
+	return Recv(r, Proto, v)
+}
+
+// body is an io.Writer appending to the body of a message.
+type body struct {
+	m *mangos.Message
+}
+
+func (b body) Write(p []byte) (int, error) {
+	b.m.Body = append(b.m.Body, p...)
+	return len(p), nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(m *mangos.Message, v interface{}) error {
+	if err := json.NewEncoder(body{m}).Encode(v); err != nil {
+		return err
+	}
+	// The Encoder ends each value with a newline, which Marshal
+	// does not.
+	m.Body = bytes.TrimSuffix(m.Body, []byte{'\n'})
+	return nil
+}
+
+func (jsonCodec) Decode(m *mangos.Message, v interface{}) error {
+	return json.Unmarshal(m.Body, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(m *mangos.Message, v interface{}) error {
+	return gob.NewEncoder(body{m}).Encode(v)
+}
+
+func (gobCodec) Decode(m *mangos.Message, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(m.Body)).Decode(v)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Encode(m *mangos.Message, v interface{}) error {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return mangos.ErrBadValue
+	}
+	b, err := proto.MarshalOptions{}.MarshalAppend(m.Body, pm)
+	if err != nil {
+		return err
+	}
+	m.Body = b
+	return nil
+}
+
+func (protoCodec) Decode(m *mangos.Message, v interface{}) error {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return mangos.ErrBadValue
+	}
+	return proto.Unmarshal(m.Body, pm)
+}
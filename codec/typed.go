@@ -0,0 +1,71 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"reflect"
+)
+
+// Conn is what a Typed sends and receives with, a Socket or a Context.
+type Conn interface {
+	Sender
+	Receiver
+}
+
+// Typed sends and receives values of a single type, for applications
+// exchanging only the one kind of message, so that the compiler checks
+// what is sent, and what is received needs no type assertion:
+//
+//	orders := codec.NewTyped[Order](sock, codec.JSON)
+//	err := orders.Send(Order{ID: 7})
+//	o, err := orders.Recv()
+//
+// With Proto, T is the pointer type of the message, such as *pb.Order.
+type Typed[T any] struct {
+	c     Conn
+	codec Codec
+	ptr   bool
+}
+
+// NewTyped returns a Typed for T, sending and receiving on c, with
+// values encoded by the codec.
+func NewTyped[T any](c Conn, codec Codec) *Typed[T] {
+	return &Typed[T]{
+		c:     c,
+		codec: codec,
+		ptr:   reflect.TypeOf((*T)(nil)).Elem().Kind() == reflect.Ptr,
+	}
+}
+
+// Send sends v.
+func (t *Typed[T]) Send(v T) error {
+	return Send(t.c, t.codec, v)
+}
+
+// Recv receives a value.  If T is a pointer type, it points to a newly
+// made value.
+func (t *Typed[T]) Recv() (T, error) {
+	var v T
+	var into interface{} = &v
+	if t.ptr {
+		v = reflect.New(reflect.TypeOf(v).Elem()).Interface().(T)
+		into = v
+	}
+	if err := Recv(t.c, t.codec, into); err != nil {
+		var zero T
+		return zero, err
+	}
+	return v, nil
+}
@@ -0,0 +1,294 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netshim
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+)
+
+// conn is the net.Conn for one pipe.
+type conn struct {
+	p      protocol.Pipe
+	sock   mangos.Socket // set for a dialed conn, which owns its socket
+	local  net.Addr
+	remote net.Addr
+
+	recvq  chan *protocol.Message
+	sendq  chan *protocol.Message
+	closeq chan struct{}
+	sent   chan struct{} // closed when the sender is done
+	once   sync.Once
+	closed int32 // closed locally, by Close
+
+	rlock sync.Mutex
+	rbuf  []byte
+	rmsg  *protocol.Message
+	wlock sync.Mutex
+
+	rdl deadline
+	wdl deadline
+}
+
+func newConn(pp protocol.Pipe) *conn {
+	c := &conn{
+		p:      pp,
+		recvq:  make(chan *protocol.Message, 16),
+		sendq:  make(chan *protocol.Message),
+		closeq: make(chan struct{}),
+		sent:   make(chan struct{}),
+		rdl:    newDeadline(),
+		wdl:    newDeadline(),
+	}
+	c.local, c.remote = addr(""), addr("")
+	if mp, ok := pp.(mangos.Pipe); ok {
+		c.local, c.remote = addr(mp.Address()), addr(mp.Address())
+		if v, err := mp.GetOption(mangos.OptionLocalAddr); err == nil {
+			if a, ok := v.(net.Addr); ok {
+				c.local = a
+			}
+		}
+		if v, err := mp.GetOption(mangos.OptionRemoteAddr); err == nil {
+			if a, ok := v.(net.Addr); ok {
+				c.remote = a
+			}
+		}
+	}
+	return c
+}
+
+func (c *conn) receiver() {
+	for {
+		m := c.p.RecvMsg()
+		if m == nil {
+			break
+		}
+		select {
+		case c.recvq <- m:
+		case <-c.closeq:
+			m.Free()
+			return
+		}
+	}
+	c.shut()
+}
+
+func (c *conn) sender() {
+	defer close(c.sent)
+	for {
+		select {
+		case m := <-c.sendq:
+			if err := c.p.SendMsg(m); err != nil {
+				m.Free()
+				c.shut()
+				return
+			}
+		case <-c.closeq:
+			return
+		}
+	}
+}
+
+// shut stops the conn, as when the pipe is gone.  What was received
+// may still be read.
+func (c *conn) shut() {
+	c.once.Do(func() { close(c.closeq) })
+}
+
+func (c *conn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	for len(c.rbuf) == 0 {
+		if c.rmsg != nil {
+			c.rmsg.Free()
+			c.rmsg = nil
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+		select {
+		case <-c.rdl.wait():
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
+		var m *protocol.Message
+		select {
+		case m = <-c.recvq:
+		default:
+			select {
+			case m = <-c.recvq:
+			case <-c.rdl.wait():
+				return 0, os.ErrDeadlineExceeded
+			case <-c.closeq:
+				// Anything that arrived before the end is still due.
+				select {
+				case m = <-c.recvq:
+				default:
+					if c.isClosed() {
+						return 0, net.ErrClosed
+					}
+					return 0, io.EOF
+				}
+			}
+		}
+		c.rmsg = m
+		c.rbuf = m.Body
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	sent := 0
+	for len(b) > 0 {
+		if c.isClosed() {
+			return sent, net.ErrClosed
+		}
+		select {
+		case <-c.wdl.wait():
+			return sent, os.ErrDeadlineExceeded
+		default:
+		}
+		n := len(b)
+		if n > MaxChunk {
+			n = MaxChunk
+		}
+		m := mangos.NewMessage(n)
+		m.Body = append(m.Body, b[:n]...)
+		select {
+		case c.sendq <- m:
+		case <-c.wdl.wait():
+			m.Free()
+			return sent, os.ErrDeadlineExceeded
+		case <-c.closeq:
+			m.Free()
+			if c.isClosed() {
+				return sent, net.ErrClosed
+			}
+			return sent, io.ErrClosedPipe
+		}
+		sent += n
+		b = b[n:]
+	}
+	return sent, nil
+}
+
+// Close closes the pipe, once what was written has been sent.
+func (c *conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return net.ErrClosed
+	}
+	c.wlock.Lock()
+	c.shut()
+	c.wlock.Unlock()
+	<-c.sent
+	err := c.p.Close()
+	if c.sock != nil {
+		err = c.sock.Close()
+	}
+	return err
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.rdl.set(t)
+	c.wdl.set(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.rdl.set(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.wdl.set(t)
+	return nil
+}
+
+// deadline is a channel that is closed once a time has passed, and that
+// may be reset, even while Read or Write waits on it.
+type deadline struct {
+	sync.Mutex
+	timer  *time.Timer
+	expire chan struct{}
+}
+
+func newDeadline() deadline {
+	return deadline{expire: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expire // the timer fired, and has closed it, or will
+	}
+	d.timer = nil
+
+	expired := false
+	select {
+	case <-d.expire:
+		expired = true
+	default:
+	}
+	if t.IsZero() {
+		if expired {
+			d.expire = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.expire = make(chan struct{})
+		}
+		expire := d.expire
+		d.timer = time.AfterFunc(dur, func() { close(expire) })
+		return
+	}
+	if !expired {
+		close(d.expire)
+	}
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	return d.expire
+}
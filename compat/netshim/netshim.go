@@ -0,0 +1,211 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netshim presents SP transports through the net.Listener and
+// net.Conn interfaces, so that code written for those, such as an HTTP
+// or gRPC server, can run over ipc, ws, and the other SP transports,
+// for benchmarking and as a step in migrating.
+//
+// Each pipe is a connection of its own, speaking PAIR to its peer, with
+// the bytes written carried as the bodies of messages.  The peer of a
+// Listener is normally a Conn from Dial, but any PAIR socket will do,
+// treating the messages it receives as a byte stream.
+package netshim
+
+import (
+	"net"
+	"sync"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+)
+
+// MaxChunk is the largest number of bytes written in one message.
+var MaxChunk = 64 * 1024
+
+// Listener is a net.Listener whose connections are the pipes of a socket.
+type Listener struct {
+	sock mangos.Socket
+	shim *shim
+	addr string
+}
+
+// Listen returns a Listener on the SP address, such as ipc:///tmp/sock.
+func Listen(addr string) (*Listener, error) {
+	s := newShim(false)
+	sock := protocol.MakeSocket(s)
+	if err := sock.Listen(addr); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return &Listener{sock: sock, shim: s, addr: addr}, nil
+}
+
+// Accept waits for the next pipe, and returns it as a net.Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.shim.acceptq:
+		return c, nil
+	case <-l.shim.closeq:
+		return nil, mangos.ErrClosed
+	}
+}
+
+// Close stops listening, and closes the connections accepted.
+func (l *Listener) Close() error {
+	return l.sock.Close()
+}
+
+// Addr returns the address listened on.
+func (l *Listener) Addr() net.Addr {
+	return addr(l.addr)
+}
+
+// Socket returns the underlying socket, so that options (for example
+// those for TLS) may be set on it.
+func (l *Listener) Socket() mangos.Socket {
+	return l.sock
+}
+
+// Dial connects to the SP address, returning the pipe as a net.Conn.
+// The connection is not remade if lost; the Conn just reads io.EOF.
+func Dial(addr string) (net.Conn, error) {
+	s := newShim(true)
+	sock := protocol.MakeSocket(s)
+	if err := sock.Dial(addr); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	select {
+	case c := <-s.acceptq:
+		c.sock = sock
+		return c, nil
+	default:
+		// The pipe was refused, perhaps by a pipe event hook.
+		sock.Close()
+		return nil, mangos.ErrConnRefused
+	}
+}
+
+// addr is a net.Addr for an SP address that has no better one, such as
+// an ipc path.
+type addr string
+
+func (a addr) Network() string { return "sp" }
+func (a addr) String() string  { return string(a) }
+
+// shim is the protocol beneath the socket, which hands each pipe to
+// Accept instead of sharing messages among them.
+type shim struct {
+	sync.Mutex
+	dialer  bool
+	conns   map[uint32]*conn
+	acceptq chan *conn
+	closeq  chan struct{}
+	closed  bool
+}
+
+func newShim(dialer bool) *shim {
+	return &shim{
+		dialer:  dialer,
+		conns:   make(map[uint32]*conn),
+		acceptq: make(chan *conn, 128),
+		closeq:  make(chan struct{}),
+	}
+}
+
+func (s *shim) AddPipe(pp protocol.Pipe) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return protocol.ErrClosed
+	}
+	if s.dialer && len(s.conns) > 0 {
+		return protocol.ErrProtoState
+	}
+	c := newConn(pp)
+	select {
+	case s.acceptq <- c:
+	default:
+		// Nobody is accepting; turn it away.
+		return protocol.ErrProtoState
+	}
+	s.conns[pp.ID()] = c
+	go c.receiver()
+	go c.sender()
+	return nil
+}
+
+func (s *shim) RemovePipe(pp protocol.Pipe) {
+	s.Lock()
+	c, ok := s.conns[pp.ID()]
+	delete(s.conns, pp.ID())
+	s.Unlock()
+	if ok {
+		c.shut()
+		if c.sock != nil {
+			// A dialed Conn is not redialed.
+			go c.sock.Close()
+		}
+	}
+}
+
+func (s *shim) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return protocol.ErrClosed
+	}
+	s.closed = true
+	conns := s.conns
+	s.conns = nil
+	s.Unlock()
+	close(s.closeq)
+	for _, c := range conns {
+		c.shut()
+	}
+	return nil
+}
+
+func (*shim) SendMsg(*protocol.Message) error {
+	return protocol.ErrProtoOp
+}
+
+func (*shim) RecvMsg() (*protocol.Message, error) {
+	return nil, protocol.ErrProtoOp
+}
+
+func (*shim) OpenContext() (protocol.Context, error) {
+	return nil, protocol.ErrProtoOp
+}
+
+func (*shim) SetOption(string, interface{}) error {
+	return protocol.ErrBadOption
+}
+
+func (*shim) GetOption(name string) (interface{}, error) {
+	if name == protocol.OptionRaw {
+		return true, nil
+	}
+	return nil, protocol.ErrBadOption
+}
+
+func (*shim) Info() protocol.Info {
+	return protocol.Info{
+		Self:     protocol.ProtoPair,
+		Peer:     protocol.ProtoPair,
+		SelfName: "pair",
+		PeerName: "pair",
+	}
+}
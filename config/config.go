@@ -0,0 +1,367 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config builds sockets from a description of them, in YAML or
+// JSON, so that the shape of a system (which sockets there are, what
+// they listen on and dial, and how they are tuned) can be changed
+// without recompiling.  A description looks like this:
+//
+//	sockets:
+//	  - name: jobs
+//	    protocol: push
+//	    options:
+//	      WRITEQ-LEN: 128
+//	      LOAD-BALANCE: least-queued
+//	      SEND-DEADLINE: 5s
+//	    listen: [ "tls+tcp://*:5555" ]
+//	    tls: { cert: server.pem, key: server.key, ca: clients.pem }
+//	  - name: results
+//	    protocol: pull
+//	    dial: [ "tcp://collector:5556" ]
+//
+// Options are named as in the mangos package, by the strings of the
+// Option constants.  Durations are written as strings, such as "250ms",
+// and the values of OptionLoadBalance, OptionQueueFullPolicy and
+// OptionNoRoute by name, such as "least-queued".  A list sets an option
+// once for each element, as for several subscriptions.  All the
+// transports are available.
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+	_ "nanomsg.org/go/mangos/v2/protocol/bus"
+	_ "nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/protocol/pub"
+	_ "nanomsg.org/go/mangos/v2/protocol/pull"
+	_ "nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/protocol/rep"
+	_ "nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/protocol/respondent"
+	_ "nanomsg.org/go/mangos/v2/protocol/star"
+	_ "nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/protocol/surveyor"
+	_ "nanomsg.org/go/mangos/v2/protocol/xbus"
+	_ "nanomsg.org/go/mangos/v2/protocol/xpair"
+	_ "nanomsg.org/go/mangos/v2/protocol/xpub"
+	_ "nanomsg.org/go/mangos/v2/protocol/xpull"
+	_ "nanomsg.org/go/mangos/v2/protocol/xpush"
+	_ "nanomsg.org/go/mangos/v2/protocol/xrep"
+	_ "nanomsg.org/go/mangos/v2/protocol/xreq"
+	_ "nanomsg.org/go/mangos/v2/protocol/xrespondent"
+	_ "nanomsg.org/go/mangos/v2/protocol/xstar"
+	_ "nanomsg.org/go/mangos/v2/protocol/xsub"
+	_ "nanomsg.org/go/mangos/v2/protocol/xsurveyor"
+	_ "nanomsg.org/go/mangos/v2/transport/all"
+)
+
+// Topology describes a set of sockets.
+type Topology struct {
+	Sockets []SocketSpec `yaml:"sockets"`
+}
+
+// SocketSpec describes one socket.
+type SocketSpec struct {
+	// Name identifies the socket among those built.  It is required.
+	Name string `yaml:"name"`
+
+	// Protocol is the name of the protocol, such as "req".  Protocols
+	// registered by the application (see mangos.RegisterProtocol) may
+	// be used as well as the standard ones.
+	Protocol string `yaml:"protocol"`
+
+	// Raw selects the raw mode of the protocol.
+	Raw bool `yaml:"raw"`
+
+	// Options are set on the socket before it listens or dials.
+	Options map[string]interface{} `yaml:"options"`
+
+	// Listen and Dial are the addresses to listen on and to dial.
+	Listen []string `yaml:"listen"`
+	Dial   []string `yaml:"dial"`
+
+	// TLS is used for the addresses of the tls+tcp, wss and quic
+	// transports.
+	TLS *TLSSpec `yaml:"tls"`
+}
+
+// TLSSpec names the files holding TLS certificates and keys.  All of
+// them are in PEM form.
+type TLSSpec struct {
+	// Cert and Key are this end's certificate and private key.  They
+	// are required for listening.  Key defaults to Cert, for a file
+	// holding both.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	// CA holds the certificates of the authorities whose peers are
+	// trusted.  On a listener, it makes peers present certificates.
+	CA string `yaml:"ca"`
+
+	// ServerName is the name expected in the certificate of a server
+	// dialed, if not the host in its address.
+	ServerName string `yaml:"server-name"`
+
+	// Insecure skips checking the certificates of servers dialed.
+	Insecure bool `yaml:"insecure"`
+}
+
+// Error is returned when a socket cannot be built as described.
+type Error struct {
+	Socket string // name of the socket
+	Option string // name of the option, if it was the trouble
+	Addr   string // address, if it was the trouble
+	Err    error
+}
+
+func (e *Error) Error() string {
+	s := "socket " + e.Socket + ": "
+	if e.Option != "" {
+		s += "option " + e.Option + ": "
+	}
+	if e.Addr != "" {
+		s += e.Addr + ": "
+	}
+	return s + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// names gives the values of the options that are set by name.
+var names = map[string]map[string]interface{}{
+	mangos.OptionLoadBalance: {
+		"round-robin":  mangos.LoadBalanceRoundRobin,
+		"least-queued": mangos.LoadBalanceLeastQueued,
+		"weighted":     mangos.LoadBalanceWeighted,
+		"latency":      mangos.LoadBalanceLatency,
+	},
+	mangos.OptionQueueFullPolicy: {
+		"block":       mangos.QueueFullBlock,
+		"drop-newest": mangos.QueueFullDropNewest,
+		"drop-oldest": mangos.QueueFullDropOldest,
+	},
+	mangos.OptionNoRoute: {
+		"drop":        mangos.NoRouteDrop,
+		"dead-letter": mangos.NoRouteDeadLetter,
+		"error":       mangos.NoRouteError,
+	},
+}
+
+// Parse reads a description in YAML, or JSON.  Unknown fields are
+// errors, so that misspellings are not silently ignored.
+func Parse(data []byte) (*Topology, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	t := &Topology{}
+	if err := dec.Decode(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Load reads a description from a file.
+func Load(path string) (*Topology, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Open builds the sockets described in a file.
+func Open(path string) (map[string]mangos.Socket, error) {
+	t, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.Build()
+}
+
+// Build makes the sockets described, keyed by name.  Every socket is
+// made and given its options before any listens, and all listen before
+// any dial, so that sockets in the same description may be connected by
+// inproc.  If anything fails, the sockets made are closed, and an Error
+// is returned.
+func (t *Topology) Build() (map[string]mangos.Socket, error) {
+	socks := make(map[string]mangos.Socket)
+	tlss := make(map[string]*tls.Config)
+	fail := func(name string, err error) (map[string]mangos.Socket, error) {
+		for _, s := range socks {
+			s.Close()
+		}
+		if e, ok := err.(*Error); ok {
+			e.Socket = name
+			return nil, e
+		}
+		return nil, &Error{Socket: name, Err: err}
+	}
+	for _, spec := range t.Sockets {
+		if spec.Name == "" {
+			return fail(spec.Name, mangos.ErrBadValue)
+		}
+		if _, ok := socks[spec.Name]; ok {
+			return fail(spec.Name, errors.New("name used twice"))
+		}
+		s, err := spec.socket()
+		if err != nil {
+			return fail(spec.Name, err)
+		}
+		socks[spec.Name] = s
+		if spec.TLS != nil {
+			if tlss[spec.Name], err = spec.TLS.config(); err != nil {
+				return fail(spec.Name, err)
+			}
+		}
+	}
+	for _, spec := range t.Sockets {
+		for _, addr := range spec.Listen {
+			err := socks[spec.Name].ListenOptions(addr,
+				endpointOptions(addr, tlss[spec.Name]))
+			if err != nil {
+				return fail(spec.Name, &Error{Addr: addr, Err: err})
+			}
+		}
+	}
+	for _, spec := range t.Sockets {
+		for _, addr := range spec.Dial {
+			err := socks[spec.Name].DialOptions(addr,
+				endpointOptions(addr, tlss[spec.Name]))
+			if err != nil {
+				return fail(spec.Name, &Error{Addr: addr, Err: err})
+			}
+		}
+	}
+	return socks, nil
+}
+
+// socket makes the socket, and sets its options.
+func (spec *SocketSpec) socket() (mangos.Socket, error) {
+	newSocket := protocol.NewSocket
+	if spec.Raw {
+		newSocket = protocol.NewRawSocket
+	}
+	s, err := newSocket(spec.Protocol)
+	if err == mangos.ErrBadProto {
+		return nil, errors.New("unknown protocol " + spec.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range spec.Options {
+		if err = setOption(s, name, v); err != nil {
+			s.Close()
+			return nil, &Error{Option: name, Err: err}
+		}
+	}
+	return s, nil
+}
+
+// setOption sets an option, trying each type the value might stand for
+// until the socket accepts one.
+func setOption(s mangos.Socket, name string, v interface{}) error {
+	if list, ok := v.([]interface{}); ok {
+		for _, e := range list {
+			if err := setOption(s, name, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var tries []interface{}
+	switch v := v.(type) {
+	case string:
+		if n, ok := names[name][v]; ok {
+			tries = append(tries, n)
+		}
+		tries = append(tries, v)
+		if d, err := time.ParseDuration(v); err == nil {
+			tries = append(tries, d)
+		}
+		tries = append(tries, []byte(v))
+	case int:
+		tries = append(tries, v)
+	case uint64:
+		tries = append(tries, int(v))
+	case float64:
+		tries = append(tries, int(v))
+	default:
+		tries = append(tries, v)
+	}
+	var err error
+	for _, try := range tries {
+		if err = s.SetOption(name, try); !errors.Is(err, mangos.ErrBadValue) {
+			return err
+		}
+	}
+	return err
+}
+
+// endpointOptions returns the options for listening on or dialing the
+// address.
+func endpointOptions(addr string, cfg *tls.Config) map[string]interface{} {
+	if cfg == nil {
+		return nil
+	}
+	for _, scheme := range []string{"tls+tcp://", "wss://", "quic://"} {
+		if strings.HasPrefix(addr, scheme) {
+			return map[string]interface{}{mangos.OptionTLSConfig: cfg}
+		}
+	}
+	return nil
+}
+
+// config loads the files named.
+func (spec *TLSSpec) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         spec.ServerName,
+		InsecureSkipVerify: spec.Insecure,
+	}
+	if spec.Cert != "" {
+		key := spec.Key
+		if key == "" {
+			key = spec.Cert
+		}
+		cert, err := tls.LoadX509KeyPair(spec.Cert, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if spec.CA != "" {
+		pem, err := ioutil.ReadFile(spec.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + spec.CA)
+		}
+		cfg.ClientCAs = cfg.RootCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Dedup drops messages that have been received already, so that with
+// at-least-once delivery (OptionAckDelivery, or REQ sending a request
+// again) the application sees each message just once.  It remembers the
+// key of each message within a window, limited by number, or by age,
+// or both.  Install it with AddRecvHook:
+//
+//	sock.AddRecvHook(mangos.NewDedup(10000, time.Minute, nil).Hook)
+//
+// The keys of messages that were never received can be forgotten once
+// the window has passed, so a sender retrying for longer than that may
+// still cause duplicates.
+type Dedup struct {
+	count int
+	age   time.Duration
+	key   func(*Message) []byte
+	seen  map[string]time.Time
+	order []dedupEntry // oldest first
+	sync.Mutex
+}
+
+type dedupEntry struct {
+	key  string
+	when time.Time
+}
+
+// DefaultDedupCount is the number of keys a Dedup remembers if it is
+// given no limit.
+const DefaultDedupCount = 1024
+
+// NewDedup returns a Dedup remembering at most count keys, each for at
+// most age.  Either may be zero, meaning no limit; if both are, count is
+// DefaultDedupCount.  The key function returns the key of a message, or
+// nil if it is not to be filtered; nil means MessageKey.
+func NewDedup(count int, age time.Duration, key func(*Message) []byte) *Dedup {
+	if count <= 0 && age <= 0 {
+		count = DefaultDedupCount
+	}
+	if key == nil {
+		key = MessageKey
+	}
+	return &Dedup{
+		count: count,
+		age:   age,
+		key:   key,
+		seen:  make(map[string]time.Time),
+	}
+}
+
+// MessageKey returns the key of a message for Dedup: the ID of the pipe
+// it was received on, followed by the ID that the sender gave it.  This
+// is the ID from OptionAckDelivery, or the request (or survey) ID of a
+// message received by REP (or RESPONDENT).  Other messages have no ID,
+// and it returns nil.
+//
+// IDs are only unique to each sender, which is why the pipe is part of
+// the key; messages from different peers never collide.  A sender only
+// reuses an ID after some two billion messages, far outside any useful
+// window.  But a message sent again over a new connection, as after a
+// reconnect, arrives on a different pipe, so it is not taken for a
+// duplicate.
+func MessageKey(m *Message) []byte {
+	h := m.Header
+	var id []byte
+	if m.ack != nil && len(h) >= 4 {
+		id = h[:4]
+	} else if len(h) >= 4 && h[len(h)-4]&0x80 != 0 {
+		// Request IDs have the high bit set, unlike the pipe IDs in
+		// front.
+		id = h[len(h)-4:]
+	} else {
+		return nil
+	}
+	key := make([]byte, 8)
+	if m.Pipe != nil {
+		binary.BigEndian.PutUint32(key, m.Pipe.ID())
+	}
+	copy(key[4:], id)
+	return key
+}
+
+// Hook is a MessageHook, dropping messages with a key seen within the
+// window.  Duplicates received with OptionAckDelivery are acknowledged
+// as they are dropped, so that the sender stops sending them.
+func (d *Dedup) Hook(m *Message) (*Message, error) {
+	key := d.key(m)
+	if key == nil || !d.Seen(key) {
+		return m, nil
+	}
+	_ = m.Ack()
+	m.Free()
+	return nil, nil
+}
+
+// Seen records the key, returning true if it was seen already within
+// the window.
+func (d *Dedup) Seen(key []byte) bool {
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	d.expire(now)
+	if _, ok := d.seen[string(key)]; ok {
+		return true
+	}
+	k := string(key)
+	d.seen[k] = now
+	d.order = append(d.order, dedupEntry{key: k, when: now})
+	if d.count > 0 && len(d.order) > d.count {
+		d.drop(len(d.order) - d.count)
+	}
+	return false
+}
+
+// Forget removes the key of a message, so that if it is sent again it
+// is let through.  This is for applications that could not handle the
+// message, and are relying on it coming again.
+func (d *Dedup) Forget(m *Message) {
+	key := d.key(m)
+	if key == nil {
+		return
+	}
+	d.Lock()
+	delete(d.seen, string(key))
+	d.Unlock()
+}
+
+// expire drops the keys older than the window.  The lock must be held.
+func (d *Dedup) expire(now time.Time) {
+	if d.age <= 0 {
+		return
+	}
+	n := 0
+	for n < len(d.order) && now.Sub(d.order[n].when) >= d.age {
+		n++
+	}
+	d.drop(n)
+}
+
+// drop forgets the oldest n keys.  Keys that were forgotten, and then
+// seen again, are left alone.  The lock must be held.
+func (d *Dedup) drop(n int) {
+	for _, e := range d.order[:n] {
+		if when, ok := d.seen[e.key]; ok && when.Equal(e.when) {
+			delete(d.seen, e.key)
+		}
+	}
+	d.order = d.order[n:]
+}
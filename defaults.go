@@ -0,0 +1,64 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"sync"
+)
+
+var defaults struct {
+	opts map[string]interface{}
+	sync.Mutex
+}
+
+// SetDefaultOption sets the value an option takes on sockets made from
+// now on, as if SetOption were called on each as it is made.  This saves
+// large applications repeating the same options wherever they make a
+// socket.  Options that a socket does not know, such as OptionTLSConfig
+// or the queue lengths of protocols without queues, are passed on to its
+// dialers and listeners instead, where their transports know them, and
+// are otherwise ignored.  Options given to the socket, dialer or listener
+// take precedence.  Sockets already made are unaffected.  A nil value
+// removes the default.
+func SetDefaultOption(name string, value interface{}) {
+	defaults.Lock()
+	defer defaults.Unlock()
+	if value == nil {
+		delete(defaults.opts, name)
+		return
+	}
+	if defaults.opts == nil {
+		defaults.opts = make(map[string]interface{})
+	}
+	defaults.opts[name] = value
+}
+
+// DefaultOptions returns a copy of the defaults set by SetDefaultOption.
+func DefaultOptions() map[string]interface{} {
+	defaults.Lock()
+	defer defaults.Unlock()
+	opts := make(map[string]interface{}, len(defaults.opts))
+	for n, v := range defaults.opts {
+		opts[n] = v
+	}
+	return opts
+}
+
+// ClearDefaultOptions removes all the defaults set by SetDefaultOption.
+func ClearDefaultOptions() {
+	defaults.Lock()
+	defaults.opts = nil
+	defaults.Unlock()
+}
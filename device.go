@@ -14,6 +14,12 @@
 
 package mangos
 
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
 // Device is used to create a forwarding loop between two sockets.  If the
 // same socket is listed (or either socket is nil), then a loopback device
 // is established instead.  Note that the single socket case is only valid
@@ -29,6 +35,10 @@ package mangos
 //
 // Both sockets should be RAW; use of a "cooked" socket will result in
 // ErrNotRaw.
+//
+// Two different BUS sockets join two bus segments, and such devices may
+// be used to build networks of them, even with loops; see
+// BusDeviceWindow for how messages are kept from going round forever.
 func Device(s1 Socket, s2 Socket) error {
 	// Is one of the sockets nil?
 	if s1 == nil {
@@ -59,6 +69,11 @@ func Device(s1 Socket, s2 Socket) error {
 		return ErrNotRaw
 	}
 
+	if s2 != s1 && info1.Self == ProtoBus {
+		go busForwarder(s1, s2)
+		go busForwarder(s2, s1)
+		return nil
+	}
 	go forwarder(s1, s2)
 	if s2 != s1 {
 		go forwarder(s2, s1)
@@ -66,6 +81,90 @@ func Device(s1 Socket, s2 Socket) error {
 	return nil
 }
 
+// BusDeviceWindow is how long a device joining two BUS sockets remembers
+// each message it forwards.  BUS has no header on the wire with which to
+// count hops, so where segments are joined in a loop, or by more than
+// one device, a message would otherwise go round forever.  Instead, a
+// message arriving within the window with the same body as one already
+// forwarded, but by a different pipe, is taken for a copy that came the
+// long way round, and is dropped.  A message sent again by the same
+// peer is forwarded as usual.  The memory is shared by all such devices
+// in the process, so that those in parallel agree.
+//
+// The cost is that identical messages from different peers within the
+// window are also taken for copies, so applications joining segments
+// this way should make their messages distinct, for example with a
+// sequence number.  Zero disables this, for trees of segments where
+// loops are impossible.
+var BusDeviceWindow = time.Second
+
+// busSeen records the messages forwarded by BUS devices, keyed by a hash
+// of the body, for BusDeviceWindow.
+var busSeen struct {
+	sync.Mutex
+	seen  map[uint64]busEntry
+	order []busEntry // oldest first, for expiry
+}
+
+type busEntry struct {
+	hash uint64
+	pipe uint32 // the pipe it arrived on first
+	when time.Time
+}
+
+// busFirst reports whether a message is to be forwarded, recording it if
+// so.
+func busFirst(m *Message) bool {
+	window := BusDeviceWindow
+	if window <= 0 || m.Pipe == nil {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write(m.Body)
+	e := busEntry{hash: h.Sum64(), pipe: m.Pipe.ID(), when: time.Now()}
+
+	busSeen.Lock()
+	defer busSeen.Unlock()
+	if busSeen.seen == nil {
+		busSeen.seen = make(map[uint64]busEntry)
+	}
+	for len(busSeen.order) > 0 && e.when.Sub(busSeen.order[0].when) > window {
+		old := busSeen.order[0]
+		busSeen.order = busSeen.order[1:]
+		// Unless it was seen again since.
+		if busSeen.seen[old.hash] == old {
+			delete(busSeen.seen, old.hash)
+		}
+	}
+	if prev, ok := busSeen.seen[e.hash]; ok && prev.pipe != e.pipe {
+		return false
+	}
+	busSeen.seen[e.hash] = e
+	busSeen.order = append(busSeen.order, e)
+	return true
+}
+
+// busForwarder is forwarder for BUS, dropping the copies of messages that
+// have already been forwarded.
+func busForwarder(fromSock Socket, toSock Socket) {
+	for {
+		m, err := fromSock.RecvMsg()
+		if err != nil {
+			return
+		}
+		if !busFirst(m) {
+			m.Free()
+			continue
+		}
+		// The pipe it came from is on the other socket, so it is of
+		// no use in excluding the sender.
+		m.Header = m.Header[:0]
+		if err = toSock.SendMsg(m); err != nil {
+			return
+		}
+	}
+}
+
 // Forwarder takes messages from one socket, and sends them to the other.
 // The sockets must be of compatible types, and must be in Raw mode.
 func forwarder(fromSock Socket, toSock Socket) {
@@ -82,3 +181,89 @@ func forwarder(fromSock Socket, toSock Socket) {
 		}
 	}
 }
+
+// PubSubDevice joins a SUB socket, up, connected to publishers, to a PUB
+// socket, down, to which subscribers connect, republishing downstream
+// what is received from upstream.  Unlike Device, it subscribes upstream
+// only to the topics wanted downstream (see OptionSubscriptions), and
+// keeps that up to date as they come and go, so that a cascade of these
+// forms a broker that carries only what some subscriber wants.  Only
+// subscribers that forward their subscriptions (OptionSubForward) narrow
+// what is wanted; while any other is connected, everything is.  The
+// device forwards up's own subscriptions, so that devices can be
+// stacked.
+//
+// The up socket must be a SUB, not raw, since raw sockets do not filter,
+// and the subscriptions it has are replaced.  As with Device, goroutines
+// do the work, and close the sockets to stop them.
+func PubSubDevice(up Socket, down Socket) error {
+	if up == nil || down == nil {
+		return ErrClosed
+	}
+	if up.Info().Self != ProtoSub || down.Info().Self != ProtoPub {
+		return ErrBadProto
+	}
+	if val, err := up.GetOption(OptionRaw); err != nil {
+		return err
+	} else if raw, ok := val.(bool); !ok || raw {
+		return ErrBadProto
+	}
+	v, err := down.GetOption(OptionSubscriptionsChanged)
+	if err != nil {
+		return err
+	}
+	changed, ok := v.(<-chan struct{})
+	if !ok {
+		return ErrBadProto
+	}
+	if err = up.SetOption(OptionSubForward, true); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		forwarder(up, down)
+		close(done)
+	}()
+	go subForwarder(up, down, changed, done)
+	return nil
+}
+
+// subForwarder keeps the subscriptions of up to those wanted by the
+// subscribers of down.
+func subForwarder(up, down Socket, changed <-chan struct{}, done <-chan struct{}) {
+	have := make(map[string]bool)
+	for {
+		v, err := down.GetOption(OptionSubscriptions)
+		if err != nil {
+			return
+		}
+		want := make(map[string]bool)
+		for _, topic := range v.([][]byte) {
+			want[string(topic)] = true
+		}
+		// Subscribe to the new first, so as not to miss messages
+		// wanted by both.
+		for topic := range want {
+			if !have[topic] {
+				if up.SetOption(OptionSubscribe, []byte(topic)) != nil {
+					return
+				}
+				have[topic] = true
+			}
+		}
+		for topic := range have {
+			if !want[topic] {
+				if up.SetOption(OptionUnsubscribe, []byte(topic)) != nil {
+					return
+				}
+				delete(have, topic)
+			}
+		}
+		select {
+		case <-changed:
+		case <-done:
+			return
+		}
+	}
+}
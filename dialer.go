@@ -18,7 +18,8 @@ package mangos
 // and address.
 type Dialer interface {
 	// Close closes the dialer, and removes it from any active socket.
-	// Further operations on the Dialer will return ErrClosed.
+	// The pipes it made are closed too, while the rest of the socket
+	// carries on.  Further operations on the Dialer will return ErrClosed.
 	Close() error
 
 	// Dial starts connecting on the address.  If a connection fails,
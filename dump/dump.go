@@ -0,0 +1,227 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dump writes out the state of every open mangos socket in the
+// process: its pipes, dialers and listeners, queue depths and counters,
+// and the events (such as pipes attaching, or dials failing) and
+// background errors that have most recently happened on it.
+//
+// This is meant for capturing a snapshot from a process in production,
+// particularly one without a debugging HTTP port.  The snapshot can be
+// written on demand, with Write or WriteJSON, or whenever the process
+// receives a signal:
+//
+//	stop := dump.Notify(os.Stderr, dump.Text, syscall.SIGUSR1)
+//	defer stop()
+//
+// Processes that do have a debugging HTTP port can serve it instead,
+// with Handler, or publish it with expvar:
+//
+//	http.Handle("/debug/mangos", dump.Handler())
+//	dump.Publish("mangos")
+//
+// Giving each socket a name, with mangos.OptionName, makes it easier to
+// tell which is which.
+package dump
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/internal/core"
+)
+
+// Format selects how the state is written.
+type Format int
+
+const (
+	// Text is a human readable format.  It is not intended to be
+	// parsed, and may change from one release to the next.
+	Text Format = iota
+
+	// JSON is a single JSON object.  The socket states are encoded
+	// as described by mangos.SocketState.
+	JSON
+)
+
+// Snapshot is the state of the process, as written by WriteJSON.
+type Snapshot struct {
+	Time    time.Time            `json:"time"`
+	Sockets []mangos.SocketState `json:"sockets"`
+}
+
+// Take returns the state of every open socket, in order of creation.
+func Take() *Snapshot {
+	return &Snapshot{Time: time.Now(), Sockets: core.Sockets()}
+}
+
+// Write writes the state of every open socket to w, as text.
+func Write(w io.Writer) error {
+	return Take().WriteText(w)
+}
+
+// WriteJSON writes the state of every open socket to w, as JSON.
+func WriteJSON(w io.Writer) error {
+	return Take().WriteJSON(w)
+}
+
+// WriteJSON writes the snapshot to w as indented JSON.
+func (snap *Snapshot) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// WriteText writes the snapshot to w in the human readable format.
+func (snap *Snapshot) WriteText(w io.Writer) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "mangos state at %s: %d sockets\n",
+		snap.Time.Format(time.RFC3339), len(snap.Sockets))
+	for _, st := range snap.Sockets {
+		writeSocket(&sb, &st)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func state(closed bool) string {
+	if closed {
+		return "closed"
+	}
+	return "open"
+}
+
+func writeSocket(sb *strings.Builder, st *mangos.SocketState) {
+	fmt.Fprintf(sb, "\nSOCKET %d", st.ID)
+	if st.Name != "" {
+		fmt.Fprintf(sb, " %q", st.Name)
+	}
+	fmt.Fprintf(sb, " %s (peer %s) %s\n", st.Protocol, st.Peer,
+		state(st.Closed))
+	fmt.Fprintf(sb, "  sent=%d received=%d dropped=%d reconnects=%d "+
+		"queued=%d\n", st.Stats.Sent, st.Stats.Received,
+		st.Stats.Dropped, st.Stats.Reconnects, st.Stats.Queued)
+	if len(st.Stats.Protocol) > 0 {
+		names := make([]string, 0, len(st.Stats.Protocol))
+		for name := range st.Stats.Protocol {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		sb.WriteString("  protocol:")
+		for _, name := range names {
+			fmt.Fprintf(sb, " %s=%d", name, st.Stats.Protocol[name])
+		}
+		sb.WriteString("\n")
+	}
+	for _, l := range st.Listeners {
+		fmt.Fprintf(sb, "  listener %s %s\n", l.Address, state(l.Closed))
+	}
+	for _, d := range st.Dialers {
+		fmt.Fprintf(sb, "  dialer %s %s\n", d.Address, d.State)
+	}
+	for _, p := range st.Pipes {
+		fmt.Fprintf(sb, "  pipe %d %s %s", p.ID, p.Address, p.Role)
+		if p.Remote != "" {
+			fmt.Fprintf(sb, " remote=%s", p.Remote)
+		}
+		fmt.Fprintf(sb, " sending=%t holding=%t %s\n", p.Sending,
+			p.Holding, state(p.Closed))
+	}
+	if len(st.Events) > 0 {
+		sb.WriteString("  events:\n")
+		for _, ev := range st.Events {
+			fmt.Fprintf(sb, "    %s %s\n",
+				ev.Time.Format("15:04:05.000"), ev.Text)
+		}
+	}
+	if len(st.Errors) > 0 {
+		sb.WriteString("  errors:\n")
+		for _, ev := range st.Errors {
+			fmt.Fprintf(sb, "    %s %s\n",
+				ev.Time.Format("15:04:05.000"), ev.Text)
+		}
+	}
+}
+
+// Handler returns an http.Handler serving the state of every open
+// socket, as text, or as JSON if the request has the query parameter
+// "format=json".  As the state includes the addresses of peers, it
+// should not be served where untrusted clients can reach it.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snap := Take()
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			_ = snap.WriteJSON(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_ = snap.WriteText(w)
+	})
+}
+
+// Publish publishes the state of every open socket with expvar, under
+// the given name, so that it appears in /debug/vars.  Like
+// expvar.Publish, it panics if the name is already in use.
+func Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return Take()
+	}))
+}
+
+// Notify installs a handler that writes the state of every open socket
+// to w, in the given format, each time the process receives sig.  The
+// returned function removes the handler, and may be called more than
+// once.  Errors writing to w are
+// ignored.
+func Notify(w io.Writer, f Format, sig os.Signal) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sig)
+	go func() {
+		for {
+			select {
+			case <-c:
+				snap := Take()
+				if f == JSON {
+					_ = snap.WriteJSON(w)
+				} else {
+					_ = snap.WriteText(w)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
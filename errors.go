@@ -18,7 +18,11 @@ import (
 	"nanomsg.org/go/mangos/v2/errors"
 )
 
-// Various error codes.
+// Various error codes.  These are the errors returned by sockets,
+// protocols and transports alike, rather than errors of their own, so
+// that applications may test for them with errors.Is.  Errors from the
+// network, such as a refused connection, are mapped to these where
+// there is an equivalent.
 const (
 	ErrBadAddr     = errors.ErrBadAddr
 	ErrBadHeader   = errors.ErrBadHeader
@@ -43,4 +47,21 @@ const (
 	ErrNotRaw      = errors.ErrNotRaw
 	ErrCanceled    = errors.ErrCanceled
 	ErrNoContext   = errors.ErrNoContext
+	ErrNoiseNoKey  = errors.ErrNoiseNoKey
+	ErrNoiseFailed = errors.ErrNoiseFailed
+	ErrNoisePeer   = errors.ErrNoisePeer
+	ErrProxyFailed = errors.ErrProxyFailed
+	ErrTLSRevoked  = errors.ErrTLSRevoked
+	ErrTLSNoStatus = errors.ErrTLSNoStatus
+	ErrNoRoute     = errors.ErrNoRoute
+	ErrPeerDead    = errors.ErrPeerDead
+	ErrAddrDenied  = errors.ErrAddrDenied
+	ErrPipeLimit   = errors.ErrPipeLimit
+	ErrAcceptRate  = errors.ErrAcceptRate
+	ErrQuarantined = errors.ErrQuarantined
+	ErrUnsupported = errors.ErrUnsupported
+	ErrChecksum    = errors.ErrChecksum
 )
+
+// ErrBadTransport is the same error as ErrBadTran, by its longer name.
+const ErrBadTransport = errors.ErrBadTransport
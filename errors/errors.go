@@ -49,4 +49,21 @@ const (
 	ErrNotRaw      = err("socket not raw")
 	ErrCanceled    = err("operation canceled")
 	ErrNoContext   = err("protocol does not support contexts")
+	ErrNoiseNoKey  = err("missing noise static key")
+	ErrNoiseFailed = err("noise handshake failed")
+	ErrNoisePeer   = err("noise peer key not permitted")
+	ErrProxyFailed = err("proxy connection failed")
+	ErrTLSRevoked  = err("TLS certificate revoked")
+	ErrTLSNoStatus = err("TLS certificate revocation status unknown")
+	ErrNoRoute     = err("no route to peer")
+	ErrPeerDead    = err("peer not responding")
+	ErrAddrDenied  = err("peer address not permitted")
+	ErrPipeLimit   = err("too many connections")
+	ErrAcceptRate  = err("connections arriving too fast")
+	ErrQuarantined = err("peer address in quarantine")
+	ErrUnsupported = err("option not supported on this platform")
+	ErrChecksum    = err("frame checksum mismatch")
 )
+
+// ErrBadTransport is the same error as ErrBadTran, by its longer name.
+const ErrBadTransport = ErrBadTran
@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"os"
+	"syscall"
+)
+
+// dupFiles returns new descriptors for the files, so that a duplicated
+// message can be closed independently of the original.  Files that
+// cannot be duplicated are left out.
+func dupFiles(files []*os.File) []*os.File {
+	dups := make([]*os.File, 0, len(files))
+	for _, f := range files {
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			continue
+		}
+		syscall.CloseOnExec(fd)
+		dups = append(dups, os.NewFile(uintptr(fd), f.Name()))
+	}
+	return dups
+}
@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import "os"
+
+// dupFiles returns nothing, as no transport can carry files on Windows,
+// so that copies of a message do not share them.
+func dupFiles([]*os.File) []*os.File {
+	return nil
+}
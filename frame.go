@@ -0,0 +1,54 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"time"
+)
+
+// Frame is a message as one of a socket's pipes sent or received it,
+// given to a Capturer (see OptionCapture).  Header and Body together are
+// what went over the wire, less the transport's own framing.  On frames
+// sent, the Header is what the protocol put in front of the body, such
+// as the request ID of REQ.  Received frames are as the transport
+// delivered them, before the protocol has split off its header, which
+// is therefore still at the front of the Body.
+type Frame struct {
+	// Time is when the frame was sent or received.
+	Time time.Time
+
+	// Pipe is the ID of the pipe, as in PipeInfo.
+	Pipe uint32
+
+	// Address is the address of the dialer or listener that made
+	// the pipe.
+	Address string
+
+	// Sent is true for frames sent to the peer, and false for those
+	// received from it.
+	Sent bool
+
+	Header []byte
+	Body   []byte
+}
+
+// Capturer is given the frames of a socket with OptionCapture.  Capture
+// is called on the goroutine sending or receiving, before the frame is
+// sent or just after it was received, and the Frame and its slices are
+// only valid until it returns; it must copy what it keeps, and should
+// not block for long.  It may be called from several goroutines at once.
+type Capturer interface {
+	Capture(f *Frame)
+}
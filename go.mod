@@ -1,8 +1,27 @@
 module nanomsg.org/go/mangos/v2
 
+go 1.26.0
+
 require (
 	github.com/Microsoft/go-winio v0.4.11
 	github.com/droundy/goopt v0.0.0-20170604162106-0b8effe182da
+	github.com/golang/snappy v1.0.0
 	github.com/gorilla/websocket v1.4.0
-	golang.org/x/sys v0.0.0-20181128092732-4ed8d59d0b35 // indirect
+	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/quic-go/quic-go v0.63.0
+	go.yaml.in/yaml/v3 v3.0.5
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.56.0
+	golang.org/x/sys v0.47.0
+	google.golang.org/protobuf v1.26.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.5.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
 )
@@ -0,0 +1,81 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import "time"
+
+// bucket is a token bucket, limiting the rate of some event.  With no
+// rate, the zero value, it permits everything.  The caller locks.
+type bucket struct {
+	rate   float64 // tokens added per second, or zero for no limit
+	burst  int     // most tokens held
+	tokens float64
+	last   time.Time
+}
+
+// burst returns the burst for a rate: a second's worth, but at least one.
+func burst(rate float64) int {
+	if rate < 1 {
+		return 1
+	}
+	return int(rate)
+}
+
+// set changes the rate and burst, starting with a full bucket.
+func (b *bucket) set(rate float64, burst int) {
+	b.rate = rate
+	b.burst = burst
+	b.tokens = float64(burst)
+	b.last = time.Now()
+}
+
+// fill adds the tokens earned since last time.
+func (b *bucket) fill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > float64(b.burst) {
+			b.tokens = float64(b.burst)
+		}
+	}
+	b.last = now
+}
+
+// reserve takes n tokens, going into debt if there are not that many,
+// and returns how long it will take for the debt to be repaid, which
+// the caller must wait.
+func (b *bucket) reserve(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.fill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take takes n tokens, if there are that many.
+func (b *bucket) take(n float64, now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.fill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
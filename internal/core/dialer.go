@@ -17,6 +17,7 @@ package core
 import (
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/errors"
@@ -33,46 +34,121 @@ type dialer struct {
 	closed        bool
 	active        bool
 	dialing       bool
+	connected     bool // has ever had a pipe
 	asynch        bool
-	redialer      *time.Timer
+	timeout       time.Duration // OptionDialTimeout
+	redialer      mangos.Timer
 	reconnTime    time.Duration
 	reconnMinTime time.Duration
 	reconnMaxTime time.Duration
+	reconnPolicy  mangos.RetryPolicy // OptionReconnectPolicy
+	attempts      int                // failed since last connected
+	weight        int                // for LoadBalanceWeighted
+	priority      int                // OptionDialPriority
+	own           map[string]bool    // transport options not inherited
 	closeq        chan struct{}
 }
 
 func (d *dialer) Dial() error {
 	d.Lock()
-	if d.active {
-		d.Unlock()
-		return mangos.ErrAddrInUse
-	}
 	if d.closed {
 		d.Unlock()
 		return mangos.ErrClosed
 	}
+	if d.active {
+		d.Unlock()
+		return mangos.ErrAddrInUse
+	}
 	d.closeq = make(chan struct{})
 	d.active = true
 	d.reconnTime = d.reconnMinTime
+	d.attempts = 0
 	if d.asynch {
 		go d.redial()
 		d.Unlock()
 		return nil
 	}
 	d.Unlock()
-	return d.dial(false)
+	return d.dialSync()
+}
+
+// dialSync dials until a connection is made, or until the dial timeout
+// has passed.  On failure, the dialer is left inactive, so that the
+// caller may try again.
+func (d *dialer) dialSync() error {
+	d.Lock()
+	clock := d.s.now()
+	deadline := clock.Now().Add(d.timeout)
+	wait := d.nextDelay(d.reconnMinTime)
+	closeq := d.closeq
+	d.Unlock()
+
+	for {
+		err := d.dial(false)
+		if err == nil {
+			return nil
+		}
+		remain := deadline.Sub(clock.Now())
+		if err == mangos.ErrClosed || remain <= 0 {
+			d.Lock()
+			d.active = false
+			d.Unlock()
+			return err
+		}
+		if wait <= 0 {
+			wait = time.Millisecond * 10
+		}
+		if wait > remain {
+			wait = remain
+		}
+		select {
+		case <-clock.After(wait):
+		case <-closeq:
+			return mangos.ErrClosed
+		}
+		d.Lock()
+		wait = wait * 3 / 2
+		if d.reconnMaxTime != 0 && wait > d.reconnMaxTime {
+			wait = d.reconnMaxTime
+		}
+		wait = d.nextDelay(wait)
+		d.Unlock()
+	}
 }
 
+// Close stops the dialer, and closes its pipes, leaving the rest of the
+// socket as it is.
 func (d *dialer) Close() error {
+	if err := d.shut(); err != nil {
+		return err
+	}
+	d.s.remEndpoint(d, nil)
+	return nil
+}
+
+// shut stops the dialer from making further connections.
+func (d *dialer) shut() error {
 	d.Lock()
 	defer d.Unlock()
 	if d.closed {
 		return mangos.ErrClosed
 	}
 	d.closed = true
+	if d.redialer != nil {
+		d.redialer.Stop()
+	}
+	if d.closeq != nil {
+		close(d.closeq)
+	}
 	return nil
 }
 
+func (d *dialer) isClosed() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.closed
+}
+
 func (d *dialer) GetOption(n string) (interface{}, error) {
 	switch n {
 	case mangos.OptionReconnectTime:
@@ -85,11 +161,31 @@ func (d *dialer) GetOption(n string) (interface{}, error) {
 		v := d.reconnMaxTime
 		d.Unlock()
 		return v, nil
+	case mangos.OptionReconnectPolicy:
+		d.Lock()
+		v := d.reconnPolicy
+		d.Unlock()
+		return v, nil
 	case mangos.OptionDialAsynch:
 		d.Lock()
 		v := d.asynch
 		d.Unlock()
 		return v, nil
+	case mangos.OptionDialTimeout:
+		d.Lock()
+		v := d.timeout
+		d.Unlock()
+		return v, nil
+	case mangos.OptionWeight:
+		d.Lock()
+		v := d.weight
+		d.Unlock()
+		return v, nil
+	case mangos.OptionDialPriority:
+		d.Lock()
+		v := d.priority
+		d.Unlock()
+		return v, nil
 	}
 	if val, err := d.d.GetOption(n); err != mangos.ErrBadOption {
 		return val, err
@@ -99,6 +195,12 @@ func (d *dialer) GetOption(n string) (interface{}, error) {
 }
 
 func (d *dialer) SetOption(n string, v interface{}) error {
+	return d.setOption(n, v, true)
+}
+
+// setOption sets an option, noting whether it is the dialer's own
+// setting, or one inherited from the socket.
+func (d *dialer) setOption(n string, v interface{}, own bool) error {
 	switch n {
 	case mangos.OptionReconnectTime:
 		if v, ok := v.(time.Duration); ok {
@@ -116,6 +218,14 @@ func (d *dialer) SetOption(n string, v interface{}) error {
 			return nil
 		}
 		return mangos.ErrBadValue
+	case mangos.OptionReconnectPolicy:
+		if rp, ok := v.(mangos.RetryPolicy); ok || v == nil {
+			d.Lock()
+			d.reconnPolicy = rp
+			d.Unlock()
+			return nil
+		}
+		return mangos.ErrBadValue
 	case mangos.OptionDialAsynch:
 		if v, ok := v.(bool); ok {
 			d.Lock()
@@ -123,9 +233,54 @@ func (d *dialer) SetOption(n string, v interface{}) error {
 			d.Unlock()
 			return nil
 		}
+		return mangos.ErrBadValue
+	case mangos.OptionDialTimeout:
+		if v, ok := v.(time.Duration); ok && v >= 0 {
+			d.Lock()
+			d.timeout = v
+			d.Unlock()
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionWeight:
+		if v, ok := v.(int); ok && v > 0 {
+			d.Lock()
+			d.weight = v
+			d.Unlock()
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionDialPriority:
+		if v, ok := v.(int); ok && v >= 1 && v <= 16 {
+			d.Lock()
+			d.priority = v
+			d.Unlock()
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+	// Transport specific options passed down, and on to live pipes.
+	if err := d.d.SetOption(n, v); err != nil {
+		return err
+	}
+	if own {
+		d.Lock()
+		d.own[n] = true
+		d.Unlock()
+	}
+	d.s.retune(d, nil, n, v)
+	return nil
+}
+
+// inherit applies an option set on the socket, unless the dialer has
+// its own setting.
+func (d *dialer) inherit(n string, v interface{}) {
+	d.Lock()
+	own := d.own[n]
+	d.Unlock()
+	if !own {
+		_ = d.setOption(n, v, false)
 	}
-	// Transport specific options passed down.
-	return d.d.SetOption(n, v)
 }
 
 func (d *dialer) Address() string {
@@ -140,7 +295,12 @@ func (d *dialer) Address() string {
 func (d *dialer) pipeConnected() {
 	d.Lock()
 	d.reconnTime = d.reconnMinTime
+	d.attempts = 0
+	rp := d.reconnPolicy
 	d.Unlock()
+	if rp != nil {
+		rp.Reset()
+	}
 }
 
 func (d *dialer) pipeClosed() {
@@ -149,10 +309,22 @@ func (d *dialer) pipeClosed() {
 	// peer refuses to accept our protocol.  Injecting at least a little
 	// delay should help.
 	d.Lock()
-	time.AfterFunc(d.reconnTime, d.redial)
+	d.s.now().AfterFunc(d.nextDelay(d.reconnTime), d.redial)
 	d.Unlock()
 }
 
+// nextDelay returns the time to wait before the next connection attempt,
+// from the OptionReconnectPolicy if there is one, otherwise the time
+// given.  The caller must hold the lock.
+func (d *dialer) nextDelay(def time.Duration) time.Duration {
+	if d.reconnPolicy == nil {
+		return def
+	}
+	wait := d.reconnPolicy.NextDelay(d.attempts)
+	d.attempts++
+	return wait
+}
+
 func (d *dialer) dial(redial bool) error {
 	d.Lock()
 	if d.asynch {
@@ -174,14 +346,27 @@ func (d *dialer) dial(redial bool) error {
 	d.Unlock()
 
 	p, err := d.d.Dial()
+	err = transport.MapDialError(err)
 	if err == nil {
 		d.s.addPipe(p, d, nil)
 
 		d.Lock()
 		d.dialing = false
+		if d.connected {
+			atomic.AddUint64(&d.s.reconnects, 1)
+		}
+		d.connected = true
 		d.Unlock()
 		return nil
 	}
+	if p != nil {
+		d.s.rejectPipe(newPipe(p, d.s, d, nil), err)
+	} else if err != mangos.ErrClosed {
+		d.s.logf("dial %s: %v", d.addr, err)
+		if redial {
+			d.s.reportError(err, d, nil)
+		}
+	}
 
 	d.Lock()
 	defer d.Unlock()
@@ -220,7 +405,7 @@ func (d *dialer) dial(redial bool) error {
 				d.reconnTime = d.reconnMaxTime
 			}
 		}
-		d.redialer = time.AfterFunc(rtime, d.redial)
+		d.redialer = d.s.now().AfterFunc(d.nextDelay(rtime), d.redial)
 	}
 	return err
 }
@@ -0,0 +1,133 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package core
+
+import (
+	gocontext "context"
+	"sync/atomic"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Values of socket.draining.
+const (
+	drainRefuse = 1 // draining, and refusing sends
+	drainAnswer = 2 // draining, but sends may answer earlier requests
+)
+
+// sendable returns false if sends are being refused because we are
+// draining.
+func (s *socket) sendable() bool {
+	return atomic.LoadInt32(&s.draining) != drainRefuse
+}
+
+func (s *socket) Drain(ctx gocontext.Context) error {
+	// Protocols that answer requests say how many are unanswered.
+	mode := int32(drainRefuse)
+	if v, err := s.proto.GetOption(mangos.OptionProtocolStats); err == nil {
+		if m, ok := v.(map[string]uint64); ok {
+			if _, ok = m[mangos.StatAwaiting]; ok {
+				mode = drainAnswer
+			}
+		}
+	}
+
+	s.Lock()
+	if s.closed || s.draining != 0 {
+		s.Unlock()
+		return mangos.ErrClosed
+	}
+	atomic.StoreInt32(&s.draining, mode)
+	listeners := s.listeners
+	dialers := s.dialers
+	s.listeners = nil
+	s.dialers = nil
+	s.Unlock()
+
+	for _, l := range listeners {
+		l.shut()
+	}
+	for _, d := range dialers {
+		d.shut()
+	}
+
+	// A message just taken from a queue by a pipe's sender is in
+	// neither place until the write starts, so, as when lingering,
+	// the socket must be seen to be drained twice, a little apart.
+	tick := time.NewTicker(time.Millisecond * 10)
+	defer tick.Stop()
+	for settled := false; ; {
+		if !s.drained() {
+			settled = false
+		} else if settled {
+			break
+		} else {
+			settled = true
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	_ = s.Flush()
+	return s.Close()
+}
+
+// drained returns true once every request has been answered, and the
+// answers sent.
+func (s *socket) drained() bool {
+	if atomic.LoadInt32(&s.sendWaiters) != 0 {
+		return false
+	}
+	if s.protoStat(mangos.StatAwaiting) != 0 {
+		return false
+	}
+	s.Lock()
+	pipes := make(map[*pipe]struct{}, len(s.pipes))
+	for p := range s.pipes {
+		pipes[p] = struct{}{}
+	}
+	s.Unlock()
+	return s.flushed(pipes)
+}
+
+func (ctx context) SendMsg(msg *Message) error {
+	return ctx.s.sendMsg(msg, ctx.ProtocolContext)
+}
+
+func (ctx context) RecvMsg() (*Message, error) {
+	if atomic.LoadInt32(&ctx.s.draining) != 0 {
+		return nil, mangos.ErrClosed
+	}
+	for {
+		msg, err := ctx.ProtocolContext.RecvMsg()
+		if err != nil {
+			return nil, err
+		}
+		msg.Uncharge()
+		ctx.s.progress()
+		hooks := ctx.s.hooks(&ctx.s.recvHooks)
+		if msg, err = ctx.s.runHooks(hooks, msg); err != nil {
+			return nil, err
+		}
+		if msg = ctx.s.validate(msg); msg != nil {
+			atomic.AddUint64(&ctx.s.received, 1)
+			ctx.s.delivered(msg)
+			return msg, nil
+		}
+	}
+}
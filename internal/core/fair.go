@@ -0,0 +1,136 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// fairGate lets senders through one at a time, for OptionFairSend,
+// taking turns between lanes, and in order of arrival within each.  The
+// sender let through holds the turn until it calls leave, which hands it
+// straight to the next waiting, so that a sender coming back at once
+// cannot jump the queue.
+type fairGate struct {
+	sync.Mutex
+	on    bool
+	busy  bool
+	lanes map[uint32][]chan struct{} // waiting senders, by lane
+	order []uint32                   // lanes with senders waiting
+}
+
+// setOn enables or disables the gate.  Senders already waiting are
+// still let through in turn.
+func (g *fairGate) setOn(on bool) {
+	g.Lock()
+	g.on = on
+	g.Unlock()
+}
+
+func (g *fairGate) isOn() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.on
+}
+
+// enter waits for the lane's turn, returning true once it has it, in
+// which case the caller must call leave.  It returns false at once if
+// the gate is off.  It gives up with an error if closeq is closed, or
+// the timer channel tq fires.
+func (g *fairGate) enter(lane uint32, closeq <-chan struct{}, tq <-chan time.Time) (bool, error) {
+	g.Lock()
+	if !g.on {
+		g.Unlock()
+		return false, nil
+	}
+	if !g.busy {
+		g.busy = true
+		g.Unlock()
+		return true, nil
+	}
+	if g.lanes == nil {
+		g.lanes = make(map[uint32][]chan struct{})
+	}
+	ch := make(chan struct{})
+	if len(g.lanes[lane]) == 0 {
+		g.order = append(g.order, lane)
+	}
+	g.lanes[lane] = append(g.lanes[lane], ch)
+	g.Unlock()
+
+	var err error
+	select {
+	case <-ch:
+		return true, nil
+	case <-closeq:
+		err = mangos.ErrClosed
+	case <-tq:
+		err = mangos.ErrSendTimeout
+	}
+
+	g.Lock()
+	waiting := g.lanes[lane]
+	for i, w := range waiting {
+		if w == ch {
+			g.lanes[lane] = append(waiting[:i:i], waiting[i+1:]...)
+			if len(g.lanes[lane]) == 0 {
+				g.dropLane(lane)
+			}
+			g.Unlock()
+			return false, err
+		}
+	}
+	g.Unlock()
+	// The turn was handed to us meanwhile, so pass it on.
+	g.leave()
+	return false, err
+}
+
+// leave ends the turn, handing it to the first sender waiting in the
+// next lane, which goes to the back of the order if more are waiting.
+func (g *fairGate) leave() {
+	g.Lock()
+	defer g.Unlock()
+	if len(g.order) == 0 {
+		g.busy = false
+		return
+	}
+	lane := g.order[0]
+	g.order = g.order[1:]
+	waiting := g.lanes[lane]
+	ch := waiting[0]
+	if len(waiting) > 1 {
+		g.lanes[lane] = waiting[1:]
+		g.order = append(g.order, lane)
+	} else {
+		delete(g.lanes, lane)
+	}
+	close(ch)
+}
+
+// dropLane removes a lane with nobody left waiting from the order.  The
+// caller holds the lock.
+func (g *fairGate) dropLane(lane uint32) {
+	delete(g.lanes, lane)
+	for i, l := range g.order {
+		if l == lane {
+			g.order = append(g.order[:i:i], g.order[i+1:]...)
+			return
+		}
+	}
+}
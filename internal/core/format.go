@@ -0,0 +1,137 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// These String and GoString implementations take the relevant locks
+// only long enough to snapshot state, so they are safe to call from
+// log statements and debuggers at any time other than while already
+// holding the object's own lock.
+
+func stateName(closed bool) string {
+	if closed {
+		return "closed"
+	}
+	return "open"
+}
+
+func (s *socket) snapshot() (np, nd, nl int, closed bool) {
+	s.Lock()
+	np, nd, nl, closed = len(s.pipes), len(s.dialers), len(s.listeners), s.closed
+	s.Unlock()
+	return
+}
+
+// String emits a short summary of the socket state.
+func (s *socket) String() string {
+	info := s.proto.Info()
+	np, nd, nl, closed := s.snapshot()
+	return fmt.Sprintf("SOCKET[%s](%p){peer=%s pipes=%d dialers=%d "+
+		"listeners=%d %s}", info.SelfName, s, info.PeerName,
+		np, nd, nl, stateName(closed))
+}
+
+// GoString emits a description of the socket for the "%#v" verb.
+func (s *socket) GoString() string {
+	info := s.proto.Info()
+	np, nd, nl, closed := s.snapshot()
+	return fmt.Sprintf("&core.socket{Proto: %q, Peer: %q, Pipes: %d, "+
+		"Dialers: %d, Listeners: %d, Closed: %t}", info.SelfName,
+		info.PeerName, np, nd, nl, closed)
+}
+
+func (p *pipe) remote() string {
+	if v, err := p.p.GetOption(mangos.OptionRemoteAddr); err == nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func (p *pipe) role() string {
+	if p.d != nil {
+		return "dialer"
+	}
+	return "listener"
+}
+
+// String emits a short summary of the pipe state.
+func (p *pipe) String() string {
+	p.Lock()
+	closed := p.closed
+	p.Unlock()
+	return fmt.Sprintf("PIPE[%d](%s){%s remote=%s sending=%t holding=%t %s}",
+		p.id, p.Address(), p.role(), p.remote(),
+		atomic.LoadInt32(&p.sending) != 0,
+		atomic.LoadInt32(&p.holding) != 0, stateName(closed))
+}
+
+// GoString emits a description of the pipe for the "%#v" verb.
+func (p *pipe) GoString() string {
+	p.Lock()
+	closed := p.closed
+	p.Unlock()
+	return fmt.Sprintf("&core.pipe{ID: %d, Address: %q, Role: %q, "+
+		"Remote: %q, Closed: %t}", p.id, p.Address(), p.role(),
+		p.remote(), closed)
+}
+
+func (d *dialer) state() string {
+	d.Lock()
+	defer d.Unlock()
+	switch {
+	case d.closed:
+		return "closed"
+	case d.dialing:
+		return "dialing"
+	case d.active:
+		return "active"
+	}
+	return "idle"
+}
+
+// String emits a short summary of the dialer state.
+func (d *dialer) String() string {
+	return fmt.Sprintf("DIALER[%s](%p){%s}", d.addr, d, d.state())
+}
+
+// GoString emits a description of the dialer for the "%#v" verb.
+func (d *dialer) GoString() string {
+	return fmt.Sprintf("&core.dialer{Address: %q, State: %q}",
+		d.addr, d.state())
+}
+
+// String emits a short summary of the listener state.
+func (l *listener) String() string {
+	l.Lock()
+	closed := l.closed
+	l.Unlock()
+	return fmt.Sprintf("LISTENER[%s](%p){%s}", l.Address(), l,
+		stateName(closed))
+}
+
+// GoString emits a description of the listener for the "%#v" verb.
+func (l *listener) GoString() string {
+	l.Lock()
+	closed := l.closed
+	l.Unlock()
+	return fmt.Sprintf("&core.listener{Address: %q, Closed: %t}",
+		l.Address(), closed)
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"nanomsg.org/go/mangos/v2"
+)
+
+// reader and writer are separate types, rather than the socket itself
+// behind a narrower interface, so that the holder of one cannot type
+// assert its way back to the whole Socket.
+type reader struct {
+	s mangos.Socket
+}
+
+func (r reader) Info() mangos.ProtocolInfo                 { return r.s.Info() }
+func (r reader) Recv() ([]byte, error)                     { return r.s.Recv() }
+func (r reader) RecvMsg() (*mangos.Message, error)         { return r.s.RecvMsg() }
+func (r reader) RecvMsgs(n int) ([]*mangos.Message, error) { return r.s.RecvMsgs(n) }
+
+type writer struct {
+	s mangos.Socket
+}
+
+func (w writer) Info() mangos.ProtocolInfo          { return w.s.Info() }
+func (w writer) Send(b []byte) error                { return w.s.Send(b) }
+func (w writer) SendMsg(m *mangos.Message) error    { return w.s.SendMsg(m) }
+func (w writer) SendMsgs(m []*mangos.Message) error { return w.s.SendMsgs(m) }
+func (w writer) Flush() error                       { return w.s.Flush() }
+
+func (s *socket) ReaderOnly() mangos.SocketReader {
+	return ReaderOnly(s)
+}
+
+func (s *socket) WriterOnly() mangos.SocketWriter {
+	return WriterOnly(s)
+}
+
+// ReaderOnly implements Socket.ReaderOnly for s.  It is exported for
+// sockets that wrap another, so that the view goes by way of their own
+// methods.
+func ReaderOnly(s mangos.Socket) mangos.SocketReader {
+	return reader{s: s}
+}
+
+// WriterOnly implements Socket.WriterOnly for s, as ReaderOnly does.
+func WriterOnly(s mangos.Socket) mangos.SocketWriter {
+	return writer{s: s}
+}
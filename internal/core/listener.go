@@ -24,20 +24,119 @@ import (
 
 type listener struct {
 	sync.Mutex
-	l      transport.Listener
-	s      *socket
-	addr   string
-	closed bool
+	l        transport.Listener
+	s        *socket
+	addr     string
+	closed   bool
+	weight   int             // for LoadBalanceWeighted
+	maxPipes int             // OptionMaxPipes, zero for no limit
+	accepts  bucket          // OptionAcceptRate and OptionAcceptBurst
+	own      map[string]bool // transport options not inherited
 }
 
 func (l *listener) GetOption(n string) (interface{}, error) {
-	// Listeners do not keep local options; we just pass this down.
+	// Listeners keep only these; the rest we just pass down.
+	var v interface{}
+	l.Lock()
+	switch n {
+	case mangos.OptionWeight:
+		v = l.weight
+	case mangos.OptionMaxPipes:
+		v = l.maxPipes
+	case mangos.OptionAcceptRate:
+		v = l.accepts.rate
+	case mangos.OptionAcceptBurst:
+		v = l.accepts.burst
+	}
+	l.Unlock()
+	if v != nil {
+		return v, nil
+	}
 	return l.l.GetOption(n)
 }
 
 func (l *listener) SetOption(n string, v interface{}) error {
-	// Listeners do not keep local options; we just pass this down.
-	return l.l.SetOption(n, v)
+	return l.setOption(n, v, true)
+}
+
+// setOption sets an option, noting whether it is the listener's own
+// setting, or one inherited from the socket.
+func (l *listener) setOption(n string, v interface{}, own bool) error {
+	if local, err := l.setLocal(n, v); local {
+		return err
+	}
+	if err := l.l.SetOption(n, v); err != nil {
+		return err
+	}
+	if own {
+		l.Lock()
+		l.own[n] = true
+		l.Unlock()
+	}
+	l.s.retune(nil, l, n, v)
+	return nil
+}
+
+// setLocal sets the options kept by the listener itself, rather than by
+// the transport, reporting whether the option was one of those.
+func (l *listener) setLocal(n string, v interface{}) (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+	switch n {
+	case mangos.OptionWeight:
+		if v, ok := v.(int); ok && v > 0 {
+			l.weight = v
+			return true, nil
+		}
+		return true, mangos.ErrBadValue
+	case mangos.OptionMaxPipes:
+		if v, ok := v.(int); ok && v >= 0 {
+			l.maxPipes = v
+			return true, nil
+		}
+		return true, mangos.ErrBadValue
+	case mangos.OptionAcceptRate:
+		if v, ok := v.(float64); ok && v >= 0 {
+			l.accepts.set(v, l.accepts.burst)
+			return true, nil
+		}
+		return true, mangos.ErrBadValue
+	case mangos.OptionAcceptBurst:
+		if v, ok := v.(int); ok && v > 0 {
+			l.accepts.set(l.accepts.rate, v)
+			return true, nil
+		}
+		return true, mangos.ErrBadValue
+	}
+	return false, nil
+}
+
+// admit checks a new connection against the limits on the number of
+// pipes and the rate they are accepted.
+func (l *listener) admit() error {
+	l.Lock()
+	max := l.maxPipes
+	l.Unlock()
+	if max > 0 && l.s.countPipes(l) >= max {
+		return mangos.ErrPipeLimit
+	}
+	l.Lock()
+	defer l.Unlock()
+	if !l.accepts.take(1, time.Now()) {
+		return mangos.ErrAcceptRate
+	}
+	return nil
+}
+
+// inherit applies an option set on the socket, unless the listener has
+// its own setting.
+func (l *listener) inherit(n string, v interface{}) {
+	l.Lock()
+	own := l.own[n]
+	l.Unlock()
+	if !own {
+		_ = l.setOption(n, v, false)
+	}
 }
 
 // serve spins in a loop, calling the accepter's Accept routine.
@@ -55,8 +154,16 @@ func (l *listener) serve() {
 		if tp, err := l.l.Accept(); err == mangos.ErrClosed {
 			return
 		} else if err == nil {
-			l.s.addPipe(tp, nil, l)
+			if err = l.admit(); err != nil {
+				l.s.rejectPipe(newPipe(tp, l.s, nil, l), err)
+			} else {
+				l.s.addPipe(tp, nil, l)
+			}
+		} else if tp != nil {
+			l.s.rejectPipe(newPipe(tp, l.s, nil, l), err)
 		} else {
+			l.s.logf("accept %s: %v", l.addr, err)
+			l.s.reportError(err, nil, l)
 			// Debounce a little bit, to avoid thrashing the CPU.
 			time.Sleep(time.Second / 100)
 		}
@@ -71,7 +178,7 @@ func (l *listener) Listen() error {
 	// connections without limit.
 
 	if err := l.l.Listen(); err != nil {
-		return err
+		return transport.MapError(err)
 	}
 
 	go l.serve()
@@ -82,12 +189,31 @@ func (l *listener) Address() string {
 	return l.l.Address()
 }
 
+// Close stops the listener, and closes its pipes, leaving the rest of
+// the socket as it is.
 func (l *listener) Close() error {
+	if err := l.shut(); err != nil {
+		return err
+	}
+	l.s.remEndpoint(nil, l)
+	return nil
+}
+
+// shut stops the listener from accepting further connections.
+func (l *listener) shut() error {
 	l.Lock()
-	defer l.Unlock()
 	if l.closed {
+		l.Unlock()
 		return mangos.ErrClosed
 	}
 	l.closed = true
+	l.Unlock()
+
 	return l.l.Close()
 }
+
+func (l *listener) isClosed() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.closed
+}
@@ -17,6 +17,7 @@ package core
 import (
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2"
@@ -42,6 +43,19 @@ type pipe struct {
 	d      *dialer
 	s      *socket
 	closed bool // true if we were closed
+	closeq chan struct{}
+
+	peerMax int // the peer's OptionPeerMaxRecvSize, if it told us
+
+	sending int32 // non-zero while a transport write is in progress
+	holding int32 // non-zero while the protocol holds a received message
+
+	since     time.Time // when the pipe was connected
+	msgsSent  uint64    // messages sent, for PipeInfo
+	msgsRecv  uint64    // messages received, for PipeInfo
+	bytesSent uint64    // header and body bytes sent, for PipeInfo
+	bytesRecv uint64    // header and body bytes received, for PipeInfo
+	active    int64     // UnixNano of the last send or receive
 }
 
 func init() {
@@ -51,10 +65,16 @@ func init() {
 
 func newPipe(tp transport.Pipe, s *socket, d *dialer, l *listener) *pipe {
 	p := &pipe{
-		p: tp,
-		d: d,
-		l: l,
-		s: s,
+		p:      tp,
+		d:      d,
+		l:      l,
+		s:      s,
+		since:  time.Now(),
+		closeq: make(chan struct{}),
+	}
+	p.active = p.since.UnixNano()
+	if v, err := tp.GetOption(mangos.OptionPeerMaxRecvSize); err == nil {
+		p.peerMax, _ = v.(int)
 	}
 	pipes.Lock()
 	for {
@@ -86,6 +106,7 @@ func (p *pipe) Close() error {
 	}
 	p.closed = true
 	p.Unlock()
+	close(p.closeq)
 
 	if s != nil {
 		s.remPipe(p)
@@ -99,33 +120,242 @@ func (p *pipe) Close() error {
 
 	// This is last, as we keep the ID reserved until everything is
 	// done with it.
+	p.release()
+
+	return nil
+}
+
+// release returns the pipe ID for reuse.
+func (p *pipe) release() {
 	pipes.Lock()
 	delete(pipes.IDs, p.id)
 	pipes.Unlock()
-
-	return nil
 }
 
 func (p *pipe) SendMsg(msg *mangos.Message) error {
 
-	if err := p.p.Send(msg); err != nil {
-		p.Close()
+	if !msg.Verify() {
+		p.modified(msg)
+		return nil
+	}
+	if msg.Expired() {
+		p.expired(msg)
+		return nil
+	}
+	if p.tooLong(msg) {
+		return nil
+	}
+	// The transport may free the message, so measure it first.
+	size := uint64(len(msg.Header) + msg.BodyLen())
+	lc := msg.Lifecycle
+	p.capture(msg, true)
+	atomic.StoreInt32(&p.sending, 1)
+	err := p.p.Send(msg)
+	atomic.StoreInt32(&p.sending, 0)
+	if err != nil {
+		p.failed(err)
+		return err
+	}
+	p.written(lc)
+	atomic.AddUint64(&p.msgsSent, 1)
+	atomic.AddUint64(&p.bytesSent, size)
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+	p.s.progress()
+	return nil
+}
+
+func (p *pipe) SendMsgs(msgs []*mangos.Message) error {
+	tp, ok := p.p.(mangos.TranPipeBatchSender)
+	if !ok {
+		for i, msg := range msgs {
+			if err := p.SendMsg(msg); err != nil {
+				for _, m := range msgs[i:] {
+					m.Free()
+				}
+				return err
+			}
+		}
+		return nil
+	}
+	batch := make([]*mangos.Message, 0, len(msgs))
+	var lcs []mangos.Lifecycle
+	track := p.s.lifecycleFunc() != nil
+	size := uint64(0)
+	for _, msg := range msgs {
+		if !msg.Verify() {
+			p.modified(msg)
+			continue
+		}
+		if msg.Expired() {
+			p.expired(msg)
+			continue
+		}
+		if p.tooLong(msg) {
+			continue
+		}
+		size += uint64(len(msg.Header) + msg.BodyLen())
+		p.capture(msg, true)
+		if track {
+			lcs = append(lcs, msg.Lifecycle)
+		}
+		batch = append(batch, msg)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	atomic.StoreInt32(&p.sending, 1)
+	err := tp.SendMsgs(batch)
+	atomic.StoreInt32(&p.sending, 0)
+	if err != nil {
+		p.failed(err)
 		return err
 	}
+	for _, lc := range lcs {
+		p.written(lc)
+	}
+	atomic.AddUint64(&p.msgsSent, uint64(len(batch)))
+	atomic.AddUint64(&p.bytesSent, size)
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+	p.s.progress()
 	return nil
 }
 
 func (p *pipe) RecvMsg() *mangos.Message {
 
-	msg, err := p.p.Recv()
-	if err != nil {
-		p.Close()
-		return nil
+	atomic.StoreInt32(&p.holding, 0)
+	var msg *mangos.Message
+	for msg == nil {
+		// Reading stops while the socket holds too much already;
+		// see OptionMaxBufferBytes.
+		if err := p.s.recvBuf.Wait(p.closeq, nil); err != nil {
+			return nil
+		}
+		m, err := p.p.Recv()
+		if err != nil {
+			p.failed(err)
+			return nil
+		}
+		p.capture(m, false)
+		msg = p.filter(m)
+	}
+	if p.s.lifecycleFunc() != nil {
+		msg.Lifecycle = mangos.Lifecycle{Read: time.Now()}
 	}
+	msg.Charge(p.s.recvBuf)
+	if cp, ok := p.p.(mangos.TranPipeCredit); ok {
+		// The peer may send another once this one is consumed.
+		if _, recv := cp.Credit(); recv >= 0 {
+			msg.SetRelease(func() { cp.Grant(1) })
+		}
+	}
+	atomic.StoreInt32(&p.holding, 1)
+	atomic.AddUint64(&p.msgsRecv, 1)
+	atomic.AddUint64(&p.bytesRecv, uint64(len(msg.Header)+len(msg.Body)))
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+	p.s.progress()
 	msg.Pipe = p
 	return msg
 }
 
+// filter returns the message, unless OptionRecvFilter rejects it, in
+// which case it is freed at once, and nil returned.
+func (p *pipe) filter(msg *mangos.Message) *mangos.Message {
+	f := p.s.filterFunc()
+	if f == nil || f(msg.Header, msg.Body) {
+		return msg
+	}
+	atomic.AddUint64(&p.s.filtered, 1)
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+	if cp, ok := p.p.(mangos.TranPipeCredit); ok {
+		// It is consumed, as far as the peer need know.
+		if _, recv := cp.Credit(); recv >= 0 {
+			cp.Grant(1)
+		}
+	}
+	msg.Free()
+	return nil
+}
+
+// capture passes the message to the socket's Capturer, if there is
+// one.  See OptionCapture.
+func (p *pipe) capture(msg *mangos.Message, sent bool) {
+	c := p.s.capturing()
+	if c == nil {
+		return
+	}
+	body := msg.Body
+	if len(msg.Bodies) != 0 {
+		// The frame has just the one body, as went over the wire.
+		body = make([]byte, 0, msg.BodyLen())
+		body = append(body, msg.Body...)
+		for _, b := range msg.Bodies {
+			body = append(body, b...)
+		}
+	}
+	c.Capture(&mangos.Frame{
+		Time:    time.Now(),
+		Pipe:    p.id,
+		Address: p.Address(),
+		Sent:    sent,
+		Header:  msg.Header,
+		Body:    body,
+	})
+}
+
+// written completes the recorded lifecycle of a message sent, which
+// the transport may have freed already, and reports it.
+func (p *pipe) written(lc mangos.Lifecycle) {
+	if f := p.s.lifecycleFunc(); f != nil {
+		lc.Written = time.Now()
+		f(p, lc)
+	}
+}
+
+// failed closes the pipe after a transport error, reporting it unless
+// the pipe was already being closed (which is likely the cause).
+func (p *pipe) failed(err error) {
+	p.Lock()
+	closed := p.closed
+	p.Unlock()
+	if !closed && err != mangos.ErrClosed {
+		if err == mangos.ErrChecksum {
+			atomic.AddUint64(&p.s.corrupt, 1)
+		}
+		p.s.logf("%v failed: %v", p, err)
+		p.s.reportError(err, p.d, p.l)
+	}
+	p.Close()
+}
+
+// modified counts, logs, and discards a message that the application
+// changed after sending it.  See OptionVerifyMessages.
+func (p *pipe) modified(msg *mangos.Message) {
+	atomic.AddUint64(&p.s.modified, 1)
+	p.s.logf("%v: message modified after SendMsg, not sent", p)
+	msg.Free()
+}
+
+// expired counts, and discards, a message that waited past its expiry.
+// See Message.SetExpiry.
+func (p *pipe) expired(msg *mangos.Message) {
+	atomic.AddUint64(&p.s.expired, 1)
+	msg.Free()
+}
+
+// tooLong counts, logs, and discards a message larger than the peer will
+// receive, returning true if it did.  Sent, the peer would only hang up.
+func (p *pipe) tooLong(msg *mangos.Message) bool {
+	n := len(msg.Header) + msg.BodyLen()
+	if p.peerMax <= 0 || n <= p.peerMax {
+		return false
+	}
+	atomic.AddUint64(&p.s.tooLong, 1)
+	p.s.logf("%v: message of %d bytes exceeds peer limit of %d, not sent",
+		p, n, p.peerMax)
+	msg.Free()
+	return true
+}
+
 func (p *pipe) Address() string {
 	switch {
 	case p.l != nil:
@@ -138,7 +368,7 @@ func (p *pipe) Address() string {
 
 func (p *pipe) GetOption(name string) (interface{}, error) {
 	val, err := p.p.GetOption(name)
-	if err == mangos.ErrBadOption {
+	if err == mangos.ErrBadOption || err == mangos.ErrBadProperty {
 		if p.d != nil {
 			val, err = p.d.GetOption(name)
 		} else if p.l != nil {
@@ -148,6 +378,28 @@ func (p *pipe) GetOption(name string) (interface{}, error) {
 	return val, err
 }
 
+// flush writes what the transport is holding back, if it does.  See
+// mangos.TranPipeFlusher.  A pipe that cannot be written to is closed.
+func (p *pipe) flush() {
+	if tp, ok := p.p.(mangos.TranPipeFlusher); ok {
+		if err := tp.Flush(); err != nil {
+			p.failed(err)
+		}
+	}
+}
+
+// retune applies a changed option to the live connection, if the
+// transport allows that.  See mangos.TranPipeSetter.
+func (p *pipe) retune(name string, value interface{}) {
+	tp, ok := p.p.(mangos.TranPipeSetter)
+	if !ok {
+		return
+	}
+	if err := tp.SetOption(name, value); err != nil && err != mangos.ErrBadOption {
+		p.s.logf("%v: cannot change %s: %v", p, name, err)
+	}
+}
+
 func (p *pipe) Dialer() mangos.Dialer {
 	if p.d == nil {
 		return nil
@@ -0,0 +1,139 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sync"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+func (s *socket) Serve(h mangos.Handler) error {
+	return Serve(s, h)
+}
+
+func (s *socket) ServeReply(h mangos.ReplyHandler) error {
+	return ServeReply(s, h)
+}
+
+// Serve implements Socket.Serve for s.  It is exported for sockets that
+// wrap another, so that what they receive goes by way of their own
+// RecvMsg.
+func Serve(s mangos.Socket, h mangos.Handler) error {
+	return serve(s, func(r receiver) error {
+		for {
+			m, err := next(s, r)
+			if m == nil {
+				return err
+			}
+			h(m)
+		}
+	})
+}
+
+// ServeReply implements Socket.ServeReply for s, as Serve does Serve.
+func ServeReply(s mangos.Socket, h mangos.ReplyHandler) error {
+	return serve(s, func(r receiver) error {
+		for {
+			m, err := next(s, r)
+			if m == nil {
+				return err
+			}
+			reply := h(m)
+			if reply == nil {
+				continue
+			}
+			if err = r.SendMsg(reply); err != nil {
+				reply.Free()
+				if err == mangos.ErrClosed {
+					return nil
+				}
+				logServe(s, "cannot send reply: %v", err)
+			}
+		}
+	})
+}
+
+// next receives the next message.  Errors that only lose a message are
+// reported, and receiving goes on; others stop serving, with nil for
+// ErrClosed, as closing is the usual way to stop.
+func next(s mangos.Socket, r receiver) (*mangos.Message, error) {
+	for {
+		m, err := r.RecvMsg()
+		switch err {
+		case nil:
+			return m, nil
+		case mangos.ErrRecvTimeout:
+		case mangos.ErrClosed:
+			return nil, nil
+		case mangos.ErrProtoState, mangos.ErrProtoOp:
+			return nil, err
+		default:
+			logServe(s, "cannot receive: %v", err)
+		}
+	}
+}
+
+// receiver is a Socket or a Context.
+type receiver interface {
+	RecvMsg() (*mangos.Message, error)
+	SendMsg(*mangos.Message) error
+}
+
+// serve runs the loop on OptionServeWorkers goroutines, each with a
+// context of its own where the protocol has them, and returns when all
+// have stopped, with the first error.
+func serve(s mangos.Socket, loop func(receiver) error) error {
+	n := 1
+	if v, err := s.GetOption(mangos.OptionServeWorkers); err == nil {
+		if w, ok := v.(int); ok && w > 1 {
+			n = w
+		}
+	}
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	for i := 0; i < n; i++ {
+		var r receiver = s
+		if c, err := s.OpenContext(); err == nil {
+			r = c
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := loop(r); err != nil {
+				once.Do(func() { first = err })
+			}
+			if c, ok := r.(mangos.Context); ok {
+				c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	return first
+}
+
+// logServe reports an error to the socket's Logger.
+func logServe(s mangos.Socket, format string, v ...interface{}) {
+	if c, ok := s.(*socket); ok {
+		c.logf(format, v...)
+		return
+	}
+	if o, err := s.GetOption(mangos.OptionLogger); err == nil {
+		if l, ok := o.(mangos.Logger); ok && l != nil {
+			l.Printf("mangos: "+format, v...)
+		}
+	}
+}
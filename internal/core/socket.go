@@ -15,9 +15,11 @@
 package core
 
 import (
-	"fmt"
+	"errors"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2"
@@ -40,20 +42,72 @@ type socket struct {
 
 	sync.Mutex
 
-	closed        bool          // true if Socket was closed at API level
-	reconnMinTime time.Duration // reconnect time after error or disconnect
-	reconnMaxTime time.Duration // max reconnect interval
-	maxRxSize     int           // max recv size
-	dialAsynch    bool          // asynchronous dialing?
+	closed        bool               // true if Socket was closed at API level
+	reconnMinTime time.Duration      // reconnect time after error or disconnect
+	reconnMaxTime time.Duration      // max reconnect interval
+	reconnPolicy  mangos.RetryPolicy // OptionReconnectPolicy
+	maxRxSize     int                // max recv size
+	dialAsynch    bool               // asynchronous dialing?
+	dialTimeout   time.Duration      // how long a synchronous dial keeps trying
+	serveWorkers  int                // handlers run at once, OptionServeWorkers
+	linger        time.Duration      // how long Close waits for queues to drain
+	strict        bool               // strict option checking?
+	dogTime       time.Duration      // watchdog interval
+	dogHook       mangos.WatchdogHook
+	dogStopq      chan struct{}
+	progressed    uint64       // messages moved, for watchdog
+	sent          uint64       // messages sent, for stats
+	received      uint64       // messages received, for stats
+	reconnects    uint64       // dialer reconnections, for stats
+	rejected      uint64       // connections refused, for stats
+	insecure      uint64       // connections not verified, for stats
+	invalid       uint64       // messages failing the validator, for stats
+	filtered      uint64       // messages discarded by the filter, for stats
+	hookDropped   uint64       // messages dropped by hooks, for stats
+	corrupt       uint64       // pipes failing checksums, for stats
+	expired       uint64       // messages past their expiry, for stats
+	tooLong       uint64       // messages too large for the peer, for stats
+	modified      uint64       // messages changed after sending, for stats
+	sendWaiters   int32        // callers blocked in SendMsg
+	draining      int32        // drainRefuse or drainAnswer if draining
+	verify        int32        // non-zero to seal messages, OptionVerifyMessages
+	capture       atomic.Value // capturer, for OptionCapture
+	lifecycle     atomic.Value // mangos.LifecycleFunc, for OptionLifecycle
+	recvFilter    atomic.Value // mangos.RecvFilterFunc, for OptionRecvFilter
+	clock         atomic.Value // clockBox, for OptionClock
+	closeq        chan struct{}
+	rateLock      sync.Mutex
+	rate          mangos.RateLimit // OptionSendRateLimit
+	rateChanged   chan struct{}    // closed when rate is set
+	msgRate       bucket
+	byteRate      bucket
+	fair          fairGate              // OptionFairSend
+	sendBuf       *mangos.BufferAccount // OptionMaxBufferBytes
+	recvBuf       *mangos.BufferAccount
 
 	listeners []*listener
 	dialers   []*dialer
 	pipes     map[*pipe]struct{}
 	pipehook  mangos.PipeEventHook
+	authhook  mangos.AuthHook
+	errhook   mangos.ErrorHandler
+	sendHooks []mangos.MessageHook
+	recvHooks []mangos.MessageHook
+	held      []*Message // batch left over when a receive hook failed
+	validator mangos.ValidatorFunc
+	logger    mangos.Logger
+	name      string // see OptionName
+	id        uint64 // registry order, for diagnostics
+	events    []mangos.Event
+	errs      []mangos.Event         // recent background errors
+	tcpOpts   map[string]interface{} // TCP options for dialers and listeners
+	tranDefs  map[string]interface{} // defaults for dialers and listeners
+	inherits  map[string]bool        // options passed on to dialers and listeners
 }
 
 type context struct {
 	mangos.ProtocolContext
+	s *socket
 }
 
 func (s *socket) addPipe(tp transport.Pipe, d *dialer, l *listener) {
@@ -66,18 +120,42 @@ func (s *socket) addPipe(tp transport.Pipe, d *dialer, l *listener) {
 
 	s.Lock()
 	ph := s.pipehook
+	ah := s.authhook
 	s.Unlock()
 
+	if ah != nil {
+		if err := ah(p); err != nil {
+			s.rejectPipe(p, err)
+			if p.d != nil {
+				go p.d.pipeClosed()
+			}
+			return
+		}
+	}
+
+	if v, err := tp.GetOption(mangos.OptionTLSInsecureSkipVerify); err == nil && v == true {
+		atomic.AddUint64(&s.insecure, 1)
+		s.logf("%v connected WITHOUT verifying the peer's certificate", p)
+	}
+
 	if ph != nil {
 		ph(mangos.PipeEventAttaching, p)
 	}
 
 	s.Lock()
-	if s.pipes == nil || s.proto.AddPipe(p) != nil {
+	if s.pipes == nil || (d != nil && d.isClosed()) || (l != nil && l.isClosed()) {
+		// The socket, or the endpoint, was closed meanwhile.
 		s.Unlock()
 		go p.Close()
 		return
 	}
+	if err := s.proto.AddPipe(p); err != nil {
+		s.Unlock()
+		s.logf("%v refused by protocol: %v", p, err)
+		s.reportError(err, d, l)
+		go p.Close()
+		return
+	}
 	s.pipes[p] = struct{}{}
 	if p.d != nil {
 		// This call resets the redial time in the dialer.  Its
@@ -86,14 +164,137 @@ func (s *socket) addPipe(tp transport.Pipe, d *dialer, l *listener) {
 		go p.d.pipeConnected()
 	}
 	s.Unlock()
+	s.event("%v attached", p)
 	if ph != nil {
 		ph(mangos.PipeEventAttached, p)
 	}
 }
 
+// rejectPipe reports a connection that was refused (for example, by
+// TLS peer verification or the AuthHook) to the pipe event hook, and
+// then discards it.  The pipe is never attached to the protocol.
+func (s *socket) rejectPipe(p *pipe, err error) {
+	p.Lock()
+	p.closed = true
+	p.Unlock()
+	p.p.Close()
+	atomic.AddUint64(&s.rejected, 1)
+	s.logf("%v rejected: %v", p, err)
+	s.reportError(err, p.d, p.l)
+
+	s.Lock()
+	ph := s.pipehook
+	s.Unlock()
+	if ph != nil {
+		ph(mangos.PipeEventRejected, p)
+	}
+	p.release()
+}
+
+// logf reports a background error to the logger, if there is one.
+// It is also kept as an event.
+func (s *socket) logf(format string, v ...interface{}) {
+	s.event(format, v...)
+	s.Lock()
+	l := s.logger
+	prefix := "mangos: "
+	if s.name != "" {
+		prefix += s.name + ": "
+	}
+	s.Unlock()
+	if l != nil {
+		l.Printf(prefix+format, v...)
+	}
+}
+
+// reportError passes a background error, from the dialer d or the
+// listener l, to the ErrorHandler, if there is one.  The handler is
+// called on its own goroutine, so that it may close the socket.  The
+// most recent errors are also kept, for SocketState.
+func (s *socket) reportError(err error, d *dialer, l *listener) {
+	s.Lock()
+	ev := mangos.Event{Time: time.Now(), Text: err.Error()}
+	if d != nil {
+		ev.Text = d.addr + ": " + ev.Text
+	} else if l != nil {
+		ev.Text = l.addr + ": " + ev.Text
+	}
+	if len(s.errs) == maxEvents {
+		copy(s.errs, s.errs[1:])
+		s.errs = s.errs[:maxEvents-1]
+	}
+	s.errs = append(s.errs, ev)
+	h := s.errhook
+	n := 0
+	for p := range s.pipes {
+		if (d != nil && p.d == d) || (l != nil && p.l == l) {
+			n++
+		}
+	}
+	s.Unlock()
+	if h == nil {
+		return
+	}
+	var ep mangos.EndpointInfo
+	if d != nil {
+		ep = d.info(n)
+	} else if l != nil {
+		ep = l.info(n)
+	}
+	go h(err, ep)
+}
+
+// countPipes returns the number of pipes attached from the listener.
+func (s *socket) countPipes(l *listener) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for p := range s.pipes {
+		if p.l == l {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *socket) Flush() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return mangos.ErrClosed
+	}
+	pipes := make([]*pipe, 0, len(s.pipes))
+	for p := range s.pipes {
+		pipes = append(pipes, p)
+	}
+	s.Unlock()
+	for _, p := range pipes {
+		p.flush()
+	}
+	return nil
+}
+
+// ClosePipe closes the pipe with the given ID, as listed by Pipes.
+func (s *socket) ClosePipe(id uint32) error {
+	s.Lock()
+	var found *pipe
+	for p := range s.pipes {
+		if p.id == id {
+			found = p
+			break
+		}
+	}
+	s.Unlock()
+	if found == nil {
+		return mangos.ErrClosed
+	}
+	return found.Close()
+}
+
 func (s *socket) remPipe(p *pipe) {
 
 	s.proto.RemovePipe(p)
+	s.event("%v detached", p)
 
 	s.Lock()
 	delete(s.pipes, p)
@@ -109,15 +310,64 @@ func newSocket(proto mangos.ProtocolBase) *socket {
 		reconnMinTime: defaultReconnMinTime,
 		reconnMaxTime: defaultReconnMaxTime,
 		maxRxSize:     defaultMaxRxSize,
+		serveWorkers:  1,
 		pipes:         make(map[*pipe]struct{}),
+		tcpOpts:       make(map[string]interface{}),
+		tranDefs:      make(map[string]interface{}),
+		inherits:      make(map[string]bool),
+		closeq:        make(chan struct{}),
+		rateChanged:   make(chan struct{}),
+		sendBuf:       mangos.NewBufferAccount(),
+		recvBuf:       mangos.NewBufferAccount(),
 	}
+	s.register()
 	return s
 }
 
 // MakeSocket is intended for use by Protocol implementations.  The intention
 // is that they can wrap this to provide a "proto.NewSocket()" implementation.
 func MakeSocket(proto mangos.ProtocolBase) mangos.Socket {
-	return newSocket(proto)
+	s := newSocket(proto)
+	s.applyDefaults()
+	return s
+}
+
+// applyDefaults sets the options given to mangos.SetDefaultOption, in
+// order of name, so that it is the same each time.  Those that neither
+// the protocol nor the socket know are kept for dialers and listeners.
+func (s *socket) applyDefaults() {
+	opts := mangos.DefaultOptions()
+	names := make([]string, 0, len(opts))
+	for n := range opts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		err := s.SetOption(n, opts[n])
+		switch {
+		case err == nil:
+		case errors.Is(err, mangos.ErrBadOption):
+			s.Lock()
+			s.tranDefs[n] = opts[n]
+			s.Unlock()
+		default:
+			s.logf("default for %s not applied: %v", n, err)
+		}
+	}
+}
+
+// transportDefaults returns the defaults for dialers and listeners that
+// were not set otherwise.
+func (s *socket) transportDefaults(options map[string]interface{}) map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	opts := make(map[string]interface{}, len(s.tranDefs))
+	for n, v := range s.tranDefs {
+		if _, ok := options[n]; !ok {
+			opts[n] = v
+		}
+	}
+	return opts
 }
 
 func (s *socket) Close() error {
@@ -134,23 +384,92 @@ func (s *socket) Close() error {
 	s.listeners = nil
 	s.dialers = nil
 	s.pipes = nil
+	s.closed = true
+	close(s.closeq)
+	if s.dogStopq != nil {
+		close(s.dogStopq)
+		s.dogStopq = nil
+	}
+	linger := s.linger
+	held := s.held
+	s.held = nil
 	s.Unlock()
 
+	for _, m := range held {
+		m.Free()
+	}
+
 	for _, l := range listeners {
-		l.Close()
+		l.shut()
 	}
 	for _, d := range dialers {
-		d.Close()
+		d.shut()
 	}
 
+	if linger > 0 {
+		s.drain(pipes, time.Now().Add(linger))
+		for p := range pipes {
+			p.flush()
+		}
+	}
 	for p := range pipes {
 		p.Close()
 	}
 
 	s.proto.Close()
+	s.unregister()
 	return nil
 }
 
+// drain waits until the send queues are flushed, or until the deadline
+// passes.  A message just taken from a queue by a pipe's sender is in
+// neither place until the write starts, so the queues must be seen to
+// be flushed twice, a little apart.
+func (s *socket) drain(pipes map[*pipe]struct{}, deadline time.Time) {
+	settled := false
+	for time.Now().Before(deadline) {
+		if !s.flushed(pipes) {
+			settled = false
+		} else if settled {
+			return
+		} else {
+			settled = true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// flushed returns true if the protocol has nothing queued for sending,
+// and no pipe is in the middle of sending.
+func (s *socket) flushed(pipes map[*pipe]struct{}) bool {
+	if s.protoStat(mangos.StatQueued) != 0 {
+		return false
+	}
+	for p := range pipes {
+		if atomic.LoadInt32(&p.sending) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// protoStat returns the named protocol counter, if the protocol keeps it.
+func (s *socket) protoStat(name string) uint64 {
+	if v, err := s.proto.GetOption(mangos.OptionProtocolStats); err == nil {
+		if m, ok := v.(map[string]uint64); ok {
+			return m[name]
+		}
+	}
+	return 0
+}
+
+func (ctx context) Cancel() error {
+	if c, ok := ctx.ProtocolContext.(mangos.ProtocolCanceler); ok {
+		return c.Cancel()
+	}
+	return mangos.ErrProtoOp
+}
+
 func (ctx context) Send(b []byte) error {
 	msg := mangos.NewMessage(len(b))
 	msg.Body = append(msg.Body, b...)
@@ -172,11 +491,228 @@ func (s *socket) OpenContext() (mangos.Context, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &context{c}, nil
+	return &context{c, s}, nil
 }
 
 func (s *socket) SendMsg(msg *Message) error {
-	return s.proto.SendMsg(msg)
+	return s.sendMsg(msg, s.proto)
+}
+
+// sendMsg sends the message to pc, which is the protocol or one of its
+// contexts, after the send hooks.
+func (s *socket) sendMsg(msg *Message, pc mangos.ProtocolContext) error {
+	if !s.sendable() {
+		return mangos.ErrClosed
+	}
+	msg, err := s.runHooks(s.hooks(&s.sendHooks), msg)
+	if msg == nil {
+		return err
+	}
+	atomic.AddInt32(&s.sendWaiters, 1)
+	err = s.push(msg, pc)
+	atomic.AddInt32(&s.sendWaiters, -1)
+	if err == nil {
+		s.progress()
+	}
+	return err
+}
+
+func (s *socket) SendMsgs(msgs []*Message) error {
+	if !s.sendable() {
+		freeMsgs(msgs)
+		return mangos.ErrClosed
+	}
+	hooks := s.hooks(&s.sendHooks)
+	atomic.AddInt32(&s.sendWaiters, 1)
+	defer atomic.AddInt32(&s.sendWaiters, -1)
+	defer s.progress()
+	for i, msg := range msgs {
+		msg, err := s.runHooks(hooks, msg)
+		if msg == nil {
+			if err != nil {
+				freeMsgs(msgs[i+1:])
+				return err
+			}
+			continue
+		}
+		if err = s.push(msg, s.proto); err != nil {
+			msg.Free()
+			freeMsgs(msgs[i+1:])
+			return err
+		}
+	}
+	return nil
+}
+
+// push hands a message, which has been through the send hooks, to pc,
+// the protocol or a context, once it has its turn under OptionFairSend,
+// OptionSendRateLimit and OptionMaxBufferBytes, and counts it as sent.
+func (s *socket) push(msg *Message, pc mangos.ProtocolContext) error {
+	s.seal(msg)
+	s.enqueued(msg)
+	turn, err := s.takeTurn(msg, pc)
+	if err == nil {
+		err = s.throttle(msg)
+	}
+	if err == nil {
+		err = s.charge(msg, pc)
+	}
+	if err == nil {
+		if err = pc.SendMsg(msg); err != nil {
+			msg.Uncharge()
+		}
+	}
+	if turn {
+		s.fair.leave()
+	}
+	if err == nil {
+		atomic.AddUint64(&s.sent, 1)
+	}
+	return err
+}
+
+// freeMsgs frees the messages that SendMsgs could not send.
+func freeMsgs(msgs []*Message) {
+	for _, m := range msgs {
+		m.Free()
+	}
+}
+
+// takeTurn waits, if OptionFairSend is set, for the turn of the message's
+// lane, returning true if it got it, when the caller must end its turn
+// with fair.leave once the message is sent.  The wait is limited by the
+// send deadline of pc, the protocol or context.
+func (s *socket) takeTurn(msg *Message, pc mangos.ProtocolContext) (bool, error) {
+	if !s.fair.isOn() {
+		return false, nil
+	}
+	var tq <-chan time.Time
+	if v, err := pc.GetOption(mangos.OptionSendDeadline); err == nil {
+		if d, ok := v.(time.Duration); ok && d > 0 {
+			tm := time.NewTimer(d)
+			defer tm.Stop()
+			tq = tm.C
+		}
+	}
+	return s.fair.enter(msg.Lane, s.closeq, tq)
+}
+
+// throttle waits, if need be, to keep within OptionSendRateLimit.  If
+// the limit is changed meanwhile, the wait is weighed again under the
+// new one.
+func (s *socket) throttle(msg *Message) error {
+	for {
+		s.rateLock.Lock()
+		if s.rate.Messages <= 0 && s.rate.Bytes <= 0 {
+			s.rateLock.Unlock()
+			return nil
+		}
+		now := time.Now()
+		wait := s.msgRate.reserve(1, now)
+		size := float64(len(msg.Header) + msg.BodyLen())
+		if w := s.byteRate.reserve(size, now); w > wait {
+			wait = w
+		}
+		changed := s.rateChanged
+		s.rateLock.Unlock()
+		if wait <= 0 {
+			return nil
+		}
+		tm := time.NewTimer(wait)
+		select {
+		case <-tm.C:
+			return nil
+		case <-changed:
+			tm.Stop()
+		case <-s.closeq:
+			tm.Stop()
+			return mangos.ErrClosed
+		}
+	}
+}
+
+// charge waits, if need be, for room within OptionMaxBufferBytes, and
+// then counts the message against the socket's send buffers.  The wait
+// is limited by the send deadline of pc, the protocol or context.
+func (s *socket) charge(msg *Message, pc mangos.ProtocolContext) error {
+	if s.sendBuf.Full() {
+		var tq <-chan time.Time
+		if v, err := pc.GetOption(mangos.OptionSendDeadline); err == nil {
+			if d, ok := v.(time.Duration); ok && d > 0 {
+				tq = time.After(d)
+			}
+		}
+		if err := s.sendBuf.Wait(s.closeq, tq); err != nil {
+			return err
+		}
+	}
+	msg.Charge(s.sendBuf)
+	return nil
+}
+
+// seal checksums the message, if OptionVerifyMessages is set, so that
+// the pipe can tell if the application changes it before it is sent.
+func (s *socket) seal(msg *Message) {
+	if atomic.LoadInt32(&s.verify) != 0 && msg != nil {
+		msg.Seal()
+	}
+}
+
+// capturer holds the Capturer of OptionCapture, which may be nil, as
+// atomic.Value cannot hold a nil interface.
+type capturer struct {
+	c mangos.Capturer
+}
+
+// capturing returns the Capturer, if there is one.
+func (s *socket) capturing() mangos.Capturer {
+	if v, ok := s.capture.Load().(capturer); ok {
+		return v.c
+	}
+	return nil
+}
+
+// clockBox holds the Clock of OptionClock, as the Clocks stored may be
+// of different types.
+type clockBox struct {
+	c mangos.Clock
+}
+
+// now returns the Clock of OptionClock, or mangos.SystemClock.
+func (s *socket) now() mangos.Clock {
+	if v, ok := s.clock.Load().(clockBox); ok && v.c != nil {
+		return v.c
+	}
+	return mangos.SystemClock
+}
+
+// lifecycleFunc returns the LifecycleFunc of OptionLifecycle, if any.
+func (s *socket) lifecycleFunc() mangos.LifecycleFunc {
+	f, _ := s.lifecycle.Load().(mangos.LifecycleFunc)
+	return f
+}
+
+// filterFunc returns the RecvFilterFunc of OptionRecvFilter, if any.
+func (s *socket) filterFunc() mangos.RecvFilterFunc {
+	f, _ := s.recvFilter.Load().(mangos.RecvFilterFunc)
+	return f
+}
+
+// enqueued starts the recorded lifecycle of a message being sent, if
+// there is a LifecycleFunc to give it to.
+func (s *socket) enqueued(msg *Message) {
+	if s.lifecycleFunc() != nil {
+		msg.Lifecycle = mangos.Lifecycle{Enqueued: time.Now()}
+	}
+}
+
+// delivered completes the recorded lifecycle of a message received,
+// and reports it.  It does nothing for a nil message.
+func (s *socket) delivered(msg *Message) {
+	if f := s.lifecycleFunc(); f != nil && msg != nil {
+		msg.Lifecycle.Delivered = time.Now()
+		f(msg.Pipe, msg.Lifecycle)
+	}
 }
 
 func (s *socket) Send(b []byte) error {
@@ -186,7 +722,176 @@ func (s *socket) Send(b []byte) error {
 }
 
 func (s *socket) RecvMsg() (*Message, error) {
-	return s.proto.RecvMsg()
+	if atomic.LoadInt32(&s.draining) != 0 {
+		return nil, mangos.ErrClosed
+	}
+	for {
+		var msg *Message
+		if held := s.takeHeld(1); held != nil {
+			msg = held[0]
+		} else {
+			m, err := s.proto.RecvMsg()
+			if err != nil {
+				return nil, err
+			}
+			msg = m
+			msg.Uncharge()
+			s.progress()
+		}
+		hooks := s.hooks(&s.recvHooks)
+		msg, err := s.runHooks(hooks, msg)
+		if err != nil {
+			return nil, err
+		}
+		if msg = s.validate(msg); msg != nil {
+			atomic.AddUint64(&s.received, 1)
+			s.delivered(msg)
+			return msg, nil
+		}
+	}
+}
+
+func (s *socket) RecvMsgs(max int) ([]*Message, error) {
+	if max < 1 {
+		return nil, mangos.ErrBadValue
+	}
+	if atomic.LoadInt32(&s.draining) != 0 {
+		return nil, mangos.ErrClosed
+	}
+	br, ok := s.proto.(mangos.ProtocolBatchReceiver)
+	if !ok {
+		msg, err := s.RecvMsg()
+		if err != nil {
+			return nil, err
+		}
+		return []*Message{msg}, nil
+	}
+	for {
+		msgs := s.takeHeld(max)
+		if msgs == nil {
+			var err error
+			if msgs, err = br.RecvMsgs(max); err != nil {
+				return nil, err
+			}
+			s.progress()
+			for _, msg := range msgs {
+				msg.Uncharge()
+			}
+		}
+		hooks := s.hooks(&s.recvHooks)
+		// Those passed are kept in place, at the front.
+		n := 0
+		var err error
+		for i, msg := range msgs {
+			if msg, err = s.runHooks(hooks, msg); err != nil {
+				s.hold(msgs[i+1:])
+				break
+			}
+			if msg = s.validate(msg); msg != nil {
+				s.delivered(msg)
+				msgs[n] = msg
+				n++
+			}
+		}
+		atomic.AddUint64(&s.received, uint64(n))
+		if err != nil {
+			if n == 0 {
+				return nil, err
+			}
+			return msgs[:n], err
+		}
+		if n > 0 {
+			return msgs[:n], nil
+		}
+	}
+}
+
+// hold keeps the messages of a batch behind one that a receive hook
+// failed, ahead of any held already, for the next receive.
+func (s *socket) hold(msgs []*Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		for _, m := range msgs {
+			m.Free()
+		}
+		return
+	}
+	held := make([]*Message, 0, len(msgs)+len(s.held))
+	held = append(held, msgs...)
+	s.held = append(held, s.held...)
+}
+
+// takeHeld returns up to max of the messages held, or nil if there are
+// none.
+func (s *socket) takeHeld(max int) []*Message {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.held) == 0 {
+		return nil
+	}
+	if max > len(s.held) {
+		max = len(s.held)
+	}
+	msgs := make([]*Message, max)
+	copy(msgs, s.held)
+	s.held = s.held[max:]
+	return msgs
+}
+
+// hooks returns the hooks now in the list, which is replaced rather than
+// changed when a hook is added, so the copy may be used unlocked.
+func (s *socket) hooks(list *[]mangos.MessageHook) []mangos.MessageHook {
+	s.Lock()
+	defer s.Unlock()
+	return *list
+}
+
+// validate returns the message if it passes the check of OptionValidator,
+// and otherwise discards it, refusing it to the sender if it can.  It
+// returns nil for a nil message.
+func (s *socket) validate(msg *Message) *Message {
+	s.Lock()
+	v := s.validator
+	s.Unlock()
+	if v == nil || msg == nil {
+		return msg
+	}
+	err := v(msg)
+	if err == nil {
+		return msg
+	}
+	atomic.AddUint64(&s.invalid, 1)
+	if msg.Pipe != nil {
+		s.logf("message from %v rejected: %v", msg.Pipe, err)
+	} else {
+		s.logf("message rejected: %v", err)
+	}
+	if err = msg.Nack(); err != nil {
+		s.logf("cannot refuse message: %v", err)
+	}
+	msg.Free()
+	return nil
+}
+
+// runHooks passes the message through the hooks in turn, returning what
+// the last returns, or nil and any error if one drops or fails it.
+func (s *socket) runHooks(hooks []mangos.MessageHook, msg *Message) (*Message, error) {
+	for _, h := range hooks {
+		m, err := h(msg)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			atomic.AddUint64(&s.hookDropped, 1)
+			return nil, nil
+		}
+		msg = m
+	}
+	return msg, nil
 }
 
 func (s *socket) Recv() ([]byte, error) {
@@ -200,21 +905,20 @@ func (s *socket) Recv() ([]byte, error) {
 	return b, nil
 }
 
-// String just emits a very high level debug.  This avoids
-// triggering race conditions from trying to print %v without
-// holding locks on structure members.
-func (s *socket) String() string {
-	return fmt.Sprintf("SOCKET[%s](%p)", s.proto.Info().SelfName, s)
+// scheme returns the transport scheme of the address, or "" if it has
+// none.
+func scheme(addr string) string {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i]
+	}
+	return ""
 }
 
 func (s *socket) getTransport(addr string) transport.Transport {
-	var i int
-
-	if i = strings.Index(addr, "://"); i < 0 {
+	scheme := scheme(addr)
+	if scheme == "" {
 		return nil
 	}
-	scheme := addr[:i]
-
 	return transport.GetTransport(scheme)
 }
 
@@ -232,20 +936,29 @@ func (s *socket) Dial(addr string) error {
 }
 
 func (s *socket) NewDialer(addr string, options map[string]interface{}) (mangos.Dialer, error) {
+	if strings.HasSuffix(scheme(addr), srvSuffix) {
+		return newSRVDialer(s, addr, options)
+	}
 	t := s.getTransport(addr)
 	if t == nil {
 		return nil, mangos.ErrBadTran
 	}
 	td, err := t.NewDialer(addr, s)
 	if err != nil {
-		return nil, err
+		return nil, transport.MapError(err)
 	}
 	d := &dialer{
 		d:             td,
 		s:             s,
 		reconnMinTime: s.reconnMinTime,
 		reconnMaxTime: s.reconnMaxTime,
+		reconnPolicy:  s.reconnPolicy,
+		asynch:        s.dialAsynch,
+		timeout:       s.dialTimeout,
+		weight:        1,
+		priority:      mangos.DefaultDialPriority,
 		addr:          addr,
+		own:           make(map[string]bool),
 	}
 	for n, v := range options {
 		switch n {
@@ -253,7 +966,15 @@ func (s *socket) NewDialer(addr string, options map[string]interface{}) (mangos.
 			fallthrough
 		case mangos.OptionMaxReconnectTime:
 			fallthrough
+		case mangos.OptionReconnectPolicy:
+			fallthrough
+		case mangos.OptionWeight:
+			fallthrough
+		case mangos.OptionDialPriority:
+			fallthrough
 		case mangos.OptionDialAsynch:
+			fallthrough
+		case mangos.OptionDialTimeout:
 			if err := d.SetOption(n, v); err != nil {
 				return nil, err
 			}
@@ -261,6 +982,7 @@ func (s *socket) NewDialer(addr string, options map[string]interface{}) (mangos.
 			if err = td.SetOption(n, v); err != nil {
 				return nil, err
 			}
+			d.own[n] = true
 		}
 	}
 	if _, ok := options[mangos.OptionMaxRecvSize]; !ok {
@@ -269,6 +991,19 @@ func (s *socket) NewDialer(addr string, options map[string]interface{}) (mangos.
 			return nil, err
 		}
 	}
+	for n, v := range s.tcpOptions() {
+		if _, ok := options[n]; !ok {
+			err = td.SetOption(n, v)
+			if err != nil && err != mangos.ErrBadOption {
+				return nil, err
+			}
+		}
+	}
+	for n, v := range s.transportDefaults(options) {
+		// Defaults apply to all transports, so those that do not
+		// suit this one are no fault of the caller's.
+		_ = td.SetOption(n, v)
+	}
 
 	s.Lock()
 	if s.closed {
@@ -281,6 +1016,9 @@ func (s *socket) NewDialer(addr string, options map[string]interface{}) (mangos.
 }
 
 func (s *socket) ListenOptions(addr string, options map[string]interface{}) error {
+	if addrs := splitAddrs(addr); len(addrs) > 1 {
+		return s.listenAll(addrs, options)
+	}
 	l, err := s.NewListener(addr, options)
 	if err != nil {
 		return err
@@ -288,6 +1026,79 @@ func (s *socket) ListenOptions(addr string, options map[string]interface{}) erro
 	return l.Listen()
 }
 
+// splitAddrs splits a comma separated list of addresses.  It is only
+// treated as a list if every element looks like an address, so that
+// commas elsewhere (such as in a websocket URL) are left alone.
+func splitAddrs(addr string) []string {
+	if !strings.Contains(addr, ",") {
+		return nil
+	}
+	addrs := strings.Split(addr, ",")
+	for i, a := range addrs {
+		addrs[i] = strings.TrimSpace(a)
+		if !strings.Contains(addrs[i], "://") {
+			return nil
+		}
+	}
+	return addrs
+}
+
+// listenAll listens on every address, or none of them.  All addresses
+// are tried, so that every failure can be reported together.
+func (s *socket) listenAll(addrs []string, options map[string]interface{}) error {
+	var errs mangos.AddrErrors
+	var good []mangos.Listener
+	for _, addr := range addrs {
+		l, err := s.NewListener(addr, options)
+		if err == nil {
+			if err = l.Listen(); err != nil {
+				l.Close()
+			}
+		}
+		if err != nil {
+			errs = append(errs, mangos.AddrError{Addr: addr, Err: err})
+			continue
+		}
+		good = append(good, l)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	for _, l := range good {
+		l.Close()
+	}
+	return errs
+}
+
+// remEndpoint removes a closed dialer or listener from the socket, and
+// closes its pipes.
+func (s *socket) remEndpoint(d *dialer, l *listener) {
+	var pipes []*pipe
+	s.Lock()
+	for i, od := range s.dialers {
+		if od == d {
+			s.dialers = append(s.dialers[:i], s.dialers[i+1:]...)
+			break
+		}
+	}
+	for i, ol := range s.listeners {
+		if ol == l {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			break
+		}
+	}
+	for p := range s.pipes {
+		if (d != nil && p.d == d) || (l != nil && p.l == l) {
+			pipes = append(pipes, p)
+		}
+	}
+	s.Unlock()
+
+	for _, p := range pipes {
+		p.Close()
+	}
+}
+
 func (s *socket) Listen(addr string) error {
 	return s.ListenOptions(addr, nil)
 }
@@ -304,13 +1115,29 @@ func (s *socket) NewListener(addr string, options map[string]interface{}) (mango
 	}
 	tl, err := t.NewListener(addr, s)
 	if err != nil {
-		return nil, err
+		return nil, transport.MapError(err)
 	}
+	l := &listener{
+		l:      tl,
+		s:      s,
+		addr:   addr,
+		weight: 1,
+		own:    make(map[string]bool),
+	}
+	l.accepts.set(0, 1)
 	for n, v := range options {
+		if local, err := l.setLocal(n, v); local {
+			if err != nil {
+				tl.Close()
+				return nil, err
+			}
+			continue
+		}
 		if err = tl.SetOption(n, v); err != nil {
 			tl.Close()
 			return nil, err
 		}
+		l.own[n] = true
 	}
 	if _, ok := options[mangos.OptionMaxRecvSize]; !ok {
 		err = tl.SetOption(mangos.OptionMaxRecvSize, s.maxRxSize)
@@ -318,10 +1145,17 @@ func (s *socket) NewListener(addr string, options map[string]interface{}) (mango
 			return nil, err
 		}
 	}
-	l := &listener{
-		l:    tl,
-		s:    s,
-		addr: addr,
+	for n, v := range s.tcpOptions() {
+		if _, ok := options[n]; !ok {
+			err = tl.SetOption(n, v)
+			if err != nil && err != mangos.ErrBadOption {
+				tl.Close()
+				return nil, err
+			}
+		}
+	}
+	for n, v := range s.transportDefaults(options) {
+		_ = tl.SetOption(n, v)
 	}
 	s.Lock()
 	if s.closed {
@@ -336,10 +1170,118 @@ func (s *socket) NewListener(addr string, options map[string]interface{}) (mango
 }
 
 func (s *socket) SetOption(name string, value interface{}) error {
-	if err := s.proto.SetOption(name, value); err != mangos.ErrBadOption {
-		return err
+	if name == mangos.OptionStrict {
+		// This is ours to enforce, so the protocol does not see it.
+		return s.setOption(name, value)
+	}
+	if name == mangos.OptionLogger || name == mangos.OptionClock {
+		// We use these, but so do protocols.
+		if err := s.setOption(name, value); err != nil {
+			return err
+		}
+		_ = s.proto.SetOption(name, value)
+		s.inherit(name, value)
+		return nil
+	}
+	s.Lock()
+	strict := s.strict
+	s.Unlock()
+	if strict {
+		if d, raw, ok := s.desc(); ok && !d.ValidOption(name, raw) {
+			return s.optionError(d, raw, name)
+		}
+	}
+
+	err := s.proto.SetOption(name, value)
+	if err == mangos.ErrBadOption {
+		err = s.setOption(name, value)
+	} else if err == nil && name == mangos.OptionBusyPoll {
+		// The TCP transports want this too, to turn off Nagle.
+		err = s.setOption(name, value)
+	}
+	if err == mangos.ErrBadOption {
+		if d, raw, ok := s.desc(); ok {
+			err = s.optionError(d, raw, name)
+		}
+	}
+	if err == nil {
+		s.inherit(name, value)
+	}
+	return err
+}
+
+// inherit passes an option that was changed on the socket on to its
+// dialers and listeners, and from them to their live pipes, except
+// where the dialer or listener has its own setting.  It is called
+// without the socket lock held, as changing live pipes needs it.
+func (s *socket) inherit(name string, value interface{}) {
+	s.Lock()
+	if !s.inherits[name] {
+		s.Unlock()
+		return
+	}
+	dialers := append([]*dialer(nil), s.dialers...)
+	listeners := append([]*listener(nil), s.listeners...)
+	s.Unlock()
+
+	for _, d := range dialers {
+		d.inherit(name, value)
+	}
+	for _, l := range listeners {
+		l.inherit(name, value)
+	}
+}
+
+// retune applies a changed transport option to the live pipes of a
+// dialer or listener, so that it takes effect without a reconnect.
+func (s *socket) retune(d *dialer, l *listener, name string, value interface{}) {
+	var live []*pipe
+	s.Lock()
+	for p := range s.pipes {
+		if (d != nil && p.d == d) || (l != nil && p.l == l) {
+			live = append(live, p)
+		}
+	}
+	s.Unlock()
+	for _, p := range live {
+		p.retune(name, value)
 	}
+}
 
+// desc returns the registry entry for the protocol, and whether the
+// socket is in raw mode.
+func (s *socket) desc() (mangos.ProtocolDesc, bool, bool) {
+	d, ok := mangos.ProtocolByNumber(s.proto.Info().Self)
+	raw := false
+	if v, err := s.proto.GetOption(mangos.OptionRaw); err == nil {
+		raw, _ = v.(bool)
+	}
+	return d, raw, ok
+}
+
+func (s *socket) optionError(d mangos.ProtocolDesc, raw bool, name string) error {
+	return &mangos.OptionError{
+		Option:   name,
+		Protocol: d.Name,
+		Raw:      raw,
+		Valid:    d.ValidOptions(raw),
+	}
+}
+
+// tcpOptions returns a copy of the TCP options set on the socket, for
+// passing on to a new dialer or listener.
+func (s *socket) tcpOptions() map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	opts := make(map[string]interface{}, len(s.tcpOpts))
+	for n, v := range s.tcpOpts {
+		opts[n] = v
+	}
+	return opts
+}
+
+// setOption handles the options common to all sockets.
+func (s *socket) setOption(name string, value interface{}) error {
 	s.Lock()
 	defer s.Unlock()
 
@@ -363,21 +1305,191 @@ func (s *socket) SetOption(name string, value interface{}) error {
 		} else {
 			return mangos.ErrBadValue
 		}
+	case mangos.OptionReconnectPolicy:
+		if v, ok := value.(mangos.RetryPolicy); ok || value == nil {
+			s.reconnPolicy = v
+		} else {
+			return mangos.ErrBadValue
+		}
 	case mangos.OptionDialAsynch:
 		if v, ok := value.(bool); ok {
 			s.dialAsynch = v
 		} else {
 			return mangos.ErrBadValue
 		}
+	case mangos.OptionDialTimeout:
+		if v, ok := value.(time.Duration); ok && v >= 0 {
+			s.dialTimeout = v
+		} else {
+			return mangos.ErrBadValue
+		}
+	case mangos.OptionNoDelay, mangos.OptionKeepAlive,
+		mangos.OptionKeepAliveTime, mangos.OptionKeepAliveInterval,
+		mangos.OptionKeepAliveCount, mangos.OptionSendBufferSize,
+		mangos.OptionRecvBufferSize:
+		if err := transport.ParseTCPOption(name, value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionBusyPoll:
+		if v, ok := value.(time.Duration); !ok || v < 0 {
+			return mangos.ErrBadValue
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionCompression:
+		if _, err := transport.ParseCompression(value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionCompressionThreshold:
+		if _, err := transport.ParseCompressionThreshold(value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionHeartbeatTime, mangos.OptionHeartbeatTimeout:
+		if _, err := transport.ParseHeartbeatTime(value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionHandshakeTimeout:
+		if _, err := transport.ParseHandshakeTimeout(value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionChunkSize:
+		if _, err := transport.ParseChunkSize(value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionCreditWindow:
+		if _, err := transport.ParseCreditWindow(value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionChecksum:
+		if _, err := transport.ParseChecksum(value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionCoalesceTime:
+		if _, err := transport.ParseCoalesceTime(value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionCoalesceBytes:
+		if _, err := transport.ParseCoalesceBytes(value); err != nil {
+			return err
+		}
+		s.tcpOpts[name] = value
+	case mangos.OptionWatchdogTime:
+		if v, ok := value.(time.Duration); ok && v >= 0 {
+			s.dogTime = v
+			s.startWatchdog()
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionLinger:
+		if v, ok := value.(time.Duration); ok && v >= 0 {
+			s.linger = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionLogger:
+		if v, ok := value.(mangos.Logger); ok || value == nil {
+			s.logger = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionName:
+		if v, ok := value.(string); ok {
+			s.name = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionStrict:
+		if v, ok := value.(bool); ok {
+			s.strict = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionSendRateLimit:
+		if v, ok := value.(mangos.RateLimit); ok && v.Messages >= 0 && v.Bytes >= 0 {
+			s.rateLock.Lock()
+			s.rate = v
+			s.msgRate.set(v.Messages, burst(v.Messages))
+			s.byteRate.set(v.Bytes, burst(v.Bytes))
+			close(s.rateChanged)
+			s.rateChanged = make(chan struct{})
+			s.rateLock.Unlock()
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionMaxBufferBytes:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.sendBuf.SetLimit(v)
+			s.recvBuf.SetLimit(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionFairSend:
+		if v, ok := value.(bool); ok {
+			s.fair.setOn(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionVerifyMessages:
+		if v, ok := value.(bool); ok {
+			var verify int32
+			if v {
+				verify = 1
+			}
+			atomic.StoreInt32(&s.verify, verify)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionCapture:
+		if v, ok := value.(mangos.Capturer); ok || value == nil {
+			s.capture.Store(capturer{v})
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionLifecycle:
+		if v, ok := value.(mangos.LifecycleFunc); ok || value == nil {
+			s.lifecycle.Store(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionClock:
+		if v, ok := value.(mangos.Clock); ok || value == nil {
+			s.clock.Store(clockBox{v})
+			s.tcpOpts[name] = v
+		} else {
+			return mangos.ErrBadValue
+		}
+	case mangos.OptionValidator:
+		if v, ok := value.(mangos.ValidatorFunc); ok || value == nil {
+			s.validator = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvFilter:
+		if v, ok := value.(mangos.RecvFilterFunc); ok || value == nil {
+			s.recvFilter.Store(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionServeWorkers:
+		if v, ok := value.(int); ok && v >= 1 {
+			s.serveWorkers = v
+			return nil
+		}
+		return mangos.ErrBadValue
 	default:
 		return mangos.ErrBadOption
 	}
-	for _, d := range s.dialers {
-		d.SetOption(name, value)
-	}
-	for _, l := range s.listeners {
-		l.SetOption(name, value)
-	}
+	// The remaining options are also passed on to the dialers and
+	// listeners; see inherit.
+	s.inherits[name] = true
 	return nil
 }
 
@@ -392,10 +1504,105 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 	switch name {
 	case mangos.OptionMaxRecvSize:
 		return s.maxRxSize, nil
+	case mangos.OptionNoDelay, mangos.OptionKeepAlive:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return true, nil
+	case mangos.OptionBusyPoll:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return time.Duration(0), nil
+	case mangos.OptionKeepAliveTime, mangos.OptionKeepAliveInterval:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return time.Duration(0), nil
+	case mangos.OptionSendBufferSize, mangos.OptionRecvBufferSize,
+		mangos.OptionKeepAliveCount:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return 0, nil
+	case mangos.OptionCompression:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return "", nil
+	case mangos.OptionCompressionThreshold:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return transport.DefaultCompressionThreshold, nil
+	case mangos.OptionHeartbeatTime, mangos.OptionHeartbeatTimeout,
+		mangos.OptionHandshakeTimeout:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return time.Duration(0), nil
+	case mangos.OptionChunkSize, mangos.OptionCreditWindow:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return 0, nil
+	case mangos.OptionChecksum:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return false, nil
+	case mangos.OptionCoalesceTime:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return time.Duration(0), nil
+	case mangos.OptionCoalesceBytes:
+		if v, ok := s.tcpOpts[name]; ok {
+			return v, nil
+		}
+		return transport.DefaultCoalesceBytes, nil
 	case mangos.OptionReconnectTime:
 		return s.reconnMinTime, nil
 	case mangos.OptionMaxReconnectTime:
 		return s.reconnMaxTime, nil
+	case mangos.OptionReconnectPolicy:
+		return s.reconnPolicy, nil
+	case mangos.OptionDialAsynch:
+		return s.dialAsynch, nil
+	case mangos.OptionDialTimeout:
+		return s.dialTimeout, nil
+	case mangos.OptionWatchdogTime:
+		return s.dogTime, nil
+	case mangos.OptionStrict:
+		return s.strict, nil
+	case mangos.OptionLinger:
+		return s.linger, nil
+	case mangos.OptionLogger:
+		return s.logger, nil
+	case mangos.OptionName:
+		return s.name, nil
+	case mangos.OptionVerifyMessages:
+		return atomic.LoadInt32(&s.verify) != 0, nil
+	case mangos.OptionCapture:
+		return s.capturing(), nil
+	case mangos.OptionLifecycle:
+		return s.lifecycleFunc(), nil
+	case mangos.OptionClock:
+		return s.now(), nil
+	case mangos.OptionValidator:
+		return s.validator, nil
+	case mangos.OptionRecvFilter:
+		return s.filterFunc(), nil
+	case mangos.OptionServeWorkers:
+		return s.serveWorkers, nil
+	case mangos.OptionSendRateLimit:
+		s.rateLock.Lock()
+		defer s.rateLock.Unlock()
+		return s.rate, nil
+	case mangos.OptionFairSend:
+		return s.fair.isOn(), nil
+	case mangos.OptionMaxBufferBytes:
+		return s.sendBuf.Limit(), nil
 	}
 	return nil, mangos.ErrBadOption
 }
@@ -404,6 +1611,34 @@ func (s *socket) Info() mangos.ProtocolInfo {
 	return s.proto.Info()
 }
 
+func (s *socket) SetAuthHook(newhook mangos.AuthHook) mangos.AuthHook {
+	s.Lock()
+	oldhook := s.authhook
+	s.authhook = newhook
+	s.Unlock()
+	return oldhook
+}
+
+func (s *socket) SetErrorHandler(newhook mangos.ErrorHandler) mangos.ErrorHandler {
+	s.Lock()
+	oldhook := s.errhook
+	s.errhook = newhook
+	s.Unlock()
+	return oldhook
+}
+
+func (s *socket) AddSendHook(hook mangos.MessageHook) {
+	s.Lock()
+	s.sendHooks = append(s.sendHooks[:len(s.sendHooks):len(s.sendHooks)], hook)
+	s.Unlock()
+}
+
+func (s *socket) AddRecvHook(hook mangos.MessageHook) {
+	s.Lock()
+	s.recvHooks = append(s.recvHooks[:len(s.recvHooks):len(s.recvHooks)], hook)
+	s.Unlock()
+}
+
 func (s *socket) SetPipeEventHook(newhook mangos.PipeEventHook) mangos.PipeEventHook {
 	s.Lock()
 	oldhook := s.pipehook
@@ -0,0 +1,267 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// srvSuffix marks a scheme whose address is the name of DNS SRV records,
+// as in "tcp+srv://_sp._tcp.example.com".
+const srvSuffix = "+srv"
+
+// defaultResolveInterval is the default for OptionResolveInterval.
+const defaultResolveInterval = time.Second * 30
+
+// lookupSRV is the default for OptionSRVLookup.
+func lookupSRV(name string) ([]*net.SRV, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	return addrs, err
+}
+
+// srvDialer dials each of the targets of a set of SRV records, with a
+// dialer of its own, looking the records up again from time to time to
+// follow changes in them.
+type srvDialer struct {
+	sync.Mutex
+	s        *socket
+	addr     string
+	scheme   string // of the targets
+	name     string // of the records
+	options  map[string]interface{}
+	lookup   mangos.SRVLookupFunc
+	interval time.Duration
+	dialers  map[string]mangos.Dialer // by target address
+	active   bool
+	closed   bool
+	closeq   chan struct{}
+}
+
+func newSRVDialer(s *socket, addr string, options map[string]interface{}) (*srvDialer, error) {
+	sch := scheme(addr)
+	d := &srvDialer{
+		s:        s,
+		addr:     addr,
+		scheme:   strings.TrimSuffix(sch, srvSuffix),
+		name:     addr[len(sch+"://"):],
+		options:  make(map[string]interface{}),
+		lookup:   lookupSRV,
+		interval: defaultResolveInterval,
+		dialers:  make(map[string]mangos.Dialer),
+		closeq:   make(chan struct{}),
+	}
+	if d.name == "" {
+		return nil, mangos.ErrBadAddr
+	}
+	for n, v := range options {
+		if err := d.SetOption(n, v); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Dial looks the records up, and starts dialing every target.  The
+// targets are dialed asynchronously, so that one being down does not
+// stop the others being used.
+func (d *srvDialer) Dial() error {
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return mangos.ErrClosed
+	}
+	if d.active {
+		d.Unlock()
+		return mangos.ErrAddrInUse
+	}
+	lookup := d.lookup
+	d.Unlock()
+
+	records, err := lookup(d.name)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return mangos.ErrClosed
+	}
+	if err = d.update(records); err != nil {
+		d.closeAll()
+		return err
+	}
+	d.active = true
+	go d.refresh()
+	return nil
+}
+
+// refresh looks the records up again at each interval.  If the lookup
+// fails, the targets are left as they were, rather than being dropped
+// for what may be a passing fault in DNS.
+func (d *srvDialer) refresh() {
+	for {
+		d.Lock()
+		interval := d.interval
+		lookup := d.lookup
+		d.Unlock()
+
+		select {
+		case <-time.After(interval):
+		case <-d.closeq:
+			return
+		case <-d.s.closeq:
+			return
+		}
+		records, err := lookup(d.name)
+		if err != nil {
+			continue
+		}
+		d.Lock()
+		if d.closed {
+			d.Unlock()
+			return
+		}
+		_ = d.update(records)
+		d.Unlock()
+	}
+}
+
+// update starts dialing the targets not already being dialed, and
+// closes the dialers of those no longer listed.  Records of worse SRV
+// priority are given a worse OptionDialPriority, and their SRV weight
+// becomes OptionWeight, unless the options set them.  The caller must
+// hold the lock.
+func (d *srvDialer) update(records []*net.SRV) error {
+	want := make(map[string]*net.SRV)
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		if host == "" {
+			continue // "." means there is no such service
+		}
+		addr := d.scheme + "://" +
+			net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+		want[addr] = r
+	}
+	for addr, dd := range d.dialers {
+		if _, ok := want[addr]; !ok {
+			_ = dd.Close()
+			delete(d.dialers, addr)
+		}
+	}
+	var err error
+	for addr, r := range want {
+		if _, ok := d.dialers[addr]; ok {
+			continue
+		}
+		options := map[string]interface{}{
+			mangos.OptionDialPriority: mangos.DefaultDialPriority +
+				int(r.Priority),
+			mangos.OptionWeight: int(r.Weight),
+		}
+		if r.Weight == 0 {
+			options[mangos.OptionWeight] = 1
+		}
+		for n, v := range d.options {
+			options[n] = v
+		}
+		options[mangos.OptionDialAsynch] = true
+
+		dd, e := d.s.NewDialer(addr, options)
+		if e == nil {
+			if e = dd.Dial(); e != nil {
+				_ = dd.Close()
+			}
+		}
+		if e != nil {
+			err = e
+			continue
+		}
+		d.dialers[addr] = dd
+	}
+	return err
+}
+
+// closeAll closes the dialers of all the targets.  The caller must hold
+// the lock.
+func (d *srvDialer) closeAll() {
+	for addr, dd := range d.dialers {
+		_ = dd.Close()
+		delete(d.dialers, addr)
+	}
+}
+
+func (d *srvDialer) Close() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return mangos.ErrClosed
+	}
+	d.closed = true
+	close(d.closeq)
+	d.closeAll()
+	return nil
+}
+
+func (d *srvDialer) Address() string {
+	return d.addr
+}
+
+func (d *srvDialer) SetOption(n string, v interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+	switch n {
+	case mangos.OptionResolveInterval:
+		if t, ok := v.(time.Duration); ok && t > 0 {
+			d.interval = t
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionSRVLookup:
+		if f, ok := v.(mangos.SRVLookupFunc); ok && f != nil {
+			d.lookup = f
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+	if d.active {
+		return mangos.ErrBadOption
+	}
+	d.options[n] = v
+	return nil
+}
+
+func (d *srvDialer) GetOption(n string) (interface{}, error) {
+	d.Lock()
+	defer d.Unlock()
+	switch n {
+	case mangos.OptionResolveInterval:
+		return d.interval, nil
+	case mangos.OptionSRVLookup:
+		return d.lookup, nil
+	}
+	if v, ok := d.options[n]; ok {
+		return v, nil
+	}
+	for _, dd := range d.dialers {
+		return dd.GetOption(n)
+	}
+	return nil, mangos.ErrBadOption
+}
@@ -0,0 +1,279 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// maxEvents is how many recent events each socket remembers.
+const maxEvents = 32
+
+// The registry keeps every socket that has not yet been closed, so
+// that diagnostic tools can find them.  Sockets that are discarded
+// without being closed stay here, which is one more reason to close
+// them.
+var registry struct {
+	sync.Mutex
+	sockets map[*socket]struct{}
+	nextID  uint64
+}
+
+func init() {
+	registry.sockets = make(map[*socket]struct{})
+}
+
+func (s *socket) register() {
+	registry.Lock()
+	registry.nextID++
+	s.id = registry.nextID
+	registry.sockets[s] = struct{}{}
+	registry.Unlock()
+}
+
+func (s *socket) unregister() {
+	registry.Lock()
+	delete(registry.sockets, s)
+	registry.Unlock()
+}
+
+// event records something of note in the socket's recent history.
+func (s *socket) event(format string, v ...interface{}) {
+	ev := mangos.Event{Time: time.Now(), Text: fmt.Sprintf(format, v...)}
+	s.Lock()
+	if len(s.events) == maxEvents {
+		copy(s.events, s.events[1:])
+		s.events = s.events[:maxEvents-1]
+	}
+	s.events = append(s.events, ev)
+	s.Unlock()
+}
+
+// Sockets returns the state of every open socket in the process, in
+// order of creation.  It is used by the dump package.
+func Sockets() []mangos.SocketState {
+	registry.Lock()
+	socks := make([]*socket, 0, len(registry.sockets))
+	for s := range registry.sockets {
+		socks = append(socks, s)
+	}
+	registry.Unlock()
+
+	sort.Slice(socks, func(i, j int) bool { return socks[i].id < socks[j].id })
+	states := make([]mangos.SocketState, 0, len(socks))
+	for _, s := range socks {
+		states = append(states, s.state())
+	}
+	return states
+}
+
+// Lookup returns the open socket with the given ID, as reported in its
+// SocketState, along with its state.  It is used by the admin package.
+func Lookup(id uint64) (mangos.Socket, mangos.SocketState, bool) {
+	registry.Lock()
+	var found *socket
+	for s := range registry.sockets {
+		if s.id == id {
+			found = s
+			break
+		}
+	}
+	registry.Unlock()
+	if found == nil {
+		return nil, mangos.SocketState{}, false
+	}
+	return found, found.state(), true
+}
+
+func (s *socket) state() mangos.SocketState {
+	info := s.proto.Info()
+	st := mangos.SocketState{
+		ID:       s.id,
+		Protocol: info.SelfName,
+		Peer:     info.PeerName,
+		Stats:    s.Stats(),
+	}
+
+	// The pipes, dialers, and listeners each have locks of their own,
+	// which must not be taken while holding the socket lock.
+	s.Lock()
+	st.Name = s.name
+	st.Closed = s.closed
+	st.Events = append([]mangos.Event(nil), s.events...)
+	st.Errors = append([]mangos.Event(nil), s.errs...)
+	pipes := make([]*pipe, 0, len(s.pipes))
+	for p := range s.pipes {
+		pipes = append(pipes, p)
+	}
+	dialers := append([]*dialer(nil), s.dialers...)
+	listeners := append([]*listener(nil), s.listeners...)
+	s.Unlock()
+
+	sort.Slice(pipes, func(i, j int) bool { return pipes[i].id < pipes[j].id })
+	for _, p := range pipes {
+		p.Lock()
+		closed := p.closed
+		p.Unlock()
+		st.Pipes = append(st.Pipes, mangos.PipeState{
+			ID:      p.id,
+			Address: p.Address(),
+			Role:    p.role(),
+			Remote:  p.remote(),
+			Sending: atomic.LoadInt32(&p.sending) != 0,
+			Holding: atomic.LoadInt32(&p.holding) != 0,
+			Closed:  closed,
+		})
+	}
+	for _, d := range dialers {
+		st.Dialers = append(st.Dialers, mangos.DialerState{
+			Address: d.addr,
+			State:   d.state(),
+		})
+	}
+	for _, l := range listeners {
+		l.Lock()
+		closed := l.closed
+		l.Unlock()
+		st.Listeners = append(st.Listeners, mangos.ListenerState{
+			Address: l.Address(),
+			Closed:  closed,
+		})
+	}
+	return st
+}
+
+// sortedPipes returns the socket's pipes in order of ID.
+func (s *socket) sortedPipes() []*pipe {
+	s.Lock()
+	pipes := make([]*pipe, 0, len(s.pipes))
+	for p := range s.pipes {
+		pipes = append(pipes, p)
+	}
+	s.Unlock()
+	sort.Slice(pipes, func(i, j int) bool { return pipes[i].id < pipes[j].id })
+	return pipes
+}
+
+func (s *socket) Pipes() []mangos.PipeInfo {
+	pipes := s.sortedPipes()
+	var stats map[uint32]map[string]uint64
+	if v, err := s.proto.GetOption(mangos.OptionPipeStats); err == nil {
+		stats, _ = v.(map[uint32]map[string]uint64)
+	}
+	infos := make([]mangos.PipeInfo, 0, len(pipes))
+	for _, p := range pipes {
+		p.Lock()
+		closed := p.closed
+		p.Unlock()
+		info := mangos.PipeInfo{
+			ID:        p.id,
+			Address:   p.Address(),
+			Role:      p.role(),
+			State:     stateName(closed),
+			Connected: p.since,
+			MsgsSent:  atomic.LoadUint64(&p.msgsSent),
+			MsgsRecv:  atomic.LoadUint64(&p.msgsRecv),
+			BytesSent: atomic.LoadUint64(&p.bytesSent),
+			BytesRecv: atomic.LoadUint64(&p.bytesRecv),
+		}
+		info.LastActive = time.Unix(0, atomic.LoadInt64(&p.active))
+		if ps, ok := stats[p.id]; ok {
+			info.Queued = ps[mangos.StatQueued]
+			info.Dropped = ps[mangos.StatDropped]
+		}
+		info.Scheme = scheme(info.Address)
+		if v, err := p.p.GetOption(mangos.OptionLocalAddr); err == nil {
+			info.LocalAddr, _ = v.(net.Addr)
+		}
+		if v, err := p.p.GetOption(mangos.OptionRemoteAddr); err == nil {
+			info.RemoteAddr, _ = v.(net.Addr)
+		}
+		if v, err := p.p.GetOption(mangos.OptionTLSConnState); err == nil {
+			if cs, ok := v.(tls.ConnectionState); ok {
+				info.TLS = &cs
+			}
+		}
+		info.SendCredit, info.RecvCredit = -1, -1
+		if cp, ok := p.p.(mangos.TranPipeCredit); ok {
+			info.SendCredit, info.RecvCredit = cp.Credit()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (s *socket) Debug() mangos.ProtocolState {
+	var st mangos.ProtocolState
+	if d, ok := s.proto.(mangos.ProtocolDebugger); ok {
+		st = d.Debug()
+	}
+	st.Protocol = s.proto.Info().SelfName
+	_, st.Raw, _ = s.desc()
+	return st
+}
+
+func (s *socket) Endpoints() []mangos.EndpointInfo {
+	pipes := s.sortedPipes()
+	s.Lock()
+	dialers := append([]*dialer(nil), s.dialers...)
+	listeners := append([]*listener(nil), s.listeners...)
+	s.Unlock()
+
+	counts := make(map[interface{}]int)
+	for _, p := range pipes {
+		if p.d != nil {
+			counts[p.d]++
+		} else if p.l != nil {
+			counts[p.l]++
+		}
+	}
+	infos := make([]mangos.EndpointInfo, 0, len(dialers)+len(listeners))
+	for _, d := range dialers {
+		infos = append(infos, d.info(counts[d]))
+	}
+	for _, l := range listeners {
+		infos = append(infos, l.info(counts[l]))
+	}
+	return infos
+}
+
+func (d *dialer) info(pipes int) mangos.EndpointInfo {
+	return mangos.EndpointInfo{
+		Address: d.addr,
+		Scheme:  scheme(d.addr),
+		Role:    "dialer",
+		State:   d.state(),
+		Pipes:   pipes,
+	}
+}
+
+func (l *listener) info(pipes int) mangos.EndpointInfo {
+	addr := l.Address()
+	return mangos.EndpointInfo{
+		Address: addr,
+		Scheme:  scheme(addr),
+		Role:    "listener",
+		State:   stateName(l.isClosed()),
+		Pipes:   pipes,
+	}
+}
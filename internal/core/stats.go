@@ -0,0 +1,57 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sync/atomic"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+func (s *socket) Stats() mangos.Stats {
+	st := mangos.Stats{
+		Sent:        atomic.LoadUint64(&s.sent),
+		Received:    atomic.LoadUint64(&s.received),
+		Reconnects:  atomic.LoadUint64(&s.reconnects),
+		Rejected:    atomic.LoadUint64(&s.rejected),
+		Invalid:     atomic.LoadUint64(&s.invalid),
+		Filtered:    atomic.LoadUint64(&s.filtered),
+		HookDropped: atomic.LoadUint64(&s.hookDropped),
+		Corrupt:     atomic.LoadUint64(&s.corrupt),
+		Expired:     atomic.LoadUint64(&s.expired),
+		TooLong:     atomic.LoadUint64(&s.tooLong),
+		Modified:    atomic.LoadUint64(&s.modified),
+		Insecure:    atomic.LoadUint64(&s.insecure),
+		Buffered:    s.sendBuf.Used() + s.recvBuf.Used(),
+	}
+
+	// Protocols keeping counters of their own report them with a
+	// read-only option.  This passes through the cooked wrappers,
+	// which is why it is not a method.
+	if v, err := s.proto.GetOption(mangos.OptionProtocolStats); err == nil {
+		if m, ok := v.(map[string]uint64); ok {
+			st.Protocol = m
+			st.Dropped = m[mangos.StatDropped]
+			st.Queued = int(m[mangos.StatQueued])
+		}
+	}
+
+	s.Lock()
+	st.Pipes = len(s.pipes)
+	st.Dialers = len(s.dialers)
+	st.Listeners = len(s.listeners)
+	s.Unlock()
+	return st
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sync/atomic"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// The watchdog does not look inside protocol queues.  Instead it relies
+// on the observation that idle pipes have their protocol receiver parked
+// inside RecvMsg and their sender outside of SendMsg.  A pipe reader that
+// is holding a message it cannot hand off, a transport write that does
+// not complete, or an application caller stuck in SendMsg all mean that
+// work is outstanding.  If that persists without any progress, we have
+// a stall.
+
+// progress notes that a message moved through the socket.
+func (s *socket) progress() {
+	atomic.AddUint64(&s.progressed, 1)
+}
+
+// pending returns true if any work is outstanding on the socket.
+func (s *socket) pending() bool {
+	if atomic.LoadInt32(&s.sendWaiters) > 0 {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	for p := range s.pipes {
+		if atomic.LoadInt32(&p.sending) != 0 ||
+			atomic.LoadInt32(&p.holding) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *socket) watchdog(interval time.Duration, stopq chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	last := atomic.LoadUint64(&s.progressed)
+	fired := false
+	for {
+		select {
+		case <-stopq:
+			return
+		case <-tick.C:
+		}
+		now := atomic.LoadUint64(&s.progressed)
+		if now != last {
+			last = now
+			fired = false
+			continue
+		}
+		if fired || !s.pending() {
+			continue
+		}
+		fired = true
+		s.Lock()
+		hook := s.dogHook
+		s.Unlock()
+		if hook != nil {
+			go hook(s)
+		}
+	}
+}
+
+// startWatchdog (re)starts the watchdog.  The socket lock must be held.
+func (s *socket) startWatchdog() {
+	if s.dogStopq != nil {
+		close(s.dogStopq)
+		s.dogStopq = nil
+	}
+	if s.dogTime > 0 && !s.closed {
+		s.dogStopq = make(chan struct{})
+		go s.watchdog(s.dogTime, s.dogStopq)
+	}
+}
+
+func (s *socket) SetWatchdogHook(newhook mangos.WatchdogHook) mangos.WatchdogHook {
+	s.Lock()
+	oldhook := s.dogHook
+	s.dogHook = newhook
+	s.Unlock()
+	return oldhook
+}
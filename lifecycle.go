@@ -0,0 +1,49 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"time"
+)
+
+// Lifecycle records when a message passed each stage on its way through
+// a socket, for finding out where latency builds up: in the socket's
+// queues (Enqueued to Written), in the transport and the peer (between
+// the sender's Written and the receiver's Read, which are only
+// comparable if the clocks agree), or waiting for the application
+// (Read to Delivered).  It is only kept while there is a LifecycleFunc
+// (see OptionLifecycle); otherwise the times are all zero.  Stages a
+// message did not pass through, such as Read for one sent, are zero.
+type Lifecycle struct {
+	// Enqueued is when SendMsg accepted the message.
+	Enqueued time.Time
+
+	// Written is when the transport finished writing it to a pipe.
+	Written time.Time
+
+	// Read is when the transport read it from a pipe.
+	Read time.Time
+
+	// Delivered is when RecvMsg returned it to the application.
+	Delivered time.Time
+}
+
+// LifecycleFunc is given the Lifecycle of each message a socket sends,
+// once it has been written to the pipe p, and of each it receives, once
+// it has been delivered; see OptionLifecycle.  It is called on the
+// goroutine sending or receiving, possibly several at once, and so
+// should be quick.  The message itself may already be gone, and is not
+// passed.
+type LifecycleFunc func(p Pipe, lc Lifecycle)
@@ -18,7 +18,8 @@ package mangos
 // and address.
 type Listener interface {
 	// Close closes the listener, and removes it from any active socket.
-	// Further operations on the Listener will return ErrClosed.
+	// The pipes it made are closed too, while the rest of the socket
+	// carries on.  Further operations on the Listener will return ErrClosed.
 	Close() error
 
 	// Listen starts listening for new connectons on the address.
@@ -34,3 +35,31 @@ type Listener interface {
 	// GetOption gets an option value from the Listener.
 	GetOption(name string) (interface{}, error)
 }
+
+// AddrError reports a failure to listen on one address, when several
+// were given, separated by commas, to Socket.Listen or ListenOptions.
+type AddrError struct {
+	Addr string
+	Err  error
+}
+
+func (e AddrError) Error() string {
+	return e.Addr + ": " + e.Err.Error()
+}
+
+// AddrErrors is returned by Socket.Listen and ListenOptions when given
+// several addresses, and listening on any of them failed.  It holds
+// one AddrError for each failed address.  In that case the socket is not
+// left listening on any of the addresses.
+type AddrErrors []AddrError
+
+func (e AddrErrors) Error() string {
+	s := ""
+	for i, ae := range e {
+		if i > 0 {
+			s += "; "
+		}
+		s += ae.Error()
+	}
+	return s
+}
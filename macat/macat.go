@@ -20,8 +20,10 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
@@ -64,6 +66,8 @@ var certFile string
 var keyFile string
 var caFile string
 var noVerifyTLS bool
+var readStdin bool
+var stdin = bufio.NewReader(os.Stdin)
 
 func setSocket(f func() (mangos.Socket, error)) error {
 	var err error
@@ -116,7 +120,7 @@ func addSub(sub string) error {
 }
 
 func setSendData(data string) error {
-	if sendData != nil {
+	if sendData != nil || readStdin {
 		return errors.New("data or file already set")
 	}
 	sendData = []byte(data)
@@ -124,7 +128,7 @@ func setSendData(data string) error {
 }
 
 func setSendFile(path string) error {
-	if sendData != nil {
+	if sendData != nil || readStdin {
 		return errors.New("data or file already set")
 	}
 	f, err := os.Open(path)
@@ -149,6 +153,7 @@ func setFormat(f string) error {
 	case "ascii":
 	case "quoted":
 	case "msgpack":
+	case "hex":
 	default:
 		return errors.New("invalid format type")
 	}
@@ -312,6 +317,10 @@ func init() {
 		func() error {
 			return setFormat("msgpack")
 		})
+	goopt.NoArg([]string{"--hex", "-H"}, "Hexadecimal output, one per line",
+		func() error {
+			return setFormat("hex")
+		})
 
 	goopt.ReqArg([]string{"--interval", "-i"}, "SEC",
 		"Send DATA every SEC seconds",
@@ -327,6 +336,15 @@ func init() {
 		setSendData)
 	goopt.ReqArg([]string{"--file", "-F"}, "FILE", "Send contents of FILE",
 		setSendFile)
+	goopt.NoArg([]string{"--stdin", "-I"},
+		"Send messages read from stdin, in the output format",
+		func() error {
+			if sendData != nil {
+				return errors.New("data or file already set")
+			}
+			readStdin = true
+			return nil
+		})
 
 	goopt.ReqArg([]string{"--cert", "-E"}, "FILE",
 		"Use certificate in FILE for SSL/TLS", setCert)
@@ -413,10 +431,95 @@ func printMsg(msg *mangos.Message) {
 		}
 		bw.Write(enc)
 		bw.Write(msg.Body)
+
+	case "hex":
+		bw.WriteString(hex.EncodeToString(msg.Body))
+		bw.WriteString("\n")
 	}
 	bw.Flush()
 }
 
+// readMsg reads the next message to send from stdin.  The encoding
+// follows the output format, so that the output of one macat can be
+// replayed by another.  With the raw format (or none), the whole of
+// stdin is a single message.
+func readMsg() ([]byte, error) {
+	switch printFormat {
+	case "ascii", "quoted", "hex":
+		line, err := stdin.ReadString('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch printFormat {
+		case "quoted":
+			s, err := strconv.Unquote("\"" + line + "\"")
+			if err != nil {
+				return nil, errors.New("bad quoted input")
+			}
+			return []byte(s), nil
+		case "hex":
+			b, err := hex.DecodeString(strings.Replace(line, " ", "", -1))
+			if err != nil {
+				return nil, errors.New("bad hex input")
+			}
+			return b, nil
+		}
+		return []byte(line), nil
+
+	case "msgpack":
+		var n int
+		c, err := stdin.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		var lb []byte
+		switch c {
+		case 0xc4:
+			lb = make([]byte, 1)
+		case 0xc5:
+			lb = make([]byte, 2)
+		case 0xc6:
+			lb = make([]byte, 4)
+		default:
+			return nil, errors.New("bad msgpack input")
+		}
+		if _, err = io.ReadFull(stdin, lb); err != nil {
+			return nil, err
+		}
+		for _, b := range lb {
+			n = n<<8 | int(b)
+		}
+		b := make([]byte, n)
+		if _, err = io.ReadFull(stdin, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	b, err := ioutil.ReadAll(stdin)
+	if err == nil && len(b) == 0 {
+		err = io.EOF
+	}
+	return b, err
+}
+
+// nextData returns the next message to send, or false if there are no
+// more.  Without --stdin, the same data is sent every time.
+func nextData() ([]byte, bool) {
+	if !readStdin {
+		return sendData, true
+	}
+	b, err := readMsg()
+	if err == io.EOF {
+		return nil, false
+	}
+	if err != nil {
+		fatalf("Reading stdin: %v", err)
+	}
+	return b, true
+}
+
 func recvLoop(sock mangos.Socket) {
 	for {
 		msg, err := sock.RecvMsg()
@@ -435,12 +538,16 @@ func recvLoop(sock mangos.Socket) {
 }
 
 func sendLoop(sock mangos.Socket) {
-	if sendData == nil {
+	if sendData == nil && !readStdin {
 		fatalf("No data to send!")
 	}
 	for {
-		msg := mangos.NewMessage(len(sendData))
-		msg.Body = append(msg.Body, sendData...)
+		data, ok := nextData()
+		if !ok {
+			break
+		}
+		msg := mangos.NewMessage(len(data))
+		msg.Body = append(msg.Body, data...)
 		err := sock.SendMsg(msg)
 
 		if err != nil {
@@ -449,22 +556,45 @@ func sendLoop(sock mangos.Socket) {
 
 		if sendInterval >= 0 {
 			time.Sleep(time.Duration(sendInterval) * time.Second)
-		} else {
+		} else if !readStdin {
 			break
 		}
 	}
+
+	// Closing the socket discards anything still queued, unless it
+	// lingers, which it does only until the messages are sent.
+	if err := sock.SetOption(mangos.OptionLinger, time.Second); err != nil {
+		fatalf("Can't set linger: %v", err)
+	}
 }
 
 func sendRecvLoop(sock mangos.Socket) {
+	// Peers of PAIR, BUS and STAR need not answer each message, so
+	// with stdin we send everything, and receive afterwards.
+	self := sock.Info().Self
+	replies := self == mangos.ProtoReq || self == mangos.ProtoSurveyor
 	for {
-		msg := mangos.NewMessage(len(sendData))
-		msg.Body = append(msg.Body, sendData...)
+		data, ok := nextData()
+		if !ok {
+			if !replies {
+				recvLoop(sock)
+			}
+			return
+		}
+		msg := mangos.NewMessage(len(data))
+		msg.Body = append(msg.Body, data...)
 		err := sock.SendMsg(msg)
 
 		if err != nil {
 			fatalf("SendMsg failed: %v", err)
 		}
 
+		if readStdin && sendInterval < 0 {
+			if replies {
+				recvReplies(sock)
+			}
+			continue
+		}
 		if sendInterval < 0 {
 			recvLoop(sock)
 			return
@@ -493,8 +623,31 @@ func sendRecvLoop(sock mangos.Socket) {
 	}
 }
 
+// recvReplies receives the replies to a message read from stdin.
+// REQ gets a single reply, while SURVEYOR gets whatever arrives before
+// the survey (or receive) timeout.
+func recvReplies(sock mangos.Socket) {
+	for {
+		msg, err := sock.RecvMsg()
+		switch err {
+		case mangos.ErrProtoState:
+			return
+		case mangos.ErrRecvTimeout:
+			return
+		case nil:
+		default:
+			fatalf("RecvMsg failed: %v", err)
+		}
+		printMsg(msg)
+		msg.Free()
+		if sock.Info().Self == mangos.ProtoReq {
+			return
+		}
+	}
+}
+
 func replyLoop(sock mangos.Socket) {
-	if sendData == nil {
+	if sendData == nil && !readStdin {
 		fatalf("No data to send!")
 	}
 	for {
@@ -509,8 +662,12 @@ func replyLoop(sock mangos.Socket) {
 		printMsg(msg)
 		msg.Free()
 
-		msg = mangos.NewMessage(len(sendData))
-		msg.Body = append(msg.Body, sendData...)
+		data, ok := nextData()
+		if !ok {
+			return
+		}
+		msg = mangos.NewMessage(len(data))
+		msg.Body = append(msg.Body, data...)
 		err = sock.SendMsg(msg)
 
 		if err != nil {
@@ -634,7 +791,7 @@ func main() {
 	case mangos.ProtoStar:
 		fallthrough
 	case mangos.ProtoBus:
-		if sendData != nil {
+		if sendData != nil || readStdin {
 			sendRecvLoop(sock)
 		} else {
 			recvLoop(sock)
@@ -648,7 +805,7 @@ func main() {
 	case mangos.ProtoRep:
 		fallthrough
 	case mangos.ProtoRespondent:
-		if sendData != nil {
+		if sendData != nil || readStdin {
 			replyLoop(sock)
 		} else {
 			recvLoop(sock)
@@ -0,0 +1,483 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mdns has sockets find one another on the local network with
+// multicast DNS, so that a BUS mesh (or any other pattern where peers
+// are alike) can be formed without knowing any addresses in advance.
+// Each socket advertises its listener under a service name, and dials
+// the others that it hears advertising the same service.  Of any two
+// peers, only the one whose instance name sorts first dials the other,
+// so that they share a single connection, and messages are not
+// delivered twice.  Peers that leave say so, and those that vanish
+// without a word are forgotten once their records expire.
+//
+// Peers are dialed at the address their announcements came from, with
+// the port and scheme of their listeners, so listeners should be bound
+// to the wildcard address, as in "tcp://*:0".  Only IPv4 is used.
+package mdns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// DefaultService is the service name used if the Config does not give
+// one.
+const DefaultService = "_sp-bus._tcp"
+
+// DefaultGroup is the multicast DNS group and port.
+const DefaultGroup = "224.0.0.251:5353"
+
+// DefaultInterval is how often peers are announced and asked for, if the
+// Config does not say.
+const DefaultInterval = time.Second * 10
+
+// Config says how a Mesh advertises itself, and what it looks for.  The
+// zero value is ready to use.
+type Config struct {
+	// Service is the name of the service, such as "_sp-bus._tcp".
+	// Only peers with the same service are dialed.
+	Service string
+
+	// Instance names this peer, and must be unique within the service.
+	// It may not contain dots.  If it is empty, a random one is chosen.
+	Instance string
+
+	// Interval is how often the peer announces itself, and asks for the
+	// others.  Its records expire after three intervals.
+	Interval time.Duration
+
+	// Group is the multicast address and port, in host:port form.  It is
+	// only worth changing to keep separate meshes apart, or in tests.
+	Group string
+
+	// Interface names the network interface to use, such as "eth0".
+	// If it is empty, the system chooses.
+	Interface string
+}
+
+// Mesh advertises a socket's listener, and dials the peers it finds.
+type Mesh struct {
+	sync.Mutex
+	sock     mangos.Socket
+	scheme   string
+	port     uint16
+	service  dnsmessage.Name // as in "_sp-bus._tcp.local."
+	instance string
+	name     dnsmessage.Name // as in "a1b2c3._sp-bus._tcp.local."
+	interval time.Duration
+	group    *net.UDPAddr
+	conn     *net.UDPConn // receives from the group
+	out      *net.UDPConn // sends to it
+	peers    map[string]*peer
+	closed   bool
+	closeq   chan struct{}
+}
+
+type peer struct {
+	addr    string
+	dialer  mangos.Dialer // nil if the peer dials us
+	expires time.Time
+}
+
+// Join starts advertising the listener of the socket, which must already
+// be listening, and dialing the peers found.
+func Join(sock mangos.Socket, l mangos.Listener, cfg Config) (*Mesh, error) {
+	scheme, hostPort, ok := strings.Cut(l.Address(), "://")
+	if !ok {
+		return nil, mangos.ErrBadAddr
+	}
+	_, ps, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, mangos.ErrBadAddr
+	}
+	port, err := strconv.ParseUint(ps, 10, 16)
+	if err != nil || port == 0 {
+		return nil, mangos.ErrBadAddr
+	}
+	if cfg.Service == "" {
+		cfg.Service = DefaultService
+	}
+	if cfg.Instance == "" {
+		b := make([]byte, 8)
+		if _, err = rand.Read(b); err != nil {
+			return nil, err
+		}
+		cfg.Instance = hex.EncodeToString(b)
+	}
+	if strings.Contains(cfg.Instance, ".") {
+		return nil, mangos.ErrBadValue
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Group == "" {
+		cfg.Group = DefaultGroup
+	}
+	m := &Mesh{
+		sock:     sock,
+		scheme:   scheme,
+		port:     uint16(port),
+		instance: cfg.Instance,
+		interval: cfg.Interval,
+		peers:    make(map[string]*peer),
+		closeq:   make(chan struct{}),
+	}
+	service := strings.TrimSuffix(cfg.Service, ".") + ".local."
+	if m.service, err = dnsmessage.NewName(service); err != nil {
+		return nil, mangos.ErrBadValue
+	}
+	if m.name, err = dnsmessage.NewName(cfg.Instance + "." + service); err != nil {
+		return nil, mangos.ErrBadValue
+	}
+	if m.group, err = net.ResolveUDPAddr("udp4", cfg.Group); err != nil {
+		return nil, mangos.ErrBadAddr
+	}
+	var ifi *net.Interface
+	if cfg.Interface != "" {
+		if ifi, err = net.InterfaceByName(cfg.Interface); err != nil {
+			return nil, err
+		}
+	}
+	if m.conn, err = net.ListenMulticastUDP("udp4", ifi, m.group); err != nil {
+		return nil, err
+	}
+	// The receiving socket does not loop back what it sends, which other
+	// peers on this host need to hear.
+	if m.out, err = net.ListenUDP("udp4", nil); err != nil {
+		m.conn.Close()
+		return nil, err
+	}
+	pc := ipv4.NewPacketConn(m.out)
+	if err = pc.SetMulticastLoopback(true); err == nil && ifi != nil {
+		err = pc.SetMulticastInterface(ifi)
+	}
+	if err != nil {
+		m.conn.Close()
+		m.out.Close()
+		return nil, err
+	}
+	go m.receiver()
+	go m.announcer()
+	return m, nil
+}
+
+// Instance returns the name this peer advertises itself by.
+func (m *Mesh) Instance() string {
+	return m.instance
+}
+
+// Peers returns the instance names of the peers presently known.
+func (m *Mesh) Peers() []string {
+	m.Lock()
+	defer m.Unlock()
+	names := make([]string, 0, len(m.peers))
+	for name := range m.peers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Close stops advertising, telling the peers so, and closes the dialers
+// of the peers found.  The socket and its listener are left open.
+func (m *Mesh) Close() error {
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return mangos.ErrClosed
+	}
+	m.closed = true
+	close(m.closeq)
+	peers := m.peers
+	m.peers = make(map[string]*peer)
+	m.Unlock()
+
+	m.send(m.announcement(0))
+	m.conn.Close()
+	m.out.Close()
+	for _, p := range peers {
+		if p.dialer != nil {
+			p.dialer.Close()
+		}
+	}
+	return nil
+}
+
+// ttl returns how long, in seconds, our records are good for.
+func (m *Mesh) ttl() uint32 {
+	if ttl := uint32(m.interval * 3 / time.Second); ttl > 0 {
+		return ttl
+	}
+	return 1
+}
+
+// announcer announces us, and asks for the others, at each interval,
+// forgetting the peers whose records have expired.
+func (m *Mesh) announcer() {
+	for {
+		m.send(m.query())
+		m.send(m.announcement(m.ttl()))
+		select {
+		case <-time.After(m.interval):
+		case <-m.closeq:
+			return
+		}
+		now := time.Now()
+		m.Lock()
+		for name, p := range m.peers {
+			if now.After(p.expires) {
+				m.forget(name, p)
+			}
+		}
+		m.Unlock()
+	}
+}
+
+func (m *Mesh) send(b []byte) {
+	if b != nil {
+		// Multicast is best effort; lost packets are made up for at
+		// the next interval.
+		_, _ = m.out.WriteToUDP(b, m.group)
+	}
+}
+
+func (m *Mesh) query() []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.EnableCompression()
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{
+		Name:  m.service,
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// announcement returns the records describing us, good for ttl seconds.
+// A ttl of zero says that we are leaving.
+func (m *Mesh) announcement(ttl uint32) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		Response:      true,
+		Authoritative: true,
+	})
+	b.EnableCompression()
+	_ = b.StartAnswers()
+	rh := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{
+			Name:  name,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		}
+	}
+	_ = b.PTRResource(rh(m.service), dnsmessage.PTRResource{PTR: m.name})
+	target, err := dnsmessage.NewName(m.instance + ".local.")
+	if err != nil {
+		return nil
+	}
+	_ = b.SRVResource(rh(m.name), dnsmessage.SRVResource{
+		Port:   m.port,
+		Target: target,
+	})
+	_ = b.TXTResource(rh(m.name), dnsmessage.TXTResource{
+		TXT: []string{"scheme=" + m.scheme},
+	})
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+func (m *Mesh) receiver() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-m.closeq:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		m.handle(buf[:n], from)
+	}
+}
+
+// handle answers questions about our service, and notes the peers
+// announcing it.  Anything malformed or of no interest is ignored.
+func (m *Mesh) handle(b []byte, from *net.UDPAddr) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return
+	}
+	if !h.Response {
+		for {
+			q, err := p.Question()
+			if err != nil {
+				return
+			}
+			if q.Type == dnsmessage.TypePTR &&
+				strings.EqualFold(q.Name.String(), m.service.String()) {
+				m.send(m.announcement(m.ttl()))
+				return
+			}
+		}
+	}
+	if p.SkipAllQuestions() != nil {
+		return
+	}
+
+	type found struct {
+		port   uint16
+		scheme string
+		ttl    uint32
+	}
+	seen := make(map[string]*found)
+	get := func(name dnsmessage.Name) *found {
+		instance, ok := m.instanceOf(name)
+		if !ok {
+			return nil
+		}
+		f := seen[instance]
+		if f == nil {
+			f = &found{scheme: "tcp"}
+			seen[instance] = f
+		}
+		return f
+	}
+	for {
+		rh, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		switch rh.Type {
+		case dnsmessage.TypeSRV:
+			r, err := p.SRVResource()
+			if err != nil {
+				return
+			}
+			if f := get(rh.Name); f != nil {
+				f.port = r.Port
+				f.ttl = rh.TTL
+			}
+		case dnsmessage.TypeTXT:
+			r, err := p.TXTResource()
+			if err != nil {
+				return
+			}
+			if f := get(rh.Name); f != nil {
+				for _, kv := range r.TXT {
+					if v := strings.TrimPrefix(kv, "scheme="); v != kv {
+						f.scheme = v
+					}
+				}
+			}
+		default:
+			if p.SkipAnswer() != nil {
+				return
+			}
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	for instance, f := range seen {
+		if instance == m.instance || f.port == 0 {
+			continue
+		}
+		old := m.peers[instance]
+		if f.ttl == 0 {
+			if old != nil {
+				m.forget(instance, old)
+			}
+			continue
+		}
+		addr := f.scheme + "://" +
+			net.JoinHostPort(from.IP.String(), strconv.Itoa(int(f.port)))
+		if old != nil && old.addr != addr {
+			m.forget(instance, old)
+			old = nil
+		}
+		if old == nil {
+			old = &peer{addr: addr}
+			if m.instance < instance {
+				old.dialer = m.dial(addr)
+			}
+			m.peers[instance] = old
+		}
+		old.expires = time.Now().Add(time.Duration(f.ttl) * time.Second)
+	}
+}
+
+// instanceOf returns the instance named by a record of our service.
+func (m *Mesh) instanceOf(name dnsmessage.Name) (string, bool) {
+	s := name.String()
+	suffix := "." + m.service.String()
+	if len(s) <= len(suffix) ||
+		!strings.EqualFold(s[len(s)-len(suffix):], suffix) {
+		return "", false
+	}
+	instance := s[:len(s)-len(suffix)]
+	if strings.Contains(instance, ".") {
+		return "", false
+	}
+	return instance, true
+}
+
+// dial starts dialing a peer, returning the dialer, or nil if it could
+// not be started.  The socket keeps trying until the peer is forgotten.
+func (m *Mesh) dial(addr string) mangos.Dialer {
+	d, err := m.sock.NewDialer(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	})
+	if err != nil {
+		return nil
+	}
+	if err = d.Dial(); err != nil {
+		d.Close()
+		return nil
+	}
+	return d
+}
+
+// forget drops a peer, closing the dialer for it.  The caller must hold
+// the lock.
+func (m *Mesh) forget(instance string, p *peer) {
+	delete(m.peers, instance)
+	if p.dialer != nil {
+		go p.dialer.Close()
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mesh keeps a socket connected to every one of a set of peers,
+// as a BUS full mesh needs, so that applications need not script their
+// own Listen and Dial calls.  Each node is given its own address, and
+// the addresses of the others, or a Source to ask for them.  Of any two
+// nodes, only the one whose address sorts first dials the other, so
+// that they share a single connection, and messages are not delivered
+// twice.  Dialers reconnect on their own, so a node that restarts is
+// connected again by the peers that dial it, and dials the rest.  For
+// this to work, every node must know the others by the same addresses
+// that they give as their own.
+//
+// For peers on the local network, without any addresses known in
+// advance, see the mdns package.
+package mesh
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// DefaultInterval is how often the Source is asked for the peers, if the
+// Config does not say.
+const DefaultInterval = time.Second * 10
+
+// Source gives the addresses of the nodes in the mesh, such as from a
+// service registry.  It may include the node asking.  A Source that
+// fails is asked again later, and the peers it last gave are kept
+// meanwhile.
+type Source interface {
+	Addresses() ([]string, error)
+}
+
+// SourceFunc is a function that is a Source.
+type SourceFunc func() ([]string, error)
+
+// Addresses implements Source.
+func (f SourceFunc) Addresses() ([]string, error) {
+	return f()
+}
+
+// Static is a Source that always gives the same addresses.
+type Static []string
+
+// Addresses implements Source.
+func (s Static) Addresses() ([]string, error) {
+	return s, nil
+}
+
+// Config says where a node listens, and how it finds its peers.
+type Config struct {
+	// Self is the address of this node, as the others dial it, such
+	// as "tcp://10.0.0.1:4000".  It is required.
+	Self string
+
+	// Listen is the address to listen on, if not Self, such as
+	// "tcp://*:4000".
+	Listen string
+
+	// Peers are the addresses of the nodes, used if Source is nil.
+	Peers []string
+
+	// Source is asked for the addresses of the nodes every Interval.
+	Source Source
+
+	// Interval is how often Source is asked.  It defaults to
+	// DefaultInterval.
+	Interval time.Duration
+}
+
+// Mesh listens for the peers that dial it, and dials the others.
+type Mesh struct {
+	sync.Mutex
+	sock     mangos.Socket
+	self     string
+	l        mangos.Listener
+	src      Source
+	interval time.Duration
+	peers    map[string]mangos.Dialer // nil for those that dial us
+	closed   bool
+	closeq   chan struct{}
+}
+
+// Join starts listening on the socket, and connecting it to the peers.
+// The addresses of the peers are read once before it returns, and an
+// error from the Source is returned then.
+func Join(sock mangos.Socket, cfg Config) (*Mesh, error) {
+	if cfg.Self == "" {
+		return nil, mangos.ErrBadAddr
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = cfg.Self
+	}
+	if cfg.Source == nil {
+		cfg.Source = Static(cfg.Peers)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	m := &Mesh{
+		sock:     sock,
+		self:     cfg.Self,
+		src:      cfg.Source,
+		interval: cfg.Interval,
+		peers:    make(map[string]mangos.Dialer),
+		closeq:   make(chan struct{}),
+	}
+	l, err := sock.NewListener(cfg.Listen, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.Listen(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	m.l = l
+	if err = m.Refresh(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go m.watcher()
+	return m, nil
+}
+
+// Peers returns the addresses of the peers presently known, sorted.
+func (m *Mesh) Peers() []string {
+	m.Lock()
+	defer m.Unlock()
+	addrs := make([]string, 0, len(m.peers))
+	for addr := range m.peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Refresh asks the Source for the peers now, rather than waiting, and
+// dials those that are new, and stops dialing those that have gone.
+func (m *Mesh) Refresh() error {
+	addrs, err := m.src.Addresses()
+	if err != nil {
+		return err
+	}
+	want := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if addr != m.self {
+			want[addr] = true
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return mangos.ErrClosed
+	}
+	for addr, d := range m.peers {
+		if !want[addr] {
+			delete(m.peers, addr)
+			if d != nil {
+				go d.Close()
+			}
+		}
+	}
+	for addr := range want {
+		if _, ok := m.peers[addr]; ok {
+			continue
+		}
+		if m.self > addr {
+			// They dial us.
+			m.peers[addr] = nil
+			continue
+		}
+		d, err := m.dial(addr)
+		if err != nil {
+			// We try again next time.
+			continue
+		}
+		m.peers[addr] = d
+	}
+	return nil
+}
+
+// dial starts dialing a peer.  The socket keeps trying until the peer
+// is dropped.
+func (m *Mesh) dial(addr string) (mangos.Dialer, error) {
+	d, err := m.sock.NewDialer(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = d.Dial(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (m *Mesh) watcher() {
+	tm := time.NewTicker(m.interval)
+	defer tm.Stop()
+	for {
+		select {
+		case <-tm.C:
+			_ = m.Refresh()
+		case <-m.closeq:
+			return
+		}
+	}
+}
+
+// Close stops the listener, and the dialers of the peers.  The socket
+// is left open.
+func (m *Mesh) Close() error {
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return mangos.ErrClosed
+	}
+	m.closed = true
+	close(m.closeq)
+	peers := m.peers
+	m.peers = make(map[string]mangos.Dialer)
+	m.Unlock()
+
+	m.l.Close()
+	for _, d := range peers {
+		if d != nil {
+			d.Close()
+		}
+	}
+	return nil
+}
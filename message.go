@@ -15,7 +15,14 @@
 package mangos
 
 import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Message encapsulates the messages that we exchange back and forth.  The
@@ -33,19 +40,106 @@ type Message struct {
 	// of as the message "payload".
 	Body []byte
 
+	// Bodies carries optional further body segments, which are sent
+	// on the wire directly after Body, in order, without being copied.
+	// This lets an application place its own envelope or topic in Body
+	// in front of a payload that it does not own.  The segments are
+	// never modified by mangos, but must not be changed by the caller
+	// until the message has been sent.  Received messages always carry
+	// the entire payload in Body, and leave this nil.
+	Bodies [][]byte
+
 	// Pipe may be set on message receipt, to indicate the Pipe from
 	// which the Message was received.  There are no guarantees that the
 	// Pipe is still active, and applications should only use this for
 	// informational purposes.
 	Pipe Pipe
 
-	bbuf  []byte
-	hbuf  []byte
-	bsize int
-	pool  *sync.Pool
+	// Target, if set, directs the message to just that Pipe, rather than
+	// to whichever peers the protocol would normally choose.  Replying
+	// to the sender of a received message is done by setting Target to
+	// its Pipe.  It is honored by BUS, PAIR, PUB and STAR sockets (raw
+	// or cooked); if the Pipe is no longer connected, the message is
+	// dropped.  Other protocols ignore it.
+	Target Pipe
+
+	// Compress overrides any transparent compression policy for this
+	// message.  Senders whose payloads are already compressed (JPEG
+	// images, for example) can set CompressNever to avoid spending
+	// CPU on data that will not shrink.  Transports that do not
+	// compress ignore this.
+	Compress CompressMode
+
+	// Lane groups the messages sent by one producer, for OptionFairSend,
+	// which takes turns between lanes so that one busy producer cannot
+	// keep others waiting.  Messages left in lane zero share it, taking
+	// turns in the order they were sent.  It is not sent to the peer.
+	Lane uint32
+
+	// Files carries open files, such as sockets, to hand to the peer
+	// along with the message.  Only the ipc transport on Unix (which
+	// uses SCM_RIGHTS) and the inproc transport carry them; others
+	// drop them.  Like the rest of
+	// the message, the files belong to the socket once sent, and are
+	// closed when the message has been sent or is freed.  On receipt,
+	// Files holds new descriptors for the same files; an application
+	// that keeps them must take them (setting Files to nil) before
+	// freeing the message.
+	Files []*os.File
+
+	// Redelivered is the number of times a message received with
+	// OptionAckDelivery was sent before, without being acknowledged.
+	// If it is not zero, the message may have been received already.
+	Redelivered int
+
+	// RequestID is the ID a REQ socket gave the request, set on the
+	// request when it is sent and on the reply to it when received, so
+	// that the two can be matched up in logs.  It is zero otherwise.
+	RequestID uint32
+
+	// Lifecycle records when the message was sent or received, if the
+	// socket has OptionLifecycle set.
+	Lifecycle Lifecycle
+
+	bbuf   []byte
+	hbuf   []byte
+	bsize  int
+	pool   *sync.Pool
+	sum    uint32 // payload checksum, if sealed
+	sealed bool
+
+	acct    *BufferAccount // charged to, if any; see OptionMaxBufferBytes
+	charged int64
+	release func() // see SetRelease
+	refs    int32  // references besides the first; see Retain
+
+	ack    func() error // see Ack
+	nack   func() error // see Nack
+	expiry time.Time    // see SetExpiry
+
+	priority int // see SetPriority
 }
 
+// CompressMode determines whether a Message body is compressed on the wire.
+type CompressMode int
+
+const (
+	// CompressDefault leaves the decision to the pipe, based upon the
+	// negotiated compression settings and size threshold.
+	CompressDefault CompressMode = iota
+
+	// CompressAlways compresses the message body, regardless of size,
+	// provided that the peer has agreed to compression.
+	CompressAlways
+
+	// CompressNever sends the message body uncompressed.
+	CompressNever
+)
+
 type msgCacheInfo struct {
+	gets    uint64 // keep 64-bit counters first for alignment
+	misses  uint64
+	frees   uint64
 	maxbody int
 	pool    *sync.Pool
 }
@@ -59,89 +153,386 @@ func newMsg(sz int) *Message {
 }
 
 // We can tweak these!
-var messageCache = []msgCacheInfo{
-	{
-		maxbody: 64,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(64) },
-		},
-	}, {
-		maxbody: 128,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(128) },
-		},
-	}, {
-		maxbody: 256,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(256) },
-		},
-	}, {
-		maxbody: 512,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(512) },
-		},
-	}, {
-		maxbody: 1024,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(1024) },
-		},
-	}, {
-		maxbody: 4096,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(4096) },
-		},
-	}, {
-		maxbody: 8192,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(8192) },
-		},
-	}, {
-		maxbody: 65536,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(65536) },
-		},
-	},
+var messageCacheSizes = []int{64, 128, 256, 512, 1024, 4096, 8192, 65536}
+
+var messageCache []msgCacheInfo
+
+// messageOversize counts allocations too large for any cache.
+var messageOversize uint64
+
+func init() {
+	messageCache = make([]msgCacheInfo, len(messageCacheSizes))
+	for i := range messageCacheSizes {
+		info := &messageCache[i]
+		sz := messageCacheSizes[i]
+		info.maxbody = sz
+		info.pool = &sync.Pool{
+			New: func() interface{} {
+				atomic.AddUint64(&info.misses, 1)
+				return newMsg(sz)
+			},
+		}
+	}
+}
+
+// MessagePoolStats reports the usage of a single size class of the
+// message cache.  These can be used to tune the allocation patterns
+// of applications that send or receive at very high rates.
+type MessagePoolStats struct {
+	// Size is the largest message body the class holds.  It is zero
+	// for the pseudo-class describing oversize allocations.
+	Size int
+
+	// Hits is the number of allocations satisfied by a recycled
+	// message.
+	Hits uint64
+
+	// Misses is the number of allocations that required a new
+	// message to be created.  Oversize allocations are always misses.
+	Misses uint64
+
+	// Frees is the number of messages returned to the class.
+	Frees uint64
+}
+
+// MessagePoolStatistics returns a snapshot of the message cache counters,
+// one entry for each size class in increasing order of size, followed by
+// an entry (with Size zero) for allocations that were too large to cache.
+// Note that the garbage collector may discard idle cached messages, so
+// misses can occur even when messages are diligently freed.
+func MessagePoolStatistics() []MessagePoolStats {
+	stats := make([]MessagePoolStats, 0, len(messageCache)+1)
+	for i := range messageCache {
+		info := &messageCache[i]
+		gets := atomic.LoadUint64(&info.gets)
+		misses := atomic.LoadUint64(&info.misses)
+		hits := uint64(0)
+		if gets > misses {
+			hits = gets - misses
+		}
+		stats = append(stats, MessagePoolStats{
+			Size:   info.maxbody,
+			Hits:   hits,
+			Misses: misses,
+			Frees:  atomic.LoadUint64(&info.frees),
+		})
+	}
+	stats = append(stats, MessagePoolStats{
+		Misses: atomic.LoadUint64(&messageOversize),
+	})
+	return stats
 }
 
 // Free releases the message to the pool from which it was allocated.
 // While this is not strictly necessary thanks to GC, doing so allows
 // for the resources to be recycled without engaging GC.  This can have
-// rather substantial benefits for performance.
+// rather substantial benefits for performance.  If the message has other
+// references (see Retain), this only drops the caller's, and the message
+// is released when the last is freed.
 func (m *Message) Free() {
+	if atomic.AddInt32(&m.refs, -1) >= 0 {
+		return
+	}
+	atomic.StoreInt32(&m.refs, 0)
+	m.Uncharge()
+	m.Bodies = nil
+	for _, f := range m.Files {
+		f.Close()
+	}
+	m.Files = nil
+	m.ack = nil
+	m.nack = nil
 	for i := range messageCache {
 		if m.bsize == messageCache[i].maxbody {
+			atomic.AddUint64(&messageCache[i].frees, 1)
 			messageCache[i].pool.Put(m)
 			return
 		}
 	}
 }
 
-// Dup creates a "duplicate" message.
-// Reference counting was found to be error prone, so we have elected
-// to simply make a full copy of the message for now.
+// BodyLen returns the total length of the body, including any
+// additional segments in Bodies.
+func (m *Message) BodyLen() int {
+	n := len(m.Body)
+	for _, b := range m.Bodies {
+		n += len(b)
+	}
+	return n
+}
+
+// Flatten copies any additional body segments onto the end of Body,
+// leaving Bodies empty.  This is useful for code that needs to inspect
+// the entire payload contiguously.
+func (m *Message) Flatten() {
+	for _, b := range m.Bodies {
+		m.Body = append(m.Body, b...)
+	}
+	m.Bodies = nil
+}
+
+// Retain adds a reference to the message, and returns it, so that the
+// same message can be queued for several pipes without copying it.  Each
+// holder of a reference must Free it, and the message is only returned
+// to the pool when the last one does.  A message with more than one
+// reference is shared, and must not be changed by anybody; Dup makes a
+// copy that may be.
+func (m *Message) Retain() *Message {
+	atomic.AddInt32(&m.refs, 1)
+	return m
+}
+
+// Shared returns true if the message has more than one reference.
+func (m *Message) Shared() bool {
+	return atomic.LoadInt32(&m.refs) > 0
+}
+
+// Dup creates a "duplicate" message, which is a full copy that the
+// caller owns outright, and may change.
 func (m *Message) Dup() *Message {
 	dup := NewMessage(len(m.Body))
 	dup.Body = append(dup.Body, m.Body...)
 	dup.Header = append(dup.Header, m.Header...)
+	if len(m.Bodies) > 0 {
+		// The segments are read-only to us, so sharing them is safe.
+		dup.Bodies = append([][]byte(nil), m.Bodies...)
+	}
 	dup.Pipe = m.Pipe
+	dup.Target = m.Target
+	dup.Compress = m.Compress
+	dup.Lane = m.Lane
+	if len(m.Files) > 0 {
+		dup.Files = dupFiles(m.Files)
+	}
+	dup.Redelivered = m.Redelivered
+	dup.RequestID = m.RequestID
+	dup.Lifecycle = m.Lifecycle
+	dup.ack = m.ack
+	dup.expiry = m.expiry
+	dup.priority = m.priority
+	dup.nack = m.nack
+	dup.sum = m.sum
+	dup.sealed = m.sealed
+	if m.acct != nil {
+		dup.Charge(m.acct)
+	}
 	return dup
 }
 
+// Ack acknowledges a message received with OptionAckDelivery, so that
+// the sender does not send it again.  It must be called before the
+// message is freed.  If the pipe it came in on has gone, it fails, and
+// the message will be sent again.  For other messages it does nothing.
+func (m *Message) Ack() error {
+	if m.ack == nil {
+		return nil
+	}
+	return m.ack()
+}
+
+// SetAck sets the function that Ack calls.  It is for protocols
+// implementing OptionAckDelivery.
+func (m *Message) SetAck(fn func() error) {
+	m.ack = fn
+}
+
+// Nack refuses a message received with OptionAckDelivery, telling the
+// sender that it will never be accepted, so that it is not sent again.
+// It is meant for messages that are malformed, rather than those that
+// cannot be handled just now, which are better left unacknowledged.
+// Like Ack, it must be called before the message is freed, and does
+// nothing for other messages.
+func (m *Message) Nack() error {
+	if m.nack == nil {
+		return nil
+	}
+	return m.nack()
+}
+
+// SetNack sets the function that Nack calls.  It is for protocols
+// implementing OptionAckDelivery.
+func (m *Message) SetNack(fn func() error) {
+	m.nack = fn
+}
+
+// SetExpiry limits how long the message may wait to be sent.  If it is
+// still queued when d has passed, it is discarded rather than sent late,
+// and counted in Stats.Expired.  This suits data, such as prices or
+// readings, that is worse late than never.  A message already being
+// written to the connection is not stopped.  Zero (or less) clears it.
+func (m *Message) SetExpiry(d time.Duration) {
+	if d <= 0 {
+		m.expiry = time.Time{}
+		return
+	}
+	m.expiry = time.Now().Add(d)
+}
+
+// Expiry returns the time after which the message will not be sent, as
+// set by SetExpiry, or the zero time if there is none.
+func (m *Message) Expiry() time.Time {
+	return m.expiry
+}
+
+// Expired returns true if the message has an expiry, which has passed.
+func (m *Message) Expired() bool {
+	return !m.expiry.IsZero() && time.Now().After(m.expiry)
+}
+
+// SetPriority sets the priority with which the message is sent, on a
+// socket with OptionSendPriorities, zero (the default) being the lowest.
+// Messages of a higher priority are sent before those of lower ones
+// already queued, so that a control message need not wait behind a
+// backlog of bulk data.  A priority beyond those the socket has is taken
+// as its highest.  The priority is not sent to the peer.
+func (m *Message) SetPriority(p int) {
+	if p < 0 {
+		p = 0
+	}
+	m.priority = p
+}
+
+// Priority returns the priority set by SetPriority.
+func (m *Message) Priority() int {
+	return m.priority
+}
+
+// PipeIDTag is the SourceTagFunc used when OptionSourceTag is true.  It
+// returns the ID of the pipe, in network byte order.
+func PipeIDTag(p Pipe) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, p.ID())
+	return b
+}
+
+// SplitSourceTag separates the tag put in front of a message body by
+// OptionSourceTag from the rest of the body.  The result is false if
+// the body is too short to hold a tag.
+func SplitSourceTag(body []byte) (tag, rest []byte, ok bool) {
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return nil, body, false
+	}
+	n := 1 + int(body[0])
+	return body[1:n], body[n:], true
+}
+
+// checksum returns the CRC of the payload (Body and Bodies).
+func (m *Message) checksum() uint32 {
+	sum := crc32.ChecksumIEEE(m.Body)
+	for _, b := range m.Bodies {
+		sum = crc32.Update(sum, crc32.IEEETable, b)
+	}
+	return sum
+}
+
+// Seal records a checksum of the message payload, so that Verify can
+// later tell whether it has been changed.  The Header is not included,
+// as protocols modify it.  Sockets seal messages passed to SendMsg when
+// OptionVerifyMessages is set; there is no need to call this directly.
+func (m *Message) Seal() {
+	m.sum = m.checksum()
+	m.sealed = true
+}
+
+// Verify returns false if the payload has changed since the message
+// (or the message it was duplicated from) was sealed.  Messages that
+// were never sealed always verify.
+func (m *Message) Verify() bool {
+	return !m.sealed || m.checksum() == m.sum
+}
+
 // NewMessage is the supported way to obtain a new Message.  This makes
 // use of a "cache" which greatly reduces the load on the garbage collector.
 func NewMessage(sz int) *Message {
 	var m *Message
 	for i := range messageCache {
 		if sz < messageCache[i].maxbody {
+			atomic.AddUint64(&messageCache[i].gets, 1)
 			m = messageCache[i].pool.Get().(*Message)
 			break
 		}
 	}
 	if m == nil {
+		atomic.AddUint64(&messageOversize, 1)
 		m = newMsg(sz)
 	}
 
 	m.Body = m.bbuf
 	m.Header = m.hbuf
+	m.Bodies = nil
+	m.Pipe = nil
+	m.Target = nil
+	m.Compress = CompressDefault
+	m.Lane = 0
+	m.Redelivered = 0
+	m.RequestID = 0
+	m.Lifecycle = Lifecycle{}
+	m.ack = nil
+	m.nack = nil
+	m.release = nil
+	m.refs = 0
+	m.expiry = time.Time{}
+	m.priority = 0
+	m.sealed = false
 	return m
 }
+
+// MessagePrefixLen is the number of leading header and body bytes shown
+// when a Message is formatted with the "%+v" verb.  Message contents are
+// otherwise never included in formatted output, as they may carry
+// sensitive data.
+var MessagePrefixLen = 16
+
+func msgPrefix(b []byte) string {
+	n := MessagePrefixLen
+	if n <= 0 {
+		return ""
+	}
+	if len(b) <= n {
+		return hex.EncodeToString(b)
+	}
+	return hex.EncodeToString(b[:n]) + "..."
+}
+
+// String returns a short description of the message, without its content.
+func (m *Message) String() string {
+	if m == nil {
+		return "Message(nil)"
+	}
+	return fmt.Sprintf("Message{Header: %d bytes, Body: %d bytes}",
+		len(m.Header), len(m.Body))
+}
+
+// GoString returns a description of the message for the "%#v" verb.
+// The content is redacted.
+func (m *Message) GoString() string {
+	if m == nil {
+		return "(*mangos.Message)(nil)"
+	}
+	pipe := uint32(0)
+	if m.Pipe != nil {
+		pipe = m.Pipe.ID()
+	}
+	return fmt.Sprintf("&mangos.Message{Header: <%d bytes>, "+
+		"Body: <%d bytes>, Pipe: %d, Compress: %d}",
+		len(m.Header), len(m.Body), pipe, m.Compress)
+}
+
+// Format implements fmt.Formatter.  The "%v" and "%s" verbs emit String(),
+// and "%#v" emits GoString().  The "%+v" form also includes a hex dump of
+// the first MessagePrefixLen bytes of the header and body, which is handy
+// when debugging protocol headers.
+func (m *Message) Format(f fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && f.Flag('#'):
+		fmt.Fprint(f, m.GoString())
+	case verb == 'v' && f.Flag('+') && m != nil:
+		fmt.Fprintf(f, "Message{Header: %d bytes [%s], Body: %d bytes [%s]}",
+			len(m.Header), msgPrefix(m.Header),
+			len(m.Body), msgPrefix(m.Body))
+	case verb == 'v' || verb == 's':
+		fmt.Fprint(f, m.String())
+	default:
+		fmt.Fprintf(f, "%%!%c(*mangos.Message)", verb)
+	}
+}
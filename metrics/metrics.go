@@ -0,0 +1,156 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics exports the statistics of mangos sockets to Prometheus.
+//
+// A Collector takes a snapshot with Socket.Stats each time it is
+// scraped, so nothing is added to the message path.  Each socket is
+// registered under a name of its choosing, which together with the
+// protocol name labels its metrics:
+//
+//	reg.MustRegister(metrics.NewCollector(sock, "frontend"))
+package metrics
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Namespace prefixes the names of all metrics.
+const Namespace = "mangos"
+
+// Collector is a prometheus.Collector for a single Socket.
+type Collector struct {
+	s          mangos.Socket
+	sent       *prometheus.Desc
+	received   *prometheus.Desc
+	dropped    *prometheus.Desc
+	reconnects *prometheus.Desc
+	invalid    *prometheus.Desc
+	filtered   *prometheus.Desc
+	expired    *prometheus.Desc
+	insecure   *prometheus.Desc
+	queued     *prometheus.Desc
+	pipes      *prometheus.Desc
+	dialers    *prometheus.Desc
+	listeners  *prometheus.Desc
+	protocol   *prometheus.Desc
+}
+
+// NewCollector returns a Collector for s, whose metrics are labelled
+// with name (as "socket") and the protocol name (as "protocol").  If
+// name is empty, the socket's own (see mangos.OptionName) is used.
+func NewCollector(s mangos.Socket, name string) *Collector {
+	if name == "" {
+		if v, err := s.GetOption(mangos.OptionName); err == nil {
+			name, _ = v.(string)
+		}
+	}
+	labels := prometheus.Labels{
+		"socket":   name,
+		"protocol": s.Info().SelfName,
+	}
+	desc := func(metric, help string, vars ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", metric),
+			help, vars, labels)
+	}
+	return &Collector{
+		s: s,
+		sent: desc("messages_sent_total",
+			"Messages sent on the socket."),
+		received: desc("messages_received_total",
+			"Messages received on the socket."),
+		dropped: desc("messages_dropped_total",
+			"Messages discarded by the protocol."),
+		reconnects: desc("reconnects_total",
+			"Connections made again by dialers after losing one."),
+		invalid: desc("messages_invalid_total",
+			"Messages received and rejected by the validator."),
+		filtered: desc("messages_filtered_total",
+			"Messages received and discarded by the receive filter."),
+		expired: desc("messages_expired_total",
+			"Messages discarded unsent, having expired in the queue."),
+		insecure: desc("tls_insecure_connections_total",
+			"Connections made without verifying the peer's certificate."),
+		queued: desc("queued_messages",
+			"Messages waiting in the protocol's send queues."),
+		pipes: desc("pipes",
+			"Pipes (connections) attached to the socket."),
+		dialers: desc("dialers",
+			"Dialers on the socket."),
+		listeners: desc("listeners",
+			"Listeners on the socket."),
+		protocol: desc("protocol_events_total",
+			"Protocol specific counters, by name.", "counter"),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sent
+	ch <- c.received
+	ch <- c.dropped
+	ch <- c.reconnects
+	ch <- c.invalid
+	ch <- c.filtered
+	ch <- c.expired
+	ch <- c.insecure
+	ch <- c.queued
+	ch <- c.pipes
+	ch <- c.dialers
+	ch <- c.listeners
+	ch <- c.protocol
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	st := c.s.Stats()
+	counter := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d,
+			prometheus.CounterValue, float64(v), labels...)
+	}
+	gauge := func(d *prometheus.Desc, v int) {
+		ch <- prometheus.MustNewConstMetric(d,
+			prometheus.GaugeValue, float64(v))
+	}
+	counter(c.sent, st.Sent)
+	counter(c.received, st.Received)
+	counter(c.dropped, st.Dropped)
+	counter(c.reconnects, st.Reconnects)
+	counter(c.invalid, st.Invalid)
+	counter(c.filtered, st.Filtered)
+	counter(c.expired, st.Expired)
+	counter(c.insecure, st.Insecure)
+	gauge(c.queued, st.Queued)
+	gauge(c.pipes, st.Pipes)
+	gauge(c.dialers, st.Dialers)
+	gauge(c.listeners, st.Listeners)
+
+	// Those with metrics of their own are not repeated here.
+	var names []string
+	for name := range st.Protocol {
+		switch name {
+		case mangos.StatDropped, mangos.StatQueued:
+		default:
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		counter(c.protocol, st.Protocol[name], name)
+	}
+}
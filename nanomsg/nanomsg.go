@@ -0,0 +1,342 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nanomsg offers an API shaped like that of the cgo based
+// nanomsg bindings (go-nanomsg), implemented with mangos.  It is meant
+// to ease migrating existing code; new code should use mangos directly.
+//
+// Sockets are made from a Domain and Protocol, are bound and connected
+// to addresses (returning Endpoints), and send and receive byte slices.
+// Options are set with SetSockOptInt and friends, using the nanomsg
+// level and option numbers.  Errors are syscall.Errno values, as the C
+// library would report them, so code checking for syscall.EAGAIN or
+// syscall.ETIMEDOUT continues to work.
+//
+// All of the mangos transports are available.
+package nanomsg
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	"nanomsg.org/go/mangos/v2/protocol/xbus"
+	"nanomsg.org/go/mangos/v2/protocol/xpair"
+	"nanomsg.org/go/mangos/v2/protocol/xpub"
+	"nanomsg.org/go/mangos/v2/protocol/xpull"
+	"nanomsg.org/go/mangos/v2/protocol/xpush"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	"nanomsg.org/go/mangos/v2/protocol/xreq"
+	"nanomsg.org/go/mangos/v2/protocol/xrespondent"
+	"nanomsg.org/go/mangos/v2/protocol/xsub"
+	"nanomsg.org/go/mangos/v2/protocol/xsurveyor"
+	_ "nanomsg.org/go/mangos/v2/transport/all" // for all transports
+)
+
+// Domain is the socket domain, either AF_SP or AF_SP_RAW.
+type Domain int
+
+// Socket domains.
+const (
+	AF_SP     = Domain(1)
+	AF_SP_RAW = Domain(2)
+)
+
+// Protocol is the SP protocol of a socket.  The numbers are those used
+// by nanomsg (and on the wire).
+type Protocol int
+
+// Protocols.
+const (
+	PAIR       = Protocol(mangos.ProtoPair)
+	PUB        = Protocol(mangos.ProtoPub)
+	SUB        = Protocol(mangos.ProtoSub)
+	REQ        = Protocol(mangos.ProtoReq)
+	REP        = Protocol(mangos.ProtoRep)
+	PUSH       = Protocol(mangos.ProtoPush)
+	PULL       = Protocol(mangos.ProtoPull)
+	SURVEYOR   = Protocol(mangos.ProtoSurveyor)
+	RESPONDENT = Protocol(mangos.ProtoRespondent)
+	BUS        = Protocol(mangos.ProtoBus)
+)
+
+// DontWait may be passed to Send or Recv, to return syscall.EAGAIN
+// rather than wait.
+const DontWait = 1
+
+// Errors particular to nanomsg, which have no equivalent in syscall.
+// The values are those of the C library.
+const (
+	ETERM = syscall.Errno(156384765)
+	EFSM  = syscall.Errno(156384766)
+)
+
+type ctor func() (mangos.Socket, error)
+
+var protocols = map[Protocol][2]ctor{
+	PAIR:       {pair.NewSocket, xpair.NewSocket},
+	PUB:        {pub.NewSocket, xpub.NewSocket},
+	SUB:        {sub.NewSocket, xsub.NewSocket},
+	REQ:        {req.NewSocket, xreq.NewSocket},
+	REP:        {rep.NewSocket, xrep.NewSocket},
+	PUSH:       {push.NewSocket, xpush.NewSocket},
+	PULL:       {pull.NewSocket, xpull.NewSocket},
+	SURVEYOR:   {surveyor.NewSocket, xsurveyor.NewSocket},
+	RESPONDENT: {respondent.NewSocket, xrespondent.NewSocket},
+	BUS:        {bus.NewSocket, xbus.NewSocket},
+}
+
+// Socket is a nanomsg style socket.
+type Socket struct {
+	sock     mangos.Socket
+	domain   Domain
+	protocol Protocol
+
+	mtx      sync.Mutex
+	sndTimeo time.Duration // negative for no timeout, as nanomsg
+	rcvTimeo time.Duration
+	sndPrio  int // for endpoints connected hereafter
+	nextEP   int
+	eps      map[int]*Endpoint
+
+	// Send and Recv each apply their deadline just before the
+	// operation, so each is serialized.
+	sendLock sync.Mutex
+	recvLock sync.Mutex
+}
+
+// Endpoint is an address the socket is bound or connected to.  It is
+// passed to Shutdown to remove it from the socket.
+type Endpoint struct {
+	Address string
+	id      int
+	l       mangos.Listener
+	d       mangos.Dialer
+}
+
+func (ep *Endpoint) String() string {
+	return ep.Address
+}
+
+// NewSocket creates a socket for the given domain and protocol.
+func NewSocket(domain Domain, protocol Protocol) (*Socket, error) {
+	c, ok := protocols[protocol]
+	if !ok {
+		return nil, syscall.EPROTONOSUPPORT
+	}
+	var f ctor
+	switch domain {
+	case AF_SP:
+		f = c[0]
+	case AF_SP_RAW:
+		f = c[1]
+	default:
+		return nil, syscall.EAFNOSUPPORT
+	}
+	sock, err := f()
+	if err != nil {
+		return nil, errno(err)
+	}
+	return &Socket{
+		sock:     sock,
+		domain:   domain,
+		protocol: protocol,
+		sndTimeo: -1,
+		rcvTimeo: -1,
+		sndPrio:  mangos.DefaultDialPriority,
+		eps:      make(map[int]*Endpoint),
+	}, nil
+}
+
+// Mangos returns the underlying mangos Socket, for features this
+// package does not expose.
+func (s *Socket) Mangos() mangos.Socket {
+	return s.sock
+}
+
+// Domain returns the domain of the socket.
+func (s *Socket) Domain() Domain {
+	return s.domain
+}
+
+// Protocol returns the protocol of the socket.
+func (s *Socket) Protocol() Protocol {
+	return s.protocol
+}
+
+// Close closes the socket, and all of its endpoints.
+func (s *Socket) Close() error {
+	return errno(s.sock.Close())
+}
+
+// Bind listens for connections on the address.
+func (s *Socket) Bind(address string) (*Endpoint, error) {
+	l, err := s.sock.NewListener(address, nil)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if err = l.Listen(); err != nil {
+		l.Close()
+		return nil, errno(err)
+	}
+	return s.addEndpoint(&Endpoint{Address: address, l: l}), nil
+}
+
+// Connect connects to the address.  As with nanomsg, this does not
+// wait for the connection to be made, and reconnects if it is lost.
+// The connection has the priority last set with NN_SNDPRIO.
+func (s *Socket) Connect(address string) (*Endpoint, error) {
+	s.mtx.Lock()
+	prio := s.sndPrio
+	s.mtx.Unlock()
+	d, err := s.sock.NewDialer(address, map[string]interface{}{
+		mangos.OptionDialAsynch:   true,
+		mangos.OptionDialPriority: prio,
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+	if err = d.Dial(); err != nil {
+		d.Close()
+		return nil, errno(err)
+	}
+	return s.addEndpoint(&Endpoint{Address: address, d: d}), nil
+}
+
+func (s *Socket) addEndpoint(ep *Endpoint) *Endpoint {
+	s.mtx.Lock()
+	s.nextEP++
+	ep.id = s.nextEP
+	s.eps[ep.id] = ep
+	s.mtx.Unlock()
+	return ep
+}
+
+// Shutdown removes an endpoint from the socket.
+func (s *Socket) Shutdown(ep *Endpoint) error {
+	s.mtx.Lock()
+	if ep == nil || s.eps[ep.id] != ep {
+		s.mtx.Unlock()
+		return syscall.EINVAL
+	}
+	delete(s.eps, ep.id)
+	s.mtx.Unlock()
+	if ep.l != nil {
+		return errno(ep.l.Close())
+	}
+	return errno(ep.d.Close())
+}
+
+// deadline converts a nanomsg timeout to a mangos deadline.
+func deadline(timeo time.Duration, flags int) time.Duration {
+	switch {
+	case flags&DontWait != 0:
+		// Near enough to not waiting at all.
+		return time.Nanosecond
+	case timeo < 0:
+		return 0
+	case timeo == 0:
+		return time.Nanosecond
+	}
+	return timeo
+}
+
+// Send sends the data, returning its length.
+func (s *Socket) Send(data []byte, flags int) (int, error) {
+	s.mtx.Lock()
+	d := deadline(s.sndTimeo, flags)
+	s.mtx.Unlock()
+
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if err := s.sock.SetOption(mangos.OptionSendDeadline, d); err != nil &&
+		!errors.Is(err, mangos.ErrBadOption) {
+		return -1, errno(err)
+	}
+	if err := s.sock.Send(data); err != nil {
+		return -1, timeoutErr(errno(err), flags)
+	}
+	return len(data), nil
+}
+
+// Recv receives a message.
+func (s *Socket) Recv(flags int) ([]byte, error) {
+	s.mtx.Lock()
+	d := deadline(s.rcvTimeo, flags)
+	s.mtx.Unlock()
+
+	s.recvLock.Lock()
+	defer s.recvLock.Unlock()
+	if err := s.sock.SetOption(mangos.OptionRecvDeadline, d); err != nil &&
+		!errors.Is(err, mangos.ErrBadOption) {
+		return nil, errno(err)
+	}
+	b, err := s.sock.Recv()
+	if err != nil {
+		return nil, timeoutErr(errno(err), flags)
+	}
+	return b, nil
+}
+
+// timeoutErr reports a timeout as EAGAIN for non-blocking calls.
+func timeoutErr(err error, flags int) error {
+	if err == syscall.ETIMEDOUT && flags&DontWait != 0 {
+		return syscall.EAGAIN
+	}
+	return err
+}
+
+// errno converts a mangos error to the errno nanomsg would use.  Errors
+// with no equivalent are returned unchanged.
+func errno(err error) error {
+	if errors.Is(err, mangos.ErrBadOption) {
+		// This includes the *mangos.OptionError of strict sockets.
+		return syscall.ENOPROTOOPT
+	}
+	switch err {
+	case nil:
+		return nil
+	case mangos.ErrRecvTimeout, mangos.ErrSendTimeout:
+		return syscall.ETIMEDOUT
+	case mangos.ErrClosed:
+		return syscall.EBADF
+	case mangos.ErrBadValue, mangos.ErrBadAddr:
+		return syscall.EINVAL
+	case mangos.ErrBadTran:
+		return syscall.EPROTONOSUPPORT
+	case mangos.ErrAddrInUse:
+		return syscall.EADDRINUSE
+	case mangos.ErrConnRefused:
+		return syscall.ECONNREFUSED
+	case mangos.ErrProtoState:
+		return EFSM
+	case mangos.ErrProtoOp:
+		return syscall.ENOTSUP
+	case mangos.ErrTooLong:
+		return syscall.EMSGSIZE
+	}
+	return err
+}
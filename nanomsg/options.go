@@ -0,0 +1,265 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nanomsg
+
+import (
+	"syscall"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Option levels.  Protocol specific options use the protocol number as
+// the level.
+const (
+	SOL_SOCKET = 0
+	NN_TCP     = -3
+)
+
+// Socket level options.  Times are in milliseconds, with -1 meaning
+// forever (or, for NN_RCVMAXSIZE, no limit).
+const (
+	NN_LINGER            = 1
+	NN_SNDBUF            = 2
+	NN_RCVBUF            = 3
+	NN_SNDTIMEO          = 4
+	NN_RCVTIMEO          = 5
+	NN_RECONNECT_IVL     = 6
+	NN_RECONNECT_IVL_MAX = 7
+	NN_SNDPRIO           = 8
+	NN_RCVPRIO           = 9
+	NN_DOMAIN            = 12
+	NN_PROTOCOL          = 13
+	NN_RCVMAXSIZE        = 16
+	NN_MAXTTL            = 17
+)
+
+// Protocol and transport options.
+const (
+	NN_REQ_RESEND_IVL    = 1 // level REQ
+	NN_SUB_SUBSCRIBE     = 1 // level SUB, a string
+	NN_SUB_UNSUBSCRIBE   = 2 // level SUB, a string
+	NN_SURVEYOR_DEADLINE = 1 // level SURVEYOR
+	NN_TCP_NODELAY       = 1 // level NN_TCP
+)
+
+func ms(v int) time.Duration {
+	return time.Duration(v) * time.Millisecond
+}
+
+func toMs(d time.Duration) int {
+	return int(d / time.Millisecond)
+}
+
+// sockOption returns the mangos option for a nanomsg one that is a time
+// (as milliseconds), or a plain integer.
+func sockOption(level, option int) (name string, isTime bool) {
+	switch {
+	case level == SOL_SOCKET && option == NN_LINGER:
+		return mangos.OptionLinger, true
+	case level == SOL_SOCKET && option == NN_RECONNECT_IVL:
+		return mangos.OptionReconnectTime, true
+	case level == SOL_SOCKET && option == NN_RECONNECT_IVL_MAX:
+		return mangos.OptionMaxReconnectTime, true
+	case level == SOL_SOCKET && option == NN_RCVMAXSIZE:
+		return mangos.OptionMaxRecvSize, false
+	case level == SOL_SOCKET && option == NN_MAXTTL:
+		return mangos.OptionTTL, false
+	case level == int(REQ) && option == NN_REQ_RESEND_IVL:
+		return mangos.OptionRetryTime, true
+	case level == int(SURVEYOR) && option == NN_SURVEYOR_DEADLINE:
+		return mangos.OptionSurveyTime, true
+	}
+	return "", false
+}
+
+// SetSockOptInt sets an integer option.
+func (s *Socket) SetSockOptInt(level, option int, value int) error {
+	if level == SOL_SOCKET {
+		switch option {
+		case NN_SNDTIMEO, NN_RCVTIMEO:
+			if value < -1 {
+				return syscall.EINVAL
+			}
+			s.mtx.Lock()
+			if option == NN_SNDTIMEO {
+				s.sndTimeo = ms(value)
+			} else {
+				s.rcvTimeo = ms(value)
+			}
+			s.mtx.Unlock()
+			return nil
+		case NN_SNDPRIO:
+			if value < 1 || value > 16 {
+				return syscall.EINVAL
+			}
+			s.mtx.Lock()
+			s.sndPrio = value
+			s.mtx.Unlock()
+			return nil
+		case NN_RCVMAXSIZE:
+			if value == -1 {
+				value = 0 // unlimited
+			} else if value < 1 {
+				return syscall.EINVAL
+			}
+		case NN_DOMAIN, NN_PROTOCOL:
+			return syscall.EINVAL // read-only
+		}
+	}
+	if level == NN_TCP && option == NN_TCP_NODELAY {
+		return errno(s.sock.SetOption(mangos.OptionNoDelay, value != 0))
+	}
+	name, isTime := sockOption(level, option)
+	if name == "" {
+		return syscall.ENOPROTOOPT
+	}
+	if isTime {
+		if value < 0 {
+			return syscall.EINVAL
+		}
+		return errno(s.sock.SetOption(name, ms(value)))
+	}
+	return errno(s.sock.SetOption(name, value))
+}
+
+// GetSockOptInt returns an integer option.
+func (s *Socket) GetSockOptInt(level, option int) (int, error) {
+	if level == SOL_SOCKET {
+		switch option {
+		case NN_SNDTIMEO, NN_RCVTIMEO:
+			s.mtx.Lock()
+			d := s.rcvTimeo
+			if option == NN_SNDTIMEO {
+				d = s.sndTimeo
+			}
+			s.mtx.Unlock()
+			if d < 0 {
+				return -1, nil
+			}
+			return toMs(d), nil
+		case NN_SNDPRIO:
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			return s.sndPrio, nil
+		case NN_DOMAIN:
+			return int(s.domain), nil
+		case NN_PROTOCOL:
+			return int(s.protocol), nil
+		}
+	}
+	if level == NN_TCP && option == NN_TCP_NODELAY {
+		v, err := s.sock.GetOption(mangos.OptionNoDelay)
+		if err != nil {
+			return 0, errno(err)
+		}
+		if b, _ := v.(bool); b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	name, isTime := sockOption(level, option)
+	if name == "" {
+		return 0, syscall.ENOPROTOOPT
+	}
+	v, err := s.sock.GetOption(name)
+	if err != nil {
+		return 0, errno(err)
+	}
+	switch v := v.(type) {
+	case time.Duration:
+		if isTime {
+			return toMs(v), nil
+		}
+	case int:
+		if name == mangos.OptionMaxRecvSize && v == 0 {
+			return -1, nil
+		}
+		return v, nil
+	}
+	return 0, syscall.ENOPROTOOPT
+}
+
+// SetSockOptString sets a string option, namely NN_SUB_SUBSCRIBE and
+// NN_SUB_UNSUBSCRIBE.
+func (s *Socket) SetSockOptString(level, option int, value string) error {
+	if level == int(SUB) {
+		switch option {
+		case NN_SUB_SUBSCRIBE:
+			return s.Subscribe(value)
+		case NN_SUB_UNSUBSCRIBE:
+			return s.Unsubscribe(value)
+		}
+	}
+	return syscall.ENOPROTOOPT
+}
+
+// Subscribe subscribes a SUB socket to topic.
+func (s *Socket) Subscribe(topic string) error {
+	return errno(s.sock.SetOption(mangos.OptionSubscribe, []byte(topic)))
+}
+
+// Unsubscribe removes a subscription from a SUB socket.
+func (s *Socket) Unsubscribe(topic string) error {
+	return errno(s.sock.SetOption(mangos.OptionUnsubscribe, []byte(topic)))
+}
+
+// SetSendTimeout sets the send timeout.  A negative value means forever.
+func (s *Socket) SetSendTimeout(timeout time.Duration) error {
+	s.mtx.Lock()
+	s.sndTimeo = timeout
+	s.mtx.Unlock()
+	return nil
+}
+
+// SendTimeout returns the send timeout.
+func (s *Socket) SendTimeout() (time.Duration, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sndTimeo, nil
+}
+
+// SetRecvTimeout sets the receive timeout.  A negative value means
+// forever.
+func (s *Socket) SetRecvTimeout(timeout time.Duration) error {
+	s.mtx.Lock()
+	s.rcvTimeo = timeout
+	s.mtx.Unlock()
+	return nil
+}
+
+// RecvTimeout returns the receive timeout.
+func (s *Socket) RecvTimeout() (time.Duration, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.rcvTimeo, nil
+}
+
+// SetLinger sets how long Close waits for queued messages to be sent.
+func (s *Socket) SetLinger(linger time.Duration) error {
+	if linger < 0 {
+		linger = 0
+	}
+	return errno(s.sock.SetOption(mangos.OptionLinger, linger))
+}
+
+// Linger returns how long Close waits for queued messages to be sent.
+func (s *Socket) Linger() (time.Duration, error) {
+	v, err := s.sock.GetOption(mangos.OptionLinger)
+	if err != nil {
+		return 0, errno(err)
+	}
+	return v.(time.Duration), nil
+}
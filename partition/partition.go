@@ -0,0 +1,123 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package partition spreads published messages over several PUB sockets,
+// one per partition, choosing the partition by hashing a key.  This lets
+// a group of subscribers share the consumption of a topic, each taking
+// one or more partitions, while messages with the same key are always
+// seen by the same subscriber, in order.
+package partition
+
+import (
+	"hash/fnv"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+)
+
+// Publisher owns a PUB socket for each partition.
+type Publisher struct {
+	socks []mangos.Socket
+}
+
+// NewPublisher returns a Publisher with n partitions.
+func NewPublisher(n int) (*Publisher, error) {
+	if n < 1 {
+		return nil, mangos.ErrBadValue
+	}
+	p := &Publisher{}
+	for i := 0; i < n; i++ {
+		s, err := pub.NewSocket()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.socks = append(p.socks, s)
+	}
+	return p, nil
+}
+
+// Partitions returns the number of partitions.
+func (p *Publisher) Partitions() int {
+	return len(p.socks)
+}
+
+// Socket returns the socket for partition i, so that it may be given
+// options, or made to listen or dial.
+func (p *Publisher) Socket(i int) mangos.Socket {
+	return p.socks[i]
+}
+
+// Listen has partition i listen on addrs[i].  There must be an address
+// for every partition.
+func (p *Publisher) Listen(addrs []string) error {
+	if len(addrs) != len(p.socks) {
+		return mangos.ErrBadAddr
+	}
+	for i, s := range p.socks {
+		if err := s.Listen(addrs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetOption sets an option on every partition's socket.
+func (p *Publisher) SetOption(name string, value interface{}) error {
+	for _, s := range p.socks {
+		if err := s.SetOption(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Partition returns the partition used for messages with the given key.
+func (p *Publisher) Partition(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(p.socks)))
+}
+
+// Send publishes body on the partition chosen by key.  The key is only
+// used for routing, and is not sent; subscribers that filter by topic
+// should have the topic at the front of body as usual.
+func (p *Publisher) Send(key, body []byte) error {
+	return p.socks[p.Partition(key)].Send(body)
+}
+
+// SendMsg publishes a message on the partition chosen by key.  As with
+// Socket.SendMsg, the Publisher takes ownership of the message.
+func (p *Publisher) SendMsg(key []byte, m *mangos.Message) error {
+	return p.socks[p.Partition(key)].SendMsg(m)
+}
+
+// Stats returns the statistics of each partition's socket.
+func (p *Publisher) Stats() []mangos.Stats {
+	stats := make([]mangos.Stats, 0, len(p.socks))
+	for _, s := range p.socks {
+		stats = append(stats, s.Stats())
+	}
+	return stats
+}
+
+// Close closes every partition's socket.
+func (p *Publisher) Close() error {
+	var err error
+	for _, s := range p.socks {
+		if e := s.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
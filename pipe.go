@@ -47,6 +47,15 @@ type Pipe interface {
 	Close() error
 }
 
+// PeerCred identifies the process at the other end of a local (ipc)
+// connection, as reported by the operating system when it was made.  It
+// is the value of OptionPeerCred.
+type PeerCred struct {
+	PID int // zero where the system does not report it
+	UID int
+	GID int
+}
+
 // PipeEvent determines what is actually transpiring on the Pipe.
 type PipeEvent int
 
@@ -64,6 +73,13 @@ const (
 	// PipeEventDetached occurs after the Pipe has been detached
 	// from the socket.
 	PipeEventDetached
+
+	// PipeEventRejected occurs when a connection was refused before it
+	// was ever attached, because it failed a policy check such as TLS
+	// peer verification (OptionTLSVerifyPeer) or the socket's AuthHook.
+	// The Pipe is already closed, but its options (for example
+	// OptionRemoteAddr) may still be examined.
+	PipeEventRejected
 )
 
 // PipeEventHook is an application supplied function to be called when
@@ -0,0 +1,116 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// PipeInfo describes a connection, either the one a message was received
+// on, or one of those listed by Socket.Pipes.  It is intended for
+// auditing, for things such as limiting the rate of each client, and for
+// finding out what a socket is actually connected to.
+type PipeInfo struct {
+	// ID is the Pipe's ID, unique among the connected pipes.
+	ID uint32
+
+	// Address is the address of the dialer or listener that made
+	// the pipe, such as "tcp://127.0.0.1:4000".
+	Address string
+
+	// Scheme is the transport scheme of Address, such as "tcp".
+	Scheme string
+
+	// LocalAddr and RemoteAddr are the addresses of either end of the
+	// connection, if the transport has them.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// TLS is the state of the TLS connection, if TLS is used.  The
+	// identity of a verified peer is in its PeerCertificates.
+	TLS *tls.ConnectionState
+
+	// The remaining fields are only set by Socket.Pipes.
+
+	// Role is "dialer" or "listener", for what made the pipe.
+	Role string
+
+	// State is "open", or "closed" if the pipe is being closed.
+	State string
+
+	// Connected is when the pipe was connected.
+	Connected time.Time
+
+	// These count the messages sent and received on the pipe, and
+	// their sizes, including headers.
+	MsgsSent  uint64
+	MsgsRecv  uint64
+	BytesSent uint64
+	BytesRecv uint64
+
+	// LastActive is when a message was last sent or received on the
+	// pipe, or when it was connected if none has been.  Throughput can
+	// be had by comparing the counters above between two calls.
+	LastActive time.Time
+
+	// Queued and Dropped are the messages waiting in the protocol's
+	// queue for the pipe, and those it has discarded for want of room,
+	// as reported with OptionPipeStats.  A peer that is not keeping up
+	// shows a full queue and a growing Dropped count, and may be shed
+	// with Socket.ClosePipe.  They are zero for protocols that do not
+	// report them.
+	Queued  uint64
+	Dropped uint64
+
+	// SendCredit and RecvCredit are the messages that may yet be sent
+	// to the peer, and that the peer may yet send, before more credit
+	// is granted, with OptionCreditWindow.  A sender out of credit shows
+	// a SendCredit of zero.  They are -1 where there is no limit.
+	SendCredit int
+	RecvCredit int
+}
+
+// PipeInfo returns details of the Pipe the message was received on.
+// The details are kept by the pipe, so they may still be had after it has
+// closed.  The second value is false if the message did not come from a
+// pipe (for example, because it was made with NewMessage).
+func (m *Message) PipeInfo() (PipeInfo, bool) {
+	p := m.Pipe
+	if p == nil {
+		return PipeInfo{}, false
+	}
+	info := PipeInfo{
+		ID:      p.ID(),
+		Address: p.Address(),
+	}
+	if i := strings.Index(info.Address, "://"); i > 0 {
+		info.Scheme = info.Address[:i]
+	}
+	if v, err := p.GetOption(OptionLocalAddr); err == nil {
+		info.LocalAddr, _ = v.(net.Addr)
+	}
+	if v, err := p.GetOption(OptionRemoteAddr); err == nil {
+		info.RemoteAddr, _ = v.(net.Addr)
+	}
+	if v, err := p.GetOption(OptionTLSConnState); err == nil {
+		if cs, ok := v.(tls.ConnectionState); ok {
+			info.TLS = &cs
+		}
+	}
+	return info, true
+}
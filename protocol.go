@@ -29,6 +29,11 @@ type ProtocolPipe interface {
 	// blocking call.
 	SendMsg(*Message) error
 
+	// SendMsgs sends the messages in order, with as few writes as the
+	// transport allows.  Unlike SendMsg, it owns the messages whether
+	// or not it succeeds.
+	SendMsgs([]*Message) error
+
 	// RecvMsg receives a message.  It blocks until the message is
 	// received.  On error, the pipe is closed and nil is returned.
 	RecvMsg() *Message
@@ -74,26 +79,60 @@ type ProtocolContext interface {
 
 // ProtocolBase provides the protocol-specific handling for sockets.
 // This is the new style API for sockets, and is how protocols provide
-// their specific handling.
+// their specific handling.  The socket itself (see protocol.MakeSocket)
+// takes care of transports, hooks, statistics and the options common to
+// all sockets, passing messages and the options it does not handle
+// itself to the protocol.  Protocols outside this package can be
+// registered with RegisterProtocol.
+//
+// A protocol may also implement ProtocolBatchReceiver and
+// ProtocolDebugger, and its contexts ProtocolCanceler, for the features
+// those provide.
 type ProtocolBase interface {
 	ProtocolContext
 
-	// Info returns the information describing this protocol.
+	// Info returns the information describing this protocol.  The
+	// protocol numbers are exchanged with peers when connecting, and
+	// those that do not match are refused.
 	Info() ProtocolInfo
 
-	// XXX: Revisit these when we can use Pipe natively.
-
 	// AddPipe is called when a new Pipe is added to the socket.
 	// Typically this is as a result of connect or accept completing.
+	// Returning an error refuses the pipe, which is then closed.
 	AddPipe(ProtocolPipe) error
 
 	// RemovePipe is called when a Pipe is removed from the socket.
 	// Typically this indicates a disconnected or closed connection.
 	RemovePipe(ProtocolPipe)
 
+	// OpenContext returns a new context, for protocols supporting
+	// them.  Those that do not return ErrProtoOp.
 	OpenContext() (ProtocolContext, error)
 }
 
+// ProtocolBatchReceiver is implemented by protocols that can return
+// several queued messages at once, for Socket.RecvMsgs.  Those that do
+// not are given one message at a time.
+type ProtocolBatchReceiver interface {
+	// RecvMsgs waits for a message as RecvMsg does, and returns it
+	// along with as many more as are already queued, up to max in all.
+	RecvMsgs(max int) ([]*Message, error)
+}
+
+// ProtocolDebugger is implemented by protocols that report their
+// internal state, for Socket.Debug.  The socket fills in the Protocol
+// and Raw fields itself.
+type ProtocolDebugger interface {
+	Debug() ProtocolState
+}
+
+// ProtocolCanceler is implemented by protocol contexts that support
+// Context.Cancel.
+type ProtocolCanceler interface {
+	// Cancel abandons the outstanding request, if there is one.
+	Cancel() error
+}
+
 // Useful constants for protocol numbers.  Note that the major protocol number
 // is stored in the upper 12 bits, and the minor (subprotocol) is located in
 // the bottom 4 bits.
@@ -0,0 +1,105 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AdaptPeriod is the interval over which an AdaptiveQ judges how its
+// queue is being used.
+var AdaptPeriod = time.Millisecond * 100
+
+// AdaptiveQ decides how deep a per-pipe queue may get, between a minimum
+// and a maximum, according to how the queue is used.  When the queue is
+// full, but the pipe has been draining it, the limit doubles.  When the
+// queue has stayed below a quarter of the limit for a period, the limit
+// halves.  The queue channel itself must be able to hold the maximum.
+//
+// Admit is called with the socket lock held, and Drained by the pipe's
+// sender as it takes each message.
+type AdaptiveQ struct {
+	min     int
+	max     int
+	limit   int
+	high    int
+	drained int64
+	start   time.Time
+}
+
+// NewAdaptiveQ returns an AdaptiveQ starting at depth n, which is clamped
+// to the range min to max.
+func NewAdaptiveQ(n, min, max int) *AdaptiveQ {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if n < min {
+		n = min
+	}
+	if n > max {
+		n = max
+	}
+	return &AdaptiveQ{min: min, max: max, limit: n, start: time.Now()}
+}
+
+// Admit reports whether one more message may be added to a queue which
+// already holds n, adjusting the limit as needed.
+func (q *AdaptiveQ) Admit(n int) bool {
+	if now := time.Now(); now.Sub(q.start) >= AdaptPeriod {
+		if q.high < q.limit/4 && q.limit > q.min {
+			q.limit /= 2
+			if q.limit < q.min {
+				q.limit = q.min
+			}
+		}
+		q.high = 0
+		q.start = now
+		atomic.StoreInt64(&q.drained, 0)
+	}
+	if n > q.high {
+		q.high = n
+	}
+	if n < q.limit {
+		return true
+	}
+	if q.limit < q.max && atomic.LoadInt64(&q.drained) > 0 {
+		q.limit *= 2
+		if q.limit > q.max {
+			q.limit = q.max
+		}
+		atomic.StoreInt64(&q.drained, 0)
+		return n < q.limit
+	}
+	return false
+}
+
+// Drained notes that a message was taken from the queue.
+func (q *AdaptiveQ) Drained() {
+	atomic.AddInt64(&q.drained, 1)
+}
+
+// Max returns the maximum depth, which the queue must be able to hold.
+func (q *AdaptiveQ) Max() int {
+	return q.max
+}
+
+// Limit returns the current depth limit.
+func (q *AdaptiveQ) Limit() int {
+	return q.limit
+}
@@ -0,0 +1,270 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"time"
+)
+
+// Balancer chooses which of the ready pipes sends next, according to
+// the OptionLoadBalance strategy.  Only the pipes with the best dial
+// priority (see OptionDialPriority) of those connected are considered.
+// It keeps the weights of the pipes for LoadBalanceWeighted, and their
+// round-trip times for LoadBalanceLatency.  The caller must serialize
+// access to it, usually with the socket lock.
+type Balancer struct {
+	mode  LoadBalance
+	peers map[uint32]*balancePeer
+	next  uint32 // pipe being waited for, if weighted
+	turns int    // choices made, for exploring with LoadBalanceLatency
+}
+
+// latencyExplore is how often LoadBalanceLatency gives a message to the
+// peer measured longest ago, rather than the fastest.
+const latencyExplore = 16
+
+type balancePeer struct {
+	weight   int
+	priority int
+	current  int           // smooth weighted round-robin credit
+	down     bool          // passed over, see SetDown
+	rtt      time.Duration // smoothed round-trip time
+	measured time.Time     // when rtt was last updated
+}
+
+// NewBalancer returns a Balancer using round-robin.
+func NewBalancer() *Balancer {
+	return &Balancer{peers: make(map[uint32]*balancePeer)}
+}
+
+// SetStrategy handles the value of OptionLoadBalance.
+func (b *Balancer) SetStrategy(value interface{}) error {
+	if v, ok := value.(LoadBalance); ok &&
+		v >= LoadBalanceRoundRobin && v <= LoadBalanceLatency {
+		b.mode = v
+		b.next = 0
+		return nil
+	}
+	return ErrBadValue
+}
+
+// Strategy returns the strategy in use.
+func (b *Balancer) Strategy() LoadBalance {
+	return b.mode
+}
+
+// pipeInt returns an integer option of the pipe, or def if it has none.
+func pipeInt(p Pipe, name string, def int) int {
+	// The core pipes have options, though the protocol interface
+	// does not require them.
+	if op, ok := p.(interface {
+		GetOption(string) (interface{}, error)
+	}); ok {
+		if v, err := op.GetOption(name); err == nil {
+			if n, ok := v.(int); ok && n > 0 {
+				return n
+			}
+		}
+	}
+	return def
+}
+
+// PipeWeight returns the weight of the pipe, from OptionWeight.  As
+// this may consult the socket, it must not be called with the protocol
+// lock held.
+func PipeWeight(p Pipe) int {
+	return pipeInt(p, OptionWeight, 1)
+}
+
+// PipePriority returns the priority of the pipe, from OptionDialPriority.
+// Like PipeWeight, it must not be called with the protocol lock held.
+func PipePriority(p Pipe) int {
+	return pipeInt(p, OptionDialPriority, DefaultDialPriority)
+}
+
+// AddPipe records the pipe, with its weight and priority (see PipeWeight
+// and PipePriority).
+func (b *Balancer) AddPipe(p Pipe, weight, priority int) {
+	b.peers[p.ID()] = &balancePeer{weight: weight, priority: priority}
+}
+
+// RemovePipe forgets the pipe.
+func (b *Balancer) RemovePipe(p Pipe) {
+	delete(b.peers, p.ID())
+	if b.next == p.ID() {
+		b.next = 0
+	}
+}
+
+// Observe records a round trip to the pipe's peer, for
+// LoadBalanceLatency.  The times are smoothed, so that one slow reply
+// does not count for much.
+func (b *Balancer) Observe(p Pipe, rtt time.Duration) {
+	bp, ok := b.peers[p.ID()]
+	if !ok {
+		return
+	}
+	if bp.measured.IsZero() {
+		bp.rtt = rtt
+	} else {
+		bp.rtt += (rtt - bp.rtt) / 4
+	}
+	bp.measured = time.Now()
+}
+
+// SetDown marks the pipe as unfit to send on, or fit again.  Pipes that
+// are down are never chosen, and do not count when finding the best
+// priority, so that those of the next priority take over.
+func (b *Balancer) SetDown(p Pipe, down bool) {
+	if bp, ok := b.peers[p.ID()]; ok {
+		bp.down = down
+	}
+	if down && b.next == p.ID() {
+		b.next = 0
+	}
+}
+
+// top returns the best (numerically lowest) priority of the pipes.
+func (b *Balancer) top() int {
+	top := 0
+	for _, bp := range b.peers {
+		if bp.down {
+			continue
+		}
+		if top == 0 || bp.priority < top {
+			top = bp.priority
+		}
+	}
+	return top
+}
+
+// Choose returns the index, among n ready pipes, of the one to send
+// next, or -1 if the message should wait for a pipe that is busy.  The
+// ready pipes should be in the order they became ready.  The id
+// function gives the ID of the i'th ready pipe, and queued the number
+// of messages it has outstanding; queued may be nil if they are not
+// known.  Once it returns -1, Choose should be called again when
+// another pipe is ready, or one has been removed.
+func (b *Balancer) Choose(n int, id func(i int) uint32, queued func(i int) int) int {
+	top := b.top()
+	eligible := func(i int) bool {
+		bp, ok := b.peers[id(i)]
+		return !ok || (bp.priority == top && !bp.down)
+	}
+
+	switch b.mode {
+	case LoadBalanceLeastQueued:
+		best, least := -1, 0
+		for i := 0; i < n; i++ {
+			if !eligible(i) {
+				continue
+			}
+			q := 0
+			if queued != nil {
+				q = queued(i)
+			}
+			if best < 0 || q < least {
+				best, least = i, q
+			}
+		}
+		return best
+
+	case LoadBalanceWeighted:
+		if b.next == 0 {
+			b.next = b.pick(top)
+		}
+		if b.next == 0 {
+			return -1
+		}
+		for i := 0; i < n; i++ {
+			if id(i) == b.next {
+				b.next = 0
+				return i
+			}
+		}
+		return -1
+
+	case LoadBalanceLatency:
+		for i := 0; i < n; i++ {
+			if bp, ok := b.peers[id(i)]; eligible(i) &&
+				(!ok || bp.measured.IsZero()) {
+				return i // try it, to find out
+			}
+		}
+		// Wait for the best, even if it is busy, as the others are
+		// slower.
+		want := b.fastest(top, (b.turns+1)%latencyExplore == 0)
+		for i := 0; i < n; i++ {
+			if id(i) == want {
+				b.turns++
+				return i
+			}
+		}
+		return -1
+	}
+	for i := 0; i < n; i++ {
+		if eligible(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+// fastest returns the ID of the measured pipe of the given priority with
+// the shortest round trips or, if exploring, the one measured longest
+// ago.
+func (b *Balancer) fastest(priority int, explore bool) uint32 {
+	var best uint32
+	var chosen *balancePeer
+	for pid, bp := range b.peers {
+		if bp.priority != priority || bp.down || bp.measured.IsZero() {
+			continue
+		}
+		switch {
+		case chosen == nil:
+		case explore && bp.measured.Before(chosen.measured):
+		case !explore && bp.rtt < chosen.rtt:
+		default:
+			continue
+		}
+		best, chosen = pid, bp
+	}
+	return best
+}
+
+// pick returns the ID of the next pipe of the given priority in the
+// weighted sequence.  This is the smooth weighted round-robin used by
+// nginx, which spreads the turns of heavier pipes evenly among the
+// others.
+func (b *Balancer) pick(priority int) uint32 {
+	var best uint32
+	var chosen *balancePeer
+	total := 0
+	for pid, bp := range b.peers {
+		if bp.priority != priority || bp.down {
+			continue
+		}
+		bp.current += bp.weight
+		total += bp.weight
+		if chosen == nil || bp.current > chosen.current ||
+			(bp.current == chosen.current && pid < best) {
+			best, chosen = pid, bp
+		}
+	}
+	if chosen != nil {
+		chosen.current -= total
+	}
+	return best
+}
@@ -57,6 +57,10 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 	return s.Protocol.SendMsg(m)
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, false, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 
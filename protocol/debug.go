@@ -0,0 +1,53 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// SortState puts the parts of a ProtocolState in order, requests and
+// backtraces by ID and pipes by ID, as Socket.Debug reports them.
+// Protocols gathering the state from maps call it before returning it.
+func SortState(st *ProtocolState) {
+	sort.Slice(st.Pending, func(i, j int) bool {
+		return st.Pending[i].ID < st.Pending[j].ID
+	})
+	sort.Slice(st.Backtraces, func(i, j int) bool {
+		return st.Backtraces[i].ID < st.Backtraces[j].ID
+	})
+	sort.Slice(st.Pipes, func(i, j int) bool {
+		return st.Pipes[i].ID < st.Pipes[j].ID
+	})
+}
+
+// Backtrace returns the state of a request awaiting a reply on the pipe
+// with the given ID, from the backtrace that was taken from its header:
+// the IDs of the pipes of any devices it passed through, and last the
+// request ID itself.
+func Backtrace(pipe uint32, bt []byte) BacktraceState {
+	st := BacktraceState{Pipe: pipe}
+	for len(bt) >= 4 {
+		v := binary.BigEndian.Uint32(bt)
+		bt = bt[4:]
+		if len(bt) < 4 {
+			st.ID = v
+			break
+		}
+		st.Hops = append(st.Hops, v)
+	}
+	return st
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of points each pipe has on a HashRing,
+// which evens out the share of keys each gets.
+const ringReplicas = 64
+
+// HashRing maps keys to pipes by consistent hashing, for OptionHashRoute.
+// When a pipe is added or removed, only the keys it gains or loses move.
+// The caller must serialize access to it, usually with the socket lock.
+type HashRing struct {
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash uint64
+	id   uint32
+}
+
+// NewHashRing returns an empty HashRing.
+func NewHashRing() *HashRing {
+	return &HashRing{}
+}
+
+// PipeName returns the name that places the pipe on a HashRing.  Pipes
+// that were dialed are named by the address, so that a peer keeps its
+// keys when it reconnects; others have only their ID.  As this may
+// consult the socket, it must not be called with the protocol lock held.
+func PipeName(p Pipe) string {
+	if sp, ok := p.(SocketPipe); ok && sp.Dialer() != nil {
+		return sp.Address()
+	}
+	return "#" + strconv.FormatUint(uint64(p.ID()), 10)
+}
+
+// hashKey hashes with FNV-1a, and then mixes the bits, as FNV alone
+// spreads short keys (and names that differ only at the end) poorly.
+func hashKey(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// AddPipe places the pipe on the ring, under the name from PipeName.
+func (r *HashRing) AddPipe(p Pipe, name string) {
+	for i := 0; i < ringReplicas; i++ {
+		h := hashKey([]byte(name + "/" + strconv.Itoa(i)))
+		r.points = append(r.points, ringPoint{hash: h, id: p.ID()})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		a, b := r.points[i], r.points[j]
+		return a.hash < b.hash || (a.hash == b.hash && a.id < b.id)
+	})
+}
+
+// RemovePipe takes the pipe off the ring.
+func (r *HashRing) RemovePipe(p Pipe) {
+	points := r.points[:0]
+	for _, pt := range r.points {
+		if pt.id != p.ID() {
+			points = append(points, pt)
+		}
+	}
+	r.points = points
+}
+
+// Lookup returns the ID of the pipe for the key, or 0 if the ring is
+// empty.
+func (r *HashRing) Lookup(key []byte) uint32 {
+	if len(r.points) == 0 {
+		return 0
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].id
+}
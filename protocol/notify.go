@@ -0,0 +1,63 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+// Notifier is a channel holding at most one notification, as returned
+// for OptionRecvReady and OptionSendReady.  Notify never blocks, and a
+// notification that has not yet been taken stands for any that follow
+// it, so that waking the application does not depend on it keeping up.
+type Notifier chan struct{}
+
+// NewNotifier returns a Notifier with no notification pending.
+func NewNotifier() Notifier {
+	return make(Notifier, 1)
+}
+
+// Notify posts a notification, unless one is already pending.
+func (n Notifier) Notify() {
+	select {
+	case n <- struct{}{}:
+	default:
+	}
+}
+
+// Set posts a notification if ready is true, and otherwise withdraws one
+// that is pending, as the condition it reported no longer holds.
+func (n Notifier) Set(ready bool) {
+	if ready {
+		n.Notify()
+		return
+	}
+	select {
+	case <-n:
+	default:
+	}
+}
+
+// Chan returns the Notifier as the receive-only channel given to the
+// application.
+func (n Notifier) Chan() <-chan struct{} {
+	return n
+}
+
+// Ready is a channel that is always ready, for OptionSendReady on
+// sockets that never block sending.
+var Ready <-chan struct{}
+
+func init() {
+	c := make(chan struct{})
+	close(c)
+	Ready = c
+}
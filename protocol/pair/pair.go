@@ -41,6 +41,14 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 	return s.Protocol.GetOption(name)
 }
 
+func (s *socket) RecvMsgs(max int) ([]*protocol.Message, error) {
+	return s.Protocol.(protocol.BatchReceiver).RecvMsgs(max)
+}
+
+func init() {
+	protocol.RegisterProtocol(SelfName, false, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
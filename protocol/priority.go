@@ -0,0 +1,174 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+// MaxSendPriorities is the most priority levels OptionSendPriorities
+// allows.
+const MaxSendPriorities = 4
+
+// ParseSendPriorities handles the value of OptionSendPriorities.
+func ParseSendPriorities(value interface{}) (int, error) {
+	if v, ok := value.(int); ok && v >= 1 && v <= MaxSendPriorities {
+		return v, nil
+	}
+	return 0, ErrBadValue
+}
+
+// Lanes are the send queues for messages of a priority above zero (see
+// Message.SetPriority), for OptionSendPriorities.  Those of priority
+// zero go on the protocol's own queue, as they always have.  Lanes are
+// made when the option asks for them, and then kept, so that what is
+// queued on them is still sent if the option is lowered.  Like the
+// protocol's queue, the lanes are changed only under its lock, and a
+// sender works from a copy taken under it, which it takes afresh when
+// the channel closed by Resize is closed.
+type Lanes struct {
+	q     [MaxSendPriorities - 1]chan *Message
+	n     int           // lanes in use
+	ready chan struct{} // signalled as messages are put on a lane
+}
+
+// SetPriorities has the lanes serve n priorities, making those missing,
+// each holding qlen messages.  If any are made, the channel *resized is
+// closed and replaced, as Resize does, so that senders take the lanes
+// afresh.  The lock must be held.
+func (l *Lanes) SetPriorities(n, qlen int, resized *chan struct{}) {
+	if l.ready == nil {
+		l.ready = make(chan struct{}, 1)
+	}
+	made := false
+	for i := 0; i < n-1; i++ {
+		if l.q[i] == nil {
+			l.q[i] = make(chan *Message, qlen)
+			made = true
+		}
+	}
+	l.n = n - 1
+	if made {
+		close(*resized)
+		*resized = make(chan struct{})
+	}
+}
+
+// Queue returns where the message should be queued: q, the protocol's
+// own queue, for priority zero, and otherwise its lane, the highest for
+// a priority beyond those in use.  The lock must be held.
+func (l *Lanes) Queue(m *Message, q *chan *Message) *chan *Message {
+	p := m.Priority()
+	if p > l.n {
+		p = l.n
+	}
+	if p == 0 {
+		return q
+	}
+	return &l.q[p-1]
+}
+
+// Queued wakes a sender waiting on Ready, once a message has been put on
+// a lane.  The lock must be held.
+func (l *Lanes) Queued() {
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready returns a channel that is signalled as messages are put on the
+// lanes, for a sender to wait on along with the protocol's own queue.
+// It is nil, and so never ready, until there are lanes.
+func (l *Lanes) Ready() <-chan struct{} {
+	return l.ready
+}
+
+// Len returns the number of messages waiting on the lanes.
+func (l *Lanes) Len() int {
+	n := 0
+	for _, q := range l.q {
+		n += len(q)
+	}
+	return n
+}
+
+// Resize resizes the lanes to hold n messages each, as Resize does the
+// protocol's own queue, and returns the number of messages that did not
+// fit.  The caller must Resize its own queue afterwards, which wakes
+// those waiting on the lanes too.  The lock must be held.
+func (l *Lanes) Resize(n int) int {
+	dropped := 0
+	for i, q := range l.q {
+		if q != nil {
+			l.q[i] = make(chan *Message, n)
+			dropped += Requeue(q, l.q[i])
+		}
+	}
+	return dropped
+}
+
+// Take returns the message waiting with the highest priority, or nil if
+// the lanes are empty.  It never waits.
+func (l *Lanes) Take() *Message {
+	for i := len(l.q) - 1; i >= 0; i-- {
+		if l.q[i] == nil {
+			continue
+		}
+		select {
+		case m := <-l.q[i]:
+			return m
+		default:
+		}
+	}
+	return nil
+}
+
+// Free discards the messages waiting on the lanes.
+func (l *Lanes) Free() {
+	for m := l.Take(); m != nil; m = l.Take() {
+		m.Free()
+	}
+}
+
+// DequeueLanes is Dequeue for a queue q with lanes.  The message m was
+// just taken from q, or is nil if the sender was woken by Ready instead.
+// It returns the messages waiting on the lanes, highest priority first,
+// followed by m and those waiting behind it, up to max in all, and
+// possibly none.  If more are left on the lanes, another sender waiting
+// on Ready is woken.
+func DequeueLanes(l *Lanes, q chan *Message, m *Message, max int) []*Message {
+	var msgs []*Message
+	room := max
+	if m != nil {
+		room-- // m must go, whatever else does
+	}
+	for len(msgs) < room {
+		lm := l.Take()
+		if lm == nil {
+			break
+		}
+		msgs = append(msgs, lm)
+	}
+	if l.Len() > 0 {
+		l.Queued()
+	}
+	if m == nil && len(msgs) < max {
+		select {
+		case m = <-q:
+		default:
+		}
+	}
+	if m != nil {
+		msgs = append(msgs, Dequeue(q, m, max-len(msgs))...)
+	}
+	return msgs
+}
@@ -50,6 +50,27 @@ type Context = mangos.ProtocolContext
 // Protocol is the main ops vector for a protocol.
 type Protocol = mangos.ProtocolBase
 
+// BatchReceiver is implemented by protocols supporting Socket.RecvMsgs.
+type BatchReceiver = mangos.ProtocolBatchReceiver
+
+// Debugger is implemented by protocols supporting Socket.Debug.
+type Debugger = mangos.ProtocolDebugger
+
+// ProtocolState is an alias for the common mangos.ProtocolState.
+type ProtocolState = mangos.ProtocolState
+
+// RequestState is an alias for the common mangos.RequestState.
+type RequestState = mangos.RequestState
+
+// BacktraceState is an alias for the common mangos.BacktraceState.
+type BacktraceState = mangos.BacktraceState
+
+// PipeState is an alias for the common mangos.ProtocolPipeState.
+type PipeState = mangos.ProtocolPipeState
+
+// Canceler is implemented by protocol contexts supporting Context.Cancel.
+type Canceler = mangos.ProtocolCanceler
+
 // Socket is the interface definition of a mangos.Socket.
 // We need this for creating new ones.
 type Socket = mangos.Socket
@@ -57,6 +78,24 @@ type Socket = mangos.Socket
 // Message is an alias for the common mangos.Message.
 type Message = mangos.Message
 
+// NewMessage is an alias for the common mangos.NewMessage.
+var NewMessage = mangos.NewMessage
+
+// Logger is an alias for the common mangos.Logger.
+type Logger = mangos.Logger
+
+// RetryPolicy is an alias for the common mangos.RetryPolicy.
+type RetryPolicy = mangos.RetryPolicy
+
+// Clock is an alias for the common mangos.Clock.
+type Clock = mangos.Clock
+
+// Timer is an alias for the common mangos.Timer.
+type Timer = mangos.Timer
+
+// SystemClock is an alias for the common mangos.SystemClock.
+var SystemClock = mangos.SystemClock
+
 // Borrow common error codes for convenience.
 const (
 	ErrClosed      = errors.ErrClosed
@@ -67,26 +106,205 @@ const (
 	ErrProtoOp     = errors.ErrProtoOp
 	ErrProtoState  = errors.ErrProtoState
 	ErrCanceled    = errors.ErrCanceled
+	ErrNoRoute     = errors.ErrNoRoute
 )
 
 // Common option definitions
 // We have elided transport-specific options here.
 const (
-	OptionRaw          = mangos.OptionRaw
-	OptionRecvDeadline = mangos.OptionRecvDeadline
-	OptionSendDeadline = mangos.OptionSendDeadline
-	OptionRetryTime    = mangos.OptionRetryTime
-	OptionSubscribe    = mangos.OptionSubscribe
-	OptionUnsubscribe  = mangos.OptionUnsubscribe
-	OptionSurveyTime   = mangos.OptionSurveyTime
-	OptionWriteQLen    = mangos.OptionWriteQLen
-	OptionReadQLen     = mangos.OptionReadQLen
-	OptionLinger       = mangos.OptionLinger // Remove?
-	OptionTTL          = mangos.OptionTTL
-	OptionBestEffort   = mangos.OptionBestEffort
+	OptionRaw             = mangos.OptionRaw
+	OptionRecvDeadline    = mangos.OptionRecvDeadline
+	OptionSendDeadline    = mangos.OptionSendDeadline
+	OptionRetryTime       = mangos.OptionRetryTime
+	OptionRetryPolicy     = mangos.OptionRetryPolicy
+	OptionBusyPoll        = mangos.OptionBusyPoll
+	OptionSubscribe       = mangos.OptionSubscribe
+	OptionUnsubscribe     = mangos.OptionUnsubscribe
+	OptionSurveyTime      = mangos.OptionSurveyTime
+	OptionWriteQLen       = mangos.OptionWriteQLen
+	OptionWriteQMaxLen    = mangos.OptionWriteQMaxLen
+	OptionWriteQMinLen    = mangos.OptionWriteQMinLen
+	OptionSendPriorities  = mangos.OptionSendPriorities
+	OptionReadQLen        = mangos.OptionReadQLen
+	OptionRecvFair        = mangos.OptionRecvFair
+	OptionRecvPipeShare   = mangos.OptionRecvPipeShare
+	OptionLinger          = mangos.OptionLinger
+	OptionTTL             = mangos.OptionTTL
+	OptionBestEffort      = mangos.OptionBestEffort
+	OptionSynchronous     = mangos.OptionSynchronous
+	OptionPolyamorous     = mangos.OptionPolyamorous
+	OptionProtocolStats   = mangos.OptionProtocolStats
+	OptionPipeStats       = mangos.OptionPipeStats
+	OptionLogger          = mangos.OptionLogger
+	OptionClock           = mangos.OptionClock
+	OptionLoadBalance     = mangos.OptionLoadBalance
+	OptionWeight          = mangos.OptionWeight
+	OptionDialPriority    = mangos.OptionDialPriority
+	OptionRetain          = mangos.OptionRetain
+	OptionRetainTopic     = mangos.OptionRetainTopic
+	OptionReplay          = mangos.OptionReplay
+	OptionRetainAge       = mangos.OptionRetainAge
+	OptionReplayOnConnect = mangos.OptionReplayOnConnect
+	OptionReplayMarker    = mangos.OptionReplayMarker
+	OptionSpoolDir        = mangos.OptionSpoolDir
+	OptionSpoolMaxBytes   = mangos.OptionSpoolMaxBytes
+	OptionAckDelivery     = mangos.OptionAckDelivery
+	OptionAckTimeout      = mangos.OptionAckTimeout
+	OptionAckStore        = mangos.OptionAckStore
+	OptionProbeInterval   = mangos.OptionProbeInterval
+	OptionProbeTimeout    = mangos.OptionProbeTimeout
+	OptionSubForward      = mangos.OptionSubForward
+	OptionSubWildcard     = mangos.OptionSubWildcard
+	OptionNoRoute         = mangos.OptionNoRoute
+	OptionDeadLetter      = mangos.OptionDeadLetter
+	OptionRequestID       = mangos.OptionRequestID
+	OptionReplyMismatch   = mangos.OptionReplyMismatch
+	OptionQueueFullPolicy = mangos.OptionQueueFullPolicy
+	OptionRecvReady       = mangos.OptionRecvReady
+	OptionSendReady       = mangos.OptionSendReady
+)
+
+// Options for subscription forwarding.
+const (
+	OptionSubscriptions        = mangos.OptionSubscriptions
+	OptionSubscriptionsChanged = mangos.OptionSubscriptionsChanged
+	OptionSubscriptionFunc     = mangos.OptionSubscriptionFunc
+)
+
+// SubscriptionEvent is an alias for the common mangos.SubscriptionEvent.
+type SubscriptionEvent = mangos.SubscriptionEvent
+
+// SubscriptionFunc is an alias for the common mangos.SubscriptionFunc.
+type SubscriptionFunc = mangos.SubscriptionFunc
+
+// OptionSendWorkers is for PUB sending with a shared pool of goroutines.
+const OptionSendWorkers = mangos.OptionSendWorkers
+
+// OptionSourceTag is for tagging messages with their sender.
+const OptionSourceTag = mangos.OptionSourceTag
+
+// SourceTagFunc is an alias for the mangos.SourceTagFunc.
+type SourceTagFunc = mangos.SourceTagFunc
+
+// SocketPipe is an alias for mangos.Pipe, the view of a pipe given to
+// applications, as in Message.Pipe.
+type SocketPipe = mangos.Pipe
+
+// PipeIDTag is an alias for mangos.PipeIDTag.
+var PipeIDTag = mangos.PipeIDTag
+
+// OptionHashRoute is for routing by consistent hashing.
+const OptionHashRoute = mangos.OptionHashRoute
+
+// OptionSurveyRespondents is the number of respondents a survey went to.
+const OptionSurveyRespondents = mangos.OptionSurveyRespondents
+
+// HashRouteFunc is an alias for the mangos.HashRouteFunc.
+type HashRouteFunc = mangos.HashRouteFunc
+
+// AckHeaderLen is the length of the header that a PUSH socket with
+// OptionAckDelivery puts in front of each message.  This is the ID of
+// the message, with the high bit set, followed by the number of times it
+// was sent before, each four bytes in network order.  The acknowledgment
+// sent back by PULL is just the ID, and a refusal (see Message.Nack) is
+// the ID with the high bit clear.
+const AckHeaderLen = 8
+
+// AckStore is an alias for the mangos.AckStore.
+type AckStore = mangos.AckStore
+
+// RetainTopicFunc is an alias for the mangos.RetainTopicFunc.
+type RetainTopicFunc = mangos.RetainTopicFunc
+
+// ReplayRequest is the body of the message that a SUB socket with
+// OptionReplay sends to each PUB peer, asking for its retained messages.
+// Nothing is otherwise sent in this direction, so PUB peers that do not
+// understand it discard it.
+var ReplayRequest = []byte("\x00mangos-replay\x00")
+
+// DefaultDialPriority is the priority of pipes without OptionDialPriority.
+const DefaultDialPriority = mangos.DefaultDialPriority
+
+// LoadBalance is an alias for the mangos.LoadBalance strategy.
+type LoadBalance = mangos.LoadBalance
+
+// Load balancing strategies, for use with OptionLoadBalance.
+const (
+	LoadBalanceRoundRobin  = mangos.LoadBalanceRoundRobin
+	LoadBalanceLeastQueued = mangos.LoadBalanceLeastQueued
+	LoadBalanceWeighted    = mangos.LoadBalanceWeighted
+	LoadBalanceLatency     = mangos.LoadBalanceLatency
+)
+
+// NoRoute is an alias for the mangos.NoRoute policy.
+type NoRoute = mangos.NoRoute
+
+// Policies for undeliverable replies, for use with OptionNoRoute.
+const (
+	NoRouteDrop       = mangos.NoRouteDrop
+	NoRouteDeadLetter = mangos.NoRouteDeadLetter
+	NoRouteError      = mangos.NoRouteError
+)
+
+// DeadLetterFunc is an alias for the mangos.DeadLetterFunc.
+type DeadLetterFunc = mangos.DeadLetterFunc
+
+// ReplyMismatchFunc is an alias for the mangos.ReplyMismatchFunc.
+type ReplyMismatchFunc = mangos.ReplyMismatchFunc
+
+// QueueFullPolicy is an alias for the mangos.QueueFullPolicy.
+type QueueFullPolicy = mangos.QueueFullPolicy
+
+// Policies for full queues, for use with OptionQueueFullPolicy.
+const (
+	QueueFullBlock      = mangos.QueueFullBlock
+	QueueFullDropNewest = mangos.QueueFullDropNewest
+	QueueFullDropOldest = mangos.QueueFullDropOldest
+)
+
+// Protocol counter names, for use with OptionProtocolStats.
+const (
+	StatDropped        = mangos.StatDropped
+	StatEchoSuppressed = mangos.StatEchoSuppressed
+	StatQueued         = mangos.StatQueued
+	StatAwaiting       = mangos.StatAwaiting
+	StatSpooled        = mangos.StatSpooled
+	StatRedelivered    = mangos.StatRedelivered
+	StatNacked         = mangos.StatNacked
+	StatUnhealthy      = mangos.StatUnhealthy
 )
 
 // MakeSocket creates a Socket on top of a Protocol.
 func MakeSocket(proto Protocol) Socket {
 	return core.MakeSocket(proto)
 }
+
+// NewProtocolFunc is an alias for the mangos.NewProtocolFunc.
+type NewProtocolFunc = mangos.NewProtocolFunc
+
+// RegisterProtocol registers a protocol implementation by name.  This is
+// the same as mangos.RegisterProtocol.
+func RegisterProtocol(name string, raw bool, newProto NewProtocolFunc) {
+	mangos.RegisterProtocol(name, raw, newProto)
+}
+
+// NewSocket creates a Socket using the protocol registered under the
+// given name, such as "req", returning ErrBadProto if there is none.
+// The protocols supplied with mangos are only registered if their
+// packages are imported.
+func NewSocket(name string) (Socket, error) {
+	proto, err := mangos.NewProtocol(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return MakeSocket(proto), nil
+}
+
+// NewRawSocket is like NewSocket, but creates a raw mode Socket.
+func NewRawSocket(name string) (Socket, error) {
+	proto, err := mangos.NewProtocol(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return MakeSocket(proto), nil
+}
@@ -42,6 +42,14 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 	return s.Protocol.GetOption(name)
 }
 
+func (s *socket) Debug() protocol.ProtocolState {
+	return s.Protocol.(protocol.Debugger).Debug()
+}
+
+func init() {
+	protocol.RegisterProtocol(SelfName, false, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
@@ -0,0 +1,233 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// ParseQueueFullPolicy handles the value of OptionQueueFullPolicy.
+func ParseQueueFullPolicy(value interface{}) (QueueFullPolicy, error) {
+	if v, ok := value.(QueueFullPolicy); ok &&
+		v >= QueueFullBlock && v <= QueueFullDropOldest {
+		return v, nil
+	}
+	return QueueFullBlock, ErrBadValue
+}
+
+// Enqueue adds a message to a send queue, applying the policy if the
+// queue is full.  With QueueFullBlock it waits for room, failing with
+// ErrClosed if closeq is closed first, or ErrSendTimeout if tq fires; on
+// failure the message is still the caller's.  With the other policies
+// it never waits, and returns how many messages it discarded, which the
+// caller should count.  A queue without a buffer has no oldest message,
+// so QueueFullDropOldest discards the newest instead.
+func Enqueue(q chan *Message, m *Message, policy QueueFullPolicy,
+	closeq <-chan struct{}, tq <-chan time.Time) (int, error) {
+
+	if policy == QueueFullBlock {
+		select {
+		case q <- m:
+			return 0, nil
+		case <-closeq:
+			return 0, ErrClosed
+		case <-tq:
+			return 0, ErrSendTimeout
+		}
+	}
+
+	dropped := 0
+	for {
+		select {
+		case q <- m:
+			return dropped, nil
+		default:
+		}
+		if policy != QueueFullDropOldest || cap(q) == 0 {
+			m.Free()
+			return dropped + 1, nil
+		}
+		// The queue's reader may have made room meanwhile, in which
+		// case there is nothing to take, and we just try again.
+		select {
+		case old := <-q:
+			old.Free()
+			dropped++
+		default:
+		}
+	}
+}
+
+// EnqueueResizable is Enqueue for a queue that may be resized meanwhile
+// (see Resize).  The queue *q is taken under the lock l along with
+// *resized, and taken again should it be resized while waiting for room.
+// A message put on a queue just as it was resized is moved on to the
+// queue that replaced it, and those that do not fit there are counted
+// with those discarded.  The caller must not hold l.
+func EnqueueResizable(l sync.Locker, q *chan *Message, resized *chan struct{},
+	m *Message, policy QueueFullPolicy, closeq <-chan struct{},
+	tq <-chan time.Time) (int, error) {
+
+	l.Lock()
+	ch, rs := *q, *resized
+	l.Unlock()
+	dropped := 0
+	if policy == QueueFullBlock {
+		for queued := false; !queued; {
+			select {
+			case ch <- m:
+				queued = true
+			case <-rs:
+				l.Lock()
+				ch, rs = *q, *resized
+				l.Unlock()
+			case <-closeq:
+				return 0, ErrClosed
+			case <-tq:
+				return 0, ErrSendTimeout
+			}
+		}
+	} else {
+		dropped, _ = Enqueue(ch, m, policy, closeq, tq)
+	}
+	if Resized(rs) {
+		l.Lock()
+		dropped += Requeue(ch, *q)
+		l.Unlock()
+	}
+	return dropped, nil
+}
+
+// MaxSendBatch is the most messages a pipe's sender takes from its queue
+// to send together with Pipe.SendMsgs.
+const MaxSendBatch = 64
+
+// Dequeue returns m, which the caller has just taken from q, followed by
+// as many messages as are waiting behind it, up to max in all.  It never
+// waits.  This is for protocols implementing RecvMsgs.
+func Dequeue(q chan *Message, m *Message, max int) []*Message {
+	n := len(q) + 1
+	if n > max {
+		n = max
+	}
+	msgs := make([]*Message, 0, n)
+	msgs = append(msgs, m)
+	for len(msgs) < max {
+		select {
+		case m = <-q:
+			msgs = append(msgs, m)
+		default:
+			return msgs
+		}
+	}
+	return msgs
+}
+
+// ShareMessage returns a reference to m, for queuing to one of several
+// pipes, as when broadcasting.  This is m itself, retained, rather than a
+// copy, unless it carries Files, of which each pipe needs its own copies.
+// Either way, the result is the pipe's to free.
+func ShareMessage(m *Message) *Message {
+	if len(m.Files) > 0 {
+		return m.Dup()
+	}
+	return m.Retain()
+}
+
+// Resize replaces the queue *q with one holding n messages, for changing
+// OptionReadQLen or OptionWriteQLen on a live socket, and moves the
+// messages waiting to it, oldest first.  Those that do not fit are freed,
+// and their number returned, for the caller to count as dropped.  The
+// channel *resized, on which those waiting on the queue also wait, is
+// closed and replaced, so that they take the queue again.  The caller
+// must hold the lock guarding both, under which they are taken.
+func Resize(q *chan *Message, resized *chan struct{}, n int) int {
+	old := *q
+	*q = make(chan *Message, n)
+	close(*resized)
+	*resized = make(chan struct{})
+	return Requeue(old, *q)
+}
+
+// Requeue moves the messages waiting in the queue from to the queue to,
+// oldest first, without waiting, freeing those that do not fit, and
+// returns their number.  A sender that has put a message on a queue,
+// and then finds that the queue was resized meanwhile (see Resize), uses
+// this to move it on to the queue that replaced it.
+func Requeue(from, to chan *Message) int {
+	dropped := 0
+	for {
+		select {
+		case m := <-from:
+			select {
+			case to <- m:
+			default:
+				m.Free()
+				dropped++
+			}
+		default:
+			return dropped
+		}
+	}
+}
+
+// Deliver puts a message received from a pipe on the socket's receive
+// queue *q, taken under the lock l along with *resized (see Resize),
+// waiting for room.  If the queue is resized meanwhile, the message goes
+// to the queue that replaced it, and the number of messages that would
+// not fit there is returned, for the caller to count as dropped.  If
+// either closeq or pipeq is closed first, the message is freed and false
+// returned.
+func Deliver(l sync.Locker, q *chan *Message, resized *chan struct{},
+	m *Message, closeq, pipeq <-chan struct{}) (int, bool) {
+	l.Lock()
+	ch, rs := *q, *resized
+	l.Unlock()
+	for {
+		select {
+		case ch <- m:
+			if !Resized(rs) {
+				return 0, true
+			}
+			// It may have missed the move to the new queue.
+			l.Lock()
+			n := Requeue(ch, *q)
+			l.Unlock()
+			return n, true
+		case <-rs:
+			l.Lock()
+			ch, rs = *q, *resized
+			l.Unlock()
+		case <-closeq:
+			m.Free()
+			return 0, false
+		case <-pipeq:
+			m.Free()
+			return 0, false
+		}
+	}
+}
+
+// Resized reports whether the channel, taken along with a queue, has
+// since been closed by Resize.
+func Resized(resized <-chan struct{}) bool {
+	select {
+	case <-resized:
+		return true
+	default:
+		return false
+	}
+}
@@ -17,7 +17,9 @@
 package rep
 
 import (
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
@@ -32,14 +34,16 @@ const (
 )
 
 type pipe struct {
-	s      *socket
-	p      protocol.Pipe
-	closed bool
-	sendQ  chan *protocol.Message
-	closeQ chan struct{}
+	s       *socket
+	p       protocol.Pipe
+	closed  bool
+	sendQ   chan *protocol.Message
+	resized chan struct{} // see protocol.Resize
+	closeQ  chan struct{}
 }
 
 type socket struct {
+	dropped  uint64 // must be first, for atomic alignment
 	sock     protocol.Socket
 	closed   bool
 	pipes    map[uint32]*pipe
@@ -49,6 +53,10 @@ type socket struct {
 	recvCtxs map[*context]struct{}
 	ctxs     map[*context]struct{}
 	defCtx   *context
+	noRoute  protocol.NoRoute
+	dead     protocol.DeadLetterFunc
+	logger   protocol.Logger
+	shares   protocol.Shares // OptionRecvFair, OptionRecvPipeShare
 	sync.Mutex
 }
 
@@ -57,6 +65,7 @@ type context struct {
 	closed     bool
 	recvWait   bool
 	recvExpire time.Duration
+	busyPoll   time.Duration
 	recvPipe   *pipe
 	recvQ      chan *protocol.Message
 	closeQ     chan struct{}
@@ -69,20 +78,17 @@ type context struct {
 	backtrace  []byte
 	repMsg     *protocol.Message
 	pipeID     uint32 // using ID keeps GC from holding the pipe
+	sharing    bool   // request counted against shareID's share
+	shareID    uint32
 
 	cond *sync.Cond
 }
 
-// closedQ represents a nonblocking time channel.
-var closedQ <-chan time.Time
-
 // nilQ represents a nil time channel (blocks forever)
 var nilQ <-chan time.Time
 
 func init() {
-	tq := make(chan time.Time)
-	closedQ = tq
-	close(tq)
+	protocol.RegisterProtocol(SelfName, false, NewProtocol)
 }
 
 func (c *context) RecvMsg() (*protocol.Message, error) {
@@ -102,6 +108,7 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 	cq := c.closeQ
 	wq := nilQ
 	exptime := c.recvExpire
+	busy := c.busyPoll
 
 	s.recvCtxs[c] = struct{}{}
 	s.recvCond.Signal()
@@ -114,13 +121,18 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 	var err error
 	var m *protocol.Message
 
-	select {
-	case m = <-c.recvQ:
-		err = nil
-	case <-wq:
-		err = protocol.ErrRecvTimeout
-	case <-cq:
-		err = protocol.ErrClosed
+	if busy > 0 {
+		m = c.spin(busy)
+	}
+	if m == nil {
+		select {
+		case m = <-c.recvQ:
+			err = nil
+		case <-wq:
+			err = protocol.ErrRecvTimeout
+		case <-cq:
+			err = protocol.ErrClosed
+		}
 	}
 
 	s.Lock()
@@ -143,6 +155,21 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 	return m, err
 }
 
+// spin waits for up to d for a message, without blocking, for
+// OptionBusyPoll.
+func (c *context) spin(d time.Duration) *protocol.Message {
+	end := time.Now().Add(d)
+	for time.Now().Before(end) {
+		select {
+		case m := <-c.recvQ:
+			return m
+		default:
+			runtime.Gosched()
+		}
+	}
+	return nil
+}
+
 func (c *context) SendMsg(m *protocol.Message) error {
 	r := c.s
 	r.Lock()
@@ -157,41 +184,61 @@ func (c *context) SendMsg(m *protocol.Message) error {
 	}
 	p := c.recvPipe
 	c.recvPipe = nil
-
-	bestEffort := c.bestEffort
-	wq := nilQ
-	if bestEffort {
-		wq = closedQ
-	} else if c.sendExpire > 0 {
-		wq = time.After(c.sendExpire)
+	c.unshare()
+	if p.closed {
+		c.backtrace = nil
+		r.Unlock()
+		return r.noRouteFor(m, false)
 	}
 
 	m.Header = c.backtrace
 	c.backtrace = nil
+	if c.bestEffort {
+		// Never wait; with no room, the reply is dropped.
+		select {
+		case p.sendQ <- m:
+		default:
+			m.Free()
+			atomic.AddUint64(&r.dropped, 1)
+		}
+		r.Unlock()
+		return nil
+	}
+	wq := nilQ
+	if c.sendExpire > 0 {
+		wq = time.After(c.sendExpire)
+	}
 	cq := c.closeQ
+	sendQ, resized := p.sendQ, p.resized
 	r.Unlock()
 
-	select {
-	case <-cq:
-		m.Header = nil
-		return protocol.ErrClosed
-	case <-p.closeQ:
-		// Pipe closed, so no way to get it to the recipient.
-		// Just discard the message.
-		m.Free()
-		return nil
-	case <-wq:
-		if bestEffort {
-			// No way to report to caller, so just discard
-			// the message.
-			m.Free()
+	for {
+		select {
+		case <-cq:
+			m.Header = nil
+			return protocol.ErrClosed
+		case <-p.closeQ:
+			// Pipe closed, so no way to get it to the recipient.
+			m.Header = nil
+			return r.noRouteFor(m, false)
+		case <-wq:
+			m.Header = nil
+			return protocol.ErrSendTimeout
+
+		case <-resized:
+			r.Lock()
+			sendQ, resized = p.sendQ, p.resized
+			r.Unlock()
+
+		case sendQ <- m:
+			if protocol.Resized(resized) {
+				r.Lock()
+				n := protocol.Requeue(sendQ, p.sendQ)
+				r.Unlock()
+				atomic.AddUint64(&r.dropped, uint64(n))
+			}
 			return nil
 		}
-		m.Header = nil
-		return protocol.ErrSendTimeout
-
-	case p.sendQ <- m:
-		return nil
 	}
 }
 
@@ -206,10 +253,21 @@ func (c *context) Close() error {
 	delete(s.ctxs, c)
 	c.closed = true
 	close(c.closeQ)
+	c.unshare()
+	s.shares.SetRoom(len(s.ctxs))
 	s.Unlock()
 	return nil
 }
 
+// unshare stops counting the request last received against its pipe's
+// share, as it has been answered or abandoned.  The lock must be held.
+func (c *context) unshare() {
+	if c.sharing {
+		c.sharing = false
+		c.s.shares.Done(c.shareID)
+	}
+}
+
 func (c *context) GetOption(name string) (interface{}, error) {
 	switch name {
 	case protocol.OptionBestEffort:
@@ -224,6 +282,12 @@ func (c *context) GetOption(name string) (interface{}, error) {
 		c.s.Unlock()
 		return v, nil
 
+	case protocol.OptionBusyPoll:
+		c.s.Lock()
+		v := c.busyPoll
+		c.s.Unlock()
+		return v, nil
+
 	case protocol.OptionSendDeadline:
 		c.s.Lock()
 		v := c.sendExpire
@@ -237,8 +301,17 @@ func (c *context) GetOption(name string) (interface{}, error) {
 
 func (c *context) SetOption(name string, v interface{}) error {
 	switch name {
+	case protocol.OptionBestEffort:
+		if val, ok := v.(bool); ok {
+			c.s.Lock()
+			c.bestEffort = val
+			c.s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
 	case protocol.OptionSendDeadline:
-		if val, ok := v.(time.Duration); ok && val.Nanoseconds() > 0 {
+		if val, ok := v.(time.Duration); ok && val >= 0 {
 			c.s.Lock()
 			c.sendExpire = val
 			c.s.Unlock()
@@ -247,7 +320,7 @@ func (c *context) SetOption(name string, v interface{}) error {
 		return protocol.ErrBadValue
 
 	case protocol.OptionRecvDeadline:
-		if val, ok := v.(time.Duration); ok && val.Nanoseconds() > 0 {
+		if val, ok := v.(time.Duration); ok && val >= 0 {
 			c.s.Lock()
 			c.recvExpire = val
 			c.s.Unlock()
@@ -255,6 +328,15 @@ func (c *context) SetOption(name string, v interface{}) error {
 		}
 		return protocol.ErrBadValue
 
+	case protocol.OptionBusyPoll:
+		if val, ok := v.(time.Duration); ok && val >= 0 {
+			c.s.Lock()
+			c.busyPoll = val
+			c.s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
 	default:
 		return protocol.ErrBadOption
 	}
@@ -269,6 +351,19 @@ getmsg:
 			break
 		}
 
+		// A REQ checking that we are alive sends just an ID
+		// without the high order bit, which we send back.
+		if len(m.Body) == 4 && m.Body[0]&0x80 == 0 {
+			s.Lock()
+			select {
+			case p.sendQ <- m:
+			default:
+				m.Free()
+			}
+			s.Unlock()
+			continue
+		}
+
 		// Move backtrace from body to header.
 		hops := 0
 		for {
@@ -289,12 +384,20 @@ getmsg:
 			}
 		}
 
+		// A pipe with as many requests being handled as its share
+		// allows waits for one to be answered.
+		if !s.shares.Wait(p.p.ID(), nil, p.closeQ) {
+			m.Free()
+			break
+		}
+
 		s.Lock()
 		for len(s.recvCtxs) == 0 && !s.closed && !p.closed {
 			s.recvCond.Wait()
 		}
 		if s.closed || p.closed {
 			s.Unlock()
+			s.shares.Done(p.p.ID())
 			m.Free()
 			break
 		}
@@ -304,7 +407,11 @@ getmsg:
 			c.recvPipe = p
 			select {
 			case c.recvQ <- m:
+				c.unshare()
+				c.sharing = true
+				c.shareID = p.p.ID()
 			default:
+				s.shares.Done(p.p.ID())
 				m.Free()
 			}
 			// We *only* want to do this loop once, as we just
@@ -317,9 +424,17 @@ getmsg:
 }
 
 func (p *pipe) sender() {
+	s := p.s
+	s.Lock()
+	sendQ, resized := p.sendQ, p.resized
+	s.Unlock()
 	for {
 		select {
-		case m := <-p.sendQ:
+		case <-resized:
+			s.Lock()
+			sendQ, resized = p.sendQ, p.resized
+			s.Unlock()
+		case m := <-sendQ:
 			if p.p.SendMsg(m) != nil {
 				p.close()
 				return
@@ -333,12 +448,50 @@ func (p *pipe) sender() {
 func (p *pipe) close() {
 	// Avoid double close
 	p.s.Lock()
-	if !p.closed {
-		p.closed = true
-		p.p.Close()
-		close(p.closeQ)
+	if p.closed {
+		p.s.Unlock()
+		return
 	}
+	p.closed = true
+	p.p.Close()
+	close(p.closeQ)
 	p.s.Unlock()
+
+	// Replies still queued can no longer be delivered.
+	for {
+		select {
+		case m := <-p.sendQ:
+			m.Header = nil
+			_ = p.s.noRouteFor(m, true)
+		default:
+			return
+		}
+	}
+}
+
+// noRouteFor disposes of a reply whose requester has gone away, as
+// OptionNoRoute says.  The queued flag is set if SendMsg has already
+// returned, so the error can no longer be reported.
+func (s *socket) noRouteFor(m *protocol.Message, queued bool) error {
+	s.Lock()
+	policy := s.noRoute
+	dead := s.dead
+	logger := s.logger
+	s.Unlock()
+
+	switch {
+	case policy == protocol.NoRouteError && !queued:
+		return protocol.ErrNoRoute
+	case policy == protocol.NoRouteDeadLetter && dead != nil:
+		dead(m)
+		return nil
+	}
+	m.Free()
+	atomic.AddUint64(&s.dropped, 1)
+	if logger != nil {
+		logger.Printf("mangos: %s dropped reply with no route", SelfName)
+	}
+	return nil
 }
 
 func (s *socket) Close() error {
@@ -366,6 +519,29 @@ func (s *socket) Close() error {
 	return nil
 }
 
+// Debug reports the requests received and not yet replied to, and the
+// replies queued for each pipe.
+func (s *socket) Debug() protocol.ProtocolState {
+	var st protocol.ProtocolState
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.ctxs {
+		if c.backtrace != nil && c.recvPipe != nil {
+			st.Backtraces = append(st.Backtraces,
+				protocol.Backtrace(c.recvPipe.p.ID(), c.backtrace))
+		}
+	}
+	for id, p := range s.pipes {
+		st.Pipes = append(st.Pipes, protocol.PipeState{
+			ID:     id,
+			Queued: len(p.sendQ),
+			Cap:    cap(p.sendQ),
+		})
+	}
+	protocol.SortState(&st)
+	return st
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -379,16 +555,18 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 
 	s.Lock()
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		sendQ:  make(chan *protocol.Message, s.sendQLen),
-		closeQ: make(chan struct{}),
+		p:       pp,
+		s:       s,
+		sendQ:   make(chan *protocol.Message, s.sendQLen),
+		resized: make(chan struct{}),
+		closeQ:  make(chan struct{}),
 	}
 	if s.closed {
 		s.Unlock()
 		return protocol.ErrClosed
 	}
 	s.pipes[pp.ID()] = p
+	s.shares.AddPipe()
 	go p.sender()
 	go p.receiver()
 	s.Unlock()
@@ -400,6 +578,7 @@ func (s *socket) RemovePipe(pp protocol.Pipe) {
 	s.Lock()
 	if p, ok := s.pipes[pp.ID()]; ok {
 		delete(s.pipes, pp.ID())
+		s.shares.RemovePipe(pp.ID())
 		go p.close()
 	}
 	s.Unlock()
@@ -411,7 +590,15 @@ func (s *socket) SetOption(name string, v interface{}) error {
 		if qlen, ok := v.(int); ok && qlen > 0 {
 			s.Lock()
 			s.sendQLen = qlen
+			n := 0
+			for _, p := range s.pipes {
+				// Those closed are draining their queues.
+				if !p.closed {
+					n += protocol.Resize(&p.sendQ, &p.resized, qlen)
+				}
+			}
 			s.Unlock()
+			atomic.AddUint64(&s.dropped, uint64(n))
 			return nil
 		}
 		return protocol.ErrBadValue
@@ -424,6 +611,43 @@ func (s *socket) SetOption(name string, v interface{}) error {
 			return nil
 		}
 		return protocol.ErrBadValue
+
+	case protocol.OptionNoRoute:
+		if nr, ok := v.(protocol.NoRoute); ok &&
+			nr >= protocol.NoRouteDrop && nr <= protocol.NoRouteError {
+			s.Lock()
+			s.noRoute = nr
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionDeadLetter:
+		if fn, ok := v.(protocol.DeadLetterFunc); ok || v == nil {
+			s.Lock()
+			s.dead = fn
+			s.Unlock()
+			return nil
+		}
+		if fn, ok := v.(func(*protocol.Message)); ok {
+			s.Lock()
+			s.dead = fn
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionLogger:
+		if l, ok := v.(protocol.Logger); ok || v == nil {
+			s.Lock()
+			s.logger = l
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionRecvFair, protocol.OptionRecvPipeShare:
+		return s.shares.SetOption(name, v)
 	}
 	return s.defCtx.SetOption(name, v)
 }
@@ -442,6 +666,36 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 		v := s.sendQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionNoRoute:
+		s.Lock()
+		v := s.noRoute
+		s.Unlock()
+		return v, nil
+	case protocol.OptionDeadLetter:
+		s.Lock()
+		v := s.dead
+		s.Unlock()
+		return v, nil
+	case protocol.OptionRecvFair, protocol.OptionRecvPipeShare:
+		return s.shares.GetOption(name)
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := 0
+		for _, p := range s.pipes {
+			queued += len(p.sendQ)
+		}
+		awaiting := 0
+		for c := range s.ctxs {
+			if c.backtrace != nil {
+				awaiting++
+			}
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped:  atomic.LoadUint64(&s.dropped),
+			protocol.StatQueued:   uint64(queued),
+			protocol.StatAwaiting: uint64(awaiting),
+		}, nil
 	}
 
 	return s.defCtx.GetOption(name)
@@ -454,10 +708,13 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 		return nil, protocol.ErrClosed
 	}
 	c := &context{
-		s:      s,
-		closeQ: make(chan struct{}),
-		recvQ:  make(chan *protocol.Message, 1),
+		s:        s,
+		closeQ:   make(chan struct{}),
+		recvQ:    make(chan *protocol.Message, 1),
+		busyPoll: s.defCtx.busyPoll,
 	}
+	s.ctxs[c] = struct{}{}
+	s.shares.SetRoom(len(s.ctxs))
 	return c, nil
 }
 
@@ -484,6 +741,7 @@ func NewProtocol() protocol.Protocol {
 	s.defCtx.s = s
 	s.recvCond = sync.NewCond(s)
 	s.ctxs[s.defCtx] = struct{}{}
+	s.shares.SetRoom(1)
 	return s
 }
 
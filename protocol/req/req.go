@@ -18,6 +18,7 @@ package req
 
 import (
 	"encoding/binary"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -37,69 +38,138 @@ type pipe struct {
 	p      protocol.Pipe
 	s      *socket
 	closed bool
+	sick   bool      // passed over for not answering probes
+	probed time.Time // when the unanswered probe was sent, if any
 }
 
 type context struct {
 	s          *socket
 	cond       *sync.Cond
-	resendTime time.Duration     // tunable resend time
-	sendExpire time.Duration     // how long to wait in send
-	recvExpire time.Duration     // how long to wait in recv
-	sendTimer  *time.Timer       // send timer
-	recvTimer  *time.Timer       // recv timer
-	resender   *time.Timer       // resend timeout
-	reqMsg     *protocol.Message // message for transmit
-	repMsg     *protocol.Message // received reply
-	sendMsg    *protocol.Message // messaging waiting for send
-	lastPipe   *pipe             // last pipe used for transmit
-	reqID      uint32            // request ID
-	sendID     uint32            // sent id (cleared after first send)
-	recvID     uint32            // recv id (set after first send)
-	recvWait   bool              // true if a thread is blocked in RecvMsg
-	bestEffort bool              // if true, don't block waiting in send
-	wantw      bool              // true if we need to send a message
-	closed     bool              // true if we are closed
+	resendTime time.Duration        // tunable resend time
+	retry      protocol.RetryPolicy // OptionRetryPolicy, if set
+	attempts   int                  // times the request was sent
+	sendExpire time.Duration        // how long to wait in send
+	recvExpire time.Duration        // how long to wait in recv
+	busyPoll   time.Duration        // how long to spin in recv
+	sendTimer  protocol.Timer       // send timer
+	recvTimer  protocol.Timer       // recv timer
+	resender   protocol.Timer       // resend timeout
+	reqMsg     *protocol.Message    // message for transmit
+	repMsg     *protocol.Message    // received reply
+	sendMsg    *protocol.Message    // messaging waiting for send
+	lastPipe   *pipe                // last pipe used for transmit
+	sentAt     time.Time            // when last transmitted, for latency
+	reqID      uint32               // request ID
+	lastID     uint32               // ID of the last request sent
+	sendID     uint32               // sent id (cleared after first send)
+	recvID     uint32               // recv id (set after first send)
+	recvWait   bool                 // true if a thread is blocked in RecvMsg
+	bestEffort bool                 // if true, don't block waiting in send
+	synch      bool                 // if true, send on caller's goroutine
+	wantw      bool                 // true if we need to send a message
+	closed     bool                 // true if we are closed
 }
 
 type socket struct {
 	sync.Mutex
-	defCtx  *context              // default context
-	ctxs    map[*context]struct{} // all contexts (set)
-	ctxByID map[uint32]*context   // contexts by request ID
-	nextID  uint32                // next request ID
-	closed  bool                  // true if we are closed
-	sendq   []*context            // contexts waiting to send
-	readyq  []*pipe               // pipes available for sending
-	pipes   map[uint32]*pipe      // all pipes for the socket (by pipe ID)
+	defCtx   *context                   // default context
+	ctxs     map[*context]struct{}      // all contexts (set)
+	ctxByID  map[uint32]*context        // contexts by request ID
+	nextID   uint32                     // next request ID
+	closed   bool                       // true if we are closed
+	sendq    []*context                 // contexts waiting to send
+	readyq   []*pipe                    // pipes available for sending
+	pipes    map[uint32]*pipe           // all pipes for the socket (by pipe ID)
+	lb       *protocol.Balancer         // chooses among the ready pipes
+	sick     int                        // pipes not answering probes
+	probeID  uint32                     // last probe ID
+	probeIv  time.Duration              // probe interval
+	probeTo  time.Duration              // probe timeout
+	prober   protocol.Timer             // sends the next probes
+	probeGn  uint32                     // generation of prober
+	mismatch protocol.ReplyMismatchFunc // given unmatched replies
+	clock    protocol.Clock             // OptionClock
 }
 
 func (s *socket) send() {
-	for len(s.sendq) != 0 && len(s.readyq) != 0 {
-		c := s.sendq[0]
-		s.sendq = s.sendq[1:]
-		c.wantw = false
+	for {
+		i := s.choose()
+		if i < 0 {
+			return
+		}
+		c, p, m := s.nextSend(i)
+		go p.sendCtx(c, m)
+	}
+}
 
-		p := s.readyq[0]
-		s.readyq = s.readyq[1:]
+// choose returns the index of the ready pipe to send the next request
+// on, or -1 if there is no request, or no suitable pipe is ready.
+func (s *socket) choose() int {
+	if len(s.sendq) == 0 || len(s.readyq) == 0 {
+		return -1
+	}
+	return s.lb.Choose(len(s.readyq), s.readyID, s.outstanding())
+}
 
-		if c.sendID != 0 {
-			c.reqMsg = c.sendMsg
-			c.sendMsg = nil
-			c.recvID = c.sendID
-			s.ctxByID[c.recvID] = c
-			c.sendID = 0
-			c.cond.Broadcast()
-		}
-		m := c.reqMsg.Dup()
+// nextSend pairs the first waiting context with the i'th ready pipe
+// (as from choose), returning the copy of the request to transmit.  The
+// caller must hold the lock.
+func (s *socket) nextSend(i int) (*context, *pipe, *protocol.Message) {
+	c := s.sendq[0]
+	s.sendq = s.sendq[1:]
+	c.wantw = false
 
-		// Schedule a retransmit for the future.
-		c.lastPipe = p
-		if c.resendTime > 0 {
-			c.resender = time.AfterFunc(c.resendTime, func() {
-				c.resendMessage(m)
-			})
+	p := s.readyq[i]
+	s.readyq = append(s.readyq[:i], s.readyq[i+1:]...)
+
+	if c.sendID != 0 {
+		c.reqMsg = c.sendMsg
+		c.sendMsg = nil
+		c.recvID = c.sendID
+		s.ctxByID[c.recvID] = c
+		c.sendID = 0
+		c.attempts = 0
+		c.cond.Broadcast()
+	}
+	m := c.reqMsg.Dup()
+
+	// Schedule a retransmit for the future.
+	c.lastPipe = p
+	c.sentAt = c.s.clock.Now()
+	resend := c.resendTime
+	if c.retry != nil {
+		resend = c.retry.NextDelay(c.attempts)
+	}
+	c.attempts++
+	if resend > 0 {
+		// The copy is the pipe's to free, so the request itself is
+		// what resendMessage must check is still outstanding.
+		req := c.reqMsg
+		c.resender = c.s.clock.AfterFunc(resend, func() {
+			c.resendMessage(req)
+		})
+	}
+	return c, p, m
+}
+
+func (s *socket) readyID(i int) uint32 {
+	return s.readyq[i].p.ID()
+}
+
+// outstanding returns, for LoadBalanceLeastQueued, the function giving
+// how many requests each ready pipe has yet to answer.
+func (s *socket) outstanding() func(int) int {
+	if s.lb.Strategy() != protocol.LoadBalanceLeastQueued {
+		return nil
+	}
+	counts := make(map[*pipe]int)
+	for c := range s.ctxs {
+		if c.lastPipe != nil && c.reqMsg != nil && !c.wantw {
+			counts[c.lastPipe]++
 		}
-		go p.sendCtx(c, m)
+	}
+	return func(i int) int {
+		return counts[s.readyq[i]]
 	}
 }
 
@@ -137,9 +207,22 @@ func (p *pipe) receiver() {
 		m.Body = m.Body[4:]
 
 		id := binary.BigEndian.Uint32(m.Header)
+		m.RequestID = id
 
+		var mismatch protocol.ReplyMismatchFunc
 		s.Lock()
-		if c, ok := s.ctxByID[id]; ok {
+		if id&0x80000000 == 0 {
+			// The answer to a probe.
+			if !p.probed.IsZero() {
+				s.lb.Observe(p.p, s.clock.Now().Sub(p.probed))
+			}
+			p.probed = time.Time{}
+			p.setSick(false)
+			m.Free()
+		} else if c, ok := s.ctxByID[id]; ok {
+			if c.lastPipe == p {
+				s.lb.Observe(p.p, s.clock.Now().Sub(c.sentAt))
+			}
 			c.unscheduleSend()
 			c.reqMsg.Free()
 			c.reqMsg = nil
@@ -149,12 +232,20 @@ func (p *pipe) receiver() {
 				c.resender.Stop()
 				c.resender = nil
 			}
+			if c.retry != nil {
+				c.retry.Reset()
+			}
 			c.cond.Broadcast()
+		} else if s.mismatch != nil {
+			mismatch = s.mismatch
 		} else {
 			// No matching receiver so just drop it.
 			m.Free()
 		}
 		s.Unlock()
+		if mismatch != nil {
+			mismatch(m)
+		}
 	}
 
 	go p.Close()
@@ -169,21 +260,96 @@ func (p *pipe) Close() error {
 	}
 	p.closed = true
 	delete(s.pipes, p.p.ID())
+	s.lb.RemovePipe(p.p)
+	if p.sick {
+		s.sick--
+	}
+	s.send() // in case we were waited for
+	p.reschedule()
+	s.Unlock()
+	p.p.Close()
+	return nil
+}
 
-	for c := range s.ctxs {
+// reschedule sends the requests last sent on the pipe again, as it is
+// closing, or not answering.  The caller must hold the lock.
+func (p *pipe) reschedule() {
+	for c := range p.s.ctxs {
 		if c.lastPipe == p {
-			// We are closing this pipe, so we need to
-			// immediately reschedule it.
 			c.lastPipe = nil
 			if m := c.reqMsg; m != nil {
 				go c.resendMessage(m)
 			}
 		}
 	}
+}
 
-	s.Unlock()
-	p.p.Close()
-	return nil
+// setSick records whether the pipe is answering probes.  The caller
+// must hold the lock.
+func (p *pipe) setSick(sick bool) {
+	s := p.s
+	if p.sick == sick || p.closed {
+		return
+	}
+	p.sick = sick
+	s.lb.SetDown(p.p, sick)
+	if sick {
+		s.sick++
+		p.reschedule()
+	} else {
+		s.sick--
+	}
+	s.send()
+}
+
+// probe passes over the pipes whose probes have gone unanswered too
+// long, and sends new probes on those not waiting for an answer.
+func (s *socket) probe(gen uint32) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed || s.probeGn != gen {
+		return
+	}
+	timeout := s.probeTo
+	if timeout <= 0 {
+		timeout = s.probeIv
+	}
+	now := s.clock.Now()
+	for _, p := range s.pipes {
+		if !p.probed.IsZero() {
+			if now.Sub(p.probed) < timeout {
+				continue
+			}
+			p.setSick(true)
+		}
+		p.probed = now
+		s.probeID = (s.probeID + 1) & 0x7fffffff
+		if s.probeID == 0 {
+			s.probeID = 1
+		}
+		m := protocol.NewMessage(0)
+		m.Header = append(m.Header, byte(s.probeID>>24),
+			byte(s.probeID>>16), byte(s.probeID>>8), byte(s.probeID))
+		go p.sendProbe(m)
+	}
+	s.startProber()
+}
+
+// startProber arranges for the next probes, if there are to be any.
+// The caller must hold the lock.
+func (s *socket) startProber() {
+	s.probeGn++
+	s.prober = nil
+	if s.probeIv > 0 {
+		gen := s.probeGn
+		s.prober = s.clock.AfterFunc(s.probeIv, func() { s.probe(gen) })
+	}
+}
+
+func (p *pipe) sendProbe(m *protocol.Message) {
+	if err := p.p.SendMsg(m); err != nil {
+		m.Free()
+	}
 }
 
 func (c *context) resendMessage(m *protocol.Message) {
@@ -247,6 +413,19 @@ func (c *context) cancel() {
 	c.cond.Broadcast()
 }
 
+// Cancel abandons the outstanding request, and any reply to it not yet
+// received.
+func (c *context) Cancel() error {
+	s := c.s
+	s.Lock()
+	defer s.Unlock()
+	if c.closed {
+		return protocol.ErrClosed
+	}
+	c.cancel()
+	return nil
+}
+
 func (c *context) SendMsg(m *protocol.Message) error {
 
 	s := c.s
@@ -267,10 +446,28 @@ func (c *context) SendMsg(m *protocol.Message) error {
 	c.cancel() // this cancels any pending send or recv calls
 
 	c.reqID = id
+	c.lastID = id
+	m.RequestID = id
 	s.ctxByID[id] = c
 	c.wantw = true
 	s.sendq = append(s.sendq, c)
 
+	// The balancer may keep count of its choices, so only choose here
+	// if the choice is to be used.
+	if c.synch && len(s.sendq) == 1 {
+		if i := s.choose(); i >= 0 {
+			// Synchronous mode, with a pipe ready to go; skip the
+			// scheduler and transmit right here.
+			c.sendID = id
+			c.sendMsg = m
+			_, p, dm := s.nextSend(i)
+			s.Unlock()
+			p.sendCtx(c, dm)
+			s.Lock()
+			return nil
+		}
+	}
+
 	if c.bestEffort {
 		// for best effort case, we just immediately go the
 		// reqMsg, and schedule it as a send.  No waiting.
@@ -278,6 +475,7 @@ func (c *context) SendMsg(m *protocol.Message) error {
 		// immediately, it will still get a chance later.
 		c.reqMsg = m
 		c.recvID = id
+		c.attempts = 0
 		s.send()
 		return nil
 	}
@@ -286,7 +484,7 @@ func (c *context) SendMsg(m *protocol.Message) error {
 	c.sendID = id
 	c.sendMsg = m
 	if c.sendExpire > 0 {
-		c.sendTimer = time.AfterFunc(c.sendExpire, func() {
+		c.sendTimer = c.s.clock.AfterFunc(c.sendExpire, func() {
 			s.Lock()
 			if c.sendID == id {
 				expired = true
@@ -330,7 +528,7 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 	expired := false
 
 	if c.recvExpire > 0 {
-		c.recvTimer = time.AfterFunc(c.recvExpire, func() {
+		c.recvTimer = c.s.clock.AfterFunc(c.recvExpire, func() {
 			s.Lock()
 			if c.recvID == id {
 				expired = true
@@ -340,6 +538,9 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 		})
 	}
 
+	if c.busyPoll > 0 {
+		c.spin(id)
+	}
 	for id == c.recvID && c.repMsg == nil {
 		c.cond.Wait()
 	}
@@ -362,6 +563,18 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 	return m, nil
 }
 
+// spin waits for up to OptionBusyPoll for the reply, without blocking.
+// It is called with the socket lock held, which it lets go of while
+// spinning, so that the reply can be delivered.
+func (c *context) spin(id uint32) {
+	end := time.Now().Add(c.busyPoll)
+	for id == c.recvID && c.repMsg == nil && time.Now().Before(end) {
+		c.s.Unlock()
+		runtime.Gosched()
+		c.s.Lock()
+	}
+}
+
 func (c *context) SetOption(name string, value interface{}) error {
 	switch name {
 	case protocol.OptionRetryTime:
@@ -373,6 +586,15 @@ func (c *context) SetOption(name string, value interface{}) error {
 		}
 		return protocol.ErrBadValue
 
+	case protocol.OptionRetryPolicy:
+		if v, ok := value.(protocol.RetryPolicy); ok || value == nil {
+			c.s.Lock()
+			c.retry = v
+			c.s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
 	case protocol.OptionRecvDeadline:
 		if v, ok := value.(time.Duration); ok {
 			c.s.Lock()
@@ -382,6 +604,15 @@ func (c *context) SetOption(name string, value interface{}) error {
 		}
 		return protocol.ErrBadValue
 
+	case protocol.OptionBusyPoll:
+		if v, ok := value.(time.Duration); ok && v >= 0 {
+			c.s.Lock()
+			c.busyPoll = v
+			c.s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
 	case protocol.OptionSendDeadline:
 		if v, ok := value.(time.Duration); ok {
 			c.s.Lock()
@@ -399,6 +630,15 @@ func (c *context) SetOption(name string, value interface{}) error {
 			return nil
 		}
 		return protocol.ErrBadValue
+
+	case protocol.OptionSynchronous:
+		if v, ok := value.(bool); ok {
+			c.s.Lock()
+			c.synch = v
+			c.s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
 	}
 
 	return protocol.ErrBadOption
@@ -411,11 +651,21 @@ func (c *context) GetOption(option string) (interface{}, error) {
 		v := c.resendTime
 		c.s.Unlock()
 		return v, nil
+	case protocol.OptionRetryPolicy:
+		c.s.Lock()
+		v := c.retry
+		c.s.Unlock()
+		return v, nil
 	case protocol.OptionRecvDeadline:
 		c.s.Lock()
 		v := c.recvExpire
 		c.s.Unlock()
 		return v, nil
+	case protocol.OptionBusyPoll:
+		c.s.Lock()
+		v := c.busyPoll
+		c.s.Unlock()
+		return v, nil
 	case protocol.OptionSendDeadline:
 		c.s.Lock()
 		v := c.sendExpire
@@ -426,6 +676,16 @@ func (c *context) GetOption(option string) (interface{}, error) {
 		v := c.bestEffort
 		c.s.Unlock()
 		return v, nil
+	case protocol.OptionSynchronous:
+		c.s.Lock()
+		v := c.synch
+		c.s.Unlock()
+		return v, nil
+	case protocol.OptionRequestID:
+		c.s.Lock()
+		v := c.lastID
+		c.s.Unlock()
+		return v, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -448,11 +708,99 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 	switch option {
 	case protocol.OptionRaw:
 		return false, nil
+	case protocol.OptionProtocolStats:
+		// Pipes not ready for sending are busy with a request.
+		s.Lock()
+		queued := len(s.sendq) + len(s.pipes) - len(s.readyq)
+		sick := s.sick
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatQueued:    uint64(queued),
+			protocol.StatUnhealthy: uint64(sick),
+		}, nil
+	case protocol.OptionLoadBalance:
+		s.Lock()
+		v := s.lb.Strategy()
+		s.Unlock()
+		return v, nil
+	case protocol.OptionProbeInterval:
+		s.Lock()
+		v := s.probeIv
+		s.Unlock()
+		return v, nil
+	case protocol.OptionProbeTimeout:
+		s.Lock()
+		v := s.probeTo
+		s.Unlock()
+		return v, nil
+	case protocol.OptionReplyMismatch:
+		s.Lock()
+		v := s.mismatch
+		s.Unlock()
+		return v, nil
 	default:
 		return s.defCtx.GetOption(option)
 	}
 }
 func (s *socket) SetOption(option string, value interface{}) error {
+	switch option {
+	case protocol.OptionLoadBalance:
+		s.Lock()
+		defer s.Unlock()
+		return s.lb.SetStrategy(value)
+
+	case protocol.OptionProbeInterval:
+		if v, ok := value.(time.Duration); ok && v >= 0 {
+			s.Lock()
+			s.probeIv = v
+			if s.prober != nil {
+				s.prober.Stop()
+			}
+			if !s.closed {
+				s.startProber()
+			}
+			if v == 0 {
+				// Without probes, nobody can recover.
+				for _, p := range s.pipes {
+					p.probed = time.Time{}
+					p.setSick(false)
+				}
+			}
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionProbeTimeout:
+		if v, ok := value.(time.Duration); ok && v >= 0 {
+			s.Lock()
+			s.probeTo = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionReplyMismatch:
+		if fn, ok := value.(protocol.ReplyMismatchFunc); ok || value == nil {
+			s.Lock()
+			s.mismatch = fn
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionClock:
+		if v, ok := value.(protocol.Clock); ok || value == nil {
+			if v == nil {
+				v = protocol.SystemClock
+			}
+			s.Lock()
+			s.clock = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+	}
 	return s.defCtx.SetOption(option, value)
 }
 
@@ -472,6 +820,10 @@ func (s *socket) Close() error {
 		return protocol.ErrClosed
 	}
 	s.closed = true
+	if s.prober != nil {
+		s.prober.Stop()
+		s.prober = nil
+	}
 	for c := range s.ctxs {
 		c.closed = true
 		c.cancel()
@@ -500,9 +852,12 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 		s:          s,
 		cond:       sync.NewCond(s),
 		bestEffort: s.defCtx.bestEffort,
+		synch:      s.defCtx.synch,
 		resendTime: s.defCtx.resendTime,
+		retry:      s.defCtx.retry,
 		sendExpire: s.defCtx.sendExpire,
 		recvExpire: s.defCtx.recvExpire,
+		busyPoll:   s.defCtx.busyPoll,
 	}
 	s.ctxs[c] = struct{}{}
 	return c, nil
@@ -513,12 +868,15 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		p: pp,
 		s: s,
 	}
+	weight := protocol.PipeWeight(pp)
+	priority := protocol.PipePriority(pp)
 	s.Lock()
 	defer s.Unlock()
 	if s.closed {
 		return protocol.ErrClosed
 	}
 	s.pipes[pp.ID()] = p
+	s.lb.AddPipe(pp, weight, priority)
 	s.readyq = append(s.readyq, p)
 	s.send()
 	go p.receiver()
@@ -533,21 +891,17 @@ func (s *socket) RemovePipe(pp protocol.Pipe) {
 		p.closed = true
 		pipes = append(pipes, p)
 		delete(s.pipes, pp.ID())
+		s.lb.RemovePipe(pp)
+		if p.sick {
+			s.sick--
+		}
 		for i, rp := range s.readyq {
 			if p == rp {
 				s.readyq = append(s.readyq[:i], s.readyq[i+1:]...)
 			}
 		}
-		for c := range s.ctxs {
-			if c.lastPipe == p {
-				// We are closing this pipe, so we need to
-				// immediately reschedule it.
-				c.lastPipe = nil
-				if m := c.reqMsg; m != nil {
-					go c.resendMessage(m)
-				}
-			}
-		}
+		s.send() // in case we were waited for
+		p.reschedule()
 	}
 	s.Unlock()
 	for _, p := range pipes {
@@ -555,6 +909,45 @@ func (s *socket) RemovePipe(pp protocol.Pipe) {
 	}
 }
 
+// Debug reports the requests awaiting replies, those waiting for a
+// pipe to be sent on, and which pipes are free or not answering probes.
+func (s *socket) Debug() protocol.ProtocolState {
+	var st protocol.ProtocolState
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.ctxs {
+		switch {
+		case c.sendID != 0:
+			st.Pending = append(st.Pending, protocol.RequestState{
+				ID: c.sendID,
+			})
+		case c.recvID != 0 && c.reqMsg != nil:
+			r := protocol.RequestState{
+				ID:       c.recvID,
+				Sent:     c.sentAt,
+				Attempts: c.attempts,
+			}
+			if c.lastPipe != nil {
+				r.Pipe = c.lastPipe.p.ID()
+			}
+			st.Pending = append(st.Pending, r)
+		}
+	}
+	ready := make(map[*pipe]bool, len(s.readyq))
+	for _, p := range s.readyq {
+		ready[p] = true
+	}
+	for id, p := range s.pipes {
+		st.Pipes = append(st.Pipes, protocol.PipeState{
+			ID:    id,
+			Ready: ready[p],
+			Down:  p.sick,
+		})
+	}
+	protocol.SortState(&st)
+	return st
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -564,6 +957,10 @@ func (*socket) Info() protocol.Info {
 	}
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, false, NewProtocol)
+}
+
 // NewProtocol allocates a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
@@ -571,6 +968,8 @@ func NewProtocol() protocol.Protocol {
 		nextID:  uint32(time.Now().UnixNano()), // quasi-random
 		ctxs:    make(map[*context]struct{}),
 		ctxByID: make(map[uint32]*context),
+		lb:      protocol.NewBalancer(),
+		clock:   protocol.SystemClock,
 	}
 	s.defCtx = &context{
 		s:          s,
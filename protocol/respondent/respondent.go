@@ -18,6 +18,7 @@ package respondent
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
@@ -32,14 +33,16 @@ const (
 )
 
 type pipe struct {
-	s      *socket
-	p      protocol.Pipe
-	closed bool
-	sendQ  chan *protocol.Message
-	closeQ chan struct{}
+	s       *socket
+	p       protocol.Pipe
+	closed  bool
+	sendQ   chan *protocol.Message
+	resized chan struct{} // see protocol.Resize
+	closeQ  chan struct{}
 }
 
 type socket struct {
+	dropped  uint64 // must be first, for atomic alignment
 	sock     protocol.Socket
 	closed   bool
 	pipes    map[uint32]*pipe
@@ -73,16 +76,11 @@ type context struct {
 	cond *sync.Cond
 }
 
-// closedQ represents a nonblocking time channel.
-var closedQ <-chan time.Time
-
 // nilQ represents a nil time channel (blocks forever)
 var nilQ <-chan time.Time
 
 func init() {
-	tq := make(chan time.Time)
-	closedQ = tq
-	close(tq)
+	protocol.RegisterProtocol(SelfName, false, NewProtocol)
 }
 
 func (c *context) RecvMsg() (*protocol.Message, error) {
@@ -158,40 +156,55 @@ func (c *context) SendMsg(m *protocol.Message) error {
 	p := c.recvPipe
 	c.recvPipe = nil
 
-	bestEffort := c.bestEffort
+	m.Header = c.backtrace
+	c.backtrace = nil
+	if c.bestEffort {
+		// Never wait; with no room, the reply is dropped.
+		select {
+		case p.sendQ <- m:
+		default:
+			m.Free()
+			atomic.AddUint64(&r.dropped, 1)
+		}
+		r.Unlock()
+		return nil
+	}
 	wq := nilQ
-	if bestEffort {
-		wq = closedQ
-	} else if c.sendExpire > 0 {
+	if c.sendExpire > 0 {
 		wq = time.After(c.sendExpire)
 	}
-
-	m.Header = c.backtrace
-	c.backtrace = nil
 	cq := c.closeQ
+	sendQ, resized := p.sendQ, p.resized
 	r.Unlock()
 
-	select {
-	case <-cq:
-		m.Header = nil
-		return protocol.ErrClosed
-	case <-p.closeQ:
-		// Pipe closed, so no way to get it to the recipient.
-		// Just discard the message.
-		m.Free()
-		return nil
-	case <-wq:
-		if bestEffort {
-			// No way to report to caller, so just discard
-			// the message.
+	for {
+		select {
+		case <-cq:
+			m.Header = nil
+			return protocol.ErrClosed
+		case <-p.closeQ:
+			// Pipe closed, so no way to get it to the recipient.
+			// Just discard the message.
 			m.Free()
 			return nil
+		case <-wq:
+			m.Header = nil
+			return protocol.ErrSendTimeout
+
+		case <-resized:
+			r.Lock()
+			sendQ, resized = p.sendQ, p.resized
+			r.Unlock()
+
+		case sendQ <- m:
+			if protocol.Resized(resized) {
+				r.Lock()
+				n := protocol.Requeue(sendQ, p.sendQ)
+				r.Unlock()
+				atomic.AddUint64(&r.dropped, uint64(n))
+			}
+			return nil
 		}
-		m.Header = nil
-		return protocol.ErrSendTimeout
-
-	case p.sendQ <- m:
-		return nil
 	}
 }
 
@@ -237,8 +250,17 @@ func (c *context) GetOption(name string) (interface{}, error) {
 
 func (c *context) SetOption(name string, v interface{}) error {
 	switch name {
+	case protocol.OptionBestEffort:
+		if val, ok := v.(bool); ok {
+			c.s.Lock()
+			c.bestEffort = val
+			c.s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
 	case protocol.OptionSendDeadline:
-		if val, ok := v.(time.Duration); ok && val.Nanoseconds() > 0 {
+		if val, ok := v.(time.Duration); ok && val >= 0 {
 			c.s.Lock()
 			c.sendExpire = val
 			c.s.Unlock()
@@ -247,7 +269,7 @@ func (c *context) SetOption(name string, v interface{}) error {
 		return protocol.ErrBadValue
 
 	case protocol.OptionRecvDeadline:
-		if val, ok := v.(time.Duration); ok && val.Nanoseconds() > 0 {
+		if val, ok := v.(time.Duration); ok && val >= 0 {
 			c.s.Lock()
 			c.recvExpire = val
 			c.s.Unlock()
@@ -317,9 +339,17 @@ getmsg:
 }
 
 func (p *pipe) sender() {
+	s := p.s
+	s.Lock()
+	sendQ, resized := p.sendQ, p.resized
+	s.Unlock()
 	for {
 		select {
-		case m := <-p.sendQ:
+		case <-resized:
+			s.Lock()
+			sendQ, resized = p.sendQ, p.resized
+			s.Unlock()
+		case m := <-sendQ:
 			if p.p.SendMsg(m) != nil {
 				p.close()
 				return
@@ -360,6 +390,29 @@ func (s *socket) Close() error {
 	return nil
 }
 
+// Debug reports the surveys received and not yet answered, and the
+// responses queued for each pipe.
+func (s *socket) Debug() protocol.ProtocolState {
+	var st protocol.ProtocolState
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.ctxs {
+		if c.backtrace != nil && c.recvPipe != nil {
+			st.Backtraces = append(st.Backtraces,
+				protocol.Backtrace(c.recvPipe.p.ID(), c.backtrace))
+		}
+	}
+	for id, p := range s.pipes {
+		st.Pipes = append(st.Pipes, protocol.PipeState{
+			ID:     id,
+			Queued: len(p.sendQ),
+			Cap:    cap(p.sendQ),
+		})
+	}
+	protocol.SortState(&st)
+	return st
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -373,10 +426,11 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 
 	s.Lock()
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		sendQ:  make(chan *protocol.Message, s.sendQLen),
-		closeQ: make(chan struct{}),
+		p:       pp,
+		s:       s,
+		sendQ:   make(chan *protocol.Message, s.sendQLen),
+		resized: make(chan struct{}),
+		closeQ:  make(chan struct{}),
 	}
 	if s.closed {
 		s.Unlock()
@@ -405,7 +459,14 @@ func (s *socket) SetOption(name string, v interface{}) error {
 		if qlen, ok := v.(int); ok && qlen > 0 {
 			s.Lock()
 			s.sendQLen = qlen
+			n := 0
+			for _, p := range s.pipes {
+				if !p.closed {
+					n += protocol.Resize(&p.sendQ, &p.resized, qlen)
+				}
+			}
 			s.Unlock()
+			atomic.AddUint64(&s.dropped, uint64(n))
 			return nil
 		}
 		return protocol.ErrBadValue
@@ -436,6 +497,24 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 		v := s.sendQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := 0
+		for _, p := range s.pipes {
+			queued += len(p.sendQ)
+		}
+		awaiting := 0
+		for c := range s.ctxs {
+			if c.backtrace != nil {
+				awaiting++
+			}
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped:  atomic.LoadUint64(&s.dropped),
+			protocol.StatQueued:   uint64(queued),
+			protocol.StatAwaiting: uint64(awaiting),
+		}, nil
 	}
 
 	return s.defCtx.GetOption(name)
@@ -452,6 +531,7 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 		closeQ: make(chan struct{}),
 		recvQ:  make(chan *protocol.Message, 1),
 	}
+	s.ctxs[c] = struct{}{}
 	return c, nil
 }
 
@@ -0,0 +1,209 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Shares limits the part of a socket's receive queue that the messages
+// of any one pipe may take up, for OptionRecvFair and
+// OptionRecvPipeShare.  A pipe holding its share waits, before
+// delivering another message, until one of its messages is received;
+// the pipes waiting for room in the queue are then served in turn.
+// Only messages delivered while a limit is set are counted.
+type Shares struct {
+	on    int32 // set if there is a limit, checked without the lock
+	mu    sync.Mutex
+	fair  bool
+	max   int
+	qlen  int
+	pipes int
+	held  map[uint32]int // messages in the queue, by pipe ID
+	room  chan struct{}  // closed when a message is taken
+}
+
+// SetOption sets OptionRecvFair or OptionRecvPipeShare.
+func (sh *Shares) SetOption(name string, value interface{}) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	switch name {
+	case OptionRecvFair:
+		v, ok := value.(bool)
+		if !ok {
+			return ErrBadValue
+		}
+		sh.fair = v
+	case OptionRecvPipeShare:
+		v, ok := value.(int)
+		if !ok || v < 0 {
+			return ErrBadValue
+		}
+		sh.max = v
+	default:
+		return ErrBadOption
+	}
+	var on int32
+	if sh.fair || sh.max > 0 {
+		on = 1
+	}
+	atomic.StoreInt32(&sh.on, on)
+	sh.wake() // a limit may have been raised
+	return nil
+}
+
+// GetOption returns OptionRecvFair or OptionRecvPipeShare.
+func (sh *Shares) GetOption(name string) (interface{}, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	switch name {
+	case OptionRecvFair:
+		return sh.fair, nil
+	case OptionRecvPipeShare:
+		return sh.max, nil
+	}
+	return nil, ErrBadOption
+}
+
+// SetQLen records the length of the receive queue, as set with
+// OptionReadQLen.  As resizing the queue may drop messages, the counts
+// start again from nothing.
+func (sh *Shares) SetQLen(n int) {
+	sh.mu.Lock()
+	sh.qlen = n
+	sh.held = nil
+	sh.wake()
+	sh.mu.Unlock()
+}
+
+// SetRoom records how many messages may be held at once, where that
+// changes without any being lost, as with the contexts of REP.
+func (sh *Shares) SetRoom(n int) {
+	sh.mu.Lock()
+	sh.qlen = n
+	sh.wake()
+	sh.mu.Unlock()
+}
+
+// AddPipe counts a pipe connected, for the fair share.
+func (sh *Shares) AddPipe() {
+	sh.mu.Lock()
+	sh.pipes++
+	sh.mu.Unlock()
+}
+
+// RemovePipe counts a pipe gone, forgetting its messages.
+func (sh *Shares) RemovePipe(id uint32) {
+	sh.mu.Lock()
+	sh.pipes--
+	delete(sh.held, id)
+	sh.wake()
+	sh.mu.Unlock()
+}
+
+// limit returns the most messages a pipe may have in the queue, or zero
+// for no limit.  The lock must be held.
+func (sh *Shares) limit() int {
+	n := sh.max
+	if sh.fair && sh.pipes > 0 {
+		f := (sh.qlen + sh.pipes - 1) / sh.pipes
+		if f < 1 {
+			f = 1
+		}
+		if n == 0 || f < n {
+			n = f
+		}
+	}
+	return n
+}
+
+func (sh *Shares) wake() {
+	if sh.room != nil {
+		close(sh.room)
+		sh.room = nil
+	}
+}
+
+// Wait waits until the pipe with the given ID may deliver a message,
+// and counts the message as delivered.  It returns false if either
+// closeq or pipeq is closed first.
+func (sh *Shares) Wait(id uint32, closeq, pipeq <-chan struct{}) bool {
+	if atomic.LoadInt32(&sh.on) == 0 {
+		return true
+	}
+	for {
+		sh.mu.Lock()
+		if n := sh.limit(); n == 0 || sh.held[id] < n {
+			if n != 0 {
+				if sh.held == nil {
+					sh.held = make(map[uint32]int)
+				}
+				sh.held[id]++
+			}
+			sh.mu.Unlock()
+			return true
+		}
+		if sh.room == nil {
+			sh.room = make(chan struct{})
+		}
+		room := sh.room
+		sh.mu.Unlock()
+		select {
+		case <-room:
+		case <-closeq:
+			return false
+		case <-pipeq:
+			return false
+		}
+	}
+}
+
+// Taken records that the messages have been taken from the queue,
+// making room for more from the pipes they came on.
+func (sh *Shares) Taken(msgs ...*Message) {
+	if atomic.LoadInt32(&sh.on) == 0 {
+		return
+	}
+	sh.mu.Lock()
+	for _, m := range msgs {
+		if m.Pipe != nil {
+			sh.done(m.Pipe.ID())
+		}
+	}
+	sh.wake()
+	sh.mu.Unlock()
+}
+
+// Done records that a message from the pipe with the given ID, counted
+// by Wait, is no longer held, as when a REP request is answered.
+func (sh *Shares) Done(id uint32) {
+	if atomic.LoadInt32(&sh.on) == 0 {
+		return
+	}
+	sh.mu.Lock()
+	sh.done(id)
+	sh.wake()
+	sh.mu.Unlock()
+}
+
+// done counts one message fewer for the pipe.  The lock must be held.
+func (sh *Shares) done(id uint32) {
+	if n := sh.held[id]; n > 1 {
+		sh.held[id] = n - 1
+	} else if n == 1 {
+		delete(sh.held, id)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// spoolSegmentSize is the size past which a Spool starts a new segment.
+const spoolSegmentSize = 4 << 20
+
+// Spool is a queue of messages kept on disk, for OptionSpoolDir.  It is
+// a log of segment files, each a run of records holding the header and
+// body of a message, with a cursor file recording how far it has been
+// read; segments are removed once read.  A message stays in the spool
+// until Pop, so the caller decides when it counts as sent.  Writes are
+// not synced, so the host crashing (but not just the process) may lose
+// the latest messages.  The caller must serialize access to it, usually
+// with the socket lock.
+type Spool struct {
+	dir    string
+	limit  int64    // OptionSpoolMaxBytes, or zero
+	size   int64    // bytes in records yet to be read
+	count  int      // records yet to be read
+	segs   []uint64 // segment numbers, oldest first
+	w      *os.File // the newest segment, for appending
+	wsize  int64
+	r      *os.File // the oldest segment, for reading
+	roff   int64    // offset of the next record in r
+	cursor *os.File
+	next   []byte // the record read by Peek, until Pop
+	nhlen  int    // the length of its header
+}
+
+const spoolRecHdr = 8 // header length, body length
+
+func spoolSegName(n uint64) string {
+	return fmt.Sprintf("%016x.seg", n)
+}
+
+// OpenSpool opens the spool in the directory, creating the directory
+// if need be.  Messages left there by a previous run are kept, to be
+// sent first.
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	sp := &Spool{dir: dir}
+	if err := sp.load(); err != nil {
+		sp.Close()
+		return nil, err
+	}
+	return sp, nil
+}
+
+// load finds the segments, and where reading left off.
+func (sp *Spool) load() error {
+	files, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 16, 64)
+		if err != nil {
+			continue
+		}
+		sp.segs = append(sp.segs, n)
+	}
+	sort.Slice(sp.segs, func(i, j int) bool { return sp.segs[i] < sp.segs[j] })
+
+	sp.cursor, err = os.OpenFile(filepath.Join(sp.dir, "cursor"),
+		os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	var cur [16]byte
+	if _, err := sp.cursor.ReadAt(cur[:], 0); err == nil {
+		seg := binary.BigEndian.Uint64(cur[:8])
+		for len(sp.segs) > 0 && sp.segs[0] < seg {
+			_ = os.Remove(sp.segPath(sp.segs[0]))
+			sp.segs = sp.segs[1:]
+		}
+		if len(sp.segs) > 0 && sp.segs[0] == seg {
+			sp.roff = int64(binary.BigEndian.Uint64(cur[8:]))
+		}
+	}
+	if len(sp.segs) == 0 {
+		sp.segs = []uint64{1}
+	}
+
+	for i, n := range sp.segs {
+		start := int64(0)
+		if i == 0 {
+			start = sp.roff
+		}
+		if err := sp.scan(n, start); err != nil {
+			return err
+		}
+	}
+	if sp.r, err = os.Open(sp.segPath(sp.segs[0])); err != nil {
+		return err
+	}
+	return sp.openWriter()
+}
+
+func (sp *Spool) segPath(n uint64) string {
+	return filepath.Join(sp.dir, spoolSegName(n))
+}
+
+// scan counts the records of a segment from start, cutting off any
+// record left incomplete by a crash.
+func (sp *Spool) scan(n uint64, start int64) error {
+	f, err := os.OpenFile(sp.segPath(n), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	off := start
+	var hdr [spoolRecHdr]byte
+	for {
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			break
+		}
+		rlen := spoolRecHdr + int64(binary.BigEndian.Uint32(hdr[:4])) +
+			int64(binary.BigEndian.Uint32(hdr[4:]))
+		if off+rlen > fi.Size() {
+			break
+		}
+		off += rlen
+		sp.size += rlen
+		sp.count++
+	}
+	if off < fi.Size() {
+		return f.Truncate(off)
+	}
+	return nil
+}
+
+func (sp *Spool) openWriter() error {
+	n := sp.segs[len(sp.segs)-1]
+	w, err := os.OpenFile(sp.segPath(n), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := w.Stat()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	sp.w = w
+	sp.wsize = fi.Size()
+	return nil
+}
+
+// SetLimit limits the bytes the spool holds, zero meaning no limit.
+// What it holds already is kept.
+func (sp *Spool) SetLimit(n int64) {
+	sp.limit = n
+}
+
+// Len returns the number of messages in the spool.
+func (sp *Spool) Len() int {
+	return sp.count
+}
+
+// Append adds a copy of the message to the spool.  It returns false,
+// without error, if the spool has no room for it.
+func (sp *Spool) Append(m *Message) (bool, error) {
+	blen := m.BodyLen()
+	rlen := int64(spoolRecHdr + len(m.Header) + blen)
+	if sp.limit > 0 && sp.size+rlen > sp.limit {
+		return false, nil
+	}
+	if sp.wsize > 0 && sp.wsize+rlen > spoolSegmentSize {
+		// Start a new segment.
+		sp.segs = append(sp.segs, sp.segs[len(sp.segs)-1]+1)
+		sp.w.Close()
+		if err := sp.openWriter(); err != nil {
+			sp.segs = sp.segs[:len(sp.segs)-1]
+			return false, err
+		}
+	}
+	b := make([]byte, spoolRecHdr, rlen)
+	binary.BigEndian.PutUint32(b[:4], uint32(len(m.Header)))
+	binary.BigEndian.PutUint32(b[4:], uint32(blen))
+	b = append(b, m.Header...)
+	b = append(b, m.Body...)
+	for _, seg := range m.Bodies {
+		b = append(b, seg...)
+	}
+	if _, err := sp.w.Write(b); err != nil {
+		return false, err
+	}
+	sp.wsize += rlen
+	sp.size += rlen
+	sp.count++
+	return true, nil
+}
+
+// Peek returns a new message with the contents of the oldest in the
+// spool, or nil if it is empty.  The message is the caller's; Pop
+// removes it from the spool.
+func (sp *Spool) Peek() (*Message, error) {
+	if sp.count == 0 {
+		return nil, nil
+	}
+	if sp.next == nil {
+		if err := sp.read(); err != nil {
+			return nil, err
+		}
+	}
+	body := sp.next[spoolRecHdr+sp.nhlen:]
+	m := NewMessage(len(body))
+	m.Header = append(m.Header, sp.next[spoolRecHdr:spoolRecHdr+sp.nhlen]...)
+	m.Body = append(m.Body, body...)
+	return m, nil
+}
+
+// read reads the next record, moving on to the next segment if this
+// one is done.
+func (sp *Spool) read() error {
+	var hdr [spoolRecHdr]byte
+	for {
+		_, err := sp.r.ReadAt(hdr[:], sp.roff)
+		if err == nil {
+			break
+		}
+		if err != io.EOF || len(sp.segs) < 2 {
+			return err
+		}
+		if err := sp.nextSegment(); err != nil {
+			return err
+		}
+	}
+	hlen := int(binary.BigEndian.Uint32(hdr[:4]))
+	blen := int(binary.BigEndian.Uint32(hdr[4:]))
+	b := make([]byte, spoolRecHdr+hlen+blen)
+	if _, err := sp.r.ReadAt(b, sp.roff); err != nil {
+		return err
+	}
+	sp.next = b
+	sp.nhlen = hlen
+	return nil
+}
+
+// nextSegment removes the segment just read, and opens the next.
+func (sp *Spool) nextSegment() error {
+	sp.r.Close()
+	sp.r = nil
+	_ = os.Remove(sp.segPath(sp.segs[0]))
+	sp.segs = sp.segs[1:]
+	sp.roff = 0
+	r, err := os.Open(sp.segPath(sp.segs[0]))
+	if err != nil {
+		return err
+	}
+	sp.r = r
+	return sp.saveCursor()
+}
+
+func (sp *Spool) saveCursor() error {
+	var cur [16]byte
+	binary.BigEndian.PutUint64(cur[:8], sp.segs[0])
+	binary.BigEndian.PutUint64(cur[8:], uint64(sp.roff))
+	_, err := sp.cursor.WriteAt(cur[:], 0)
+	return err
+}
+
+// Pop removes the message returned by Peek from the spool.
+func (sp *Spool) Pop() error {
+	if sp.next == nil {
+		return nil
+	}
+	sp.roff += int64(len(sp.next))
+	sp.size -= int64(len(sp.next))
+	sp.next = nil
+	sp.count--
+	return sp.saveCursor()
+}
+
+// Close closes the files of the spool, leaving what it holds on disk.
+func (sp *Spool) Close() error {
+	for _, f := range []*os.File{sp.r, sp.w, sp.cursor} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	sp.r, sp.w, sp.cursor = nil, nil, nil
+	return nil
+}
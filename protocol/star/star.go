@@ -64,6 +64,10 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 	return m, err
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, false, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
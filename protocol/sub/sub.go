@@ -24,6 +24,7 @@ package sub
 
 import (
 	"bytes"
+	"sort"
 	"sync"
 	"time"
 
@@ -43,6 +44,9 @@ type socket struct {
 	ctxs   map[*context]struct{}
 	pipes  map[uint32]*pipe
 	closed bool
+	replay bool
+	fwd    bool   // OptionSubForward
+	sep    []byte // OptionSubWildcard, nil for plain prefixes
 	sync.Mutex
 }
 
@@ -50,15 +54,19 @@ type pipe struct {
 	s      *socket
 	p      protocol.Pipe
 	closed bool
+	closeq chan struct{}
+	notify protocol.Notifier // subscriptions to be sent
 }
 
 type context struct {
 	recvq      chan *protocol.Message
+	readable   protocol.Notifier
 	recvQLen   int
 	recvExpire time.Duration
 	closeq     chan struct{}
 	closed     bool
 	subs       [][]byte
+	trie       *trie // the subs, if using wildcards
 	s          *socket
 }
 
@@ -80,17 +88,24 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 
 Loop:
 	for {
+		// Unsubscribing replaces the queue, so take it under the lock.
+		s.Lock()
+		recvq := c.recvq
+		s.Unlock()
 		select {
 		case <-timeq:
 			return nil, protocol.ErrRecvTimeout
 		case <-c.closeq:
 			return nil, protocol.ErrClosed
-		case m, ok := <-c.recvq:
+		case m, ok := <-recvq:
 			// Assume c.recvq will only be closed after c.recvq is assigned with a new channel unsubscribe()
 			// Otherwise this becomes a busy wait until timeq trigger or context closed
 			if !ok {
 				continue Loop
 			}
+			s.Lock()
+			c.readable.Set(len(c.recvq) > 0)
+			s.Unlock()
 			return m, nil
 		}
 	}
@@ -105,6 +120,7 @@ func (c *context) Close() error {
 	}
 	s.closed = true
 	delete(s.ctxs, c)
+	s.subsChanged()
 	s.Unlock()
 	close(c.closeq)
 	return nil
@@ -131,6 +147,7 @@ func (p *pipe) receiver() {
 				dm := m.Dup()
 				select {
 				case c.recvq <- dm:
+					c.readable.Notify()
 				default:
 					dm.Free()
 				}
@@ -145,8 +162,10 @@ func (p *pipe) receiver() {
 
 func (s *socket) AddPipe(pp protocol.Pipe) error {
 	p := &pipe{
-		p: pp,
-		s: s,
+		p:      pp,
+		s:      s,
+		closeq: make(chan struct{}),
+		notify: protocol.NewNotifier(),
 	}
 	s.Lock()
 	defer s.Unlock()
@@ -155,15 +174,120 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 	}
 	s.pipes[p.p.ID()] = p
 	go p.receiver()
+	if s.fwd {
+		// The subscriptions go first, so that the replay is of
+		// just the messages wanted.
+		p.notify.Notify()
+		go p.announcer(s.replay)
+	} else {
+		go p.announcer(false)
+		if s.replay {
+			go p.requestReplay()
+		}
+	}
 	return nil
 }
 
+// announcer sends the subscriptions to the publisher each time they
+// change, if forwarding them, and then asks for a replay if replay is
+// true.
+func (p *pipe) announcer(replay bool) {
+	s := p.s
+	for {
+		select {
+		case <-p.notify:
+		case <-p.closeq:
+			return
+		}
+		s.Lock()
+		topics := [][]byte{{}}
+		if s.fwd {
+			topics = s.topics()
+		}
+		s.Unlock()
+		m := protocol.EncodeSubscriptions(topics)
+		if err := p.p.SendMsg(m); err != nil {
+			m.Free()
+			return
+		}
+		if replay {
+			replay = false
+			go p.requestReplay()
+		}
+	}
+}
+
+// topics returns the subscriptions of all the contexts, sorted and
+// without duplicates.  The lock must be held.
+func (s *socket) topics() [][]byte {
+	seen := make(map[string]bool)
+	topics := [][]byte{}
+	for c := range s.ctxs {
+		for _, sub := range c.subs {
+			if s.sep != nil {
+				// The publisher only knows prefixes.
+				sub = literalPrefix(sub, s.sep)
+			}
+			if !seen[string(sub)] {
+				seen[string(sub)] = true
+				topics = append(topics, sub)
+			}
+		}
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return bytes.Compare(topics[i], topics[j]) < 0
+	})
+	return topics
+}
+
+// literalPrefix returns the part of the topic before its first wildcard
+// segment, which is the most that a publisher can filter on.
+func literalPrefix(topic, sep []byte) []byte {
+	n := 0
+	for {
+		i := bytes.Index(topic[n:], sep)
+		end := len(topic)
+		if i >= 0 {
+			end = n + i
+		}
+		switch string(topic[n:end]) {
+		case wildOne, wildOne2, wildRest:
+			return topic[:n]
+		}
+		if i < 0 {
+			return topic
+		}
+		n = end + len(sep)
+	}
+}
+
+// subsChanged has the subscriptions sent to every publisher, if they
+// are being forwarded.  The lock must be held.
+func (s *socket) subsChanged() {
+	if !s.fwd {
+		return
+	}
+	for _, p := range s.pipes {
+		p.notify.Notify()
+	}
+}
+
+// requestReplay asks the publisher for the messages it has retained.
+func (p *pipe) requestReplay() {
+	m := protocol.NewMessage(len(protocol.ReplayRequest))
+	m.Body = append(m.Body, protocol.ReplayRequest...)
+	if err := p.p.SendMsg(m); err != nil {
+		m.Free()
+	}
+}
+
 func (s *socket) RemovePipe(pp protocol.Pipe) {
 	s.Lock()
 	defer s.Unlock()
 	p := s.pipes[pp.ID()]
 	if p != nil && p.p == pp && !p.closed {
 		p.closed = true
+		close(p.closeq)
 		pp.Close()
 		delete(s.pipes, pp.ID())
 	}
@@ -201,6 +325,7 @@ func (p *pipe) Close() error {
 		return protocol.ErrClosed
 	}
 	p.closed = true
+	close(p.closeq)
 	s.Unlock()
 
 	p.p.Close()
@@ -208,6 +333,9 @@ func (p *pipe) Close() error {
 }
 
 func (c *context) matches(m *protocol.Message) bool {
+	if c.trie != nil {
+		return c.trie.match(m.Body)
+	}
 	for _, sub := range c.subs {
 		if bytes.HasPrefix(m.Body, sub) {
 			return true
@@ -225,6 +353,9 @@ func (c *context) subscribe(topic []byte) error {
 		}
 	}
 	c.subs = append(c.subs, topic)
+	if c.trie != nil {
+		c.trie.add(topic)
+	}
 	return nil
 }
 
@@ -234,41 +365,52 @@ func (c *context) unsubscribe(topic []byte) error {
 			continue
 		}
 		c.subs = append(c.subs[:i], c.subs[i+1:]...)
+		if c.trie != nil {
+			c.trie.remove(topic)
+		}
 
 		// Because we have changed the subscription,
 		// we may have messages in the channel that
 		// we don't want any more.  Lets prune those.
-		newchan := make(chan *protocol.Message, c.recvQLen)
-		oldchan := c.recvq
-		c.recvq = newchan
-		close(oldchan)
-		for m := range oldchan {
-			if !c.matches(m) {
-				m.Free()
-				continue
-			}
-			select {
-			case newchan <- m:
-			default:
-				m.Free()
-			}
-		}
+		c.requeue(c.recvQLen)
 		return nil
 	}
 	// Subscription not present
 	return protocol.ErrBadValue
 }
 
+// requeue replaces the receive queue with one of length n, moving over
+// the messages still subscribed to, oldest first, as many as fit.  The
+// old queue is closed, so that RecvMsg waiting on it takes the new one.
+// The socket lock must be held.
+func (c *context) requeue(n int) {
+	newchan := make(chan *protocol.Message, n)
+	oldchan := c.recvq
+	c.recvq = newchan
+	close(oldchan)
+	for m := range oldchan {
+		if !c.matches(m) {
+			m.Free()
+			continue
+		}
+		select {
+		case newchan <- m:
+		default:
+			m.Free()
+		}
+	}
+	c.readable.Set(len(newchan) > 0)
+}
+
 func (c *context) SetOption(name string, value interface{}) error {
 	s := c.s
 
 	switch name {
 	case protocol.OptionReadQLen:
-		if v, ok := value.(int); ok {
-			newchan := make(chan *protocol.Message, v)
+		if v, ok := value.(int); ok && v >= 0 {
 			c.s.Lock()
-			c.recvq = newchan
 			c.recvQLen = v
+			c.requeue(v)
 			c.s.Unlock()
 			return nil
 		}
@@ -303,25 +445,33 @@ func (c *context) SetOption(name string, value interface{}) error {
 	s.Lock()
 	defer s.Unlock()
 
+	var err error
 	switch name {
 	case protocol.OptionSubscribe:
-		return c.subscribe(vb)
-
+		err = c.subscribe(vb)
 	case protocol.OptionUnsubscribe:
-		return c.unsubscribe(vb)
-
-	default:
-		return protocol.ErrBadOption
+		err = c.unsubscribe(vb)
 	}
+	if err == nil {
+		s.subsChanged()
+	}
+	return err
 }
 
 func (c *context) GetOption(name string) (interface{}, error) {
 	switch name {
+	case protocol.OptionRecvReady:
+		return c.readable.Chan(), nil
 	case protocol.OptionReadQLen:
 		c.s.Lock()
 		v := c.recvQLen
 		c.s.Unlock()
 		return v, nil
+	case protocol.OptionRecvDeadline:
+		c.s.Lock()
+		v := c.recvExpire
+		c.s.Unlock()
+		return v, nil
 	}
 	return nil, protocol.ErrBadOption
 }
@@ -340,10 +490,14 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 		s:          s,
 		closeq:     make(chan struct{}),
 		recvq:      make(chan *protocol.Message, s.master.recvQLen),
+		readable:   protocol.NewNotifier(),
 		recvQLen:   s.master.recvQLen,
 		recvExpire: s.master.recvExpire,
 		subs:       [][]byte{},
 	}
+	if s.sep != nil {
+		c.trie = newTrie(s.sep)
+	}
 	s.ctxs[c] = struct{}{}
 	return c, nil
 }
@@ -352,15 +506,108 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 	switch name {
 	case protocol.OptionRaw:
 		return false, nil
+	case protocol.OptionReplay:
+		s.Lock()
+		v := s.replay
+		s.Unlock()
+		return v, nil
+	case protocol.OptionSubForward:
+		s.Lock()
+		v := s.fwd
+		s.Unlock()
+		return v, nil
+	case protocol.OptionSubWildcard:
+		s.Lock()
+		v := string(s.sep)
+		s.Unlock()
+		return v, nil
 	default:
 		return s.master.GetOption(name)
 	}
 }
 
 func (s *socket) SetOption(name string, val interface{}) error {
+	if name == protocol.OptionReplay {
+		if v, ok := val.(bool); ok {
+			s.Lock()
+			s.replay = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+	}
+	if name == protocol.OptionSubForward {
+		if v, ok := val.(bool); ok {
+			s.Lock()
+			if v != s.fwd {
+				// Turning it off sends the empty topic, so that
+				// the publishers send everything again.
+				s.fwd = true
+				s.subsChanged()
+				s.fwd = v
+			}
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+	}
+	if name == protocol.OptionSubWildcard {
+		if v, ok := val.(string); ok {
+			s.Lock()
+			s.setWildcard([]byte(v))
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+	}
 	return s.master.SetOption(name, val)
 }
 
+// setWildcard changes the separator for wildcards, rebuilding the
+// subscriptions of each context.  The lock must be held.
+func (s *socket) setWildcard(sep []byte) {
+	if len(sep) == 0 {
+		sep = nil
+	}
+	s.sep = sep
+	for c := range s.ctxs {
+		c.trie = nil
+		if sep == nil {
+			continue
+		}
+		c.trie = newTrie(sep)
+		for _, sub := range c.subs {
+			c.trie.add(sub)
+		}
+	}
+	s.subsChanged()
+}
+
+// Debug reports the subscriptions of all the contexts, wildcards and
+// all, and the messages waiting to be received by the socket.
+func (s *socket) Debug() protocol.ProtocolState {
+	var st protocol.ProtocolState
+	s.Lock()
+	defer s.Unlock()
+	seen := make(map[string]bool)
+	for c := range s.ctxs {
+		for _, sub := range c.subs {
+			if !seen[string(sub)] {
+				seen[string(sub)] = true
+				st.Subscriptions = append(st.Subscriptions, string(sub))
+			}
+		}
+	}
+	sort.Strings(st.Subscriptions)
+	st.RecvQueued = len(s.master.recvq)
+	st.RecvCap = cap(s.master.recvq)
+	for id := range s.pipes {
+		st.Pipes = append(st.Pipes, protocol.PipeState{ID: id})
+	}
+	protocol.SortState(&st)
+	return st
+}
+
 func (s *socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -370,6 +617,10 @@ func (s *socket) Info() protocol.Info {
 	}
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, false, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
@@ -379,6 +630,7 @@ func NewProtocol() protocol.Protocol {
 	s.master = &context{
 		s:        s,
 		recvq:    make(chan *protocol.Message, defaultQLen),
+		readable: protocol.NewNotifier(),
 		closeq:   make(chan struct{}),
 		recvQLen: defaultQLen,
 	}
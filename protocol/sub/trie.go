@@ -0,0 +1,158 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sub
+
+import "bytes"
+
+// Wildcard segments, see OptionSubWildcard.  Both '*' and '+' stand for
+// any one segment, and '#' at the end for all those that follow.
+const (
+	wildOne  = "*"
+	wildOne2 = "+"
+	wildRest = "#"
+)
+
+// trie holds the subscriptions of a context, split into segments, when
+// using wildcards.  Each node is reached by the segments of the topics
+// above it.  Matching walks down the segments of a message, taking both
+// the literal and the wildcard branch, so the cost depends on the depth
+// of the topics rather than on how many there are.
+type trie struct {
+	sep  []byte
+	root *trieNode
+}
+
+type trieNode struct {
+	next map[string]*trieNode // by literal segment, not the last
+	wild *trieNode            // by "*" or "+", not the last
+	last map[string]int       // topics ending in a literal segment
+	any  int                  // topics ending in "*" or "+"
+	rest int                  // topics ending in "#"
+}
+
+func newTrie(sep []byte) *trie {
+	return &trie{sep: sep, root: &trieNode{}}
+}
+
+func (n *trieNode) empty() bool {
+	return len(n.next) == 0 && n.wild == nil && len(n.last) == 0 &&
+		n.any == 0 && n.rest == 0
+}
+
+// add puts the topic in the trie.  The caller ensures that it is not
+// already there.
+func (t *trie) add(topic []byte) {
+	segs := bytes.Split(topic, t.sep)
+	n := t.root
+	for _, seg := range segs[:len(segs)-1] {
+		s := string(seg)
+		if s == wildOne || s == wildOne2 {
+			if n.wild == nil {
+				n.wild = &trieNode{}
+			}
+			n = n.wild
+			continue
+		}
+		if n.next == nil {
+			n.next = make(map[string]*trieNode)
+		}
+		c := n.next[s]
+		if c == nil {
+			c = &trieNode{}
+			n.next[s] = c
+		}
+		n = c
+	}
+	switch s := string(segs[len(segs)-1]); s {
+	case wildOne, wildOne2:
+		n.any++
+	case wildRest:
+		n.rest++
+	default:
+		if n.last == nil {
+			n.last = make(map[string]int)
+		}
+		n.last[s]++
+	}
+}
+
+// remove takes the topic out of the trie, pruning the nodes left empty.
+// The caller ensures that it is there.
+func (t *trie) remove(topic []byte) {
+	t.removeAt(t.root, bytes.Split(topic, t.sep))
+}
+
+func (t *trie) removeAt(n *trieNode, segs [][]byte) {
+	s := string(segs[0])
+	if len(segs) == 1 {
+		switch s {
+		case wildOne, wildOne2:
+			n.any--
+		case wildRest:
+			n.rest--
+		default:
+			if n.last[s]--; n.last[s] == 0 {
+				delete(n.last, s)
+			}
+		}
+		return
+	}
+	if s == wildOne || s == wildOne2 {
+		t.removeAt(n.wild, segs[1:])
+		if n.wild.empty() {
+			n.wild = nil
+		}
+		return
+	}
+	c := n.next[s]
+	t.removeAt(c, segs[1:])
+	if c.empty() {
+		delete(n.next, s)
+	}
+}
+
+// match returns true if any topic in the trie matches the message body.
+// As with plain subscriptions, the last segment of a topic need only be
+// a prefix of that of the body, and what follows it is not looked at.
+func (t *trie) match(body []byte) bool {
+	return t.matchAt(t.root, body, true)
+}
+
+// matchAt matches the body below the node.  If ok is false, the body
+// has no more segments.
+func (t *trie) matchAt(n *trieNode, body []byte, ok bool) bool {
+	if n.rest > 0 {
+		return true
+	}
+	if !ok {
+		return false
+	}
+	seg, rest, more := body, []byte(nil), false
+	if i := bytes.Index(body, t.sep); i >= 0 {
+		seg, rest, more = body[:i], body[i+len(t.sep):], true
+	}
+	if n.any > 0 {
+		return true
+	}
+	for i := 0; i <= len(seg) && len(n.last) > 0; i++ {
+		if n.last[string(seg[:i])] > 0 {
+			return true
+		}
+	}
+	if c := n.next[string(seg)]; c != nil && t.matchAt(c, rest, more) {
+		return true
+	}
+	return n.wild != nil && t.matchAt(n.wild, rest, more)
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// SubscriptionsPrefix starts the body of the message that a SUB socket
+// with OptionSubForward sends to each PUB peer, listing all of its
+// subscriptions.  Each follows as a 32-bit length (network byte order)
+// and the topic itself.  Like ReplayRequest, PUB peers that do not
+// understand it discard it.
+var SubscriptionsPrefix = []byte("\x00mangos-subs\x00")
+
+// EncodeSubscriptions returns the message listing the topics.
+func EncodeSubscriptions(topics [][]byte) *Message {
+	n := len(SubscriptionsPrefix)
+	for _, t := range topics {
+		n += 4 + len(t)
+	}
+	m := NewMessage(n)
+	m.Body = append(m.Body, SubscriptionsPrefix...)
+	for _, t := range topics {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(t)))
+		m.Body = append(m.Body, l[:]...)
+		m.Body = append(m.Body, t...)
+	}
+	return m
+}
+
+// DecodeSubscriptions returns the topics listed in a message body, and
+// false if the body is not such a list.
+func DecodeSubscriptions(body []byte) ([][]byte, bool) {
+	if !bytes.HasPrefix(body, SubscriptionsPrefix) {
+		return nil, false
+	}
+	body = body[len(SubscriptionsPrefix):]
+	topics := [][]byte{}
+	for len(body) > 0 {
+		if len(body) < 4 {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		if uint64(n) > uint64(len(body)) {
+			return nil, false
+		}
+		topics = append(topics, append([]byte{}, body[:n]...))
+		body = body[n:]
+	}
+	return topics, true
+}
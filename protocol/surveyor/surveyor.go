@@ -36,11 +36,12 @@ const (
 const defaultSurveyTime = time.Second
 
 type pipe struct {
-	s      *socket
-	p      protocol.Pipe
-	closed bool
-	closeq chan struct{}
-	sendq  chan *protocol.Message
+	s       *socket
+	p       protocol.Pipe
+	closed  bool
+	closeq  chan struct{}
+	sendq   chan *protocol.Message
+	resized chan struct{} // see protocol.Resize
 }
 
 type context struct {
@@ -52,6 +53,8 @@ type context struct {
 	recvExpire time.Duration
 	survExpire time.Duration
 	survID     uint32
+	sentTo     int       // respondents the last survey was sent to
+	sentAt     time.Time // when the last survey was sent
 }
 
 type socket struct {
@@ -62,6 +65,7 @@ type socket struct {
 	nextID   uint32                // next survey ID
 	closed   bool                  // true if closed
 	sendQLen int                   // send Q depth
+	clock    protocol.Clock        // OptionClock
 	sync.Mutex
 }
 
@@ -107,9 +111,10 @@ func (c *context) SendMsg(m *protocol.Message) error {
 	}
 	c.cancel()
 	c.survID = id
+	c.sentAt = s.clock.Now()
 	c.recvq = make(chan *protocol.Message, c.recvQLen)
 	s.surveys[id] = c
-	time.AfterFunc(c.survExpire, func() {
+	s.clock.AfterFunc(c.survExpire, func() {
 		s.Lock()
 		if c.survID == id {
 			c.cancel()
@@ -118,10 +123,12 @@ func (c *context) SendMsg(m *protocol.Message) error {
 	})
 
 	// Best-effort broadcast on all pipes
+	c.sentTo = 0
 	for _, p := range s.pipes {
 		dm := m.Dup()
 		select {
 		case p.sendq <- dm:
+			c.sentTo++
 		default:
 			dm.Free()
 		}
@@ -137,7 +144,7 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 	recvq := c.recvq
 	timeq := nilQ
 	if c.recvExpire > 0 {
-		timeq = time.After(c.recvExpire)
+		timeq = s.clock.After(c.recvExpire)
 	}
 	s.Unlock()
 
@@ -201,10 +208,9 @@ func (c *context) SetOption(name string, value interface{}) error {
 		return protocol.ErrBadValue
 
 	case protocol.OptionReadQLen:
-		if v, ok := value.(int); ok {
-			newchan := make(chan *protocol.Message, v)
+		if v, ok := value.(int); ok && v >= 0 {
+			// The survey under way keeps the queue it has.
 			c.s.Lock()
-			c.recvq = newchan
 			c.recvQLen = v
 			c.s.Unlock()
 			return nil
@@ -232,6 +238,11 @@ func (c *context) GetOption(option string) (interface{}, error) {
 		v := c.recvQLen
 		c.s.Unlock()
 		return v, nil
+	case protocol.OptionSurveyRespondents:
+		c.s.Lock()
+		v := c.sentTo
+		c.s.Unlock()
+		return v, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -253,13 +264,22 @@ func (p *pipe) Close() error {
 }
 
 func (p *pipe) sender() {
+	s := p.s
+	s.Lock()
+	sendq, resized := p.sendq, p.resized
+	s.Unlock()
 outer:
 	for {
 		var m *protocol.Message
 		select {
 		case <-p.closeq:
 			break outer
-		case m = <-p.sendq:
+		case <-resized:
+			s.Lock()
+			sendq, resized = p.sendq, p.resized
+			s.Unlock()
+			continue
+		case m = <-sendq:
 		}
 
 		if err := p.p.SendMsg(m); err != nil {
@@ -326,10 +346,11 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 
 func (s *socket) AddPipe(pp protocol.Pipe) error {
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		sendq:  make(chan *protocol.Message, s.sendQLen),
-		closeq: make(chan struct{}),
+		p:       pp,
+		s:       s,
+		sendq:   make(chan *protocol.Message, s.sendQLen),
+		resized: make(chan struct{}),
+		closeq:  make(chan struct{}),
 	}
 	s.Lock()
 	defer s.Unlock()
@@ -393,6 +414,16 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.sendQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := 0
+		for _, p := range s.pipes {
+			queued += len(p.sendq)
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatQueued: uint64(queued),
+		}, nil
 
 	default:
 		return s.master.GetOption(option)
@@ -402,9 +433,24 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 func (s *socket) SetOption(option string, value interface{}) error {
 	switch option {
 	case protocol.OptionWriteQLen:
-		if v, ok := value.(int); ok {
+		if v, ok := value.(int); ok && v >= 0 {
 			s.Lock()
 			s.sendQLen = v
+			for _, p := range s.pipes {
+				protocol.Resize(&p.sendq, &p.resized, v)
+			}
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionClock:
+		if v, ok := value.(protocol.Clock); ok || value == nil {
+			if v == nil {
+				v = protocol.SystemClock
+			}
+			s.Lock()
+			s.clock = v
 			s.Unlock()
 			return nil
 		}
@@ -413,6 +459,30 @@ func (s *socket) SetOption(option string, value interface{}) error {
 	return s.master.SetOption(option, value)
 }
 
+// Debug reports the surveys that have yet to expire, and the surveys
+// queued for each pipe.
+func (s *socket) Debug() protocol.ProtocolState {
+	var st protocol.ProtocolState
+	s.Lock()
+	defer s.Unlock()
+	for id, c := range s.surveys {
+		st.Pending = append(st.Pending, protocol.RequestState{
+			ID:       id,
+			Sent:     c.sentAt,
+			Attempts: 1,
+		})
+	}
+	for id, p := range s.pipes {
+		st.Pipes = append(st.Pipes, protocol.PipeState{
+			ID:     id,
+			Queued: len(p.sendq),
+			Cap:    cap(p.sendq),
+		})
+	}
+	protocol.SortState(&st)
+	return st
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -422,6 +492,37 @@ func (*socket) Info() protocol.Info {
 	}
 }
 
+// Receiver is a SURVEYOR socket or context, as used with Responses.
+type Receiver interface {
+	RecvMsg() (*protocol.Message, error)
+}
+
+// Responses returns a channel that delivers the responses to the survey
+// last sent on r as they arrive, and that is closed when the survey ends,
+// at OptionSurveyTime (or OptionRecvDeadline, if sooner), or when r is
+// closed.  The caller must read from the channel until it is closed, and
+// must not send another survey on r until then, nor receive from r
+// itself.  The responses belong to the caller, who should free them.
+// OptionSurveyRespondents gives the most that may be expected.
+func Responses(r Receiver) <-chan *protocol.Message {
+	ch := make(chan *protocol.Message)
+	go func() {
+		defer close(ch)
+		for {
+			m, err := r.RecvMsg()
+			if err != nil {
+				return
+			}
+			ch <- m
+		}
+	}()
+	return ch
+}
+
+func init() {
+	protocol.RegisterProtocol(SelfName, false, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
@@ -429,6 +530,7 @@ func NewProtocol() protocol.Protocol {
 		surveys:  make(map[uint32]*context),
 		ctxs:     make(map[*context]struct{}),
 		sendQLen: defaultQLen,
+		clock:    protocol.SystemClock,
 		nextID:   uint32(time.Now().UnixNano()), // quasi-random
 	}
 	s.master = &context{
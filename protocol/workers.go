@@ -0,0 +1,123 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import "sync"
+
+// Task is work for a WorkerPool, typically sending what is queued for a
+// pipe.  Work should do a bounded amount of it, so that other tasks get
+// their turn, and report whether there is more to do.
+type Task interface {
+	Work() bool
+}
+
+// Task states in a WorkerPool.
+const (
+	taskQueued  = 1 // waiting for a worker
+	taskRunning = 2 // being worked on
+	taskRerun   = 3 // being worked on, and scheduled again meanwhile
+)
+
+// WorkerPool runs tasks on a bounded set of goroutines, rather than one
+// (or more) for each pipe.  PUB uses one for its senders, with
+// OptionSendWorkers; the transports do not, and still read each pipe
+// with a goroutine of its own.  A task is run by only one worker at a
+// time, and scheduling it again while it runs has it run once more
+// afterwards.
+type WorkerPool struct {
+	size    int // workers wanted
+	running int // workers started, and not yet stopped
+	stopped bool
+	queue   []Task
+	state   map[Task]int
+	cv      *sync.Cond
+	sync.Mutex
+}
+
+// NewWorkerPool returns a pool with no workers; see Resize.
+func NewWorkerPool() *WorkerPool {
+	wp := &WorkerPool{state: make(map[Task]int)}
+	wp.cv = sync.NewCond(wp)
+	return wp
+}
+
+// Resize sets the number of workers.  Those beyond it stop when they
+// have finished their current task.
+func (wp *WorkerPool) Resize(n int) {
+	wp.Lock()
+	defer wp.Unlock()
+	if wp.stopped {
+		return
+	}
+	wp.size = n
+	for wp.running < wp.size {
+		wp.running++
+		go wp.worker()
+	}
+	wp.cv.Broadcast()
+}
+
+// Stop stops the workers, and forgets any tasks not yet run.
+func (wp *WorkerPool) Stop() {
+	wp.Lock()
+	wp.stopped = true
+	wp.queue = nil
+	wp.cv.Broadcast()
+	wp.Unlock()
+}
+
+// Schedule has the task run by the next free worker.
+func (wp *WorkerPool) Schedule(t Task) {
+	wp.Lock()
+	defer wp.Unlock()
+	switch wp.state[t] {
+	case taskQueued, taskRerun:
+	case taskRunning:
+		wp.state[t] = taskRerun
+	default:
+		wp.state[t] = taskQueued
+		wp.queue = append(wp.queue, t)
+		wp.cv.Signal()
+	}
+}
+
+func (wp *WorkerPool) worker() {
+	wp.Lock()
+	defer wp.Unlock()
+	for {
+		if wp.stopped || wp.running > wp.size {
+			wp.running--
+			return
+		}
+		if len(wp.queue) == 0 {
+			wp.cv.Wait()
+			continue
+		}
+		t := wp.queue[0]
+		wp.queue[0] = nil
+		wp.queue = wp.queue[1:]
+		wp.state[t] = taskRunning
+		wp.Unlock()
+		more := t.Work()
+		wp.Lock()
+		if (more || wp.state[t] == taskRerun) && !wp.stopped {
+			wp.state[t] = taskQueued
+			wp.queue = append(wp.queue, t)
+			wp.cv.Signal()
+		} else {
+			delete(wp.state, t)
+		}
+	}
+}
@@ -21,27 +21,41 @@ package xbus
 import (
 	"encoding/binary"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
 )
 
 type pipe struct {
-	p      protocol.Pipe
-	s      *socket
-	closed bool
-	closeq chan struct{}
-	sendq  chan *protocol.Message
+	drops   uint64 // messages discarded for this pipe
+	p       protocol.Pipe
+	s       *socket
+	closed  bool
+	closeq  chan struct{}
+	sendq   chan *protocol.Message
+	resized chan struct{} // see protocol.Resize
+	adapt   *protocol.AdaptiveQ
 }
 
 type socket struct {
+	dropped    uint64 // messages discarded due to backpressure
+	echoes     uint64 // messages not sent back to their origin
 	closed     bool
 	closeq     chan struct{}
 	pipes      map[uint32]*pipe
 	recvQLen   int
 	sendQLen   int
+	qMinLen    int
+	qMaxLen    int
+	policy     protocol.QueueFullPolicy
+	bestEffort bool
 	recvExpire time.Duration
 	recvq      chan *protocol.Message
+	resized    chan struct{} // see protocol.Resize
+	readable   protocol.Notifier
+	shares     protocol.Shares // OptionRecvFair, OptionRecvPipeShare
+	logger     protocol.Logger
 	sync.Mutex
 }
 
@@ -66,6 +80,7 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 		return protocol.ErrClosed
 	}
 	var id uint32
+	dropped := 0
 
 	if len(m.Header) == 4 {
 		// This is coming back to us - its a forwarded message
@@ -76,26 +91,75 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 		m.Header = m.Header[:0]
 	}
 
+	pipes := s.targets(m)
+	if pipes == nil {
+		// The target has gone away.
+		dropped++
+	}
+
 	// This could benefit from optimization to avoid useless duplicates.
-	for _, p := range s.pipes {
+	policy := s.policy
+	if policy == protocol.QueueFullBlock && s.bestEffort {
+		policy = protocol.QueueFullDropNewest
+	}
+	var wait []*pipe
+	for _, p := range pipes {
 
 		// Don't deliver the message back up to the same pipe it
 		// arrived from.
 		if p.p.ID() == id {
+			atomic.AddUint64(&s.echoes, 1)
 			continue
 		}
-		pm := m.Dup()
-		select {
-		case p.sendq <- pm:
-		case <-p.closeq:
-			pm.Free()
-		default:
-			// backpressure, but we do not exert
-			pm.Free()
+		if p.adapt != nil && !p.adapt.Admit(len(p.sendq)) {
+			atomic.AddUint64(&p.drops, 1)
+			dropped++
+			continue
 		}
+		if policy == protocol.QueueFullBlock {
+			// Waiting is done without the lock, below.
+			wait = append(wait, p)
+			continue
+		}
+		n, _ := protocol.Enqueue(p.sendq, protocol.ShareMessage(m), policy,
+			p.closeq, nilQ)
+		atomic.AddUint64(&p.drops, uint64(n))
+		dropped += n
 	}
+	logger := s.logger
+	npipes := len(s.pipes)
 	s.Unlock()
+	for _, p := range wait {
+		pm := protocol.ShareMessage(m)
+		n, err := protocol.EnqueueResizable(s, &p.sendq, &p.resized, pm,
+			policy, p.closeq, nilQ)
+		if err != nil {
+			pm.Free()
+			n++
+		}
+		atomic.AddUint64(&p.drops, uint64(n))
+		dropped += n
+	}
 	m.Free()
+	if dropped > 0 {
+		atomic.AddUint64(&s.dropped, uint64(dropped))
+		if logger != nil {
+			logger.Printf("mangos: %s dropped message for %d of %d pipes",
+				SelfName, dropped, npipes)
+		}
+	}
+	return nil
+}
+
+// targets returns the pipes a message is to be sent to, which are all of
+// them unless the message has a Target.
+func (s *socket) targets(m *protocol.Message) map[uint32]*pipe {
+	if m.Target == nil {
+		return s.pipes
+	}
+	if p, ok := s.pipes[m.Target.ID()]; ok {
+		return map[uint32]*pipe{p.p.ID(): p}
+	}
 	return nil
 }
 
@@ -109,19 +173,50 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 		tq = time.After(s.recvExpire)
 	}
 	s.Unlock()
-	select {
-	case <-s.closeq:
-		return nil, protocol.ErrClosed
-	case <-tq:
-		return nil, protocol.ErrRecvTimeout
-	case m := <-s.recvq:
-		return m, nil
+	for {
+		s.Lock()
+		recvq, resized := s.recvq, s.resized
+		s.Unlock()
+		select {
+		case <-s.closeq:
+			return nil, protocol.ErrClosed
+		case <-tq:
+			return nil, protocol.ErrRecvTimeout
+		case <-resized:
+		case m := <-recvq:
+			s.readable.Set(len(recvq) > 0)
+			s.shares.Taken(m)
+			return m, nil
+		}
 	}
 }
 
+func (s *socket) RecvMsgs(max int) ([]*protocol.Message, error) {
+	m, err := s.RecvMsg()
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	recvq := s.recvq
+	s.Unlock()
+	msgs := protocol.Dequeue(recvq, m, max)
+	s.readable.Set(len(recvq) > 0)
+	s.shares.Taken(msgs[1:]...)
+	return msgs, nil
+}
+
 func (s *socket) SetOption(name string, value interface{}) error {
 	switch name {
 
+	case protocol.OptionLogger:
+		if v, ok := value.(protocol.Logger); ok || value == nil {
+			s.Lock()
+			s.logger = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
 	case protocol.OptionRecvDeadline:
 		if v, ok := value.(time.Duration); ok {
 			s.Lock()
@@ -135,6 +230,50 @@ func (s *socket) SetOption(name string, value interface{}) error {
 		if v, ok := value.(int); ok && v >= 0 {
 			s.Lock()
 			s.sendQLen = v
+			for _, p := range s.pipes {
+				// Adaptive queues size themselves.
+				if p.adapt == nil {
+					n := protocol.Resize(&p.sendq, &p.resized, v)
+					atomic.AddUint64(&p.drops, uint64(n))
+					atomic.AddUint64(&s.dropped, uint64(n))
+				}
+			}
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionWriteQMaxLen:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.Lock()
+			s.qMaxLen = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionBestEffort:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			s.bestEffort = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionQueueFullPolicy:
+		v, err := protocol.ParseQueueFullPolicy(value)
+		if err == nil {
+			s.Lock()
+			s.policy = v
+			s.Unlock()
+		}
+		return err
+
+	case protocol.OptionWriteQMinLen:
+		if v, ok := value.(int); ok && v >= 1 {
+			s.Lock()
+			s.qMinLen = v
 			s.Unlock()
 			return nil
 		}
@@ -142,31 +281,18 @@ func (s *socket) SetOption(name string, value interface{}) error {
 
 	case protocol.OptionReadQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
 			s.Lock()
 			s.recvQLen = v
-			oldchan := s.recvq
-			s.recvq = newchan
+			n := protocol.Resize(&s.recvq, &s.resized, v)
 			s.Unlock()
-
-			for {
-				var m *protocol.Message
-				select {
-				case m = <-oldchan:
-				default:
-				}
-				if m == nil {
-					break
-				}
-				select {
-				case newchan <- m:
-				default:
-					m.Free()
-				}
-			}
+			s.shares.SetQLen(v)
+			atomic.AddUint64(&s.dropped, uint64(n))
 			return nil
 		}
 		return protocol.ErrBadValue
+
+	case protocol.OptionRecvFair, protocol.OptionRecvPipeShare:
+		return s.shares.SetOption(name, value)
 	}
 
 	return protocol.ErrBadOption
@@ -176,6 +302,11 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 	switch option {
 	case protocol.OptionRaw:
 		return true, nil
+	case protocol.OptionRecvReady:
+		return s.readable.Chan(), nil
+	case protocol.OptionSendReady:
+		// Sending never blocks.
+		return protocol.Ready, nil
 	case protocol.OptionRecvDeadline:
 		s.Lock()
 		v := s.recvExpire
@@ -186,11 +317,56 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.sendQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionWriteQMaxLen:
+		s.Lock()
+		v := s.qMaxLen
+		s.Unlock()
+		return v, nil
+	case protocol.OptionWriteQMinLen:
+		s.Lock()
+		v := s.qMinLen
+		s.Unlock()
+		return v, nil
+	case protocol.OptionBestEffort:
+		s.Lock()
+		v := s.bestEffort
+		s.Unlock()
+		return v, nil
+	case protocol.OptionQueueFullPolicy:
+		s.Lock()
+		v := s.policy
+		s.Unlock()
+		return v, nil
 	case protocol.OptionReadQLen:
 		s.Lock()
 		v := s.recvQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := 0
+		for _, p := range s.pipes {
+			queued += len(p.sendq)
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped:        atomic.LoadUint64(&s.dropped),
+			protocol.StatEchoSuppressed: atomic.LoadUint64(&s.echoes),
+			protocol.StatQueued:         uint64(queued),
+		}, nil
+	case protocol.OptionPipeStats:
+		s.Lock()
+		stats := make(map[uint32]map[string]uint64, len(s.pipes))
+		for id, p := range s.pipes {
+			stats[id] = map[string]uint64{
+				protocol.StatDropped: atomic.LoadUint64(&p.drops),
+				protocol.StatQueued:  uint64(len(p.sendq)),
+			}
+		}
+		s.Unlock()
+		return stats, nil
+	case protocol.OptionRecvFair, protocol.OptionRecvPipeShare:
+		return s.shares.GetOption(option)
 	}
 
 	return nil, protocol.ErrBadOption
@@ -203,12 +379,19 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		return protocol.ErrClosed
 	}
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		closeq: make(chan struct{}),
-		sendq:  make(chan *protocol.Message, s.sendQLen),
+		p:       pp,
+		s:       s,
+		closeq:  make(chan struct{}),
+		resized: make(chan struct{}),
+	}
+	if s.qMaxLen > 0 {
+		p.adapt = protocol.NewAdaptiveQ(s.sendQLen, s.qMinLen, s.qMaxLen)
+		p.sendq = make(chan *protocol.Message, p.adapt.Max())
+	} else {
+		p.sendq = make(chan *protocol.Message, s.sendQLen)
 	}
 	s.pipes[pp.ID()] = p
+	s.shares.AddPipe()
 
 	go p.sender()
 	go p.receiver()
@@ -263,17 +446,31 @@ func (s *socket) Close() error {
 }
 
 func (p *pipe) sender() {
+	s := p.s
+	s.Lock()
+	sendq, resized := p.sendq, p.resized
+	s.Unlock()
 outer:
 	for {
 		var m *protocol.Message
 		select {
 		case <-p.closeq:
 			break outer
-		case m = <-p.sendq:
+		case <-resized:
+			s.Lock()
+			sendq, resized = p.sendq, p.resized
+			s.Unlock()
+			continue
+		case m = <-sendq:
+		}
+		msgs := protocol.Dequeue(sendq, m, protocol.MaxSendBatch)
+		if p.adapt != nil {
+			for range msgs {
+				p.adapt.Drained()
+			}
 		}
 
-		if err := p.p.SendMsg(m); err != nil {
-			m.Free()
+		if err := p.p.SendMsgs(msgs); err != nil {
 			break
 		}
 	}
@@ -281,7 +478,7 @@ outer:
 }
 
 func (p *pipe) receiver() {
-outer:
+	s := p.s
 	for {
 		m := p.p.RecvMsg()
 		if m == nil {
@@ -296,15 +493,17 @@ outer:
 		m.Header = make([]byte, 4)
 		binary.BigEndian.PutUint32(m.Header, p.p.ID())
 
-		select {
-		case p.s.recvq <- m:
-		case <-p.closeq:
-			m.Free()
-			break outer
-		case <-p.s.closeq:
+		if !s.shares.Wait(p.p.ID(), p.closeq, s.closeq) {
 			m.Free()
-			break outer
+			break
+		}
+		n, ok := protocol.Deliver(s, &s.recvq, &s.resized, m,
+			p.closeq, s.closeq)
+		atomic.AddUint64(&s.dropped, uint64(n))
+		if !ok {
+			break
 		}
+		s.readable.Notify()
 	}
 	p.Close()
 }
@@ -318,21 +517,31 @@ func (p *pipe) Close() error {
 	p.closed = true
 	delete(p.s.pipes, p.p.ID())
 	p.s.Unlock()
+	p.s.shares.RemovePipe(p.p.ID())
 
 	close(p.closeq)
 	p.p.Close()
 	return nil
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
 		pipes:    make(map[uint32]*pipe),
 		closeq:   make(chan struct{}),
 		recvq:    make(chan *protocol.Message, defaultQLen),
+		resized:  make(chan struct{}),
+		readable: protocol.NewNotifier(),
 		sendQLen: defaultQLen,
+		qMinLen:  1,
+		policy:   protocol.QueueFullDropNewest,
 		recvQLen: defaultQLen,
 	}
+	s.shares.SetQLen(defaultQLen)
 	return s
 }
 
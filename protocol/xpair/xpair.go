@@ -13,11 +13,14 @@
 // limitations under the License.
 
 // Package xpair implements the PAIR protocol. This is a simple 1:1
-// messaging pattern.  Only one peer can be connected at a time.
+// messaging pattern.  Only one peer can be connected at a time, unless
+// OptionPolyamorous is set, in which case messages are sent to the peer
+// most recently heard from.
 package xpair
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
@@ -34,61 +37,99 @@ const (
 const defaultQlen = 128
 
 type pipe struct {
-	p      protocol.Pipe
-	s      *socket
-	closeq chan struct{}
-	closed bool
+	p       protocol.Pipe
+	s       *socket
+	sendq   chan *protocol.Message // own queue, only when polyamorous
+	lanes   protocol.Lanes         // and its lanes
+	resized chan struct{}          // see protocol.Resize
+	closeq  chan struct{}
+	closed  bool
 }
 
 type socket struct {
-	closed     bool
-	closeq     chan struct{}
-	peer       *pipe
-	recvQLen   int
-	sendQLen   int
-	recvExpire time.Duration
-	sendExpire time.Duration
-	bestEffort bool
-	recvq      chan *protocol.Message
-	sendq      chan *protocol.Message
+	dropped     uint64 // messages discarded by the queue full policy
+	closed      bool
+	closeq      chan struct{}
+	peer        *pipe // the peer, or the most recently active one
+	peers       map[uint32]*pipe
+	poly        bool
+	recvQLen    int
+	sendQLen    int
+	recvExpire  time.Duration
+	sendExpire  time.Duration
+	bestEffort  bool
+	policy      protocol.QueueFullPolicy
+	synch       bool
+	recvq       chan *protocol.Message
+	resized     chan struct{} // see protocol.Resize
+	sendq       chan *protocol.Message
+	lanes       protocol.Lanes // OptionSendPriorities
+	prios       int
+	sendResized chan struct{} // see protocol.Resize
+	readable    protocol.Notifier
+	writable    protocol.Notifier
 	sync.Mutex
 }
 
 var (
-	nilQ    <-chan time.Time
-	closedQ chan time.Time
+	nilQ <-chan time.Time
 )
 
-func init() {
-	closedQ = make(chan time.Time)
-	close(closedQ)
-}
-
 const defaultQLen = 128
 
 func (s *socket) SendMsg(m *protocol.Message) error {
 	tq := nilQ
 	s.Lock()
-	if s.bestEffort {
-		tq = closedQ
-	} else if s.sendExpire > 0 {
-		tq = time.After(s.sendExpire)
-	}
-	s.Unlock()
-
-	select {
-	case <-s.closeq:
-		return protocol.ErrClosed
-	case <-tq:
-		if tq == closedQ {
+	p := s.peer
+	if t := m.Target; t != nil {
+		if p = s.peers[t.ID()]; p == nil {
+			// That peer is gone.
+			s.Unlock()
 			m.Free()
 			return nil
 		}
-		return protocol.ErrSendTimeout
+	}
+	if s.poly && p == nil {
+		s.Unlock()
+		return protocol.ErrNoRoute
+	}
+	q, lanes, resized := s.queue(p)
+	if s.synch && p != nil && len(*q) == 0 && lanes.Len() == 0 {
+		s.Unlock()
+		return p.send(m)
+	}
+	lq := lanes.Queue(m, q)
+	policy := s.policy
+	if policy == protocol.QueueFullBlock {
+		if s.bestEffort {
+			policy = protocol.QueueFullDropNewest
+		} else if s.sendExpire > 0 {
+			tq = time.After(s.sendExpire)
+		}
+	}
+	s.Unlock()
 
-	case s.sendq <- m:
-		return nil
+	n, err := protocol.EnqueueResizable(s, lq, resized, m, policy, s.closeq, tq)
+	if n > 0 {
+		atomic.AddUint64(&s.dropped, uint64(n))
 	}
+	s.Lock()
+	if lq != q {
+		lanes.Queued()
+	}
+	s.writable.Set(len(*q) < cap(*q))
+	s.Unlock()
+	return err
+}
+
+// queue returns the send queue for the peer p, which is its own when
+// polyamorous, along with its lanes, and the channel closed when either
+// is resized.  The lock must be held.
+func (s *socket) queue(p *pipe) (*chan *protocol.Message, *protocol.Lanes, *chan struct{}) {
+	if p != nil && p.sendq != nil {
+		return &p.sendq, &p.lanes, &p.resized
+	}
+	return &s.sendq, &s.lanes, &s.sendResized
 }
 
 func (s *socket) RecvMsg() (*protocol.Message, error) {
@@ -101,19 +142,48 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 		tq = time.After(s.recvExpire)
 	}
 	s.Unlock()
-	select {
-	case <-s.closeq:
-		return nil, protocol.ErrClosed
-	case <-tq:
-		return nil, protocol.ErrRecvTimeout
-	case m := <-s.recvq:
-		return m, nil
+	for {
+		s.Lock()
+		recvq, resized := s.recvq, s.resized
+		s.Unlock()
+		select {
+		case <-s.closeq:
+			return nil, protocol.ErrClosed
+		case <-tq:
+			return nil, protocol.ErrRecvTimeout
+		case <-resized:
+		case m := <-recvq:
+			s.readable.Set(len(recvq) > 0)
+			return m, nil
+		}
 	}
 }
 
+func (s *socket) RecvMsgs(max int) ([]*protocol.Message, error) {
+	m, err := s.RecvMsg()
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	recvq := s.recvq
+	s.Unlock()
+	msgs := protocol.Dequeue(recvq, m, max)
+	s.readable.Set(len(recvq) > 0)
+	return msgs, nil
+}
+
 func (s *socket) SetOption(name string, value interface{}) error {
 	switch name {
 
+	case protocol.OptionQueueFullPolicy:
+		v, err := protocol.ParseQueueFullPolicy(value)
+		if err == nil {
+			s.Lock()
+			s.policy = v
+			s.Unlock()
+		}
+		return err
+
 	case protocol.OptionBestEffort:
 		if v, ok := value.(bool); ok {
 			s.Lock()
@@ -123,6 +193,27 @@ func (s *socket) SetOption(name string, value interface{}) error {
 		}
 		return protocol.ErrBadValue
 
+	case protocol.OptionSynchronous:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			s.synch = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionPolyamorous:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			defer s.Unlock()
+			if len(s.peers) != 0 && v != s.poly {
+				return protocol.ErrProtoState
+			}
+			s.poly = v
+			return nil
+		}
+		return protocol.ErrBadValue
+
 	case protocol.OptionRecvDeadline:
 		if v, ok := value.(time.Duration); ok {
 			s.Lock()
@@ -143,30 +234,47 @@ func (s *socket) SetOption(name string, value interface{}) error {
 
 	case protocol.OptionReadQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
-
 			s.Lock()
 			s.recvQLen = v
-			s.recvq = newchan
+			n := protocol.Resize(&s.recvq, &s.resized, v)
 			s.Unlock()
-
+			atomic.AddUint64(&s.dropped, uint64(n))
 			return nil
 		}
 		return protocol.ErrBadValue
 
 	case protocol.OptionWriteQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
-
 			s.Lock()
 			s.sendQLen = v
-			s.sendq = newchan
+			n := s.lanes.Resize(v)
+			n += protocol.Resize(&s.sendq, &s.sendResized, v)
+			for _, p := range s.peers {
+				if p.sendq != nil {
+					n += p.lanes.Resize(v)
+					n += protocol.Resize(&p.sendq, &p.resized, v)
+				}
+			}
 			s.Unlock()
-
+			atomic.AddUint64(&s.dropped, uint64(n))
 			return nil
 		}
 		return protocol.ErrBadValue
 
+	case protocol.OptionSendPriorities:
+		v, err := protocol.ParseSendPriorities(value)
+		if err == nil {
+			s.Lock()
+			s.prios = v
+			s.lanes.SetPriorities(v, s.sendQLen, &s.sendResized)
+			for _, p := range s.peers {
+				if p.sendq != nil {
+					p.lanes.SetPriorities(v, s.sendQLen, &p.resized)
+				}
+			}
+			s.Unlock()
+		}
+		return err
 	}
 
 	return protocol.ErrBadOption
@@ -181,6 +289,25 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.bestEffort
 		s.Unlock()
 		return v, nil
+	case protocol.OptionQueueFullPolicy:
+		s.Lock()
+		v := s.policy
+		s.Unlock()
+		return v, nil
+	case protocol.OptionRecvReady:
+		return s.readable.Chan(), nil
+	case protocol.OptionSendReady:
+		return s.writable.Chan(), nil
+	case protocol.OptionSynchronous:
+		s.Lock()
+		v := s.synch
+		s.Unlock()
+		return v, nil
+	case protocol.OptionPolyamorous:
+		s.Lock()
+		v := s.poly
+		s.Unlock()
+		return v, nil
 	case protocol.OptionRecvDeadline:
 		s.Lock()
 		v := s.recvExpire
@@ -201,7 +328,22 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.sendQLen
 		s.Unlock()
 		return v, nil
-
+	case protocol.OptionSendPriorities:
+		s.Lock()
+		v := s.prios
+		s.Unlock()
+		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := len(s.sendq) + s.lanes.Len()
+		for _, p := range s.peers {
+			queued += len(p.sendq) + p.lanes.Len()
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped: atomic.LoadUint64(&s.dropped),
+			protocol.StatQueued:  uint64(queued),
+		}, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -213,14 +355,22 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 	if s.closed {
 		return protocol.ErrClosed
 	}
-	if s.peer != nil {
+	if s.peer != nil && !s.poly {
 		return protocol.ErrProtoState
 	}
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		closeq: make(chan struct{}),
+		p:       pp,
+		s:       s,
+		closeq:  make(chan struct{}),
+		resized: make(chan struct{}),
 	}
+	if s.poly {
+		p.sendq = make(chan *protocol.Message, s.sendQLen)
+		if s.prios > 1 {
+			p.lanes.SetPriorities(s.prios, s.sendQLen, &p.resized)
+		}
+	}
+	s.peers[pp.ID()] = p
 	s.peer = p
 	go p.receiver()
 	go p.sender()
@@ -229,13 +379,11 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 
 func (s *socket) RemovePipe(pp protocol.Pipe) {
 	s.Lock()
-	p := s.peer
-	if p == nil || pp != p.p {
-		s.Unlock()
-		return
-	}
+	p := s.peers[pp.ID()]
 	s.Unlock()
-	p.Close()
+	if p != nil {
+		p.Close()
+	}
 }
 
 func (s *socket) OpenContext() (protocol.Context, error) {
@@ -259,13 +407,16 @@ func (s *socket) Close() error {
 	}
 	s.closed = true
 
-	p := s.peer
+	var peers []*pipe
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
 
 	s.Unlock()
 	close(s.closeq)
 
 	// This allows synchronous close without the lock.
-	if p != nil {
+	for _, p := range peers {
 		p.Close()
 	}
 
@@ -274,42 +425,83 @@ func (s *socket) Close() error {
 
 func (p *pipe) receiver() {
 	s := p.s
-outer:
 	for {
 		m := p.p.RecvMsg()
 		if m == nil {
 			break
 		}
+		if s.poly {
+			s.Lock()
+			if !p.closed {
+				s.peer = p
+			}
+			s.Unlock()
+		}
 
-		select {
-		case s.recvq <- m:
-		case <-s.closeq:
-			m.Free()
-			break outer
-		case <-p.closeq:
-			m.Free()
-			break outer
+		n, ok := protocol.Deliver(s, &s.recvq, &s.resized, m,
+			p.closeq, s.closeq)
+		atomic.AddUint64(&s.dropped, uint64(n))
+		if !ok {
+			break
 		}
+		s.readable.Notify()
 	}
 	p.Close()
 }
 
+// send writes the message directly on the calling goroutine.  This is
+// used by the synchronous mode.
+func (p *pipe) send(m *protocol.Message) error {
+	if err := p.p.SendMsg(m); err != nil {
+		m.Free()
+		p.Close()
+		return err
+	}
+	return nil
+}
+
 func (p *pipe) sender() {
 	s := p.s
+	s.Lock()
+	q, l, rs := s.queue(p)
+	sendq, lanes, resized := *q, *l, *rs
+	s.Unlock()
 outer:
 	for {
+		var m *protocol.Message
 		select {
-		case m := <-s.sendq:
-			if err := p.p.SendMsg(m); err != nil {
-				m.Free()
-				break outer
-			}
+		case <-resized:
+			s.Lock()
+			sendq, lanes, resized = *q, *l, *rs
+			s.Unlock()
+			continue
+
+		case m = <-sendq:
+		case <-lanes.Ready():
 
 		case <-s.closeq:
 			break outer
 		case <-p.closeq:
 			break outer
 		}
+		msgs := protocol.DequeueLanes(&lanes, sendq, m, protocol.MaxSendBatch)
+		s.writable.Notify()
+		n := 0
+		for _, m := range msgs {
+			if t := m.Target; t != nil && t.ID() != p.p.ID() {
+				// Meant for an earlier peer.
+				m.Free()
+				continue
+			}
+			msgs[n] = m
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		if err := p.p.SendMsgs(msgs[:n]); err != nil {
+			break
+		}
 	}
 	p.Close()
 }
@@ -322,24 +514,53 @@ func (p *pipe) Close() error {
 		return protocol.ErrClosed
 	}
 	p.closed = true
+	delete(s.peers, p.p.ID())
 	if s.peer == p {
+		// Fall back to another peer, if there is one.
 		s.peer = nil
+		for _, other := range s.peers {
+			s.peer = other
+			break
+		}
 	}
 	s.Unlock()
 	close(p.closeq)
 	p.p.Close()
+	if p.sendq != nil {
+		// Nobody else will send what was queued for this peer.
+		p.lanes.Free()
+		for {
+			select {
+			case m := <-p.sendq:
+				m.Free()
+			default:
+				return nil
+			}
+		}
+	}
 	return nil
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
-		closeq:   make(chan struct{}),
-		recvq:    make(chan *protocol.Message, defaultQLen),
-		sendq:    make(chan *protocol.Message, defaultQLen),
-		recvQLen: defaultQLen,
-		sendQLen: defaultQLen,
+		closeq:      make(chan struct{}),
+		peers:       make(map[uint32]*pipe),
+		recvq:       make(chan *protocol.Message, defaultQLen),
+		resized:     make(chan struct{}),
+		sendq:       make(chan *protocol.Message, defaultQLen),
+		sendResized: make(chan struct{}),
+		recvQLen:    defaultQLen,
+		sendQLen:    defaultQLen,
+		prios:       1,
+		readable:    protocol.NewNotifier(),
+		writable:    protocol.NewNotifier(),
 	}
+	s.writable.Notify()
 	return s
 }
 
@@ -17,25 +17,74 @@
 package xpub
 
 import (
+	"bytes"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
 )
 
 type pipe struct {
-	p      protocol.Pipe
-	s      *socket
-	closed bool
-	closeq chan struct{}
-	sendq  chan *protocol.Message
+	drops   uint64 // messages discarded for this pipe
+	p       protocol.Pipe
+	s       *socket
+	closed  bool
+	closeq  chan struct{}
+	sendq   chan *protocol.Message
+	resized chan struct{} // see protocol.Resize
+	adapt   *protocol.AdaptiveQ
+	since   uint64 // sequence of the first message sent live
+	replay  bool   // true once history has been replayed
+
+	// backlog is the replay for OptionReplayOnConnect, which is sent
+	// before anything in sendq.
+	backlog []*protocol.Message
+
+	subs  [][]byte // what the peer wants, see OptionSubForward
+	known bool     // true once the peer has sent its subscriptions
+
+	pool *protocol.WorkerPool // sends for us, if OptionSendWorkers
 }
 
 type socket struct {
-	closed   bool
-	pipes    map[uint32]*pipe
-	sendQLen int
+	dropped    uint64 // messages discarded due to backpressure
+	closed     bool
+	pipes      map[uint32]*pipe
+	sendQLen   int
+	qMinLen    int
+	qMaxLen    int
+	logger     protocol.Logger
+	policy     protocol.QueueFullPolicy
+	bestEffort bool
+	retain     int           // messages kept per topic
+	age        time.Duration // OptionRetainAge
+	topicFn    protocol.RetainTopicFunc
+	onConn     bool   // OptionReplayOnConnect
+	marker     []byte // OptionReplayMarker
+	seq        uint64 // sequence of the last message kept
+	history    map[string][]retained
+	changed    protocol.Notifier // OptionSubscriptionsChanged
+	subFn      protocol.SubscriptionFunc
+	events     []protocol.SubscriptionEvent // waiting for subFn
+	reporting  bool                         // true while reportEvents runs
 	sync.Mutex
+
+	workers int                  // OptionSendWorkers
+	pool    *protocol.WorkerPool // made when workers is first set
+
+	spool    *protocol.Spool // OptionSpoolDir
+	spoolDir string
+	spoolMax int               // OptionSpoolMaxBytes
+	room     protocol.Notifier // wakes drainSpool
+}
+
+// retained is a message kept for replay.
+type retained struct {
+	seq  uint64
+	when time.Time
+	m    *protocol.Message
 }
 
 // Protocol identity information.
@@ -58,23 +107,359 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 		s.Unlock()
 		return protocol.ErrClosed
 	}
-	// This could benefit from optimization to avoid useless duplicates.
-	for _, p := range s.pipes {
-		pm := m.Dup()
-		select {
-		case p.sendq <- pm:
-		case <-p.closeq:
-			pm.Free()
-		default:
-			// backpressure, but we do not exert
-			pm.Free()
+	if s.spool != nil && m.Target == nil &&
+		(s.spool.Len() > 0 || len(s.pipes) == 0) {
+		defer s.Unlock()
+		return s.spoolMsg(m)
+	}
+	s.deliver(m)
+	return nil
+}
+
+// deliver queues the message for each pipe that wants it.  It is called
+// with the lock held, and returns without it.
+func (s *socket) deliver(m *protocol.Message) {
+	dropped := 0
+	if (s.retain > 0 || s.age > 0) && m.Target == nil {
+		s.keep(m)
+	}
+
+	pipes := s.targets(m)
+	if pipes == nil {
+		// The target has gone away.
+		dropped++
+	}
+
+	// Each pipe is given a reference to the one message, not a copy.
+	policy := s.policy
+	if policy == protocol.QueueFullBlock && s.bestEffort {
+		policy = protocol.QueueFullDropNewest
+	}
+	var wait []*pipe
+	for _, p := range pipes {
+		if !p.wants(m.Body) {
+			continue
+		}
+		if p.adapt != nil && !p.adapt.Admit(len(p.sendq)) {
+			atomic.AddUint64(&p.drops, 1)
+			dropped++
+			continue
+		}
+		if policy == protocol.QueueFullBlock {
+			// Waiting is done without the lock, below.
+			wait = append(wait, p)
+			continue
 		}
+		n, _ := protocol.Enqueue(p.sendq, protocol.ShareMessage(m), policy,
+			p.closeq, nilQ)
+		atomic.AddUint64(&p.drops, uint64(n))
+		dropped += n
+		p.kick()
 	}
+	logger := s.logger
+	npipes := len(s.pipes)
 	s.Unlock()
+	for _, p := range wait {
+		pm := protocol.ShareMessage(m)
+		n, err := protocol.EnqueueResizable(s, &p.sendq, &p.resized, pm,
+			policy, p.closeq, nilQ)
+		if err != nil {
+			pm.Free()
+			n++
+		}
+		atomic.AddUint64(&p.drops, uint64(n))
+		dropped += n
+		p.kick()
+	}
+	m.Free()
+	if dropped > 0 {
+		atomic.AddUint64(&s.dropped, uint64(dropped))
+		if logger != nil {
+			logger.Printf("mangos: %s dropped message for %d of %d pipes",
+				SelfName, dropped, npipes)
+		}
+	}
+}
+
+// spoolMsg adds the message to the spool.  The lock must be held.
+func (s *socket) spoolMsg(m *protocol.Message) error {
+	ok, err := s.spool.Append(m)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		atomic.AddUint64(&s.dropped, 1)
+	}
 	m.Free()
 	return nil
 }
 
+// roomy reports whether every pipe has room in its queue, so that the
+// spool can be drained without loss.  The lock must be held.
+func (s *socket) roomy() bool {
+	for _, p := range s.pipes {
+		if len(p.sendq) >= cap(p.sendq) {
+			return false
+		}
+	}
+	return true
+}
+
+// drainSpool delivers messages from the spool as room is made, while
+// there are pipes to send them.
+func (s *socket) drainSpool(sp *protocol.Spool) {
+	for range s.room {
+		s.Lock()
+		for !s.closed && s.spool == sp && len(s.pipes) > 0 && s.roomy() {
+			m, err := sp.Peek()
+			if m == nil || err != nil {
+				break
+			}
+			_ = sp.Pop()
+			s.deliver(m)
+			s.Lock()
+		}
+		if s.closed || s.spool != sp {
+			// Replaced, so the new one may want this.
+			s.Unlock()
+			s.room.Notify()
+			return
+		}
+		s.Unlock()
+	}
+}
+
+// targets returns the pipes a message is to be sent to, which are all of
+// them unless the message has a Target.
+func (s *socket) targets(m *protocol.Message) map[uint32]*pipe {
+	if m.Target == nil {
+		return s.pipes
+	}
+	if p, ok := s.pipes[m.Target.ID()]; ok {
+		return map[uint32]*pipe{p.p.ID(): p}
+	}
+	return nil
+}
+
+// keep adds a copy of the message to the history of its topic,
+// discarding the oldest if the topic is full.  The lock must be held.
+func (s *socket) keep(m *protocol.Message) {
+	// The history has a limit of its own, so the copy is not counted
+	// against OptionMaxBufferBytes.  It is flattened, as any further
+	// body segments are the application's, and may change once sent.
+	dm := m.Dup()
+	dm.Uncharge()
+	dm.Flatten()
+	topic := ""
+	if s.topicFn != nil {
+		topic = s.topicFn(dm.Body)
+	}
+	s.seq++
+	h := append(s.history[topic], retained{seq: s.seq, when: time.Now(), m: dm})
+	s.history[topic] = s.trim(h)
+}
+
+// trim discards the oldest messages of a topic's history, beyond the
+// limits of OptionRetain and OptionRetainAge.  The lock must be held.
+func (s *socket) trim(h []retained) []retained {
+	drop := 0
+	if s.retain > 0 && len(h) > s.retain {
+		drop = len(h) - s.retain
+	} else if s.retain == 0 && s.age == 0 {
+		drop = len(h)
+	}
+	if s.age > 0 {
+		old := time.Now().Add(-s.age)
+		for drop < len(h) && h[drop].when.Before(old) {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return h
+	}
+	for _, r := range h[:drop] {
+		r.m.Free()
+	}
+	n := copy(h, h[drop:])
+	return h[:n]
+}
+
+// trimAll trims the history of every topic.  The lock must be held.
+func (s *socket) trimAll() {
+	for topic, h := range s.history {
+		if h = s.trim(h); len(h) == 0 {
+			delete(s.history, topic)
+		} else {
+			s.history[topic] = h
+		}
+	}
+}
+
+// replayed returns copies of the messages kept from before the pipe was
+// connected that it wants, oldest first, followed by the marker if
+// there is one.  The lock must be held.
+func (p *pipe) replayed() []*protocol.Message {
+	s := p.s
+	p.replay = true
+	s.trimAll()
+	var kept []retained
+	for _, h := range s.history {
+		for _, r := range h {
+			if r.seq < p.since && p.wants(r.m.Body) {
+				kept = append(kept, r)
+			}
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].seq < kept[j].seq })
+	msgs := make([]*protocol.Message, 0, len(kept)+1)
+	for _, r := range kept {
+		msgs = append(msgs, protocol.ShareMessage(r.m))
+	}
+	if len(s.marker) > 0 {
+		m := protocol.NewMessage(len(s.marker))
+		m.Body = append(m.Body, s.marker...)
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// replayHistory queues copies of the messages kept from before the pipe
+// was connected, when the peer asks for them.
+func (p *pipe) replayHistory() {
+	s := p.s
+	s.Lock()
+	if p.replay || p.closed {
+		s.Unlock()
+		return
+	}
+	msgs := p.replayed()
+	s.Unlock()
+
+	for i, m := range msgs {
+		n, err := protocol.EnqueueResizable(s, &p.sendq, &p.resized, m,
+			protocol.QueueFullBlock, p.closeq, nilQ)
+		if err != nil {
+			for _, m := range msgs[i:] {
+				m.Free()
+			}
+			return
+		}
+		atomic.AddUint64(&p.drops, uint64(n))
+		p.kick()
+	}
+}
+
+// wants reports whether the peer is subscribed to the message, as far
+// as we know.  The lock must be held.
+func (p *pipe) wants(body []byte) bool {
+	if !p.known {
+		return true
+	}
+	for _, sub := range p.subs {
+		if bytes.HasPrefix(body, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptions returns the topics wanted by the peers, for
+// OptionSubscriptions.  The lock must be held.
+func (s *socket) subscriptions() [][]byte {
+	seen := make(map[string]bool)
+	topics := [][]byte{}
+	for _, p := range s.pipes {
+		if !p.known {
+			return [][]byte{{}}
+		}
+		for _, sub := range p.subs {
+			if !seen[string(sub)] {
+				seen[string(sub)] = true
+				topics = append(topics, sub)
+			}
+		}
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return bytes.Compare(topics[i], topics[j]) < 0
+	})
+	return topics
+}
+
+// setSubs changes the subscriptions of the pipe, queueing the events
+// for OptionSubscriptionFunc.  A nil subs, with known false, is for the
+// pipe going away.  The lock must be held.
+func (s *socket) setSubs(p *pipe, subs [][]byte, known bool) {
+	old := p.subs
+	p.subs = subs
+	p.known = known
+	if s.subFn == nil {
+		return
+	}
+	had := make(map[string]bool, len(old))
+	for _, sub := range old {
+		had[string(sub)] = true
+	}
+	has := make(map[string]bool, len(subs))
+	for _, sub := range subs {
+		has[string(sub)] = true
+	}
+	sp, _ := p.p.(protocol.SocketPipe)
+	for _, sub := range old {
+		if !has[string(sub)] {
+			s.queueEvent(sp, sub, false)
+		}
+	}
+	for _, sub := range subs {
+		if !had[string(sub)] {
+			had[string(sub)] = true
+			s.queueEvent(sp, sub, true)
+		}
+	}
+}
+
+// queueEvent queues an event for OptionSubscriptionFunc, and starts
+// reportEvents if it is not running.  The lock must be held.
+func (s *socket) queueEvent(sp protocol.SocketPipe, topic []byte, sub bool) {
+	n := 0
+	for _, p := range s.pipes {
+		for _, x := range p.subs {
+			if bytes.Equal(x, topic) {
+				n++
+				break
+			}
+		}
+	}
+	s.events = append(s.events, protocol.SubscriptionEvent{
+		Pipe:        sp,
+		Topic:       append([]byte(nil), topic...),
+		Subscribed:  sub,
+		Subscribers: n,
+	})
+	if !s.reporting {
+		s.reporting = true
+		go s.reportEvents()
+	}
+}
+
+// reportEvents gives the queued events to the SubscriptionFunc, one at
+// a time, without the lock, so that it may use the socket.
+func (s *socket) reportEvents() {
+	s.Lock()
+	for len(s.events) > 0 {
+		ev := s.events[0]
+		s.events = s.events[1:]
+		fn := s.subFn
+		s.Unlock()
+		if fn != nil {
+			fn(ev)
+		}
+		s.Lock()
+	}
+	s.events = nil
+	s.reporting = false
+	s.Unlock()
+}
+
 func (s *socket) RecvMsg() (*protocol.Message, error) {
 	return nil, protocol.ErrProtoOp
 }
@@ -82,10 +467,207 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 func (s *socket) SetOption(name string, value interface{}) error {
 	switch name {
 
+	case protocol.OptionLogger:
+		if v, ok := value.(protocol.Logger); ok || value == nil {
+			s.Lock()
+			s.logger = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
 	case protocol.OptionWriteQLen:
 		if v, ok := value.(int); ok && v >= 0 {
 			s.Lock()
 			s.sendQLen = v
+			for _, p := range s.pipes {
+				// Adaptive queues size themselves.
+				if p.adapt == nil {
+					n := protocol.Resize(&p.sendq, &p.resized, v)
+					atomic.AddUint64(&p.drops, uint64(n))
+					atomic.AddUint64(&s.dropped, uint64(n))
+					p.kick()
+				}
+			}
+			s.Unlock()
+			s.room.Notify()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionWriteQMaxLen:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.Lock()
+			s.qMaxLen = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionWriteQMinLen:
+		if v, ok := value.(int); ok && v >= 1 {
+			s.Lock()
+			s.qMinLen = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionBestEffort:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			s.bestEffort = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionQueueFullPolicy:
+		v, err := protocol.ParseQueueFullPolicy(value)
+		if err == nil {
+			s.Lock()
+			s.policy = v
+			s.Unlock()
+		}
+		return err
+
+	case protocol.OptionRetain:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.Lock()
+			s.retain = v
+			s.trimAll()
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionRetainAge:
+		if v, ok := value.(time.Duration); ok && v >= 0 {
+			s.Lock()
+			s.age = v
+			s.trimAll()
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionReplayOnConnect:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			s.onConn = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionReplayMarker:
+		var b []byte
+		switch v := value.(type) {
+		case []byte:
+			b = append([]byte{}, v...)
+		case string:
+			b = []byte(v)
+		default:
+			if value != nil {
+				return protocol.ErrBadValue
+			}
+		}
+		s.Lock()
+		s.marker = b
+		s.Unlock()
+		return nil
+
+	case protocol.OptionSendWorkers:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.Lock()
+			defer s.Unlock()
+			if s.closed {
+				return protocol.ErrClosed
+			}
+			s.workers = v
+			if v > 0 {
+				// Pipes already using the pool keep it, even if
+				// it is no longer used for new ones.
+				if s.pool == nil {
+					s.pool = protocol.NewWorkerPool()
+				}
+				s.pool.Resize(v)
+			}
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionSpoolDir:
+		if v, ok := value.(string); ok {
+			var sp *protocol.Spool
+			if v != "" {
+				var err error
+				if sp, err = protocol.OpenSpool(v); err != nil {
+					return err
+				}
+			}
+			s.Lock()
+			if s.closed {
+				s.Unlock()
+				if sp != nil {
+					sp.Close()
+				}
+				return protocol.ErrClosed
+			}
+			old := s.spool
+			s.spool, s.spoolDir = sp, v
+			if sp != nil {
+				sp.SetLimit(int64(s.spoolMax))
+				go s.drainSpool(sp)
+				s.room.Notify()
+			}
+			if old != nil {
+				old.Close()
+			}
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionSpoolMaxBytes:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.Lock()
+			s.spoolMax = v
+			if s.spool != nil {
+				s.spool.SetLimit(int64(v))
+			}
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionSubscriptionFunc:
+		var fn protocol.SubscriptionFunc
+		switch v := value.(type) {
+		case protocol.SubscriptionFunc:
+			fn = v
+		case func(protocol.SubscriptionEvent):
+			fn = v
+		default:
+			if value != nil {
+				return protocol.ErrBadValue
+			}
+		}
+		s.Lock()
+		s.subFn = fn
+		s.Unlock()
+		return nil
+
+	case protocol.OptionRetainTopic:
+		if v, ok := value.(protocol.RetainTopicFunc); ok || value == nil {
+			s.Lock()
+			s.topicFn = v
+			s.Unlock()
+			return nil
+		}
+		if v, ok := value.(func([]byte) string); ok {
+			s.Lock()
+			s.topicFn = v
 			s.Unlock()
 			return nil
 		}
@@ -99,11 +681,115 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 	switch option {
 	case protocol.OptionRaw:
 		return true, nil
+	case protocol.OptionSendReady:
+		// Sending never blocks.
+		return protocol.Ready, nil
 	case protocol.OptionWriteQLen:
 		s.Lock()
 		v := s.sendQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionWriteQMaxLen:
+		s.Lock()
+		v := s.qMaxLen
+		s.Unlock()
+		return v, nil
+	case protocol.OptionWriteQMinLen:
+		s.Lock()
+		v := s.qMinLen
+		s.Unlock()
+		return v, nil
+	case protocol.OptionBestEffort:
+		s.Lock()
+		v := s.bestEffort
+		s.Unlock()
+		return v, nil
+	case protocol.OptionQueueFullPolicy:
+		s.Lock()
+		v := s.policy
+		s.Unlock()
+		return v, nil
+	case protocol.OptionRetain:
+		s.Lock()
+		v := s.retain
+		s.Unlock()
+		return v, nil
+	case protocol.OptionRetainTopic:
+		s.Lock()
+		v := s.topicFn
+		s.Unlock()
+		return v, nil
+	case protocol.OptionSubscriptionFunc:
+		s.Lock()
+		v := s.subFn
+		s.Unlock()
+		return v, nil
+	case protocol.OptionRetainAge:
+		s.Lock()
+		v := s.age
+		s.Unlock()
+		return v, nil
+	case protocol.OptionReplayOnConnect:
+		s.Lock()
+		v := s.onConn
+		s.Unlock()
+		return v, nil
+	case protocol.OptionReplayMarker:
+		s.Lock()
+		v := s.marker
+		s.Unlock()
+		return v, nil
+	case protocol.OptionSendWorkers:
+		s.Lock()
+		v := s.workers
+		s.Unlock()
+		return v, nil
+	case protocol.OptionSpoolDir:
+		s.Lock()
+		v := s.spoolDir
+		s.Unlock()
+		return v, nil
+	case protocol.OptionSpoolMaxBytes:
+		s.Lock()
+		v := s.spoolMax
+		s.Unlock()
+		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := 0
+		for _, p := range s.pipes {
+			queued += len(p.sendq)
+		}
+		spooled := 0
+		if s.spool != nil {
+			spooled = s.spool.Len()
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped: atomic.LoadUint64(&s.dropped),
+			protocol.StatQueued:  uint64(queued),
+			protocol.StatSpooled: uint64(spooled),
+		}, nil
+	case protocol.OptionSubscriptions:
+		s.Lock()
+		defer s.Unlock()
+		if s.closed {
+			return nil, protocol.ErrClosed
+		}
+		return s.subscriptions(), nil
+	case protocol.OptionSubscriptionsChanged:
+		return s.changed.Chan(), nil
+	case protocol.OptionPipeStats:
+		s.Lock()
+		stats := make(map[uint32]map[string]uint64, len(s.pipes))
+		for id, p := range s.pipes {
+			stats[id] = map[string]uint64{
+				protocol.StatDropped: atomic.LoadUint64(&p.drops),
+				protocol.StatQueued:  uint64(len(p.sendq)),
+			}
+		}
+		s.Unlock()
+		return stats, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -116,14 +802,35 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		return protocol.ErrClosed
 	}
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		closeq: make(chan struct{}),
-		sendq:  make(chan *protocol.Message, s.sendQLen),
+		p:       pp,
+		s:       s,
+		closeq:  make(chan struct{}),
+		resized: make(chan struct{}),
+		since:   s.seq + 1,
+	}
+	if s.qMaxLen > 0 {
+		p.adapt = protocol.NewAdaptiveQ(s.sendQLen, s.qMinLen, s.qMaxLen)
+		p.sendq = make(chan *protocol.Message, p.adapt.Max())
+	} else {
+		p.sendq = make(chan *protocol.Message, s.sendQLen)
+	}
+	if s.onConn {
+		// The peer has not yet had a chance to subscribe, so it
+		// gets the lot.
+		p.backlog = p.replayed()
 	}
 	s.pipes[pp.ID()] = p
+	s.changed.Notify()
+	s.room.Notify()
 
-	go p.sender()
+	if s.workers > 0 {
+		p.pool = s.pool
+		if len(p.backlog) > 0 {
+			p.kick()
+		}
+	} else {
+		go p.sender()
+	}
 	go p.receiver()
 	return nil
 }
@@ -141,6 +848,28 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 	return nil, protocol.ErrProtoOp
 }
 
+// Debug reports the subscriptions forwarded by the peers, and the
+// messages queued for each pipe, including any replay not yet sent.
+func (s *socket) Debug() protocol.ProtocolState {
+	var st protocol.ProtocolState
+	s.Lock()
+	defer s.Unlock()
+	if len(s.pipes) > 0 {
+		for _, sub := range s.subscriptions() {
+			st.Subscriptions = append(st.Subscriptions, string(sub))
+		}
+	}
+	for id, p := range s.pipes {
+		st.Pipes = append(st.Pipes, protocol.PipeState{
+			ID:     id,
+			Queued: len(p.sendq) + len(p.backlog),
+			Cap:    cap(p.sendq),
+		})
+	}
+	protocol.SortState(&st)
+	return st
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -162,41 +891,168 @@ func (s *socket) Close() error {
 	for _, p := range s.pipes {
 		pipes = append(pipes, p)
 	}
+	for _, h := range s.history {
+		for _, r := range h {
+			r.m.Free()
+		}
+	}
+	s.history = nil
+	pool := s.pool
+	if s.spool != nil {
+		// What is left is kept for next time.
+		s.spool.Close()
+		s.spool = nil
+	}
 	s.Unlock()
+	s.changed.Notify()
+	s.room.Notify()
 
 	// close and remove each and every pipe
 	for _, p := range pipes {
 		p.Close()
 	}
+	if pool != nil {
+		pool.Stop()
+	}
 	return nil
 
 }
 
 func (p *pipe) sender() {
+	for len(p.backlog) > 0 {
+		if !p.sendBacklog() {
+			p.Close()
+			return
+		}
+	}
+	s := p.s
+	s.Lock()
+	sendq, resized := p.sendq, p.resized
+	s.Unlock()
 outer:
 	for {
 		var m *protocol.Message
 		select {
 		case <-p.closeq:
 			break outer
-		case m = <-p.sendq:
+		case <-resized:
+			s.Lock()
+			sendq, resized = p.sendq, p.resized
+			s.Unlock()
+			continue
+		case m = <-sendq:
 		}
-
-		if err := p.p.SendMsg(m); err != nil {
-			m.Free()
+		if !p.send(sendq, m) {
 			break
 		}
 	}
 	p.Close()
 }
 
+// send sends m, taken from sendq, along with what is queued behind it,
+// as a batch, returning false if the pipe failed.
+func (p *pipe) send(sendq chan *protocol.Message, m *protocol.Message) bool {
+	msgs := protocol.Dequeue(sendq, m, protocol.MaxSendBatch)
+	if p.adapt != nil {
+		for range msgs {
+			p.adapt.Drained()
+		}
+	}
+	p.s.room.Notify()
+	return p.p.SendMsgs(msgs) == nil
+}
+
+// sendBacklog sends a batch from the backlog, returning false if the
+// pipe failed.  Only the sender, or the pool, touches the backlog once
+// the pipe has been added.
+func (p *pipe) sendBacklog() bool {
+	n := len(p.backlog)
+	if n > protocol.MaxSendBatch {
+		n = protocol.MaxSendBatch
+	}
+	msgs := p.backlog[:n]
+	p.backlog = p.backlog[n:]
+	if len(p.backlog) == 0 {
+		p.backlog = nil
+	}
+	if err := p.p.SendMsgs(msgs); err != nil {
+		p.freeBacklog()
+		return false
+	}
+	return true
+}
+
+// freeBacklog discards what is left of the backlog.
+func (p *pipe) freeBacklog() {
+	for _, m := range p.backlog {
+		m.Free()
+	}
+	p.backlog = nil
+}
+
+// kick has the pool send what was just queued, if the pipe uses one.
+func (p *pipe) kick() {
+	if p.pool != nil {
+		p.pool.Schedule(p)
+	}
+}
+
+// Work sends a batch for the pool, in place of sender.
+func (p *pipe) Work() bool {
+	if len(p.backlog) > 0 {
+		select {
+		case <-p.closeq:
+			p.freeBacklog()
+			return false
+		default:
+		}
+		if !p.sendBacklog() {
+			p.Close()
+			return false
+		}
+		return true
+	}
+	// A resize kicks the pipe again, so the queue is not waited on.
+	p.s.Lock()
+	sendq := p.sendq
+	p.s.Unlock()
+	var m *protocol.Message
+	select {
+	case <-p.closeq:
+		return false
+	case m = <-sendq:
+	default:
+		return false
+	}
+	if !p.send(sendq, m) {
+		p.Close()
+		return false
+	}
+	return len(sendq) > 0
+}
+
 func (p *pipe) receiver() {
 	for {
 		m := p.p.RecvMsg()
 		if m == nil {
 			break
 		}
+		// Subscribers send only requests for replay, and their
+		// subscriptions.
+		replay := bytes.Equal(m.Body, protocol.ReplayRequest)
+		subs, ok := protocol.DecodeSubscriptions(m.Body)
 		m.Free()
+		if replay {
+			p.replayHistory()
+		}
+		if ok {
+			p.s.Lock()
+			if !p.closed {
+				p.s.setSubs(p, subs, true)
+			}
+			p.s.Unlock()
+			p.s.changed.Notify()
+		}
 	}
 	p.Close()
 }
@@ -209,18 +1065,29 @@ func (p *pipe) Close() error {
 	}
 	p.closed = true
 	delete(p.s.pipes, p.p.ID())
+	p.s.setSubs(p, nil, false)
 	p.s.Unlock()
+	p.s.changed.Notify()
 
 	close(p.closeq)
 	p.p.Close()
 	return nil
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
 		pipes:    make(map[uint32]*pipe),
 		sendQLen: defaultQLen,
+		qMinLen:  1,
+		policy:   protocol.QueueFullDropNewest,
+		history:  make(map[string][]retained),
+		changed:  protocol.NewNotifier(),
+		room:     protocol.NewNotifier(),
 	}
 	return s
 }
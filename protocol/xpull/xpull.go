@@ -17,6 +17,7 @@
 package xpull
 
 import (
+	"encoding/binary"
 	"sync"
 	"time"
 
@@ -36,6 +37,9 @@ type pipe struct {
 	s      *socket
 	closed bool
 	closeq chan struct{}
+	tagFn  protocol.SourceTagFunc
+	tag    []byte // with its length in front, once known
+	ack    bool   // OptionAckDelivery
 }
 
 type socket struct {
@@ -45,7 +49,13 @@ type socket struct {
 	recvQLen   int
 	recvExpire time.Duration
 	recvq      chan *protocol.Message
+	resized    chan struct{} // see protocol.Resize
+	readable   protocol.Notifier
+	shares     protocol.Shares // OptionRecvFair, OptionRecvPipeShare
 	sync.Mutex
+
+	tagFn protocol.SourceTagFunc // OptionSourceTag
+	ack   bool                   // OptionAckDelivery
 }
 
 var (
@@ -68,16 +78,38 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 		tq = time.After(s.recvExpire)
 	}
 	s.Unlock()
-	select {
-	case <-s.closeq:
-		return nil, protocol.ErrClosed
-	case <-tq:
-		return nil, protocol.ErrRecvTimeout
-	case m := <-s.recvq:
-		return m, nil
+	for {
+		s.Lock()
+		recvq, resized := s.recvq, s.resized
+		s.Unlock()
+		select {
+		case <-s.closeq:
+			return nil, protocol.ErrClosed
+		case <-tq:
+			return nil, protocol.ErrRecvTimeout
+		case <-resized:
+		case m := <-recvq:
+			s.readable.Set(len(recvq) > 0)
+			s.shares.Taken(m)
+			return m, nil
+		}
 	}
 }
 
+func (s *socket) RecvMsgs(max int) ([]*protocol.Message, error) {
+	m, err := s.RecvMsg()
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	recvq := s.recvq
+	s.Unlock()
+	msgs := protocol.Dequeue(recvq, m, max)
+	s.readable.Set(len(recvq) > 0)
+	s.shares.Taken(msgs[1:]...)
+	return msgs, nil
+}
+
 func (s *socket) SetOption(name string, value interface{}) error {
 	switch name {
 
@@ -90,33 +122,49 @@ func (s *socket) SetOption(name string, value interface{}) error {
 		}
 		return protocol.ErrBadValue
 
+	case protocol.OptionSourceTag:
+		var fn protocol.SourceTagFunc
+		switch v := value.(type) {
+		case bool:
+			if v {
+				fn = protocol.PipeIDTag
+			}
+		case protocol.SourceTagFunc:
+			fn = v
+		case func(protocol.SocketPipe) []byte:
+			fn = v
+		default:
+			if value != nil {
+				return protocol.ErrBadValue
+			}
+		}
+		s.Lock()
+		s.tagFn = fn
+		s.Unlock()
+		return nil
+
+	case protocol.OptionAckDelivery:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			s.ack = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
 	case protocol.OptionReadQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
 			s.Lock()
 			s.recvQLen = v
-			oldchan := s.recvq
-			s.recvq = newchan
+			protocol.Resize(&s.recvq, &s.resized, v)
 			s.Unlock()
-
-			for {
-				var m *protocol.Message
-				select {
-				case m = <-oldchan:
-				default:
-				}
-				if m == nil {
-					break
-				}
-				select {
-				case newchan <- m:
-				default:
-					m.Free()
-				}
-			}
+			s.shares.SetQLen(v)
 			return nil
 		}
 		return protocol.ErrBadValue
+
+	case protocol.OptionRecvFair, protocol.OptionRecvPipeShare:
+		return s.shares.SetOption(name, value)
 	}
 
 	return protocol.ErrBadOption
@@ -126,6 +174,8 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 	switch option {
 	case protocol.OptionRaw:
 		return true, nil
+	case protocol.OptionRecvReady:
+		return s.readable.Chan(), nil
 	case protocol.OptionRecvDeadline:
 		s.Lock()
 		v := s.recvExpire
@@ -136,6 +186,18 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.recvQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionSourceTag:
+		s.Lock()
+		v := s.tagFn
+		s.Unlock()
+		return v, nil
+	case protocol.OptionAckDelivery:
+		s.Lock()
+		v := s.ack
+		s.Unlock()
+		return v, nil
+	case protocol.OptionRecvFair, protocol.OptionRecvPipeShare:
+		return s.shares.GetOption(option)
 	}
 
 	return nil, protocol.ErrBadOption
@@ -151,8 +213,11 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		p:      pp,
 		s:      s,
 		closeq: make(chan struct{}),
+		tagFn:  s.tagFn,
+		ack:    s.ack,
 	}
 	s.pipes[pp.ID()] = p
+	s.shares.AddPipe()
 
 	go p.receiver()
 	return nil
@@ -206,26 +271,77 @@ func (s *socket) Close() error {
 }
 
 func (p *pipe) receiver() {
-outer:
+	s := p.s
 	for {
 		m := p.p.RecvMsg()
 		if m == nil {
 			break
 		}
-
-		select {
-		case p.s.recvq <- m:
-		case <-p.closeq:
+		if p.ack && !p.setAck(m) {
 			m.Free()
-			break outer
-		case <-p.s.closeq:
+			continue
+		}
+		if p.tagFn != nil {
+			p.addTag(m)
+		}
+		if !s.shares.Wait(p.p.ID(), p.closeq, s.closeq) {
 			m.Free()
-			break outer
+			break
 		}
+
+		if _, ok := protocol.Deliver(s, &s.recvq, &s.resized, m,
+			p.closeq, s.closeq); !ok {
+			break
+		}
+		s.readable.Notify()
 	}
 	p.Close()
 }
 
+// setAck moves the header put on by PUSH with OptionAckDelivery from the
+// body to the header, and arranges for Ack to send back the ID.  It
+// returns false if the message is too short to have one.
+func (p *pipe) setAck(m *protocol.Message) bool {
+	if len(m.Body) < protocol.AckHeaderLen {
+		return false
+	}
+	m.Header = append(m.Header, m.Body[:protocol.AckHeaderLen]...)
+	m.Body = m.Body[protocol.AckHeaderLen:]
+	m.Redelivered = int(binary.BigEndian.Uint32(m.Header[4:]))
+	id := binary.BigEndian.Uint32(m.Header)
+	pp := p.p
+	reply := func(id uint32) error {
+		am := protocol.NewMessage(4)
+		am.Body = am.Body[:4]
+		binary.BigEndian.PutUint32(am.Body, id)
+		err := pp.SendMsg(am)
+		if err != nil {
+			am.Free()
+		}
+		return err
+	}
+	m.SetAck(func() error { return reply(id) })
+	// A refusal is the ID without its high bit.
+	m.SetNack(func() error { return reply(id &^ 0x80000000) })
+	return true
+}
+
+// addTag puts the pipe's tag in front of the message body, reusing the
+// body's buffer if it has room.  See OptionSourceTag.
+func (p *pipe) addTag(m *protocol.Message) {
+	if p.tag == nil {
+		tag := p.tagFn(m.Pipe)
+		if len(tag) > 255 {
+			tag = tag[:255]
+		}
+		p.tag = append([]byte{byte(len(tag))}, tag...)
+	}
+	n := len(m.Body)
+	m.Body = append(m.Body, p.tag...)
+	copy(m.Body[len(p.tag):], m.Body[:n])
+	copy(m.Body, p.tag)
+}
+
 func (p *pipe) Close() error {
 	p.s.Lock()
 	if p.closed {
@@ -235,20 +351,28 @@ func (p *pipe) Close() error {
 	p.closed = true
 	delete(p.s.pipes, p.p.ID())
 	p.s.Unlock()
+	p.s.shares.RemovePipe(p.p.ID())
 
 	close(p.closeq)
 	p.p.Close()
 	return nil
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
 		pipes:    make(map[uint32]*pipe),
 		closeq:   make(chan struct{}),
 		recvq:    make(chan *protocol.Message, defaultQLen),
+		resized:  make(chan struct{}),
+		readable: protocol.NewNotifier(),
 		recvQLen: defaultQLen,
 	}
+	s.shares.SetQLen(defaultQLen)
 	return s
 }
 
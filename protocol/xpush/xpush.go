@@ -16,7 +16,11 @@
 package xpush
 
 import (
+	"encoding/binary"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
@@ -38,29 +42,67 @@ type pipe struct {
 }
 
 type socket struct {
+	dropped    uint64 // messages discarded by the queue full policy
 	closed     bool
 	closeq     chan struct{}
 	sendq      chan *protocol.Message
+	lanes      protocol.Lanes // OptionSendPriorities
+	prios      int
+	resized    chan struct{} // see protocol.Resize
+	writable   protocol.Notifier
 	pipes      map[uint32]*pipe
 	sendExpire time.Duration
 	sendQLen   int
 	bestEffort bool
+	policy     protocol.QueueFullPolicy
 	readyq     []*pipe
+	lb         *protocol.Balancer
 	cv         *sync.Cond
 	sync.Mutex
+
+	hashFn  protocol.HashRouteFunc // OptionHashRoute
+	ring    *protocol.HashRing
+	head    *protocol.Message // taken from sendq, waiting for its pipe
+	headKey []byte
+
+	spool    *protocol.Spool // OptionSpoolDir
+	spoolDir string
+	spoolMax int               // OptionSpoolMaxBytes
+	room     protocol.Notifier // wakes drainSpool
+
+	acking      bool          // OptionAckDelivery
+	ackTimeout  time.Duration // OptionAckTimeout
+	resending   bool          // true once resender is started
+	nextID      uint32
+	pending     map[uint32]*unacked // sent, awaiting acknowledgment
+	redoq       []*unacked          // to be sent again
+	headAck     *unacked            // if head is being sent again
+	redelivered uint64
+	nacked      uint64
+
+	store  protocol.AckStore // OptionAckStore
+	loaded bool              // messages in the store queued to send again
+	epoch  uint64            // store keys are this, plus the message ID
+}
+
+// unacked is a message sent with OptionAckDelivery, kept until the peer
+// acknowledges it.
+type unacked struct {
+	id    uint32
+	key   uint64 // in the store, if there is one
+	count uint32 // times sent before
+	m     *protocol.Message
+	p     *pipe
+	sent  time.Time
 }
 
 var (
-	nilQ    <-chan time.Time
-	closedQ chan time.Time
+	nilQ <-chan time.Time
 )
 
 const defaultQLen = 128
 
-func init() {
-	closedQ = make(chan time.Time)
-	close(closedQ)
-}
+const defaultAckTimeout = time.Minute
 
 // SendMsg implements sending a message.  The message must come with
 // its headers already prepared.  This will be at a minimum the request
@@ -68,33 +110,94 @@ func init() {
 // coming from a paired REP socket.
 func (s *socket) SendMsg(m *protocol.Message) error {
 	s.Lock()
-	bestEffort := s.bestEffort
+	if s.closed {
+		s.Unlock()
+		return protocol.ErrClosed
+	}
+	if s.spool != nil {
+		defer s.Unlock()
+		return s.spoolMsg(m)
+	}
+	policy := s.policy
 	tq := nilQ
-	if bestEffort {
-		tq = closedQ
-	} else if s.sendExpire > 0 {
-		tq = time.After(s.sendExpire)
+	if policy == protocol.QueueFullBlock {
+		if s.bestEffort {
+			policy = protocol.QueueFullDropNewest
+		} else if s.sendExpire > 0 {
+			tq = time.After(s.sendExpire)
+		}
 	}
+	q := s.lanes.Queue(m, &s.sendq)
 	s.Unlock()
 
-	select {
-	case s.sendq <- m:
-	case <-s.closeq:
-		return protocol.ErrClosed
-	case <-tq:
-		if bestEffort {
-			m.Free()
-			return nil
-		}
-		return protocol.ErrSendTimeout
+	n, err := protocol.EnqueueResizable(s, q, &s.resized, m, policy,
+		s.closeq, tq)
+	if n > 0 {
+		atomic.AddUint64(&s.dropped, uint64(n))
 	}
-
 	s.Lock()
+	s.writable.Set(len(s.sendq) < cap(s.sendq))
+	if err != nil {
+		s.Unlock()
+		return err
+	}
 	s.cv.Signal()
 	s.Unlock()
 	return nil
 }
 
+// spoolMsg queues the message if there is a pipe for it and room in the
+// queue, and otherwise adds it to the spool.  The lock must be held.
+func (s *socket) spoolMsg(m *protocol.Message) error {
+	if s.spool.Len() == 0 && len(s.pipes) > 0 {
+		select {
+		case *s.lanes.Queue(m, &s.sendq) <- m:
+			s.writable.Set(len(s.sendq) < cap(s.sendq))
+			s.cv.Signal()
+			return nil
+		default:
+		}
+	}
+	ok, err := s.spool.Append(m)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		atomic.AddUint64(&s.dropped, 1)
+	}
+	m.Free()
+	return nil
+}
+
+// drainSpool moves messages from the spool to the queue as room is made,
+// while there are pipes to send them.
+func (s *socket) drainSpool(sp *protocol.Spool) {
+	for {
+		select {
+		case <-s.closeq:
+			return
+		case <-s.room:
+		}
+		s.Lock()
+		if s.spool != sp {
+			// Replaced, so the new one may want this.
+			s.Unlock()
+			s.room.Notify()
+			return
+		}
+		for len(s.pipes) > 0 && len(s.sendq) < cap(s.sendq) {
+			m, err := sp.Peek()
+			if m == nil || err != nil {
+				break
+			}
+			s.sendq <- m
+			_ = sp.Pop()
+			s.cv.Signal()
+		}
+		s.Unlock()
+	}
+}
+
 func (s *socket) sender() {
 	s.Lock()
 	defer s.Unlock()
@@ -102,17 +205,223 @@ func (s *socket) sender() {
 		if s.closed {
 			return
 		}
-		if len(s.readyq) == 0 || len(s.sendq) == 0 {
+		if len(s.readyq) == 0 ||
+			(s.head == nil && s.queued() == 0 && len(s.redoq) == 0) {
 			s.cv.Wait()
 			continue
 		}
-		m := <-s.sendq
-		p := s.readyq[0]
-		s.readyq = s.readyq[1:]
+		if s.head == nil && len(s.redoq) > 0 {
+			u := s.redoq[0]
+			s.redoq = s.redoq[1:]
+			s.head, s.headAck = u.m.Dup(), u
+			if s.hashFn != nil {
+				s.headKey = s.hashFn(s.head)
+			}
+		}
+		if s.head == nil && s.hashFn != nil {
+			// We must know the key to choose, so the message
+			// waits here for its pipe.
+			s.head = s.next()
+			s.writable.Notify()
+			s.room.Notify()
+			s.headKey = s.hashFn(s.head)
+		}
+		var i int
+		if s.headKey != nil {
+			i = s.readyIndex(s.ring.Lookup(s.headKey))
+		} else {
+			i = s.lb.Choose(len(s.readyq), s.readyID, nil)
+		}
+		if i < 0 {
+			// Waiting for a busy pipe.
+			s.cv.Wait()
+			continue
+		}
+		m, u := s.head, s.headAck
+		if m != nil {
+			s.head, s.headKey, s.headAck = nil, nil, nil
+		} else {
+			m = s.next()
+			s.writable.Notify()
+			s.room.Notify()
+		}
+		p := s.readyq[i]
+		if s.acking {
+			s.track(p, m, u)
+		}
+		s.readyq = append(s.readyq[:i], s.readyq[i+1:]...)
 		go p.send(m)
 	}
 }
 
+// queued returns the number of messages waiting on the send queue and
+// its lanes.  The lock must be held.
+func (s *socket) queued() int {
+	return len(s.sendq) + s.lanes.Len()
+}
+
+// next takes the message to send next, of the highest priority waiting.
+// The lock must be held, and there must be one.
+func (s *socket) next() *protocol.Message {
+	if m := s.lanes.Take(); m != nil {
+		return m
+	}
+	return <-s.sendq
+}
+
+// track keeps a copy of a message being sent with OptionAckDelivery, and
+// puts the header in front.  If the message is being sent again, u is
+// its record.  The lock must be held.
+func (s *socket) track(p *pipe, m *protocol.Message, u *unacked) {
+	if u == nil {
+		s.nextID++
+		dm := m.Dup()
+		dm.Uncharge()
+		dm.Flatten()
+		u = &unacked{id: s.nextID | 0x80000000, m: dm}
+		u.key = s.epoch | uint64(u.id)
+		if s.store != nil {
+			// Should this fail, the message is still kept here,
+			// as it would be with no store.
+			_ = s.store.Put(u.key, dm.Body)
+		}
+	} else {
+		u.count++
+	}
+	u.p = p
+	u.sent = time.Now()
+	s.pending[u.id] = u
+	var hdr [protocol.AckHeaderLen]byte
+	binary.BigEndian.PutUint32(hdr[:], u.id)
+	binary.BigEndian.PutUint32(hdr[4:], u.count)
+	m.Header = append(hdr[:], m.Header...)
+}
+
+// redo queues the messages to be sent again, oldest first.  The lock
+// must be held.
+func (s *socket) redo(us []*unacked) {
+	if len(us) == 0 {
+		return
+	}
+	for _, u := range us {
+		delete(s.pending, u.id)
+	}
+	s.redoq = append(s.redoq, us...)
+	sort.Slice(s.redoq, func(i, j int) bool { return s.redoq[i].id < s.redoq[j].id })
+	atomic.AddUint64(&s.redelivered, uint64(len(us)))
+	s.cv.Broadcast()
+}
+
+// acked discards the message with the ID, as the peer has it, or has
+// refused it.  It returns false if there was none.
+func (s *socket) acked(id uint32) bool {
+	s.Lock()
+	defer s.Unlock()
+	if u, ok := s.pending[id]; ok {
+		delete(s.pending, id)
+		s.forget(u)
+		return true
+	}
+	// It may have been acknowledged just too late.
+	for i, u := range s.redoq {
+		if u.id == id {
+			s.redoq = append(s.redoq[:i], s.redoq[i+1:]...)
+			s.forget(u)
+			return true
+		}
+	}
+	return false
+}
+
+// forget discards a message that needs no more sending.  The lock must
+// be held.
+func (s *socket) forget(u *unacked) {
+	s.drop(u, true)
+}
+
+// drop discards a message, removing it from the store too if forget is
+// true.  The lock must be held.
+func (s *socket) drop(u *unacked, forget bool) {
+	u.m.Free()
+	if forget && s.store != nil {
+		_ = s.store.Delete(u.key)
+	}
+}
+
+// load queues the messages left in the store by an earlier socket to be
+// sent again, once both it and OptionAckDelivery are set.  The lock must
+// be held.
+func (s *socket) load() {
+	if !s.acking || s.store == nil || s.loaded {
+		return
+	}
+	s.loaded = true
+	var us []*unacked
+	_ = s.store.Range(func(key uint64, body []byte) error {
+		s.nextID++
+		m := protocol.NewMessage(len(body))
+		m.Body = append(m.Body, body...)
+		us = append(us, &unacked{id: s.nextID | 0x80000000, key: key, m: m})
+		return nil
+	})
+	s.redo(us)
+}
+
+// resender sends again the messages not acknowledged in time.
+func (s *socket) resender() {
+	for {
+		s.Lock()
+		tick := s.ackTimeout / 4
+		s.Unlock()
+		if tick < time.Millisecond*10 {
+			tick = time.Millisecond * 10
+		}
+		select {
+		case <-s.closeq:
+			return
+		case <-time.After(tick):
+		}
+		s.Lock()
+		var late []*unacked
+		for _, u := range s.pending {
+			if time.Since(u.sent) >= s.ackTimeout {
+				late = append(late, u)
+			}
+		}
+		s.redo(late)
+		s.Unlock()
+	}
+}
+
+// dropAcks discards the messages kept for OptionAckDelivery, removing
+// them from the store too if forget is true.  The lock must be held.
+func (s *socket) dropAcks(forget bool) {
+	for id, u := range s.pending {
+		delete(s.pending, id)
+		s.drop(u, forget)
+	}
+	for _, u := range s.redoq {
+		s.drop(u, forget)
+	}
+	s.redoq = nil
+	s.headAck = nil
+}
+
+func (s *socket) readyID(i int) uint32 {
+	return s.readyq[i].p.ID()
+}
+
+// readyIndex returns the index in readyq of the pipe with the ID, or -1
+// if it is busy.
+func (s *socket) readyIndex(id uint32) int {
+	for i, p := range s.readyq {
+		if p.p.ID() == id {
+			return i
+		}
+	}
+	return -1
+}
+
 func (s *socket) RecvMsg() (*protocol.Message, error) {
 	return nil, protocol.ErrProtoOp
 }
@@ -123,7 +432,14 @@ func (p *pipe) receiver() {
 		if m == nil {
 			break
 		}
-		// We really never expected to receive this.
+		// Only acknowledgments, and refusals, are expected;
+		// anything else is discarded.
+		if len(m.Body) == 4 {
+			id := binary.BigEndian.Uint32(m.Body)
+			if p.s.acked(id|0x80000000) && id&0x80000000 == 0 {
+				atomic.AddUint64(&p.s.nacked, 1)
+			}
+		}
 		m.Free()
 	}
 	p.Close()
@@ -161,6 +477,16 @@ func (p *pipe) Close() error {
 		}
 	}
 	delete(s.pipes, p.p.ID())
+	var lost []*unacked
+	for _, u := range s.pending {
+		if u.p == p {
+			lost = append(lost, u)
+		}
+	}
+	s.redo(lost)
+	s.lb.RemovePipe(p.p)
+	s.ring.RemovePipe(p.p)
+	s.cv.Broadcast()
 	s.Unlock()
 	close(p.closeq)
 	p.p.Close()
@@ -188,33 +514,144 @@ func (s *socket) SetOption(name string, value interface{}) error {
 		}
 		return protocol.ErrBadValue
 
-	case protocol.OptionWriteQLen:
-		if v, ok := value.(int); ok && v >= 0 {
+	case protocol.OptionQueueFullPolicy:
+		v, err := protocol.ParseQueueFullPolicy(value)
+		if err == nil {
+			s.Lock()
+			s.policy = v
+			s.Unlock()
+		}
+		return err
+
+	case protocol.OptionLoadBalance:
+		s.Lock()
+		defer s.Unlock()
+		return s.lb.SetStrategy(value)
 
-			newchan := make(chan *protocol.Message, v)
+	case protocol.OptionHashRoute:
+		if v, ok := value.(protocol.HashRouteFunc); ok || value == nil {
 			s.Lock()
-			s.sendQLen = v
-			oldchan := s.sendq
-			s.sendq = newchan
+			s.hashFn = v
+			s.Unlock()
+			return nil
+		}
+		if v, ok := value.(func(*protocol.Message) []byte); ok {
+			s.Lock()
+			s.hashFn = v
 			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
 
-			for {
-				var m *protocol.Message
-				select {
-				case m = <-oldchan:
-				default:
-				}
-				if m == nil {
-					break
+	case protocol.OptionAckDelivery:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			defer s.Unlock()
+			if s.closed {
+				return protocol.ErrClosed
+			}
+			s.acking = v
+			if !v {
+				s.dropAcks(true)
+				s.loaded = false
+				return nil
+			}
+			if !s.resending {
+				s.resending = true
+				go s.resender()
+			}
+			s.load()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionAckStore:
+		if v, ok := value.(protocol.AckStore); ok || value == nil {
+			s.Lock()
+			defer s.Unlock()
+			s.store, s.loaded = v, false
+			s.load()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionAckTimeout:
+		if v, ok := value.(time.Duration); ok && v > 0 {
+			s.Lock()
+			s.ackTimeout = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionSpoolDir:
+		if v, ok := value.(string); ok {
+			var sp *protocol.Spool
+			if v != "" {
+				var err error
+				if sp, err = protocol.OpenSpool(v); err != nil {
+					return err
 				}
-				select {
-				case newchan <- m:
-				default:
-					m.Free()
+			}
+			s.Lock()
+			if s.closed {
+				s.Unlock()
+				if sp != nil {
+					sp.Close()
 				}
+				return protocol.ErrClosed
+			}
+			old := s.spool
+			s.spool, s.spoolDir = sp, v
+			if sp != nil {
+				sp.SetLimit(int64(s.spoolMax))
+				go s.drainSpool(sp)
+				s.room.Notify()
+			}
+			if old != nil {
+				old.Close()
+			}
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionSpoolMaxBytes:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.Lock()
+			s.spoolMax = v
+			if s.spool != nil {
+				s.spool.SetLimit(int64(v))
 			}
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionWriteQLen:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.Lock()
+			s.sendQLen = v
+			n := s.lanes.Resize(v)
+			n += protocol.Resize(&s.sendq, &s.resized, v)
+			s.writable.Set(len(s.sendq) < cap(s.sendq))
+			s.room.Notify()
+			s.cv.Signal()
+			s.Unlock()
+			atomic.AddUint64(&s.dropped, uint64(n))
+			return nil
 		}
 		return protocol.ErrBadValue
+
+	case protocol.OptionSendPriorities:
+		v, err := protocol.ParseSendPriorities(value)
+		if err == nil {
+			s.Lock()
+			s.prios = v
+			s.lanes.SetPriorities(v, s.sendQLen, &s.resized)
+			s.Unlock()
+		}
+		return err
 	}
 	return protocol.ErrBadOption
 }
@@ -223,6 +660,8 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 	switch option {
 	case protocol.OptionRaw:
 		return true, nil
+	case protocol.OptionSendReady:
+		return s.writable.Chan(), nil
 	case protocol.OptionSendDeadline:
 		s.Lock()
 		v := s.sendExpire
@@ -238,6 +677,70 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.sendQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionSendPriorities:
+		s.Lock()
+		v := s.prios
+		s.Unlock()
+		return v, nil
+	case protocol.OptionQueueFullPolicy:
+		s.Lock()
+		v := s.policy
+		s.Unlock()
+		return v, nil
+	case protocol.OptionLoadBalance:
+		s.Lock()
+		v := s.lb.Strategy()
+		s.Unlock()
+		return v, nil
+	case protocol.OptionHashRoute:
+		s.Lock()
+		v := s.hashFn
+		s.Unlock()
+		return v, nil
+	case protocol.OptionAckDelivery:
+		s.Lock()
+		v := s.acking
+		s.Unlock()
+		return v, nil
+	case protocol.OptionAckTimeout:
+		s.Lock()
+		v := s.ackTimeout
+		s.Unlock()
+		return v, nil
+	case protocol.OptionAckStore:
+		s.Lock()
+		v := s.store
+		s.Unlock()
+		return v, nil
+	case protocol.OptionSpoolDir:
+		s.Lock()
+		v := s.spoolDir
+		s.Unlock()
+		return v, nil
+	case protocol.OptionSpoolMaxBytes:
+		s.Lock()
+		v := s.spoolMax
+		s.Unlock()
+		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := s.queued() + len(s.redoq)
+		if s.head != nil {
+			queued++
+		}
+		spooled := 0
+		if s.spool != nil {
+			spooled = s.spool.Len()
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped: atomic.LoadUint64(&s.dropped),
+			protocol.StatQueued:  uint64(queued),
+			protocol.StatSpooled: uint64(spooled),
+
+			protocol.StatRedelivered: atomic.LoadUint64(&s.redelivered),
+			protocol.StatNacked:      atomic.LoadUint64(&s.nacked),
+		}, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -255,6 +758,12 @@ func (s *socket) Close() error {
 	for _, p := range s.pipes {
 		pipes = append(pipes, p)
 	}
+	if s.spool != nil {
+		// What is left is kept for next time.
+		s.spool.Close()
+		s.spool = nil
+	}
+	s.dropAcks(false)
 
 	s.Unlock()
 	close(s.closeq)
@@ -267,6 +776,9 @@ func (s *socket) Close() error {
 }
 
 func (s *socket) AddPipe(pp protocol.Pipe) error {
+	weight := protocol.PipeWeight(pp)
+	priority := protocol.PipePriority(pp)
+	name := protocol.PipeName(pp)
 	s.Lock()
 	defer s.Unlock()
 	if s.closed {
@@ -278,10 +790,13 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		closeq: make(chan struct{}),
 	}
 	s.pipes[pp.ID()] = p
+	s.lb.AddPipe(pp, weight, priority)
+	s.ring.AddPipe(pp, name)
 	go p.receiver()
 
 	s.readyq = append(s.readyq, p)
 	s.cv.Broadcast()
+	s.room.Notify()
 	return nil
 }
 
@@ -298,6 +813,50 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 	return nil, protocol.ErrProtoOp
 }
 
+// Debug reports the messages awaiting acknowledgment, with
+// OptionAckDelivery, those queued to be sent, and which pipes are free
+// to take one.
+func (s *socket) Debug() protocol.ProtocolState {
+	var st protocol.ProtocolState
+	s.Lock()
+	defer s.Unlock()
+	for id, u := range s.pending {
+		r := protocol.RequestState{
+			ID:       id,
+			Sent:     u.sent,
+			Attempts: int(u.count) + 1,
+		}
+		if u.p != nil {
+			r.Pipe = u.p.p.ID()
+		}
+		st.Pending = append(st.Pending, r)
+	}
+	for _, u := range s.redoq {
+		st.Pending = append(st.Pending, protocol.RequestState{
+			ID:       u.id,
+			Sent:     u.sent,
+			Attempts: int(u.count) + 1,
+		})
+	}
+	st.SendQueued = s.queued()
+	if s.head != nil {
+		st.SendQueued++
+	}
+	st.SendCap = cap(s.sendq)
+	ready := make(map[*pipe]bool, len(s.readyq))
+	for _, p := range s.readyq {
+		ready[p] = true
+	}
+	for id, p := range s.pipes {
+		st.Pipes = append(st.Pipes, protocol.PipeState{
+			ID:    id,
+			Ready: ready[p],
+		})
+	}
+	protocol.SortState(&st)
+	return st
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -307,15 +866,31 @@ func (*socket) Info() protocol.Info {
 	}
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
 		pipes:    make(map[uint32]*pipe),
 		closeq:   make(chan struct{}),
 		sendq:    make(chan *protocol.Message, defaultQLen),
+		resized:  make(chan struct{}),
+		writable: protocol.NewNotifier(),
+		room:     protocol.NewNotifier(),
 		sendQLen: defaultQLen,
+		prios:    1,
+		lb:       protocol.NewBalancer(),
+		ring:     protocol.NewHashRing(),
+		pending:  make(map[uint32]*unacked),
+		nextID:   uint32(time.Now().UnixNano()), // quasi-random
+		epoch:    uint64(rand.Uint32()) << 32,
+
+		ackTimeout: defaultAckTimeout,
 	}
 	s.cv = sync.NewCond(s)
+	s.writable.Notify()
 	go s.sender()
 	return s
 }
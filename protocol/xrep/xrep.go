@@ -19,6 +19,7 @@ package xrep
 import (
 	"encoding/binary"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
@@ -33,17 +34,20 @@ const (
 )
 
 type pipe struct {
-	p      protocol.Pipe
-	s      *socket
-	closed bool
-	closeq chan struct{}
-	sendq  chan *protocol.Message
+	p       protocol.Pipe
+	s       *socket
+	closed  bool
+	closeq  chan struct{}
+	sendq   chan *protocol.Message
+	resized chan struct{} // see protocol.Resize
 }
 
 type socket struct {
+	dropped    uint64 // must be first, for atomic alignment
 	closed     bool
 	closeq     chan struct{}
 	recvq      chan *protocol.Message
+	resized    chan struct{} // see protocol.Resize
 	pipes      map[uint32]*pipe
 	recvExpire time.Duration
 	sendExpire time.Duration
@@ -51,19 +55,21 @@ type socket struct {
 	recvQLen   int
 	bestEffort bool
 	ttl        int
+	noRoute    protocol.NoRoute
+	dead       protocol.DeadLetterFunc
+	logger     protocol.Logger
+	shares     protocol.Shares // OptionRecvFair, OptionRecvPipeShare
 	sync.Mutex
 }
 
 var (
-	nilQ    <-chan time.Time
-	closedQ chan time.Time
+	nilQ <-chan time.Time
 )
 
 const defaultQLen = 128
 
 func init() {
-	closedQ := make(chan time.Time)
-	close(closedQ)
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
 }
 
 // SendMessage implements sending a message.  The message must already
@@ -84,33 +90,37 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 	p, ok := s.pipes[id]
 	if !ok {
 		s.Unlock()
-		m.Free()
-		return nil
+		m.Header = hdr
+		return s.noRouteFor(m, false)
 	}
-	bestEffort := s.bestEffort
+	policy := protocol.QueueFullBlock
 	tq := nilQ
-	if bestEffort {
-		tq = closedQ
+	if s.bestEffort {
+		// Never wait; with no room, the reply is dropped.
+		policy = protocol.QueueFullDropNewest
 	} else if s.sendExpire > 0 {
 		tq = time.After(s.sendExpire)
 	}
 	s.Unlock()
 
-	select {
-	case p.sendq <- m:
+	n, err := protocol.EnqueueResizable(s, &p.sendq, &p.resized, m,
+		policy, p.closeq, tq)
+	atomic.AddUint64(&s.dropped, uint64(n))
+	switch err {
+	case nil:
 		return nil
-	case <-s.closeq:
+	case protocol.ErrSendTimeout:
 		// restore the header
 		m.Header = hdr
+		return err
+	}
+	// The pipe is closed, perhaps along with the socket.
+	m.Header = hdr
+	select {
+	case <-s.closeq:
 		return protocol.ErrClosed
-	case <-tq:
-		if bestEffort {
-			m.Free()
-			return nil
-		}
-		// restore the header
-		m.Header = hdr
-		return protocol.ErrSendTimeout
+	default:
+		return s.noRouteFor(m, false)
 	}
 }
 
@@ -121,13 +131,20 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 		tq = time.After(s.recvExpire)
 	}
 	s.Unlock()
-	select {
-	case <-s.closeq:
-		return nil, protocol.ErrClosed
-	case <-tq:
-		return nil, protocol.ErrRecvTimeout
-	case m := <-s.recvq:
-		return m, nil
+	for {
+		s.Lock()
+		recvq, resized := s.recvq, s.resized
+		s.Unlock()
+		select {
+		case <-s.closeq:
+			return nil, protocol.ErrClosed
+		case <-tq:
+			return nil, protocol.ErrRecvTimeout
+		case <-resized:
+		case m := <-recvq:
+			s.shares.Taken(m)
+			return m, nil
+		}
 	}
 }
 
@@ -173,15 +190,15 @@ outer:
 			m.Body = m.Body[4:]
 		}
 
-		select {
-		case s.recvq <- m:
-			continue
-		case <-s.closeq:
-			m.Free()
-			break outer
-		case <-p.closeq:
+		if !s.shares.Wait(p.p.ID(), p.closeq, s.closeq) {
 			m.Free()
-			break outer
+			break
+		}
+		n, ok := protocol.Deliver(s, &s.recvq, &s.resized, m,
+			p.closeq, s.closeq)
+		atomic.AddUint64(&s.dropped, uint64(n))
+		if !ok {
+			break
 		}
 	}
 	go p.Close()
@@ -190,11 +207,20 @@ outer:
 // This is a puller, and doesn't permit for priorities.  We might want
 // to refactor this to use a push based scheme later.
 func (p *pipe) sender() {
+	s := p.s
+	s.Lock()
+	sendq, resized := p.sendq, p.resized
+	s.Unlock()
 outer:
 	for {
 		var m *protocol.Message
 		select {
-		case m = <-p.sendq:
+		case m = <-sendq:
+		case <-resized:
+			s.Lock()
+			sendq, resized = p.sendq, p.resized
+			s.Unlock()
+			continue
 		case <-p.closeq:
 			break outer
 		}
@@ -219,8 +245,46 @@ func (p *pipe) Close() error {
 	p.closed = true
 	delete(s.pipes, p.p.ID())
 	s.Unlock()
+	s.shares.RemovePipe(p.p.ID())
 	close(p.closeq)
 	p.p.Close()
+
+	// Replies still queued can no longer be delivered.
+	for {
+		select {
+		case m := <-p.sendq:
+			id := make([]byte, 4, 4+len(m.Header))
+			binary.BigEndian.PutUint32(id, p.p.ID())
+			m.Header = append(id, m.Header...)
+			_ = s.noRouteFor(m, true)
+		default:
+			return nil
+		}
+	}
+}
+
+// noRouteFor disposes of a reply whose requester has gone away, as
+// OptionNoRoute says.  The queued flag is set if SendMsg has already
+// returned, so the error can no longer be reported.
+func (s *socket) noRouteFor(m *protocol.Message, queued bool) error {
+	s.Lock()
+	policy := s.noRoute
+	dead := s.dead
+	logger := s.logger
+	s.Unlock()
+
+	switch {
+	case policy == protocol.NoRouteError && !queued:
+		return protocol.ErrNoRoute
+	case policy == protocol.NoRouteDeadLetter && dead != nil:
+		dead(m)
+		return nil
+	}
+	m.Free()
+	atomic.AddUint64(&s.dropped, 1)
+	if logger != nil {
+		logger.Printf("mangos: %s dropped reply with no route", SelfName)
+	}
 	return nil
 }
 
@@ -265,20 +329,65 @@ func (s *socket) SetOption(name string, value interface{}) error {
 	case protocol.OptionWriteQLen:
 		if v, ok := value.(int); ok && v >= 0 {
 			s.Lock()
-			// This does not impact pipes already connected.
 			s.sendQLen = v
+			n := 0
+			for _, p := range s.pipes {
+				n += protocol.Resize(&p.sendq, &p.resized, v)
+			}
 			s.Unlock()
+			atomic.AddUint64(&s.dropped, uint64(n))
+			return nil
 		}
 		return protocol.ErrBadValue
 
 	case protocol.OptionReadQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
 			s.Lock()
 			s.recvQLen = v
-			s.recvq = newchan
+			n := protocol.Resize(&s.recvq, &s.resized, v)
+			s.Unlock()
+			s.shares.SetQLen(v)
+			atomic.AddUint64(&s.dropped, uint64(n))
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionRecvFair, protocol.OptionRecvPipeShare:
+		return s.shares.SetOption(name, value)
+
+	case protocol.OptionNoRoute:
+		if v, ok := value.(protocol.NoRoute); ok &&
+			v >= protocol.NoRouteDrop && v <= protocol.NoRouteError {
+			s.Lock()
+			s.noRoute = v
 			s.Unlock()
+			return nil
 		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionDeadLetter:
+		if v, ok := value.(protocol.DeadLetterFunc); ok || value == nil {
+			s.Lock()
+			s.dead = v
+			s.Unlock()
+			return nil
+		}
+		if v, ok := value.(func(*protocol.Message)); ok {
+			s.Lock()
+			s.dead = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionLogger:
+		if v, ok := value.(protocol.Logger); ok || value == nil {
+			s.Lock()
+			s.logger = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
 		// We don't support these
 		// case OptionLinger:
 	}
@@ -320,6 +429,29 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.recvQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionNoRoute:
+		s.Lock()
+		v := s.noRoute
+		s.Unlock()
+		return v, nil
+	case protocol.OptionDeadLetter:
+		s.Lock()
+		v := s.dead
+		s.Unlock()
+		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := 0
+		for _, p := range s.pipes {
+			queued += len(p.sendq)
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped: atomic.LoadUint64(&s.dropped),
+			protocol.StatQueued:  uint64(queued),
+		}, nil
+	case protocol.OptionRecvFair, protocol.OptionRecvPipeShare:
+		return s.shares.GetOption(option)
 	}
 
 	return nil, protocol.ErrBadOption
@@ -355,12 +487,14 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		return protocol.ErrClosed
 	}
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		closeq: make(chan struct{}),
-		sendq:  make(chan *protocol.Message, s.sendQLen),
+		p:       pp,
+		s:       s,
+		closeq:  make(chan struct{}),
+		sendq:   make(chan *protocol.Message, s.sendQLen),
+		resized: make(chan struct{}),
 	}
 	s.pipes[pp.ID()] = p
+	s.shares.AddPipe()
 
 	go p.sender()
 	go p.receiver()
@@ -395,10 +529,12 @@ func NewProtocol() protocol.Protocol {
 		pipes:    make(map[uint32]*pipe),
 		closeq:   make(chan struct{}),
 		recvq:    make(chan *protocol.Message, defaultQLen),
+		resized:  make(chan struct{}),
 		sendQLen: defaultQLen,
 		recvQLen: defaultQLen,
 		ttl:      8,
 	}
+	s.shares.SetQLen(defaultQLen)
 	return s
 }
 
@@ -18,6 +18,7 @@ package xreq
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
@@ -39,29 +40,30 @@ type pipe struct {
 }
 
 type socket struct {
-	closed     bool
-	closeq     chan struct{}
-	recvq      chan *protocol.Message
-	sendq      chan *protocol.Message
-	pipes      map[uint32]*pipe
-	recvExpire time.Duration
-	sendExpire time.Duration
-	sendQLen   int
-	recvQLen   int
-	bestEffort bool
+	dropped     uint64 // must be first, for atomic alignment
+	closed      bool
+	closeq      chan struct{}
+	recvq       chan *protocol.Message
+	resized     chan struct{} // see protocol.Resize
+	sendq       chan *protocol.Message
+	sendResized chan struct{} // see protocol.Resize
+	pipes       map[uint32]*pipe
+	recvExpire  time.Duration
+	sendExpire  time.Duration
+	sendQLen    int
+	recvQLen    int
+	bestEffort  bool
 	sync.Mutex
 }
 
 var (
-	nilQ    <-chan time.Time
-	closedQ chan time.Time
+	nilQ <-chan time.Time
 )
 
 const defaultQLen = 128
 
 func init() {
-	closedQ = make(chan time.Time)
-	close(closedQ)
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
 }
 
 // SendMsg implements sending a message.  The message must come with
@@ -70,27 +72,20 @@ func init() {
 // coming from a paired REP socket.
 func (s *socket) SendMsg(m *protocol.Message) error {
 	s.Lock()
-	bestEffort := s.bestEffort
+	policy := protocol.QueueFullBlock
 	tq := nilQ
-	if bestEffort {
-		tq = closedQ
+	if s.bestEffort {
+		// Never wait; with no room, the request is dropped.
+		policy = protocol.QueueFullDropNewest
 	} else if s.sendExpire > 0 {
 		tq = time.After(s.sendExpire)
 	}
 	s.Unlock()
 
-	select {
-	case s.sendq <- m:
-		return nil
-	case <-s.closeq:
-		return protocol.ErrClosed
-	case <-tq:
-		if bestEffort {
-			m.Free()
-			return nil
-		}
-		return protocol.ErrSendTimeout
-	}
+	n, err := protocol.EnqueueResizable(s, &s.sendq, &s.sendResized, m,
+		policy, s.closeq, tq)
+	atomic.AddUint64(&s.dropped, uint64(n))
+	return err
 }
 
 func (s *socket) RecvMsg() (*protocol.Message, error) {
@@ -100,19 +95,24 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 		tq = time.After(s.recvExpire)
 	}
 	s.Unlock()
-	select {
-	case <-s.closeq:
-		return nil, protocol.ErrClosed
-	case <-tq:
-		return nil, protocol.ErrRecvTimeout
-	case m := <-s.recvq:
-		return m, nil
+	for {
+		s.Lock()
+		recvq, resized := s.recvq, s.resized
+		s.Unlock()
+		select {
+		case <-s.closeq:
+			return nil, protocol.ErrClosed
+		case <-tq:
+			return nil, protocol.ErrRecvTimeout
+		case <-resized:
+		case m := <-recvq:
+			return m, nil
+		}
 	}
 }
 
 func (p *pipe) receiver() {
 	s := p.s
-outer:
 	for {
 		m := p.p.RecvMsg()
 		if m == nil {
@@ -127,15 +127,11 @@ outer:
 		m.Header = m.Body[:4]
 		m.Body = m.Body[4:]
 
-		select {
-		case s.recvq <- m:
-			continue
-		case <-s.closeq:
-			m.Free()
-			break outer
-		case <-p.closeq:
-			m.Free()
-			break outer
+		n, ok := protocol.Deliver(s, &s.recvq, &s.resized, m,
+			p.closeq, s.closeq)
+		atomic.AddUint64(&s.dropped, uint64(n))
+		if !ok {
+			break
 		}
 	}
 	p.Close()
@@ -145,11 +141,19 @@ outer:
 // to refactor this to use a push based scheme later.
 func (p *pipe) sender() {
 	s := p.s
+	s.Lock()
+	sendq, resized := s.sendq, s.sendResized
+	s.Unlock()
 outer:
 	for {
 		var m *protocol.Message
 		select {
-		case m = <-s.sendq:
+		case m = <-sendq:
+		case <-resized:
+			s.Lock()
+			sendq, resized = s.sendq, s.sendResized
+			s.Unlock()
+			continue
 		case <-p.closeq:
 			break outer
 		case <-s.closeq:
@@ -209,23 +213,25 @@ func (s *socket) SetOption(name string, value interface{}) error {
 
 	case protocol.OptionWriteQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-
-			newchan := make(chan *protocol.Message, v)
 			s.Lock()
 			s.sendQLen = v
-			s.sendq = newchan
+			n := protocol.Resize(&s.sendq, &s.sendResized, v)
 			s.Unlock()
+			atomic.AddUint64(&s.dropped, uint64(n))
+			return nil
 		}
 		return protocol.ErrBadValue
 
 	case protocol.OptionReadQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
 			s.Lock()
 			s.recvQLen = v
-			s.recvq = newchan
+			n := protocol.Resize(&s.recvq, &s.resized, v)
 			s.Unlock()
+			atomic.AddUint64(&s.dropped, uint64(n))
+			return nil
 		}
+		return protocol.ErrBadValue
 		// We don't support these
 		// case OptionLinger:
 	}
@@ -262,6 +268,14 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.recvQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := len(s.sendq)
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped: atomic.LoadUint64(&s.dropped),
+			protocol.StatQueued:  uint64(queued),
+		}, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -333,12 +347,14 @@ func (*socket) Info() protocol.Info {
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
-		pipes:    make(map[uint32]*pipe),
-		closeq:   make(chan struct{}),
-		recvq:    make(chan *protocol.Message, defaultQLen),
-		sendq:    make(chan *protocol.Message, defaultQLen),
-		sendQLen: defaultQLen,
-		recvQLen: defaultQLen,
+		pipes:       make(map[uint32]*pipe),
+		closeq:      make(chan struct{}),
+		recvq:       make(chan *protocol.Message, defaultQLen),
+		resized:     make(chan struct{}),
+		sendResized: make(chan struct{}),
+		sendq:       make(chan *protocol.Message, defaultQLen),
+		sendQLen:    defaultQLen,
+		recvQLen:    defaultQLen,
 	}
 	return s
 }
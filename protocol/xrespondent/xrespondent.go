@@ -19,6 +19,7 @@ package xrespondent
 import (
 	"encoding/binary"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
@@ -33,17 +34,20 @@ const (
 )
 
 type pipe struct {
-	p      protocol.Pipe
-	s      *socket
-	closed bool
-	closeq chan struct{}
-	sendq  chan *protocol.Message
+	p       protocol.Pipe
+	s       *socket
+	closed  bool
+	closeq  chan struct{}
+	sendq   chan *protocol.Message
+	resized chan struct{} // see protocol.Resize
 }
 
 type socket struct {
+	dropped    uint64 // must be first, for atomic alignment
 	closed     bool
 	closeq     chan struct{}
 	recvq      chan *protocol.Message
+	resized    chan struct{} // see protocol.Resize
 	pipes      map[uint32]*pipe
 	recvExpire time.Duration
 	sendExpire time.Duration
@@ -55,15 +59,13 @@ type socket struct {
 }
 
 var (
-	nilQ    <-chan time.Time
-	closedQ chan time.Time
+	nilQ <-chan time.Time
 )
 
 const defaultQLen = 128
 
 func init() {
-	closedQ := make(chan time.Time)
-	close(closedQ)
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
 }
 
 // SendMessage implements sending a message.  The message must already
@@ -87,31 +89,24 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 		m.Free()
 		return nil
 	}
-	bestEffort := s.bestEffort
+	policy := protocol.QueueFullBlock
 	tq := nilQ
-	if bestEffort {
-		tq = closedQ
+	if s.bestEffort {
+		// Never wait; with no room, the reply is dropped.
+		policy = protocol.QueueFullDropNewest
 	} else if s.sendExpire > 0 {
 		tq = time.After(s.sendExpire)
 	}
 	s.Unlock()
 
-	select {
-	case p.sendq <- m:
-		return nil
-	case <-s.closeq:
+	n, err := protocol.EnqueueResizable(s, &p.sendq, &p.resized, m,
+		policy, s.closeq, tq)
+	atomic.AddUint64(&s.dropped, uint64(n))
+	if err != nil {
 		// restore the header
 		m.Header = hdr
-		return protocol.ErrClosed
-	case <-tq:
-		if bestEffort {
-			m.Free()
-			return nil
-		}
-		// restore the header
-		m.Header = hdr
-		return protocol.ErrSendTimeout
 	}
+	return err
 }
 
 func (s *socket) RecvMsg() (*protocol.Message, error) {
@@ -121,13 +116,19 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 		tq = time.After(s.recvExpire)
 	}
 	s.Unlock()
-	select {
-	case <-s.closeq:
-		return nil, protocol.ErrClosed
-	case <-tq:
-		return nil, protocol.ErrRecvTimeout
-	case m := <-s.recvq:
-		return m, nil
+	for {
+		s.Lock()
+		recvq, resized := s.recvq, s.resized
+		s.Unlock()
+		select {
+		case <-s.closeq:
+			return nil, protocol.ErrClosed
+		case <-tq:
+			return nil, protocol.ErrRecvTimeout
+		case <-resized:
+		case m := <-recvq:
+			return m, nil
+		}
 	}
 }
 
@@ -173,15 +174,11 @@ outer:
 			m.Body = m.Body[4:]
 		}
 
-		select {
-		case s.recvq <- m:
-			continue
-		case <-s.closeq:
-			m.Free()
-			break outer
-		case <-p.closeq:
-			m.Free()
-			break outer
+		n, ok := protocol.Deliver(s, &s.recvq, &s.resized, m,
+			p.closeq, s.closeq)
+		atomic.AddUint64(&s.dropped, uint64(n))
+		if !ok {
+			break
 		}
 	}
 	p.Close()
@@ -190,11 +187,20 @@ outer:
 // This is a puller, and doesn't permit for priorities.  We might want
 // to refactor this to use a push based scheme later.
 func (p *pipe) sender() {
+	s := p.s
+	s.Lock()
+	sendq, resized := p.sendq, p.resized
+	s.Unlock()
 outer:
 	for {
 		var m *protocol.Message
 		select {
-		case m = <-p.sendq:
+		case m = <-sendq:
+		case <-resized:
+			s.Lock()
+			sendq, resized = p.sendq, p.resized
+			s.Unlock()
+			continue
 		case <-p.closeq:
 			break outer
 		}
@@ -265,20 +271,27 @@ func (s *socket) SetOption(name string, value interface{}) error {
 	case protocol.OptionWriteQLen:
 		if v, ok := value.(int); ok && v >= 0 {
 			s.Lock()
-			// This does not impact pipes already connected.
 			s.sendQLen = v
+			n := 0
+			for _, p := range s.pipes {
+				n += protocol.Resize(&p.sendq, &p.resized, v)
+			}
 			s.Unlock()
+			atomic.AddUint64(&s.dropped, uint64(n))
+			return nil
 		}
 		return protocol.ErrBadValue
 
 	case protocol.OptionReadQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
 			s.Lock()
 			s.recvQLen = v
-			s.recvq = newchan
+			n := protocol.Resize(&s.recvq, &s.resized, v)
 			s.Unlock()
+			atomic.AddUint64(&s.dropped, uint64(n))
+			return nil
 		}
+		return protocol.ErrBadValue
 		// We don't support these
 		// case OptionLinger:
 	}
@@ -320,6 +333,17 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.recvQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := 0
+		for _, p := range s.pipes {
+			queued += len(p.sendq)
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped: atomic.LoadUint64(&s.dropped),
+			protocol.StatQueued:  uint64(queued),
+		}, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -354,10 +378,11 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		return protocol.ErrClosed
 	}
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		closeq: make(chan struct{}),
-		sendq:  make(chan *protocol.Message, s.sendQLen),
+		p:       pp,
+		s:       s,
+		closeq:  make(chan struct{}),
+		sendq:   make(chan *protocol.Message, s.sendQLen),
+		resized: make(chan struct{}),
 	}
 	s.pipes[pp.ID()] = p
 
@@ -394,6 +419,7 @@ func NewProtocol() protocol.Protocol {
 		pipes:    make(map[uint32]*pipe),
 		closeq:   make(chan struct{}),
 		recvq:    make(chan *protocol.Message, defaultQLen),
+		resized:  make(chan struct{}),
 		sendQLen: defaultQLen,
 		recvQLen: defaultQLen,
 		ttl:      8,
@@ -21,6 +21,7 @@ package xstar
 import (
 	"encoding/binary"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nanomsg.org/go/mangos/v2/protocol"
@@ -35,21 +36,28 @@ const (
 )
 
 type pipe struct {
-	p      protocol.Pipe
-	s      *socket
-	closed bool
-	closeq chan struct{}
-	sendq  chan *protocol.Message
+	drops   uint64 // messages discarded for this pipe
+	p       protocol.Pipe
+	s       *socket
+	closed  bool
+	closeq  chan struct{}
+	sendq   chan *protocol.Message
+	resized chan struct{} // see protocol.Resize
 }
 
 type socket struct {
+	dropped    uint64 // messages discarded due to backpressure
 	closed     bool
 	closeq     chan struct{}
 	pipes      map[uint32]*pipe
 	recvQLen   int
 	sendQLen   int
+	policy     protocol.QueueFullPolicy
+	bestEffort bool
 	recvExpire time.Duration
 	recvq      chan *protocol.Message
+	resized    chan struct{} // see protocol.Resize
+	readable   protocol.Notifier
 	ttl        int
 	sync.Mutex
 }
@@ -69,6 +77,7 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 
 	// Raw mode messages are required to come wth the header.
 	if len(m.Header) != 4 {
+		s.Unlock()
 		m.Free()
 		return nil
 	}
@@ -80,25 +89,56 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 	id := binary.BigEndian.Uint32(m.Header)
 
 	// This could benefit from optimization to avoid useless duplicates.
-	for _, p := range s.pipes {
+	policy := s.policy
+	if policy == protocol.QueueFullBlock && s.bestEffort {
+		policy = protocol.QueueFullDropNewest
+	}
+	dropped := 0
+	var wait []*pipe
+	for _, p := range s.targets(m) {
 
 		// Don't deliver the message back up to the same pipe it
 		// arrived from.
 		if p.p.ID() == id {
 			continue
 		}
+		if policy == protocol.QueueFullBlock {
+			// Waiting is done without the lock, below.
+			wait = append(wait, p)
+			continue
+		}
+		n, _ := protocol.Enqueue(p.sendq, m.Dup(), policy, p.closeq, nilQ)
+		atomic.AddUint64(&p.drops, uint64(n))
+		dropped += n
+	}
+	s.Unlock()
+	for _, p := range wait {
 		pm := m.Dup()
-		select {
-		case p.sendq <- pm:
-		case <-p.closeq:
-			pm.Free()
-		default:
-			// backpressure, but we do not exert
+		n, err := protocol.EnqueueResizable(s, &p.sendq, &p.resized, pm,
+			policy, p.closeq, nilQ)
+		if err != nil {
 			pm.Free()
+			n++
 		}
+		atomic.AddUint64(&p.drops, uint64(n))
+		dropped += n
 	}
-	s.Unlock()
 	m.Free()
+	if dropped > 0 {
+		atomic.AddUint64(&s.dropped, uint64(dropped))
+	}
+	return nil
+}
+
+// targets returns the pipes a message is to be sent to, which are all of
+// them unless the message has a Target.
+func (s *socket) targets(m *protocol.Message) map[uint32]*pipe {
+	if m.Target == nil {
+		return s.pipes
+	}
+	if p, ok := s.pipes[m.Target.ID()]; ok {
+		return map[uint32]*pipe{p.p.ID(): p}
+	}
 	return nil
 }
 
@@ -112,16 +152,36 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 		tq = time.After(s.recvExpire)
 	}
 	s.Unlock()
-	select {
-	case <-s.closeq:
-		return nil, protocol.ErrClosed
-	case <-tq:
-		return nil, protocol.ErrRecvTimeout
-	case m := <-s.recvq:
-		return m, nil
+	for {
+		s.Lock()
+		recvq, resized := s.recvq, s.resized
+		s.Unlock()
+		select {
+		case <-s.closeq:
+			return nil, protocol.ErrClosed
+		case <-tq:
+			return nil, protocol.ErrRecvTimeout
+		case <-resized:
+		case m := <-recvq:
+			s.readable.Set(len(recvq) > 0)
+			return m, nil
+		}
 	}
 }
 
+func (s *socket) RecvMsgs(max int) ([]*protocol.Message, error) {
+	m, err := s.RecvMsg()
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	recvq := s.recvq
+	s.Unlock()
+	msgs := protocol.Dequeue(recvq, m, max)
+	s.readable.Set(len(recvq) > 0)
+	return msgs, nil
+}
+
 func (s *socket) SetOption(name string, value interface{}) error {
 	switch name {
 
@@ -147,19 +207,41 @@ func (s *socket) SetOption(name string, value interface{}) error {
 		if v, ok := value.(int); ok && v >= 0 {
 			s.Lock()
 			s.sendQLen = v
+			for _, p := range s.pipes {
+				n := protocol.Resize(&p.sendq, &p.resized, v)
+				atomic.AddUint64(&p.drops, uint64(n))
+				atomic.AddUint64(&s.dropped, uint64(n))
+			}
 			s.Unlock()
 			return nil
 		}
 		return protocol.ErrBadValue
 
+	case protocol.OptionBestEffort:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			s.bestEffort = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionQueueFullPolicy:
+		v, err := protocol.ParseQueueFullPolicy(value)
+		if err == nil {
+			s.Lock()
+			s.policy = v
+			s.Unlock()
+		}
+		return err
+
 	case protocol.OptionReadQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
 			s.Lock()
 			s.recvQLen = v
-			s.recvq = newchan
+			n := protocol.Resize(&s.recvq, &s.resized, v)
 			s.Unlock()
-
+			atomic.AddUint64(&s.dropped, uint64(n))
 			return nil
 		}
 		return protocol.ErrBadValue
@@ -172,6 +254,11 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 	switch option {
 	case protocol.OptionRaw:
 		return true, nil
+	case protocol.OptionRecvReady:
+		return s.readable.Chan(), nil
+	case protocol.OptionSendReady:
+		// Sending never blocks.
+		return protocol.Ready, nil
 	case protocol.OptionTTL:
 		s.Lock()
 		v := s.ttl
@@ -192,6 +279,38 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.recvQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionBestEffort:
+		s.Lock()
+		v := s.bestEffort
+		s.Unlock()
+		return v, nil
+	case protocol.OptionQueueFullPolicy:
+		s.Lock()
+		v := s.policy
+		s.Unlock()
+		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := 0
+		for _, p := range s.pipes {
+			queued += len(p.sendq)
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatDropped: atomic.LoadUint64(&s.dropped),
+			protocol.StatQueued:  uint64(queued),
+		}, nil
+	case protocol.OptionPipeStats:
+		s.Lock()
+		stats := make(map[uint32]map[string]uint64, len(s.pipes))
+		for id, p := range s.pipes {
+			stats[id] = map[string]uint64{
+				protocol.StatDropped: atomic.LoadUint64(&p.drops),
+				protocol.StatQueued:  uint64(len(p.sendq)),
+			}
+		}
+		s.Unlock()
+		return stats, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -204,10 +323,11 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		return protocol.ErrClosed
 	}
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		closeq: make(chan struct{}),
-		sendq:  make(chan *protocol.Message, s.sendQLen),
+		p:       pp,
+		s:       s,
+		closeq:  make(chan struct{}),
+		sendq:   make(chan *protocol.Message, s.sendQLen),
+		resized: make(chan struct{}),
 	}
 	s.pipes[pp.ID()] = p
 
@@ -264,17 +384,26 @@ func (s *socket) Close() error {
 }
 
 func (p *pipe) sender() {
+	s := p.s
+	s.Lock()
+	sendq, resized := p.sendq, p.resized
+	s.Unlock()
 outer:
 	for {
 		var m *protocol.Message
 		select {
 		case <-p.closeq:
 			break outer
-		case m = <-p.sendq:
+		case <-resized:
+			s.Lock()
+			sendq, resized = p.sendq, p.resized
+			s.Unlock()
+			continue
+		case m = <-sendq:
 		}
+		msgs := protocol.Dequeue(sendq, m, protocol.MaxSendBatch)
 
-		if err := p.p.SendMsg(m); err != nil {
-			m.Free()
+		if err := p.p.SendMsgs(msgs); err != nil {
 			break
 		}
 	}
@@ -283,7 +412,6 @@ outer:
 
 func (p *pipe) receiver() {
 	s := p.s
-outer:
 	for {
 		m := p.p.RecvMsg()
 		if m == nil {
@@ -306,32 +434,34 @@ outer:
 
 		userm := m.Dup()
 		s.Lock()
+		// Forwarding never waits, whatever the policy, lest one slow
+		// peer stall the others.
+		policy := s.policy
+		if policy == protocol.QueueFullBlock {
+			policy = protocol.QueueFullDropNewest
+		}
+		dropped := 0
 		for _, p2 := range s.pipes {
 			if p2 == p || p2.closed {
 				continue
 			}
-
-			m2 := m.Dup()
-			select {
-			case p2.sendq <- m2:
-			case <-s.closeq:
-				m2.Free()
-			default:
-				m2.Free()
-			}
+			n, _ := protocol.Enqueue(p2.sendq, m.Dup(), policy, p2.closeq, nilQ)
+			atomic.AddUint64(&p2.drops, uint64(n))
+			dropped += n
 		}
 		s.Unlock()
 		m.Free()
+		if dropped > 0 {
+			atomic.AddUint64(&s.dropped, uint64(dropped))
+		}
 
-		select {
-		case s.recvq <- userm:
-		case <-p.closeq:
-			userm.Free()
-			break outer
-		case <-s.closeq:
-			userm.Free()
-			break outer
+		n, ok := protocol.Deliver(s, &s.recvq, &s.resized, userm,
+			p.closeq, s.closeq)
+		atomic.AddUint64(&s.dropped, uint64(n))
+		if !ok {
+			break
 		}
+		s.readable.Notify()
 	}
 	p.Close()
 }
@@ -351,14 +481,21 @@ func (p *pipe) Close() error {
 	return nil
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
 		pipes:    make(map[uint32]*pipe),
 		closeq:   make(chan struct{}),
 		recvq:    make(chan *protocol.Message, defaultQLen),
+		resized:  make(chan struct{}),
+		readable: protocol.NewNotifier(),
 		sendQLen: defaultQLen,
 		recvQLen: defaultQLen,
+		policy:   protocol.QueueFullDropNewest,
 		ttl:      8,
 	}
 	return s
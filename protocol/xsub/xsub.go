@@ -45,6 +45,9 @@ type socket struct {
 	recvQLen   int
 	recvExpire time.Duration
 	recvq      chan *protocol.Message
+	resized    chan struct{} // see protocol.Resize
+	readable   protocol.Notifier
+	replay     bool
 	sync.Mutex
 }
 
@@ -68,16 +71,36 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 		tq = time.After(s.recvExpire)
 	}
 	s.Unlock()
-	select {
-	case <-s.closeq:
-		return nil, protocol.ErrClosed
-	case <-tq:
-		return nil, protocol.ErrRecvTimeout
-	case m := <-s.recvq:
-		return m, nil
+	for {
+		s.Lock()
+		recvq, resized := s.recvq, s.resized
+		s.Unlock()
+		select {
+		case <-s.closeq:
+			return nil, protocol.ErrClosed
+		case <-tq:
+			return nil, protocol.ErrRecvTimeout
+		case <-resized:
+		case m := <-recvq:
+			s.readable.Set(len(recvq) > 0)
+			return m, nil
+		}
 	}
 }
 
+func (s *socket) RecvMsgs(max int) ([]*protocol.Message, error) {
+	m, err := s.RecvMsg()
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	recvq := s.recvq
+	s.Unlock()
+	msgs := protocol.Dequeue(recvq, m, max)
+	s.readable.Set(len(recvq) > 0)
+	return msgs, nil
+}
+
 func (s *socket) SetOption(name string, value interface{}) error {
 	switch name {
 
@@ -92,28 +115,19 @@ func (s *socket) SetOption(name string, value interface{}) error {
 
 	case protocol.OptionReadQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
 			s.Lock()
 			s.recvQLen = v
-			oldchan := s.recvq
-			s.recvq = newchan
+			protocol.Resize(&s.recvq, &s.resized, v)
 			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
 
-			for {
-				var m *protocol.Message
-				select {
-				case m = <-oldchan:
-				default:
-				}
-				if m == nil {
-					break
-				}
-				select {
-				case newchan <- m:
-				default:
-					m.Free()
-				}
-			}
+	case protocol.OptionReplay:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			s.replay = v
+			s.Unlock()
 			return nil
 		}
 		return protocol.ErrBadValue
@@ -126,6 +140,8 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 	switch option {
 	case protocol.OptionRaw:
 		return true, nil
+	case protocol.OptionRecvReady:
+		return s.readable.Chan(), nil
 	case protocol.OptionRecvDeadline:
 		s.Lock()
 		v := s.recvExpire
@@ -136,6 +152,11 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.recvQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionReplay:
+		s.Lock()
+		v := s.replay
+		s.Unlock()
+		return v, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -155,9 +176,21 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 	s.pipes[pp.ID()] = p
 
 	go p.receiver()
+	if s.replay {
+		go p.requestReplay()
+	}
 	return nil
 }
 
+// requestReplay asks the publisher for the messages it has retained.
+func (p *pipe) requestReplay() {
+	m := protocol.NewMessage(len(protocol.ReplayRequest))
+	m.Body = append(m.Body, protocol.ReplayRequest...)
+	if err := p.p.SendMsg(m); err != nil {
+		m.Free()
+	}
+}
+
 func (s *socket) RemovePipe(pp protocol.Pipe) {
 	s.Lock()
 	p, ok := s.pipes[pp.ID()]
@@ -206,22 +239,18 @@ func (s *socket) Close() error {
 }
 
 func (p *pipe) receiver() {
-outer:
+	s := p.s
 	for {
 		m := p.p.RecvMsg()
 		if m == nil {
 			break
 		}
 
-		select {
-		case p.s.recvq <- m:
-		case <-p.closeq:
-			m.Free()
-			break outer
-		case <-p.s.closeq:
-			m.Free()
-			break outer
+		if _, ok := protocol.Deliver(s, &s.recvq, &s.resized, m,
+			p.closeq, s.closeq); !ok {
+			break
 		}
+		s.readable.Notify()
 	}
 	p.Close()
 }
@@ -241,12 +270,18 @@ func (p *pipe) Close() error {
 	return nil
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
 		pipes:    make(map[uint32]*pipe),
 		closeq:   make(chan struct{}),
 		recvq:    make(chan *protocol.Message, defaultQLen),
+		resized:  make(chan struct{}),
+		readable: protocol.NewNotifier(),
 		recvQLen: defaultQLen,
 	}
 	return s
@@ -32,11 +32,12 @@ const (
 )
 
 type pipe struct {
-	p      protocol.Pipe
-	s      *socket
-	closed bool
-	closeq chan struct{}
-	sendq  chan *protocol.Message
+	p       protocol.Pipe
+	s       *socket
+	closed  bool
+	closeq  chan struct{}
+	sendq   chan *protocol.Message
+	resized chan struct{} // see protocol.Resize
 }
 
 type socket struct {
@@ -47,6 +48,7 @@ type socket struct {
 	sendQLen   int
 	recvExpire time.Duration
 	recvq      chan *protocol.Message
+	resized    chan struct{} // see protocol.Resize
 	sync.Mutex
 }
 
@@ -89,13 +91,19 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 		tq = time.After(s.recvExpire)
 	}
 	s.Unlock()
-	select {
-	case <-s.closeq:
-		return nil, protocol.ErrClosed
-	case <-tq:
-		return nil, protocol.ErrRecvTimeout
-	case m := <-s.recvq:
-		return m, nil
+	for {
+		s.Lock()
+		recvq, resized := s.recvq, s.resized
+		s.Unlock()
+		select {
+		case <-s.closeq:
+			return nil, protocol.ErrClosed
+		case <-tq:
+			return nil, protocol.ErrRecvTimeout
+		case <-resized:
+		case m := <-recvq:
+			return m, nil
+		}
 	}
 }
 
@@ -115,6 +123,9 @@ func (s *socket) SetOption(name string, value interface{}) error {
 		if v, ok := value.(int); ok && v >= 0 {
 			s.Lock()
 			s.sendQLen = v
+			for _, p := range s.pipes {
+				protocol.Resize(&p.sendq, &p.resized, v)
+			}
 			s.Unlock()
 			return nil
 		}
@@ -122,29 +133,13 @@ func (s *socket) SetOption(name string, value interface{}) error {
 
 	case protocol.OptionReadQLen:
 		if v, ok := value.(int); ok && v >= 0 {
-			newchan := make(chan *protocol.Message, v)
 			s.Lock()
 			s.recvQLen = v
-			oldchan := s.recvq
-			s.recvq = newchan
+			protocol.Resize(&s.recvq, &s.resized, v)
 			s.Unlock()
-
-			for {
-				var m *protocol.Message
-				select {
-				case m = <-oldchan:
-				default:
-				}
-				if m == nil {
-					break
-				}
-				select {
-				case newchan <- m:
-				default:
-					m.Free()
-				}
-			}
+			return nil
 		}
+		return protocol.ErrBadValue
 		// We don't support these
 		// case OptionLinger:
 	}
@@ -171,6 +166,16 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.recvQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionProtocolStats:
+		s.Lock()
+		queued := 0
+		for _, p := range s.pipes {
+			queued += len(p.sendq)
+		}
+		s.Unlock()
+		return map[string]uint64{
+			protocol.StatQueued: uint64(queued),
+		}, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -183,10 +188,11 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		return protocol.ErrClosed
 	}
 	p := &pipe{
-		p:      pp,
-		s:      s,
-		closeq: make(chan struct{}),
-		sendq:  make(chan *protocol.Message, s.sendQLen),
+		p:       pp,
+		s:       s,
+		closeq:  make(chan struct{}),
+		sendq:   make(chan *protocol.Message, s.sendQLen),
+		resized: make(chan struct{}),
 	}
 	s.pipes[pp.ID()] = p
 
@@ -242,13 +248,22 @@ func (s *socket) Close() error {
 }
 
 func (p *pipe) sender() {
+	s := p.s
+	s.Lock()
+	sendq, resized := p.sendq, p.resized
+	s.Unlock()
 outer:
 	for {
 		var m *protocol.Message
 		select {
 		case <-p.closeq:
 			break outer
-		case m = <-p.sendq:
+		case <-resized:
+			s.Lock()
+			sendq, resized = p.sendq, p.resized
+			s.Unlock()
+			continue
+		case m = <-sendq:
 		}
 
 		if err := p.p.SendMsg(m); err != nil {
@@ -260,7 +275,7 @@ outer:
 }
 
 func (p *pipe) receiver() {
-outer:
+	s := p.s
 	for {
 		m := p.p.RecvMsg()
 		if m == nil {
@@ -275,14 +290,9 @@ outer:
 		m.Header = m.Body[:4]
 		m.Body = m.Body[4:]
 
-		select {
-		case p.s.recvq <- m:
-		case <-p.closeq:
-			m.Free()
-			break outer
-		case <-p.s.closeq:
-			m.Free()
-			break outer
+		if _, ok := protocol.Deliver(s, &s.recvq, &s.resized, m,
+			p.closeq, s.closeq); !ok {
+			break
 		}
 	}
 	p.Close()
@@ -303,12 +313,17 @@ func (p *pipe) Close() error {
 	return nil
 }
 
+func init() {
+	protocol.RegisterProtocol(SelfName, true, NewProtocol)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
 		pipes:    make(map[uint32]*pipe),
 		closeq:   make(chan struct{}),
 		recvq:    make(chan *protocol.Message, defaultQLen),
+		resized:  make(chan struct{}),
 		sendQLen: defaultQLen,
 		recvQLen: defaultQLen,
 	}
@@ -0,0 +1,517 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ProtocolDesc describes one of the SP protocols, along with the options
+// it accepts.  This is intended for generic tooling, such as command line
+// utilities and configuration loaders, which need to enumerate or validate
+// protocols without importing every protocol implementation.  When the
+// protocol's implementation is registered (see RegisterProtocol), the
+// options are those it actually accepts, found by offering it each option
+// known to any protocol; otherwise they are as described.
+type ProtocolDesc struct {
+	Name       string   // protocol name, such as "req"
+	Number     uint16   // SP protocol number
+	PeerName   string   // name of the peer protocol
+	PeerNumber uint16   // SP protocol number of the peer
+	Options    []string // socket options accepted in cooked mode
+	RawOptions []string // socket options for raw mode, if not Options
+}
+
+// SocketOptions are the options that may be set on every socket,
+// regardless of protocol.  Transport specific options (such as OptionTLSConfig) are not
+// included, as they depend on the dialers and listeners in use.  The TCP
+// options are, as the socket passes them on to its dialers and listeners.
+var SocketOptions = []string{
+	OptionMaxRecvSize,
+	OptionReconnectTime,
+	OptionMaxReconnectTime,
+	OptionReconnectPolicy,
+	OptionDialAsynch,
+	OptionDialTimeout,
+	OptionWatchdogTime,
+	OptionStrict,
+	OptionLogger,
+	OptionName,
+	OptionLinger,
+	OptionVerifyMessages,
+	OptionCapture,
+	OptionLifecycle,
+	OptionClock,
+	OptionValidator,
+	OptionRecvFilter,
+	OptionServeWorkers,
+	OptionSendRateLimit,
+	OptionFairSend,
+	OptionMaxBufferBytes,
+	OptionNoDelay,
+	OptionKeepAlive,
+	OptionKeepAliveTime,
+	OptionKeepAliveInterval,
+	OptionKeepAliveCount,
+	OptionSendBufferSize,
+	OptionRecvBufferSize,
+	OptionCompression,
+	OptionCompressionThreshold,
+	OptionHeartbeatTime,
+	OptionHeartbeatTimeout,
+	OptionHandshakeTimeout,
+	OptionChunkSize,
+	OptionCreditWindow,
+	OptionChecksum,
+	OptionCoalesceTime,
+	OptionCoalesceBytes,
+	OptionBusyPoll,
+}
+
+var protocols = []ProtocolDesc{
+	{
+		Name:       "pair",
+		Number:     ProtoPair,
+		PeerName:   "pair",
+		PeerNumber: ProtoPair,
+		Options: []string{OptionBestEffort, OptionRecvDeadline,
+			OptionSendDeadline, OptionReadQLen, OptionWriteQLen,
+			OptionSynchronous, OptionQueueFullPolicy, OptionPolyamorous,
+			OptionSendPriorities},
+	},
+	{
+		Name:       "pub",
+		Number:     ProtoPub,
+		PeerName:   "sub",
+		PeerNumber: ProtoSub,
+		Options: []string{OptionBestEffort, OptionWriteQLen,
+			OptionWriteQMaxLen, OptionWriteQMinLen, OptionRetain,
+			OptionRetainTopic,
+			OptionQueueFullPolicy, OptionSendWorkers, OptionRetainAge,
+			OptionReplayOnConnect, OptionReplayMarker, OptionSpoolDir,
+			OptionSpoolMaxBytes, OptionSubscriptionFunc},
+	},
+	{
+		Name:       "sub",
+		Number:     ProtoSub,
+		PeerName:   "pub",
+		PeerNumber: ProtoPub,
+		Options: []string{OptionRecvDeadline, OptionReadQLen,
+			OptionSubscribe, OptionUnsubscribe, OptionReplay,
+			OptionSubForward, OptionSubWildcard},
+		RawOptions: []string{OptionRecvDeadline, OptionReadQLen,
+			OptionReplay},
+	},
+	{
+		Name:       "req",
+		Number:     ProtoReq,
+		PeerName:   "rep",
+		PeerNumber: ProtoRep,
+		Options: []string{OptionBestEffort, OptionRecvDeadline,
+			OptionSendDeadline, OptionRetryTime, OptionRetryPolicy,
+			OptionSynchronous, OptionLoadBalance, OptionProbeInterval,
+			OptionProbeTimeout, OptionReplyMismatch},
+		RawOptions: []string{OptionBestEffort, OptionRecvDeadline,
+			OptionSendDeadline, OptionReadQLen, OptionWriteQLen},
+	},
+	{
+		Name:       "rep",
+		Number:     ProtoRep,
+		PeerName:   "req",
+		PeerNumber: ProtoReq,
+		Options: []string{OptionBestEffort, OptionRecvDeadline,
+			OptionSendDeadline, OptionWriteQLen, OptionTTL,
+			OptionNoRoute, OptionDeadLetter, OptionRecvFair,
+			OptionRecvPipeShare},
+		RawOptions: []string{OptionBestEffort, OptionRecvDeadline,
+			OptionSendDeadline, OptionReadQLen, OptionWriteQLen,
+			OptionTTL, OptionNoRoute, OptionDeadLetter,
+			OptionRecvFair, OptionRecvPipeShare},
+	},
+	{
+		Name:       "push",
+		Number:     ProtoPush,
+		PeerName:   "pull",
+		PeerNumber: ProtoPull,
+		Options: []string{OptionBestEffort, OptionSendDeadline,
+			OptionWriteQLen, OptionLoadBalance, OptionQueueFullPolicy,
+			OptionHashRoute, OptionSpoolDir, OptionSpoolMaxBytes,
+			OptionAckDelivery, OptionAckTimeout, OptionAckStore,
+			OptionSendPriorities},
+	},
+	{
+		Name:       "pull",
+		Number:     ProtoPull,
+		PeerName:   "push",
+		PeerNumber: ProtoPush,
+		Options: []string{OptionRecvDeadline, OptionReadQLen,
+			OptionSourceTag, OptionAckDelivery, OptionRecvFair,
+			OptionRecvPipeShare},
+	},
+	{
+		Name:       "surveyor",
+		Number:     ProtoSurveyor,
+		PeerName:   "respondent",
+		PeerNumber: ProtoRespondent,
+		Options: []string{OptionRecvDeadline, OptionReadQLen,
+			OptionWriteQLen, OptionSurveyTime},
+		RawOptions: []string{OptionRecvDeadline, OptionReadQLen,
+			OptionWriteQLen},
+	},
+	{
+		Name:       "respondent",
+		Number:     ProtoRespondent,
+		PeerName:   "surveyor",
+		PeerNumber: ProtoSurveyor,
+		Options: []string{OptionBestEffort, OptionRecvDeadline,
+			OptionSendDeadline, OptionWriteQLen, OptionTTL},
+		RawOptions: []string{OptionBestEffort, OptionRecvDeadline,
+			OptionSendDeadline, OptionReadQLen, OptionWriteQLen,
+			OptionTTL},
+	},
+	{
+		Name:       "bus",
+		Number:     ProtoBus,
+		PeerName:   "bus",
+		PeerNumber: ProtoBus,
+		Options: []string{OptionBestEffort, OptionRecvDeadline,
+			OptionReadQLen, OptionWriteQLen, OptionWriteQMaxLen,
+			OptionWriteQMinLen, OptionQueueFullPolicy,
+			OptionRecvFair, OptionRecvPipeShare},
+	},
+	{
+		Name:       "star",
+		Number:     ProtoStar,
+		PeerName:   "star",
+		PeerNumber: ProtoStar,
+		Options: []string{OptionBestEffort, OptionRecvDeadline,
+			OptionReadQLen, OptionWriteQLen, OptionTTL,
+			OptionQueueFullPolicy},
+	},
+}
+
+var protoLock sync.RWMutex
+
+// NewProtocolFunc returns a new instance of a protocol, for one socket.
+type NewProtocolFunc func() ProtocolBase
+
+type protoKey struct {
+	name string
+	raw  bool
+}
+
+var protoNews = map[protoKey]NewProtocolFunc{}
+
+// protoOpts caches the options accepted by each registered protocol
+// implementation.  It is discarded whenever a protocol or description is
+// registered, and protoGen counts those registrations, so that a result
+// found meanwhile is not cached.
+var protoOpts = map[protoKey][]string{}
+var protoGen uint64
+
+// probeValue is offered to protocols to learn which options they accept.
+// No option takes it, so an accepted option reports ErrBadValue, and is
+// left unchanged.
+type probeValue struct{}
+
+// RegisterProtocol registers a protocol implementation globally, under
+// the given name, after which sockets using it can be made by name with
+// protocol.NewSocket (or protocol.NewRawSocket, if raw is true), as they
+// are from configuration files.  Like transports, the protocols supplied
+// with mangos register themselves when their packages are imported.
+// Third parties can supply their own patterns by implementing
+// ProtocolBase, along with ProtocolContext if they support contexts, and
+// registering a function returning a new instance for each socket.  Such
+// a protocol should also describe itself with RegisterProtocolDesc, so
+// that the options it accepts are known.  This will override any other
+// implementation registered for the same name and mode.  If newProto is
+// nil, then any implementation registered for them is removed.
+func RegisterProtocol(name string, raw bool, newProto NewProtocolFunc) {
+	protoLock.Lock()
+	if newProto == nil {
+		delete(protoNews, protoKey{name, raw})
+	} else {
+		protoNews[protoKey{name, raw}] = newProto
+	}
+	protoOpts = map[protoKey][]string{}
+	protoGen++
+	protoLock.Unlock()
+}
+
+// NewProtocol returns a new instance of the protocol registered under
+// the given name and mode, or ErrBadProto if there is none.
+func NewProtocol(name string, raw bool) (ProtocolBase, error) {
+	protoLock.RLock()
+	fn := protoNews[protoKey{name, raw}]
+	protoLock.RUnlock()
+	if fn == nil {
+		return nil, ErrBadProto
+	}
+	return fn(), nil
+}
+
+// RegisteredProtocols returns the names of all the registered protocols,
+// in either mode, in sorted order.
+func RegisteredProtocols() []string {
+	protoLock.RLock()
+	seen := make(map[string]bool, len(protoNews))
+	names := make([]string, 0, len(protoNews))
+	for k := range protoNews {
+		if !seen[k.name] {
+			seen[k.name] = true
+			names = append(names, k.name)
+		}
+	}
+	protoLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// RegisterProtocolDesc adds the description of a protocol to those
+// returned by Protocols, ProtocolByName, and ProtocolByNumber, replacing
+// any description with the same name.  Sockets use it to check options,
+// and tooling to enumerate protocols.
+func RegisterProtocolDesc(desc ProtocolDesc) {
+	protoLock.Lock()
+	defer protoLock.Unlock()
+	protoOpts = map[protoKey][]string{}
+	protoGen++
+	for i, d := range protocols {
+		if d.Name == desc.Name {
+			protocols[i] = desc
+			return
+		}
+	}
+	protocols = append(protocols, desc)
+}
+
+// Protocols returns descriptions of all the known protocols, ordered by
+// protocol number.
+func Protocols() []ProtocolDesc {
+	protoLock.RLock()
+	descs := make([]ProtocolDesc, len(protocols))
+	copy(descs, protocols)
+	protoLock.RUnlock()
+	for i := range descs {
+		descs[i] = descs[i].accepted()
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		return descs[i].Number < descs[j].Number
+	})
+	return descs
+}
+
+// ProtocolByName looks up the description of the named protocol.
+func ProtocolByName(name string) (ProtocolDesc, bool) {
+	return findProtocol(func(d ProtocolDesc) bool { return d.Name == name })
+}
+
+// ProtocolByNumber looks up the description of a protocol by its
+// SP protocol number.
+func ProtocolByNumber(num uint16) (ProtocolDesc, bool) {
+	return findProtocol(func(d ProtocolDesc) bool { return d.Number == num })
+}
+
+func findProtocol(match func(ProtocolDesc) bool) (ProtocolDesc, bool) {
+	protoLock.RLock()
+	for _, d := range protocols {
+		if match(d) {
+			protoLock.RUnlock()
+			return d.accepted(), true
+		}
+	}
+	protoLock.RUnlock()
+	return ProtocolDesc{}, false
+}
+
+// accepted returns the description with its options replaced by those
+// its registered implementations accept, in each mode there is one for.
+func (d ProtocolDesc) accepted() ProtocolDesc {
+	if opts := acceptedOptions(d.Name, false); opts != nil {
+		d.Options = opts
+	}
+	if opts := acceptedOptions(d.Name, true); opts != nil {
+		d.RawOptions = opts
+	}
+	return d
+}
+
+// acceptedOptions returns the options, other than SocketOptions, that
+// the implementation registered for the protocol and mode accepts, or nil
+// if none is registered.  The candidates are the options described for
+// any protocol, each of which is offered to a fresh instance.
+func acceptedOptions(name string, raw bool) []string {
+	key := protoKey{name, raw}
+	protoLock.RLock()
+	opts, ok := protoOpts[key]
+	fn := protoNews[key]
+	gen := protoGen
+	var candidates []string
+	if !ok && fn != nil {
+		candidates = knownOptions()
+	}
+	protoLock.RUnlock()
+	if ok || fn == nil {
+		return opts
+	}
+
+	proto := fn()
+	opts = make([]string, 0, len(candidates))
+	for _, o := range candidates {
+		if err := proto.SetOption(o, probeValue{}); !errors.Is(err, ErrBadOption) {
+			opts = append(opts, o)
+		}
+	}
+	_ = proto.Close()
+
+	protoLock.Lock()
+	if gen == protoGen {
+		protoOpts[key] = opts
+	}
+	protoLock.Unlock()
+	return opts
+}
+
+// knownOptions returns the options described for any protocol, except
+// those in SocketOptions.  It is called with protoLock held.
+func knownOptions() []string {
+	seen := make(map[string]bool)
+	for _, o := range SocketOptions {
+		seen[o] = true
+	}
+	var opts []string
+	for _, d := range protocols {
+		for _, list := range [][]string{d.Options, d.RawOptions} {
+			for _, o := range list {
+				if !seen[o] {
+					seen[o] = true
+					opts = append(opts, o)
+				}
+			}
+		}
+	}
+	return opts
+}
+
+// Compatible returns true if a socket using this protocol can be
+// connected to one using the given protocol number.
+func (d ProtocolDesc) Compatible(peer uint16) bool {
+	return d.PeerNumber == peer
+}
+
+// ValidOption returns true if the named option may be set on a socket
+// using this protocol, in raw mode if raw is true, and cooked mode
+// otherwise.  Options common to all sockets (see SocketOptions) are
+// always valid.
+func (d ProtocolDesc) ValidOption(name string, raw bool) bool {
+	opts := d.Options
+	if raw && d.RawOptions != nil {
+		opts = d.RawOptions
+	}
+	for _, o := range opts {
+		if o == name {
+			return true
+		}
+	}
+	for _, o := range SocketOptions {
+		if o == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidOptions returns the options that may be set on a socket using this
+// protocol, including those common to all sockets, in sorted order.
+func (d ProtocolDesc) ValidOptions(raw bool) []string {
+	opts := d.Options
+	if raw && d.RawOptions != nil {
+		opts = d.RawOptions
+	}
+	seen := make(map[string]bool, len(opts)+len(SocketOptions))
+	valid := make([]string, 0, len(opts)+len(SocketOptions))
+	for _, list := range [][]string{opts, SocketOptions} {
+		for _, o := range list {
+			if !seen[o] {
+				seen[o] = true
+				valid = append(valid, o)
+			}
+		}
+	}
+	sort.Strings(valid)
+	return valid
+}
+
+// OptionError is returned by Socket.SetOption when the option is not
+// supported by the socket's protocol.  It names the protocol, and lists
+// the options that are supported.  It wraps ErrBadOption, so that
+// errors.Is(err, ErrBadOption) is true.
+type OptionError struct {
+	Option   string   // name of the option being set
+	Protocol string   // name of the protocol, such as "push"
+	Raw      bool     // true if the socket is in raw mode
+	Valid    []string // options supported, as from ValidOptions
+}
+
+func (e *OptionError) Error() string {
+	mode := "cooked"
+	if e.Raw {
+		mode = "raw"
+	}
+	return "invalid or unsupported option " + e.Option + " for " +
+		mode + " " + e.Protocol + " socket (valid options: " +
+		strings.Join(e.Valid, ", ") + ")"
+}
+
+// Unwrap returns ErrBadOption.
+func (e *OptionError) Unwrap() error {
+	return ErrBadOption
+}
+
+// ProtocolError is the error with which a connection is refused when the
+// peer's protocol does not pair with ours, such as a PUB connecting to a
+// REP.  It is returned by Dial, given to the error hook and the Logger,
+// and the pipe refused is reported to the pipe event hook with
+// PipeEventRejected.  It wraps ErrBadProto, so that
+// errors.Is(err, ErrBadProto) is true.
+type ProtocolError struct {
+	Self uint16 // our protocol
+	Peer uint16 // the protocol ours pairs with
+	Got  uint16 // the protocol the peer has
+}
+
+func (e *ProtocolError) Error() string {
+	return ErrBadProto.Error() + ": peer is " + protoString(e.Got) +
+		", but " + protoString(e.Self) + " pairs only with " +
+		protoString(e.Peer)
+}
+
+// Unwrap returns ErrBadProto.
+func (e *ProtocolError) Unwrap() error {
+	return ErrBadProto
+}
+
+// protoString returns the name and number of a protocol, or just the
+// number if it is not registered.
+func protoString(num uint16) string {
+	if d, ok := ProtocolByNumber(num); ok {
+		return d.Name + " (" + strconv.Itoa(int(num)) + ")"
+	}
+	return strconv.Itoa(int(num))
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides how long to wait before trying something again,
+// such as a dialer reconnecting (see OptionReconnectPolicy), or REQ
+// sending a request again (see OptionRetryPolicy).  NextDelay is given
+// the number of attempts that have failed before this one, starting
+// from zero.  The caller keeps the count, and starts again from zero
+// once an attempt succeeds, when it also calls Reset, for policies that
+// keep state of their own.  A policy may be used by several dialers or
+// contexts at once, so one keeping state must be safe for that.
+//
+// The stock policies, ConstantRetry, ExponentialRetry and FibonacciRetry,
+// keep no state, so that an organization can standardize on one value
+// and share it freely.
+type RetryPolicy interface {
+	NextDelay(attempt int) time.Duration
+	Reset()
+}
+
+// ConstantRetry is a RetryPolicy waiting the same time before each attempt.
+type ConstantRetry time.Duration
+
+// NextDelay implements RetryPolicy.
+func (r ConstantRetry) NextDelay(int) time.Duration {
+	return time.Duration(r)
+}
+
+// Reset implements RetryPolicy.
+func (ConstantRetry) Reset() {}
+
+// ExponentialRetry is a RetryPolicy doubling the wait after each failed
+// attempt, starting from Min, up to Max (if not zero).  Jitter, between
+// zero and one, takes a random fraction up to that much off each wait,
+// so that many peers losing the same server do not all return at once.
+type ExponentialRetry struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+// NextDelay implements RetryPolicy.
+func (r ExponentialRetry) NextDelay(attempt int) time.Duration {
+	d := r.Min
+	for i := 0; i < attempt && d > 0 && d < r.limit(); i++ {
+		d *= 2
+	}
+	if d > r.limit() {
+		d = r.limit()
+	}
+	if r.Jitter > 0 && r.Jitter <= 1 {
+		d -= time.Duration(rand.Float64() * r.Jitter * float64(d))
+	}
+	return d
+}
+
+func (r ExponentialRetry) limit() time.Duration {
+	if r.Max > 0 {
+		return r.Max
+	}
+	return maxRetryDelay
+}
+
+// Reset implements RetryPolicy.
+func (ExponentialRetry) Reset() {}
+
+// FibonacciRetry is a RetryPolicy growing the wait after each failed
+// attempt as the Fibonacci numbers do (Min, Min, 2*Min, 3*Min, 5*Min...),
+// up to Max (if not zero).  This backs off more gently than doubling.
+type FibonacciRetry struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// NextDelay implements RetryPolicy.
+func (r FibonacciRetry) NextDelay(attempt int) time.Duration {
+	limit := r.Max
+	if limit <= 0 {
+		limit = maxRetryDelay
+	}
+	prev, d := time.Duration(0), r.Min
+	for i := 0; i < attempt && d > 0 && d < limit; i++ {
+		prev, d = d, prev+d
+	}
+	if d > limit {
+		d = limit
+	}
+	return d
+}
+
+// Reset implements RetryPolicy.
+func (FibonacciRetry) Reset() {}
+
+// maxRetryDelay caps the stock policies with no Max, well short of
+// overflowing.
+const maxRetryDelay = time.Hour * 24
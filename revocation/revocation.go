@@ -0,0 +1,302 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package revocation provides checks of certificate revocation status,
+// using certificate revocation lists (CRLs) or OCSP, for use with the
+// mangos.OptionTLSRevocation option.  It also provides a Stapler, which
+// obtains OCSP responses for a listener to staple to its handshakes
+// (see mangos.OptionTLSOCSPStaple).
+package revocation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"nanomsg.org/go/mangos/v2"
+)
+
+// clockSkew is how far our clock may differ from those of issuers and
+// responders, when judging whether what they say is current.
+const clockSkew = time.Minute * 5
+
+// current returns true if information issued at thisUpdate, and to be
+// replaced by nextUpdate (if that is not zero), may be relied upon now.
+func current(thisUpdate, nextUpdate time.Time) bool {
+	now := time.Now()
+	if thisUpdate.After(now.Add(clockSkew)) {
+		return false
+	}
+	return nextUpdate.IsZero() || now.Before(nextUpdate.Add(clockSkew))
+}
+
+// CRL is a mangos.RevocationChecker using certificate revocation lists.
+// Lists may be added (or replaced with newer ones) at any time.  A list
+// past its NextUpdate time, or not yet valid, is still believed about
+// the certificates it revokes, but not about those it does not; for
+// them it is as if there were no list.
+type CRL struct {
+	// Strict causes certificates for whose issuer there is no list to
+	// be refused, with mangos.ErrTLSNoStatus.  Otherwise they pass.
+	Strict bool
+
+	lists map[string]*x509.RevocationList
+	sync.Mutex
+}
+
+// NewCRL returns a CRL checker using the given lists.
+func NewCRL(lists ...*x509.RevocationList) *CRL {
+	c := &CRL{lists: make(map[string]*x509.RevocationList)}
+	for _, l := range lists {
+		c.Add(l)
+	}
+	return c
+}
+
+// Add adds a revocation list, replacing any held for the same issuer.
+func (c *CRL) Add(l *x509.RevocationList) {
+	c.Lock()
+	c.lists[string(l.RawIssuer)] = l
+	c.Unlock()
+}
+
+// CheckRevocation implements mangos.RevocationChecker.
+func (c *CRL) CheckRevocation(cert, issuer *x509.Certificate, _ []byte) error {
+	c.Lock()
+	l, ok := c.lists[string(cert.RawIssuer)]
+	c.Unlock()
+	if !ok {
+		if c.Strict {
+			return mangos.ErrTLSNoStatus
+		}
+		return nil
+	}
+	// A list we cannot vouch for tells us nothing.
+	if issuer != nil {
+		if err := l.CheckSignatureFrom(issuer); err != nil {
+			if c.Strict {
+				return mangos.ErrTLSNoStatus
+			}
+			return nil
+		}
+	}
+	for _, e := range l.RevokedCertificateEntries {
+		if e.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return mangos.ErrTLSRevoked
+		}
+	}
+	// A certificate may have been revoked since a stale list.
+	if c.Strict && !current(l.ThisUpdate, l.NextUpdate) {
+		return mangos.ErrTLSNoStatus
+	}
+	return nil
+}
+
+// OCSP is a mangos.RevocationChecker using OCSP.  A response stapled by
+// the peer is used if there is one; otherwise the responder named in the
+// certificate is asked.  Responses past their NextUpdate time, or not
+// yet valid, are disregarded, allowing a few minutes for clocks that
+// disagree.  Responses are cached until their NextUpdate time, and not
+// at all if they have none.
+type OCSP struct {
+	// Client is used to query responders.  If nil, a client with a
+	// ten second timeout is used.
+	Client *http.Client
+
+	// Strict causes certificates whose status cannot be had (e.g. for
+	// want of an issuer, or because the responder is unreachable) to
+	// be refused with mangos.ErrTLSNoStatus.  Otherwise these "soft
+	// fail", and are accepted.
+	Strict bool
+
+	cache map[string]*ocsp.Response
+	sync.Mutex
+}
+
+var defaultClient = &http.Client{Timeout: time.Second * 10}
+
+func (o *OCSP) cached(key string) *ocsp.Response {
+	o.Lock()
+	defer o.Unlock()
+	if r, ok := o.cache[key]; ok {
+		if time.Now().Before(r.NextUpdate) {
+			return r
+		}
+		delete(o.cache, key)
+	}
+	return nil
+}
+
+func (o *OCSP) store(key string, r *ocsp.Response) {
+	if r.NextUpdate.IsZero() {
+		return
+	}
+	o.Lock()
+	if o.cache == nil {
+		o.cache = make(map[string]*ocsp.Response)
+	}
+	o.cache[key] = r
+	o.Unlock()
+}
+
+// CheckRevocation implements mangos.RevocationChecker.
+func (o *OCSP) CheckRevocation(cert, issuer *x509.Certificate, staple []byte) error {
+	if issuer == nil {
+		return o.unknown()
+	}
+	// A stapled response is the freshest word we have, so it takes
+	// precedence over anything cached.
+	var r *ocsp.Response
+	key := string(cert.RawIssuer) + cert.SerialNumber.String()
+	if len(staple) > 0 {
+		sr, err := ocsp.ParseResponseForCert(staple, cert, issuer)
+		if err == nil && current(sr.ThisUpdate, sr.NextUpdate) {
+			r = sr
+		}
+	}
+	if r == nil {
+		r = o.cached(key)
+	}
+	if r == nil {
+		client := o.Client
+		if client == nil {
+			client = defaultClient
+		}
+		qr, _, err := query(client, cert, issuer)
+		if err != nil || !current(qr.ThisUpdate, qr.NextUpdate) {
+			return o.unknown()
+		}
+		r = qr
+	}
+	switch r.Status {
+	case ocsp.Good:
+		o.store(key, r)
+		return nil
+	case ocsp.Revoked:
+		o.store(key, r)
+		return mangos.ErrTLSRevoked
+	}
+	return o.unknown()
+}
+
+func (o *OCSP) unknown() error {
+	if o.Strict {
+		return mangos.ErrTLSNoStatus
+	}
+	return nil
+}
+
+// errNoResponder is returned by Query when the certificate names no
+// OCSP responder.
+var errNoResponder = errors.New("no OCSP responder")
+
+// query asks the first OCSP responder named in cert for its status,
+// returning the parsed response, and the response as received.
+func query(client *http.Client, cert, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, nil, errNoResponder
+	}
+	req, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{
+		Hash: crypto.SHA256,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Post(cert.OCSPServer[0], "application/ocsp-request",
+		bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.New("OCSP responder: " + resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := ocsp.ParseResponseForCert(b, cert, issuer)
+	return r, b, err
+}
+
+// Stapler obtains OCSP responses for a listener's certificates, for use
+// with mangos.OptionTLSOCSPStaple.  Responses are fetched from the
+// responder named in the certificate, and kept until half way to their
+// NextUpdate time (or an hour if they have none), so that a fresh one is
+// always at hand.  The certificate chain must include the issuer.
+type Stapler struct {
+	// Client is used to query responders.  If nil, a client with a
+	// ten second timeout is used.
+	Client *http.Client
+
+	staples map[string]*staple // by serial number
+	sync.Mutex
+}
+
+type staple struct {
+	der     []byte
+	refresh time.Time
+}
+
+// Staple returns the OCSP response to staple for cert.
+func (s *Stapler) Staple(cert *tls.Certificate) ([]byte, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("certificate chain lacks issuer")
+	}
+	leaf := cert.Leaf
+	var err error
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.staples == nil {
+		s.staples = make(map[string]*staple)
+	}
+	serial := leaf.SerialNumber.String()
+	if st, ok := s.staples[serial]; ok && time.Now().Before(st.refresh) {
+		return st.der, nil
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	client := s.Client
+	if client == nil {
+		client = defaultClient
+	}
+	r, der, err := query(client, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if !current(r.ThisUpdate, r.NextUpdate) {
+		// Peers would only disregard it.
+		return nil, errors.New("OCSP response is not current")
+	}
+	refresh := time.Now().Add(time.Hour)
+	if !r.NextUpdate.IsZero() {
+		refresh = time.Now().Add(time.Until(r.NextUpdate) / 2)
+	}
+	s.staples[serial] = &staple{der: der, refresh: refresh}
+	return der, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shutdown implements the coordinated shutdown (or other control)
+// broadcast, where one party announces a message to a known set of peers,
+// and waits until every one of them has acknowledged it before going on.
+//
+// The coordinator calls Broadcast, and each peer calls Acknowledge with
+// its own name.  Either SURVEYOR/RESPONDENT or BUS sockets may be used.
+// With SURVEYOR, each round is a fresh survey, answered by the peers
+// that hear it.  With BUS, the peers should be connected only to the
+// coordinator, as acknowledgments are themselves broadcast, and the
+// socket should be dedicated to the exchange.
+//
+// Peers that miss a round (because they were not yet connected, or the
+// message was dropped) are given another, so peers must be prepared to
+// see the message, and acknowledge it, more than once.
+package shutdown
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// DefaultRetryTime is how often the message is sent again on BUS, for
+// peers that have yet to acknowledge it.  On SURVEYOR, the survey time
+// (mangos.OptionSurveyTime) is used instead.
+var DefaultRetryTime = time.Second
+
+// Error is returned by Broadcast when some peers did not acknowledge
+// the message in time.
+type Error struct {
+	// Missing are the names of the peers that did not acknowledge.
+	Missing []string
+}
+
+func (e *Error) Error() string {
+	return "no acknowledgment from: " + strings.Join(e.Missing, ", ")
+}
+
+// Unwrap returns mangos.ErrRecvTimeout, so that errors.Is may be used.
+func (e *Error) Unwrap() error {
+	return mangos.ErrRecvTimeout
+}
+
+type waiter struct {
+	want map[string]bool
+}
+
+func (w *waiter) ack(m *mangos.Message) {
+	delete(w.want, string(m.Body))
+	m.Free()
+}
+
+func (w *waiter) err() error {
+	if len(w.want) == 0 {
+		return nil
+	}
+	e := &Error{}
+	for name := range w.want {
+		e.Missing = append(e.Missing, name)
+	}
+	sort.Strings(e.Missing)
+	return e
+}
+
+// Broadcast sends body on s, which must be a SURVEYOR or BUS socket, and
+// waits until each of the named peers has acknowledged it, sending it
+// again as needed.  If that has not happened within timeout, an *Error
+// naming the missing peers is returned.
+func Broadcast(s mangos.Socket, body []byte, peers []string, timeout time.Duration) error {
+	w := &waiter{want: make(map[string]bool)}
+	for _, name := range peers {
+		w.want[name] = true
+	}
+	switch s.Info().Self {
+	case mangos.ProtoSurveyor:
+		return w.survey(s, body, time.Now().Add(timeout))
+	case mangos.ProtoBus:
+		return w.bus(s, body, time.Now().Add(timeout))
+	}
+	return mangos.ErrBadProto
+}
+
+// survey runs the exchange on a context of its own, leaving the socket
+// free for other use.
+func (w *waiter) survey(s mangos.Socket, body []byte, expire time.Time) error {
+	c, err := s.OpenContext()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for len(w.want) > 0 {
+		left := time.Until(expire)
+		if left <= 0 {
+			break
+		}
+		v, err := c.GetOption(mangos.OptionSurveyTime)
+		if err != nil {
+			return err
+		}
+		if d := v.(time.Duration); d > left {
+			c.SetOption(mangos.OptionSurveyTime, left)
+		}
+		if err = c.Send(body); err != nil {
+			return err
+		}
+		for len(w.want) > 0 {
+			m, err := c.RecvMsg()
+			if err == mangos.ErrProtoState || err == mangos.ErrRecvTimeout {
+				// Survey expired; start another round.
+				break
+			}
+			if err != nil {
+				return err
+			}
+			w.ack(m)
+		}
+	}
+	return w.err()
+}
+
+// bus uses the socket itself, as BUS has no contexts.  The receive
+// deadline is borrowed for the duration, and restored afterwards.
+func (w *waiter) bus(s mangos.Socket, body []byte, expire time.Time) error {
+	v, err := s.GetOption(mangos.OptionRecvDeadline)
+	if err != nil {
+		return err
+	}
+	defer s.SetOption(mangos.OptionRecvDeadline, v)
+
+	for len(w.want) > 0 {
+		left := time.Until(expire)
+		if left <= 0 {
+			break
+		}
+		if left > DefaultRetryTime {
+			left = DefaultRetryTime
+		}
+		if err = s.Send(body); err != nil {
+			return err
+		}
+		round := time.Now().Add(left)
+		for len(w.want) > 0 {
+			left = time.Until(round)
+			if left <= 0 {
+				break
+			}
+			if err = s.SetOption(mangos.OptionRecvDeadline, left); err != nil {
+				return err
+			}
+			m, err := s.RecvMsg()
+			if err == mangos.ErrRecvTimeout {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			w.ack(m)
+		}
+	}
+	return w.err()
+}
+
+// Acknowledge waits for a message from the coordinator on s, which must
+// be a RESPONDENT or BUS socket, acknowledges it under the given name,
+// and returns its body.  The receive deadline of s applies.
+func Acknowledge(s mangos.Socket, name string) ([]byte, error) {
+	switch s.Info().Self {
+	case mangos.ProtoRespondent, mangos.ProtoBus:
+	default:
+		return nil, mangos.ErrBadProto
+	}
+	body, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if err = s.Send([]byte(name)); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
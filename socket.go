@@ -14,6 +14,10 @@
 
 package mangos
 
+import (
+	"context"
+)
+
 // Socket is the main access handle applications use to access the SP
 // system.  It is an abstraction of an application's "connection" to a
 // messaging topology.  Applications can have more than one Socket open
@@ -27,6 +31,15 @@ type Socket interface {
 	// will return ErrClosed.
 	Close() error
 
+	// Drain closes the Socket gracefully.  New connections are refused,
+	// and new sends and receives fail with ErrClosed, except that REP
+	// and RESPONDENT sockets may still answer requests already
+	// received.  Drain waits for those answers, and for the send queues
+	// to be flushed to the transport, and then closes the Socket.  If
+	// ctx is done first, the Socket is closed anyway, and the context's
+	// error is returned.
+	Drain(ctx context.Context) error
+
 	// Send puts the message on the outbound send queue.  It blocks
 	// until the message can be queued, or the send deadline expires.
 	// If a queued message is later dropped for any reason,
@@ -41,14 +54,43 @@ type Socket interface {
 	// ASSUMES OWNERSHIP OF THE MESSAGE.
 	SendMsg(*Message) error
 
+	// SendMsgs sends the messages in order, as SendMsg would, but
+	// with less overhead for each, and lets the pipes write them out
+	// together, so that many small messages take fewer system calls.
+	// The Socket ASSUMES OWNERSHIP OF EVERY MESSAGE, sent or not: if
+	// one cannot be sent, it stops there, frees that message and those
+	// after it, and returns the error.
+	SendMsgs([]*Message) error
+
+	// Flush writes at once whatever the pipes are holding back to send
+	// together, as they do for OptionCoalesceTime, for a caller that
+	// cares more for the latency of what it has just sent.  Messages
+	// still queued by the protocol are not waited for; they are written
+	// as the pipes take them.  A pipe that cannot be written to is
+	// closed, as when a send fails.
+	Flush() error
+
 	// RecvMsg receives a complete message, including the message header,
 	// which is useful for protocols in raw mode.
 	RecvMsg() (*Message, error)
 
+	// RecvMsgs works like RecvMsg, but returns up to max messages at
+	// once: it waits for the first, and then takes those already queued
+	// behind it without waiting further.  This saves per-message
+	// overhead for consumers needing high throughput.  Receive hooks run
+	// for each message; if one fails, those before it are returned
+	// with the error, and those after it are kept, to be returned
+	// first by the next RecvMsgs or RecvMsg.
+	RecvMsgs(max int) ([]*Message, error)
+
 	// Dial connects a remote endpoint to the Socket.  The function
 	// returns immediately, and an asynchronous goroutine is started to
 	// establish and maintain the connection, reconnecting as needed.
-	// If the address is invalid, then an error is returned.
+	// If the address is invalid, then an error is returned.  An address
+	// whose scheme has "+srv" added, as in
+	// "tcp+srv://_sp._tcp.example.com", names DNS SRV records instead:
+	// each of their targets is dialed, with the scheme without "+srv",
+	// and the records are looked up again every OptionResolveInterval.
 	Dial(addr string) error
 
 	DialOptions(addr string, options map[string]interface{}) error
@@ -61,6 +103,11 @@ type Socket interface {
 	// may connect (e.g. with Dial) and will each be "connected" to
 	// the Socket.  The accepter logic is run in a separate goroutine.
 	// The only error possible is if the address is invalid.
+	// Several addresses may be given, separated by commas (for example
+	// "tcp://0.0.0.0:5555,ipc:///tmp/svc.sock"), creating a listener
+	// for each; either all of them are listening on return, or none
+	// are, and the error is an AddrErrors describing each failure.
+	// (ListenOptions applies the same options to every listener.)
 	Listen(addr string) error
 
 	ListenOptions(addr string, options map[string]interface{}) error
@@ -82,6 +129,159 @@ type Socket interface {
 	// The previous hook is returned (nil if none.)  (Only one hook can
 	// be used at a time.)
 	SetPipeEventHook(PipeEventHook) PipeEventHook
+
+	// SetWatchdogHook sets a WatchdogHook function to be called when
+	// the watchdog (see OptionWatchdogTime) detects that the socket has
+	// stalled.  The previous hook is returned (nil if none.)
+	SetWatchdogHook(WatchdogHook) WatchdogHook
+
+	// SetAuthHook sets an AuthHook function to be called for each
+	// new Pipe, whether accepted by a listener or connected by a
+	// dialer, before it is attached.  The previous hook is returned
+	// (nil if none.)
+	SetAuthHook(AuthHook) AuthHook
+
+	// SetErrorHandler sets an ErrorHandler function to be called for
+	// errors that happen in the background, where there is no caller
+	// to return them to: failed dials and accepts, connections that
+	// are rejected, and pipes that fail.  The previous handler is
+	// returned (nil if none.)
+	SetErrorHandler(ErrorHandler) ErrorHandler
+
+	// AddSendHook adds a MessageHook to those run on each message sent,
+	// by SendMsg and Send, and by the sockets's contexts.  Hooks run in
+	// the order they were added, each given the message the one before
+	// returned, before the message reaches the protocol.
+	AddSendHook(MessageHook)
+
+	// AddRecvHook adds a MessageHook to those run on each message
+	// received, after the protocol has done with it, and before it is
+	// returned by RecvMsg or Recv.  These too run in the order added, so
+	// hooks that undo what send hooks did (such as decrypting) should be
+	// added in the reverse order of those.
+	AddRecvHook(MessageHook)
+
+	// Stats returns a snapshot of the counters kept for the socket.
+	Stats() Stats
+
+	// Endpoints describes the socket's dialers and listeners, in the
+	// order they were created.
+	Endpoints() []EndpointInfo
+
+	// Pipes describes the socket's connected pipes, in order of ID.
+	Pipes() []PipeInfo
+
+	// Debug returns the internal state of the protocol: the requests
+	// awaiting answers, the subscriptions, what is queued for each
+	// pipe, and the like.  It is for diagnosing a socket that seems to
+	// be stuck.
+	Debug() ProtocolState
+
+	// ClosePipe closes the connected pipe with the given ID, as when
+	// shedding a peer that is not keeping up.  A dialer reconnects as
+	// usual.  It returns ErrClosed if there is no such pipe.
+	ClosePipe(id uint32) error
+
+	// Serve receives messages, and calls the handler with each, until
+	// the socket is closed.  OptionServeWorkers handlers may run at
+	// once.  Messages that fail to arrive (for example, rejected by a
+	// receive hook) are reported to the Logger and passed over, as
+	// are receive timeouts.  Serve returns nil once the socket has been
+	// closed (or drained) and every handler has returned, or an error
+	// if the protocol cannot receive, as for a SURVEYOR with no survey.
+	Serve(Handler) error
+
+	// ServeReply is Serve for protocols that answer what they receive,
+	// such as REP and RESPONDENT.  Each handler's reply, unless nil, is
+	// sent back, on a Context of its own where the protocol has them,
+	// so that handlers may run at once.  Draining the socket lets
+	// the handlers running answer before it closes.
+	ServeReply(ReplyHandler) error
+
+	// ReaderOnly returns a view of the Socket that can only receive, to
+	// hand to code that should not send, close, or configure it.
+	ReaderOnly() SocketReader
+
+	// WriterOnly returns a view of the Socket that can only send.
+	WriterOnly() SocketWriter
+}
+
+// SocketReader is the receiving half of a Socket, as returned by
+// Socket.ReaderOnly.  Its methods work as the Socket's do; for a protocol
+// that cannot receive, such as PUB or PUSH, they return ErrProtoOp.
+type SocketReader interface {
+	Info() ProtocolInfo
+	Recv() ([]byte, error)
+	RecvMsg() (*Message, error)
+	RecvMsgs(max int) ([]*Message, error)
+}
+
+// SocketWriter is the sending half of a Socket, as returned by
+// Socket.WriterOnly.  Its methods work as the Socket's do; for a protocol
+// that cannot send, such as SUB or PULL, they return ErrProtoOp.
+type SocketWriter interface {
+	Info() ProtocolInfo
+	Send([]byte) error
+	SendMsg(*Message) error
+	SendMsgs([]*Message) error
+	Flush() error
+}
+
+// Handler is called by Socket.Serve with each message received.  It owns
+// the message, and should Free it when done.
+type Handler func(m *Message)
+
+// ReplyHandler is called by Socket.ServeReply with each message received,
+// and returns the reply to send, or nil to send none.  It owns the
+// message it is given, which it may return as the reply.
+type ReplyHandler func(m *Message) *Message
+
+// WatchdogHook is an application supplied function to be called when
+// the socket watchdog detects a stall, typically indicating a wedged
+// pipe or a consumer that has stopped receiving.  It is called on its
+// own goroutine, and may safely close the socket.
+type WatchdogHook func(Socket)
+
+// AuthHook is an application supplied function used to authorize new
+// connections.  It is called with the Pipe before it is attached to the
+// socket, and may examine the transport metadata with GetOption (for
+// example OptionRemoteAddr, or OptionTLSConnState), as well as whether
+// the Pipe came from a Dialer or a Listener.  This gives a single place
+// to apply IP allow lists and similar policies, regardless of transport.
+// If it returns an error, the connection is refused (the Pipe is closed)
+// and the pipe event hook is called with PipeEventRejected.  The hook is
+// called synchronously, and should not block for long, as that will
+// stall further connections on the same listener or dialer.
+type AuthHook func(Pipe) error
+
+// ErrorHandler is an application supplied function called with each
+// background error, and the dialer or listener it came from, so that a
+// supervisor can react to it (raising an alert, failing over, or exiting).
+// The errors are those that the Logger is given, mapped where possible to
+// mangos errors such as ErrConnRefused.  It is called on its own
+// goroutine, and may safely close the socket.
+type ErrorHandler func(err error, ep EndpointInfo)
+
+// MessageHook is an application supplied function run on each message
+// sent or received, as added with Socket.AddSendHook or AddRecvHook, for
+// things such as encryption, compression, metrics, and validation.  It
+// returns the message to pass on, which may be the same one, modified,
+// or another one.  It may return a nil message, and no error, to drop
+// the message quietly: sending then succeeds without it, and receiving
+// waits for the next; these are counted in Stats.HookDropped.  If it
+// returns an error, the message is dropped, and the send or receive
+// fails with that error.  A message the hook does not pass on is its
+// own, and the socket does not free it, so a hook that drops a message
+// must Free it (unless it has kept it for later).  Hooks are called
+// on the goroutine sending or receiving, so should not block for long.
+type MessageHook func(*Message) (*Message, error)
+
+// Logger is used with OptionLogger to report errors that would otherwise
+// go unseen.  A *log.Logger satisfies it.  It may be called from any
+// goroutine, sometimes once per message (when messages are being dropped),
+// so it should be cheap.
+type Logger interface {
+	Printf(format string, v ...interface{})
 }
 
 // Context is a protocol context, and represents the upper side operations
@@ -118,4 +318,12 @@ type Context interface {
 	// RecvMsg receives a complete message, including the message header,
 	// which is useful for protocols in raw mode.
 	RecvMsg() (*Message, error)
+
+	// Cancel abandons the request outstanding on the context, if any.
+	// It is no longer sent again, a Send or Recv waiting for it returns
+	// ErrCanceled, and a reply that arrives for it later is discarded
+	// (or given to OptionReplyMismatch).  This may be called from
+	// another goroutine, as when a context.Context is done.  Only REQ
+	// contexts have requests to cancel; others return ErrProtoOp.
+	Cancel() error
 }
@@ -0,0 +1,400 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// spbench measures the throughput and latency of mangos, for each
+// combination of protocol, transport and message size requested.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/droundy/goopt"
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/all"
+)
+
+// A bench describes a protocol pairing.  Round trip benchmarks measure
+// the time for a request and its reply, the others the time from send
+// to receipt, by way of a timestamp carried in the message.  Lossy
+// protocols drop messages when the receiver cannot keep up, so for
+// those the rate is of messages actually received.
+type bench struct {
+	server    func() (mangos.Socket, error)
+	client    func() (mangos.Socket, error)
+	roundTrip bool
+	lossy     bool
+}
+
+var benches = map[string]bench{
+	"pair":     {pair.NewSocket, pair.NewSocket, false, false},
+	"reqrep":   {rep.NewSocket, req.NewSocket, true, false},
+	"pipeline": {pull.NewSocket, push.NewSocket, false, false},
+	"pubsub":   {sub.NewSocket, pub.NewSocket, false, true},
+	"bus":      {bus.NewSocket, bus.NewSocket, false, true},
+}
+
+// lossyWait is how long the receiver waits for a further message from
+// a lossy protocol before concluding that the rest were dropped.
+var lossyWait = time.Millisecond * 500
+
+// Addresses with a %d get a fresh one for each run, so that one run
+// cannot see the remnants of the last.
+var addrs = map[string]string{
+	"inproc": "inproc://spbench%d",
+	"ipc":    "ipc://spbench%d.sock",
+	"tcp":    "tcp://127.0.0.1:40890",
+	"tls":    "tls+tcp://127.0.0.1:40891",
+	"ws":     "ws://127.0.0.1:40892/spbench",
+	"wss":    "wss://127.0.0.1:40893/spbench",
+}
+
+var protos = []string{"pair", "reqrep", "pipeline", "pubsub", "bus"}
+var trans = []string{"inproc", "ipc", "tcp"}
+var sizes = []int{64, 1024, 65536}
+var count = 10000
+var csv bool
+var srvCfg, cliCfg *tls.Config
+var runs int
+
+func setList(names *[]string, valid map[string]string) func(string) error {
+	return func(s string) error {
+		var list []string
+		for _, n := range strings.Split(s, ",") {
+			if _, ok := valid[n]; !ok {
+				return errors.New("unknown name " + n)
+			}
+			list = append(list, n)
+		}
+		*names = list
+		return nil
+	}
+}
+
+func setSizes(s string) error {
+	var list []int
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errors.New("bad size " + v)
+		}
+		list = append(list, n)
+	}
+	sizes = list
+	return nil
+}
+
+func setCount(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return errors.New("value not a positive number")
+	}
+	count = n
+	return nil
+}
+
+func init() {
+	names := make(map[string]string)
+	for n := range benches {
+		names[n] = n
+	}
+	goopt.ReqArg([]string{"--proto", "-p"}, "LIST",
+		"Benchmark the comma separated protocols in LIST "+
+			"(default pair,reqrep,pipeline,pubsub,bus)",
+		setList(&protos, names))
+	goopt.ReqArg([]string{"--transport", "-T"}, "LIST",
+		"Benchmark the comma separated transports in LIST "+
+			"(default inproc,ipc,tcp)",
+		setList(&trans, addrs))
+	goopt.ReqArg([]string{"--size", "-s"}, "LIST",
+		"Use the comma separated message sizes in LIST "+
+			"(default 64,1024,65536)",
+		setSizes)
+	goopt.ReqArg([]string{"--count", "-n"}, "COUNT",
+		"Send COUNT messages for each benchmark (default 10000)",
+		setCount)
+	goopt.NoArg([]string{"--csv"}, "Report results as CSV",
+		func() error {
+			csv = true
+			return nil
+		})
+	goopt.Description = func() string {
+		return `The spbench command measures the throughput and latency
+of mangos for each combination of protocol, transport, and message size
+given, reporting messages per second, the 50th and 99th percentile
+latencies, and the allocations made per message.`
+	}
+	goopt.Author = "The Mangos Authors"
+	goopt.Version = ""
+	goopt.Suite = "mangos"
+	goopt.Summary = "benchmark SP protocols and transports"
+}
+
+func fatalf(f string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "spbench: %s\n", fmt.Sprintf(f, args...))
+	os.Exit(1)
+}
+
+// newTLSConfigs makes a throwaway self-signed certificate, good enough
+// to benchmark the TLS transports with.
+func newTLSConfigs() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	srvCfg = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	cliCfg = &tls.Config{InsecureSkipVerify: true}
+	return nil
+}
+
+type result struct {
+	proto string
+	tran  string
+	size  int
+	rate  float64
+	p50   time.Duration
+	p99   time.Duration
+	alloc float64
+}
+
+func percentile(lat []time.Duration, p int) time.Duration {
+	if len(lat) == 0 {
+		return 0
+	}
+	return lat[(len(lat)-1)*p/100]
+}
+
+func address(tran string) string {
+	if a := addrs[tran]; strings.Contains(a, "%d") {
+		return fmt.Sprintf(a, runs)
+	}
+	return addrs[tran]
+}
+
+// connect sets up the server and client sockets.  The server listens,
+// as it is the receiving side for all but the round trip protocols.
+func connect(b bench, tran string) (srv, cli mangos.Socket, err error) {
+	if srv, err = b.server(); err != nil {
+		return
+	}
+	if cli, err = b.client(); err != nil {
+		srv.Close()
+		return
+	}
+	opts := make(map[string]interface{})
+	if tran == "tls" || tran == "wss" {
+		opts[mangos.OptionTLSConfig] = srvCfg
+	}
+	addr := address(tran)
+	if err = srv.ListenOptions(addr, opts); err != nil {
+		srv.Close()
+		cli.Close()
+		return
+	}
+	if tran == "tls" || tran == "wss" {
+		opts[mangos.OptionTLSConfig] = cliCfg
+	}
+	if err = cli.DialOptions(addr, opts); err != nil {
+		srv.Close()
+		cli.Close()
+		return
+	}
+	if srv.Info().Self == mangos.ProtoSub {
+		srv.SetOption(mangos.OptionSubscribe, []byte{})
+	}
+	// Give the pipes time to attach, so that nothing is dropped.
+	time.Sleep(time.Millisecond * 100)
+	return
+}
+
+func run(name string, tran string, size int) (*result, error) {
+	b := benches[name]
+	runs++
+	srv, cli, err := connect(b, tran)
+	if err != nil {
+		return nil, err
+	}
+	defer srv.Close()
+	defer cli.Close()
+	if tran == "ipc" {
+		defer os.Remove(strings.TrimPrefix(address(tran), "ipc://"))
+	}
+
+	// One way latency needs room for the send time.
+	if !b.roundTrip && size < 8 {
+		size = 8
+	}
+	lat := make([]time.Duration, 0, count)
+	errq := make(chan error, 1)
+	if b.lossy {
+		srv.SetOption(mangos.OptionRecvDeadline, lossyWait)
+	}
+	var last time.Time
+	var ms0, ms1 runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms0)
+	start := time.Now()
+
+	if b.roundTrip {
+		go func() {
+			for {
+				m, err := srv.RecvMsg()
+				if err != nil {
+					return
+				}
+				if err = srv.SendMsg(m); err != nil {
+					return
+				}
+			}
+		}()
+		for i := 0; i < count; i++ {
+			m := mangos.NewMessage(size)
+			m.Body = m.Body[:size]
+			t0 := time.Now()
+			if err = cli.SendMsg(m); err != nil {
+				return nil, err
+			}
+			if m, err = cli.RecvMsg(); err != nil {
+				return nil, err
+			}
+			lat = append(lat, time.Since(t0))
+			m.Free()
+		}
+	} else {
+		go func() {
+			for i := 0; i < count; i++ {
+				m, err := srv.RecvMsg()
+				if err == mangos.ErrRecvTimeout && b.lossy {
+					break
+				}
+				if err != nil {
+					errq <- err
+					return
+				}
+				last = time.Now()
+				t0 := int64(binary.BigEndian.Uint64(m.Body))
+				lat = append(lat, time.Duration(last.UnixNano()-t0))
+				m.Free()
+			}
+			errq <- nil
+		}()
+		for i := 0; i < count; i++ {
+			m := mangos.NewMessage(size)
+			m.Body = m.Body[:size]
+			binary.BigEndian.PutUint64(m.Body, uint64(time.Now().UnixNano()))
+			if err = cli.SendMsg(m); err != nil {
+				return nil, err
+			}
+		}
+		if err = <-errq; err != nil {
+			return nil, err
+		}
+	}
+
+	elapsed := time.Since(start)
+	if !b.roundTrip {
+		elapsed = last.Sub(start)
+	}
+	runtime.ReadMemStats(&ms1)
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	return &result{
+		proto: name,
+		tran:  tran,
+		size:  size,
+		rate:  float64(len(lat)) / elapsed.Seconds(),
+		p50:   percentile(lat, 50),
+		p99:   percentile(lat, 99),
+		alloc: float64(ms1.Mallocs-ms0.Mallocs) / float64(count),
+	}, nil
+}
+
+func report(r *result) {
+	if csv {
+		fmt.Printf("%s,%s,%d,%.0f,%d,%d,%.1f\n", r.proto, r.tran,
+			r.size, r.rate, r.p50.Nanoseconds(), r.p99.Nanoseconds(),
+			r.alloc)
+		return
+	}
+	fmt.Printf("%-9s %-7s %7d %12.0f %12v %12v %9.1f\n", r.proto, r.tran,
+		r.size, r.rate, r.p50, r.p99, r.alloc)
+}
+
+func main() {
+	goopt.Parse(nil)
+	if len(goopt.Args) != 0 {
+		fmt.Fprintln(os.Stderr, goopt.Usage())
+		os.Exit(2)
+	}
+	if err := newTLSConfigs(); err != nil {
+		fatalf("Failed creating TLS config: %v", err)
+	}
+	if csv {
+		fmt.Println("proto,transport,size,msgs/sec,p50ns,p99ns,allocs/msg")
+	} else {
+		fmt.Printf("%-9s %-7s %7s %12s %12s %12s %9s\n", "PROTO",
+			"TRAN", "SIZE", "MSGS/SEC", "P50", "P99", "ALLOCS")
+	}
+	for _, p := range protos {
+		for _, t := range trans {
+			for _, sz := range sizes {
+				r, err := run(p, t, sz)
+				if err != nil {
+					fatalf("%s over %s failed: %v", p, t, err)
+				}
+				report(r)
+			}
+		}
+	}
+}
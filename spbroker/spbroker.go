@@ -0,0 +1,137 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// spbroker runs the devices described in a configuration file, as a
+// central point for SP peers to meet.
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+import (
+	"github.com/droundy/goopt"
+	"nanomsg.org/go/mangos/v2/broker"
+)
+
+var verbose int
+var configFile string
+var interval = time.Minute
+
+func init() {
+	goopt.NoArg([]string{"--verbose", "-v"}, "Increase verbosity",
+		func() error {
+			verbose++
+			return nil
+		})
+	goopt.ReqArg([]string{"--config", "-c"}, "FILE",
+		"Read the devices to run from FILE",
+		func(path string) error {
+			configFile = path
+			return nil
+		})
+	goopt.ReqArg([]string{"--stats", "-s"}, "DUR",
+		"With --verbose, log statistics every DUR (default 1m)",
+		func(s string) error {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("bad interval %q", s)
+			}
+			interval = d
+			return nil
+		})
+	goopt.Description = func() string {
+		return `The spbroker command runs the SP (nanomsg) devices described
+in the file given with --config: REQ/REP proxies, PUB/SUB forwarders,
+BUS hubs and bridges, and the like, so that peers need only know where
+the broker is.  If the file names an admin address, statistics are served
+there over HTTP, as JSON at /stats and for Prometheus at /metrics.  It
+runs until interrupted.`
+	}
+
+	goopt.Author = "The Mangos Authors"
+
+	goopt.Suite = "mangos"
+
+	goopt.Summary = "SP device broker"
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "spbroker: "+format+"\n", v...)
+	os.Exit(1)
+}
+
+func logf(format string, v ...interface{}) {
+	if verbose > 0 {
+		fmt.Fprintf(os.Stderr, format+"\n", v...)
+	}
+}
+
+// report logs the message counts of every socket at each interval.
+func report(b *broker.Broker, done <-chan struct{}) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-done:
+			return
+		}
+		stats := b.Stats()
+		names := make([]string, 0, len(stats))
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			st := stats[name]
+			logf("%s: %d pipes, %d sent, %d received, %d dropped",
+				name, st.Pipes, st.Sent, st.Received, st.Dropped)
+		}
+	}
+}
+
+func main() {
+	goopt.Parse(nil)
+	if len(goopt.Args) != 0 || configFile == "" {
+		fatalf("A --config file must be given.")
+	}
+	cfg, err := broker.Load(configFile)
+	if err != nil {
+		fatalf("Failed reading %s: %v", configFile, err)
+	}
+	b, err := broker.Start(cfg)
+	if err != nil {
+		fatalf("Failed starting: %v", err)
+	}
+	for _, name := range b.Devices() {
+		logf("running %s", name)
+	}
+	if addr := b.AdminAddr(); addr != nil {
+		logf("admin endpoint at http://%s/", addr)
+	}
+	done := make(chan struct{})
+	if verbose > 0 {
+		go report(b, done)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	<-sigs
+	close(done)
+	b.Close()
+}
@@ -0,0 +1,604 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// spdoctor connects to an SP endpoint and reports what it finds there,
+// to help work out why a client cannot talk to it.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/droundy/goopt"
+	"github.com/gorilla/websocket"
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/star"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	_ "nanomsg.org/go/mangos/v2/transport/all"
+)
+
+var sockets = map[string]func() (mangos.Socket, error){
+	"bus":        bus.NewSocket,
+	"pair":       pair.NewSocket,
+	"pub":        pub.NewSocket,
+	"pull":       pull.NewSocket,
+	"push":       push.NewSocket,
+	"rep":        rep.NewSocket,
+	"req":        req.NewSocket,
+	"respondent": respondent.NewSocket,
+	"star":       star.NewSocket,
+	"sub":        sub.NewSocket,
+	"surveyor":   surveyor.NewSocket,
+}
+
+var verbose int
+var proto string
+var timeout = time.Second * 5
+var sampleTime = time.Second * 2
+var topicLen = 32
+var tlscfg tls.Config
+var certFile string
+var keyFile string
+var failures int
+
+func setProto(name string) error {
+	if _, ok := sockets[name]; !ok {
+		return errors.New("unknown protocol")
+	}
+	proto = name
+	return nil
+}
+
+func setSeconds(d *time.Duration) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 {
+			return errors.New("value not a positive number")
+		}
+		*d = time.Duration(v * float64(time.Second))
+		return nil
+	}
+}
+
+func setCaCert(path string) error {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tlscfg.RootCAs = x509.NewCertPool()
+	if !tlscfg.RootCAs.AppendCertsFromPEM(pem) {
+		return errors.New("unable to load CA certs")
+	}
+	return nil
+}
+
+func init() {
+	goopt.NoArg([]string{"--verbose", "-v"}, "Increase verbosity",
+		func() error {
+			verbose++
+			return nil
+		})
+	goopt.ReqArg([]string{"--proto", "-p"}, "NAME",
+		"Use protocol NAME locally (default is the peer's peer)",
+		setProto)
+	goopt.ReqArg([]string{"--timeout", "-t"}, "SEC",
+		"Give up on each step after SEC seconds (default 5)",
+		setSeconds(&timeout))
+	goopt.ReqArg([]string{"--sample", "-s"}, "SEC",
+		"Sample PUB topics for SEC seconds (default 2, 0 disables)",
+		setSeconds(&sampleTime))
+	goopt.ReqArg([]string{"--topic-len"}, "N",
+		"Treat at most N leading bytes as the topic (default 32)",
+		func(s string) error {
+			var err error
+			if topicLen, err = strconv.Atoi(s); err != nil || topicLen < 1 {
+				return errors.New("value not a positive integer")
+			}
+			return nil
+		})
+	goopt.ReqArg([]string{"--cert", "-E"}, "FILE",
+		"Use certificate in FILE for SSL/TLS",
+		func(path string) error {
+			certFile = path
+			return nil
+		})
+	goopt.ReqArg([]string{"--key"}, "FILE",
+		"Use private key in FILE for SSL/TLS",
+		func(path string) error {
+			keyFile = path
+			return nil
+		})
+	goopt.ReqArg([]string{"--cacert"}, "FILE",
+		"Use CA certicate(s) in FILE for SSL/TLS", setCaCert)
+	goopt.NoArg([]string{"--insecure", "-k"},
+		"Do not validate TLS/SSL peer certificate",
+		func() error {
+			tlscfg.InsecureSkipVerify = true
+			return nil
+		})
+	goopt.Description = func() string {
+		return `The spdoctor command connects to an SP (nanomsg)
+endpoint, given as the only argument, and reports on what it finds: the
+transport and TLS details, the protocol the peer speaks, which local
+protocols can talk to it, and (for PUB peers) a sample of the topics
+being published.  It exits non-zero if any check fails.`
+	}
+
+	goopt.Author = "The Mangos Authors"
+
+	goopt.Suite = "mangos"
+
+	goopt.Summary = "diagnose connections to SP endpoints"
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+	os.Exit(2)
+}
+
+func pass(format string, v ...interface{}) {
+	fmt.Printf("[ OK ] "+format+"\n", v...)
+}
+
+func fail(format string, v ...interface{}) {
+	failures++
+	fmt.Printf("[FAIL] "+format+"\n", v...)
+}
+
+func info(format string, v ...interface{}) {
+	fmt.Printf("       "+format+"\n", v...)
+}
+
+func debugf(format string, v ...interface{}) {
+	if verbose > 0 {
+		info(format, v...)
+	}
+}
+
+// target is the endpoint being examined.
+type target struct {
+	addr   string // as given
+	scheme string
+	host   string // host:port, or path for ipc
+	tls    bool
+	ws     bool
+}
+
+func parseTarget(addr string) (*target, error) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return nil, mangos.ErrBadAddr
+	}
+	t := &target{addr: addr, scheme: addr[:i], host: addr[i+3:]}
+	switch t.scheme {
+	case "tcp", "ipc":
+	case "tls+tcp":
+		t.tls = true
+	case "ws", "wss":
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		t.host = u.Host
+		t.ws = true
+		t.tls = t.scheme == "wss"
+	default:
+		if mangos.GetTransport(t.scheme) == nil {
+			return nil, mangos.ErrBadTran
+		}
+		return nil, errors.New("transport not supported by spdoctor")
+	}
+	return t, nil
+}
+
+// connect establishes the underlying stream, returning it along with
+// the time it took.
+func (t *target) connect() (net.Conn, time.Duration, error) {
+	network, host := "tcp", t.host
+	if t.scheme == "ipc" {
+		network = "unix"
+	} else if strings.HasPrefix(host, "*") {
+		host = host[1:]
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout(network, host, timeout)
+	return conn, time.Since(start), err
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("unknown (0x%04x)", v)
+}
+
+// checkTLS performs the TLS handshake, and reports on the results.
+func (t *target) checkTLS(conn net.Conn) (*tls.Conn, error) {
+	cfg := tlscfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(t.host)
+	}
+
+	// Do the verification ourselves, so that we can report on the
+	// certificates even when they are bad.
+	verify := !cfg.InsecureSkipVerify
+	cfg.InsecureSkipVerify = true
+	tc := tls.Client(conn, cfg)
+	tc.SetDeadline(time.Now().Add(timeout))
+	start := time.Now()
+	if err := tc.Handshake(); err != nil {
+		fail("TLS handshake: %v", err)
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	cs := tc.ConnectionState()
+	pass("TLS handshake in %v: %s, %s", time.Since(start),
+		tlsVersion(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+
+	if len(cs.PeerCertificates) == 0 {
+		fail("TLS peer presented no certificate")
+		return tc, nil
+	}
+	cert := cs.PeerCertificates[0]
+	info("subject: %s", cert.Subject)
+	info("issuer:  %s", cert.Issuer)
+	if len(cert.DNSNames) != 0 || len(cert.IPAddresses) != 0 {
+		var names []string
+		names = append(names, cert.DNSNames...)
+		for _, ip := range cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		info("names:   %s", strings.Join(names, ", "))
+	}
+	info("valid:   %s to %s", cert.NotBefore.Format(time.RFC3339),
+		cert.NotAfter.Format(time.RFC3339))
+
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		fail("TLS certificate expired %v ago", now.Sub(cert.NotAfter))
+	} else if now.Before(cert.NotBefore) {
+		fail("TLS certificate not valid for another %v",
+			cert.NotBefore.Sub(now))
+	} else if left := cert.NotAfter.Sub(now); left < time.Hour*24*30 {
+		info("certificate expires in %v", left.Round(time.Hour))
+	}
+
+	if !verify {
+		info("certificate not verified (--insecure)")
+		return tc, nil
+	}
+	opts := x509.VerifyOptions{
+		Roots:         cfg.RootCAs,
+		DNSName:       cfg.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		fail("TLS certificate verification: %v", err)
+	} else {
+		pass("TLS certificate verified for %s", cfg.ServerName)
+	}
+	return tc, nil
+}
+
+// probeSP exchanges SP headers on a stream, returning the peer's
+// protocol number.  We send the header for our own protocol (if chosen),
+// or for PAIR otherwise; peers send theirs regardless.
+func (t *target) probeSP(conn net.Conn) (uint16, error) {
+	self := uint16(mangos.ProtoPair)
+	if d, ok := mangos.ProtocolByName(proto); ok {
+		self = d.Number
+	}
+	hdr := []byte{0, 'S', 'P', 0, byte(self >> 8), byte(self), 0, 0}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	start := time.Now()
+	if _, err := conn.Write(hdr); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		if err == io.EOF {
+			err = errors.New("peer closed without sending a header" +
+				" (not an SP endpoint, or TLS expected?)")
+		}
+		return 0, err
+	}
+	rtt := time.Since(start)
+	debugf("header: % x", hdr)
+	if hdr[0] != 0 || hdr[1] != 'S' || hdr[2] != 'P' {
+		return 0, fmt.Errorf("peer sent % x, which is not an SP header"+
+			" (not an SP endpoint, or TLS expected?)", hdr)
+	}
+	if hdr[3] != 0 {
+		return 0, fmt.Errorf("peer speaks SP version %d, we know 0",
+			hdr[3])
+	}
+	if hdr[6] != 0 || hdr[7] != 0 {
+		info("peer set reserved header bytes: % x", hdr[6:])
+	}
+	pass("SP header exchange in %v (version 0)", rtt)
+	return uint16(hdr[4])<<8 | uint16(hdr[5]), nil
+}
+
+// probeWS finds the peer's protocol by offering every subprotocol.
+func (t *target) probeWS() (uint16, error) {
+	wd := &websocket.Dialer{HandshakeTimeout: timeout}
+	if t.tls {
+		cfg := tlscfg.Clone()
+		wd.TLSClientConfig = cfg
+	}
+	for _, d := range mangos.Protocols() {
+		wd.Subprotocols = append(wd.Subprotocols,
+			d.Name+".sp.nanomsg.org")
+	}
+	start := time.Now()
+	ws, resp, err := wd.Dial(t.addr, nil)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%v (HTTP %s)", err, resp.Status)
+		}
+		return 0, err
+	}
+	defer ws.Close()
+	pass("websocket upgrade in %v", time.Since(start))
+	sp := ws.Subprotocol()
+	debugf("subprotocol: %q", sp)
+	d, ok := mangos.ProtocolByName(strings.TrimSuffix(sp, ".sp.nanomsg.org"))
+	if !ok {
+		return 0, fmt.Errorf("peer selected subprotocol %q", sp)
+	}
+	return d.Number, nil
+}
+
+// probe examines the transport, returning the peer's protocol.
+func (t *target) probe() (uint16, bool) {
+	if t.ws {
+		if t.tls {
+			// Report on the TLS details separately, as that is
+			// the usual culprit.
+			conn, _, err := t.connect()
+			if err == nil {
+				t.checkTLS(conn)
+				conn.Close()
+			}
+		}
+		n, err := t.probeWS()
+		if err != nil {
+			fail("websocket: %v", err)
+			return 0, false
+		}
+		return n, true
+	}
+
+	conn, rtt, err := t.connect()
+	if err != nil {
+		fail("connect: %v", err)
+		return 0, false
+	}
+	defer conn.Close()
+	pass("connected to %s in %v", conn.RemoteAddr(), rtt)
+
+	if t.tls {
+		tc, err := t.checkTLS(conn)
+		if err != nil {
+			return 0, false
+		}
+		conn = tc
+	}
+	n, err := t.probeSP(conn)
+	if err != nil {
+		fail("SP handshake: %v", err)
+		return 0, false
+	}
+	return n, true
+}
+
+// checkPeer reports on the peer protocol, and picks the local one.
+func checkPeer(n uint16) (mangos.ProtocolDesc, bool) {
+	peer, ok := mangos.ProtocolByNumber(n)
+	if !ok {
+		fail("peer speaks unknown protocol %d (%d.%d)", n, n>>4, n&0xf)
+		return peer, false
+	}
+	pass("peer speaks %s (%d), which talks to %s", strings.ToUpper(peer.Name),
+		peer.Number, strings.ToUpper(peer.PeerName))
+
+	name := proto
+	if name == "" {
+		name = peer.PeerName
+	}
+	self, _ := mangos.ProtocolByName(name)
+	if !self.Compatible(peer.Number) {
+		fail("local protocol %s cannot talk to %s; use %s",
+			strings.ToUpper(self.Name), strings.ToUpper(peer.Name),
+			strings.ToUpper(peer.PeerName))
+		return self, false
+	}
+	opts := append([]string{}, self.Options...)
+	sort.Strings(opts)
+	info("%s options: %s", strings.ToUpper(self.Name),
+		strings.Join(opts, ", "))
+	return self, true
+}
+
+// session opens a real socket to the peer, and samples traffic where
+// that is free of side effects.
+func (t *target) session(self mangos.ProtocolDesc) {
+	sock, err := sockets[self.Name]()
+	if err != nil {
+		fail("socket: %v", err)
+		return
+	}
+	defer sock.Close()
+
+	attached := make(chan struct{}, 1)
+	sock.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventAttached {
+			select {
+			case attached <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	opts := make(map[string]interface{})
+	if t.tls {
+		cfg := tlscfg.Clone()
+		if cfg.ServerName == "" && !t.ws {
+			cfg.ServerName, _, _ = net.SplitHostPort(t.host)
+		}
+		opts[mangos.OptionTLSConfig] = cfg
+	}
+	start := time.Now()
+	if err = sock.DialOptions(t.addr, opts); err != nil {
+		fail("%s dial: %v", strings.ToUpper(self.Name), err)
+		return
+	}
+	select {
+	case <-attached:
+		pass("%s session established in %v", strings.ToUpper(self.Name),
+			time.Since(start))
+	case <-time.After(timeout):
+		fail("%s session not established", strings.ToUpper(self.Name))
+		return
+	}
+
+	if self.Number == mangos.ProtoSub && sampleTime > 0 {
+		sampleTopics(sock)
+	}
+}
+
+func topicOf(b []byte) string {
+	if len(b) > topicLen {
+		b = b[:topicLen]
+	}
+	for i, c := range b {
+		if c == ' ' || c == 0 || c == '\n' || c == '\t' {
+			b = b[:i]
+			break
+		}
+	}
+	return strconv.Quote(string(b))
+}
+
+func sampleTopics(sock mangos.Socket) {
+	if err := sock.SetOption(mangos.OptionSubscribe, []byte{}); err != nil {
+		fail("subscribe: %v", err)
+		return
+	}
+	topics := make(map[string]int)
+	total := 0
+	bytes := 0
+	end := time.Now().Add(sampleTime)
+	for {
+		left := time.Until(end)
+		if left <= 0 {
+			break
+		}
+		sock.SetOption(mangos.OptionRecvDeadline, left)
+		b, err := sock.Recv()
+		if err != nil {
+			break
+		}
+		topics[topicOf(b)]++
+		total++
+		bytes += len(b)
+	}
+	if total == 0 {
+		info("no messages published in %v", sampleTime)
+		return
+	}
+	pass("received %d messages (%d bytes) in %v", total, bytes, sampleTime)
+
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if topics[names[i]] != topics[names[j]] {
+			return topics[names[i]] > topics[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > 20 && verbose == 0 {
+		info("%d topics, top 20 shown (-v for all)", len(names))
+		names = names[:20]
+	}
+	for _, name := range names {
+		info("%6d  %s", topics[name], name)
+	}
+}
+
+func main() {
+	goopt.Parse(nil)
+	if len(goopt.Args) != 1 {
+		fatalf("Exactly one address must be given.")
+	}
+	if len(certFile) != 0 {
+		if len(keyFile) == 0 {
+			keyFile = certFile
+		}
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			fatalf("Failed loading cert/key: %v", err)
+		}
+		tlscfg.Certificates = []tls.Certificate{c}
+	}
+
+	t, err := parseTarget(goopt.Args[0])
+	if err != nil {
+		fatalf("Bad address %s: %v", goopt.Args[0], err)
+	}
+
+	if n, ok := t.probe(); ok {
+		if self, ok := checkPeer(n); ok {
+			t.session(self)
+		}
+	}
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// spproxy republishes the messages of upstream PUB sockets to its own
+// subscribers, subscribing upstream only to what they want, so that
+// several may be cascaded as a broker.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+import (
+	"github.com/droundy/goopt"
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/all"
+)
+
+var verbose int
+var upAddrs []string
+var downAddrs []string
+var tlscfg tls.Config
+var certFile string
+var keyFile string
+
+func setCaCert(path string) error {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tlscfg.RootCAs = x509.NewCertPool()
+	if !tlscfg.RootCAs.AppendCertsFromPEM(pem) {
+		return errors.New("unable to load CA certs")
+	}
+	return nil
+}
+
+func init() {
+	goopt.NoArg([]string{"--verbose", "-v"}, "Increase verbosity",
+		func() error {
+			verbose++
+			return nil
+		})
+	goopt.ReqArg([]string{"--connect", "-c"}, "ADDR",
+		"Subscribe to the publisher at ADDR (may be repeated)",
+		func(addr string) error {
+			upAddrs = append(upAddrs, addr)
+			return nil
+		})
+	goopt.ReqArg([]string{"--bind", "-b"}, "ADDR",
+		"Publish to subscribers at ADDR (may be repeated)",
+		func(addr string) error {
+			downAddrs = append(downAddrs, addr)
+			return nil
+		})
+	goopt.ReqArg([]string{"--cert", "-E"}, "FILE",
+		"Use certificate in FILE for SSL/TLS",
+		func(path string) error {
+			certFile = path
+			return nil
+		})
+	goopt.ReqArg([]string{"--key"}, "FILE",
+		"Use private key in FILE for SSL/TLS",
+		func(path string) error {
+			keyFile = path
+			return nil
+		})
+	goopt.ReqArg([]string{"--cacert"}, "FILE",
+		"Use CA certicate(s) in FILE for SSL/TLS", setCaCert)
+	goopt.NoArg([]string{"--insecure", "-k"},
+		"Do not validate TLS/SSL peer certificate",
+		func() error {
+			tlscfg.InsecureSkipVerify = true
+			return nil
+		})
+	goopt.Description = func() string {
+		return `The spproxy command subscribes to the SP (nanomsg)
+publishers given with --connect, and republishes what it receives to the
+subscribers connected to the addresses given with --bind.  It subscribes
+upstream only to the topics its subscribers want, where they say (as
+mangos subscribers with the SUB-FORWARD option do, and spproxy itself
+does), so that proxies may be cascaded without carrying messages nobody
+wants.  It runs until interrupted.`
+	}
+
+	goopt.Author = "The Mangos Authors"
+
+	goopt.Suite = "mangos"
+
+	goopt.Summary = "topic filtering PUB/SUB proxy"
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "spproxy: "+format+"\n", v...)
+	os.Exit(1)
+}
+
+func logf(format string, v ...interface{}) {
+	if verbose > 0 {
+		fmt.Fprintf(os.Stderr, format+"\n", v...)
+	}
+}
+
+// topics formats the subscriptions for the log.
+func topics(subs [][]byte) string {
+	if len(subs) == 0 {
+		return "(none)"
+	}
+	names := make([]string, 0, len(subs))
+	for _, t := range subs {
+		names = append(names, strconv.Quote(string(t)))
+	}
+	return strings.Join(names, " ")
+}
+
+// watch logs the subscriptions wanted downstream as they change.
+func watch(down mangos.Socket) {
+	v, err := down.GetOption(mangos.OptionSubscriptionsChanged)
+	if err != nil {
+		return
+	}
+	changed := v.(<-chan struct{})
+	for range changed {
+		v, err := down.GetOption(mangos.OptionSubscriptions)
+		if err != nil {
+			return
+		}
+		logf("subscribed to %s", topics(v.([][]byte)))
+	}
+}
+
+func main() {
+	goopt.Parse(nil)
+	if len(goopt.Args) != 0 || len(upAddrs) == 0 || len(downAddrs) == 0 {
+		fatalf("At least one --connect and one --bind address must be given.")
+	}
+	if len(certFile) != 0 {
+		if len(keyFile) == 0 {
+			keyFile = certFile
+		}
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			fatalf("Failed loading cert/key: %v", err)
+		}
+		tlscfg.Certificates = []tls.Certificate{c}
+	}
+	opts := map[string]interface{}{}
+	if len(tlscfg.Certificates) != 0 || tlscfg.RootCAs != nil ||
+		tlscfg.InsecureSkipVerify {
+		opts[mangos.OptionTLSConfig] = &tlscfg
+	}
+
+	up, err := sub.NewSocket()
+	if err != nil {
+		fatalf("Failed creating SUB socket: %v", err)
+	}
+	down, err := pub.NewSocket()
+	if err != nil {
+		fatalf("Failed creating PUB socket: %v", err)
+	}
+	for _, addr := range downAddrs {
+		if err = down.ListenOptions(addr, tlsOpts(addr, opts)); err != nil {
+			fatalf("Failed listening on %s: %v", addr, err)
+		}
+		logf("listening on %s", addr)
+	}
+	if verbose > 0 {
+		go watch(down)
+	}
+	if err = mangos.PubSubDevice(up, down); err != nil {
+		fatalf("Failed starting device: %v", err)
+	}
+	// Dialing asynchronously lets us start before the publishers do.
+	if err = up.SetOption(mangos.OptionDialAsynch, true); err != nil {
+		fatalf("Failed setting option: %v", err)
+	}
+	for _, addr := range upAddrs {
+		if err = up.DialOptions(addr, tlsOpts(addr, opts)); err != nil {
+			fatalf("Failed dialing %s: %v", addr, err)
+		}
+		logf("connecting to %s", addr)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	<-sigs
+	up.Close()
+	down.Close()
+}
+
+// tlsOpts returns the options for the address, which are the TLS ones
+// only for the transports that use TLS.
+func tlsOpts(addr string, opts map[string]interface{}) map[string]interface{} {
+	if strings.HasPrefix(addr, "tls+tcp://") || strings.HasPrefix(addr, "wss://") {
+		return opts
+	}
+	return nil
+}
@@ -0,0 +1,641 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// spsoak runs a topology of mangos sockets under sustained load, for
+// hours if need be, checking that messages arrive in order and without
+// loss, and reporting throughput and any violations as it goes.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	mrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/droundy/goopt"
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/all"
+)
+
+// A topology describes how the nodes are made and connected.  Node 0
+// listens, and the others dial it.  Each message carries the node that
+// sent it and its sequence number, and each receiver checks, for each
+// node it hears from, that these arrive in order.  Lossy protocols drop
+// messages when a receiver cannot keep up, so for those gaps are counted
+// but are not violations.
+type topology struct {
+	hub       func() (mangos.Socket, error) // node 0
+	spoke     func() (mangos.Socket, error) // the others
+	hears     func(i, j int) bool           // node i receives from j
+	nodes     int                           // if fixed
+	roundTrip bool
+	lossy     bool
+}
+
+var topologies = map[string]topology{
+	"pair": {
+		hub:   pair.NewSocket,
+		spoke: pair.NewSocket,
+		hears: func(i, j int) bool { return i != j },
+		nodes: 2,
+	},
+	"pipeline": {
+		hub:   pull.NewSocket,
+		spoke: push.NewSocket,
+		hears: func(i, j int) bool { return i == 0 && j != 0 },
+	},
+	"reqrep": {
+		hub:       rep.NewSocket,
+		spoke:     req.NewSocket,
+		hears:     func(i, j int) bool { return false },
+		roundTrip: true,
+	},
+	"pubsub": {
+		hub:   pub.NewSocket,
+		spoke: sub.NewSocket,
+		hears: func(i, j int) bool { return i != 0 && j == 0 },
+		lossy: true,
+	},
+	"bus": {
+		hub:   bus.NewSocket,
+		spoke: bus.NewSocket,
+		hears: func(i, j int) bool { return i != j && (i == 0 || j == 0) },
+		lossy: true,
+	},
+}
+
+var addrs = map[string]string{
+	"inproc": "inproc://spsoak",
+	"ipc":    "ipc://spsoak.sock",
+	"tcp":    "tcp://127.0.0.1:40894",
+	"tls":    "tls+tcp://127.0.0.1:40895",
+	"ws":     "ws://127.0.0.1:40896/spsoak",
+	"wss":    "wss://127.0.0.1:40897/spsoak",
+}
+
+// A message starts with the sending node, its sequence number, and the
+// time it was sent, in nanoseconds.
+const headerSize = 4 + 8 + 8
+
+// maxShown is how many violations are described, before the rest are
+// only counted.
+const maxShown = 20
+
+var proto = "pipeline"
+var tran = "tcp"
+var nodes = 4
+var size = 64
+var rate = 0
+var duration = time.Minute
+var interval = time.Second * 10
+var faultEvery time.Duration
+var srvCfg, cliCfg *tls.Config
+
+// Counters, for all the nodes together.
+var (
+	sent       uint64
+	recvd      uint64
+	lost       uint64
+	violations uint64
+	faults     uint64
+	latSum     int64
+	latMax     int64
+)
+
+func setName(name *string, valid func(string) bool) func(string) error {
+	return func(s string) error {
+		if !valid(s) {
+			return errors.New("unknown name " + s)
+		}
+		*name = s
+		return nil
+	}
+}
+
+func setInt(v *int, min int) func(string) error {
+	return func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min {
+			return fmt.Errorf("value not a number of at least %d", min)
+		}
+		*v = n
+		return nil
+	}
+}
+
+func setDuration(v *time.Duration) func(string) error {
+	return func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return errors.New("value not a duration")
+		}
+		*v = d
+		return nil
+	}
+}
+
+func init() {
+	goopt.ReqArg([]string{"--proto", "-p"}, "NAME",
+		"Run the protocol NAME: pair, pipeline, reqrep, pubsub or bus "+
+			"(default pipeline)",
+		setName(&proto, func(s string) bool {
+			_, ok := topologies[s]
+			return ok
+		}))
+	goopt.ReqArg([]string{"--transport", "-T"}, "NAME",
+		"Connect the nodes with transport NAME (default tcp)",
+		setName(&tran, func(s string) bool {
+			_, ok := addrs[s]
+			return ok
+		}))
+	goopt.ReqArg([]string{"--nodes", "-N"}, "COUNT",
+		"Run COUNT nodes, one of which the others dial (default 4)",
+		setInt(&nodes, 2))
+	goopt.ReqArg([]string{"--size", "-s"}, "SIZE",
+		"Send messages of SIZE bytes, at least 20 (default 64)",
+		setInt(&size, headerSize))
+	goopt.ReqArg([]string{"--rate", "-r"}, "RATE",
+		"Send RATE messages per second from each sending node, "+
+			"or as fast as possible if 0 (default 0)",
+		setInt(&rate, 0))
+	goopt.ReqArg([]string{"--duration", "-d"}, "DURATION",
+		"Run for DURATION, such as 4h (default 1m)",
+		setDuration(&duration))
+	goopt.ReqArg([]string{"--interval", "-i"}, "DURATION",
+		"Report progress every DURATION (default 10s)",
+		setDuration(&interval))
+	goopt.ReqArg([]string{"--fault", "-f"}, "DURATION",
+		"Close a connection at random every DURATION, for the dialer "+
+			"to restore (default never)",
+		setDuration(&faultEvery))
+	goopt.Description = func() string {
+		return `The spsoak command runs a topology of mangos sockets
+under sustained load, checking that the messages from each node arrive
+in order and, for protocols that do not drop messages, without loss.  It
+reports throughput and violations periodically, and exits with status 1
+if there were any violations.`
+	}
+	goopt.Author = "The Mangos Authors"
+	goopt.Version = ""
+	goopt.Suite = "mangos"
+	goopt.Summary = "soak test SP protocols and transports"
+}
+
+func fatalf(f string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "spsoak: %s\n", fmt.Sprintf(f, args...))
+	os.Exit(1)
+}
+
+// violation counts a broken invariant, describing the first few.
+func violation(f string, args ...interface{}) {
+	if n := atomic.AddUint64(&violations, 1); n <= maxShown {
+		fmt.Fprintf(os.Stderr, "spsoak: %s\n", fmt.Sprintf(f, args...))
+		if n == maxShown {
+			fmt.Fprintln(os.Stderr,
+				"spsoak: further violations are counted only")
+		}
+	}
+}
+
+// newTLSConfigs makes a throwaway self-signed certificate, good enough
+// to test the TLS transports with.
+func newTLSConfigs() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(duration + time.Hour*24),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	srvCfg = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	cliCfg = &tls.Config{InsecureSkipVerify: true}
+	return nil
+}
+
+type node struct {
+	id   int
+	sock mangos.Socket
+	seq  uint64 // messages sent, and so the next sequence number
+	sync.Mutex
+	next map[uint32]uint64 // next sequence number expected, by node
+}
+
+// makeNodes creates the nodes and connects them, waiting until each
+// spoke has a pipe to the hub, so that nothing is missed at the start.
+func makeNodes(t topology) ([]*node, error) {
+	addr := addrs[tran]
+	var list []*node
+	for i := 0; i < nodes; i++ {
+		mk := t.spoke
+		if i == 0 {
+			mk = t.hub
+		}
+		s, err := mk()
+		if err != nil {
+			return list, err
+		}
+		n := &node{id: i, sock: s, next: make(map[uint32]uint64)}
+		list = append(list, n)
+		if s.Info().Self == mangos.ProtoSub {
+			if err = s.SetOption(mangos.OptionSubscribe, []byte{}); err != nil {
+				return list, err
+			}
+		}
+		if t.roundTrip && i != 0 {
+			// Requests lost to faults are sent again.
+			if err = s.SetOption(mangos.OptionRetryTime, time.Second); err != nil {
+				return list, err
+			}
+		}
+		opts := make(map[string]interface{})
+		if tran == "tls" || tran == "wss" {
+			opts[mangos.OptionTLSConfig] = cliCfg
+			if i == 0 {
+				opts[mangos.OptionTLSConfig] = srvCfg
+			}
+		}
+		if i == 0 {
+			err = s.ListenOptions(addr, opts)
+		} else {
+			opts[mangos.OptionReconnectTime] = time.Millisecond * 10
+			err = s.DialOptions(addr, opts)
+		}
+		if err != nil {
+			return list, err
+		}
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for len(list[0].sock.Pipes()) < nodes-1 {
+		if time.Now().After(deadline) {
+			return list, errors.New("timed out connecting nodes")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// Subscribers need a moment more for their pipes to be used.
+	time.Sleep(time.Millisecond * 100)
+	return list, nil
+}
+
+func (n *node) message(seq uint64) *mangos.Message {
+	m := mangos.NewMessage(size)
+	m.Body = m.Body[:size]
+	binary.BigEndian.PutUint32(m.Body, uint32(n.id))
+	binary.BigEndian.PutUint64(m.Body[4:], seq)
+	binary.BigEndian.PutUint64(m.Body[12:], uint64(time.Now().UnixNano()))
+	return m
+}
+
+func latency(body []byte) {
+	t0 := int64(binary.BigEndian.Uint64(body[12:]))
+	d := time.Now().UnixNano() - t0
+	atomic.AddInt64(&latSum, d)
+	for {
+		max := atomic.LoadInt64(&latMax)
+		if d <= max || atomic.CompareAndSwapInt64(&latMax, max, d) {
+			break
+		}
+	}
+}
+
+// send sends messages, at the rate asked for, until stop is closed.  A
+// message is only counted once it has been accepted, so that one timed
+// out is sent again with the same sequence number.
+func (n *node) send(stop chan struct{}) {
+	var pace time.Duration
+	if rate > 0 {
+		pace = time.Second / time.Duration(rate)
+	}
+	start := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		seq := atomic.LoadUint64(&n.seq)
+		if pace > 0 {
+			if d := time.Until(start.Add(pace * time.Duration(seq))); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		switch err := n.sock.SendMsg(n.message(seq)); err {
+		case nil:
+			atomic.AddUint64(&n.seq, 1)
+			atomic.AddUint64(&sent, 1)
+		case mangos.ErrSendTimeout:
+		case mangos.ErrClosed:
+			return
+		default:
+			violation("node %d: send failed: %v", n.id, err)
+			return
+		}
+	}
+}
+
+// request sends requests until stop is closed, checking that each
+// reply is the one for the request.
+func (n *node) request(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		seq := atomic.LoadUint64(&n.seq)
+		m := n.message(seq)
+		want := append([]byte(nil), m.Body...)
+		if err := n.sock.SendMsg(m); err != nil {
+			if err != mangos.ErrClosed {
+				violation("node %d: send failed: %v", n.id, err)
+			}
+			return
+		}
+		atomic.AddUint64(&sent, 1)
+		atomic.AddUint64(&n.seq, 1)
+		m, err := n.sock.RecvMsg()
+		switch err {
+		case nil:
+		case mangos.ErrRecvTimeout:
+			atomic.AddUint64(&lost, 1)
+			continue
+		case mangos.ErrClosed:
+			return
+		default:
+			violation("node %d: receive failed: %v", n.id, err)
+			return
+		}
+		atomic.AddUint64(&recvd, 1)
+		if string(m.Body) != string(want) {
+			violation("node %d: reply to request %d does not match",
+				n.id, seq)
+		} else {
+			latency(m.Body)
+		}
+		m.Free()
+	}
+}
+
+// reply answers requests until the socket is closed.
+func (n *node) reply() {
+	for {
+		m, err := n.sock.RecvMsg()
+		if err != nil {
+			return
+		}
+		if n.sock.SendMsg(m) != nil {
+			return
+		}
+	}
+}
+
+// receive checks messages until the socket is closed.
+func (n *node) receive(t topology) {
+	for {
+		m, err := n.sock.RecvMsg()
+		if err != nil {
+			return
+		}
+		n.check(t, m.Body)
+		m.Free()
+	}
+}
+
+func (n *node) check(t topology, body []byte) {
+	if len(body) < headerSize {
+		violation("node %d: short message of %d bytes", n.id, len(body))
+		return
+	}
+	from := binary.BigEndian.Uint32(body)
+	seq := binary.BigEndian.Uint64(body[4:])
+	if int(from) >= nodes || !t.hears(n.id, int(from)) {
+		violation("node %d: message from node %d", n.id, from)
+		return
+	}
+	atomic.AddUint64(&recvd, 1)
+	latency(body)
+
+	n.Lock()
+	defer n.Unlock()
+	want := n.next[from]
+	switch {
+	case seq == want:
+	case seq > want:
+		atomic.AddUint64(&lost, seq-want)
+	case seq == want-1:
+		violation("node %d: message %d from node %d duplicated",
+			n.id, seq, from)
+		return
+	default:
+		violation("node %d: message %d from node %d after %d",
+			n.id, seq, from, want-1)
+		return
+	}
+	n.next[from] = seq + 1
+}
+
+// tails counts the messages that never arrived at the end of each
+// stream, which check cannot see as gaps.
+func tails(t topology, list []*node) uint64 {
+	var missing uint64
+	for _, n := range list {
+		n.Lock()
+		for _, from := range list {
+			if t.hears(n.id, from.id) {
+				missing += atomic.LoadUint64(&from.seq) - n.next[uint32(from.id)]
+			}
+		}
+		n.Unlock()
+	}
+	return missing
+}
+
+// fault closes a pipe of a node chosen at random.
+func fault(list []*node) {
+	n := list[mrand.Intn(len(list))]
+	pipes := n.sock.Pipes()
+	if len(pipes) == 0 {
+		return
+	}
+	p := pipes[mrand.Intn(len(pipes))]
+	if n.sock.ClosePipe(p.ID) == nil {
+		atomic.AddUint64(&faults, 1)
+	}
+}
+
+var lastRecvd uint64
+var lastTime time.Time
+
+func report(start, now time.Time) {
+	r := atomic.LoadUint64(&recvd)
+	rps := float64(r-lastRecvd) / now.Sub(lastTime).Seconds()
+	lastRecvd, lastTime = r, now
+	var avg time.Duration
+	if r > 0 {
+		avg = time.Duration(atomic.LoadInt64(&latSum) / int64(r))
+	}
+	fmt.Printf("%9v %12d %12d %10.0f %10d %6d %6d %12v %12v\n",
+		now.Sub(start).Truncate(time.Second),
+		atomic.LoadUint64(&sent), r, rps, atomic.LoadUint64(&lost),
+		atomic.LoadUint64(&violations), atomic.LoadUint64(&faults),
+		avg, time.Duration(atomic.LoadInt64(&latMax)))
+}
+
+func main() {
+	goopt.Parse(nil)
+	if len(goopt.Args) != 0 {
+		fmt.Fprintln(os.Stderr, goopt.Usage())
+		os.Exit(2)
+	}
+	t := topologies[proto]
+	if t.nodes != 0 {
+		nodes = t.nodes
+	}
+	if err := newTLSConfigs(); err != nil {
+		fatalf("Failed creating TLS config: %v", err)
+	}
+	if tran == "ipc" {
+		defer os.Remove(strings.TrimPrefix(addrs[tran], "ipc://"))
+	}
+
+	list, err := makeNodes(t)
+	for _, n := range list {
+		defer n.sock.Close()
+	}
+	if err != nil {
+		fatalf("Failed setting up %s over %s: %v", proto, tran, err)
+	}
+
+	stop := make(chan struct{})
+	var senders sync.WaitGroup
+	for _, n := range list {
+		s := n.sock
+		// Senders blocked for want of a peer look again for stop.
+		s.SetOption(mangos.OptionSendDeadline, time.Second)
+		s.SetOption(mangos.OptionRecvDeadline, time.Second*10)
+		switch {
+		case t.roundTrip && n.id == 0:
+			go n.reply()
+			continue
+		case t.roundTrip:
+			senders.Add(1)
+			go func(n *node) {
+				defer senders.Done()
+				n.request(stop)
+			}(n)
+			continue
+		}
+		sends, receives := false, false
+		for _, o := range list {
+			sends = sends || t.hears(o.id, n.id)
+			receives = receives || t.hears(n.id, o.id)
+		}
+		if sends {
+			senders.Add(1)
+			go func(n *node) {
+				defer senders.Done()
+				n.send(stop)
+			}(n)
+		}
+		if receives {
+			s.SetOption(mangos.OptionRecvDeadline, time.Duration(0))
+			go n.receive(t)
+		}
+	}
+
+	fmt.Printf("%s over %s, %d nodes, %d byte messages\n",
+		proto, tran, nodes, size)
+	fmt.Printf("%9s %12s %12s %10s %10s %6s %6s %12s %12s\n", "TIME",
+		"SENT", "RECEIVED", "MSGS/SEC", "LOST", "VIOL", "FAULTS",
+		"AVG LAT", "MAX LAT")
+	start := time.Now()
+	lastTime = start
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var faultq <-chan time.Time
+	if faultEvery > 0 {
+		ft := time.NewTicker(faultEvery)
+		defer ft.Stop()
+		faultq = ft.C
+	}
+	end := time.After(duration)
+run:
+	for {
+		select {
+		case now := <-ticker.C:
+			report(start, now)
+		case <-faultq:
+			fault(list)
+		case <-end:
+			break run
+		}
+	}
+
+	// Let what is in flight arrive, and then account for what never
+	// will.
+	stopped := time.Now()
+	close(stop)
+	senders.Wait()
+	time.Sleep(time.Second * 2)
+	if !t.roundTrip {
+		atomic.AddUint64(&lost, tails(t, list))
+	}
+	if !t.lossy && faultEvery == 0 {
+		if n := atomic.LoadUint64(&lost); n > 0 {
+			violation("%d messages lost without faults", n)
+		}
+	}
+	// The last line is for the whole run.
+	lastRecvd, lastTime = 0, start
+	report(start, stopped)
+	if atomic.LoadUint64(&violations) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+import "time"
+
+// SocketState is a diagnostic snapshot of a socket, as collected by
+// the dump package.  Unlike Stats, it describes each pipe, dialer and
+// listener individually, and is intended for people rather than for
+// monitoring systems.
+type SocketState struct {
+	ID        uint64          `json:"id"` // order of creation in the process
+	Name      string          `json:"name,omitempty"`
+	Protocol  string          `json:"protocol"`
+	Peer      string          `json:"peer"`
+	Closed    bool            `json:"closed"`
+	Stats     Stats           `json:"stats"`
+	Pipes     []PipeState     `json:"pipes"`
+	Dialers   []DialerState   `json:"dialers"`
+	Listeners []ListenerState `json:"listeners"`
+	Events    []Event         `json:"events"` // oldest first
+	Errors    []Event         `json:"errors"` // background errors, oldest first
+}
+
+// PipeState describes a single pipe in a SocketState.
+type PipeState struct {
+	ID      uint32 `json:"id"`
+	Address string `json:"address"`
+	Role    string `json:"role"` // "dialer" or "listener"
+	Remote  string `json:"remote,omitempty"`
+	Sending bool   `json:"sending"` // a transport write is in progress
+	Holding bool   `json:"holding"` // the protocol holds a received message
+	Closed  bool   `json:"closed"`
+}
+
+// DialerState describes a single dialer in a SocketState.  The State
+// is one of "idle", "dialing", "active" or "closed".
+type DialerState struct {
+	Address string `json:"address"`
+	State   string `json:"state"`
+}
+
+// ListenerState describes a single listener in a SocketState.
+type ListenerState struct {
+	Address string `json:"address"`
+	Closed  bool   `json:"closed"`
+}
+
+// Event is something of note that happened on a socket, such as a pipe
+// being attached or a dial failing.  Each socket remembers only the most
+// recent events.
+type Event struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// EndpointInfo describes a dialer or listener, as returned by
+// Socket.Endpoints.
+type EndpointInfo struct {
+	Address string `json:"address"` // as given to Dial or Listen
+	Scheme  string `json:"scheme"`  // the transport, such as "tcp"
+	Role    string `json:"role"`    // "dialer" or "listener"
+
+	// State is "idle", "dialing", "active" or "closed" for dialers,
+	// and "open" or "closed" for listeners.
+	State string `json:"state"`
+
+	// Pipes is the number of pipes currently connected through it.
+	Pipes int `json:"pipes"`
+}
+
+// ProtocolState is the internal state of a socket's protocol, as returned
+// by Socket.Debug.  It is meant for attaching to bug reports, such as
+// about a REQ socket that waits for a reply which never comes, or a SUB
+// socket that misses messages.  Protocols fill in only the parts that
+// apply to them, and what they report may change from one release to
+// the next.
+type ProtocolState struct {
+	Protocol string `json:"protocol"`
+	Raw      bool   `json:"raw"`
+
+	// Pending are the requests sent by REQ, surveys by SURVEYOR, or
+	// messages sent by PUSH with OptionAckDelivery, that have yet to be
+	// answered (or, for surveys, to expire).
+	Pending []RequestState `json:"pending,omitempty"`
+
+	// Backtraces are the requests received by REP or RESPONDENT that
+	// have yet to be replied to.
+	Backtraces []BacktraceState `json:"backtraces,omitempty"`
+
+	// Subscriptions are the topics a SUB socket is subscribed to, or
+	// that the peers of a PUB socket have forwarded, in order.
+	Subscriptions []string `json:"subscriptions,omitempty"`
+
+	// SendQueued and SendCap are the messages waiting in the socket's
+	// send queue, and its room, for protocols that share one among
+	// the pipes.  RecvQueued and RecvCap are the same for the receive
+	// queue.
+	SendQueued int `json:"send_queued"`
+	SendCap    int `json:"send_cap"`
+	RecvQueued int `json:"recv_queued"`
+	RecvCap    int `json:"recv_cap"`
+
+	// Pipes is the protocol's view of each pipe, in order of ID.
+	Pipes []ProtocolPipeState `json:"pipes,omitempty"`
+}
+
+// RequestState describes a request awaiting an answer, in a
+// ProtocolState.
+type RequestState struct {
+	ID       uint32    `json:"id"`
+	Pipe     uint32    `json:"pipe"` // last sent on, or 0 if waiting or broadcast
+	Sent     time.Time `json:"sent"` // when last sent
+	Attempts int       `json:"attempts"`
+}
+
+// BacktraceState describes a request awaiting a reply, in a
+// ProtocolState.
+type BacktraceState struct {
+	ID   uint32   `json:"id"`   // request ID
+	Pipe uint32   `json:"pipe"` // the reply goes back on this pipe
+	Hops []uint32 `json:"hops"` // pipe IDs added by devices, nearest first
+}
+
+// ProtocolPipeState describes a pipe as the protocol sees it, in a
+// ProtocolState.
+type ProtocolPipeState struct {
+	ID     uint32 `json:"id"`
+	Queued int    `json:"queued"` // messages waiting to be sent on it
+	Cap    int    `json:"cap"`    // room in its send queue, if it has one
+	Ready  bool   `json:"ready"`  // free to send, for REQ and PUSH
+	Down   bool   `json:"down"`   // passed over, as for not answering probes
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+// Stats is a snapshot of the counters kept for a Socket, as returned by
+// Socket.Stats.  The message counters only ever increase, so rates can
+// be had by comparing successive snapshots.
+type Stats struct {
+	// Sent is the number of messages accepted by SendMsg (or Send).
+	Sent uint64
+
+	// Received is the number of messages returned by RecvMsg (or Recv).
+	Received uint64
+
+	// Dropped is the number of messages the protocol discarded, for
+	// example because a peer was not keeping up.  This is the same as
+	// the protocol counter named by StatDropped.
+	Dropped uint64
+
+	// Reconnects is the number of times a dialer has connected again,
+	// after losing an earlier connection.
+	Reconnects uint64
+
+	// Rejected is the number of connections refused before they were
+	// attached, by OptionAcceptFilter, OptionTLSVerifyPeer, the
+	// AuthHook and the like.  These are the ones reported with
+	// PipeEventRejected.
+	Rejected uint64
+
+	// Invalid is the number of messages received that were discarded
+	// for failing the check of OptionValidator.
+	Invalid uint64
+
+	// Filtered is the number of messages received that were discarded
+	// by OptionRecvFilter.
+	Filtered uint64
+
+	// HookDropped is the number of messages that a send or receive
+	// hook dropped, by returning a nil message without an error.
+	HookDropped uint64
+
+	// Corrupt is the number of pipes closed for receiving a frame whose
+	// checksum did not match (see OptionChecksum).
+	Corrupt uint64
+
+	// Insecure is the number of connections made without verifying
+	// the peer's certificate (see OptionTLSInsecureSkipVerify).  Outside
+	// of testing, it should be zero.
+	Insecure uint64
+
+	// Expired is the number of messages discarded unsent because they
+	// waited longer than Message.SetExpiry allowed.
+	Expired uint64
+
+	// TooLong is the number of messages discarded unsent because they
+	// were larger than the peer would receive (see
+	// OptionPeerMaxRecvSize).  Each is also logged, with OptionLogger.
+	TooLong uint64
+
+	// Modified is the number of messages discarded unsent because the
+	// application changed them after sending (see OptionVerifyMessages).
+	// Each is also logged, with OptionLogger.
+	Modified uint64
+
+	// Queued is the number of messages presently waiting in the
+	// protocol's send queues, where it reports them (StatQueued).
+	Queued int
+
+	// Buffered is the number of bytes, of headers and bodies, held in
+	// the socket's queues, received or waiting to be sent.  It is what
+	// OptionMaxBufferBytes limits.
+	Buffered int64
+
+	// Pipes is the number of pipes currently attached.
+	Pipes int
+
+	// Dialers is the number of dialers on the socket.
+	Dialers int
+
+	// Listeners is the number of listeners on the socket.
+	Listeners int
+
+	// Protocol holds counters specific to the protocol, keyed by name.
+	// See OptionProtocolStats.  It is nil if the protocol keeps none.
+	Protocol map[string]uint64
+}
+
+// Names of counters reported by protocols with OptionProtocolStats.
+// Not every protocol reports every counter.
+const (
+	// StatDropped counts messages discarded by the protocol for any
+	// reason other than those counted separately below.
+	StatDropped = "dropped"
+
+	// StatEchoSuppressed counts messages that were not forwarded back
+	// to the pipe they originally arrived on.  (BUS only.)
+	StatEchoSuppressed = "echo-suppressed"
+
+	// StatQueued is the number of messages presently waiting in the
+	// send queues, or (for REQ) being sent.  It is used by OptionLinger.
+	// Unlike the counters, this is a gauge.
+	StatQueued = "queued"
+
+	// StatAwaiting is the number of requests received by the application
+	// that have yet to be answered.  (REP and RESPONDENT only.)  It is
+	// used by Socket.Drain, and it too is a gauge.
+	StatAwaiting = "awaiting-reply"
+
+	// StatSpooled is the number of messages in the spool on disk (see
+	// OptionSpoolDir).  It is a gauge, and as the spool outlives the
+	// socket, it is not counted in StatQueued.
+	StatSpooled = "spooled"
+
+	// StatRedelivered counts messages sent again for want of an
+	// acknowledgment (see OptionAckDelivery).  (PUSH only.)
+	StatRedelivered = "redelivered"
+
+	// StatNacked counts messages that the receiver refused (see
+	// Message.Nack), and that were therefore not sent again.  (PUSH
+	// only.)
+	StatNacked = "nacked"
+
+	// StatUnhealthy is the number of pipes passed over for not answering
+	// probes (see OptionProbeInterval).  It is a gauge.  (REQ only.)
+	StatUnhealthy = "unhealthy"
+)
@@ -0,0 +1,200 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stream presents sockets as an io.ReadWriteCloser, so that
+// stream oriented code, such as encoders, copy loops and RPC layers, can
+// run over any SP transport.  It is meant for a PAIR socket, or for a
+// PULL and a PUSH socket, one for each direction.
+//
+// The bytes written are sent in chunks, each a message, of at most the
+// chunk size.  The boundaries between chunks mean nothing to the reader,
+// which sees only the bytes.  Closing the writing side sends a last,
+// empty chunk marking the end, after which the peer reads io.EOF.
+//
+// On the wire, each message is a one byte type, 0 for data and 1 for
+// the end, followed for data by the bytes themselves.
+package stream
+
+import (
+	"io"
+	"sync"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// DefaultChunkSize is the largest number of bytes sent in one message,
+// unless changed with SetChunkSize.
+var DefaultChunkSize = 64 * 1024
+
+const (
+	chunkData = 0
+	chunkEnd  = 1
+)
+
+// Conn is a stream over sockets.  Read may be called concurrently with
+// Write, but neither with itself.
+type Conn struct {
+	rsock mangos.Socket
+	wsock mangos.Socket
+	chunk int
+
+	rlock sync.Mutex
+	rbuf  []byte // unread bytes of the current chunk
+	rmsg  *mangos.Message
+	rerr  error // sticky, once the end is seen
+
+	wlock  sync.Mutex
+	wended bool
+	closed bool
+}
+
+// New returns a Conn reading from and writing to sock, which is usually
+// a PAIR socket.  The Conn owns the socket, and closes it when closed.
+func New(sock mangos.Socket) *Conn {
+	return NewPair(sock, sock)
+}
+
+// NewPair returns a Conn reading from r and writing to w, such as a
+// PULL socket and a PUSH socket.  The Conn owns both, and closes them
+// when closed.
+func NewPair(r, w mangos.Socket) *Conn {
+	return &Conn{rsock: r, wsock: w, chunk: DefaultChunkSize}
+}
+
+// SetChunkSize sets the largest number of bytes sent in one message.
+// It should be no larger than the peer's OptionMaxRecvSize allows.
+func (c *Conn) SetChunkSize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.wlock.Lock()
+	c.chunk = n
+	c.wlock.Unlock()
+}
+
+// Read reads bytes from the stream, receiving another chunk when those
+// already received are used up.  It returns io.EOF once the peer has
+// closed its side, and the error from the socket (such as
+// mangos.ErrRecvTimeout) if receiving fails.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	for len(c.rbuf) == 0 {
+		if c.rmsg != nil {
+			c.rmsg.Free()
+			c.rmsg = nil
+		}
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+		m, err := c.rsock.RecvMsg()
+		if err != nil {
+			return 0, err
+		}
+		if len(m.Body) == 0 {
+			m.Free()
+			return 0, mangos.ErrGarbled
+		}
+		switch m.Body[0] {
+		case chunkData:
+			c.rmsg = m
+			c.rbuf = m.Body[1:]
+		case chunkEnd:
+			m.Free()
+			c.rerr = io.EOF
+		default:
+			m.Free()
+			return 0, mangos.ErrGarbled
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write sends the bytes, in as many chunks as needed.  If it fails part
+// way, it returns the number of bytes in the chunks that were sent.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.wended {
+		return 0, mangos.ErrClosed
+	}
+	sent := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > c.chunk {
+			n = c.chunk
+		}
+		m := mangos.NewMessage(n + 1)
+		m.Body = append(m.Body, chunkData)
+		m.Body = append(m.Body, b[:n]...)
+		if err := c.wsock.SendMsg(m); err != nil {
+			m.Free()
+			return sent, err
+		}
+		sent += n
+		b = b[n:]
+	}
+	return sent, nil
+}
+
+// CloseWrite marks the end of the stream, so that the peer reads
+// io.EOF, but leaves the Conn open for reading.
+func (c *Conn) CloseWrite() error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.end()
+}
+
+// end sends the end of the stream, if not already sent.  The write lock
+// must be held.
+func (c *Conn) end() error {
+	if c.wended {
+		return nil
+	}
+	c.wended = true
+	m := mangos.NewMessage(1)
+	m.Body = append(m.Body, chunkEnd)
+	if err := c.wsock.SendMsg(m); err != nil {
+		m.Free()
+		return err
+	}
+	return nil
+}
+
+// Close marks the end of the stream, if CloseWrite has not already, and
+// closes the sockets.  The socket's OptionLinger determines how long it
+// waits for what was written to be sent.
+func (c *Conn) Close() error {
+	c.wlock.Lock()
+	if c.closed {
+		c.wlock.Unlock()
+		return mangos.ErrClosed
+	}
+	c.closed = true
+	_ = c.end()
+	c.wlock.Unlock()
+
+	err := c.wsock.Close()
+	if c.rsock != c.wsock {
+		if e := c.rsock.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
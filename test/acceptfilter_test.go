@@ -0,0 +1,126 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+	_ "nanomsg.org/go/mangos/v2/transport/ws"
+	_ "nanomsg.org/go/mangos/v2/transport/wss"
+)
+
+func TestAcceptFilterOption(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	for _, addr := range []string{AddrTestTCP(), AddrTestTLS(), AddrTestWS()} {
+		l, err := s.NewListener(addr, nil)
+		MustSucceed(t, err)
+		v, err := l.GetOption(mangos.OptionAcceptFilter)
+		MustSucceed(t, err)
+		MustBeTrue(t, len(v.(mangos.AcceptFilter).Allow) == 0)
+
+		f := mangos.AcceptFilter{
+			Allow: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"},
+			Deny:  []string{"10.1.0.0/16"},
+		}
+		MustSucceed(t, l.SetOption(mangos.OptionAcceptFilter, f))
+		v, err = l.GetOption(mangos.OptionAcceptFilter)
+		MustSucceed(t, err)
+		MustBeTrue(t, len(v.(mangos.AcceptFilter).Allow) == 3)
+
+		MustBeTrue(t, l.SetOption(mangos.OptionAcceptFilter,
+			mangos.AcceptFilter{Deny: []string{"10.0.0.0/33"}}) == mangos.ErrBadValue)
+		MustBeTrue(t, l.SetOption(mangos.OptionAcceptFilter,
+			mangos.AcceptFilter{Allow: []string{"localhost"}}) == mangos.ErrBadValue)
+		MustBeTrue(t, l.SetOption(mangos.OptionAcceptFilter, "10.0.0.0/8") == mangos.ErrBadValue)
+	}
+}
+
+// tryFilter listens on addr with the filter, dials it, and reports
+// whether the connection was accepted.
+func tryFilter(t *testing.T, addr string, f mangos.AcceptFilter) bool {
+	vc := newVerifyCerts(t)
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	rejectq := make(chan net.Addr, 10)
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventRejected {
+			v, err := p.GetOption(mangos.OptionRemoteAddr)
+			MustSucceed(t, err)
+			rejectq <- v.(net.Addr)
+		}
+	})
+	lopts := map[string]interface{}{mangos.OptionAcceptFilter: f}
+	dopts := map[string]interface{}{mangos.OptionDialAsynch: true}
+	if strings.HasPrefix(addr, "tls+tcp://") || strings.HasPrefix(addr, "wss://") {
+		lopts[mangos.OptionTLSConfig] = &tls.Config{
+			Certificates: []tls.Certificate{vc.leaf(t, "server")},
+		}
+		dopts[mangos.OptionTLSConfig] = &tls.Config{
+			RootCAs:    vc.pool,
+			ServerName: "127.0.0.1",
+		}
+	}
+	MustSucceed(t, srv.ListenOptions(addr, lopts))
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.DialOptions(addr, dopts))
+
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		if srv.Stats().Pipes == 1 {
+			MustBeTrue(t, srv.Stats().Rejected == 0)
+			return true
+		}
+		select {
+		case a := <-rejectq:
+			MustBeTrue(t, a.(*net.TCPAddr).IP.IsLoopback())
+			MustBeTrue(t, srv.Stats().Rejected > 0)
+			MustBeTrue(t, srv.Stats().Pipes == 0)
+			return false
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	t.Fatalf("neither accepted nor rejected")
+	return false
+}
+
+func TestAcceptFilter(t *testing.T) {
+	for _, addr := range []string{AddrTestTCP(), AddrTestTLS(), AddrTestWS(), AddrTestWSS()} {
+		MustBeTrue(t, tryFilter(t, addr, mangos.AcceptFilter{}))
+		MustBeTrue(t, tryFilter(t, addr, mangos.AcceptFilter{
+			Allow: []string{"127.0.0.0/8"},
+		}))
+		MustBeFalse(t, tryFilter(t, addr, mangos.AcceptFilter{
+			Allow: []string{"10.0.0.0/8"},
+		}))
+		MustBeFalse(t, tryFilter(t, addr, mangos.AcceptFilter{
+			Allow: []string{"127.0.0.0/8"},
+			Deny:  []string{"127.0.0.1"},
+		}))
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestAcceptLimitOptions(t *testing.T) {
+	s, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	l, err := s.NewListener(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+
+	v, err := l.GetOption(mangos.OptionMaxPipes)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+	v, err = l.GetOption(mangos.OptionAcceptRate)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(float64) == 0)
+	v, err = l.GetOption(mangos.OptionAcceptBurst)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 1)
+
+	MustSucceed(t, l.SetOption(mangos.OptionMaxPipes, 10))
+	MustSucceed(t, l.SetOption(mangos.OptionAcceptRate, 2.5))
+	MustSucceed(t, l.SetOption(mangos.OptionAcceptBurst, 5))
+	v, err = l.GetOption(mangos.OptionAcceptRate)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(float64) == 2.5)
+
+	MustBeTrue(t, l.SetOption(mangos.OptionMaxPipes, -1) == mangos.ErrBadValue)
+	MustBeTrue(t, l.SetOption(mangos.OptionAcceptRate, 2) == mangos.ErrBadValue)
+	MustBeTrue(t, l.SetOption(mangos.OptionAcceptBurst, 0) == mangos.ErrBadValue)
+
+	_, err = s.NewListener(AddrTestTCP(), map[string]interface{}{
+		mangos.OptionMaxPipes: "many",
+	})
+	MustBeTrue(t, err == mangos.ErrBadValue)
+}
+
+// dialMany dials addr from n sockets, returning them.
+func dialMany(t *testing.T, addr string, n int) []mangos.Socket {
+	var socks []mangos.Socket
+	for i := 0; i < n; i++ {
+		s, err := bus.NewSocket()
+		MustSucceed(t, err)
+		MustSucceed(t, s.SetOption(mangos.OptionReconnectTime, time.Millisecond*20))
+		MustSucceed(t, s.SetOption(mangos.OptionDialAsynch, true))
+		MustSucceed(t, s.Dial(addr))
+		socks = append(socks, s)
+	}
+	return socks
+}
+
+func TestMaxPipes(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionMaxPipes: 2,
+	}))
+
+	clis := dialMany(t, addr, 3)
+	for _, c := range clis {
+		defer c.Close()
+	}
+	waitPipes(t, srv, 2)
+	for srv.Stats().Rejected == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 100)
+	MustBeTrue(t, srv.Stats().Pipes == 2)
+
+	// Once one goes, the one left over gets in as it redials.
+	MustSucceed(t, clis[0].Close())
+	time.Sleep(time.Millisecond * 100)
+	MustBeTrue(t, srv.Stats().Pipes == 2)
+	MustBeTrue(t, clis[1].Stats().Pipes == 1)
+	MustBeTrue(t, clis[2].Stats().Pipes == 1)
+}
+
+func TestAcceptRate(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionAcceptRate:  1.0,
+		mangos.OptionAcceptBurst: 2,
+	}))
+
+	clis := dialMany(t, addr, 5)
+	for _, c := range clis {
+		defer c.Close()
+	}
+	waitPipes(t, srv, 2)
+	time.Sleep(time.Millisecond * 200)
+	MustBeTrue(t, srv.Stats().Pipes == 2)
+	MustBeTrue(t, srv.Stats().Rejected >= 3)
+
+	// Another is let in after a second.
+	time.Sleep(time.Millisecond * 1000)
+	MustBeTrue(t, srv.Stats().Pipes == 3)
+}
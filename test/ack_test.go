@@ -0,0 +1,201 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/ack"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// ackAddrs are the addresses used for messages and acknowledgments.
+type ackAddrs struct {
+	msgs, acks string
+}
+
+func newAckAddrs() ackAddrs {
+	return ackAddrs{msgs: AddrTestInp(), acks: AddrTestInp()}
+}
+
+func (a ackAddrs) sender(t *testing.T, store ack.Store) *ack.Sender {
+	sock, err := push.NewSocket()
+	MustSucceed(t, err)
+	acks, err := pull.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, sock.SetOption(mangos.OptionSendDeadline, time.Millisecond*100))
+	dial := map[string]interface{}{mangos.OptionDialAsynch: true}
+	MustSucceed(t, sock.DialOptions(a.msgs, dial))
+	MustSucceed(t, acks.DialOptions(a.acks, dial))
+	s, err := ack.NewSender(sock, acks, store)
+	MustSucceed(t, err)
+	return s
+}
+
+func (a ackAddrs) receiver(t *testing.T) *ack.Receiver {
+	sock, err := pull.NewSocket()
+	MustSucceed(t, err)
+	acks, err := push.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, sock.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+	MustSucceed(t, sock.Listen(a.msgs))
+	MustSucceed(t, acks.Listen(a.acks))
+	return ack.NewReceiver(sock, acks)
+}
+
+// waitPending waits for the sender to have n messages outstanding.
+func waitPending(s *ack.Sender, n int) bool {
+	for i := 0; i < 100; i++ {
+		if s.Pending() == n {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
+func TestAckDelivery(t *testing.T) {
+	a := newAckAddrs()
+	r := a.receiver(t)
+	defer r.Close()
+	s := a.sender(t, ack.NewMemoryStore())
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		MustSucceed(t, s.Send([]byte{byte(i)}))
+	}
+	for i := 0; i < 10; i++ {
+		id, b, err := r.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, bytes.Equal(b, []byte{byte(i)}))
+		MustSucceed(t, r.Ack(id))
+	}
+	MustBeTrue(t, waitPending(s, 0))
+	MustSucceed(t, s.Close())
+	MustBeTrue(t, s.Send([]byte{}) == mangos.ErrClosed)
+}
+
+func TestAckRedeliver(t *testing.T) {
+	a := newAckAddrs()
+	r := a.receiver(t)
+	defer r.Close()
+	s := a.sender(t, ack.NewMemoryStore())
+	defer s.Close()
+	s.SetResendTime(time.Millisecond * 200)
+
+	MustSucceed(t, s.Send([]byte("again")))
+	id1, b, err := r.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "again")
+
+	// Not acknowledged, so it comes back, with the same ID.
+	id2, b, err := r.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "again")
+	MustBeTrue(t, id1 == id2)
+	MustBeTrue(t, s.Pending() == 1)
+	MustSucceed(t, r.Ack(id2))
+	MustBeTrue(t, waitPending(s, 0))
+}
+
+func TestAckRecvErrors(t *testing.T) {
+	a := newAckAddrs()
+	r := a.receiver(t)
+	defer r.Close()
+
+	// Acknowledgments are still handled, even though receiving them
+	// keeps failing in between.
+	sock, err := push.NewSocket()
+	MustSucceed(t, err)
+	acks, err := pull.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, acks.SetOption(mangos.OptionRecvDeadline, time.Microsecond))
+	MustSucceed(t, sock.Dial(a.msgs))
+	MustSucceed(t, acks.Dial(a.acks))
+	s, err := ack.NewSender(sock, acks, ack.NewMemoryStore())
+	MustSucceed(t, err)
+	defer s.Close()
+
+	MustSucceed(t, s.Send([]byte("hello")))
+	id, b, err := r.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "hello")
+	time.Sleep(time.Millisecond * 50)
+	MustSucceed(t, r.Ack(id))
+	MustBeTrue(t, waitPending(s, 0))
+}
+
+func TestAckRestart(t *testing.T) {
+	a := newAckAddrs()
+	store, err := ack.NewDirStore(t.TempDir())
+	MustSucceed(t, err)
+
+	// Nobody is listening yet, so these stay in the store.
+	s := a.sender(t, store)
+	MustSucceed(t, s.Send([]byte("one")))
+	MustSucceed(t, s.Send([]byte("two")))
+	MustBeTrue(t, s.Pending() == 2)
+	MustSucceed(t, s.Close())
+
+	r := a.receiver(t)
+	defer r.Close()
+	s = a.sender(t, store)
+	defer s.Close()
+	MustBeTrue(t, s.Pending() == 2)
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		id, b, err := r.Recv()
+		MustSucceed(t, err)
+		got[string(b)] = true
+		MustSucceed(t, r.Ack(id))
+	}
+	MustBeTrue(t, got["one"] && got["two"])
+	MustBeTrue(t, waitPending(s, 0))
+
+	n := 0
+	MustSucceed(t, store.Range(func(uint64, []byte) error {
+		n++
+		return nil
+	}))
+	MustBeTrue(t, n == 0)
+}
+
+func TestAckStores(t *testing.T) {
+	dir, err := ack.NewDirStore(t.TempDir())
+	MustSucceed(t, err)
+	for _, store := range []ack.Store{ack.NewMemoryStore(), dir} {
+		MustSucceed(t, store.Put(1, []byte("a")))
+		MustSucceed(t, store.Put(2, []byte("b")))
+		b, err := store.Get(1)
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "a")
+		_, err = store.Get(3)
+		MustBeTrue(t, err == ack.ErrNotFound)
+
+		MustSucceed(t, store.Delete(1))
+		MustSucceed(t, store.Delete(1))
+		ids := []uint64{}
+		MustSucceed(t, store.Range(func(id uint64, b []byte) error {
+			ids = append(ids, id)
+			MustBeTrue(t, string(b) == "b")
+			return nil
+		}))
+		MustBeTrue(t, len(ids) == 1 && ids[0] == 2)
+	}
+}
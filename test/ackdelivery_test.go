@@ -0,0 +1,226 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/ack"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func newAckPush(t *testing.T, addr string, timeout time.Duration) mangos.Socket {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionAckDelivery, true))
+	MustSucceed(t, s.SetOption(mangos.OptionAckTimeout, timeout))
+	MustSucceed(t, s.Listen(addr))
+	return s
+}
+
+func newAckPull(t *testing.T, addr string) mangos.Socket {
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionAckDelivery, true))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.Dial(addr))
+	return s
+}
+
+func TestAckDeliveryOptions(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionAckDelivery)
+	MustSucceed(t, err)
+	MustBeFalse(t, v.(bool))
+	v, err = s.GetOption(mangos.OptionAckTimeout)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Minute)
+	MustFail(t, s.SetOption(mangos.OptionAckDelivery, 1))
+	MustFail(t, s.SetOption(mangos.OptionAckTimeout, time.Duration(0)))
+	MustSucceed(t, s.SetOption(mangos.OptionAckDelivery, true))
+	MustSucceed(t, s.SetOption(mangos.OptionAckDelivery, false))
+
+	l, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer l.Close()
+	MustSucceed(t, l.SetOption(mangos.OptionAckDelivery, true))
+	v, err = l.GetOption(mangos.OptionAckDelivery)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+	MustFail(t, l.SetOption(mangos.OptionAckTimeout, time.Second))
+
+	// Messages not received this way have nothing to acknowledge.
+	m := mangos.NewMessage(0)
+	MustSucceed(t, m.Ack())
+	m.Free()
+}
+
+func TestAckDeliveryAcked(t *testing.T) {
+	addr := AddrTestInp()
+	s := newAckPush(t, addr, time.Millisecond*50)
+	defer s.Close()
+	l := newAckPull(t, addr)
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		MustSucceed(t, s.Send([]byte(fmt.Sprint(i))))
+	}
+	for i := 0; i < 10; i++ {
+		m, err := l.RecvMsg()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(m.Body) == fmt.Sprint(i))
+		MustBeTrue(t, m.Redelivered == 0)
+		MustSucceed(t, m.Ack())
+		m.Free()
+	}
+
+	// Nothing comes again.
+	MustSucceed(t, l.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+	_, err := l.RecvMsg()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	v, err := s.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(map[string]uint64)[mangos.StatRedelivered] == 0)
+}
+
+func TestAckDeliveryTimeout(t *testing.T) {
+	addr := AddrTestInp()
+	s := newAckPush(t, addr, time.Millisecond*50)
+	defer s.Close()
+	l := newAckPull(t, addr)
+	defer l.Close()
+
+	MustSucceed(t, s.Send([]byte("again")))
+	m, err := l.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, m.Redelivered == 0)
+	m.Free()
+
+	// Not acknowledged, so it comes again, and is marked as such.
+	m, err = l.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m.Body) == "again")
+	MustBeTrue(t, m.Redelivered == 1)
+	MustSucceed(t, m.Ack())
+	m.Free()
+
+	MustSucceed(t, l.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+	_, err = l.RecvMsg()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	v, err := s.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(map[string]uint64)[mangos.StatRedelivered] == 1)
+}
+
+func TestAckDeliveryPipeLoss(t *testing.T) {
+	addr := AddrTestInp()
+	s := newAckPush(t, addr, time.Minute)
+	defer s.Close()
+	lost := newAckPull(t, addr)
+	waitPipes(t, s, 1)
+
+	// The first takes these, and goes away without acknowledging.
+	for i := 0; i < 5; i++ {
+		MustSucceed(t, s.Send([]byte(fmt.Sprint(i))))
+	}
+	for i := 0; i < 5; i++ {
+		m, err := lost.RecvMsg()
+		MustSucceed(t, err)
+		m.Free()
+	}
+
+	l := newAckPull(t, addr)
+	defer l.Close()
+	waitPipes(t, s, 2)
+	MustSucceed(t, lost.Close())
+
+	got := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		m, err := l.RecvMsg()
+		MustSucceed(t, err)
+		MustBeTrue(t, m.Redelivered == 1)
+		got[string(m.Body)] = true
+		MustSucceed(t, m.Ack())
+		m.Free()
+	}
+	MustBeTrue(t, len(got) == 5)
+}
+
+func TestAckDeliveryStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := ack.NewDirStore(dir)
+	MustSucceed(t, err)
+
+	addr := AddrTestInp()
+	s := newAckPush(t, addr, time.Minute)
+	MustSucceed(t, s.SetOption(mangos.OptionAckStore, store))
+	v, err := s.GetOption(mangos.OptionAckStore)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == mangos.AckStore(store))
+	MustFail(t, s.SetOption(mangos.OptionAckStore, "nope"))
+	lost := newAckPull(t, addr)
+
+	// Received, but never acknowledged before both go away.
+	for i := 0; i < 5; i++ {
+		MustSucceed(t, s.Send([]byte(fmt.Sprint(i))))
+	}
+	for i := 0; i < 5; i++ {
+		m, err := lost.RecvMsg()
+		MustSucceed(t, err)
+		m.Free()
+	}
+	MustSucceed(t, s.Close())
+	MustSucceed(t, lost.Close())
+
+	// A new socket with the store sends them again.
+	store, err = ack.NewDirStore(dir)
+	MustSucceed(t, err)
+	addr = AddrTestInp()
+	s = newAckPush(t, addr, time.Minute)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionAckStore, store))
+	l := newAckPull(t, addr)
+	defer l.Close()
+
+	got := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		m, err := l.RecvMsg()
+		MustSucceed(t, err)
+		MustBeTrue(t, m.Redelivered == 1)
+		got[string(m.Body)] = true
+		MustSucceed(t, m.Ack())
+		m.Free()
+	}
+	MustBeTrue(t, len(got) == 5)
+
+	// Once acknowledged, they are gone from the store.
+	n := -1
+	for i := 0; i < 100 && n != 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+		n = 0
+		MustSucceed(t, store.Range(func(uint64, []byte) error {
+			n++
+			return nil
+		}))
+	}
+	MustBeTrue(t, n == 0)
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestAdaptiveQClamp(t *testing.T) {
+	q := protocol.NewAdaptiveQ(128, 4, 64)
+	MustBeTrue(t, q.Limit() == 64)
+	MustBeTrue(t, q.Max() == 64)
+	q = protocol.NewAdaptiveQ(1, 4, 64)
+	MustBeTrue(t, q.Limit() == 4)
+	q = protocol.NewAdaptiveQ(8, 0, 0)
+	MustBeTrue(t, q.Limit() == 1)
+}
+
+func TestAdaptiveQGrow(t *testing.T) {
+	q := protocol.NewAdaptiveQ(4, 2, 16)
+	for n := 0; n < 4; n++ {
+		MustBeTrue(t, q.Admit(n))
+	}
+	// Full, and nobody is draining it, so no growth.
+	MustBeFalse(t, q.Admit(4))
+	MustBeTrue(t, q.Limit() == 4)
+
+	// Full, but draining, so it grows.
+	q.Drained()
+	MustBeTrue(t, q.Admit(4))
+	MustBeTrue(t, q.Limit() == 8)
+
+	// But only as far as the maximum.
+	for i := 0; i < 4; i++ {
+		q.Drained()
+		q.Admit(q.Limit())
+	}
+	MustBeTrue(t, q.Limit() == 16)
+	q.Drained()
+	MustBeFalse(t, q.Admit(16))
+}
+
+func TestAdaptiveQShrink(t *testing.T) {
+	q := protocol.NewAdaptiveQ(16, 2, 16)
+	for q.Limit() > 2 {
+		time.Sleep(protocol.AdaptPeriod)
+		MustBeTrue(t, q.Admit(0))
+	}
+	MustBeTrue(t, q.Limit() == 2)
+
+	// A busy queue keeps its size.
+	q = protocol.NewAdaptiveQ(16, 2, 16)
+	q.Admit(12)
+	time.Sleep(protocol.AdaptPeriod)
+	q.Admit(0)
+	MustBeTrue(t, q.Limit() == 16)
+}
+
+func TestAdaptiveQOptions(t *testing.T) {
+	for _, f := range []func() (mangos.Socket, error){pub.NewSocket, bus.NewSocket} {
+		s, err := f()
+		MustSucceed(t, err)
+		v, err := s.GetOption(mangos.OptionWriteQMaxLen)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(int) == 0)
+		v, err = s.GetOption(mangos.OptionWriteQMinLen)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(int) == 1)
+
+		MustSucceed(t, s.SetOption(mangos.OptionWriteQMaxLen, 1024))
+		MustSucceed(t, s.SetOption(mangos.OptionWriteQMinLen, 8))
+		v, _ = s.GetOption(mangos.OptionWriteQMaxLen)
+		MustBeTrue(t, v.(int) == 1024)
+		v, _ = s.GetOption(mangos.OptionWriteQMinLen)
+		MustBeTrue(t, v.(int) == 8)
+
+		MustFail(t, s.SetOption(mangos.OptionWriteQMaxLen, -1))
+		MustFail(t, s.SetOption(mangos.OptionWriteQMinLen, 0))
+		MustFail(t, s.SetOption(mangos.OptionWriteQMaxLen, "big"))
+		s.Close()
+	}
+}
+
+func TestAdaptiveQPubSub(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	MustSucceed(t, p.SetOption(mangos.OptionWriteQLen, 1))
+	MustSucceed(t, p.SetOption(mangos.OptionWriteQMaxLen, 256))
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte{}))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, p.Listen(addr))
+	MustSucceed(t, s.Dial(addr))
+	time.Sleep(time.Millisecond * 50)
+
+	// The subscriber keeps up, so the messages get through.
+	for i := 0; i < 100; i++ {
+		MustSucceed(t, p.Send([]byte{byte(i)}))
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, b[0] == byte(i))
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// The addresses handed out here are meant to let tests run in parallel,
+// including tests in other packages and processes, without colliding.
+// TCP ports are chosen by the system, and never handed out twice by
+// one process.  The IPC and inproc names use the same numbers, so they
+// are distinct as well.
+
+type portAlloc struct {
+	sync.Mutex
+	used map[uint16]bool
+	next uint16 // fallback, if the system cannot choose
+}
+
+var ports = &portAlloc{
+	used: make(map[uint16]bool),
+	next: uint16(time.Now().UnixNano()%20000 + 20000),
+}
+
+// NextPort returns a TCP port on the loopback interface that was free
+// when asked for, and has not been returned before by this process.
+// There is still a small window for some other program to take the
+// port; where that matters, listen on port 0 instead, and dial the
+// address that MustListen returns.
+func NextPort() uint16 {
+	ports.Lock()
+	defer ports.Unlock()
+	for i := 0; i < 100; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			break
+		}
+		p := uint16(l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+		if !ports.used[p] {
+			ports.used[p] = true
+			return p
+		}
+	}
+	for ports.used[ports.next] {
+		ports.next++
+	}
+	p := ports.next
+	ports.used[p] = true
+	return p
+}
+
+// AddrTestIPC returns a unique IPC address.
+func AddrTestIPC() string {
+	return fmt.Sprintf("ipc://mangostest%d", NextPort())
+}
+
+// AddrTestSHM returns a unique shared memory address.
+func AddrTestSHM() string {
+	return fmt.Sprintf("shm://mangostestshm%d", NextPort())
+}
+
+// AddrTestWSS returns a secure websocket address on a free port.
+func AddrTestWSS() string {
+	return fmt.Sprintf("wss://127.0.0.1:%d/", NextPort())
+}
+
+// AddrTestWS returns a websocket address on a free port.
+func AddrTestWS() string {
+	return fmt.Sprintf("ws://127.0.0.1:%d/", NextPort())
+}
+
+// AddrTestTCP returns a TCP address on a free port.
+func AddrTestTCP() string {
+	return fmt.Sprintf("tcp://127.0.0.1:%d", NextPort())
+}
+
+// AddrTestTLS returns a TLS address on a free port.
+func AddrTestTLS() string {
+	return fmt.Sprintf("tls+tcp://127.0.0.1:%d", NextPort())
+}
+
+// AddrTestQUIC returns a QUIC address on a free port.
+func AddrTestQUIC() string {
+	return fmt.Sprintf("quic://127.0.0.1:%d", NextPort())
+}
+
+// AddrTestInp returns a unique inproc address.
+func AddrTestInp() string {
+	return fmt.Sprintf("inproc://test_%d", NextPort())
+}
+
+// AddrTestMock returns a unique address for the mock transport.
+func AddrTestMock() string {
+	return fmt.Sprintf("test://test_%d", NextPort())
+}
+
+// MustListen starts sock listening on addr, and returns the address
+// of the listener, for dialing.  The port in a TCP based addr may be
+// zero, such as "tcp://127.0.0.1:0", in which case the system chooses
+// a free one, and the address returned has the port actually used.
+func MustListen(t *testing.T, sock mangos.Socket, addr string) string {
+	l, err := sock.NewListener(addr, nil)
+	MustSucceed(t, err)
+	MustSucceed(t, l.Listen())
+	return l.Address()
+}
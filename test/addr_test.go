@@ -0,0 +1,60 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/ws"
+)
+
+func TestNextPortUnique(t *testing.T) {
+	t.Parallel()
+	seen := make(map[uint16]bool)
+	for i := 0; i < 50; i++ {
+		p := NextPort()
+		MustBeFalse(t, seen[p])
+		seen[p] = true
+	}
+}
+
+func TestMustListenAnonymous(t *testing.T) {
+	t.Parallel()
+	for _, addr := range []string{
+		"tcp://127.0.0.1:0",
+		"ws://127.0.0.1:0/anon",
+	} {
+		srv, err := pair.NewSocket()
+		MustSucceed(t, err)
+		defer srv.Close()
+		MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+		bound := MustListen(t, srv, addr)
+		MustBeFalse(t, strings.Contains(bound, ":0/") ||
+			strings.HasSuffix(bound, ":0"))
+
+		cli, err := pair.NewSocket()
+		MustSucceed(t, err)
+		defer cli.Close()
+		MustSucceed(t, cli.Dial(bound))
+		MustSucceed(t, cli.Send([]byte("hello")))
+		m, err := srv.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(m) == "hello")
+	}
+}
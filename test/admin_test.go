@@ -0,0 +1,155 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/admin"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func adminGet(t *testing.T, srv *httptest.Server, path string, v interface{}) int {
+	resp, err := http.Get(srv.URL + path)
+	MustSucceed(t, err)
+	defer resp.Body.Close()
+	MustBeTrue(t, resp.Header.Get("Content-Type") == "application/json")
+	MustSucceed(t, json.NewDecoder(resp.Body).Decode(v))
+	return resp.StatusCode
+}
+
+func adminServer() *httptest.Server {
+	mux := http.NewServeMux()
+	admin.Mount(mux, "/sp/admin")
+	return httptest.NewServer(mux)
+}
+
+func TestAdminList(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	MustSucceed(t, s1.SetOption(mangos.OptionName, "admin-rep"))
+	MustSucceed(t, s1.Listen(addr))
+	s2, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+
+	srv := adminServer()
+	defer srv.Close()
+
+	var list []admin.Summary
+	MustBeTrue(t, adminGet(t, srv, "/sp/admin/", &list) == http.StatusOK)
+	found := false
+	for _, sum := range list {
+		if sum.Name == "admin-rep" {
+			found = true
+			MustBeTrue(t, sum.Protocol == "rep")
+			MustBeTrue(t, sum.Peer == "req")
+			MustBeTrue(t, sum.Pipes == 1)
+		}
+	}
+	MustBeTrue(t, found)
+}
+
+func TestAdminSocket(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	MustSucceed(t, s1.SetOption(mangos.OptionName, "admin-pair"))
+	MustSucceed(t, s1.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s1.Listen(addr))
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+	MustSucceed(t, s2.Send([]byte("hello")))
+	_, err = s1.Recv()
+	MustSucceed(t, err)
+
+	// A dialer with nothing to connect to reports background errors.
+	bad := AddrTestTCP()
+	MustSucceed(t, s1.DialOptions(bad, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	}))
+
+	srv := adminServer()
+	defer srv.Close()
+
+	var id uint64
+	for _, sum := range admin.List() {
+		if sum.Name == "admin-pair" {
+			id = sum.ID
+		}
+	}
+	MustBeTrue(t, id != 0)
+	path := "/sp/admin/" + strconv.FormatUint(id, 10)
+
+	var d admin.Socket
+	for i := 0; ; i++ {
+		d = admin.Socket{}
+		MustBeTrue(t, adminGet(t, srv, path, &d) == http.StatusOK)
+		if len(d.Errors) > 0 || i == 100 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	MustBeTrue(t, d.ID == id)
+	MustBeTrue(t, d.Protocol == "pair")
+	MustBeFalse(t, d.Raw)
+	MustBeTrue(t, d.Options[mangos.OptionRecvDeadline] == "1s")
+	MustBeTrue(t, d.Options[mangos.OptionName] == "admin-pair")
+	MustBeTrue(t, len(d.Endpoints) == 2)
+	MustBeTrue(t, len(d.Pipes) == 1)
+	MustBeTrue(t, d.Pipes[0].Address == addr)
+	MustBeTrue(t, d.Pipes[0].Role == "listener")
+	MustBeTrue(t, d.Pipes[0].MsgsRecv == 1)
+	MustBeTrue(t, d.Stats.Received == 1)
+	MustBeTrue(t, len(d.Errors) > 0)
+	MustBeTrue(t, strings.HasPrefix(d.Errors[0].Text, bad+": "))
+	MustBeTrue(t, len(d.Events) > 0)
+}
+
+func TestAdminNotFound(t *testing.T) {
+	srv := adminServer()
+	defer srv.Close()
+
+	var e struct {
+		Error string `json:"error"`
+	}
+	MustBeTrue(t, adminGet(t, srv, "/sp/admin/0", &e) == http.StatusNotFound)
+	MustBeTrue(t, e.Error == "no such socket")
+	MustBeTrue(t, adminGet(t, srv, "/sp/admin/bogus", &e) == http.StatusNotFound)
+
+	resp, err := http.Post(srv.URL+"/sp/admin/", "text/plain", nil)
+	MustSucceed(t, err)
+	resp.Body.Close()
+	MustBeTrue(t, resp.StatusCode == http.StatusMethodNotAllowed)
+}
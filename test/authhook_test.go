@@ -0,0 +1,110 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+)
+
+func TestAuthHook(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+
+	var lock sync.Mutex
+	calls := 0
+	rejected := 0
+	MustBeNil(t, srv.SetAuthHook(func(p mangos.Pipe) error {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		MustBeTrue(t, p.Listener() != nil)
+		v, err := p.GetOption(mangos.OptionRemoteAddr)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(net.Addr).String() != "")
+		if calls == 1 {
+			return errors.New("go away")
+		}
+		return nil
+	}))
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventRejected {
+			lock.Lock()
+			rejected++
+			lock.Unlock()
+		}
+	})
+
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+
+	// The first connection is refused, and the dialer tries again.
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		n := calls
+		lock.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	MustSucceed(t, cli.Send([]byte("knock")))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "knock")
+
+	lock.Lock()
+	MustBeTrue(t, calls == 2)
+	MustBeTrue(t, rejected == 1)
+	lock.Unlock()
+
+	// Dialers are covered too.
+	addr = AddrTestInp()
+	srv2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv2.Close()
+	MustSucceed(t, srv2.Listen(addr))
+
+	cli2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli2.Close()
+	dialed := make(chan bool, 10)
+	cli2.SetAuthHook(func(p mangos.Pipe) error {
+		dialed <- p.Dialer() != nil
+		return errors.New("no thanks")
+	})
+	MustSucceed(t, cli2.SetOption(mangos.OptionSendDeadline, time.Millisecond*50))
+	MustSucceed(t, cli2.SetOption(mangos.OptionWriteQLen, 0))
+	MustSucceed(t, cli2.Dial(addr))
+	select {
+	case fromDialer := <-dialed:
+		MustBeTrue(t, fromDialer)
+	case <-time.After(time.Second):
+		t.Fatalf("auth hook not called for dialer")
+	}
+	MustBeTrue(t, cli2.Send([]byte("nope")) == mangos.ErrSendTimeout)
+}
@@ -21,6 +21,8 @@ import (
 
 	"nanomsg.org/go/mangos/v2"
 	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
 	"nanomsg.org/go/mangos/v2/protocol/rep"
 	"nanomsg.org/go/mangos/v2/protocol/req"
 	"nanomsg.org/go/mangos/v2/transport/all"
@@ -175,12 +177,59 @@ func benchmarkPair(t *testing.B, url string, size int) {
 	}
 }
 
-var benchInpAddr = "inproc://benchmark_test"
-var benchTCPAddr = "tcp://127.0.0.1:33833"
-var benchIPCAddr = "ipc://benchmark_test_sock"
-var benchTLSAddr = "tls+tcp://127.0.0.1:44844"
-var benchWSAddr = "ws://127.0.0.1:55855/BENCHMARK"
-var benchWSSAddr = "wss://127.0.0.1:55856/BENCHMARK"
+// benchmarkPush sends small messages with PUSH, which, unlike PAIR,
+// writes each one on its own, so that the options, such as
+// OptionCoalesceTime, decide how many system calls they take.
+func benchmarkPush(t *testing.B, url string, size int, opts map[string]interface{}) {
+	srvsock, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed creating server socket: %v", err)
+	}
+	defer srvsock.Close()
+	clisock, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed creating client socket: %v", err)
+	}
+	defer clisock.Close()
+
+	if err = srvsock.Listen(url); err != nil {
+		t.Fatalf("Server listen failed: %v", err)
+	}
+	if err = clisock.DialOptions(url, opts); err != nil {
+		t.Fatalf("Client dial failed: %v", err)
+	}
+	finish := make(chan struct{})
+	go func() {
+		defer close(finish)
+		for i := 0; i < t.N; i++ {
+			m, err := srvsock.RecvMsg()
+			if err != nil {
+				t.Errorf("Error receiving %d: %v", i, err)
+				return
+			}
+			m.Free()
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	t.ResetTimer()
+
+	for i := 0; i < t.N; i++ {
+		if err = clisock.SendMsg(mangos.NewMessage(size)); err != nil {
+			t.Errorf("Client send failed: %v", err)
+			return
+		}
+	}
+	<-finish
+	t.StopTimer()
+}
+
+var benchInpAddr = AddrTestInp()
+var benchTCPAddr = AddrTestTCP()
+var benchIPCAddr = AddrTestIPC()
+var benchSHMAddr = AddrTestSHM()
+var benchTLSAddr = AddrTestTLS()
+var benchWSAddr = AddrTestWS() + "BENCHMARK"
+var benchWSSAddr = AddrTestWSS() + "BENCHMARK"
 
 func BenchmarkLatencyInp(t *testing.B) {
 	benchmarkReq(t, benchInpAddr, 0)
@@ -188,6 +237,9 @@ func BenchmarkLatencyInp(t *testing.B) {
 func BenchmarkLatencyIPC(t *testing.B) {
 	benchmarkReq(t, benchIPCAddr, 0)
 }
+func BenchmarkLatencySHM(t *testing.B) {
+	benchmarkReq(t, benchSHMAddr, 0)
+}
 func BenchmarkLatencyTCP(t *testing.B) {
 	benchmarkReq(t, benchTCPAddr, 0)
 }
@@ -201,12 +253,24 @@ func BenchmarkLatencyWSS(t *testing.B) {
 	benchmarkReq(t, benchWSSAddr, 0)
 }
 
+func BenchmarkTPut64TCP(t *testing.B) {
+	benchmarkPush(t, benchTCPAddr, 64, nil)
+}
+func BenchmarkTPut64TCPCoalesce(t *testing.B) {
+	benchmarkPush(t, benchTCPAddr, 64, map[string]interface{}{
+		mangos.OptionCoalesceTime: 100 * time.Microsecond,
+	})
+}
+
 func BenchmarkTPut4kInp(t *testing.B) {
 	benchmarkPair(t, benchInpAddr, 4096)
 }
 func BenchmarkTPut4kIPC(t *testing.B) {
 	benchmarkPair(t, benchIPCAddr, 4096)
 }
+func BenchmarkTPut4kSHM(t *testing.B) {
+	benchmarkPair(t, benchSHMAddr, 4096)
+}
 func BenchmarkTPut4kTCP(t *testing.B) {
 	benchmarkPair(t, benchTCPAddr, 4096)
 }
@@ -226,6 +290,9 @@ func BenchmarkTPut64kInp(t *testing.B) {
 func BenchmarkTPut64kIPC(t *testing.B) {
 	benchmarkPair(t, benchIPCAddr, 65536)
 }
+func BenchmarkTPut64kSHM(t *testing.B) {
+	benchmarkPair(t, benchSHMAddr, 65536)
+}
 func BenchmarkTPut64kTCP(t *testing.B) {
 	benchmarkPair(t, benchTCPAddr, 65536)
 }
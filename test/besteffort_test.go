@@ -19,7 +19,14 @@ import (
 	"time"
 
 	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
 	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/star"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	"nanomsg.org/go/mangos/v2/protocol/xreq"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
 	_ "nanomsg.org/go/mangos/v2/transport/tcp"
 )
 
@@ -74,3 +81,81 @@ func testBestEffort(t *testing.T, addr string) {
 func TestBestEffortTCP(t *testing.T) {
 	testBestEffort(t, AddrTestTCP())
 }
+
+// dropped returns the protocol's count of messages dropped.
+func dropped(t *testing.T, s mangos.Socket) uint64 {
+	v, err := s.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	return v.(map[string]uint64)[mangos.StatDropped]
+}
+
+func TestBestEffortMulticast(t *testing.T) {
+	for _, f := range []func() (mangos.Socket, error){
+		pub.NewSocket, bus.NewSocket, star.NewSocket,
+	} {
+		addr := AddrTestInp()
+		s, err := f()
+		MustSucceed(t, err)
+		defer s.Close()
+		MustSucceed(t, s.SetOption(mangos.OptionQueueFullPolicy,
+			mangos.QueueFullBlock))
+		MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 1))
+		MustSucceed(t, s.SetOption(mangos.OptionBestEffort, true))
+		v, err := s.GetOption(mangos.OptionBestEffort)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(bool))
+		MustSucceed(t, s.Listen(addr))
+
+		// A peer that never reads fills up its queue.
+		peer, err := f()
+		if s.Info().Self == mangos.ProtoPub {
+			peer, err = sub.NewSocket()
+		}
+		MustSucceed(t, err)
+		defer peer.Close()
+		MustSucceed(t, peer.SetOption(mangos.OptionReadQLen, 0))
+		MustSucceed(t, peer.Dial(addr))
+		waitPipes(t, s, 1)
+
+		start := time.Now()
+		for i := 0; i < 100; i++ {
+			MustSucceed(t, s.Send(make([]byte, 64)))
+		}
+		MustBeTrue(t, time.Since(start) < time.Second)
+		MustBeTrue(t, dropped(t, s) > 0)
+	}
+}
+
+func TestBestEffortReqRep(t *testing.T) {
+	addr := AddrTestInp()
+	cli, err := xreq.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionWriteQLen, 2))
+	MustSucceed(t, cli.SetOption(mangos.OptionBestEffort, true))
+
+	// With no peer, the queue fills, and then requests are dropped.
+	for i := 0; i < 5; i++ {
+		m := mangos.NewMessage(0)
+		m.Header = append(m.Header, 0x80, 0, 0, byte(i))
+		MustSucceed(t, cli.SendMsg(m))
+	}
+	MustBeTrue(t, dropped(t, cli) == 3)
+
+	srv, err := xrep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.SetOption(mangos.OptionBestEffort, true))
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+
+	// Those queued are delivered, and a reply is never waited for.
+	for i := 0; i < 2; i++ {
+		m, err := srv.RecvMsg()
+		MustSucceed(t, err)
+		MustBeTrue(t, m.Header[len(m.Header)-1] == byte(i))
+		MustSucceed(t, srv.SendMsg(m))
+	}
+	MustBeTrue(t, dropped(t, srv) == 0)
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+)
+
+func TestBodiesFlatten(t *testing.T) {
+	payload := []byte("payload")
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, "topic."...)
+	m.Bodies = [][]byte{payload, []byte("!")}
+	MustBeTrue(t, m.BodyLen() == 14)
+
+	dup := m.Dup()
+	MustBeTrue(t, dup.BodyLen() == 14)
+
+	m.Flatten()
+	MustBeTrue(t, m.Bodies == nil)
+	MustBeTrue(t, string(m.Body) == "topic.payload!")
+	MustBeTrue(t, string(payload) == "payload")
+	MustBeTrue(t, len(dup.Bodies) == 2)
+	m.Free()
+	dup.Free()
+}
+
+func testBodies(t *testing.T, addr string) {
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s1.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+
+	payload := bytes.Repeat([]byte{'x'}, 1000)
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, "topic|"...)
+	m.Bodies = [][]byte{payload, nil, []byte("|end")}
+	MustSucceed(t, s2.SendMsg(m))
+
+	m, err = s1.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, m.Bodies == nil)
+	MustBeTrue(t, len(m.Body) == 1010)
+	MustBeTrue(t, string(m.Body[:6]) == "topic|")
+	MustBeTrue(t, bytes.Equal(m.Body[6:1006], payload))
+	MustBeTrue(t, string(m.Body[1006:]) == "|end")
+	m.Free()
+}
+
+func TestBodiesTCP(t *testing.T) {
+	testBodies(t, AddrTestTCP())
+}
+
+func TestBodiesIPC(t *testing.T) {
+	testBodies(t, AddrTestIPC())
+}
+
+func TestBodiesInp(t *testing.T) {
+	testBodies(t, AddrTestInp())
+}
+
+func TestBodiesWS(t *testing.T) {
+	testBodies(t, AddrTestWS())
+}
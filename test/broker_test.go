@@ -0,0 +1,166 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/broker"
+	"nanomsg.org/go/mangos/v2/config"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+func startBroker(t *testing.T, text string) *broker.Broker {
+	cfg, err := broker.Parse([]byte(text))
+	MustSucceed(t, err)
+	b, err := broker.Start(cfg)
+	MustSucceed(t, err)
+	return b
+}
+
+func httpGet(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	MustSucceed(t, err)
+	defer resp.Body.Close()
+	MustBeTrue(t, resp.StatusCode == http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	MustSucceed(t, err)
+	return string(body)
+}
+
+func TestBrokerReqRep(t *testing.T) {
+	front, back := AddrTestInp(), AddrTestInp()
+	b := startBroker(t, `
+admin: 127.0.0.1:0
+devices:
+  - name: rpc
+    kind: req-rep
+    front: { listen: [ "`+front+`" ] }
+    back: { listen: [ "`+back+`" ] }
+`)
+	defer b.Close()
+	MustBeTrue(t, len(b.Devices()) == 1 && b.Devices()[0] == "rpc")
+
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Dial(back))
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.Dial(front))
+	waitPipes(t, b.Socket("rpc", true), 1)
+
+	MustSucceed(t, cli.Send([]byte("ping")))
+	m, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "ping")
+	MustSucceed(t, srv.Send([]byte("pong")))
+	m, err = cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "pong")
+
+	url := "http://" + b.AdminAddr().String()
+	var stats map[string]mangos.Stats
+	MustSucceed(t, json.Unmarshal([]byte(httpGet(t, url+"/stats")), &stats))
+	MustBeTrue(t, stats["rpc.front"].Received == 1)
+	MustBeTrue(t, stats["rpc.back"].Received == 1)
+	MustBeTrue(t, httpGet(t, url+"/healthz") == "ok\n")
+	MustBeTrue(t, strings.Contains(httpGet(t, url+"/metrics"),
+		`socket="rpc.back"`))
+
+	MustSucceed(t, b.Close())
+	MustBeTrue(t, b.Close() == mangos.ErrClosed)
+	_, err = http.Get(url + "/healthz")
+	MustFail(t, err)
+}
+
+func TestBrokerBusHub(t *testing.T) {
+	addr := AddrTestInp()
+	b := startBroker(t, `
+devices:
+  - name: chat
+    kind: bus
+    front: { listen: [ "`+addr+`" ] }
+`)
+	defer b.Close()
+	MustBeTrue(t, b.AdminAddr() == nil)
+	MustBeTrue(t, b.Socket("chat", true) == nil)
+
+	var peers []mangos.Socket
+	for i := 0; i < 3; i++ {
+		s, err := bus.NewSocket()
+		MustSucceed(t, err)
+		defer s.Close()
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Millisecond*500))
+		MustSucceed(t, s.Dial(addr))
+		peers = append(peers, s)
+	}
+	waitPipes(t, b.Socket("chat", false), 3)
+
+	MustSucceed(t, peers[0].Send([]byte("hello")))
+	for _, s := range peers[1:] {
+		m, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(m) == "hello")
+	}
+	_, err := peers[0].Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+}
+
+func TestBrokerErrors(t *testing.T) {
+	cfg, err := broker.Parse([]byte(`
+devices:
+  - { name: odd, kind: req-pub }
+`))
+	MustSucceed(t, err)
+	_, err = broker.Start(cfg)
+	var ce *config.Error
+	MustBeTrue(t, errors.As(err, &ce))
+	MustBeTrue(t, ce.Socket == "odd.front")
+
+	_, err = broker.Parse([]byte("devices:\n  - { name: a, knd: bus }\n"))
+	MustFail(t, err)
+
+	// A failure part way leaves nothing behind.
+	addr := AddrTestInp()
+	cfg, err = broker.Parse([]byte(`
+devices:
+  - name: one
+    kind: pair
+    front: { listen: [ "` + addr + `" ] }
+    back: { dial: [ "bogus://nowhere" ] }
+`))
+	MustSucceed(t, err)
+	_, err = broker.Start(cfg)
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadTransport))
+	b, err := broker.Start(&broker.Config{Devices: []broker.DeviceSpec{{
+		Name: "two", Kind: "bus",
+		Front: config.SocketSpec{Listen: []string{addr}},
+	}}})
+	MustSucceed(t, err)
+	MustSucceed(t, b.Close())
+}
@@ -161,6 +161,10 @@ func TestBusInp(t *testing.T) {
 	RunTestsInp(t, busCases())
 }
 
+func TestBusMock(t *testing.T) {
+	RunTestsMock(t, busCases())
+}
+
 func TestBusTCP(t *testing.T) {
 	RunTestsTCP(t, busCases())
 }
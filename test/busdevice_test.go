@@ -85,3 +85,83 @@ func TestBusDevice(t *testing.T) {
 	MustFail(t, e)
 	MustBeNil(t, m3)
 }
+
+// busHub returns a raw BUS socket reflecting what it receives to its
+// other peers, as the center of a bus segment.
+func busHub(t *testing.T, addr string) mangos.Socket {
+	s, err := xbus.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.Listen(addr))
+	MustSucceed(t, mangos.Device(s, s))
+	return s
+}
+
+// busBridge joins the segments at the two addresses with a device.
+func busBridge(t *testing.T, addr1, addr2 string) (mangos.Socket, mangos.Socket) {
+	s1, err := xbus.NewSocket()
+	MustSucceed(t, err)
+	s2, err := xbus.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s1.Dial(addr1))
+	MustSucceed(t, s2.Dial(addr2))
+	MustSucceed(t, mangos.Device(s1, s2))
+	return s1, s2
+}
+
+func busClient(t *testing.T, addr string) mangos.Socket {
+	s, err := bus.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+	MustSucceed(t, s.Dial(addr))
+	return s
+}
+
+// TestBusDeviceSegments joins two segments with two devices, making a
+// loop, and checks that messages cross once, and are not echoed back.
+func TestBusDeviceSegments(t *testing.T) {
+	addrA := AddrTestInp()
+	addrB := AddrTestInp()
+	hA := busHub(t, addrA)
+	defer hA.Close()
+	hB := busHub(t, addrB)
+	defer hB.Close()
+	for i := 0; i < 2; i++ {
+		s1, s2 := busBridge(t, addrA, addrB)
+		defer s1.Close()
+		defer s2.Close()
+	}
+	cA := busClient(t, addrA)
+	defer cA.Close()
+	cB := busClient(t, addrB)
+	defer cB.Close()
+	waitPipes(t, hA, 3)
+	waitPipes(t, hB, 3)
+
+	// Messages must be distinct, even from earlier runs.
+	fromA := "from A " + addrA
+	fromB := "from B " + addrB
+
+	MustSucceed(t, cA.Send([]byte(fromA)))
+	b, err := cB.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == fromA)
+	_, err = cB.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	_, err = cA.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+
+	// The same again, from the same peer, is not a copy.
+	MustSucceed(t, cA.Send([]byte(fromA)))
+	b, err = cB.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == fromA)
+
+	MustSucceed(t, cB.Send([]byte(fromB)))
+	b, err = cA.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == fromB)
+	_, err = cA.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	_, err = cB.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestBusyPollOptions(t *testing.T) {
+	for _, f := range []func() (mangos.Socket, error){req.NewSocket, rep.NewSocket} {
+		sock, err := f()
+		MustSucceed(t, err)
+		v, err := sock.GetOption(mangos.OptionBusyPoll)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(time.Duration) == 0)
+		MustBeTrue(t, sock.SetOption(mangos.OptionBusyPoll, -time.Second) == mangos.ErrBadValue)
+		MustBeTrue(t, sock.SetOption(mangos.OptionBusyPoll, 1) == mangos.ErrBadValue)
+		MustSucceed(t, sock.SetOption(mangos.OptionBusyPoll, time.Millisecond))
+
+		// Contexts start with the socket's, and the TCP transport
+		// has it too.
+		c, err := sock.OpenContext()
+		MustSucceed(t, err)
+		v, err = c.GetOption(mangos.OptionBusyPoll)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(time.Duration) == time.Millisecond)
+		d, err := sock.NewDialer(AddrTestTCP(), nil)
+		MustSucceed(t, err)
+		v, err = d.GetOption(mangos.OptionBusyPoll)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(time.Duration) == time.Millisecond)
+		MustSucceed(t, sock.Close())
+	}
+}
+
+func TestBusyPollPingPong(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionBusyPoll, time.Millisecond))
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionBusyPoll, time.Millisecond))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.SetOption(mangos.OptionNoDelay, false))
+	MustSucceed(t, cli.Dial(addr))
+
+	go func() {
+		for {
+			m, err := srv.RecvMsg()
+			if err != nil {
+				return
+			}
+			if srv.SendMsg(m) != nil {
+				return
+			}
+		}
+	}()
+
+	// Some replies come while spinning, others after it gives up.
+	for i := 0; i < 200; i++ {
+		MustSucceed(t, cli.Send([]byte{byte(i)}))
+		b, err := cli.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, b[0] == byte(i))
+		if i%50 == 0 {
+			time.Sleep(time.Millisecond * 2)
+		}
+	}
+
+	// The deadline still applies, once spinning is done.
+	c, err := cli.OpenContext()
+	MustSucceed(t, err)
+	MustSucceed(t, srv.Close())
+	MustSucceed(t, c.SetOption(mangos.OptionRecvDeadline, time.Millisecond*20))
+	MustSucceed(t, c.Send([]byte("lost")))
+	_, err = c.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/capture"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestCapturePcapng(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	var file bytes.Buffer
+	pc, err := capture.NewPcapng(&file)
+	MustSucceed(t, err)
+	MustSucceed(t, cli.SetOption(mangos.OptionCapture, pc))
+	v, err := cli.GetOption(mangos.OptionCapture)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == pc)
+
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+	start := time.Now()
+	MustSucceed(t, cli.Send([]byte("ping")))
+	m, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "ping")
+	MustSucceed(t, srv.Send([]byte("pong")))
+	m, err = cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "pong")
+
+	// Nothing more once it is taken away.
+	MustSucceed(t, cli.SetOption(mangos.OptionCapture, nil))
+	MustSucceed(t, cli.Send([]byte("unseen")))
+	MustSucceed(t, pc.Err())
+
+	frames, err := capture.ReadPcapng(bytes.NewReader(file.Bytes()))
+	MustSucceed(t, err)
+	MustBeTrue(t, len(frames) == 2)
+	out, in := frames[0], frames[1]
+	MustBeTrue(t, out.Sent && !in.Sent)
+	MustBeTrue(t, string(out.Body) == "ping")
+	MustBeTrue(t, out.Pipe == in.Pipe && out.Pipe != 0)
+	MustBeTrue(t, out.Address == addr && in.Address == addr)
+
+	// The request ID goes out in the header, and comes back at the
+	// front of the reply, as the protocol has yet to take it off.
+	MustBeTrue(t, len(out.Header) == 4 && out.Header[0]&0x80 != 0)
+	MustBeTrue(t, len(in.Header) == 0)
+	MustBeTrue(t, string(in.Body) == string(out.Header)+"pong")
+	MustBeFalse(t, out.Time.Before(start.Truncate(time.Microsecond)))
+	MustBeFalse(t, in.Time.Before(out.Time))
+}
+
+func TestCaptureText(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	var sb strings.Builder
+	tc := capture.NewText(&sb)
+	tc.Limit(4)
+	MustSucceed(t, s2.SetOption(mangos.OptionCapture, tc))
+	MustSucceed(t, s1.Send([]byte("hello world")))
+	_, err := s2.Recv()
+	MustSucceed(t, err)
+	MustSucceed(t, tc.Err())
+
+	text := sb.String()
+	MustBeTrue(t, strings.Contains(text, " < inproc://"))
+	MustBeTrue(t, strings.Contains(text, "header 0 body 11\n"))
+	MustBeTrue(t, strings.Contains(text, "68 65 6c 6c "))
+	MustBeTrue(t, strings.Contains(text, "|hell|\n"))
+	MustBeFalse(t, strings.Contains(text, "6f"))
+}
+
+func TestCaptureBodies(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	var file bytes.Buffer
+	pc, err := capture.NewPcapng(&file)
+	MustSucceed(t, err)
+	MustSucceed(t, s1.SetOption(mangos.OptionCapture, pc))
+
+	// The segments in Bodies are captured after the Body.
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, "hello"...)
+	m.Bodies = [][]byte{[]byte(" "), []byte("world")}
+	MustSucceed(t, s1.SendMsg(m))
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "hello world")
+	MustSucceed(t, pc.Err())
+
+	frames, err := capture.ReadPcapng(bytes.NewReader(file.Bytes()))
+	MustSucceed(t, err)
+	MustBeTrue(t, len(frames) == 1)
+	MustBeTrue(t, frames[0].Sent)
+	MustBeTrue(t, string(frames[0].Body) == "hello world")
+}
+
+func TestCaptureErrors(t *testing.T) {
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionCapture)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == nil)
+	MustBeTrue(t, s.SetOption(mangos.OptionCapture, "file") == mangos.ErrBadValue)
+
+	_, err = capture.ReadPcapng(strings.NewReader("not a capture"))
+	MustBeTrue(t, err == capture.ErrFormat)
+	_, err = capture.ReadPcapng(strings.NewReader(""))
+	MustBeTrue(t, err == capture.ErrFormat)
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/transport"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+	_ "nanomsg.org/go/mangos/v2/transport/wss"
+)
+
+// writeCert writes the certificate and its key as PEM files.
+func writeCert(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	kb, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	MustSucceed(t, err)
+	MustSucceed(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	MustSucceed(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0600))
+}
+
+// serverCN dials addr, and returns the common name of the certificate
+// the server presented, leaving the client open.
+func serverCN(t *testing.T, addr string, pool *x509.CertPool) (mangos.Socket, string) {
+	cli, err := bus.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{
+			RootCAs:    pool,
+			ServerName: "127.0.0.1",
+		},
+	}))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.Send([]byte("hello")))
+	m, err := cli.RecvMsg()
+	MustSucceed(t, err)
+	defer m.Free()
+	v, err := m.Pipe.GetOption(mangos.OptionTLSConnState)
+	MustSucceed(t, err)
+	return cli, v.(tls.ConnectionState).PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSCertReload(t *testing.T) {
+	for _, addr := range []string{AddrTestTLS(), AddrTestWSS()} {
+		vc := newVerifyCerts(t)
+		dir, err := ioutil.TempDir("", "certreload")
+		MustSucceed(t, err)
+		defer os.RemoveAll(dir)
+		certFile := filepath.Join(dir, "cert.pem")
+		keyFile := filepath.Join(dir, "key.pem")
+		writeCert(t, vc.leaf(t, "first"), certFile, keyFile)
+
+		r, err := transport.NewCertReloader(certFile, keyFile)
+		MustSucceed(t, err)
+
+		srv, err := bus.NewSocket()
+		MustSucceed(t, err)
+		defer srv.Close()
+		MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+		MustSucceed(t, srv.ListenOptions(addr, map[string]interface{}{
+			mangos.OptionTLSConfig: &tls.Config{GetCertificate: r.GetCertificate},
+		}))
+		// Answer each hello, so that the client can see its pipe.  BUS
+		// sends each answer to every client.
+		go func() {
+			for {
+				m, err := srv.RecvMsg()
+				if err != nil {
+					return
+				}
+				srv.SendMsg(m)
+			}
+		}()
+
+		cli1, cn := serverCN(t, addr, vc.pool)
+		MustBeTrue(t, cn == "first")
+		defer cli1.Close()
+
+		// A bad file leaves the certificate as it was.
+		MustSucceed(t, ioutil.WriteFile(keyFile, []byte("junk"), 0600))
+		MustFail(t, r.Reload())
+
+		writeCert(t, vc.leaf(t, "second"), certFile, keyFile)
+		MustSucceed(t, r.Reload())
+		cli2, cn := serverCN(t, addr, vc.pool)
+		MustBeTrue(t, cn == "second")
+		MustSucceed(t, cli2.Close())
+
+		// The connection made before carries on.
+		MustSucceed(t, cli1.Send([]byte("again")))
+		_, err = cli1.Recv()
+		MustSucceed(t, err)
+	}
+}
+
+func TestTLSNoCert(t *testing.T) {
+	srv, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	err = srv.ListenOptions(AddrTestTLS(), map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{},
+	})
+	MustBeTrue(t, err == mangos.ErrTLSNoCert)
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestChecksumOptions(t *testing.T) {
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+
+	v, err := sock.GetOption(mangos.OptionChecksum)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == false)
+	MustBeTrue(t, sock.SetOption(mangos.OptionChecksum, 1) == mangos.ErrBadValue)
+	MustSucceed(t, sock.SetOption(mangos.OptionChecksum, true))
+
+	d, err := sock.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionChecksum)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == true)
+}
+
+func TestChecksumAgreed(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, cli.SetOption(mangos.OptionChecksum, true))
+	MustSucceed(t, cli.SetOption(mangos.OptionChunkSize, 4096))
+	MustSucceed(t, cli.SetOption(mangos.OptionHeartbeatTime, time.Millisecond*10))
+	MustSucceed(t, cli.Dial(addr))
+	time.Sleep(time.Millisecond * 50) // some heartbeats
+
+	big := make([]byte, 20000)
+	rand.Read(big)
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, big[:5000]...)
+	m.Bodies = [][]byte{big[5000:]}
+	MustSucceed(t, cli.SendMsg(m))
+	MustSucceed(t, cli.Send([]byte("small")))
+	m, err = srv.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(m.Body, big))
+	v, err := m.Pipe.GetOption(mangos.OptionChecksum)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == true)
+	m.Free()
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "small")
+
+	// And the other way, in a batch.
+	var msgs []*mangos.Message
+	for i := 0; i < 10; i++ {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, byte(i))
+		msgs = append(msgs, m)
+	}
+	MustSucceed(t, srv.SendMsgs(msgs))
+	for i := 0; i < 10; i++ {
+		b, err := cli.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && int(b[0]) == i)
+	}
+	MustBeTrue(t, srv.Stats().Corrupt == 0)
+	MustBeTrue(t, cli.Stats().Corrupt == 0)
+}
+
+// crcFrame frames b as the given type of frame, with its checksum.
+func crcFrame(typ byte, b []byte) []byte {
+	f := make([]byte, 9, 13+len(b))
+	binary.BigEndian.PutUint64(f, uint64(len(b)+5))
+	f[8] = typ
+	f = append(f, b...)
+	var sum [4]byte
+	c := crc32.Checksum(f[8:], crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(sum[:], c)
+	return append(f, sum[:]...)
+}
+
+// TestChecksumWire checks the checksums sent, with a peer of our own,
+// and that one that does not match closes the pipe.
+func TestChecksumWire(t *testing.T) {
+	addr := AddrTestTCP()
+	l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer l.Close()
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.SetOption(mangos.OptionChecksum, true))
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	}))
+
+	c, err := l.Accept()
+	MustSucceed(t, err)
+	defer c.Close()
+	MustSucceed(t, c.SetDeadline(time.Now().Add(time.Second*5)))
+	hdr := make([]byte, 10)
+	_, err = io.ReadFull(c, hdr)
+	MustSucceed(t, err)
+	MustBeTrue(t, binary.BigEndian.Uint16(hdr[6:]) == 0x8000)
+	_, err = io.ReadFull(c, make([]byte, binary.BigEndian.Uint16(hdr[8:])))
+	MustSucceed(t, err)
+	block := extTLV(6, []byte{1})
+	reply := []byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoPair), 0x80, 0}
+	reply = append(reply, byte(len(block)>>8), byte(len(block)))
+	_, err = c.Write(append(reply, block...))
+	MustSucceed(t, err)
+
+	MustSucceed(t, cli.Send([]byte("hello")))
+	want := crcFrame(0, []byte("hello"))
+	got := make([]byte, len(want))
+	_, err = io.ReadFull(c, got)
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(got, want))
+
+	_, err = c.Write(crcFrame(0, []byte("fine")))
+	MustSucceed(t, err)
+	b, err := cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "fine")
+	MustBeTrue(t, cli.Stats().Corrupt == 0)
+
+	// A flipped bit is caught, and the pipe closed.
+	bad := crcFrame(0, []byte("garbled"))
+	bad[10] ^= 0x04
+	_, err = c.Write(bad)
+	MustSucceed(t, err)
+	_, err = cli.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	MustBeTrue(t, cli.Stats().Corrupt == 1)
+	_, err = c.Read(make([]byte, 1))
+	MustBeTrue(t, err == io.EOF)
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestChunkOptions(t *testing.T) {
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+
+	v, err := sock.GetOption(mangos.OptionChunkSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+	MustBeTrue(t, sock.SetOption(mangos.OptionChunkSize, 100) == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionChunkSize, -1) == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionChunkSize, "big") == mangos.ErrBadValue)
+	MustSucceed(t, sock.SetOption(mangos.OptionChunkSize, 4096))
+
+	d, err := sock.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionChunkSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 4096)
+}
+
+func TestChunkAgreed(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, srv.SetOption(mangos.OptionChunkSize, 8192))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, cli.SetOption(mangos.OptionChunkSize, 4096))
+	MustSucceed(t, cli.Dial(addr))
+
+	// Split over segments, so that chunks span them.
+	big := make([]byte, 512*1024+123)
+	rand.Read(big)
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, big[:5000]...)
+	m.Bodies = [][]byte{big[5000:70000], {}, big[70000:]}
+	MustSucceed(t, cli.SendMsg(m))
+	MustSucceed(t, cli.Send([]byte("small")))
+
+	m, err = srv.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(m.Body, big))
+	v, err := m.Pipe.GetOption(mangos.OptionChunkSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 4096)
+	m.Free()
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "small")
+
+	// And the other way.
+	MustSucceed(t, srv.Send(big))
+	m, err = cli.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(m.Body, big))
+	v, err = m.Pipe.GetOption(mangos.OptionChunkSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 4096)
+	m.Free()
+}
+
+// chunkFrame frames b as the given type of frame.
+func chunkFrame(typ byte, b []byte) []byte {
+	f := make([]byte, 9, 9+len(b))
+	binary.BigEndian.PutUint64(f, uint64(len(b)+1))
+	f[8] = typ
+	return append(f, b...)
+}
+
+// TestChunkWire checks the framing of chunks, with a peer of our own
+// that agrees to chunks of 1024 bytes, and sends a message between the
+// chunks of another.
+func TestChunkWire(t *testing.T) {
+	addr := AddrTestTCP()
+	l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer l.Close()
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.SetOption(mangos.OptionChunkSize, 1024))
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	}))
+
+	c, err := l.Accept()
+	MustSucceed(t, err)
+	defer c.Close()
+	MustSucceed(t, c.SetDeadline(time.Now().Add(time.Second*5)))
+	hdr := make([]byte, 10)
+	_, err = io.ReadFull(c, hdr)
+	MustSucceed(t, err)
+	MustBeTrue(t, binary.BigEndian.Uint16(hdr[6:]) == 0x8000)
+	_, err = io.ReadFull(c, make([]byte, binary.BigEndian.Uint16(hdr[8:])))
+	MustSucceed(t, err)
+	block := extTLV(4, []byte{0, 0, 4, 0})
+	reply := []byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoPair), 0x80, 0}
+	reply = append(reply, byte(len(block)>>8), byte(len(block)))
+	_, err = c.Write(append(reply, block...))
+	MustSucceed(t, err)
+
+	// 2.5 chunks' worth arrives as three frames.
+	big := make([]byte, 2560)
+	rand.Read(big)
+	MustSucceed(t, cli.Send(big))
+	var got []byte
+	for _, want := range []struct {
+		typ byte
+		n   int
+	}{{3, 1024}, {3, 1024}, {4, 512}} {
+		fh := make([]byte, 9)
+		_, err = io.ReadFull(c, fh)
+		MustSucceed(t, err)
+		MustBeTrue(t, binary.BigEndian.Uint64(fh) == uint64(want.n+1))
+		MustBeTrue(t, fh[8] == want.typ)
+		b := make([]byte, want.n)
+		_, err = io.ReadFull(c, b)
+		MustSucceed(t, err)
+		got = append(got, b...)
+	}
+	MustBeTrue(t, bytes.Equal(got, big))
+
+	// A message sent whole between chunks arrives first.
+	var out []byte
+	out = append(out, chunkFrame(3, big[:1024])...)
+	out = append(out, chunkFrame(0, []byte("between"))...)
+	out = append(out, chunkFrame(2, nil)...) // a heartbeat
+	out = append(out, chunkFrame(3, big[1024:2048])...)
+	out = append(out, chunkFrame(4, big[2048:])...)
+	_, err = c.Write(out)
+	MustSucceed(t, err)
+	b, err := cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "between")
+	b, err = cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(b, big))
+}
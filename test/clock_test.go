@@ -0,0 +1,140 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/clock"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestClockOption(t *testing.T) {
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionClock)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == mangos.SystemClock)
+
+	vc := clock.NewVirtual(time.Time{})
+	MustSucceed(t, s.SetOption(mangos.OptionClock, vc))
+	v, err = s.GetOption(mangos.OptionClock)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == vc)
+	MustBeTrue(t, s.SetOption(mangos.OptionClock, 1) == mangos.ErrBadValue)
+	MustSucceed(t, s.SetOption(mangos.OptionClock, nil))
+	v, err = s.GetOption(mangos.OptionClock)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == mangos.SystemClock)
+}
+
+func TestClockResend(t *testing.T) {
+	addr := AddrTestInp()
+	vc := clock.NewVirtual(time.Time{})
+	rx, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.Listen(addr))
+	tx, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.SetOption(mangos.OptionClock, vc))
+	MustSucceed(t, tx.SetOption(mangos.OptionRetryTime, time.Hour))
+	MustSucceed(t, tx.Dial(addr))
+	waitPipes(t, tx, 1)
+
+	MustSucceed(t, tx.Send([]byte("ping")))
+	b, err := rx.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+
+	// An hour passes at once, and the request is sent again.
+	vc.WaitTimers(1)
+	vc.Advance(time.Hour)
+	b, err = rx.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+
+	MustSucceed(t, rx.Send([]byte("pong")))
+	MustSucceed(t, tx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	b, err = tx.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "pong")
+}
+
+func TestClockSurveyTime(t *testing.T) {
+	addr := AddrTestInp()
+	vc := clock.NewVirtual(time.Time{})
+	s, err := surveyor.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionClock, vc))
+	MustSucceed(t, s.SetOption(mangos.OptionSurveyTime, time.Hour))
+	MustSucceed(t, s.Listen(addr))
+	r, err := respondent.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.Dial(addr))
+	waitPipes(t, s, 1)
+
+	done := make(chan error, 1)
+	MustSucceed(t, s.Send([]byte("survey")))
+	go func() {
+		_, err := s.Recv()
+		done <- err
+	}()
+	vc.WaitTimers(1)
+	vc.Advance(time.Hour)
+	select {
+	case err := <-done:
+		MustBeTrue(t, err == mangos.ErrProtoState)
+	case <-time.After(time.Second):
+		t.Fatalf("survey did not end")
+	}
+}
+
+func TestClockReconnect(t *testing.T) {
+	addr := AddrTestInp()
+	vc := clock.NewVirtual(time.Time{})
+	tx, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.SetOption(mangos.OptionClock, vc))
+	MustSucceed(t, tx.SetOption(mangos.OptionReconnectTime, time.Hour))
+	MustSucceed(t, tx.SetOption(mangos.OptionMaxReconnectTime, time.Hour))
+	MustSucceed(t, tx.DialOptions(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	}))
+
+	// The first attempt fails, and the next is an hour away.
+	vc.WaitTimers(1)
+	rx, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.Listen(addr))
+	time.Sleep(time.Millisecond * 20)
+	MustBeTrue(t, len(tx.Pipes()) == 0)
+
+	vc.Advance(time.Hour)
+	waitPipes(t, tx, 1)
+}
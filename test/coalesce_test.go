@@ -0,0 +1,153 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestCoalesceOptions(t *testing.T) {
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+
+	v, err := sock.GetOption(mangos.OptionCoalesceTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == time.Duration(0))
+	v, err = sock.GetOption(mangos.OptionCoalesceBytes)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == 64*1024)
+	MustBeTrue(t, sock.SetOption(mangos.OptionCoalesceTime, -time.Second) == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionCoalesceTime, 1) == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionCoalesceBytes, 0) == mangos.ErrBadValue)
+	MustSucceed(t, sock.SetOption(mangos.OptionCoalesceTime, time.Millisecond))
+	MustSucceed(t, sock.SetOption(mangos.OptionCoalesceBytes, 1024))
+
+	d, err := sock.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionCoalesceTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == time.Millisecond)
+	v, err = d.GetOption(mangos.OptionCoalesceBytes)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == 1024)
+}
+
+// coalescePair returns a connected pair of sockets, the first of which
+// holds back what it sends for an hour, unless flushed.
+func coalescePair(t *testing.T) (mangos.Socket, mangos.Socket) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, cli.SetOption(mangos.OptionCoalesceTime, time.Hour))
+	MustSucceed(t, cli.SetOption(mangos.OptionCoalesceBytes, 4096))
+	MustSucceed(t, cli.Dial(addr))
+	waitPipes(t, srv, 1)
+	return cli, srv
+}
+
+func TestCoalesceFlush(t *testing.T) {
+	cli, srv := coalescePair(t)
+	defer cli.Close()
+	defer srv.Close()
+
+	for i := 0; i < 10; i++ {
+		MustSucceed(t, cli.Send([]byte{byte(i)}))
+	}
+	_, err := srv.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+
+	// The pipe may not have taken the last from the queue yet.
+	time.Sleep(time.Millisecond * 20)
+	MustSucceed(t, cli.WriterOnly().Flush())
+	for i := 0; i < 10; i++ {
+		b, err := srv.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && int(b[0]) == i)
+	}
+
+	// What would take more than the limit goes at once, with what was
+	// held back before it.
+	MustSucceed(t, cli.Send([]byte("first")))
+	MustSucceed(t, cli.Send(make([]byte, 5000)))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "first")
+	b, err = srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, len(b) == 5000)
+
+	// Batches are held back too.
+	var msgs []*mangos.Message
+	for i := 0; i < 5; i++ {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, byte(i))
+		msgs = append(msgs, m)
+	}
+	MustSucceed(t, cli.SendMsgs(msgs))
+	_, err = srv.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+
+	// Turning coalescing off, on the live pipe, writes them.
+	MustSucceed(t, cli.SetOption(mangos.OptionCoalesceTime, time.Duration(0)))
+	for i := 0; i < 5; i++ {
+		b, err := srv.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && int(b[0]) == i)
+	}
+	MustSucceed(t, cli.Send([]byte("now")))
+	b, err = srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "now")
+}
+
+func TestCoalesceExpire(t *testing.T) {
+	cli, srv := coalescePair(t)
+	defer cli.Close()
+	defer srv.Close()
+
+	MustSucceed(t, cli.SetOption(mangos.OptionCoalesceTime, time.Millisecond*20))
+	start := time.Now()
+	MustSucceed(t, cli.Send([]byte("late")))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "late")
+	MustBeTrue(t, time.Since(start) >= time.Millisecond*20)
+}
+
+func TestCoalesceDrain(t *testing.T) {
+	cli, srv := coalescePair(t)
+	defer srv.Close()
+
+	MustSucceed(t, cli.Send([]byte("held")))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	MustSucceed(t, cli.Drain(ctx))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "held")
+	MustBeTrue(t, cli.Flush() == mangos.ErrClosed)
+}
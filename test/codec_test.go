@@ -0,0 +1,139 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/codec"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+type codecOrder struct {
+	ID    int
+	Items []string
+}
+
+func TestCodecJSON(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	MustSucceed(t, codec.SendJSON(s1, &codecOrder{ID: 7, Items: []string{"a"}}))
+	m, err := s2.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m.Body) == `{"ID":7,"Items":["a"]}`)
+	m.Free()
+
+	MustSucceed(t, codec.SendJSON(s1, codecOrder{ID: 8}))
+	var o codecOrder
+	MustSucceed(t, codec.RecvJSON(s2, &o))
+	MustBeTrue(t, o.ID == 8 && o.Items == nil)
+
+	// What cannot be encoded is not sent, and what cannot be
+	// decoded is consumed.
+	MustFail(t, codec.SendJSON(s1, make(chan int)))
+	MustSucceed(t, s1.Send([]byte("{not json")))
+	MustSucceed(t, s1.Send([]byte(`{"ID": 9}`)))
+	MustFail(t, codec.RecvJSON(s2, &o))
+	MustSucceed(t, codec.RecvJSON(s2, &o))
+	MustBeTrue(t, o.ID == 9)
+}
+
+func TestCodecGob(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	for i := 0; i < 3; i++ {
+		MustSucceed(t, codec.SendGob(s1, &codecOrder{ID: i, Items: []string{"x", "y"}}))
+	}
+	for i := 0; i < 3; i++ {
+		var o codecOrder
+		MustSucceed(t, codec.RecvGob(s2, &o))
+		MustBeTrue(t, o.ID == i && len(o.Items) == 2)
+	}
+}
+
+func TestCodecProto(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+
+	// Contexts work as well as sockets.
+	ctx, err := cli.OpenContext()
+	MustSucceed(t, err)
+	MustSucceed(t, ctx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, codec.SendProto(ctx, wrapperspb.String("ping")))
+	q := &wrapperspb.StringValue{}
+	MustSucceed(t, codec.RecvProto(srv, q))
+	MustBeTrue(t, q.Value == "ping")
+	MustSucceed(t, codec.SendProto(srv, wrapperspb.Int64(42)))
+	a := &wrapperspb.Int64Value{}
+	MustSucceed(t, codec.RecvProto(ctx, a))
+	MustBeTrue(t, a.Value == 42)
+
+	MustBeTrue(t, codec.Send(srv, codec.Proto, "text") == mangos.ErrBadValue)
+	m := mangos.NewMessage(0)
+	MustBeTrue(t, codec.Proto.Decode(m, &q.Value) == mangos.ErrBadValue)
+	m.Free()
+}
+
+func TestCodecTyped(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	orders := codec.NewTyped[codecOrder](s1, codec.JSON)
+	MustSucceed(t, orders.Send(codecOrder{ID: 1, Items: []string{"a"}}))
+	o, err := codec.NewTyped[codecOrder](s2, codec.JSON).Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, o.ID == 1 && o.Items[0] == "a")
+
+	// Pointers are given something new to point to.
+	ptrs := codec.NewTyped[*codecOrder](s2, codec.Gob)
+	MustSucceed(t, codec.NewTyped[*codecOrder](s1, codec.Gob).Send(&codecOrder{ID: 2}))
+	p, err := ptrs.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, p != nil && p.ID == 2)
+
+	pb := codec.NewTyped[*wrapperspb.StringValue](s2, codec.Proto)
+	MustSucceed(t, codec.NewTyped[*wrapperspb.StringValue](s1, codec.Proto).Send(
+		wrapperspb.String("typed")))
+	sv, err := pb.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, sv.Value == "typed")
+
+	// Failures give the zero value.
+	MustSucceed(t, s1.Send([]byte("{")))
+	p, err = codec.NewTyped[*codecOrder](s2, codec.JSON).Recv()
+	MustFail(t, err)
+	MustBeTrue(t, p == nil)
+	MustSucceed(t, s1.SetOption(mangos.OptionRecvDeadline, time.Millisecond*10))
+	o, err = orders.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	MustBeTrue(t, o.ID == 0 && o.Items == nil)
+}
@@ -0,0 +1,291 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// compressPair connects two PAIR sockets over TCP, with the given
+// compression wanted by each.
+func compressPair(t *testing.T, dial, listen string) (mangos.Socket, mangos.Socket) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.SetOption(mangos.OptionCompression, listen))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.SetOption(mangos.OptionCompression, dial))
+	MustSucceed(t, cli.Dial(addr))
+	return cli, srv
+}
+
+func compressRoundTrip(t *testing.T, from, to mangos.Socket, m *mangos.Message) *mangos.Message {
+	body := append([]byte{}, m.Body...)
+	MustSucceed(t, from.SendMsg(m))
+	r, err := to.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(r.Body, body))
+	return r
+}
+
+func TestCompressionOptions(t *testing.T) {
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+
+	v, err := sock.GetOption(mangos.OptionCompression)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(string) == "")
+	v, err = sock.GetOption(mangos.OptionCompressionThreshold)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 512)
+
+	MustSucceed(t, sock.SetOption(mangos.OptionCompression, "gzip"))
+	MustSucceed(t, sock.SetOption(mangos.OptionCompression, "snappy"))
+	MustSucceed(t, sock.SetOption(mangos.OptionCompressionThreshold, 0))
+	MustBeTrue(t, sock.SetOption(mangos.OptionCompression, "lz4") == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionCompression, 1) == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionCompressionThreshold, -1) == mangos.ErrBadValue)
+
+	d, err := sock.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionCompression)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(string) == "snappy")
+	v, err = d.GetOption(mangos.OptionCompressionThreshold)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+}
+
+func TestCompressionAgreed(t *testing.T) {
+	for _, name := range []string{"gzip", "snappy"} {
+		cli, srv := compressPair(t, name, name)
+
+		big := strings.Repeat("compressible ", 1000)
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, big...)
+		r := compressRoundTrip(t, cli, srv, m)
+		v, err := r.Pipe.GetOption(mangos.OptionCompression)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(string) == name)
+
+		// Small messages, and those asked not to be, go plain, but
+		// arrive just the same.
+		m = mangos.NewMessage(0)
+		m.Body = append(m.Body, "small"...)
+		compressRoundTrip(t, srv, cli, m)
+		m = mangos.NewMessage(0)
+		m.Body = append(m.Body, big...)
+		m.Compress = mangos.CompressNever
+		compressRoundTrip(t, srv, cli, m)
+		m = mangos.NewMessage(0)
+		m.Body = append(m.Body, "tiny but forced"...)
+		m.Compress = mangos.CompressAlways
+		compressRoundTrip(t, cli, srv, m)
+
+		cli.Close()
+		srv.Close()
+	}
+}
+
+func TestCompressionDeclined(t *testing.T) {
+	for _, c := range [][2]string{{"gzip", ""}, {"", "gzip"}, {"gzip", "snappy"}} {
+		cli, srv := compressPair(t, c[0], c[1])
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, strings.Repeat("x", 4096)...)
+		r := compressRoundTrip(t, cli, srv, m)
+		v, err := r.Pipe.GetOption(mangos.OptionCompression)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(string) == "")
+		cli.Close()
+		srv.Close()
+	}
+}
+
+func TestCompressionMaxRecvSize(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+	MustSucceed(t, srv.SetOption(mangos.OptionMaxRecvSize, 1024))
+	MustSucceed(t, srv.SetOption(mangos.OptionCompression, "gzip"))
+	MustSucceed(t, srv.Listen(addr))
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionCompression, "gzip"))
+	MustSucceed(t, cli.Dial(addr))
+
+	// This compresses to well under the limit, but must still be
+	// refused, either by the sender, which was told the limit, or by
+	// the receiver, once expanded.
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, make([]byte, 64*1024)...)
+	MustSucceed(t, cli.SendMsg(m))
+	_, err = srv.RecvMsg()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+}
+
+// TestCompressionLegacyPeer checks that a dialer falls back to a plain
+// handshake with a peer that rejects the offer, as older versions of
+// mangos, and nanomsg, do.
+func TestCompressionLegacyPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	MustSucceed(t, err)
+	defer l.Close()
+
+	done := make(chan []byte, 1)
+	go func() {
+		reply := []byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoPair), 0, 0}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			hdr := make([]byte, 8)
+			if _, err = io.ReadFull(c, hdr); err != nil {
+				c.Close()
+				continue
+			}
+			c.Write(reply)
+			if binary.BigEndian.Uint16(hdr[6:]) != 0 {
+				c.Close()
+				continue
+			}
+			// A plain handshake, so plain messages follow.
+			var size uint64
+			binary.Read(c, binary.BigEndian, &size)
+			body := make([]byte, size)
+			io.ReadFull(c, body)
+			done <- body
+			c.Close()
+			return
+		}
+	}()
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionCompression, "gzip"))
+	MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	MustSucceed(t, cli.DialOptions("tcp://"+l.Addr().String(),
+		map[string]interface{}{mangos.OptionDialAsynch: true}))
+	MustSucceed(t, cli.Send([]byte("hello")))
+
+	select {
+	case body := <-done:
+		MustBeTrue(t, string(body) == "hello")
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no plain connection made")
+	}
+}
+
+// TestCompressionOnTheWire checks, from a listener speaking the handshake
+// itself, which messages arrive compressed.  Message.Compress overrides
+// the threshold either way.
+func TestCompressionOnTheWire(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	MustSucceed(t, err)
+	defer l.Close()
+
+	frames := make(chan []byte, 4)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		hdr := make([]byte, 10)
+		if _, err = io.ReadFull(c, hdr); err != nil {
+			return
+		}
+		offers := make([]byte, binary.BigEndian.Uint16(hdr[8:]))
+		if _, err = io.ReadFull(c, offers); err != nil {
+			return
+		}
+		block := extTLV(1, []byte("gzip"))
+		reply := []byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoPair), 0x80, 0}
+		reply = append(reply, byte(len(block)>>8), byte(len(block)))
+		if _, err = c.Write(append(reply, block...)); err != nil {
+			return
+		}
+		for i := 0; i < cap(frames); i++ {
+			var size uint64
+			if binary.Read(c, binary.BigEndian, &size) != nil {
+				return
+			}
+			frame := make([]byte, size)
+			if _, err = io.ReadFull(c, frame); err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionCompression, "gzip"))
+	MustSucceed(t, cli.Dial("tcp://"+l.Addr().String()))
+
+	big := strings.Repeat("compressible ", 100)
+	small := strings.Repeat("a", 400) // under the threshold of 512
+	cases := []struct {
+		body       string
+		compress   mangos.CompressMode
+		compressed bool
+	}{
+		{big, mangos.CompressDefault, true},
+		{small, mangos.CompressDefault, false},
+		{big, mangos.CompressNever, false},
+		{small, mangos.CompressAlways, true},
+	}
+	for _, c := range cases {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, c.body...)
+		m.Compress = c.compress
+		MustSucceed(t, cli.SendMsg(m))
+	}
+	for _, c := range cases {
+		select {
+		case frame := <-frames:
+			if c.compressed {
+				MustBeTrue(t, frame[0] == 1)
+				MustBeTrue(t, len(frame) < len(c.body))
+			} else {
+				MustBeTrue(t, frame[0] == 0)
+				MustBeTrue(t, string(frame[1:]) == c.body)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("message not received")
+		}
+	}
+}
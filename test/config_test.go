@@ -0,0 +1,189 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/config"
+)
+
+func TestConfigYAML(t *testing.T) {
+	jobs, results := AddrTestInp(), AddrTestInp()
+	socks, err := buildConfig(t, `
+sockets:
+  - name: jobs
+    protocol: push
+    options:
+      WRITEQ-LEN: 16
+      LOAD-BALANCE: least-queued
+      SEND-DEADLINE: 1s
+    listen: [ "`+jobs+`" ]
+  - name: worker
+    protocol: pull
+    options:
+      RECV-DEADLINE: 1s
+    dial: [ "`+jobs+`" ]
+  - name: news
+    protocol: pub
+    listen: [ "`+results+`" ]
+  - name: reader
+    protocol: sub
+    raw: false
+    options:
+      SUBSCRIBE: [ "a", "b" ]
+      RECV-DEADLINE: 1s
+    dial: [ "`+results+`" ]
+`)
+	MustSucceed(t, err)
+	MustBeTrue(t, len(socks) == 4)
+	for _, s := range socks {
+		defer s.Close()
+	}
+
+	v, err := socks["jobs"].GetOption(mangos.OptionWriteQLen)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == 16)
+	v, err = socks["jobs"].GetOption(mangos.OptionLoadBalance)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == mangos.LoadBalanceLeastQueued)
+	v, err = socks["jobs"].GetOption(mangos.OptionSendDeadline)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == time.Second)
+
+	MustSucceed(t, socks["jobs"].Send([]byte("work")))
+	b, err := socks["worker"].Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "work")
+
+	waitPipes(t, socks["news"], 1)
+	for _, topic := range []string{"a1", "c1", "b1"} {
+		MustSucceed(t, socks["news"].Send([]byte(topic)))
+	}
+	for _, topic := range []string{"a1", "b1"} {
+		b, err = socks["reader"].Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == topic)
+	}
+}
+
+func TestConfigJSONFile(t *testing.T) {
+	addr := AddrTestInp()
+	dir, err := ioutil.TempDir("", "config")
+	MustSucceed(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "topology.json")
+	MustSucceed(t, ioutil.WriteFile(path, []byte(`{
+	"sockets": [
+		{"name": "server", "protocol": "rep", "raw": true,
+		 "listen": ["`+addr+`"]},
+		{"name": "client", "protocol": "req",
+		 "options": {"RETRY-TIME": "2m"}, "dial": ["`+addr+`"]}
+	]
+}`), 0644))
+	socks, err := config.Open(path)
+	MustSucceed(t, err)
+	for _, s := range socks {
+		defer s.Close()
+	}
+	v, err := socks["server"].GetOption(mangos.OptionRaw)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == true)
+	v, err = socks["client"].GetOption(mangos.OptionRetryTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == time.Minute*2)
+	waitPipes(t, socks["server"], 1)
+
+	_, err = config.Open(filepath.Join(dir, "missing.json"))
+	MustBeTrue(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestConfigErrors(t *testing.T) {
+	addr := AddrTestInp()
+	var ce *config.Error
+
+	_, err := buildConfig(t, `
+sockets:
+  - name: a
+    protocol: pair
+    listen: [ "`+addr+`" ]
+  - name: b
+    protocol: chat
+`)
+	MustBeTrue(t, errors.As(err, &ce))
+	MustBeTrue(t, ce.Socket == "b")
+
+	_, err = buildConfig(t, `
+sockets:
+  - name: a
+    protocol: pair
+    options: { SURVEY-TIME: 1s }
+`)
+	MustBeTrue(t, errors.As(err, &ce))
+	MustBeTrue(t, ce.Option == mangos.OptionSurveyTime)
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadOption))
+
+	_, err = buildConfig(t, `
+sockets:
+  - name: a
+    protocol: push
+    options: { WRITEQ-LEN: lots }
+`)
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadValue))
+	MustBeTrue(t, strings.Contains(err.Error(), "WRITEQ-LEN"))
+
+	_, err = buildConfig(t, `
+sockets:
+  - { name: a, protocol: pair }
+  - { name: a, protocol: pair }
+`)
+	MustBeTrue(t, errors.As(err, &ce))
+
+	_, err = buildConfig(t, `
+sockets:
+  - { name: a, protocol: pair, dial: [ "bogus://nowhere" ] }
+`)
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadTransport))
+
+	_, err = buildConfig(t, `
+sockets:
+  - { name: a, protocol: pair, tls: { cert: /nonexistent.pem } }
+`)
+	MustBeTrue(t, errors.Is(err, os.ErrNotExist))
+
+	_, err = config.Parse([]byte("sockets:\n  - { name: a, protocl: pair }\n"))
+	MustFail(t, err)
+
+	// Nothing is left behind by a failure; the address is free again.
+	s, err := buildConfig(t, `
+sockets:
+  - { name: a, protocol: pair, listen: [ "`+addr+`" ] }
+`)
+	MustSucceed(t, err)
+	MustSucceed(t, s["a"].Close())
+}
+
+func buildConfig(t *testing.T, text string) (map[string]mangos.Socket, error) {
+	topo, err := config.Parse([]byte(text))
+	MustSucceed(t, err)
+	return topo.Build()
+}
@@ -0,0 +1,383 @@
+// +build conformance
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+// These tests check that mangos speaks the SP wire protocol exactly as
+// documented by the nanomsg RFCs (sp-tcp-mapping, sp-ipc-mapping, and
+// the individual protocol RFCs), by talking to it byte for byte over
+// raw connections.  They guard against silent divergence from nanomsg
+// and other implementations.  If nanomsg's nanocat utility is found in
+// the PATH, we also check interoperation with it.  Run them with:
+//
+//	go test -tags conformance -run TestWire ./test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// wirePeer is a hand-rolled SP peer on a raw connection.
+type wirePeer struct {
+	t    *testing.T
+	c    net.Conn
+	ipc  bool
+	self uint16
+}
+
+func dialWire(t *testing.T, addr string, self uint16) *wirePeer {
+	network, host := "tcp", addr[len("tcp://"):]
+	ipc := false
+	if addr[:3] == "ipc" {
+		network, host, ipc = "unix", addr[len("ipc://"):], true
+	}
+	var c net.Conn
+	var err error
+	// The listener may still be getting ready.
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial(network, host); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	MustSucceed(t, err)
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+	return &wirePeer{t: t, c: c, ipc: ipc, self: self}
+}
+
+func listenWire(t *testing.T, addr string) net.Listener {
+	var l net.Listener
+	var err error
+	if addr[:3] == "ipc" {
+		l, err = net.Listen("unix", addr[len("ipc://"):])
+	} else {
+		l, err = net.Listen("tcp", addr[len("tcp://"):])
+	}
+	MustSucceed(t, err)
+	return l
+}
+
+func acceptWire(t *testing.T, l net.Listener, self uint16) *wirePeer {
+	c, err := l.Accept()
+	MustSucceed(t, err)
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+	_, ipc := l.(*net.UnixListener)
+	return &wirePeer{t: t, c: c, ipc: ipc, self: self}
+}
+
+// handshake exchanges the 8 byte SP header, and checks that the peer's
+// is exactly as the RFC requires: 0x00, 'S', 'P', version 0, the
+// protocol number (big endian), and two reserved zero bytes.
+func (w *wirePeer) handshake(peer uint16) {
+	hdr := []byte{0, 'S', 'P', 0, byte(w.self >> 8), byte(w.self), 0, 0}
+	_, err := w.c.Write(hdr)
+	MustSucceed(w.t, err)
+	got := make([]byte, 8)
+	_, err = io.ReadFull(w.c, got)
+	MustSucceed(w.t, err)
+	want := []byte{0, 'S', 'P', 0, byte(peer >> 8), byte(peer), 0, 0}
+	if !bytes.Equal(got, want) {
+		w.t.Fatalf("bad SP header: got % x want % x", got, want)
+	}
+}
+
+// send writes a message, framed by a 64-bit big endian length (and for
+// IPC, preceded by a message type byte of 1).  The header and body are
+// simply concatenated on the wire.
+func (w *wirePeer) send(hdr, body []byte) {
+	var frame []byte
+	if w.ipc {
+		frame = append(frame, 1)
+	}
+	var l [8]byte
+	binary.BigEndian.PutUint64(l[:], uint64(len(hdr)+len(body)))
+	frame = append(frame, l[:]...)
+	frame = append(frame, hdr...)
+	frame = append(frame, body...)
+	_, err := w.c.Write(frame)
+	MustSucceed(w.t, err)
+}
+
+// recv reads one framed message, returning its payload.
+func (w *wirePeer) recv() []byte {
+	if w.ipc {
+		var mt [1]byte
+		_, err := io.ReadFull(w.c, mt[:])
+		MustSucceed(w.t, err)
+		if mt[0] != 1 {
+			w.t.Fatalf("bad IPC message type %d", mt[0])
+		}
+	}
+	var l [8]byte
+	_, err := io.ReadFull(w.c, l[:])
+	MustSucceed(w.t, err)
+	b := make([]byte, binary.BigEndian.Uint64(l[:]))
+	_, err = io.ReadFull(w.c, b)
+	MustSucceed(w.t, err)
+	return b
+}
+
+func (w *wirePeer) close() {
+	w.c.Close()
+}
+
+func wireAddrs() []string {
+	return []string{AddrTestTCP(), AddrTestIPC()}
+}
+
+func newWireSock(t *testing.T, f func() (mangos.Socket, error)) mangos.Socket {
+	s, err := f()
+	MustSucceed(t, err)
+	return s
+}
+
+// dialWireSock dials a raw listener.  The dial must be asynchronous,
+// as the handshake cannot complete until we accept the connection.
+func dialWireSock(t *testing.T, s mangos.Socket, addr string) {
+	MustSucceed(t, s.DialOptions(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	}))
+}
+
+func TestWireRejectsBadPeer(t *testing.T) {
+	for _, addr := range wireAddrs() {
+		s := newWireSock(t, rep.NewSocket)
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+		MustSucceed(t, s.Listen(addr))
+
+		// A PUB is no peer for a REP, so the connection is dropped
+		// once the headers are exchanged.
+		w := dialWire(t, addr, mangos.ProtoPub)
+		w.handshake(mangos.ProtoRep)
+		_, err := w.c.Read(make([]byte, 1))
+		MustBeTrue(t, err == io.EOF)
+		w.close()
+
+		// As is one with a bad header.
+		w = dialWire(t, addr, mangos.ProtoReq)
+		_, err = w.c.Write([]byte{0, 'S', 'P', 1, 0, 0x30, 0, 0})
+		MustSucceed(t, err)
+		io.ReadFull(w.c, make([]byte, 8))
+		_, err = w.c.Read(make([]byte, 1))
+		MustBeTrue(t, err == io.EOF)
+		w.close()
+		s.Close()
+	}
+}
+
+// TestWireRep has mangos answer requests from a hand-rolled REQ.  The
+// request carries a 32-bit request ID with the high bit set, which
+// must be echoed in front of the reply.
+func TestWireRep(t *testing.T) {
+	for _, addr := range wireAddrs() {
+		s := newWireSock(t, rep.NewSocket)
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+		MustSucceed(t, s.Listen(addr))
+		w := dialWire(t, addr, mangos.ProtoReq)
+		w.handshake(mangos.ProtoRep)
+
+		for _, id := range []uint32{0x80000001, 0x8badf00d} {
+			hdr := make([]byte, 4)
+			binary.BigEndian.PutUint32(hdr, id)
+			w.send(hdr, []byte("ping"))
+			b, err := s.Recv()
+			MustSucceed(t, err)
+			MustBeTrue(t, string(b) == "ping")
+			MustSucceed(t, s.Send([]byte("pong")))
+			MustBeTrue(t, bytes.Equal(w.recv(), append(hdr, "pong"...)))
+		}
+		w.close()
+		s.Close()
+	}
+}
+
+// TestWireReq has a hand-rolled REP answer requests from mangos.
+func TestWireReq(t *testing.T) {
+	for _, addr := range wireAddrs() {
+		l := listenWire(t, addr)
+		s := newWireSock(t, req.NewSocket)
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+		dialWireSock(t, s, addr)
+		w := acceptWire(t, l, mangos.ProtoRep)
+		w.handshake(mangos.ProtoReq)
+
+		MustSucceed(t, s.Send([]byte("ping")))
+		b := w.recv()
+		MustBeTrue(t, len(b) == 8)
+		MustBeTrue(t, b[0]&0x80 != 0) // the ID ends the backtrace
+		MustBeTrue(t, string(b[4:]) == "ping")
+		w.send(b[:4], []byte("pong"))
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "pong")
+
+		// A subsequent request gets a different ID.
+		MustSucceed(t, s.Send([]byte("again")))
+		b2 := w.recv()
+		MustBeTrue(t, b2[0]&0x80 != 0)
+		MustBeFalse(t, bytes.Equal(b[:4], b2[:4]))
+
+		w.close()
+		l.Close()
+		s.Close()
+	}
+}
+
+// TestWirePub checks that PUB sends bare messages, with no header.
+func TestWirePub(t *testing.T) {
+	for _, addr := range wireAddrs() {
+		s := newWireSock(t, pub.NewSocket)
+		MustSucceed(t, s.Listen(addr))
+		w := dialWire(t, addr, mangos.ProtoSub)
+		w.handshake(mangos.ProtoPub)
+		// There is nothing to say the subscriber is attached, so
+		// keep publishing until it hears something.
+		for {
+			MustSucceed(t, s.Send([]byte("topic data")))
+			w.c.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+			var l [1]byte
+			if _, err := w.c.Read(l[:]); err == nil {
+				break
+			}
+		}
+		// We have consumed the first byte of the frame; read past
+		// the rest of it, then check the next one in full.
+		w.c.SetDeadline(time.Now().Add(time.Second * 5))
+		n := 7 + len("topic data")
+		if w.ipc {
+			n++
+		}
+		io.ReadFull(w.c, make([]byte, n))
+		MustSucceed(t, s.Send([]byte("second")))
+		MustBeTrue(t, string(w.recv()) == "second")
+		w.close()
+		s.Close()
+	}
+}
+
+// TestWireSub checks that SUB filters bare messages by prefix.
+func TestWireSub(t *testing.T) {
+	for _, addr := range wireAddrs() {
+		l := listenWire(t, addr)
+		s := newWireSock(t, sub.NewSocket)
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+		MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte("yes")))
+		dialWireSock(t, s, addr)
+		w := acceptWire(t, l, mangos.ProtoPub)
+		w.handshake(mangos.ProtoSub)
+
+		w.send(nil, []byte("no thanks"))
+		w.send(nil, []byte("yes please"))
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "yes please")
+		w.close()
+		l.Close()
+		s.Close()
+	}
+}
+
+// TestWirePipeline checks PUSH and PULL, which use no header.
+func TestWirePipeline(t *testing.T) {
+	for _, addr := range wireAddrs() {
+		s := newWireSock(t, pull.NewSocket)
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+		MustSucceed(t, s.Listen(addr))
+		w := dialWire(t, addr, mangos.ProtoPush)
+		w.handshake(mangos.ProtoPull)
+		w.send(nil, []byte("work"))
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "work")
+		w.close()
+		s.Close()
+
+		l := listenWire(t, addr)
+		s = newWireSock(t, push.NewSocket)
+		dialWireSock(t, s, addr)
+		w = acceptWire(t, l, mangos.ProtoPull)
+		w.handshake(mangos.ProtoPush)
+		MustSucceed(t, s.Send([]byte("work")))
+		MustBeTrue(t, string(w.recv()) == "work")
+		w.close()
+		l.Close()
+		s.Close()
+	}
+}
+
+// TestWireBus checks that BUS uses no header.
+func TestWireBus(t *testing.T) {
+	for _, addr := range wireAddrs() {
+		s := newWireSock(t, bus.NewSocket)
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+		MustSucceed(t, s.Listen(addr))
+		w := dialWire(t, addr, mangos.ProtoBus)
+		w.handshake(mangos.ProtoBus)
+
+		w.send(nil, []byte("hello"))
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "hello")
+		MustSucceed(t, s.Send([]byte("world")))
+		MustBeTrue(t, string(w.recv()) == "world")
+		w.close()
+		s.Close()
+	}
+}
+
+// TestWireNanocat checks interoperation with the nanomsg C library, by
+// way of its nanocat utility.
+func TestWireNanocat(t *testing.T) {
+	nanocat, err := exec.LookPath("nanocat")
+	if err != nil {
+		t.Skip("nanocat not found")
+	}
+	for _, addr := range wireAddrs() {
+		s := newWireSock(t, rep.NewSocket)
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+		MustSucceed(t, s.Listen(addr))
+
+		cmd := exec.Command(nanocat, "--req", "--connect", addr,
+			"--data", "ping", "--raw")
+		out := &bytes.Buffer{}
+		cmd.Stdout = out
+		MustSucceed(t, cmd.Start())
+
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "ping")
+		MustSucceed(t, s.Send([]byte("pong")))
+		MustSucceed(t, cmd.Wait())
+		MustBeTrue(t, out.String() == "pong")
+		s.Close()
+	}
+}
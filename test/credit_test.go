@@ -0,0 +1,155 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestCreditOptions(t *testing.T) {
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+
+	v, err := sock.GetOption(mangos.OptionCreditWindow)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+	MustBeTrue(t, sock.SetOption(mangos.OptionCreditWindow, -1) == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionCreditWindow, "many") == mangos.ErrBadValue)
+	MustSucceed(t, sock.SetOption(mangos.OptionCreditWindow, 8))
+
+	d, err := sock.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionCreditWindow)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 8)
+}
+
+// TestCreditPushPull has a receiver that does not keep up stop the
+// sender once its window is used, until it consumes what it was sent.
+func TestCreditPushPull(t *testing.T) {
+	addr := AddrTestTCP()
+	tx, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.SetOption(mangos.OptionWriteQLen, 1))
+	MustSucceed(t, tx.SetOption(mangos.OptionSendDeadline, time.Millisecond*100))
+	MustSucceed(t, tx.Listen(addr))
+
+	rx, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.SetOption(mangos.OptionCreditWindow, 4))
+	MustSucceed(t, rx.Dial(addr))
+	waitPipes(t, tx, 1)
+
+	// Without credit these would all fit in the kernel's buffers.
+	sent := 0
+	for ; sent < 50; sent++ {
+		if err := tx.Send([]byte{byte(sent)}); err != nil {
+			MustBeTrue(t, err == mangos.ErrSendTimeout)
+			break
+		}
+	}
+	MustBeTrue(t, sent >= 4 && sent < 10)
+
+	info := tx.Pipes()[0]
+	MustBeTrue(t, info.SendCredit == 0)
+	MustBeTrue(t, info.RecvCredit == -1)
+	// The last may still be on its way.
+	for i := 0; rx.Pipes()[0].RecvCredit != 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	info = rx.Pipes()[0]
+	MustBeTrue(t, info.SendCredit == -1)
+	MustBeTrue(t, info.RecvCredit == 0)
+
+	m, err := rx.RecvMsg()
+	MustSucceed(t, err)
+	v, err := m.Pipe.GetOption(mangos.OptionCreditWindow)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 4)
+	m.Free()
+
+	// Consuming the rest frees credit for those held back, in order.
+	for i := 1; i < sent; i++ {
+		b, err := rx.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, b[0] == byte(i))
+	}
+	MustSucceed(t, tx.Send([]byte("more")))
+	b, err := rx.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "more")
+}
+
+// TestCreditBothWays has each end limit the other to its own window.
+func TestCreditBothWays(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	MustSucceed(t, s1.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s1.SetOption(mangos.OptionCreditWindow, 16))
+	MustSucceed(t, s1.Listen(addr))
+
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s2.SetOption(mangos.OptionCreditWindow, 2))
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+
+	MustBeTrue(t, s1.Pipes()[0].SendCredit == 2)
+	MustBeTrue(t, s1.Pipes()[0].RecvCredit == 16)
+	MustBeTrue(t, s2.Pipes()[0].SendCredit == 16)
+	MustBeTrue(t, s2.Pipes()[0].RecvCredit == 2)
+
+	// Far more than either window, taking each as it comes.
+	for i := 0; i < 100; i++ {
+		MustSucceed(t, s1.Send([]byte("ping")))
+		_, err := s2.Recv()
+		MustSucceed(t, err)
+		MustSucceed(t, s2.Send([]byte("pong")))
+		_, err = s1.Recv()
+		MustSucceed(t, err)
+	}
+}
+
+func TestCreditNone(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	MustSucceed(t, s1.Listen(addr))
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+
+	info := s1.Pipes()[0]
+	MustBeTrue(t, info.SendCredit == -1)
+	MustBeTrue(t, info.RecvCredit == -1)
+}
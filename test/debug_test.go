@@ -0,0 +1,155 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestDebugReqRep(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.Listen(addr))
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+
+	// With no peer, the request waits to be sent.
+	MustSucceed(t, cli.SetOption(mangos.OptionBestEffort, true))
+	MustSucceed(t, cli.Send([]byte("ping")))
+	st := cli.Debug()
+	MustBeTrue(t, st.Protocol == "req")
+	MustBeFalse(t, st.Raw)
+	MustBeTrue(t, len(st.Pending) == 1)
+	MustBeTrue(t, st.Pending[0].Pipe == 0)
+	MustBeTrue(t, st.Pending[0].Attempts == 0)
+
+	MustSucceed(t, cli.Dial(addr))
+	waitPipes(t, srv, 1)
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	m.Free()
+
+	st = cli.Debug()
+	MustBeTrue(t, len(st.Pending) == 1)
+	id := st.Pending[0].ID
+	MustBeTrue(t, id&0x80000000 != 0)
+	MustBeTrue(t, st.Pending[0].Pipe != 0)
+	MustBeTrue(t, st.Pending[0].Attempts == 1)
+	MustBeFalse(t, st.Pending[0].Sent.IsZero())
+	MustBeTrue(t, len(st.Pipes) == 1)
+	MustBeFalse(t, st.Pipes[0].Down)
+
+	// The server holds the backtrace until it replies.
+	st = srv.Debug()
+	MustBeTrue(t, st.Protocol == "rep")
+	MustBeTrue(t, len(st.Backtraces) == 1)
+	MustBeTrue(t, st.Backtraces[0].ID == id)
+	MustBeTrue(t, len(st.Backtraces[0].Hops) == 0)
+	MustBeTrue(t, st.Backtraces[0].Pipe == srv.Pipes()[0].ID)
+	MustBeTrue(t, len(st.Pipes) == 1)
+	MustBeTrue(t, st.Pipes[0].ID == st.Backtraces[0].Pipe)
+
+	MustSucceed(t, srv.Send([]byte("pong")))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	_, err = cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, len(srv.Debug().Backtraces) == 0)
+	MustBeTrue(t, len(cli.Debug().Pending) == 0)
+}
+
+func TestDebugSub(t *testing.T) {
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte("b")))
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte("a")))
+	c, err := s.OpenContext()
+	MustSucceed(t, err)
+	MustSucceed(t, c.SetOption(mangos.OptionSubscribe, []byte("c")))
+	MustSucceed(t, c.SetOption(mangos.OptionSubscribe, []byte("a")))
+
+	st := s.Debug()
+	MustBeTrue(t, st.Protocol == "sub")
+	MustBeTrue(t, len(st.Subscriptions) == 3)
+	MustBeTrue(t, st.Subscriptions[0] == "a")
+	MustBeTrue(t, st.Subscriptions[1] == "b")
+	MustBeTrue(t, st.Subscriptions[2] == "c")
+	MustBeTrue(t, st.RecvQueued == 0)
+	MustBeTrue(t, st.RecvCap > 0)
+}
+
+func TestDebugSurvey(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := surveyor.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	MustSucceed(t, s1.Listen(addr))
+	s2, err := respondent.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+
+	MustSucceed(t, s1.Send([]byte("survey")))
+	st := s1.Debug()
+	MustBeTrue(t, len(st.Pending) == 1)
+	id := st.Pending[0].ID
+
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	_, err = s2.Recv()
+	MustSucceed(t, err)
+	st = s2.Debug()
+	MustBeTrue(t, len(st.Backtraces) == 1)
+	MustBeTrue(t, st.Backtraces[0].ID == id)
+}
+
+func TestDebugPush(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	// With no peer, messages wait in the socket's queue.
+	MustSucceed(t, s.Send([]byte("one")))
+	MustSucceed(t, s.Send([]byte("two")))
+	st := s.Debug()
+	MustBeTrue(t, st.Protocol == "push")
+	MustBeTrue(t, st.SendQueued == 2)
+	MustBeTrue(t, st.SendCap > 0)
+	MustBeTrue(t, len(st.Pending) == 0)
+}
+
+func TestDebugUnsupported(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	st := s.Debug()
+	MustBeTrue(t, st.Protocol == "pair")
+	MustBeTrue(t, len(st.Pipes) == 0)
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestDedupSeen(t *testing.T) {
+	d := mangos.NewDedup(2, 0, nil)
+	MustBeFalse(t, d.Seen([]byte("a")))
+	MustBeTrue(t, d.Seen([]byte("a")))
+	MustBeFalse(t, d.Seen([]byte("b")))
+	MustBeFalse(t, d.Seen([]byte("c")))
+	// Only two are remembered, so the oldest is forgotten.
+	MustBeFalse(t, d.Seen([]byte("a")))
+	MustBeTrue(t, d.Seen([]byte("c")))
+
+	d = mangos.NewDedup(0, time.Millisecond*50, nil)
+	MustBeFalse(t, d.Seen([]byte("a")))
+	MustBeTrue(t, d.Seen([]byte("a")))
+	time.Sleep(time.Millisecond * 60)
+	MustBeFalse(t, d.Seen([]byte("a")))
+}
+
+func TestDedupHook(t *testing.T) {
+	byBody := func(m *mangos.Message) []byte {
+		if len(m.Body) == 0 {
+			return nil
+		}
+		return m.Body
+	}
+	d := mangos.NewDedup(0, 0, byBody)
+	msg := func(b string) *mangos.Message {
+		m := mangos.NewMessage(len(b))
+		m.Body = append(m.Body, b...)
+		return m
+	}
+	m, err := d.Hook(msg("x"))
+	MustSucceed(t, err)
+	MustNotBeNil(t, m)
+	m, err = d.Hook(msg("x"))
+	MustSucceed(t, err)
+	MustBeTrue(t, m == nil)
+
+	// Messages without a key are always let through.
+	for i := 0; i < 2; i++ {
+		m, err = d.Hook(msg(""))
+		MustSucceed(t, err)
+		MustNotBeNil(t, m)
+	}
+
+	// Once forgotten, it is new again.
+	d.Forget(msg("x"))
+	m, err = d.Hook(msg("x"))
+	MustSucceed(t, err)
+	MustNotBeNil(t, m)
+}
+
+func TestDedupMessageKey(t *testing.T) {
+	m := mangos.NewMessage(0)
+	defer m.Free()
+	MustBeTrue(t, mangos.MessageKey(m) == nil)
+
+	// A pipe ID, and then a request ID.
+	m.Header = append(m.Header, 0, 0, 0, 1, 0x80, 0, 0, 2)
+	MustBeTrue(t, string(mangos.MessageKey(m)) == "\x00\x00\x00\x00\x80\x00\x00\x02")
+
+	// The same ID from different peers is a different key.
+	m.Pipe = idPipe{id: 3}
+	key := mangos.MessageKey(m)
+	MustBeTrue(t, string(key) == "\x00\x00\x00\x03\x80\x00\x00\x02")
+	m.Pipe = idPipe{id: 4}
+	MustBeTrue(t, string(mangos.MessageKey(m)) != string(key))
+	d := mangos.NewDedup(0, 0, nil)
+	MustBeFalse(t, d.Seen(key))
+	MustBeFalse(t, d.Seen(mangos.MessageKey(m)))
+	MustBeTrue(t, d.Seen(key))
+	m.Pipe = nil
+
+	m.Header = m.Header[:4]
+	MustBeTrue(t, mangos.MessageKey(m) == nil)
+}
+
+// idPipe is a Pipe that has just an ID.
+type idPipe struct {
+	mangos.Pipe
+	id uint32
+}
+
+func (p idPipe) ID() uint32 { return p.id }
+
+func TestDedupAckDelivery(t *testing.T) {
+	addr := AddrTestInp()
+	s := newAckPush(t, addr, time.Millisecond*50)
+	defer s.Close()
+	l := newAckPull(t, addr)
+	defer l.Close()
+	l.AddRecvHook(mangos.NewDedup(100, 0, nil).Hook)
+
+	MustSucceed(t, s.Send([]byte("once")))
+	m, err := l.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m.Body) == "once")
+
+	// It is sent again, as it was not acknowledged in time, but the
+	// copy is dropped, and acknowledged, so no more come.
+	MustSucceed(t, l.SetOption(mangos.OptionRecvDeadline, time.Millisecond*300))
+	_, err = l.RecvMsg()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	redelivered := func() uint64 {
+		v, err := s.GetOption(mangos.OptionProtocolStats)
+		MustSucceed(t, err)
+		return v.(map[string]uint64)[mangos.StatRedelivered]
+	}
+	n := redelivered()
+	MustBeTrue(t, n >= 1)
+	time.Sleep(time.Millisecond * 200)
+	MustBeTrue(t, redelivered() == n)
+	MustSucceed(t, m.Ack())
+	m.Free()
+}
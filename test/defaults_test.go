@@ -0,0 +1,101 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+)
+
+func TestDefaultOptions(t *testing.T) {
+	defer mangos.ClearDefaultOptions()
+	cfg := &tls.Config{ServerName: "default.mangos.example.com"}
+	mangos.SetDefaultOption(mangos.OptionWriteQLen, 7)
+	mangos.SetDefaultOption(mangos.OptionMaxRecvSize, 4096)
+	mangos.SetDefaultOption(mangos.OptionReconnectTime, time.Millisecond*10)
+	mangos.SetDefaultOption(mangos.OptionTLSConfig, cfg)
+	MustBeTrue(t, len(mangos.DefaultOptions()) == 4)
+
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionWriteQLen)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 7)
+	v, err = s.GetOption(mangos.OptionMaxRecvSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 4096)
+	v, err = s.GetOption(mangos.OptionReconnectTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Millisecond*10)
+
+	// The TLS configuration is for the dialers and listeners that
+	// can use it, unless they are given their own.
+	d, err := s.NewDialer(AddrTestTLS(), nil)
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionTLSConfig)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(*tls.Config) == cfg)
+	own := &tls.Config{}
+	d, err = s.NewDialer(AddrTestTLS(), map[string]interface{}{
+		mangos.OptionTLSConfig: own,
+	})
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionTLSConfig)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(*tls.Config) == own)
+	_, err = s.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+
+	// A protocol without a write queue is not troubled by it.
+	s2, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	// Sockets set their own, and later changes affect only new ones.
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 3))
+	mangos.SetDefaultOption(mangos.OptionWriteQLen, nil)
+	MustBeTrue(t, len(mangos.DefaultOptions()) == 3)
+	s3, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s3.Close()
+	v, err = s3.GetOption(mangos.OptionWriteQLen)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 128)
+	v, err = s.GetOption(mangos.OptionWriteQLen)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 3)
+
+	mangos.ClearDefaultOptions()
+	MustBeTrue(t, len(mangos.DefaultOptions()) == 0)
+}
+
+func TestDefaultOptionsBadValue(t *testing.T) {
+	defer mangos.ClearDefaultOptions()
+	mangos.SetDefaultOption(mangos.OptionMaxRecvSize, "huge")
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionMaxRecvSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 1024*1024)
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/nanomsg"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestDialPriorityOption(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	d, err := s.NewDialer(AddrTestInp(), nil)
+	MustSucceed(t, err)
+	v, err := d.GetOption(mangos.OptionDialPriority)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == mangos.DefaultDialPriority)
+	MustSucceed(t, d.SetOption(mangos.OptionDialPriority, 1))
+	MustSucceed(t, d.SetOption(mangos.OptionDialPriority, 16))
+	MustBeTrue(t, d.SetOption(mangos.OptionDialPriority, 0) == mangos.ErrBadValue)
+	MustBeTrue(t, d.SetOption(mangos.OptionDialPriority, 17) == mangos.ErrBadValue)
+	MustBeTrue(t, d.SetOption(mangos.OptionDialPriority, "1") == mangos.ErrBadValue)
+
+	_, err = s.NewDialer(AddrTestInp(), map[string]interface{}{
+		mangos.OptionDialPriority: 20,
+	})
+	MustBeTrue(t, err == mangos.ErrBadValue)
+
+	n, err := nanomsg.NewSocket(nanomsg.AF_SP, nanomsg.PUSH)
+	MustSucceed(t, err)
+	defer n.Close()
+	MustSucceed(t, n.SetSockOptInt(nanomsg.SOL_SOCKET, nanomsg.NN_SNDPRIO, 2))
+	p, err := n.GetSockOptInt(nanomsg.SOL_SOCKET, nanomsg.NN_SNDPRIO)
+	MustSucceed(t, err)
+	MustBeTrue(t, p == 2)
+}
+
+func newPull(t *testing.T, addr string) mangos.Socket {
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Millisecond*100))
+	MustSucceed(t, s.Listen(addr))
+	return s
+}
+
+// drainCount receives until the socket times out, returning the count.
+func drainCount(s mangos.Socket) int {
+	n := 0
+	for {
+		if _, err := s.Recv(); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestDialPriorityPush(t *testing.T) {
+	addr1, addr2 := AddrTestInp(), AddrTestInp()
+	primary := newPull(t, addr1)
+	backup := newPull(t, addr2)
+	defer backup.Close()
+
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	MustSucceed(t, s.DialOptions(addr2, map[string]interface{}{
+		mangos.OptionDialPriority: 2,
+	}))
+	MustSucceed(t, s.DialOptions(addr1, map[string]interface{}{
+		mangos.OptionDialPriority: 1,
+	}))
+	waitPipes(t, s, 2)
+
+	for i := 0; i < 20; i++ {
+		MustSucceed(t, s.Send([]byte{byte(i)}))
+	}
+	MustBeTrue(t, drainCount(primary) == 20)
+	MustBeTrue(t, drainCount(backup) == 0)
+
+	// The backup takes over while the primary is down.
+	MustSucceed(t, primary.Close())
+	waitPipes(t, s, 1)
+	for i := 0; i < 20; i++ {
+		MustSucceed(t, s.Send([]byte{byte(i)}))
+	}
+	MustBeTrue(t, drainCount(backup) == 20)
+
+	// And hands back once it returns.
+	primary = newPull(t, addr1)
+	defer primary.Close()
+	waitPipes(t, s, 2)
+	for i := 0; i < 20; i++ {
+		MustSucceed(t, s.Send([]byte{byte(i)}))
+	}
+	MustBeTrue(t, drainCount(primary) == 20)
+	MustBeTrue(t, drainCount(backup) == 0)
+}
+
+func TestDialPriorityReq(t *testing.T) {
+	addr1, addr2 := AddrTestInp(), AddrTestInp()
+	var count [2]int
+	var servers [2]mangos.Socket
+	for i, addr := range []string{addr1, addr2} {
+		r, err := rep.NewSocket()
+		MustSucceed(t, err)
+		MustSucceed(t, r.Listen(addr))
+		servers[i] = r
+		go func(i int, r mangos.Socket) {
+			for {
+				m, err := r.RecvMsg()
+				if err != nil {
+					return
+				}
+				m.Body = append(m.Body[:0], byte(i))
+				_ = r.SendMsg(m)
+			}
+		}(i, r)
+	}
+	defer servers[1].Close()
+
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.DialOptions(addr2, map[string]interface{}{
+		mangos.OptionDialPriority: 9,
+	}))
+	MustSucceed(t, s.DialOptions(addr1, map[string]interface{}{
+		mangos.OptionDialPriority: 3,
+	}))
+	waitPipes(t, s, 2)
+
+	ask := func() {
+		MustSucceed(t, s.Send([]byte("who")))
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		count[b[0]]++
+	}
+	for i := 0; i < 10; i++ {
+		ask()
+	}
+	MustBeTrue(t, count[0] == 10 && count[1] == 0)
+
+	MustSucceed(t, servers[0].Close())
+	waitPipes(t, s, 1)
+	for i := 0; i < 10; i++ {
+		ask()
+	}
+	MustBeTrue(t, count[0] == 10 && count[1] == 10)
+}
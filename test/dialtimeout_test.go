@@ -0,0 +1,128 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestDialTimeoutWaits(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	MustSucceed(t, cli.SetOption(mangos.OptionDialTimeout, time.Second*5))
+
+	// The listener comes along late, but the dial waits for it.
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		MustSucceed(t, srv.Listen(addr))
+	}()
+	start := time.Now()
+	MustSucceed(t, cli.Dial(addr))
+	MustBeTrue(t, time.Since(start) >= time.Millisecond*100)
+
+	MustSucceed(t, cli.Send([]byte("ping")))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+}
+
+func TestDialTimeoutExpires(t *testing.T) {
+	addr := AddrTestTCP()
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+
+	d, err := cli.NewDialer(addr, map[string]interface{}{
+		mangos.OptionReconnectTime: time.Millisecond * 10,
+		mangos.OptionDialTimeout:   time.Millisecond * 100,
+	})
+	MustSucceed(t, err)
+	start := time.Now()
+	MustFail(t, d.Dial())
+	MustBeTrue(t, time.Since(start) >= time.Millisecond*100)
+
+	// The dialer gave up, so it may be started again.
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, d.Dial())
+}
+
+func TestDialTimeoutHandshakeError(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	MustSucceed(t, cli.SetOption(mangos.OptionDialTimeout, time.Millisecond*50))
+	MustBeTrue(t, errors.Is(cli.Dial(addr), mangos.ErrBadProto))
+}
+
+func TestDialTimeoutClosed(t *testing.T) {
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, cli.SetOption(mangos.OptionDialTimeout, time.Second*10))
+	MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime, time.Millisecond*100))
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cli.Close()
+	}()
+	start := time.Now()
+	MustBeTrue(t, cli.Dial(AddrTestTCP()) == mangos.ErrClosed)
+	MustBeTrue(t, time.Since(start) < time.Second)
+}
+
+func TestDialAsynchSocketOption(t *testing.T) {
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+
+	v, err := cli.GetOption(mangos.OptionDialAsynch)
+	MustSucceed(t, err)
+	MustBeFalse(t, v.(bool))
+	MustSucceed(t, cli.SetOption(mangos.OptionDialAsynch, true))
+
+	// New dialers take the socket's setting, so this does not fail,
+	// even with nobody listening.
+	d, err := cli.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionDialAsynch)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+	MustSucceed(t, d.Dial())
+}
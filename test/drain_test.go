@@ -0,0 +1,174 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// drainReqRep returns connected REQ and REP sockets.
+func drainReqRep(t *testing.T) (mangos.Socket, mangos.Socket) {
+	addr := AddrTestInp()
+	s1, err := req.NewSocket()
+	MustSucceed(t, err)
+	s2, err := rep.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s1.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+	MustSucceed(t, s2.Listen(addr))
+	MustSucceed(t, s1.Dial(addr))
+	return s1, s2
+}
+
+func TestDrainRep(t *testing.T) {
+	s1, s2 := drainReqRep(t)
+	defer s1.Close()
+
+	MustSucceed(t, s1.Send([]byte("ping")))
+	_, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, s2.Stats().Protocol[mangos.StatAwaiting] == 1)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s2.Drain(context.Background())
+	}()
+
+	// We owe an answer, so it waits for it.
+	select {
+	case <-done:
+		t.Fatalf("drain finished early")
+	case <-time.After(time.Millisecond * 100):
+	}
+	// New requests are not taken, but the answer goes out.
+	_, err = s2.Recv()
+	MustBeTrue(t, err == mangos.ErrClosed)
+	MustSucceed(t, s2.Send([]byte("pong")))
+	select {
+	case err = <-done:
+		MustSucceed(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("drain did not finish")
+	}
+	b, err := s1.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "pong")
+
+	// And it is closed now.
+	MustBeTrue(t, s2.Send([]byte("pong")) == mangos.ErrClosed)
+	MustBeTrue(t, s2.Close() == mangos.ErrClosed)
+	MustBeTrue(t, s2.Drain(context.Background()) == mangos.ErrClosed)
+}
+
+func TestDrainContexts(t *testing.T) {
+	s1, s2 := drainReqRep(t)
+	defer s1.Close()
+
+	c1, err := s1.OpenContext()
+	MustSucceed(t, err)
+	c2, err := s1.OpenContext()
+	MustSucceed(t, err)
+	MustSucceed(t, c1.Send([]byte("one")))
+	MustSucceed(t, c2.Send([]byte("two")))
+
+	var ctxs []mangos.Context
+	for i := 0; i < 2; i++ {
+		c, err := s2.OpenContext()
+		MustSucceed(t, err)
+		MustSucceed(t, c.SetOption(mangos.OptionRecvDeadline, time.Second))
+		b, err := c.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 3)
+		ctxs = append(ctxs, c)
+	}
+	MustBeTrue(t, s2.Stats().Protocol[mangos.StatAwaiting] == 2)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s2.Drain(context.Background())
+	}()
+	time.Sleep(time.Millisecond * 50)
+	for _, c := range ctxs {
+		_, err = c.Recv()
+		MustBeTrue(t, err == mangos.ErrClosed)
+	}
+	MustSucceed(t, ctxs[0].Send([]byte("1")))
+	MustSucceed(t, ctxs[1].Send([]byte("2")))
+	MustSucceed(t, <-done)
+
+	b, err := c1.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "1")
+	b, err = c2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "2")
+}
+
+func TestDrainTimeout(t *testing.T) {
+	s1, s2 := drainReqRep(t)
+	defer s1.Close()
+
+	MustSucceed(t, s1.Send([]byte("ping")))
+	_, err := s2.Recv()
+	MustSucceed(t, err)
+
+	// Never answered, so we give up.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	MustBeTrue(t, s2.Drain(ctx) == context.DeadlineExceeded)
+	MustBeTrue(t, s2.Close() == mangos.ErrClosed)
+}
+
+func TestDrainPush(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := push.NewSocket()
+	MustSucceed(t, err)
+	s2, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	MustSucceed(t, s1.SetOption(mangos.OptionWriteQLen, 100))
+	MustSucceed(t, s2.SetOption(mangos.OptionReadQLen, 1))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s2.Listen(addr))
+	MustSucceed(t, s1.Dial(addr))
+	for i := 0; i < 50; i++ {
+		MustSucceed(t, s1.Send([]byte{byte(i)}))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s1.Drain(context.Background())
+	}()
+	time.Sleep(time.Millisecond * 10)
+	MustBeTrue(t, s1.Send([]byte{0}) == mangos.ErrClosed)
+
+	// Everything queued before the drain still arrives.
+	for i := 0; i < 50; i++ {
+		b, err := s2.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && b[0] == byte(i))
+	}
+	MustSucceed(t, <-done)
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/dump"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func dumpPair(t *testing.T) (string, mangos.Socket, mangos.Socket) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, srv.Listen(addr))
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, cli.Dial(addr))
+	waitPipes(t, srv, 1)
+	return addr, srv, cli
+}
+
+func TestDumpText(t *testing.T) {
+	addr, srv, cli := dumpPair(t)
+	defer srv.Close()
+	defer cli.Close()
+
+	var b bytes.Buffer
+	MustSucceed(t, dump.Write(&b))
+	out := b.String()
+	MustBeTrue(t, strings.HasPrefix(out, "mangos state at "))
+	MustBeTrue(t, strings.Contains(out, "rep (peer req) open"))
+	MustBeTrue(t, strings.Contains(out, "req (peer rep) open"))
+	MustBeTrue(t, strings.Contains(out, "listener "+addr+" open"))
+	MustBeTrue(t, strings.Contains(out, "dialer "+addr+" active"))
+	MustBeTrue(t, strings.Contains(out, " attached\n"))
+
+	// Closed sockets are no longer reported.
+	MustSucceed(t, cli.Close())
+	b.Reset()
+	MustSucceed(t, dump.Write(&b))
+	MustBeFalse(t, strings.Contains(b.String(), "dialer "+addr))
+}
+
+func TestDumpJSON(t *testing.T) {
+	addr, srv, cli := dumpPair(t)
+	defer srv.Close()
+	defer cli.Close()
+
+	var b bytes.Buffer
+	MustSucceed(t, dump.WriteJSON(&b))
+	snap := &dump.Snapshot{}
+	MustSucceed(t, json.Unmarshal(b.Bytes(), snap))
+
+	var found *mangos.SocketState
+	for i := range snap.Sockets {
+		st := &snap.Sockets[i]
+		if len(st.Listeners) == 1 && st.Listeners[0].Address == addr {
+			found = st
+		}
+	}
+	MustNotBeNil(t, found)
+	MustBeTrue(t, found.Protocol == "rep")
+	MustBeTrue(t, len(found.Pipes) == 1)
+	MustBeTrue(t, found.Pipes[0].Role == "listener")
+	MustBeTrue(t, found.Stats.Pipes == 1)
+	MustBeTrue(t, len(found.Events) > 0)
+}
+
+// syncBuffer is a bytes.Buffer that tells when it has been written.
+type syncBuffer struct {
+	sync.Mutex
+	b     bytes.Buffer
+	wrote chan struct{}
+}
+
+func (sb *syncBuffer) Write(b []byte) (int, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	n, err := sb.b.Write(b)
+	select {
+	case sb.wrote <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+func TestDumpNotify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("cannot signal ourselves")
+	}
+	_, srv, cli := dumpPair(t)
+	defer srv.Close()
+	defer cli.Close()
+
+	sb := &syncBuffer{wrote: make(chan struct{}, 1)}
+	stop := dump.Notify(sb, dump.JSON, os.Interrupt)
+	defer stop()
+
+	proc, err := os.FindProcess(os.Getpid())
+	MustSucceed(t, err)
+	MustSucceed(t, proc.Signal(os.Interrupt))
+	select {
+	case <-sb.wrote:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no dump written")
+	}
+
+	sb.Lock()
+	snap := &dump.Snapshot{}
+	MustSucceed(t, json.Unmarshal(sb.b.Bytes(), snap))
+	sb.Unlock()
+	MustBeTrue(t, len(snap.Sockets) >= 2)
+	stop()
+	stop()
+}
+
+func TestDumpName(t *testing.T) {
+	addr, srv, cli := dumpPair(t)
+	defer srv.Close()
+	defer cli.Close()
+
+	v, err := srv.GetOption(mangos.OptionName)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == "")
+	MustBeTrue(t, srv.SetOption(mangos.OptionName, 1) == mangos.ErrBadValue)
+	MustSucceed(t, srv.SetOption(mangos.OptionName, "frontend"))
+	v, err = srv.GetOption(mangos.OptionName)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == "frontend")
+
+	var b bytes.Buffer
+	MustSucceed(t, dump.Write(&b))
+	MustBeTrue(t, strings.Contains(b.String(), `"frontend" rep (peer req)`))
+
+	snap := dump.Take()
+	found := false
+	for _, st := range snap.Sockets {
+		if st.Name == "frontend" {
+			found = true
+			MustBeTrue(t, st.Listeners[0].Address == addr)
+		}
+	}
+	MustBeTrue(t, found)
+}
+
+func TestDumpNameLogged(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	l := &testLogger{}
+	MustSucceed(t, s.SetOption(mangos.OptionLogger, l))
+	MustSucceed(t, s.SetOption(mangos.OptionName, "lonely"))
+	MustSucceed(t, s.Listen(addr))
+
+	// PAIR refuses a second peer, which is logged.
+	for i := 0; i < 2; i++ {
+		c, err := pair.NewSocket()
+		MustSucceed(t, err)
+		defer c.Close()
+		MustSucceed(t, c.Dial(addr))
+	}
+	MustBeTrue(t, l.wait("mangos: lonely: "))
+}
+
+func TestDumpHandler(t *testing.T) {
+	addr, srv, cli := dumpPair(t)
+	defer srv.Close()
+	defer cli.Close()
+
+	h := dump.Handler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/mangos", nil))
+	MustBeTrue(t, w.Code == 200)
+	MustBeTrue(t, strings.HasPrefix(w.Body.String(), "mangos state at "))
+	MustBeTrue(t, strings.Contains(w.Body.String(), "listener "+addr))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/mangos?format=json", nil))
+	MustBeTrue(t, w.Header().Get("Content-Type") == "application/json")
+	snap := &dump.Snapshot{}
+	MustSucceed(t, json.Unmarshal(w.Body.Bytes(), snap))
+	MustBeTrue(t, len(snap.Sockets) >= 2)
+}
+
+func TestDumpPublish(t *testing.T) {
+	_, srv, cli := dumpPair(t)
+	defer srv.Close()
+	defer cli.Close()
+
+	dump.Publish("mangos-test")
+	v := expvar.Get("mangos-test")
+	MustNotBeNil(t, v)
+	snap := &dump.Snapshot{}
+	MustSucceed(t, json.Unmarshal([]byte(v.String()), snap))
+	MustBeTrue(t, len(snap.Sockets) >= 2)
+}
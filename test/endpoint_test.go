@@ -0,0 +1,106 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestDialerCloseEndpoint(t *testing.T) {
+	addr1 := AddrTestTCP()
+	addr2 := AddrTestTCP()
+	srv1, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv1.Close()
+	MustSucceed(t, srv1.Listen(addr1))
+	srv2, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv2.Close()
+	MustSucceed(t, srv2.Listen(addr2))
+	MustSucceed(t, srv2.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	d1, err := cli.NewDialer(addr1, nil)
+	MustSucceed(t, err)
+	MustSucceed(t, d1.Dial())
+	MustSucceed(t, cli.Dial(addr2))
+	waitPipes(t, cli, 2)
+
+	// Retire the first address; its pipe goes, and is not remade.
+	MustSucceed(t, d1.Close())
+	waitPipes(t, cli, 1)
+	MustBeTrue(t, d1.Close() == mangos.ErrClosed)
+	MustBeTrue(t, d1.Dial() == mangos.ErrClosed)
+
+	// Every request now goes to the one that remains.
+	for i := 0; i < 5; i++ {
+		MustSucceed(t, cli.Send([]byte("ping")))
+		_, err = srv2.Recv()
+		MustSucceed(t, err)
+		MustSucceed(t, srv2.Send([]byte("pong")))
+		_, err = cli.Recv()
+		MustSucceed(t, err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	MustBeTrue(t, cli.Stats().Pipes == 1)
+}
+
+func TestListenerCloseEndpoint(t *testing.T) {
+	addr1 := AddrTestInp()
+	addr2 := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	l1, err := srv.NewListener(addr1, nil)
+	MustSucceed(t, err)
+	MustSucceed(t, l1.Listen())
+	MustSucceed(t, srv.Listen(addr2))
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	cli1, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli1.Close()
+	MustSucceed(t, cli1.Dial(addr1))
+	cli2, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli2.Close()
+	MustSucceed(t, cli2.Dial(addr2))
+	waitPipes(t, srv, 2)
+
+	MustSucceed(t, l1.Close())
+	waitPipes(t, srv, 1)
+
+	// The other listener, and its pipe, carry on.
+	MustSucceed(t, cli2.Send([]byte("ping")))
+	_, err = srv.Recv()
+	MustSucceed(t, err)
+
+	// And the address is free for another.
+	other, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer other.Close()
+	MustSucceed(t, other.Listen(addr1))
+}
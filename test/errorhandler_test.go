@@ -0,0 +1,108 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+type reported struct {
+	err error
+	ep  mangos.EndpointInfo
+}
+
+func errorChan(s mangos.Socket) chan reported {
+	ch := make(chan reported, 10)
+	s.SetErrorHandler(func(err error, ep mangos.EndpointInfo) {
+		select {
+		case ch <- reported{err, ep}:
+		default:
+		}
+	})
+	return ch
+}
+
+func waitReported(t *testing.T, ch chan reported) reported {
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no error reported")
+	}
+	return reported{}
+}
+
+func TestErrorHandlerRedial(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	ch := errorChan(s)
+
+	// A synchronous dial returns its error, and does not report it.
+	MustBeTrue(t, errors.Is(s.Dial(addr), mangos.ErrConnRefused))
+	select {
+	case r := <-ch:
+		t.Fatalf("unexpected report: %v", r.err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	d, err := s.NewDialer(addr, nil)
+	MustSucceed(t, err)
+	MustSucceed(t, d.SetOption(mangos.OptionDialAsynch, true))
+	MustSucceed(t, d.Dial())
+	r := waitReported(t, ch)
+	MustBeTrue(t, errors.Is(r.err, mangos.ErrConnRefused))
+	MustBeTrue(t, r.ep.Address == addr)
+	MustBeTrue(t, r.ep.Role == "dialer")
+	MustBeTrue(t, r.ep.Scheme == "tcp")
+}
+
+func TestErrorHandlerRejected(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	ch := errorChan(s1)
+
+	errDenied := errors.New("denied")
+	s1.SetAuthHook(func(mangos.Pipe) error { return errDenied })
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	r := waitReported(t, ch)
+	MustBeTrue(t, r.err == errDenied)
+	MustBeTrue(t, r.ep.Address == addr)
+	MustBeTrue(t, r.ep.Role == "listener")
+	MustBeTrue(t, r.ep.Pipes == 0)
+}
+
+func TestErrorHandlerReplace(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustBeTrue(t, s.SetErrorHandler(func(error, mangos.EndpointInfo) {}) == nil)
+	MustNotBeNil(t, s.SetErrorHandler(nil))
+	MustBeTrue(t, s.SetErrorHandler(nil) == nil)
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestExpiryMessage(t *testing.T) {
+	m := mangos.NewMessage(0)
+	MustBeTrue(t, m.Expiry().IsZero())
+	MustBeFalse(t, m.Expired())
+	m.SetExpiry(time.Millisecond)
+	MustBeFalse(t, m.Expiry().IsZero())
+	dup := m.Dup()
+	MustBeTrue(t, dup.Expiry().Equal(m.Expiry()))
+	time.Sleep(time.Millisecond * 5)
+	MustBeTrue(t, m.Expired())
+	MustBeTrue(t, dup.Expired())
+	m.SetExpiry(0)
+	MustBeFalse(t, m.Expired())
+	m.Free()
+	dup.Free()
+}
+
+func TestExpiryQueued(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.Listen(addr))
+
+	// With no peer yet, these all wait in the queue.
+	for i := 0; i < 10; i++ {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, byte(i))
+		if i%2 == 0 {
+			m.SetExpiry(time.Millisecond * 10)
+		} else {
+			m.SetExpiry(time.Minute)
+		}
+		MustSucceed(t, s.SendMsg(m))
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	r, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, r.Dial(addr))
+
+	// Only those that have not expired arrive.
+	for i := 1; i < 10; i += 2 {
+		b, err := r.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && b[0] == byte(i))
+	}
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Millisecond*50))
+	_, err = r.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+
+	st := s.Stats()
+	MustBeTrue(t, st.Expired == 5)
+	MustBeTrue(t, st.Sent == 10)
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// extTLV encodes one extension.
+func extTLV(typ uint16, v []byte) []byte {
+	b := make([]byte, 4, 4+len(v))
+	binary.BigEndian.PutUint16(b[0:], typ)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(v)))
+	return append(b, v...)
+}
+
+func TestExtensionUnknownIgnored(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionCompression, "snappy"))
+	MustSucceed(t, srv.Listen(addr))
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer c.Close()
+	MustSucceed(t, c.SetDeadline(time.Now().Add(time.Second)))
+
+	// A dialer from the future, with an extension we know nothing of.
+	var block []byte
+	block = append(block, extTLV(0x7fff, []byte("from the future"))...)
+	block = append(block, extTLV(1, []byte("snappy"))...)
+	hdr := []byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoPair), 0x80, 0}
+	out := append(hdr, byte(len(block)>>8), byte(len(block)))
+	_, err = c.Write(append(out, block...))
+	MustSucceed(t, err)
+
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(c, reply)
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(reply[:6], hdr[:6]))
+	MustBeTrue(t, binary.BigEndian.Uint16(reply[6:]) == 0x8000)
+	block = make([]byte, binary.BigEndian.Uint16(reply[8:]))
+	_, err = io.ReadFull(c, block)
+	MustSucceed(t, err)
+
+	// Only the compression was answered.
+	MustBeTrue(t, bytes.Equal(block, extTLV(1, []byte("snappy"))))
+}
+
+func TestExtensionPeerMaxRecvSize(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.SetOption(mangos.OptionMaxRecvSize, 1024))
+	MustSucceed(t, srv.SetOption(mangos.OptionCompression, "gzip"))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	l := &testLogger{}
+	MustSucceed(t, cli.SetOption(mangos.OptionLogger, l))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.SetOption(mangos.OptionCompression, "gzip"))
+	MustSucceed(t, cli.Dial(addr))
+
+	MustSucceed(t, srv.Send([]byte("hello")))
+	m, err := cli.RecvMsg()
+	MustSucceed(t, err)
+	v, err := m.Pipe.GetOption(mangos.OptionPeerMaxRecvSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 1024)
+
+	// Too big for the peer, so it is not sent, but counted and logged,
+	// and the connection survives for the next.
+	big := make([]byte, 4096)
+	rand.Read(big)
+	MustSucceed(t, cli.Send(big))
+	MustSucceed(t, cli.Send([]byte("small")))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "small")
+	MustBeTrue(t, cli.Stats().TooLong == 1)
+	MustBeTrue(t, l.wait("exceeds peer limit of 1024"))
+
+	// Likewise when sent in a batch.
+	m1 := mangos.NewMessage(len(big))
+	m1.Body = append(m1.Body, big...)
+	m2 := mangos.NewMessage(4)
+	m2.Body = append(m2.Body, "next"...)
+	MustSucceed(t, cli.SendMsgs([]*mangos.Message{m1, m2}))
+	b, err = srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "next")
+	MustBeTrue(t, cli.Stats().TooLong == 2)
+}
+
+func TestExtensionNotOffered(t *testing.T) {
+	addr := AddrTestTCP()
+	l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer l.Close()
+
+	hdrq := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		hdr := make([]byte, 8)
+		if _, err = io.ReadFull(c, hdr); err == nil {
+			hdrq <- hdr
+		}
+	}()
+
+	// Nothing needs negotiating, so the header is as it always was,
+	// even though the limit on message size might be told.
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionMaxRecvSize, 1024))
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	}))
+	select {
+	case hdr := <-hdrq:
+		MustBeTrue(t, binary.BigEndian.Uint16(hdr[6:]) == 0)
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no connection")
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestFairSendOrder(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustBeTrue(t, s.SetOption(mangos.OptionFairSend, 1) == mangos.ErrBadValue)
+	MustSucceed(t, s.SetOption(mangos.OptionFairSend, true))
+	v, err := s.GetOption(mangos.OptionFairSend)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+	MustSucceed(t, s.SetOption(mangos.OptionSendDeadline, time.Second*5))
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 1))
+	MustSucceed(t, s.Listen(addr))
+
+	// With no peer, the first is queued, the next blocks holding
+	// the turn, and the rest wait behind it, in the order started.
+	sends := []struct {
+		lane uint32
+		body string
+	}{
+		{0, "x1"}, {1, "a1"}, {1, "a2"}, {1, "a3"}, {2, "b1"}, {2, "b2"}, {3, "c1"},
+	}
+	errs := make(chan error, len(sends))
+	for _, snd := range sends {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, snd.body...)
+		m.Lane = snd.lane
+		go func() { errs <- s.SendMsg(m) }()
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	r, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, r.Dial(addr))
+
+	// The lanes take turns in the order they started waiting, each going
+	// to the back once served, so a2 is followed by b1 and c1 before a3.
+	for _, want := range []string{"x1", "a1", "a2", "b1", "c1", "a3", "b2"} {
+		b, err := r.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == want)
+	}
+	for range sends {
+		MustSucceed(t, <-errs)
+	}
+}
+
+func TestFairSendTimeout(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionFairSend, true))
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 1))
+	MustSucceed(t, s.SetOption(mangos.OptionSendDeadline, time.Millisecond*50))
+	MustSucceed(t, s.Send([]byte("queued")))
+
+	// The one waiting for its turn gives up at its deadline too.
+	errs := make(chan error, 2)
+	go func() { errs <- s.Send([]byte("first")) }()
+	time.Sleep(time.Millisecond * 10)
+	go func() { errs <- s.Send([]byte("second")) }()
+	MustBeTrue(t, <-errs == mangos.ErrSendTimeout)
+	MustBeTrue(t, <-errs == mangos.ErrSendTimeout)
+
+	// And on close.
+	MustSucceed(t, s.SetOption(mangos.OptionSendDeadline, time.Duration(0)))
+	go func() { errs <- s.Send([]byte("first")) }()
+	time.Sleep(time.Millisecond * 10)
+	go func() { errs <- s.Send([]byte("second")) }()
+	time.Sleep(time.Millisecond * 10)
+	MustSucceed(t, s.Close())
+	MustBeTrue(t, <-errs == mangos.ErrClosed)
+	MustBeTrue(t, <-errs == mangos.ErrClosed)
+}
+
+func TestFairSendContext(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionFairSend, true))
+	MustSucceed(t, s.Listen(addr))
+
+	// With no peer, each context's request waits to be sent, so the
+	// first holds the turn, and the rest wait for theirs.
+	sends := []struct {
+		lane uint32
+		body string
+	}{
+		{0, "x1"}, {1, "a1"}, {1, "a2"}, {1, "a3"}, {2, "b1"}, {2, "b2"}, {3, "c1"},
+	}
+	errs := make(chan error, len(sends))
+	for _, snd := range sends {
+		c, err := s.OpenContext()
+		MustSucceed(t, err)
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, snd.body...)
+		m.Lane = snd.lane
+		go func() { errs <- c.SendMsg(m) }()
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	r, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, r.Dial(addr))
+
+	for _, want := range []string{"x1", "a1", "b1", "c1", "a2", "b2", "a3"} {
+		c, err := r.OpenContext()
+		MustSucceed(t, err)
+		b, err := c.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == want)
+	}
+	for range sends {
+		MustSucceed(t, <-errs)
+	}
+	// Contexts are counted as the socket is.
+	MustBeTrue(t, s.Stats().Sent == uint64(len(sends)))
+	MustBeTrue(t, r.Stats().Received == uint64(len(sends)))
+}
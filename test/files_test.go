@@ -0,0 +1,140 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+)
+
+// checkFile checks that the file passed is the write end of the pipe.
+func checkFile(t *testing.T, f *os.File, r *os.File, text string) {
+	_, err := f.Write([]byte(text))
+	MustSucceed(t, err)
+	MustSucceed(t, f.Close())
+	b := make([]byte, len(text))
+	_, err = r.Read(b)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == text)
+}
+
+func testFilesPair(t *testing.T, addr string) {
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+
+	r, w, err := os.Pipe()
+	MustSucceed(t, err)
+	defer r.Close()
+	tmp, err := ioutil.TempFile("", "mangos")
+	MustSucceed(t, err)
+	defer os.Remove(tmp.Name())
+
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, "two files"...)
+	m.Files = []*os.File{w, tmp}
+	MustSucceed(t, s1.SendMsg(m))
+
+	// A message without files follows, to check they stay with the
+	// one they were sent with.
+	MustSucceed(t, s1.Send([]byte("no files")))
+
+	m, err = s2.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m.Body) == "two files")
+	MustBeTrue(t, len(m.Files) == 2)
+	files := m.Files
+	m.Files = nil
+	m.Free()
+	checkFile(t, files[0], r, "through the pipe")
+	MustSucceed(t, files[1].Close())
+
+	m, err = s2.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m.Body) == "no files")
+	MustBeTrue(t, len(m.Files) == 0)
+	m.Free()
+}
+
+func TestFilesIPC(t *testing.T) {
+	testFilesPair(t, AddrTestIPC())
+}
+
+func TestFilesInp(t *testing.T) {
+	testFilesPair(t, AddrTestInp())
+}
+
+// TestFilesDup has a publisher send a file to two subscribers, which
+// each get one of their own.
+func TestFilesDup(t *testing.T) {
+	addr := AddrTestIPC()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.Listen(addr))
+
+	var subs []mangos.Socket
+	for i := 0; i < 2; i++ {
+		s, err := sub.NewSocket()
+		MustSucceed(t, err)
+		defer s.Close()
+		MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte{}))
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+		MustSucceed(t, s.Dial(addr))
+		subs = append(subs, s)
+	}
+	waitPipes(t, p, 2)
+
+	r, w, err := os.Pipe()
+	MustSucceed(t, err)
+	defer r.Close()
+	m := mangos.NewMessage(0)
+	m.Files = []*os.File{w}
+	MustSucceed(t, p.SendMsg(m))
+
+	for _, s := range subs {
+		m, err := s.RecvMsg()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(m.Files) == 1)
+		f := m.Files[0]
+		m.Files = nil
+		m.Free()
+		checkFile(t, f, r, "x")
+	}
+	// The publisher closed its own copies, so with the subscribers'
+	// closed, the pipe is finished.
+	b := make([]byte, 1)
+	_, err = r.Read(b)
+	MustBeTrue(t, err != nil)
+}
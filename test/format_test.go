@@ -0,0 +1,92 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestFormatMessage(t *testing.T) {
+	m := mangos.NewMessage(0)
+	defer m.Free()
+	m.Header = append(m.Header, 0xde, 0xad)
+	m.Body = append(m.Body, []byte("secret-password")...)
+
+	s := fmt.Sprintf("%v", m)
+	MustBeTrue(t, !strings.Contains(s, "secret"))
+	MustBeTrue(t, strings.Contains(s, "15 bytes"))
+	s = fmt.Sprintf("%#v", m)
+	MustBeTrue(t, !strings.Contains(s, "secret"))
+	MustBeTrue(t, strings.HasPrefix(s, "&mangos.Message{"))
+
+	s = fmt.Sprintf("%+v", m)
+	MustBeTrue(t, strings.Contains(s, "dead"))
+	MustBeTrue(t, strings.Contains(s, fmt.Sprintf("%x", "secret-password")))
+
+	saved := mangos.MessagePrefixLen
+	mangos.MessagePrefixLen = 4
+	s = fmt.Sprintf("%+v", m)
+	mangos.MessagePrefixLen = saved
+	MustBeTrue(t, strings.Contains(s, fmt.Sprintf("%x...", "secr")))
+	MustBeTrue(t, !strings.Contains(s, fmt.Sprintf("%x", "secret")))
+}
+
+func TestFormatSocket(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	l, err := s1.NewListener(addr, nil)
+	MustSucceed(t, err)
+	MustSucceed(t, l.Listen())
+	d, err := s2.NewDialer(addr, nil)
+	MustSucceed(t, err)
+	MustSucceed(t, d.Dial())
+
+	MustSucceed(t, s2.Send([]byte("ping")))
+	m, err := s1.RecvMsg()
+	MustSucceed(t, err)
+	defer m.Free()
+
+	str := fmt.Sprint(s1)
+	MustBeTrue(t, strings.HasPrefix(str, "SOCKET[pair]"))
+	MustBeTrue(t, strings.Contains(str, "pipes=1"))
+	MustBeTrue(t, strings.Contains(str, "listeners=1"))
+	MustBeTrue(t, strings.Contains(fmt.Sprintf("%#v", s1), "Pipes: 1"))
+
+	str = fmt.Sprint(m.Pipe)
+	MustBeTrue(t, strings.HasPrefix(str, "PIPE["))
+	MustBeTrue(t, strings.Contains(str, addr))
+	MustBeTrue(t, strings.Contains(str, "listener"))
+
+	MustBeTrue(t, strings.Contains(fmt.Sprint(l), addr))
+	MustBeTrue(t, strings.HasPrefix(fmt.Sprint(d), "DIALER["+addr))
+	MustBeTrue(t, strings.Contains(fmt.Sprint(d), "active"))
+	MustSucceed(t, d.Close())
+	MustBeTrue(t, strings.Contains(fmt.Sprintf("%#v", d), "closed"))
+
+	MustSucceed(t, s1.Close())
+	MustBeTrue(t, strings.Contains(fmt.Sprint(s1), "closed"))
+}
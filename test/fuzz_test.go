@@ -0,0 +1,236 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/star"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	"nanomsg.org/go/mangos/v2/protocol/xbus"
+	"nanomsg.org/go/mangos/v2/protocol/xpair"
+	"nanomsg.org/go/mangos/v2/protocol/xpub"
+	"nanomsg.org/go/mangos/v2/protocol/xpull"
+	"nanomsg.org/go/mangos/v2/protocol/xpush"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	"nanomsg.org/go/mangos/v2/protocol/xreq"
+	"nanomsg.org/go/mangos/v2/protocol/xrespondent"
+	"nanomsg.org/go/mangos/v2/protocol/xstar"
+	"nanomsg.org/go/mangos/v2/protocol/xsub"
+	"nanomsg.org/go/mangos/v2/protocol/xsurveyor"
+	"nanomsg.org/go/mangos/v2/transport"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// The fuzz targets here feed what a hostile or broken peer might send
+// to the parsers facing the network.  Whatever arrives, they must fail
+// with an error, and never panic.  Run one with, for example:
+//
+//	go test -run XXX -fuzz FuzzConnHandshake ./test
+
+// fuzzConn is a net.Conn reading the fuzzer's data, and discarding what
+// is written to it.
+type fuzzConn struct {
+	r *bytes.Reader
+}
+
+func (c *fuzzConn) Read(b []byte) (int, error)       { return c.r.Read(b) }
+func (c *fuzzConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c *fuzzConn) Close() error                     { return nil }
+func (c *fuzzConn) LocalAddr() net.Addr              { return fuzzAddr{} }
+func (c *fuzzConn) RemoteAddr() net.Addr             { return fuzzAddr{} }
+func (c *fuzzConn) SetDeadline(time.Time) error      { return nil }
+func (c *fuzzConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(time.Time) error { return nil }
+
+type fuzzAddr struct{}
+
+func (fuzzAddr) Network() string { return "fuzz" }
+func (fuzzAddr) String() string  { return "fuzz" }
+
+// spHeader is the connection header of a peer of the given protocol,
+// with rsvd set to offer or answer extensions.
+func spHeader(proto uint16, rsvd uint16) []byte {
+	h := []byte{0, 'S', 'P', 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(h[4:], proto)
+	binary.BigEndian.PutUint16(h[6:], rsvd)
+	return h
+}
+
+// spFrame is a message as conn sends it, with its length in front.
+func spFrame(body []byte) []byte {
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint64(b, uint64(len(body)))
+	return append(b, body...)
+}
+
+func FuzzConnHandshake(f *testing.F) {
+	pairHdr := spHeader(mangos.ProtoPair, 0)
+	f.Add(false, append(pairHdr, spFrame([]byte("hello"))...))
+	f.Add(false, spHeader(mangos.ProtoPair, 1))
+	f.Add(true, spHeader(mangos.ProtoPair, 0))
+	f.Add(true, append(spHeader(mangos.ProtoPair, 1), 0, 4, 0, 1, 0, 0))
+	f.Add(false, append(pairHdr, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf0))
+	// An offer of snappy compression, and a compressed frame.
+	offer := append(spHeader(mangos.ProtoPair, 1), 0, 10, 0, 1, 0, 6)
+	offer = append(offer, "snappy"...)
+	f.Add(false, append(offer, spFrame([]byte{1, 5, 16, 'h', 'e', 'l', 'l', 'o'})...))
+	f.Add(false, append(offer, spFrame([]byte{1, 0xff, 0xff, 0xff, 0xff, 0x0f})...))
+	// An offer of chunking, and a message in two chunks.
+	chunks := append(spHeader(mangos.ProtoPair, 0x8000), 0, 8, 0, 4, 0, 4, 0, 0, 4, 0)
+	chunks = append(chunks, spFrame([]byte{3, 'h', 'e'})...)
+	f.Add(false, append(chunks, spFrame([]byte{4, 'l', 'l', 'o'})...))
+
+	info := transport.ProtocolInfo{
+		Self: mangos.ProtoPair, Peer: mangos.ProtoPair,
+		SelfName: "pair", PeerName: "pair",
+	}
+	f.Fuzz(func(t *testing.T, dialer bool, data []byte) {
+		opts := map[string]interface{}{
+			mangos.OptionCompression:      "snappy",
+			mangos.OptionHeartbeatTime:    time.Hour,
+			mangos.OptionHeartbeatTimeout: time.Hour,
+			mangos.OptionChunkSize:        1024,
+		}
+		c := &fuzzConn{r: bytes.NewReader(data)}
+		newPipe := transport.NewConnPipeListener
+		if dialer {
+			newPipe = transport.NewConnPipeDialer
+		}
+		p, err := newPipe(c, info, opts)
+		MustSucceed(t, err)
+		h := transport.NewConnHandshaker()
+		defer h.Close()
+		MustSucceed(t, h.Start(p))
+		if p, err = h.Wait(); err != nil {
+			return
+		}
+		defer p.Close()
+		for {
+			m, err := p.Recv()
+			if err != nil {
+				return
+			}
+			m.Free()
+		}
+	})
+}
+
+func FuzzIPCFrame(f *testing.F) {
+	hdr := spHeader(mangos.ProtoPair, 0)
+	f.Add(append(append(hdr, 1), spFrame([]byte("hello"))...))
+	f.Add(append(append(hdr, 2), spFrame([]byte("hello"))...))
+	f.Add(append(append(hdr, 1), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff))
+
+	info := transport.ProtocolInfo{
+		Self: mangos.ProtoPair, Peer: mangos.ProtoPair,
+		SelfName: "pair", PeerName: "pair",
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := &fuzzConn{r: bytes.NewReader(data)}
+		p, err := transport.NewConnPipeIPC(c, info, nil)
+		MustSucceed(t, err)
+		h := transport.NewConnHandshaker()
+		defer h.Close()
+		MustSucceed(t, h.Start(p))
+		if p, err = h.Wait(); err != nil {
+			return
+		}
+		defer p.Close()
+		for {
+			m, err := p.Recv()
+			if err != nil {
+				return
+			}
+			m.Free()
+		}
+	})
+}
+
+var fuzzProtocols = []func() (mangos.Socket, error){
+	bus.NewSocket, pair.NewSocket, pub.NewSocket, pull.NewSocket,
+	push.NewSocket, rep.NewSocket, req.NewSocket, respondent.NewSocket,
+	star.NewSocket, sub.NewSocket, surveyor.NewSocket,
+	xbus.NewSocket, xpair.NewSocket, xpub.NewSocket, xpull.NewSocket,
+	xpush.NewSocket, xrep.NewSocket, xreq.NewSocket,
+	xrespondent.NewSocket, xstar.NewSocket, xsub.NewSocket,
+	xsurveyor.NewSocket,
+}
+
+// FuzzProtocolHeader has a peer send frames to a socket of each
+// protocol, which must make what it can of their headers.
+func FuzzProtocolHeader(f *testing.F) {
+	f.Add(uint8(0), []byte{0, 0, 0, 0, 0, 0, 0, 0})  // bus
+	f.Add(uint8(5), []byte{0x80, 0, 0, 1, 'h', 'i'}) // rep
+	f.Add(uint8(5), []byte{0, 0, 0, 1, 0x80, 0, 0, 2})
+	f.Add(uint8(5), []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	f.Add(uint8(6), []byte{0x80, 0, 0, 1, 'h', 'i'}) // req
+	f.Add(uint8(7), []byte{0x80, 0, 0, 1})           // respondent
+	f.Add(uint8(8), []byte{1, 2, 3})                 // star
+	f.Add(uint8(9), []byte("topic"))                 // sub
+	f.Add(uint8(10), []byte{0x80, 0, 0, 1, 'y'})     // surveyor
+	f.Add(uint8(16), []byte{0x80, 0, 0, 1})          // xrep
+	f.Add(uint8(19), []byte{})                       // xstar
+
+	type target struct {
+		sock mangos.Socket
+		addr string
+	}
+	var targets []target
+	for _, newSock := range fuzzProtocols {
+		s, err := newSock()
+		if err != nil {
+			f.Fatal(err)
+		}
+		defer s.Close()
+		_ = s.SetOption(mangos.OptionRecvDeadline, time.Millisecond)
+		_ = s.SetOption(mangos.OptionSendDeadline, time.Millisecond)
+		_ = s.SetOption(mangos.OptionSubscribe, []byte{})
+		addr := AddrTestTCP()
+		if err = s.Listen(addr); err != nil {
+			f.Fatal(err)
+		}
+		targets = append(targets, target{s, strings.TrimPrefix(addr, "tcp://")})
+	}
+
+	f.Fuzz(func(t *testing.T, which uint8, data []byte) {
+		tg := targets[int(which)%len(targets)]
+		c, err := net.Dial("tcp", tg.addr)
+		MustSucceed(t, err)
+		defer c.Close()
+		_, err = c.Write(append(spHeader(tg.sock.Info().Peer, 0), spFrame(data)...))
+		MustSucceed(t, err)
+		// Take whatever comes of it, and answer it, so that the send
+		// side (such as REP's backtrace) sees it too.
+		if m, err := tg.sock.RecvMsg(); err == nil {
+			_ = tg.sock.SendMsg(m)
+		}
+	})
+}
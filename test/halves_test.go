@@ -0,0 +1,90 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestSocketHalves(t *testing.T) {
+	addr := AddrTestInp()
+	rx, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.Listen(addr))
+	tx, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.Dial(addr))
+
+	r := rx.ReaderOnly()
+	w := tx.WriterOnly()
+	MustBeTrue(t, r.Info().Self == mangos.ProtoPull)
+	MustBeTrue(t, w.Info().Self == mangos.ProtoPush)
+
+	// The views cannot be turned back into the whole socket.
+	_, ok := r.(mangos.Socket)
+	MustBeFalse(t, ok)
+	_, ok = w.(mangos.Socket)
+	MustBeFalse(t, ok)
+
+	MustSucceed(t, w.Send([]byte("one")))
+	MustSucceed(t, w.SendMsgs([]*mangos.Message{mangos.NewMessage(0)}))
+	b, err := r.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "one")
+	ms, err := r.RecvMsgs(4)
+	MustSucceed(t, err)
+	MustBeTrue(t, len(ms) == 1)
+	ms[0].Free()
+}
+
+func TestSocketHalvesWrongWay(t *testing.T) {
+	for _, f := range []func() (mangos.Socket, error){
+		pub.NewSocket, push.NewSocket,
+	} {
+		s, err := f()
+		MustSucceed(t, err)
+		r := s.ReaderOnly()
+		_, err = r.Recv()
+		MustBeTrue(t, err == mangos.ErrProtoOp)
+		_, err = r.RecvMsg()
+		MustBeTrue(t, err == mangos.ErrProtoOp)
+		_, err = r.RecvMsgs(2)
+		MustBeTrue(t, err == mangos.ErrProtoOp)
+		MustSucceed(t, s.Close())
+	}
+	for _, f := range []func() (mangos.Socket, error){
+		sub.NewSocket, pull.NewSocket,
+	} {
+		s, err := f()
+		MustSucceed(t, err)
+		w := s.WriterOnly()
+		MustBeTrue(t, w.Send([]byte("x")) == mangos.ErrProtoOp)
+		MustBeTrue(t, w.SendMsg(mangos.NewMessage(0)) == mangos.ErrProtoOp)
+		MustBeTrue(t, w.SendMsgs([]*mangos.Message{
+			mangos.NewMessage(0)}) == mangos.ErrProtoOp)
+		MustSucceed(t, s.Close())
+	}
+}
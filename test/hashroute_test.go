@@ -0,0 +1,160 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// hashKeyFirst keys each message by its first byte, or not at all for
+// an empty body.
+func hashKeyFirst(m *mangos.Message) []byte {
+	if len(m.Body) == 0 {
+		return nil
+	}
+	return m.Body[:1]
+}
+
+// hashWorkers receives from each of the pull sockets until they all go
+// quiet, and returns which got each key.
+func hashWorkers(t *testing.T, workers []mangos.Socket) map[byte][]int {
+	got := make(map[byte][]int)
+	for i, w := range workers {
+		MustSucceed(t, w.SetOption(mangos.OptionRecvDeadline,
+			time.Millisecond*200))
+		for {
+			b, err := w.Recv()
+			if err == mangos.ErrRecvTimeout {
+				break
+			}
+			MustSucceed(t, err)
+			got[b[0]] = append(got[b[0]], i)
+		}
+	}
+	return got
+}
+
+func TestHashRoute(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionHashRoute,
+		mangos.HashRouteFunc(hashKeyFirst)))
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 256))
+	MustSucceed(t, s.Listen(addr))
+
+	workers := make([]mangos.Socket, 3)
+	for i := range workers {
+		w, err := pull.NewSocket()
+		MustSucceed(t, err)
+		defer w.Close()
+		MustSucceed(t, w.SetOption(mangos.OptionReadQLen, 256))
+		MustSucceed(t, w.Dial(addr))
+		workers[i] = w
+	}
+	waitPipes(t, s, 3)
+
+	for n := 0; n < 4; n++ {
+		for k := 0; k < 32; k++ {
+			MustSucceed(t, s.Send([]byte{byte(k), byte(n)}))
+		}
+	}
+	got := hashWorkers(t, workers)
+	MustBeTrue(t, len(got) == 32)
+	owner := make(map[byte]int)
+	used := make(map[int]bool)
+	for k, ws := range got {
+		MustBeTrue(t, len(ws) == 4)
+		for _, w := range ws {
+			MustBeTrue(t, w == ws[0])
+		}
+		owner[k] = ws[0]
+		used[ws[0]] = true
+	}
+	// With this many keys, each worker should get some.
+	MustBeTrue(t, len(used) == 3)
+
+	// Losing a worker moves only its keys.
+	MustSucceed(t, workers[2].Close())
+	workers = workers[:2]
+	waitPipes(t, s, 2)
+	for k := 0; k < 32; k++ {
+		MustSucceed(t, s.Send([]byte{byte(k)}))
+	}
+	got = hashWorkers(t, workers)
+	MustBeTrue(t, len(got) == 32)
+	for k, ws := range got {
+		MustBeTrue(t, len(ws) == 1)
+		if owner[k] != 2 {
+			MustBeTrue(t, ws[0] == owner[k])
+		}
+	}
+}
+
+func TestHashRouteNilKey(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionHashRoute, hashKeyFirst))
+	MustSucceed(t, s.Listen(addr))
+
+	w, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer w.Close()
+	MustSucceed(t, w.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, w.Dial(addr))
+	waitPipes(t, s, 1)
+
+	// No key, so these are balanced as usual.
+	MustSucceed(t, s.Send([]byte{}))
+	b, err := w.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, len(b) == 0)
+}
+
+func TestHashRouteOption(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	v, err := s.GetOption(mangos.OptionHashRoute)
+	MustSucceed(t, err)
+	fn, ok := v.(mangos.HashRouteFunc)
+	MustBeTrue(t, ok)
+	MustBeTrue(t, fn == nil)
+
+	MustSucceed(t, s.SetOption(mangos.OptionHashRoute, hashKeyFirst))
+	v, err = s.GetOption(mangos.OptionHashRoute)
+	MustSucceed(t, err)
+	fn, ok = v.(mangos.HashRouteFunc)
+	MustBeTrue(t, ok)
+	MustBeTrue(t, fn != nil)
+
+	MustSucceed(t, s.SetOption(mangos.OptionHashRoute, nil))
+	MustFail(t, s.SetOption(mangos.OptionHashRoute, 3))
+
+	p, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustFail(t, p.SetOption(mangos.OptionHashRoute, hashKeyFirst))
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestHeartbeatOptions(t *testing.T) {
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+
+	v, err := sock.GetOption(mangos.OptionHeartbeatTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == 0)
+	MustSucceed(t, sock.SetOption(mangos.OptionHeartbeatTime, time.Second))
+	MustSucceed(t, sock.SetOption(mangos.OptionHeartbeatTimeout, time.Second*5))
+	MustBeTrue(t, sock.SetOption(mangos.OptionHeartbeatTime, -time.Second) == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionHeartbeatTimeout, 5) == mangos.ErrBadValue)
+
+	d, err := sock.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionHeartbeatTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Second)
+}
+
+func TestHeartbeatIdle(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.SetOption(mangos.OptionHeartbeatTime, time.Millisecond*20))
+	MustSucceed(t, cli.Dial(addr))
+
+	MustSucceed(t, cli.Send([]byte("first")))
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	v, err := m.Pipe.GetOption(mangos.OptionHeartbeatTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Millisecond*20)
+	p := m.Pipe
+	m.Free()
+
+	// Idle for many times the timeout; the heartbeats keep it up.
+	time.Sleep(time.Millisecond * 300)
+	MustSucceed(t, srv.Send([]byte("second")))
+	m, err = cli.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m.Body) == "second")
+	m.Free()
+	MustSucceed(t, cli.Send([]byte("third")))
+	m, err = srv.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, m.Pipe.ID() == p.ID())
+	m.Free()
+}
+
+// silentPeer accepts connections, completes the handshake agreeing to
+// heartbeats, and then says nothing more, as though it had gone away.
+func silentPeer(l net.Listener, connq chan<- net.Conn) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		hdr := make([]byte, 10)
+		if _, err = io.ReadFull(c, hdr); err != nil {
+			c.Close()
+			continue
+		}
+		block := make([]byte, binary.BigEndian.Uint16(hdr[8:]))
+		if _, err = io.ReadFull(c, block); err != nil {
+			c.Close()
+			continue
+		}
+		reply := []byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoPair), 0x80, 0}
+		reply = append(reply, 0, 8)
+		reply = append(reply, extTLV(2, []byte{0, 0, 0, 20})...)
+		c.Write(reply)
+		connq <- c
+	}
+}
+
+func TestHeartbeatDeadPeer(t *testing.T) {
+	addr := AddrTestTCP()
+	l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer l.Close()
+	connq := make(chan net.Conn, 10)
+	go silentPeer(l, connq)
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	detached := make(chan struct{}, 10)
+	cli.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventDetached {
+			detached <- struct{}{}
+		}
+	})
+	MustSucceed(t, cli.SetOption(mangos.OptionHeartbeatTime, time.Millisecond*20))
+	MustSucceed(t, cli.SetOption(mangos.OptionHeartbeatTimeout, time.Millisecond*100))
+	MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	MustSucceed(t, cli.Dial(addr))
+
+	var c net.Conn
+	select {
+	case c = <-connq:
+		defer c.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("no connection")
+	}
+
+	// The peer sends nothing, so the pipe must be closed, and the
+	// dialer connect again.
+	select {
+	case <-detached:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("dead peer not detected")
+	}
+	select {
+	case c = <-connq:
+		defer c.Close()
+	case <-time.After(time.Second * 2):
+		t.Fatalf("no reconnection")
+	}
+}
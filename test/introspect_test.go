@@ -0,0 +1,137 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestSocketEndpoints(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.Dial(addr))
+	d, err := cli.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+	waitPipes(t, srv, 1)
+
+	eps := srv.Endpoints()
+	MustBeTrue(t, len(eps) == 1)
+	MustBeTrue(t, eps[0].Address == addr)
+	MustBeTrue(t, eps[0].Scheme == "tcp")
+	MustBeTrue(t, eps[0].Role == "listener")
+	MustBeTrue(t, eps[0].State == "open")
+	MustBeTrue(t, eps[0].Pipes == 1)
+
+	eps = cli.Endpoints()
+	MustBeTrue(t, len(eps) == 2)
+	MustBeTrue(t, eps[0].Role == "dialer")
+	MustBeTrue(t, eps[0].State == "active")
+	MustBeTrue(t, eps[0].Pipes == 1)
+	MustBeTrue(t, eps[1].Address == d.Address())
+	MustBeTrue(t, eps[1].State == "idle")
+	MustBeTrue(t, eps[1].Pipes == 0)
+}
+
+func TestSocketPipes(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	start := time.Now()
+	MustSucceed(t, cli.Dial(addr))
+
+	for i := 0; i < 3; i++ {
+		MustSucceed(t, cli.Send([]byte("ping")))
+		_, err = srv.Recv()
+		MustSucceed(t, err)
+		MustSucceed(t, srv.Send([]byte("pong!")))
+		_, err = cli.Recv()
+		MustSucceed(t, err)
+	}
+
+	pipes := cli.Pipes()
+	MustBeTrue(t, len(pipes) == 1)
+	p := pipes[0]
+	MustBeTrue(t, p.Address == addr)
+	MustBeTrue(t, p.Scheme == "tcp")
+	MustBeTrue(t, p.Role == "dialer")
+	MustBeTrue(t, p.State == "open")
+	MustBeFalse(t, p.Connected.Before(start))
+	MustNotBeNil(t, p.LocalAddr)
+	MustNotBeNil(t, p.RemoteAddr)
+	MustBeTrue(t, p.MsgsSent == 3)
+	MustBeTrue(t, p.MsgsRecv == 3)
+	// Each request carries a four byte request ID in its header.
+	MustBeTrue(t, p.BytesSent == 3*(4+4))
+	MustBeTrue(t, p.BytesRecv == 3*(4+5))
+
+	pipes = srv.Pipes()
+	MustBeTrue(t, len(pipes) == 1)
+	MustBeTrue(t, pipes[0].Role == "listener")
+	MustBeTrue(t, pipes[0].RemoteAddr.String() == p.LocalAddr.String())
+	MustBeTrue(t, pipes[0].MsgsRecv == 3)
+
+	MustSucceed(t, cli.Close())
+	waitPipes(t, srv, 0)
+	MustBeTrue(t, len(srv.Pipes()) == 0)
+}
+
+func TestSocketPipesBodies(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.Dial(addr))
+
+	// Segments in Bodies are counted as well as the Body.
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, "pi"...)
+	m.Bodies = [][]byte{[]byte("n"), []byte("g")}
+	MustSucceed(t, cli.SendMsg(m))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+
+	pipes := cli.Pipes()
+	MustBeTrue(t, len(pipes) == 1)
+	MustBeTrue(t, pipes[0].BytesSent == 4+4)
+	MustBeTrue(t, srv.Pipes()[0].BytesRecv == 4+4)
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+)
+
+// needIPv6 skips the test if the IPv6 loopback cannot be used.
+func needIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	l.Close()
+}
+
+// ipPair connects a pair of sockets, and returns the address the
+// listening side sees the connection come from.
+func ipPair(t *testing.T, laddr, daddr string, lopts, dopts map[string]interface{}) net.Addr {
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	l, err := srv.NewListener(laddr, lopts)
+	MustSucceed(t, err)
+	MustSucceed(t, l.Listen())
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.DialOptions(daddr, dopts))
+	MustSucceed(t, cli.Send([]byte("hello")))
+
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	defer m.Free()
+	info, ok := m.PipeInfo()
+	MustBeTrue(t, ok)
+	return info.RemoteAddr
+}
+
+func TestIPv6Loopback(t *testing.T) {
+	needIPv6(t)
+	port := NextPort()
+	addr := fmt.Sprintf("tcp://[::1]:%d", port)
+	from := ipPair(t, addr, addr, nil, nil)
+	MustBeTrue(t, from.(*net.TCPAddr).IP.Equal(net.IPv6loopback))
+
+	addr = fmt.Sprintf("tcp6://[::1]:%d", NextPort())
+	from = ipPair(t, addr, addr, nil, nil)
+	MustBeTrue(t, from.(*net.TCPAddr).IP.Equal(net.IPv6loopback))
+}
+
+func TestIPv6Wildcard(t *testing.T) {
+	needIPv6(t)
+
+	// A plain wildcard accepts both IPv4 and IPv6.
+	port := NextPort()
+	addr := fmt.Sprintf("tcp://*:%d", port)
+	ipPair(t, addr, fmt.Sprintf("tcp://127.0.0.1:%d", port), nil, nil)
+	port = NextPort()
+	addr = fmt.Sprintf("tcp://*:%d", port)
+	ipPair(t, addr, fmt.Sprintf("tcp://[::1]:%d", port), nil, nil)
+
+	// But a v6 one only accepts IPv6.
+	port = NextPort()
+	ipPair(t, fmt.Sprintf("tcp6://*:%d", port),
+		fmt.Sprintf("tcp://[::1]:%d", port), nil, nil)
+
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+	port = NextPort()
+	MustSucceed(t, sock.ListenOptions(fmt.Sprintf("tcp://*:%d", port),
+		map[string]interface{}{mangos.OptionIPVersion: 6}))
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustFail(t, cli.Dial(fmt.Sprintf("tcp://127.0.0.1:%d", port)))
+}
+
+func TestIPVersionResolve(t *testing.T) {
+	// localhost is IPv4 everywhere, but not everywhere IPv6.
+	port := NextPort()
+	from := ipPair(t, fmt.Sprintf("tcp4://*:%d", port),
+		fmt.Sprintf("tcp://localhost:%d", port), nil,
+		map[string]interface{}{mangos.OptionIPVersion: 4})
+	MustBeTrue(t, from.(*net.TCPAddr).IP.To4() != nil)
+
+	// Literal addresses must match the version.
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+	_, err = sock.NewDialer("tcp6://127.0.0.1:5555", nil)
+	MustFail(t, err)
+	_, err = sock.NewListener("tcp4://[::1]:5555", nil)
+	MustFail(t, err)
+	MustFail(t, sock.DialOptions(fmt.Sprintf("tcp://127.0.0.1:%d", NextPort()),
+		map[string]interface{}{mangos.OptionIPVersion: 6}))
+	MustFail(t, sock.DialOptions(fmt.Sprintf("tls+tcp://127.0.0.1:%d", NextPort()),
+		map[string]interface{}{mangos.OptionIPVersion: 6}))
+
+	for _, v := range []interface{}{5, "6", -1} {
+		_, err = sock.NewDialer(AddrTestTCP(), map[string]interface{}{
+			mangos.OptionIPVersion: v,
+		})
+		MustBeTrue(t, err == mangos.ErrBadValue)
+	}
+}
+
+func TestIPv6Zone(t *testing.T) {
+	needIPv6(t)
+	ifcs, err := net.Interfaces()
+	MustSucceed(t, err)
+	for _, ifc := range ifcs {
+		if ifc.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := ifc.Addrs()
+		MustSucceed(t, err)
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || !ipn.IP.IsLinkLocalUnicast() || ipn.IP.To4() != nil {
+				continue
+			}
+			addr := fmt.Sprintf("tcp://[%s%%%s]:%d", ipn.IP, ifc.Name, NextPort())
+			from := ipPair(t, addr, addr, nil, nil)
+			MustBeTrue(t, from.(*net.TCPAddr).IP.Equal(ipn.IP))
+			return
+		}
+	}
+	t.Skip("no IPv6 link-local address")
+}
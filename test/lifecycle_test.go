@@ -0,0 +1,120 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+type lifecycles struct {
+	sync.Mutex
+	sent []mangos.Lifecycle
+	recv []mangos.Lifecycle
+	addr []string
+}
+
+func (l *lifecycles) record(p mangos.Pipe, lc mangos.Lifecycle) {
+	l.Lock()
+	defer l.Unlock()
+	if lc.Written.IsZero() {
+		l.recv = append(l.recv, lc)
+	} else {
+		l.sent = append(l.sent, lc)
+	}
+	l.addr = append(l.addr, p.Address())
+}
+
+func TestLifecycle(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	v, err := s1.GetOption(mangos.OptionLifecycle)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.LifecycleFunc) == nil)
+	MustBeTrue(t, s1.SetOption(mangos.OptionLifecycle, 1) == mangos.ErrBadValue)
+
+	l1 := &lifecycles{}
+	l2 := &lifecycles{}
+	MustSucceed(t, s1.SetOption(mangos.OptionLifecycle,
+		mangos.LifecycleFunc(l1.record)))
+	MustSucceed(t, s2.SetOption(mangos.OptionLifecycle,
+		mangos.LifecycleFunc(l2.record)))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+
+	start := time.Now()
+	const n = 5
+	for i := 0; i < n; i++ {
+		MustSucceed(t, s1.Send([]byte("timed")))
+	}
+	for i := 0; i < n; i++ {
+		m, err := s2.RecvMsg()
+		MustSucceed(t, err)
+		lc := m.Lifecycle
+		MustBeFalse(t, lc.Read.Before(start))
+		MustBeFalse(t, lc.Delivered.Before(lc.Read))
+		MustBeTrue(t, lc.Enqueued.IsZero() && lc.Written.IsZero())
+		m.Free()
+	}
+
+	// The sender reports each once it is written, which may be a
+	// little after Send returns.
+	deadline := time.Now().Add(time.Second)
+	for {
+		l1.Lock()
+		done := len(l1.sent) == n
+		l1.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	l1.Lock()
+	MustBeTrue(t, len(l1.sent) == n)
+	MustBeTrue(t, len(l1.recv) == 0)
+	for i, lc := range l1.sent {
+		MustBeFalse(t, lc.Enqueued.Before(start))
+		MustBeFalse(t, lc.Written.Before(lc.Enqueued))
+		MustBeTrue(t, lc.Read.IsZero() && lc.Delivered.IsZero())
+		MustBeTrue(t, strings.HasPrefix(l1.addr[i], "tcp://"))
+	}
+	l1.Unlock()
+	l2.Lock()
+	MustBeTrue(t, len(l2.recv) == n)
+	MustBeTrue(t, len(l2.sent) == 0)
+	l2.Unlock()
+
+	// Without a function, no times are taken.
+	MustSucceed(t, s2.SetOption(mangos.OptionLifecycle, nil))
+	MustSucceed(t, s1.Send([]byte("untimed")))
+	m, err := s2.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, m.Lifecycle == mangos.Lifecycle{})
+	m.Free()
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestLingerOption(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	v, err := s.GetOption(mangos.OptionLinger)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == 0)
+	MustSucceed(t, s.SetOption(mangos.OptionLinger, time.Second))
+	v, err = s.GetOption(mangos.OptionLinger)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Second)
+	MustBeTrue(t, s.SetOption(mangos.OptionLinger, -time.Second) == mangos.ErrBadValue)
+	MustBeTrue(t, s.SetOption(mangos.OptionLinger, 1) == mangos.ErrBadValue)
+}
+
+func TestLingerPushFlush(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := push.NewSocket()
+	MustSucceed(t, err)
+	s2, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	MustSucceed(t, s1.SetOption(mangos.OptionWriteQLen, 100))
+	MustSucceed(t, s1.SetOption(mangos.OptionLinger, time.Second*5))
+	MustSucceed(t, s2.SetOption(mangos.OptionReadQLen, 1))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s2.Listen(addr))
+	MustSucceed(t, s1.Dial(addr))
+
+	// These all fit in the queue, and most of them will still be
+	// there when we close, as the receiver is slow.
+	for i := 0; i < 50; i++ {
+		MustSucceed(t, s1.Send([]byte{byte(i)}))
+	}
+	done := make(chan struct{})
+	go func() {
+		s1.Close()
+		close(done)
+	}()
+	for i := 0; i < 50; i++ {
+		b, err := s2.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && b[0] == byte(i))
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("close did not finish when drained")
+	}
+}
+
+func TestLingerExpires(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionLinger, time.Millisecond*100))
+	MustSucceed(t, s.DialOptions(AddrTestInp(), map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	}))
+
+	// Nobody to send to, so this never drains.
+	MustSucceed(t, s.Send([]byte("lost")))
+	now := time.Now()
+	MustSucceed(t, s.Close())
+	MustBeTrue(t, time.Since(now) >= time.Millisecond*100)
+	MustBeTrue(t, time.Since(now) < time.Second)
+}
+
+func TestLingerEmpty(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionLinger, time.Second*5))
+
+	// Nothing queued, so there is no waiting.
+	now := time.Now()
+	MustSucceed(t, s.Close())
+	MustBeTrue(t, time.Since(now) < time.Second)
+}
+
+func TestLingerReply(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := rep.NewSocket()
+	MustSucceed(t, err)
+
+	MustSucceed(t, s1.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s2.SetOption(mangos.OptionLinger, time.Second))
+	MustSucceed(t, s2.Listen(addr))
+	MustSucceed(t, s1.Dial(addr))
+
+	// The reply goes out, even though we close straight after.
+	MustSucceed(t, s1.Send([]byte("ping")))
+	_, err = s2.Recv()
+	MustSucceed(t, err)
+	MustSucceed(t, s2.Send(make([]byte, 1<<19)))
+	MustSucceed(t, s2.Close())
+	b, err := s1.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, len(b) == 1<<19)
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestLiveReadQLenWaiting(t *testing.T) {
+	addr := AddrTestInp()
+	rx, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.Listen(addr))
+	tx, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.Dial(addr))
+	waitPipes(t, rx, 1)
+
+	// A Recv already waiting takes from the new queue.
+	done := make(chan string, 1)
+	go func() {
+		b, err := rx.Recv()
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		done <- string(b)
+	}()
+	time.Sleep(time.Millisecond * 20)
+	MustSucceed(t, rx.SetOption(mangos.OptionReadQLen, 4))
+	MustSucceed(t, tx.Send([]byte("after")))
+	select {
+	case s := <-done:
+		MustBeTrue(t, s == "after")
+	case <-time.After(time.Second * 2):
+		t.Fatalf("receiver stuck on the old queue")
+	}
+}
+
+func TestLiveReadQLenQueued(t *testing.T) {
+	addr := AddrTestInp()
+	rx, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.Listen(addr))
+	tx, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.Dial(addr))
+	waitPipes(t, rx, 1)
+
+	for i := 0; i < 10; i++ {
+		MustSucceed(t, tx.Send([]byte(fmt.Sprint(i))))
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// The oldest are kept, and the rest counted as dropped.
+	MustSucceed(t, rx.SetOption(mangos.OptionReadQLen, 4))
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline,
+		time.Millisecond*100))
+	for i := 0; i < 4; i++ {
+		b, err := rx.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == fmt.Sprint(i))
+	}
+	_, err = rx.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	v, err := rx.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(map[string]uint64)[mangos.StatDropped] == 6)
+
+	// It grows again just as well.
+	MustSucceed(t, rx.SetOption(mangos.OptionReadQLen, 64))
+	MustSucceed(t, tx.Send([]byte("more")))
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	b, err := rx.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "more")
+}
+
+func TestLiveWriteQLen(t *testing.T) {
+	addr := AddrTestInp()
+	tx, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.SetOption(mangos.OptionWriteQLen, 2))
+	MustSucceed(t, tx.SetOption(mangos.OptionSendDeadline, time.Second*2))
+	MustSucceed(t, tx.Send([]byte("0")))
+	MustSucceed(t, tx.Send([]byte("1")))
+
+	// A Send waiting for room finds it in the new queue.
+	done := make(chan error, 1)
+	go func() {
+		done <- tx.Send([]byte("2"))
+	}()
+	time.Sleep(time.Millisecond * 20)
+	MustSucceed(t, tx.SetOption(mangos.OptionWriteQLen, 8))
+	select {
+	case err := <-done:
+		MustSucceed(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("sender stuck on the old queue")
+	}
+	v, err := tx.GetOption(mangos.OptionWriteQLen)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 8)
+
+	rx, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.Listen(addr))
+	MustSucceed(t, tx.Dial(addr))
+	for i := 0; i < 3; i++ {
+		b, err := rx.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == fmt.Sprint(i))
+	}
+}
+
+func TestLiveWriteQLenPipes(t *testing.T) {
+	addr := AddrTestInp()
+	rx, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.Listen(addr))
+	tx, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.Dial(addr))
+	waitPipes(t, tx, 1)
+
+	// Pipes already connected are resized too, while in use.
+	for i := 0; i < 20; i++ {
+		MustSucceed(t, tx.SetOption(mangos.OptionWriteQLen, 1+i%3))
+		MustSucceed(t, tx.Send([]byte(fmt.Sprint(i))))
+	}
+	n := 0
+	for {
+		if _, err := rx.Recv(); err != nil {
+			MustBeTrue(t, err == mangos.ErrRecvTimeout)
+			break
+		}
+		n++
+		MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline,
+			time.Millisecond*100))
+	}
+	v, err := tx.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	MustBeTrue(t, uint64(n)+v.(map[string]uint64)[mangos.StatDropped] == 20)
+}
+
+func TestLiveSendRateLimit(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSendRateLimit,
+		mangos.RateLimit{Messages: 0.5}))
+	MustSucceed(t, s.Send([]byte("first")))
+
+	// The second would wait two seconds, but the limit is lifted.
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- s.Send([]byte("second"))
+	}()
+	time.Sleep(time.Millisecond * 50)
+	MustSucceed(t, s.SetOption(mangos.OptionSendRateLimit, mangos.RateLimit{}))
+	select {
+	case err := <-done:
+		MustSucceed(t, err)
+		MustBeTrue(t, time.Since(start) < time.Second)
+	case <-time.After(time.Second):
+		t.Fatalf("sender held to the old limit")
+	}
+}
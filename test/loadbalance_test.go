@@ -0,0 +1,227 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestLoadBalanceOption(t *testing.T) {
+	for _, f := range []func() (mangos.Socket, error){push.NewSocket, req.NewSocket} {
+		s, err := f()
+		MustSucceed(t, err)
+		MustSucceed(t, s.SetOption(mangos.OptionStrict, true))
+		v, err := s.GetOption(mangos.OptionLoadBalance)
+		MustSucceed(t, err)
+		MustBeTrue(t, v == mangos.LoadBalanceRoundRobin)
+		MustSucceed(t, s.SetOption(mangos.OptionLoadBalance, mangos.LoadBalanceWeighted))
+		v, err = s.GetOption(mangos.OptionLoadBalance)
+		MustSucceed(t, err)
+		MustBeTrue(t, v == mangos.LoadBalanceWeighted)
+		MustBeTrue(t, s.SetOption(mangos.OptionLoadBalance, 1) == mangos.ErrBadValue)
+		MustBeTrue(t, s.SetOption(mangos.OptionLoadBalance, mangos.LoadBalance(9)) ==
+			mangos.ErrBadValue)
+		MustSucceed(t, s.Close())
+	}
+}
+
+func TestLoadBalanceWeightOption(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	d, err := s.NewDialer(AddrTestInp(), map[string]interface{}{
+		mangos.OptionWeight: 5,
+	})
+	MustSucceed(t, err)
+	v, err := d.GetOption(mangos.OptionWeight)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == 5)
+	MustBeTrue(t, d.SetOption(mangos.OptionWeight, 0) == mangos.ErrBadValue)
+
+	l, err := s.NewListener(AddrTestInp(), nil)
+	MustSucceed(t, err)
+	v, err = l.GetOption(mangos.OptionWeight)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == 1)
+	MustSucceed(t, l.SetOption(mangos.OptionWeight, 2))
+	v, err = l.GetOption(mangos.OptionWeight)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == 2)
+
+	_, err = s.NewListener(AddrTestInp(), map[string]interface{}{
+		mangos.OptionWeight: -1,
+	})
+	MustBeTrue(t, err == mangos.ErrBadValue)
+}
+
+func TestLoadBalanceWeighted(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionLoadBalance, mangos.LoadBalanceWeighted))
+
+	var wg sync.WaitGroup
+	counts := make([]int, 2)
+	weights := []int{3, 1}
+	for i := range weights {
+		addr := AddrTestInp()
+		r, err := pull.NewSocket()
+		MustSucceed(t, err)
+		defer r.Close()
+		MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+		MustSucceed(t, r.Listen(addr))
+		MustSucceed(t, s.DialOptions(addr, map[string]interface{}{
+			mangos.OptionWeight: weights[i],
+		}))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				if _, err := r.Recv(); err != nil {
+					return
+				}
+				counts[i]++
+			}
+		}(i)
+	}
+	waitPipes(t, s, 2)
+
+	for i := 0; i < 400; i++ {
+		MustSucceed(t, s.Send([]byte{byte(i)}))
+	}
+	wg.Wait()
+	MustBeTrue(t, counts[0]+counts[1] == 400)
+	MustBeTrue(t, counts[0] > counts[1]*2)
+}
+
+func TestLoadBalanceLeastQueued(t *testing.T) {
+	fast, slow := AddrTestInp(), AddrTestInp()
+	var got [2]int
+	var lock sync.Mutex
+	for i, addr := range []string{fast, slow} {
+		r, err := rep.NewSocket()
+		MustSucceed(t, err)
+		defer r.Close()
+		MustSucceed(t, r.Listen(addr))
+		go func(i int, r mangos.Socket) {
+			for {
+				m, err := r.RecvMsg()
+				if err != nil {
+					return
+				}
+				lock.Lock()
+				got[i]++
+				lock.Unlock()
+				if i == 0 {
+					_ = r.SendMsg(m)
+				} else {
+					m.Free() // the slow server never answers
+				}
+			}
+		}(i, r)
+	}
+
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionLoadBalance, mangos.LoadBalanceLeastQueued))
+	MustSucceed(t, s.Dial(fast))
+	MustSucceed(t, s.Dial(slow))
+	waitPipes(t, s, 2)
+
+	for i := 0; i < 10; i++ {
+		c, err := s.OpenContext()
+		MustSucceed(t, err)
+		defer c.Close()
+		MustSucceed(t, c.Send([]byte("work")))
+		time.Sleep(time.Millisecond * 20)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	MustBeTrue(t, got[0]+got[1] == 10)
+	MustBeTrue(t, got[1] <= 1)
+}
+
+func TestLoadBalanceLatency(t *testing.T) {
+	var got [2]int
+	var delay [2]int64
+	var lock sync.Mutex
+	delay[1] = int64(time.Millisecond * 20)
+
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionLoadBalance, mangos.LoadBalanceLatency))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	for i := range got {
+		addr := AddrTestInp()
+		r, err := rep.NewSocket()
+		MustSucceed(t, err)
+		defer r.Close()
+		MustSucceed(t, r.Listen(addr))
+		MustSucceed(t, s.Dial(addr))
+		go func(i int, r mangos.Socket) {
+			for {
+				m, err := r.RecvMsg()
+				if err != nil {
+					return
+				}
+				lock.Lock()
+				got[i]++
+				lock.Unlock()
+				time.Sleep(time.Duration(atomic.LoadInt64(&delay[i])))
+				_ = r.SendMsg(m)
+			}
+		}(i, r)
+	}
+	waitPipes(t, s, 2)
+
+	count := func(n int) [2]int {
+		lock.Lock()
+		got = [2]int{}
+		lock.Unlock()
+		for i := 0; i < n; i++ {
+			MustSucceed(t, s.Send([]byte("work")))
+			_, err := s.Recv()
+			MustSucceed(t, err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return got
+	}
+
+	// The slow one is tried, and then only explored now and again.
+	n := count(64)
+	MustBeTrue(t, n[0] >= 56)
+	MustBeTrue(t, n[1] >= 2)
+
+	// When they trade places, the traffic follows.
+	atomic.StoreInt64(&delay[0], int64(time.Millisecond*20))
+	atomic.StoreInt64(&delay[1], 0)
+	count(64)
+	n = count(32)
+	MustBeTrue(t, n[1] >= 28)
+}
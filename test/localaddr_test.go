@@ -0,0 +1,125 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+)
+
+// freeLocalAddr returns a loopback address with a port not in use.
+func freeLocalAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	MustSucceed(t, err)
+	addr := l.Addr().String()
+	MustSucceed(t, l.Close())
+	return addr
+}
+
+// dialFrom dials addr with the given options, and returns the address
+// the listener sees the connection come from.
+func dialFrom(t *testing.T, addr string, lopts, dopts map[string]interface{}) net.Addr {
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.ListenOptions(addr, lopts))
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.DialOptions(addr, dopts))
+	MustSucceed(t, cli.Send([]byte("hello")))
+
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	defer m.Free()
+	info, ok := m.PipeInfo()
+	MustBeTrue(t, ok)
+	return info.RemoteAddr
+}
+
+func TestDialLocalAddrTCP(t *testing.T) {
+	local := freeLocalAddr(t)
+	from := dialFrom(t, AddrTestTCP(), nil, map[string]interface{}{
+		mangos.OptionDialLocalAddr: local,
+	})
+	MustBeTrue(t, from.String() == local)
+}
+
+func TestDialLocalAddrTLS(t *testing.T) {
+	vc := newVerifyCerts(t)
+	local := freeLocalAddr(t)
+	from := dialFrom(t, AddrTestTLS(), map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{vc.leaf(t, "server")},
+		},
+	}, map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{
+			RootCAs:    vc.pool,
+			ServerName: "127.0.0.1",
+		},
+		mangos.OptionDialLocalAddr: local,
+	})
+	MustBeTrue(t, from.String() == local)
+}
+
+func TestDialInterface(t *testing.T) {
+	ifcs, err := net.Interfaces()
+	MustSucceed(t, err)
+	name := ""
+	for _, ifc := range ifcs {
+		if ifc.Flags&net.FlagLoopback != 0 && ifc.Flags&net.FlagUp != 0 {
+			name = ifc.Name
+			break
+		}
+	}
+	if name == "" {
+		t.Skip("no loopback interface")
+	}
+	from := dialFrom(t, AddrTestTCP(), nil, map[string]interface{}{
+		mangos.OptionDialInterface: name,
+	})
+	MustBeTrue(t, from.(*net.TCPAddr).IP.IsLoopback())
+}
+
+func TestDialLocalAddrBad(t *testing.T) {
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+
+	for _, v := range []interface{}{"localhost", "127.0.0.1:port", "[::1", 5} {
+		err = sock.DialOptions(AddrTestTCP(), map[string]interface{}{
+			mangos.OptionDialLocalAddr: v,
+		})
+		MustBeTrue(t, err == mangos.ErrBadValue)
+	}
+	err = sock.DialOptions(AddrTestTCP(), map[string]interface{}{
+		mangos.OptionDialInterface: 5,
+	})
+	MustBeTrue(t, err == mangos.ErrBadValue)
+
+	// The interface is only looked up when dialing.
+	err = sock.DialOptions(AddrTestTCP(), map[string]interface{}{
+		mangos.OptionDialInterface: "no-such-interface",
+	})
+	MustFail(t, err)
+}
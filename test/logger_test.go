@@ -0,0 +1,169 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// testLogger collects log lines, for tests to look through.
+type testLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+// wait waits up to a second for a line containing s to be logged.
+func (l *testLogger) wait(s string) bool {
+	for i := 0; i < 100; i++ {
+		l.Lock()
+		for _, line := range l.lines {
+			if strings.Contains(line, s) {
+				l.Unlock()
+				return true
+			}
+		}
+		l.Unlock()
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
+func TestLoggerOption(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	v, err := s.GetOption(mangos.OptionLogger)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == nil)
+
+	l := &testLogger{}
+	MustSucceed(t, s.SetOption(mangos.OptionLogger, l))
+	v, err = s.GetOption(mangos.OptionLogger)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.Logger) == l)
+
+	MustBeTrue(t, s.SetOption(mangos.OptionLogger, "junk") == mangos.ErrBadValue)
+	MustSucceed(t, s.SetOption(mangos.OptionLogger, nil))
+
+	// It is common to all sockets, so strict checking allows it.
+	MustSucceed(t, s.SetOption(mangos.OptionStrict, true))
+	MustSucceed(t, s.SetOption(mangos.OptionLogger, l))
+}
+
+func TestLoggerDialFailure(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	l := &testLogger{}
+	MustSucceed(t, s.SetOption(mangos.OptionLogger, l))
+
+	// Nobody is listening here.
+	addr := AddrTestTCP()
+	MustSucceed(t, s.DialOptions(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	}))
+	MustBeTrue(t, l.wait("dial "+addr))
+}
+
+func TestLoggerRejected(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	l := &testLogger{}
+	MustSucceed(t, s1.SetOption(mangos.OptionLogger, l))
+	s1.SetAuthHook(func(mangos.Pipe) error {
+		return errors.New("go away")
+	})
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	MustBeTrue(t, l.wait("rejected: go away"))
+}
+
+func TestLoggerPipeFailed(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+
+	l := &testLogger{}
+	MustSucceed(t, s1.SetOption(mangos.OptionLogger, l))
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	for i := 0; s1.Stats().Pipes == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	MustBeTrue(t, s1.Stats().Pipes == 1)
+
+	// The peer going away is a failure from our side.
+	MustSucceed(t, s2.Close())
+	MustBeTrue(t, l.wait("failed"))
+
+	// But closing our own socket is not.
+	l.Lock()
+	l.lines = nil
+	l.Unlock()
+	MustSucceed(t, s1.Close())
+	MustBeFalse(t, l.wait("failed"))
+}
+
+func TestLoggerDropped(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	l := &testLogger{}
+	MustSucceed(t, s1.SetOption(mangos.OptionLogger, l))
+	MustSucceed(t, s1.SetOption(mangos.OptionWriteQLen, 1))
+	MustSucceed(t, s2.SetOption(mangos.OptionReadQLen, 1))
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	for i := 0; s1.Stats().Pipes == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	MustBeTrue(t, s1.Stats().Pipes == 1)
+
+	for i := 0; i < 20; i++ {
+		MustSucceed(t, s1.Send([]byte{byte(i)}))
+	}
+	MustBeTrue(t, l.wait("bus dropped message"))
+}
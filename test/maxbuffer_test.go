@@ -0,0 +1,125 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// waitBuffered waits for the socket's buffered bytes to settle at a
+// value satisfying ok.
+func waitBuffered(t *testing.T, s mangos.Socket, ok func(int64) bool) int64 {
+	for i := 0; i < 100; i++ {
+		if n := s.Stats().Buffered; ok(n) {
+			return n
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("buffered bytes stuck at %d", s.Stats().Buffered)
+	return 0
+}
+
+func TestMaxBufferBytesOption(t *testing.T) {
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionMaxBufferBytes)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+	MustSucceed(t, s.SetOption(mangos.OptionMaxBufferBytes, 1<<20))
+	v, err = s.GetOption(mangos.OptionMaxBufferBytes)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 1<<20)
+	MustFail(t, s.SetOption(mangos.OptionMaxBufferBytes, -1))
+	MustFail(t, s.SetOption(mangos.OptionMaxBufferBytes, "big"))
+}
+
+func TestMaxBufferBytesSend(t *testing.T) {
+	tx, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.SetOption(mangos.OptionMaxBufferBytes, 1000))
+	MustSucceed(t, tx.SetOption(mangos.OptionSendDeadline, time.Millisecond*50))
+
+	// With no peer, everything sent stays queued.  Tiny messages fit
+	// by the dozen...
+	for i := 0; i < 50; i++ {
+		MustSucceed(t, tx.Send(make([]byte, 10)))
+	}
+	MustBeTrue(t, tx.Stats().Buffered == 500)
+
+	// ... but a large one is let in only while there is room.
+	MustSucceed(t, tx.Send(make([]byte, 600)))
+	MustBeTrue(t, tx.Send(make([]byte, 600)) == mangos.ErrSendTimeout)
+	MustBeTrue(t, tx.Stats().Buffered == 1100)
+
+	addr := AddrTestTCP()
+	rx, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.Listen(addr))
+	MustSucceed(t, tx.Dial(addr))
+	for i := 0; i < 51; i++ {
+		_, err := rx.Recv()
+		MustSucceed(t, err)
+	}
+	waitBuffered(t, tx, func(n int64) bool { return n == 0 })
+	MustSucceed(t, tx.Send(make([]byte, 600)))
+}
+
+func TestMaxBufferBytesRecv(t *testing.T) {
+	addr := AddrTestTCP()
+	rx, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	MustSucceed(t, rx.SetOption(mangos.OptionMaxBufferBytes, 10000))
+	MustSucceed(t, rx.SetOption(mangos.OptionReadQLen, 100))
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.Listen(addr))
+
+	tx, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.Dial(addr))
+	waitPipes(t, rx, 1)
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		b := make([]byte, 4000)
+		b[0] = byte(i)
+		MustSucceed(t, tx.Send(b))
+	}
+
+	// Reading stops once the limit is reached, overshooting by no
+	// more than a message, although the queue has room for them all.
+	n := waitBuffered(t, rx, func(n int64) bool { return n >= 10000 })
+	time.Sleep(time.Millisecond * 50)
+	MustBeTrue(t, rx.Stats().Buffered == n)
+	MustBeTrue(t, n < 14000)
+
+	for i := 0; i < count; i++ {
+		b, err := rx.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, b[0] == byte(i))
+	}
+	MustBeTrue(t, rx.Stats().Buffered == 0)
+}
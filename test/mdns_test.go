@@ -0,0 +1,121 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/mdns"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// mdnsGroup returns a multicast group of its own for a test, skipping it
+// if multicast does not loop back on this host.
+func mdnsGroup(t *testing.T) string {
+	g := &net.UDPAddr{IP: net.IPv4(239, 255, 77, 3), Port: int(NextPort())}
+	r, err := net.ListenMulticastUDP("udp4", nil, g)
+	if err != nil {
+		t.Skipf("no multicast: %v", err)
+	}
+	defer r.Close()
+	s, err := net.DialUDP("udp4", nil, g)
+	if err != nil {
+		t.Skipf("no multicast: %v", err)
+	}
+	defer s.Close()
+	MustSucceed(t, r.SetReadDeadline(time.Now().Add(time.Second)))
+	for i := 0; i < 3; i++ {
+		_, _ = s.Write([]byte("probe"))
+	}
+	if _, _, err = r.ReadFromUDP(make([]byte, 16)); err != nil {
+		t.Skipf("no multicast loopback: %v", err)
+	}
+	g.Port = int(NextPort())
+	return g.String()
+}
+
+func mdnsPeer(t *testing.T, group, name string) (mangos.Socket, *mdns.Mesh) {
+	s, err := bus.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	l, err := s.NewListener(fmt.Sprintf("tcp://*:%d", NextPort()), nil)
+	MustSucceed(t, err)
+	MustSucceed(t, l.Listen())
+	m, err := mdns.Join(s, l, mdns.Config{
+		Instance: name,
+		Interval: time.Millisecond * 50,
+		Group:    group,
+	})
+	MustSucceed(t, err)
+	return s, m
+}
+
+func TestMDNSBusMesh(t *testing.T) {
+	group := mdnsGroup(t)
+	var socks []mangos.Socket
+	var meshes []*mdns.Mesh
+	for _, name := range []string{"alpha", "bravo", "charlie"} {
+		s, m := mdnsPeer(t, group, name)
+		defer s.Close()
+		defer m.Close()
+		socks = append(socks, s)
+		meshes = append(meshes, m)
+	}
+	for _, s := range socks {
+		waitPipes(t, s, 2)
+	}
+	peers := meshes[0].Peers()
+	sort.Strings(peers)
+	MustBeTrue(t, fmt.Sprint(peers) == "[bravo charlie]")
+
+	// Each gets just one copy of what the others send.
+	MustSucceed(t, socks[1].Send([]byte("hello")))
+	for _, i := range []int{0, 2} {
+		b, err := socks[i].Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "hello")
+	}
+	MustSucceed(t, socks[0].SetOption(mangos.OptionRecvDeadline, time.Millisecond*100))
+	_, err := socks[0].Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+
+	// One leaving is dropped by the others.
+	MustSucceed(t, meshes[1].Close())
+	MustBeTrue(t, meshes[1].Close() == mangos.ErrClosed)
+	waitPipes(t, socks[0], 1)
+	waitPipes(t, socks[2], 1)
+	waitPipes(t, socks[1], 0)
+	MustBeTrue(t, len(meshes[0].Peers()) == 1)
+}
+
+func TestMDNSBadConfig(t *testing.T) {
+	s, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	l, err := s.NewListener(fmt.Sprintf("tcp://*:%d", NextPort()), nil)
+	MustSucceed(t, err)
+	MustSucceed(t, l.Listen())
+
+	_, err = mdns.Join(s, l, mdns.Config{Instance: "a.b"})
+	MustBeTrue(t, err == mangos.ErrBadValue)
+	_, err = mdns.Join(s, l, mdns.Config{Group: "nowhere"})
+	MustBeTrue(t, err == mangos.ErrBadAddr)
+}
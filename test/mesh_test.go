@@ -0,0 +1,178 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/mesh"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func meshPeer(t *testing.T, self string, src mesh.Source) (mangos.Socket, *mesh.Mesh) {
+	s, err := bus.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	MustSucceed(t, s.SetOption(mangos.OptionMaxReconnectTime, time.Millisecond*50))
+	m, err := mesh.Join(s, mesh.Config{
+		Self:     self,
+		Source:   src,
+		Interval: time.Millisecond * 20,
+	})
+	MustSucceed(t, err)
+	return s, m
+}
+
+func meshOnce(t *testing.T, socks []mangos.Socket, from int) {
+	msg := fmt.Sprintf("from %d", from)
+	MustSucceed(t, socks[from].Send([]byte(msg)))
+	for i, s := range socks {
+		if i == from {
+			continue
+		}
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == msg)
+	}
+	for _, s := range socks {
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Millisecond*50))
+		_, err := s.Recv()
+		MustBeTrue(t, err == mangos.ErrRecvTimeout)
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	}
+}
+
+func TestMeshStatic(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, AddrTestTCP())
+	}
+	var socks []mangos.Socket
+	var meshes []*mesh.Mesh
+	for _, addr := range addrs {
+		s, m := meshPeer(t, addr, mesh.Static(addrs))
+		defer s.Close()
+		defer m.Close()
+		socks = append(socks, s)
+		meshes = append(meshes, m)
+	}
+	for _, s := range socks {
+		waitPipes(t, s, 2)
+	}
+	MustBeTrue(t, len(meshes[1].Peers()) == 2)
+	for i := range socks {
+		meshOnce(t, socks, i)
+	}
+
+	// A node that restarts is connected again.
+	MustSucceed(t, meshes[1].Close())
+	MustBeTrue(t, meshes[1].Close() == mangos.ErrClosed)
+	MustSucceed(t, socks[1].Close())
+	waitPipes(t, socks[0], 1)
+	waitPipes(t, socks[2], 1)
+
+	s, m := meshPeer(t, addrs[1], mesh.Static(addrs))
+	defer s.Close()
+	defer m.Close()
+	socks[1] = s
+	for _, s := range socks {
+		waitPipes(t, s, 2)
+	}
+	for i := range socks {
+		meshOnce(t, socks, i)
+	}
+}
+
+func TestMeshSource(t *testing.T) {
+	var lock sync.Mutex
+	var addrs []string
+	var fail error
+	src := mesh.SourceFunc(func() ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return addrs, fail
+	})
+	set := func(a []string, err error) {
+		lock.Lock()
+		addrs, fail = a, err
+		lock.Unlock()
+	}
+
+	all := []string{AddrTestInp(), AddrTestInp(), AddrTestInp()}
+	set(all[:2], nil)
+	var socks []mangos.Socket
+	var meshes []*mesh.Mesh
+	join := func(addr string) {
+		s, m := meshPeer(t, addr, src)
+		socks = append(socks, s)
+		meshes = append(meshes, m)
+	}
+	defer func() {
+		for i := range socks {
+			meshes[i].Close()
+			socks[i].Close()
+		}
+	}()
+	join(all[0])
+	join(all[1])
+	waitPipes(t, socks[0], 1)
+	waitPipes(t, socks[1], 1)
+	MustBeTrue(t, fmt.Sprint(meshes[0].Peers()) == fmt.Sprint(all[1:2]))
+
+	// A failing source keeps the peers it gave last.
+	set(nil, errors.New("registry down"))
+	MustBeTrue(t, meshes[0].Refresh() != nil)
+	MustBeTrue(t, len(meshes[0].Peers()) == 1)
+
+	// The third joins the mesh when the source knows it.
+	set(all, nil)
+	join(all[2])
+	for _, s := range socks {
+		waitPipes(t, s, 2)
+	}
+	meshOnce(t, socks, 2)
+
+	// And is dropped when it leaves.
+	set(all[:2], nil)
+	MustSucceed(t, meshes[2].Close())
+	waitPipes(t, socks[2], 0)
+	waitPipes(t, socks[0], 1)
+	waitPipes(t, socks[1], 1)
+	MustSucceed(t, meshes[1].Refresh())
+	MustBeTrue(t, len(meshes[1].Peers()) == 1)
+}
+
+func TestMeshBadConfig(t *testing.T) {
+	s, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	_, err = mesh.Join(s, mesh.Config{})
+	MustBeTrue(t, err == mangos.ErrBadAddr)
+	_, err = mesh.Join(s, mesh.Config{
+		Self: AddrTestInp(),
+		Source: mesh.SourceFunc(func() ([]string, error) {
+			return nil, mangos.ErrBadValue
+		}),
+	})
+	MustBeTrue(t, err == mangos.ErrBadValue)
+}
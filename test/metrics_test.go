@@ -0,0 +1,112 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/metrics"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func gatherMetrics(t *testing.T, reg *prometheus.Registry) map[string][]*dto.Metric {
+	mfs, err := reg.Gather()
+	MustSucceed(t, err)
+	m := make(map[string][]*dto.Metric)
+	for _, mf := range mfs {
+		m[mf.GetName()] = mf.GetMetric()
+	}
+	return m
+}
+
+func metricLabel(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestMetricsCollector(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	for i := 0; i < 3; i++ {
+		MustSucceed(t, s1.Send([]byte("hello")))
+		_, err = s2.Recv()
+		MustSucceed(t, err)
+	}
+
+	reg := prometheus.NewRegistry()
+	MustSucceed(t, reg.Register(metrics.NewCollector(s1, "one")))
+	MustSucceed(t, reg.Register(metrics.NewCollector(s2, "two")))
+
+	m := gatherMetrics(t, reg)
+	sent := m["mangos_messages_sent_total"]
+	MustBeTrue(t, len(sent) == 2)
+	for _, v := range sent {
+		MustBeTrue(t, metricLabel(v, "protocol") == "pair")
+		switch metricLabel(v, "socket") {
+		case "one":
+			MustBeTrue(t, v.GetCounter().GetValue() == 3)
+		case "two":
+			MustBeTrue(t, v.GetCounter().GetValue() == 0)
+		default:
+			t.Errorf("bad socket label")
+		}
+	}
+	for _, v := range m["mangos_messages_received_total"] {
+		if metricLabel(v, "socket") == "two" {
+			MustBeTrue(t, v.GetCounter().GetValue() == 3)
+		}
+	}
+	for _, v := range m["mangos_pipes"] {
+		MustBeTrue(t, v.GetGauge().GetValue() == 1)
+	}
+	MustBeTrue(t, len(m["mangos_listeners"]) == 2)
+	MustBeTrue(t, len(m["mangos_reconnects_total"]) == 2)
+	MustBeTrue(t, len(m["mangos_queued_messages"]) == 2)
+
+	// The same name may not be registered twice.
+	MustFail(t, reg.Register(metrics.NewCollector(s1, "one")))
+}
+
+func TestMetricsProtocol(t *testing.T) {
+	s, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	reg := prometheus.NewRegistry()
+	MustSucceed(t, reg.Register(metrics.NewCollector(s, "bus")))
+	m := gatherMetrics(t, reg)
+	ev := m["mangos_protocol_events_total"]
+	MustBeTrue(t, len(ev) == 1)
+	MustBeTrue(t, metricLabel(ev[0], "counter") == mangos.StatEchoSuppressed)
+}
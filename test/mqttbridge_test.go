@@ -0,0 +1,270 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/bridge/mqtt"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// mqttBroker is just enough of an MQTT broker to test the bridge.
+type mqttBroker struct {
+	t *testing.T
+	l net.Listener
+	sync.Mutex
+	conns      map[net.Conn][]string // subscriptions
+	published  []string              // topic, payload and QoS
+	subscribes int
+	acks       int
+}
+
+func newMqttBroker(t *testing.T) *mqttBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	MustSucceed(t, err)
+	b := &mqttBroker{t: t, l: l, conns: make(map[net.Conn][]string)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *mqttBroker) addr() string {
+	return "tcp://" + b.l.Addr().String()
+}
+
+// drop closes the connections, as if the broker restarted.
+func (b *mqttBroker) drop() {
+	b.Lock()
+	defer b.Unlock()
+	for c := range b.conns {
+		c.Close()
+	}
+}
+
+func (b *mqttBroker) count(n *int) int {
+	b.Lock()
+	defer b.Unlock()
+	return *n
+}
+
+func (b *mqttBroker) send(c net.Conn, kind byte, body []byte) {
+	hdr := []byte{kind, byte(len(body))}
+	c.Write(append(hdr, body...))
+}
+
+// mqttMatch matches a topic against a filter, with wildcards.
+func mqttMatch(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	n := strings.Split(topic, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(n) || (f[i] != "+" && f[i] != n[i]) {
+			return false
+		}
+	}
+	return len(f) == len(n)
+}
+
+func (b *mqttBroker) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		hdr, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		body := make([]byte, n)
+		if _, err = io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch hdr >> 4 {
+		case 1: // CONNECT
+			b.Lock()
+			b.conns[c] = nil
+			b.Unlock()
+			b.send(c, 0x20, []byte{0, 0})
+		case 8: // SUBSCRIBE
+			id, rest := body[:2], body[2:]
+			codes := []byte{}
+			b.Lock()
+			for len(rest) > 0 {
+				l := int(binary.BigEndian.Uint16(rest))
+				b.conns[c] = append(b.conns[c], string(rest[2:2+l]))
+				codes = append(codes, rest[2+l])
+				rest = rest[3+l:]
+			}
+			b.subscribes++
+			b.Unlock()
+			b.send(c, 0x90, append(id, codes...))
+		case 3: // PUBLISH
+			l := int(binary.BigEndian.Uint16(body))
+			topic, rest := string(body[2:2+l]), body[2+l:]
+			qos := (hdr >> 1) & 3
+			if qos > 0 {
+				b.send(c, 0x40, rest[:2])
+				rest = rest[2:]
+			}
+			b.Lock()
+			b.published = append(b.published,
+				topic+" "+string(rest)+" "+string('0'+qos))
+			for peer, filters := range b.conns {
+				for _, f := range filters {
+					if mqttMatch(f, topic) {
+						msg := append([]byte{0, byte(l)}, topic...)
+						msg = append(msg, 0, 9) // packet id
+						b.send(peer, 0x32, append(msg, rest...))
+						break
+					}
+				}
+			}
+			b.Unlock()
+		case 4: // PUBACK
+			b.Lock()
+			b.acks++
+			b.Unlock()
+		case 12: // PINGREQ
+			b.send(c, 0xd0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func waitCount(t *testing.T, b *mqttBroker, n *int, want int) {
+	for i := 0; i < 100 && b.count(n) < want; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	MustBeTrue(t, b.count(n) >= want)
+}
+
+func TestMqttBridge(t *testing.T) {
+	broker := newMqttBroker(t)
+	defer broker.l.Close()
+	srcAddr := AddrTestInp()
+	dstAddr := AddrTestInp()
+
+	src, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer src.Close()
+	MustSucceed(t, src.Listen(srcAddr))
+	up, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer up.Close()
+	MustSucceed(t, up.Dial(srcAddr))
+
+	down, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer down.Close()
+	MustSucceed(t, down.Listen(dstAddr))
+	dst, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer dst.Close()
+	MustSucceed(t, dst.SetOption(mangos.OptionSubscribe, "sp/"))
+	MustSucceed(t, dst.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, dst.Dial(dstAddr))
+
+	b, err := mqtt.Dial(mqtt.Config{
+		Broker:     broker.addr(),
+		ClientID:   "bridge",
+		QoS:        1,
+		SPPrefix:   "sp/",
+		MQTTPrefix: "site/",
+		Separator:  ' ',
+
+		ReconnectTime: time.Millisecond * 10,
+	}, up, down)
+	MustSucceed(t, err)
+	defer b.Close()
+	waitCount(t, broker, &broker.subscribes, 1)
+	waitPipes(t, src, 1)
+	waitPipes(t, down, 1)
+
+	// Out to the broker, and back again.
+	for _, m := range []string{"sp/temp 21", "other/temp 5", "sp/hum 50"} {
+		MustSucceed(t, src.Send([]byte(m)))
+	}
+	for _, want := range []string{"sp/temp 21", "sp/hum 50"} {
+		m, err := dst.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(m) == want)
+	}
+	waitCount(t, broker, &broker.acks, 2)
+	broker.Lock()
+	MustBeTrue(t, strings.Join(broker.published, ",") ==
+		"site/temp 21 1,site/hum 50 1")
+	broker.Unlock()
+
+	// The bridge reconnects, and subscribes again.
+	broker.drop()
+	waitCount(t, broker, &broker.subscribes, 2)
+	MustSucceed(t, src.Send([]byte("sp/temp 22")))
+	m, err := dst.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "sp/temp 22")
+
+	MustSucceed(t, b.Close())
+	MustBeTrue(t, b.Close() == mangos.ErrClosed)
+}
+
+func TestMqttBridgeBad(t *testing.T) {
+	broker := newMqttBroker(t)
+	defer broker.l.Close()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	cfg := mqtt.Config{Broker: broker.addr()}
+	_, err = mqtt.Dial(cfg, p, nil)
+	MustBeTrue(t, err == mangos.ErrBadProto)
+	_, err = mqtt.Dial(cfg, nil, s)
+	MustBeTrue(t, err == mangos.ErrBadProto)
+	_, err = mqtt.Dial(mqtt.Config{Broker: broker.addr(), QoS: 2}, nil, p)
+	MustBeTrue(t, err == mangos.ErrBadValue)
+	_, err = mqtt.Dial(mqtt.Config{Broker: "mqtt://nowhere"}, nil, p)
+	MustBeTrue(t, err == mangos.ErrBadTran)
+
+	// Publishing only, at QoS 0.
+	b, err := mqtt.Dial(cfg, nil, p)
+	MustSucceed(t, err)
+	MustSucceed(t, b.Close())
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func hookPair(t *testing.T) (mangos.Socket, mangos.Socket) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+	return s1, s2
+}
+
+// xor is a toy cipher, its own inverse.
+func xor(m *mangos.Message) (*mangos.Message, error) {
+	for i := range m.Body {
+		m.Body[i] ^= 0x5a
+	}
+	return m, nil
+}
+
+func TestMsgHookOrder(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	tag := func(b byte) mangos.MessageHook {
+		return func(m *mangos.Message) (*mangos.Message, error) {
+			m.Body = append(m.Body, b)
+			return m, nil
+		}
+	}
+	s1.AddSendHook(tag('a'))
+	s1.AddSendHook(tag('b'))
+	s2.AddRecvHook(tag('c'))
+	s2.AddRecvHook(tag('d'))
+
+	MustSucceed(t, s1.Send([]byte("x")))
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "xabcd")
+}
+
+func TestMsgHookTransform(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	var wire []byte
+	s1.AddSendHook(xor)
+	s2.AddRecvHook(func(m *mangos.Message) (*mangos.Message, error) {
+		wire = append([]byte{}, m.Body...)
+		return m, nil
+	})
+	s2.AddRecvHook(xor)
+
+	MustSucceed(t, s1.Send([]byte("secret")))
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "secret")
+	MustBeFalse(t, bytes.Equal(wire, b))
+}
+
+func TestMsgHookReplace(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	s1.AddSendHook(func(m *mangos.Message) (*mangos.Message, error) {
+		n := mangos.NewMessage(0)
+		n.Body = append(n.Body, "replaced"...)
+		m.Free()
+		return n, nil
+	})
+	MustSucceed(t, s1.Send([]byte("original")))
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "replaced")
+}
+
+func TestMsgHookDropAndFail(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	errInvalid := errors.New("invalid message")
+	s1.AddSendHook(func(m *mangos.Message) (*mangos.Message, error) {
+		switch string(m.Body) {
+		case "bad":
+			return nil, errInvalid
+		case "skip":
+			m.Free()
+			return nil, nil
+		}
+		return m, nil
+	})
+	s2.AddRecvHook(func(m *mangos.Message) (*mangos.Message, error) {
+		if string(m.Body) == "quiet" {
+			m.Free()
+			return nil, nil
+		}
+		return m, nil
+	})
+
+	MustBeTrue(t, s1.Send([]byte("bad")) == errInvalid)
+	MustSucceed(t, s1.Send([]byte("skip")))
+	MustSucceed(t, s1.Send([]byte("quiet")))
+	MustSucceed(t, s1.Send([]byte("good")))
+
+	// Only the last gets through; the others were dropped on the way.
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "good")
+	MustBeTrue(t, s1.Stats().Sent == 2)
+	MustBeTrue(t, s2.Stats().Received == 1)
+	MustBeTrue(t, s1.Stats().HookDropped == 1)
+	MustBeTrue(t, s2.Stats().HookDropped == 1)
+
+	s2.AddRecvHook(func(m *mangos.Message) (*mangos.Message, error) {
+		return nil, errInvalid
+	})
+	MustSucceed(t, s1.Send([]byte("again")))
+	_, err = s2.Recv()
+	MustBeTrue(t, err == errInvalid)
+}
+
+func TestMsgHookContext(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+
+	srv.AddRecvHook(xor)
+	srv.AddSendHook(xor)
+	cli.AddSendHook(xor)
+	cli.AddRecvHook(xor)
+
+	cc, err := cli.OpenContext()
+	MustSucceed(t, err)
+	sc, err := srv.OpenContext()
+	MustSucceed(t, err)
+	MustSucceed(t, sc.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cc.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	MustSucceed(t, cc.Send([]byte("ping")))
+	b, err := sc.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+	MustSucceed(t, sc.Send([]byte("pong")))
+	b, err = cc.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "pong")
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+func poolStats(size int) mangos.MessagePoolStats {
+	for _, st := range mangos.MessagePoolStatistics() {
+		if st.Size == size {
+			return st
+		}
+	}
+	return mangos.MessagePoolStats{}
+}
+
+func TestMessagePoolStats(t *testing.T) {
+	before := poolStats(1024)
+	for i := 0; i < 10; i++ {
+		m := mangos.NewMessage(1000)
+		MustBeTrue(t, cap(m.Body) >= 1000)
+		m.Free()
+	}
+	// The statistics are for the whole process, so goroutines left by
+	// other tests may add to them meanwhile; only lower bounds hold.
+	after := poolStats(1024)
+	MustBeTrue(t, after.Hits+after.Misses >= before.Hits+before.Misses+10)
+	MustBeTrue(t, after.Frees >= before.Frees+10)
+
+	big := poolStats(0)
+	m := mangos.NewMessage(1 << 20)
+	m.Free()
+	MustBeTrue(t, poolStats(0).Misses >= big.Misses+1)
+}
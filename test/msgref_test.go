@@ -0,0 +1,145 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestMsgRetain(t *testing.T) {
+	a := mangos.NewBufferAccount()
+	m := mangos.NewMessage(64)
+	m.Body = append(m.Body, "shared"...)
+	m.Charge(a)
+	released := 0
+	m.SetRelease(func() { released++ })
+	MustBeFalse(t, m.Shared())
+
+	MustBeTrue(t, m.Retain() == m)
+	MustBeTrue(t, m.Retain() == m)
+	MustBeTrue(t, m.Shared())
+
+	// The charge and release go with the last reference.
+	m.Free()
+	m.Free()
+	MustBeFalse(t, m.Shared())
+	MustBeTrue(t, released == 0)
+	MustBeTrue(t, a.Used() == int64(len(m.Body)))
+	MustBeTrue(t, string(m.Body) == "shared")
+	m.Free()
+	MustBeTrue(t, released == 1)
+	MustBeTrue(t, a.Used() == 0)
+
+	// A duplicate is never shared.
+	m = mangos.NewMessage(0)
+	m.Retain()
+	d := m.Dup()
+	MustBeFalse(t, d.Shared())
+	d.Free()
+	m.Free()
+	m.Free()
+}
+
+func TestMsgShareFiles(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	MustSucceed(t, err)
+	m := mangos.NewMessage(0)
+	m.Files = []*os.File{f}
+
+	// Each pipe needs files of its own, so these are copied.
+	d := protocol.ShareMessage(m)
+	MustBeTrue(t, d != m)
+	MustBeFalse(t, m.Shared())
+	MustBeTrue(t, len(d.Files) == 1 && d.Files[0] != f)
+	d.Free()
+	m.Free()
+
+	m = mangos.NewMessage(0)
+	MustBeTrue(t, protocol.ShareMessage(m) == m)
+	MustBeTrue(t, m.Shared())
+	m.Free()
+	m.Free()
+}
+
+func TestMsgShareFanOut(t *testing.T) {
+	addr := AddrTestTCP()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.Listen(addr))
+
+	const nsubs = 8
+	const nmsgs = 50
+	var subs []mangos.Socket
+	for i := 0; i < nsubs; i++ {
+		s, err := sub.NewSocket()
+		MustSucceed(t, err)
+		defer s.Close()
+		MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte{}))
+		MustSucceed(t, s.SetOption(mangos.OptionReadQLen, nmsgs))
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+		MustSucceed(t, s.Dial(addr))
+		subs = append(subs, s)
+	}
+	waitPipes(t, p, nsubs)
+
+	body := bytes.Repeat([]byte("fan-out "), 512)
+	for i := 0; i < nmsgs; i++ {
+		MustSucceed(t, p.Send(append(body, byte(i))))
+	}
+	for _, s := range subs {
+		for i := 0; i < nmsgs; i++ {
+			b, err := s.Recv()
+			MustSucceed(t, err)
+			MustBeTrue(t, bytes.Equal(b, append(body, byte(i))))
+		}
+	}
+}
+
+func TestMsgShareBus(t *testing.T) {
+	addr := AddrTestTCP()
+	hub, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer hub.Close()
+	MustSucceed(t, hub.Listen(addr))
+
+	var peers []mangos.Socket
+	for i := 0; i < 4; i++ {
+		s, err := bus.NewSocket()
+		MustSucceed(t, err)
+		defer s.Close()
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+		MustSucceed(t, s.Dial(addr))
+		peers = append(peers, s)
+	}
+	waitPipes(t, hub, len(peers))
+
+	MustSucceed(t, hub.Send([]byte("everyone")))
+	for _, s := range peers {
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "everyone")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestListenMulti(t *testing.T) {
+	addrs := []string{AddrTestTCP(), AddrTestIPC(), "inproc://multilisten"}
+
+	srv, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addrs[0]+", "+addrs[1]+","+addrs[2]))
+	MustBeTrue(t, srv.Stats().Listeners == 3)
+
+	for _, addr := range addrs {
+		cli, err := push.NewSocket()
+		MustSucceed(t, err)
+		MustSucceed(t, cli.Dial(addr))
+		MustSucceed(t, cli.Send([]byte(addr)))
+		b, err := srv.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == addr)
+		cli.Close()
+	}
+}
+
+func TestListenMultiFail(t *testing.T) {
+	busy, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer busy.Close()
+	MustSucceed(t, busy.Listen("inproc://multilistenbusy"))
+
+	srv, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	good := "inproc://multilistengood"
+	err = srv.Listen(good + ",inproc://multilistenbusy,bogus://x")
+	MustFail(t, err)
+	errs, ok := err.(mangos.AddrErrors)
+	MustBeTrue(t, ok)
+	MustBeTrue(t, len(errs) == 2)
+	MustBeTrue(t, errs[0].Addr == "inproc://multilistenbusy")
+	MustBeTrue(t, errs[0].Err == mangos.ErrAddrInUse)
+	MustBeTrue(t, errs[1].Addr == "bogus://x")
+	MustBeTrue(t, errs[1].Err == mangos.ErrBadTran)
+
+	// Nothing was left listening, so the good address is free again.
+	MustBeTrue(t, srv.Stats().Listeners == 0)
+	MustSucceed(t, busy.Listen(good))
+}
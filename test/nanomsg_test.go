@@ -0,0 +1,143 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2/nanomsg"
+)
+
+func TestNanomsgReqRep(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := nanomsg.NewSocket(nanomsg.AF_SP, nanomsg.REP)
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := nanomsg.NewSocket(nanomsg.AF_SP, nanomsg.REQ)
+	MustSucceed(t, err)
+	defer cli.Close()
+
+	_, err = srv.Bind(addr)
+	MustSucceed(t, err)
+	ep, err := cli.Connect(addr)
+	MustSucceed(t, err)
+	MustBeTrue(t, ep.Address == addr)
+	MustSucceed(t, srv.SetSockOptInt(nanomsg.SOL_SOCKET, nanomsg.NN_RCVTIMEO, 1000))
+	MustSucceed(t, cli.SetRecvTimeout(time.Second))
+
+	n, err := cli.Send([]byte("ping"), 0)
+	MustSucceed(t, err)
+	MustBeTrue(t, n == 4)
+	b, err := srv.Recv(0)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+	_, err = srv.Send([]byte("pong"), 0)
+	MustSucceed(t, err)
+	b, err = cli.Recv(0)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "pong")
+
+	MustSucceed(t, cli.Shutdown(ep))
+	MustBeTrue(t, cli.Shutdown(ep) == syscall.EINVAL)
+}
+
+func TestNanomsgErrors(t *testing.T) {
+	_, err := nanomsg.NewSocket(nanomsg.AF_SP, nanomsg.Protocol(7))
+	MustBeTrue(t, err == syscall.EPROTONOSUPPORT)
+	_, err = nanomsg.NewSocket(nanomsg.Domain(9), nanomsg.PAIR)
+	MustBeTrue(t, err == syscall.EAFNOSUPPORT)
+
+	s, err := nanomsg.NewSocket(nanomsg.AF_SP, nanomsg.PULL)
+	MustSucceed(t, err)
+	_, err = s.Recv(nanomsg.DontWait)
+	MustBeTrue(t, err == syscall.EAGAIN)
+	MustSucceed(t, s.SetSockOptInt(nanomsg.SOL_SOCKET, nanomsg.NN_RCVTIMEO, 10))
+	_, err = s.Recv(0)
+	MustBeTrue(t, err == syscall.ETIMEDOUT)
+	_, err = s.Bind("bogus://nowhere")
+	MustBeTrue(t, err == syscall.EPROTONOSUPPORT)
+	MustBeTrue(t, s.SetSockOptInt(99, 99, 1) == syscall.ENOPROTOOPT)
+	MustSucceed(t, s.Close())
+	MustBeTrue(t, s.Close() == syscall.EBADF)
+}
+
+func TestNanomsgOptions(t *testing.T) {
+	s, err := nanomsg.NewSocket(nanomsg.AF_SP_RAW, nanomsg.REQ)
+	MustSucceed(t, err)
+	defer s.Close()
+
+	check := func(level, option, value int) {
+		MustSucceed(t, s.SetSockOptInt(level, option, value))
+		v, err := s.GetSockOptInt(level, option)
+		MustSucceed(t, err)
+		MustBeTrue(t, v == value)
+	}
+	check(nanomsg.SOL_SOCKET, nanomsg.NN_SNDTIMEO, 250)
+	check(nanomsg.SOL_SOCKET, nanomsg.NN_SNDTIMEO, -1)
+	check(nanomsg.SOL_SOCKET, nanomsg.NN_LINGER, 500)
+	check(nanomsg.SOL_SOCKET, nanomsg.NN_RECONNECT_IVL, 50)
+	check(nanomsg.SOL_SOCKET, nanomsg.NN_RCVMAXSIZE, 4096)
+	check(nanomsg.SOL_SOCKET, nanomsg.NN_RCVMAXSIZE, -1)
+
+	v, err := s.GetSockOptInt(nanomsg.SOL_SOCKET, nanomsg.NN_DOMAIN)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == int(nanomsg.AF_SP_RAW))
+	v, err = s.GetSockOptInt(nanomsg.SOL_SOCKET, nanomsg.NN_PROTOCOL)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == int(nanomsg.REQ))
+	MustBeTrue(t, s.SetSockOptInt(nanomsg.SOL_SOCKET, nanomsg.NN_LINGER, -5) ==
+		syscall.EINVAL)
+
+	d, err := s.Linger()
+	MustSucceed(t, err)
+	MustBeTrue(t, d == time.Millisecond*500)
+
+	c, err := nanomsg.NewSocket(nanomsg.AF_SP, nanomsg.REQ)
+	MustSucceed(t, err)
+	defer c.Close()
+	v, err = c.GetSockOptInt(int(nanomsg.REQ), nanomsg.NN_REQ_RESEND_IVL)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == 60000)
+}
+
+func TestNanomsgPubSub(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := nanomsg.NewSocket(nanomsg.AF_SP, nanomsg.PUB)
+	MustSucceed(t, err)
+	defer p.Close()
+	s, err := nanomsg.NewSocket(nanomsg.AF_SP, nanomsg.SUB)
+	MustSucceed(t, err)
+	defer s.Close()
+
+	_, err = p.Bind(addr)
+	MustSucceed(t, err)
+	_, err = s.Connect(addr)
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetSockOptString(int(nanomsg.SUB), nanomsg.NN_SUB_SUBSCRIBE, "yes"))
+	MustSucceed(t, s.SetRecvTimeout(time.Millisecond*200))
+	waitPipes(t, p.Mangos(), 1)
+
+	_, err = p.Send([]byte("no thanks"), 0)
+	MustSucceed(t, err)
+	_, err = p.Send([]byte("yes please"), 0)
+	MustSucceed(t, err)
+	b, err := s.Recv(0)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "yes please")
+	_, err = s.Recv(0)
+	MustBeTrue(t, err == syscall.ETIMEDOUT)
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/compat/netshim"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestNetShimHTTP(t *testing.T) {
+	addr := AddrTestTCP()
+	l, err := netshim.Listen(addr)
+	MustSucceed(t, err)
+	defer l.Close()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("got "), b...))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	cli := &http.Client{Transport: &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return netshim.Dial(addr)
+		},
+	}}
+	for i := 0; i < 3; i++ {
+		resp, err := cli.Post("http://shim/", "text/plain", bytes.NewReader([]byte("hello")))
+		MustSucceed(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		MustSucceed(t, err)
+		resp.Body.Close()
+		MustBeTrue(t, string(b) == "got hello")
+	}
+}
+
+func TestNetShimConn(t *testing.T) {
+	addr := AddrTestInp()
+	l, err := netshim.Listen(addr)
+	MustSucceed(t, err)
+	defer l.Close()
+	MustBeTrue(t, l.Addr().String() == addr)
+
+	c1, err := netshim.Dial(addr)
+	MustSucceed(t, err)
+	c2, err := l.Accept()
+	MustSucceed(t, err)
+
+	// Large writes are carried in several messages.
+	data := make([]byte, 300*1024)
+	rand.Read(data)
+	go func() {
+		_, err := c1.Write(data)
+		MustSucceed(t, err)
+		MustSucceed(t, c1.Close())
+	}()
+	got, err := ioutil.ReadAll(c2)
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(got, data))
+
+	_, err = c1.Write([]byte("late"))
+	MustBeTrue(t, err == net.ErrClosed)
+	MustSucceed(t, c2.Close())
+	MustBeTrue(t, c2.Close() == net.ErrClosed)
+}
+
+func TestNetShimDeadline(t *testing.T) {
+	addr := AddrTestInp()
+	l, err := netshim.Listen(addr)
+	MustSucceed(t, err)
+	defer l.Close()
+	c1, err := netshim.Dial(addr)
+	MustSucceed(t, err)
+	defer c1.Close()
+	c2, err := l.Accept()
+	MustSucceed(t, err)
+	defer c2.Close()
+
+	MustSucceed(t, c2.SetReadDeadline(time.Now().Add(time.Millisecond*20)))
+	_, err = c2.Read(make([]byte, 10))
+	MustFail(t, err)
+	ne, ok := err.(net.Error)
+	MustBeTrue(t, ok && ne.Timeout())
+
+	// A deadline in the past unblocks a waiting Read at once.
+	MustSucceed(t, c2.SetReadDeadline(time.Time{}))
+	done := make(chan error)
+	go func() {
+		_, err := c2.Read(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	MustSucceed(t, c2.SetReadDeadline(time.Now()))
+	select {
+	case err = <-done:
+		MustFail(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("Read not interrupted")
+	}
+
+	// Clearing it lets data through again.
+	MustSucceed(t, c2.SetReadDeadline(time.Time{}))
+	_, err = c1.Write([]byte("ok"))
+	MustSucceed(t, err)
+	b := make([]byte, 2)
+	_, err = io.ReadFull(c2, b)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ok")
+}
+
+func TestNetShimPairPeer(t *testing.T) {
+	addr := AddrTestInp()
+	l, err := netshim.Listen(addr)
+	MustSucceed(t, err)
+	defer l.Close()
+
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.Dial(addr))
+	c, err := l.Accept()
+	MustSucceed(t, err)
+	defer c.Close()
+
+	MustSucceed(t, s.Send([]byte("abc")))
+	MustSucceed(t, s.Send([]byte("def")))
+	b := make([]byte, 6)
+	_, err = io.ReadFull(c, b)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "abcdef")
+
+	_, err = c.Write([]byte("xyz"))
+	MustSucceed(t, err)
+	m, err := s.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "xyz")
+}
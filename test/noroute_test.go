@@ -0,0 +1,134 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// orphanReply sets up a REP socket holding a request whose requester
+// has gone away, and returns the reply to send.
+func orphanReply(t *testing.T, s mangos.Socket) *mangos.Message {
+	addr := AddrTestInp()
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.Listen(addr))
+
+	c, err := req.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, c.Dial(addr))
+	MustSucceed(t, c.Send([]byte("ping")))
+	m, err := s.RecvMsg()
+	MustSucceed(t, err)
+	MustSucceed(t, c.Close())
+	waitPipes(t, s, 0)
+
+	m.Body = append(m.Body[:0], []byte("pong")...)
+	return m
+}
+
+func TestNoRouteOptions(t *testing.T) {
+	for _, f := range []func() (mangos.Socket, error){rep.NewSocket, xrep.NewSocket} {
+		s, err := f()
+		MustSucceed(t, err)
+		defer s.Close()
+
+		v, err := s.GetOption(mangos.OptionNoRoute)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(mangos.NoRoute) == mangos.NoRouteDrop)
+		MustFail(t, s.SetOption(mangos.OptionNoRoute, 1))
+		MustFail(t, s.SetOption(mangos.OptionNoRoute, mangos.NoRoute(7)))
+		MustSucceed(t, s.SetOption(mangos.OptionNoRoute, mangos.NoRouteError))
+		v, err = s.GetOption(mangos.OptionNoRoute)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(mangos.NoRoute) == mangos.NoRouteError)
+
+		MustSucceed(t, s.SetOption(mangos.OptionDeadLetter, func(m *mangos.Message) { m.Free() }))
+		MustSucceed(t, s.SetOption(mangos.OptionDeadLetter, nil))
+		MustFail(t, s.SetOption(mangos.OptionDeadLetter, "nowhere"))
+	}
+}
+
+func TestNoRouteDrop(t *testing.T) {
+	s, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	l := &testLogger{}
+	MustSucceed(t, s.SetOption(mangos.OptionLogger, l))
+
+	m := orphanReply(t, s)
+	MustSucceed(t, s.SendMsg(m))
+	MustBeTrue(t, s.Stats().Dropped == 1)
+	MustBeTrue(t, l.wait("rep dropped reply with no route"))
+}
+
+func TestNoRouteError(t *testing.T) {
+	s, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionNoRoute, mangos.NoRouteError))
+
+	m := orphanReply(t, s)
+	err = s.SendMsg(m)
+	MustBeTrue(t, errors.Is(err, mangos.ErrNoRoute))
+	MustBeTrue(t, string(m.Body) == "pong")
+	m.Free()
+	MustBeTrue(t, s.Stats().Dropped == 0)
+}
+
+func TestNoRouteDeadLetter(t *testing.T) {
+	s, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	dead := make(chan *mangos.Message, 1)
+	MustSucceed(t, s.SetOption(mangos.OptionNoRoute, mangos.NoRouteDeadLetter))
+	MustSucceed(t, s.SetOption(mangos.OptionDeadLetter, mangos.DeadLetterFunc(func(m *mangos.Message) {
+		dead <- m
+	})))
+
+	m := orphanReply(t, s)
+	MustSucceed(t, s.SendMsg(m))
+	select {
+	case m = <-dead:
+		MustBeTrue(t, string(m.Body) == "pong")
+		m.Free()
+	case <-time.After(time.Second):
+		t.Fatal("no dead letter")
+	}
+	MustBeTrue(t, s.Stats().Dropped == 0)
+}
+
+func TestNoRouteRaw(t *testing.T) {
+	s, err := xrep.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionNoRoute, mangos.NoRouteError))
+
+	m := orphanReply(t, s)
+	hdr := append([]byte{}, m.Header...)
+	err = s.SendMsg(m)
+	MustBeTrue(t, errors.Is(err, mangos.ErrNoRoute))
+	MustBeTrue(t, string(m.Header) == string(hdr))
+
+	MustSucceed(t, s.SetOption(mangos.OptionNoRoute, mangos.NoRouteDrop))
+	MustSucceed(t, s.SendMsg(m))
+	MustBeTrue(t, s.Stats().Dropped == 1)
+}
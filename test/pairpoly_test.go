@@ -0,0 +1,147 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/xpair"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestPairPolyOption(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionPolyamorous)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == false)
+	MustBeTrue(t, errors.Is(s.SetOption(mangos.OptionPolyamorous, 1),
+		mangos.ErrBadValue))
+	MustSucceed(t, s.SetOption(mangos.OptionPolyamorous, true))
+	v, err = s.GetOption(mangos.OptionPolyamorous)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == true)
+
+	x, err := xpair.NewSocket()
+	MustSucceed(t, err)
+	defer x.Close()
+	MustSucceed(t, x.SetOption(mangos.OptionPolyamorous, true))
+
+	// With no peer there is nowhere to send.
+	MustBeTrue(t, errors.Is(s.Send([]byte("nobody")), mangos.ErrNoRoute))
+}
+
+func TestPairPolyMonogamous(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.Listen(addr))
+
+	c1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer c1.Close()
+	MustSucceed(t, c1.Dial(addr))
+	waitPipes(t, s, 1)
+
+	// A second peer is refused by default.
+	c2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer c2.Close()
+	MustSucceed(t, c2.Dial(addr))
+	time.Sleep(time.Millisecond * 50)
+	MustBeTrue(t, s.Stats().Pipes == 1)
+
+	// Nor may the option be changed now.
+	MustBeTrue(t, errors.Is(s.SetOption(mangos.OptionPolyamorous, true),
+		mangos.ErrProtoState))
+}
+
+func TestPairPolyLastActive(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionPolyamorous, true))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.Listen(addr))
+
+	var peers []mangos.Socket
+	for i := 0; i < 3; i++ {
+		c, err := pair.NewSocket()
+		MustSucceed(t, err)
+		defer c.Close()
+		MustSucceed(t, c.SetOption(mangos.OptionRecvDeadline, time.Second))
+		MustSucceed(t, c.Dial(addr))
+		waitPipes(t, s, i+1)
+		peers = append(peers, c)
+	}
+
+	// Each reply goes back to the one that sent last.
+	for _, i := range []int{1, 0, 2, 1} {
+		MustSucceed(t, peers[i].Send([]byte{byte(i)}))
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, b[0] == byte(i))
+		MustSucceed(t, s.Send([]byte{'r', byte(i)}))
+		b, err = peers[i].Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == string([]byte{'r', byte(i)}))
+	}
+
+	// A message with a target goes there, whoever was last.
+	MustSucceed(t, peers[2].Send([]byte("hello")))
+	m, err := s.RecvMsg()
+	MustSucceed(t, err)
+	target := m.Pipe
+	m.Free()
+	MustSucceed(t, peers[0].Send([]byte("again")))
+	_, err = s.Recv()
+	MustSucceed(t, err)
+	m = mangos.NewMessage(0)
+	m.Body = append(m.Body, "targeted"...)
+	m.Target = target
+	MustSucceed(t, s.SendMsg(m))
+	b, err := peers[2].Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "targeted")
+
+	// When the active peer goes, another takes over.
+	MustSucceed(t, peers[0].Close())
+	waitPipes(t, s, 2)
+	MustSucceed(t, s.Send([]byte("still")))
+	got := 0
+	for _, c := range peers[1:] {
+		MustSucceed(t, c.SetOption(mangos.OptionRecvDeadline,
+			time.Millisecond*100))
+		if b, err := c.Recv(); err == nil {
+			MustBeTrue(t, string(b) == "still")
+			got++
+		}
+	}
+	MustBeTrue(t, got == 1)
+
+	// And a target that has gone is quietly dropped.
+	MustSucceed(t, peers[2].Close())
+	waitPipes(t, s, 1)
+	m = mangos.NewMessage(0)
+	m.Target = target
+	MustSucceed(t, s.SendMsg(m))
+}
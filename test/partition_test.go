@@ -0,0 +1,89 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/partition"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestPartitionPublisher(t *testing.T) {
+	_, err := partition.NewPublisher(0)
+	MustBeTrue(t, err == mangos.ErrBadValue)
+
+	const n = 3
+	p, err := partition.NewPublisher(n)
+	MustSucceed(t, err)
+	defer p.Close()
+	MustBeTrue(t, p.Partitions() == n)
+
+	addrs := []string{}
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, AddrTestInp())
+	}
+	MustBeTrue(t, p.Listen(addrs[:1]) == mangos.ErrBadAddr)
+	MustSucceed(t, p.Listen(addrs))
+
+	// One subscriber per partition.
+	subs := []mangos.Socket{}
+	for i := 0; i < n; i++ {
+		s, err := sub.NewSocket()
+		MustSucceed(t, err)
+		defer s.Close()
+		MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte{}))
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+		MustSucceed(t, s.Dial(addrs[i]))
+		subs = append(subs, s)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; p.Socket(i).Stats().Pipes == 0 && j < 100; j++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// The same key always goes to the same partition.
+	want := make([]int, n)
+	for i := 0; i < 30; i++ {
+		key := []byte(fmt.Sprintf("key%d", i%10))
+		part := p.Partition(key)
+		MustBeTrue(t, part == p.Partition(key))
+		want[part]++
+		MustSucceed(t, p.Send(key, []byte{byte(part)}))
+	}
+	for i, s := range subs {
+		got := 0
+		for {
+			b, err := s.Recv()
+			if err == mangos.ErrRecvTimeout {
+				break
+			}
+			MustSucceed(t, err)
+			MustBeTrue(t, len(b) == 1 && int(b[0]) == i)
+			got++
+		}
+		MustBeTrue(t, got == want[i])
+	}
+
+	stats := p.Stats()
+	MustBeTrue(t, len(stats) == n)
+	for i := range stats {
+		MustBeTrue(t, stats[i].Sent == uint64(want[i]))
+	}
+}
@@ -0,0 +1,93 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestPeerCredIPC(t *testing.T) {
+	addr := AddrTestIPC()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	creds := make(chan mangos.PeerCred, 1)
+	s1.SetAuthHook(func(p mangos.Pipe) error {
+		v, err := p.GetOption(mangos.OptionPeerCred)
+		if err != nil {
+			return err
+		}
+		cred := v.(mangos.PeerCred)
+		creds <- cred
+		// Only processes of our own user are allowed.
+		if cred.UID != os.Getuid() {
+			return errors.New("not our user")
+		}
+		return nil
+	})
+	// The dialer sees the listener's credentials too.
+	dcreds := make(chan interface{}, 1)
+	s2.SetAuthHook(func(p mangos.Pipe) error {
+		v, _ := p.GetOption(mangos.OptionPeerCred)
+		dcreds <- v
+		return nil
+	})
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+
+	MustBeTrue(t, (<-dcreds).(mangos.PeerCred).UID == os.Getuid())
+	cred := <-creds
+	MustBeTrue(t, cred.UID == os.Getuid())
+	MustBeTrue(t, cred.GID == os.Getgid())
+	if runtime.GOOS != "freebsd" {
+		MustBeTrue(t, cred.PID == os.Getpid())
+	}
+}
+
+func TestPeerCredOnlyIPC(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	errs := make(chan error, 1)
+	s1.SetAuthHook(func(p mangos.Pipe) error {
+		_, err := p.GetOption(mangos.OptionPeerCred)
+		errs <- err
+		return nil
+	})
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	MustBeTrue(t, <-errs != nil)
+}
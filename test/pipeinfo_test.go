@@ -0,0 +1,108 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+)
+
+func TestPipeInfoNone(t *testing.T) {
+	m := mangos.NewMessage(0)
+	defer m.Free()
+	_, ok := m.PipeInfo()
+	MustBeFalse(t, ok)
+}
+
+func TestPipeInfoTCP(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, cli.Dial(addr))
+	MustSucceed(t, cli.Send([]byte("ping")))
+
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	info, ok := m.PipeInfo()
+	MustBeTrue(t, ok)
+	MustBeTrue(t, info.ID == m.Pipe.ID())
+	MustBeTrue(t, info.Address == addr)
+	MustBeTrue(t, info.Scheme == "tcp")
+	MustNotBeNil(t, info.RemoteAddr)
+	MustNotBeNil(t, info.LocalAddr)
+	MustBeTrue(t, info.TLS == nil)
+
+	// Still available once the peer has gone.
+	remote := info.RemoteAddr.String()
+	MustSucceed(t, cli.Close())
+	waitPipes(t, srv, 0)
+	info, ok = m.PipeInfo()
+	MustBeTrue(t, ok)
+	MustBeTrue(t, info.RemoteAddr.String() == remote)
+	m.Free()
+}
+
+func TestPipeInfoTLS(t *testing.T) {
+	vc := newVerifyCerts(t)
+	addr := AddrTestTLS()
+
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{vc.leaf(t, "server")},
+			ClientCAs:    vc.pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	}))
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{vc.leaf(t, "alice")},
+			RootCAs:      vc.pool,
+			ServerName:   "127.0.0.1",
+		},
+	}))
+	MustSucceed(t, cli.Send([]byte("hello")))
+
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	defer m.Free()
+	info, ok := m.PipeInfo()
+	MustBeTrue(t, ok)
+	MustBeTrue(t, info.Scheme == "tls+tcp")
+	MustNotBeNil(t, info.TLS)
+	MustBeTrue(t, len(info.TLS.PeerCertificates) > 0)
+	MustBeTrue(t, info.TLS.PeerCertificates[0].Subject.CommonName == "alice")
+}
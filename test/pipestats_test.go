@@ -0,0 +1,168 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// TestPipeStatsSlowSubscriber has one subscriber keeping up, and another
+// that never reads, and checks that the slow one can be told apart and
+// shed.
+func TestPipeStatsSlowSubscriber(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 2))
+	MustSucceed(t, s.Listen(addr))
+
+	fast, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer fast.Close()
+	MustSucceed(t, fast.SetOption(mangos.OptionSubscribe, []byte{}))
+	MustSucceed(t, fast.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, fast.Dial(addr))
+	waitPipes(t, s, 1)
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer c.Close()
+	MustSucceed(t, c.SetDeadline(time.Now().Add(time.Second*5)))
+	_, err = c.Write([]byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoSub), 0, 0})
+	MustSucceed(t, err)
+	hdr := make([]byte, 8)
+	_, err = io.ReadFull(c, hdr)
+	MustSucceed(t, err)
+	waitPipes(t, s, 2)
+
+	// Enough to fill the kernel's buffers for the slow one as well as
+	// its queue.  The fast one takes each before the next is sent.
+	body := make([]byte, 256*1024)
+	for i := 0; i < 100; i++ {
+		MustSucceed(t, s.Send(body))
+		_, err = fast.Recv()
+		MustSucceed(t, err)
+	}
+
+	var slow *mangos.PipeInfo
+	infos := s.Pipes()
+	MustBeTrue(t, len(infos) == 2)
+	for i := range infos {
+		info := &infos[i]
+		MustBeFalse(t, info.LastActive.Before(info.Connected))
+		if info.RemoteAddr.String() == c.LocalAddr().String() {
+			slow = info
+			continue
+		}
+		MustBeTrue(t, info.Dropped == 0)
+		MustBeTrue(t, info.Queued == 0)
+	}
+	MustNotBeNil(t, slow)
+	MustBeTrue(t, slow.Dropped > 0)
+	MustBeTrue(t, slow.Queued > 0)
+	MustBeTrue(t, slow.MsgsSent+slow.Dropped+slow.Queued <= 100)
+	MustBeTrue(t, s.Stats().Dropped == slow.Dropped)
+
+	v, err := s.GetOption(mangos.OptionPipeStats)
+	MustSucceed(t, err)
+	stats, ok := v.(map[uint32]map[string]uint64)
+	MustBeTrue(t, ok)
+	MustBeTrue(t, len(stats) == 2)
+	MustBeTrue(t, stats[slow.ID][mangos.StatDropped] == slow.Dropped)
+	MustBeTrue(t, errors.Is(s.SetOption(mangos.OptionPipeStats, stats),
+		mangos.ErrBadOption))
+
+	MustSucceed(t, s.ClosePipe(slow.ID))
+	waitPipes(t, s, 1)
+	MustBeTrue(t, s.ClosePipe(slow.ID) == mangos.ErrClosed)
+
+	// The one left is still served.
+	MustSucceed(t, s.Send([]byte("still here")))
+	m, err := fast.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "still here")
+}
+
+func TestPipeStatsBus(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	MustSucceed(t, s1.SetOption(mangos.OptionWriteQLen, 1))
+	MustSucceed(t, s2.SetOption(mangos.OptionReadQLen, 1))
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+
+	// Nobody is receiving on s2, so most of these must be dropped.
+	for i := 0; i < 20; i++ {
+		MustSucceed(t, s1.Send([]byte{byte(i)}))
+	}
+	infos := s1.Pipes()
+	MustBeTrue(t, len(infos) == 1)
+	MustBeTrue(t, infos[0].Dropped > 0)
+	MustBeTrue(t, infos[0].Dropped == s1.Stats().Dropped)
+}
+
+func TestPipeStatsUnsupported(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	_, err = s1.GetOption(mangos.OptionPipeStats)
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadOption))
+
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	waitPipes(t, s1, 1)
+	before := s1.Pipes()[0].LastActive
+
+	time.Sleep(time.Millisecond * 10)
+	MustSucceed(t, s1.Send([]byte("hello")))
+	_, err = s2.Recv()
+	MustSucceed(t, err)
+	infos := s1.Pipes()
+	MustBeTrue(t, len(infos) == 1)
+	MustBeTrue(t, infos[0].LastActive.After(before))
+	MustBeTrue(t, infos[0].Queued == 0)
+	MustBeTrue(t, infos[0].Dropped == 0)
+
+	MustBeTrue(t, s1.ClosePipe(0) == mangos.ErrClosed)
+	MustSucceed(t, s1.ClosePipe(infos[0].ID))
+	waitPipes(t, s1, 0)
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+)
+
+// platformOptions are the options that tune the connections beneath
+// the transports, with a value for each that is not the default.
+var platformOptions = []struct {
+	name  string
+	value interface{}
+}{
+	{mangos.OptionNoDelay, false},
+	{mangos.OptionKeepAlive, true},
+	{mangos.OptionKeepAliveTime, time.Minute},
+	{mangos.OptionKeepAliveInterval, time.Second * 10},
+	{mangos.OptionKeepAliveCount, 4},
+	{mangos.OptionSendBufferSize, 65536},
+	{mangos.OptionRecvBufferSize, 65536},
+}
+
+// platformOptionError is the error expected from setting an option on a
+// dialer or listener of the transport, on this platform.  It says in
+// one place what options.go says about each, so that an option that
+// does nothing somewhere shows up here, rather than being ignored.
+func platformOptionError(scheme, name string, listener bool) error {
+	switch name {
+	case mangos.OptionKeepAliveTime, mangos.OptionKeepAliveInterval,
+		mangos.OptionKeepAliveCount:
+		if scheme != "ipc" && runtime.GOOS == "openbsd" {
+			return mangos.ErrUnsupported
+		}
+	case mangos.OptionSendBufferSize, mangos.OptionRecvBufferSize:
+		if scheme == "ipc" && runtime.GOOS == "windows" && !listener {
+			return mangos.ErrBadOption
+		}
+		return nil
+	}
+	if scheme == "ipc" {
+		return mangos.ErrBadOption
+	}
+	return nil
+}
+
+func TestPlatformOptionsSocket(t *testing.T) {
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	for _, o := range platformOptions {
+		want := platformOptionError("tcp", o.name, false)
+		MustBeTrue(t, s.SetOption(o.name, o.value) == want)
+		if want != nil {
+			continue
+		}
+		v, err := s.GetOption(o.name)
+		MustSucceed(t, err)
+		MustBeTrue(t, v == o.value)
+	}
+	MustBeTrue(t, s.SetOption(mangos.OptionKeepAliveInterval,
+		time.Duration(-1)) == mangos.ErrBadValue)
+	MustBeTrue(t, s.SetOption(mangos.OptionKeepAliveCount, -1) ==
+		mangos.ErrBadValue)
+}
+
+func TestPlatformOptionsMatrix(t *testing.T) {
+	scfg, err := GetTLSConfig(true)
+	MustSucceed(t, err)
+	ccfg, err := GetTLSConfig(false)
+	MustSucceed(t, err)
+
+	for _, tc := range []struct {
+		scheme string
+		addr   func() string
+		lopts  map[string]interface{}
+		dopts  map[string]interface{}
+	}{
+		{"tcp", AddrTestTCP, nil, nil},
+		{"tls+tcp", AddrTestTLS,
+			map[string]interface{}{mangos.OptionTLSConfig: scfg},
+			map[string]interface{}{mangos.OptionTLSConfig: ccfg}},
+		{"ipc", AddrTestIPC, nil, nil},
+	} {
+		t.Run(tc.scheme, func(t *testing.T) {
+			addr := tc.addr()
+			srv, err := rep.NewSocket()
+			MustSucceed(t, err)
+			defer srv.Close()
+			MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+			cli, err := req.NewSocket()
+			MustSucceed(t, err)
+			defer cli.Close()
+			MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+			l, err := srv.NewListener(addr, tc.lopts)
+			MustSucceed(t, err)
+			d, err := cli.NewDialer(addr, tc.dopts)
+			MustSucceed(t, err)
+			for _, o := range platformOptions {
+				want := platformOptionError(tc.scheme, o.name, true)
+				MustBeTrue(t, l.SetOption(o.name, o.value) == want)
+				want = platformOptionError(tc.scheme, o.name, false)
+				MustBeTrue(t, d.SetOption(o.name, o.value) == want)
+			}
+			MustSucceed(t, l.Listen())
+			MustSucceed(t, d.Dial())
+
+			// The connection works, and its pipes have the
+			// options that were taken.
+			MustSucceed(t, cli.Send([]byte("ping")))
+			m, err := srv.RecvMsg()
+			MustSucceed(t, err)
+			sp := m.Pipe
+			MustSucceed(t, srv.SendMsg(m))
+			m, err = cli.RecvMsg()
+			MustSucceed(t, err)
+			cp := m.Pipe
+			m.Free()
+			for _, o := range platformOptions {
+				if platformOptionError(tc.scheme, o.name, true) == nil {
+					v, err := sp.GetOption(o.name)
+					MustSucceed(t, err)
+					MustBeTrue(t, v == o.value)
+				}
+				if platformOptionError(tc.scheme, o.name, false) == nil {
+					v, err := cp.GetOption(o.name)
+					MustSucceed(t, err)
+					MustBeTrue(t, v == o.value)
+				}
+			}
+		})
+	}
+}
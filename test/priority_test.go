@@ -0,0 +1,178 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestPriorityMessage(t *testing.T) {
+	m := mangos.NewMessage(0)
+	MustBeTrue(t, m.Priority() == 0)
+	m.SetPriority(2)
+	MustBeTrue(t, m.Priority() == 2)
+	dup := m.Dup()
+	MustBeTrue(t, dup.Priority() == 2)
+	m.SetPriority(-1)
+	MustBeTrue(t, m.Priority() == 0)
+	m.Free()
+	dup.Free()
+	m = mangos.NewMessage(0)
+	MustBeTrue(t, m.Priority() == 0)
+	m.Free()
+}
+
+func TestPriorityOptions(t *testing.T) {
+	for _, f := range []func() (mangos.Socket, error){pair.NewSocket, push.NewSocket} {
+		s, err := f()
+		MustSucceed(t, err)
+		v, err := s.GetOption(mangos.OptionSendPriorities)
+		MustSucceed(t, err)
+		MustBeTrue(t, v == 1)
+		MustBeTrue(t, s.SetOption(mangos.OptionSendPriorities, 0) == mangos.ErrBadValue)
+		MustBeTrue(t, s.SetOption(mangos.OptionSendPriorities, 5) == mangos.ErrBadValue)
+		MustBeTrue(t, s.SetOption(mangos.OptionSendPriorities, "2") == mangos.ErrBadValue)
+		MustSucceed(t, s.SetOption(mangos.OptionSendPriorities, 3))
+		v, err = s.GetOption(mangos.OptionSendPriorities)
+		MustSucceed(t, err)
+		MustBeTrue(t, v == 3)
+		MustSucceed(t, s.Close())
+	}
+}
+
+// priorityQueue sends bulk messages, numbered from zero, and then
+// urgent ones, numbered from 100 for priority 1 and 200 for priority 2,
+// all of which wait in the queue, there being no peer yet.
+func priorityQueue(t *testing.T, s mangos.Socket) {
+	send := func(n, prio int) {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, byte(n))
+		m.SetPriority(prio)
+		MustSucceed(t, s.SendMsg(m))
+	}
+	for i := 0; i < 20; i++ {
+		send(i, 0)
+	}
+	for i := 0; i < 3; i++ {
+		send(100+i, 1)
+		send(200+i, 5) // more than there are, so the highest
+	}
+}
+
+// priorityCheck receives what priorityQueue sent, expecting the urgent
+// messages first, and each priority in the order it was sent.
+func priorityCheck(t *testing.T, r mangos.Socket) {
+	var want []int
+	for i := 0; i < 3; i++ {
+		want = append(want, 200+i)
+	}
+	for i := 0; i < 3; i++ {
+		want = append(want, 100+i)
+	}
+	for i := 0; i < 20; i++ {
+		want = append(want, i)
+	}
+	for _, n := range want {
+		b, err := r.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && int(b[0]) == n)
+	}
+}
+
+func TestPriorityPair(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSendPriorities, 3))
+	MustSucceed(t, s.Listen(addr))
+	priorityQueue(t, s)
+	v, err := s.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(map[string]uint64)[mangos.StatQueued] == 26)
+
+	r, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, r.Dial(addr))
+	priorityCheck(t, r)
+}
+
+func TestPriorityPairPoly(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionPolyamorous, true))
+	MustSucceed(t, s.SetOption(mangos.OptionSendPriorities, 3))
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 64))
+	MustSucceed(t, s.Listen(addr))
+
+	r, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, r.Dial(addr))
+	waitPipes(t, s, 1)
+
+	// Sends in turn arrive in turn; only a backlog is reordered.
+	for i := 0; i < 3; i++ {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, byte(i))
+		m.SetPriority(2 - i)
+		MustSucceed(t, s.SendMsg(m))
+		b, err := r.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && int(b[0]) == i)
+	}
+}
+
+func TestPriorityPush(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSendPriorities, 3))
+	MustSucceed(t, s.Listen(addr))
+	priorityQueue(t, s)
+
+	// Lowering the priorities leaves those queued on the lanes, but
+	// what is sent now goes with the bulk.
+	MustSucceed(t, s.SetOption(mangos.OptionSendPriorities, 1))
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, 20)
+	m.SetPriority(2)
+	MustSucceed(t, s.SendMsg(m))
+	// And resizing the queue keeps them all.
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 64))
+
+	r, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, r.Dial(addr))
+	priorityCheck(t, r)
+	b, err := r.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, len(b) == 1 && b[0] == 20)
+}
@@ -0,0 +1,198 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func unhealthy(t *testing.T, s mangos.Socket) uint64 {
+	v, err := s.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	return v.(map[string]uint64)[mangos.StatUnhealthy]
+}
+
+func waitUnhealthy(t *testing.T, s mangos.Socket, n uint64) {
+	for i := 0; unhealthy(t, s) != n; i++ {
+		if i > 200 {
+			t.Fatalf("unhealthy pipes never reached %d", n)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// echo answers the probes, and anything else, sent on a connection
+// pretending to be a REP peer.
+func echo(c net.Conn) {
+	for {
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint64(hdr))
+		if _, err := io.ReadFull(c, body); err != nil {
+			return
+		}
+		if _, err := c.Write(append(hdr, body...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestProbeSkipsSilentPeer(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionProbeInterval, time.Millisecond*20))
+	MustSucceed(t, s.SetOption(mangos.OptionRetryTime, time.Minute))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.Listen(addr))
+
+	good, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer good.Close()
+	MustSucceed(t, good.Dial(addr))
+	go func() {
+		for {
+			m, err := good.RecvMsg()
+			if err != nil {
+				return
+			}
+			if good.SendMsg(m) != nil {
+				return
+			}
+		}
+	}()
+
+	// Connected, but never reading anything.
+	c, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoRep), 0, 0})
+	MustSucceed(t, err)
+	hdr := make([]byte, 8)
+	_, err = io.ReadFull(c, hdr)
+	MustSucceed(t, err)
+	waitPipes(t, s, 2)
+	waitUnhealthy(t, s, 1)
+
+	// Every request goes to the one answering.
+	for i := 0; i < 10; i++ {
+		MustSucceed(t, s.Send([]byte{byte(i)}))
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && b[0] == byte(i))
+	}
+
+	// Once it answers, it is used again.
+	go echo(c)
+	waitUnhealthy(t, s, 0)
+}
+
+func TestProbeResendsFromSilentPeer(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionRetryTime, time.Minute))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+	MustSucceed(t, s.Listen(addr))
+
+	// The only peer to begin with never answers.
+	c, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoRep), 0, 0})
+	MustSucceed(t, err)
+	hdr := make([]byte, 8)
+	_, err = io.ReadFull(c, hdr)
+	MustSucceed(t, err)
+	waitPipes(t, s, 1)
+	MustSucceed(t, s.Send([]byte("hello")))
+
+	good, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer good.Close()
+	MustSucceed(t, good.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+	MustSucceed(t, good.Dial(addr))
+	waitPipes(t, s, 2)
+
+	// Without waiting for the retry time, the request moves.
+	MustSucceed(t, s.SetOption(mangos.OptionProbeInterval, time.Millisecond*20))
+	m, err := good.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m.Body) == "hello")
+	MustSucceed(t, good.SendMsg(m))
+	b, err := s.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "hello")
+	MustBeTrue(t, unhealthy(t, s) == 1)
+
+	// Turning probes off forgives it.
+	MustSucceed(t, s.SetOption(mangos.OptionProbeInterval, time.Duration(0)))
+	MustBeTrue(t, unhealthy(t, s) == 0)
+}
+
+func TestProbeHealthyPeers(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionProbeInterval, time.Millisecond*10))
+	MustSucceed(t, s.SetOption(mangos.OptionProbeTimeout, time.Millisecond*50))
+	MustSucceed(t, s.Listen(addr))
+	for i := 0; i < 3; i++ {
+		r, err := rep.NewSocket()
+		MustSucceed(t, err)
+		defer r.Close()
+		MustSucceed(t, r.Dial(addr))
+	}
+	waitPipes(t, s, 3)
+	time.Sleep(time.Millisecond * 200)
+	MustBeTrue(t, unhealthy(t, s) == 0)
+}
+
+func TestProbeOptions(t *testing.T) {
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	v, err := s.GetOption(mangos.OptionProbeInterval)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == 0)
+	v, err = s.GetOption(mangos.OptionProbeTimeout)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == 0)
+
+	MustSucceed(t, s.SetOption(mangos.OptionProbeTimeout, time.Second))
+	v, err = s.GetOption(mangos.OptionProbeTimeout)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Second)
+
+	MustBeTrue(t, s.SetOption(mangos.OptionProbeInterval, 1) == mangos.ErrBadValue)
+	MustBeTrue(t, s.SetOption(mangos.OptionProbeInterval, -time.Second) == mangos.ErrBadValue)
+	MustBeTrue(t, s.SetOption(mangos.OptionProbeTimeout, "x") == mangos.ErrBadValue)
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/all"
+)
+
+// These benchmarks cover each protocol over each transport, at a range
+// of message sizes.  Besides the usual time (and allocations) per
+// message, they report msgs/s and the p50 and p99 latencies, the last
+// being round trip times for REQ/REP, and one way times otherwise.
+// The lossy protocols (PUB/SUB and BUS) are left to spbench, as b.N
+// messages cannot be relied upon to arrive.
+
+var benchProtoAddrs = []struct {
+	name string
+	addr func() string
+}{
+	{"inproc", AddrTestInp},
+	{"ipc", AddrTestIPC},
+	{"tcp", AddrTestTCP},
+	{"tls", AddrTestTLS},
+	{"ws", AddrTestWS},
+	{"wss", AddrTestWSS},
+}
+
+var benchProtoSizes = []int{64, 1024, 65536}
+
+func benchMust(b *testing.B, err error) {
+	if err != nil {
+		b.Fatalf("Failed: %v", err)
+	}
+}
+
+func benchProtoConnect(b *testing.B, srv, cli mangos.Socket, addr string) {
+	srvopts := make(map[string]interface{})
+	cliopts := make(map[string]interface{})
+	if strings.HasPrefix(addr, "wss://") || strings.HasPrefix(addr, "tls+tcp://") {
+		srvopts[mangos.OptionTLSConfig] = srvCfg
+		cliopts[mangos.OptionTLSConfig] = cliCfg
+	}
+	if err := srv.ListenOptions(addr, srvopts); err != nil {
+		b.Fatalf("Listen failed: %v", err)
+	}
+	if err := cli.DialOptions(addr, cliopts); err != nil {
+		b.Fatalf("Dial failed: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+}
+
+func benchProtoReport(b *testing.B, lat []time.Duration, elapsed time.Duration) {
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	b.ReportMetric(float64(len(lat))/elapsed.Seconds(), "msgs/s")
+	b.ReportMetric(float64(lat[len(lat)*50/100].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(lat[len(lat)*99/100].Nanoseconds()), "p99-ns")
+}
+
+func benchProtoRoundTrip(b *testing.B, addr string, size int) {
+	srv, err := rep.NewSocket()
+	benchMust(b, err)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	benchMust(b, err)
+	defer cli.Close()
+	benchProtoConnect(b, srv, cli, addr)
+
+	go func() {
+		for {
+			m, err := srv.RecvMsg()
+			if err != nil {
+				return
+			}
+			if srv.SendMsg(m) != nil {
+				return
+			}
+		}
+	}()
+
+	lat := make([]time.Duration, 0, b.N)
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		m := mangos.NewMessage(size)
+		m.Body = m.Body[:size]
+		t0 := time.Now()
+		benchMust(b, cli.SendMsg(m))
+		m, err = cli.RecvMsg()
+		benchMust(b, err)
+		lat = append(lat, time.Since(t0))
+		m.Free()
+	}
+	b.StopTimer()
+	benchProtoReport(b, lat, time.Since(start))
+}
+
+func benchProtoOneWay(b *testing.B, srv, cli mangos.Socket, addr string, size int) {
+	defer srv.Close()
+	defer cli.Close()
+	benchProtoConnect(b, srv, cli, addr)
+
+	// Room for the send time.
+	if size < 8 {
+		size = 8
+	}
+	lat := make([]time.Duration, 0, b.N)
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			m, err := srv.RecvMsg()
+			if err != nil {
+				done <- err
+				return
+			}
+			t0 := int64(binary.BigEndian.Uint64(m.Body))
+			lat = append(lat, time.Duration(time.Now().UnixNano()-t0))
+			m.Free()
+		}
+		done <- nil
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		m := mangos.NewMessage(size)
+		m.Body = m.Body[:size]
+		binary.BigEndian.PutUint64(m.Body, uint64(time.Now().UnixNano()))
+		benchMust(b, cli.SendMsg(m))
+	}
+	benchMust(b, <-done)
+	b.StopTimer()
+	benchProtoReport(b, lat, time.Since(start))
+}
+
+func benchProtoPair(b *testing.B, addr string, size int) {
+	srv, err := pair.NewSocket()
+	benchMust(b, err)
+	cli, err := pair.NewSocket()
+	benchMust(b, err)
+	benchProtoOneWay(b, srv, cli, addr, size)
+}
+
+func benchProtoPipeline(b *testing.B, addr string, size int) {
+	srv, err := pull.NewSocket()
+	benchMust(b, err)
+	cli, err := push.NewSocket()
+	benchMust(b, err)
+	benchProtoOneWay(b, srv, cli, addr, size)
+}
+
+func benchProto(b *testing.B, f func(*testing.B, string, int)) {
+	for _, a := range benchProtoAddrs {
+		for _, sz := range benchProtoSizes {
+			addr := a.addr
+			size := sz
+			b.Run(fmt.Sprintf("%s/%d", a.name, size), func(b *testing.B) {
+				f(b, addr(), size)
+			})
+		}
+	}
+}
+
+func BenchmarkProtoReqRep(b *testing.B) {
+	benchProto(b, benchProtoRoundTrip)
+}
+
+func BenchmarkProtoPair(b *testing.B) {
+	benchProto(b, benchProtoPair)
+}
+
+func BenchmarkProtoPipeline(b *testing.B) {
+	benchProto(b, benchProtoPipeline)
+}
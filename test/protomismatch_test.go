@@ -0,0 +1,93 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestProtocolMismatch(t *testing.T) {
+	for _, addr := range []string{AddrTestTCP(), AddrTestInp()} {
+		srv, err := rep.NewSocket()
+		MustSucceed(t, err)
+		defer srv.Close()
+		l := &testLogger{}
+		MustSucceed(t, srv.SetOption(mangos.OptionLogger, l))
+		errq := make(chan error, 4)
+		srv.SetErrorHandler(func(err error, _ mangos.EndpointInfo) {
+			errq <- err
+		})
+		rejectq := make(chan net.Addr, 4)
+		srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+			if ev == mangos.PipeEventRejected {
+				v, _ := p.GetOption(mangos.OptionRemoteAddr)
+				a, _ := v.(net.Addr)
+				rejectq <- a
+			}
+		})
+		MustSucceed(t, srv.Listen(addr))
+
+		cli, err := pub.NewSocket()
+		MustSucceed(t, err)
+		defer cli.Close()
+		err = cli.Dial(addr)
+		MustBeTrue(t, errors.Is(err, mangos.ErrBadProto))
+		var pe *mangos.ProtocolError
+		MustBeTrue(t, errors.As(err, &pe))
+		MustBeTrue(t, pe.Self == mangos.ProtoPub)
+		MustBeTrue(t, pe.Peer == mangos.ProtoSub)
+		MustBeTrue(t, pe.Got == mangos.ProtoRep)
+		MustBeTrue(t, err.Error() == "invalid or unsupported protocol: "+
+			"peer is rep (49), but pub (32) pairs only with sub (33)")
+
+		if !strings.HasPrefix(addr, "tcp://") {
+			// Only the dialer knows, without a handshake.
+			continue
+		}
+		// The listener hears of it too, with its own view.
+		MustBeTrue(t, l.wait("peer is pub (32), but rep (49) pairs only with req (48)"))
+		select {
+		case err := <-errq:
+			MustBeTrue(t, errors.As(err, &pe))
+			MustBeTrue(t, pe.Self == mangos.ProtoRep && pe.Got == mangos.ProtoPub)
+		case <-time.After(time.Second):
+			t.Fatalf("no error reported")
+		}
+		select {
+		case a := <-rejectq:
+			MustBeTrue(t, a.(*net.TCPAddr).IP.IsLoopback())
+		case <-time.After(time.Second):
+			t.Fatalf("no rejected pipe")
+		}
+		MustBeTrue(t, srv.Stats().Rejected == 1)
+		MustBeTrue(t, srv.Stats().Pipes == 0)
+	}
+}
+
+func TestProtocolErrorUnknown(t *testing.T) {
+	err := &mangos.ProtocolError{Self: mangos.ProtoReq,
+		Peer: mangos.ProtoRep, Got: 0x1234}
+	MustBeTrue(t, strings.Contains(err.Error(), "peer is 4660,"))
+}
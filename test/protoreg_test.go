@@ -0,0 +1,152 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/protocol/xreq"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// shout is a toy protocol, PAIR with the bodies of messages sent
+// upper-cased.
+type shout struct {
+	protocol.Protocol
+}
+
+func (s *shout) SendMsg(m *protocol.Message) error {
+	for i, c := range m.Body {
+		if c >= 'a' && c <= 'z' {
+			m.Body[i] = c - 'a' + 'A'
+		}
+	}
+	return s.Protocol.SendMsg(m)
+}
+
+func newShout() protocol.Protocol {
+	return &shout{Protocol: pair.NewProtocol()}
+}
+
+func TestProtocolRegisterBuiltin(t *testing.T) {
+	names := mangos.RegisteredProtocols()
+	found := false
+	for _, n := range names {
+		found = found || n == "req"
+	}
+	MustBeTrue(t, found)
+
+	s, err := protocol.NewSocket("req")
+	MustSucceed(t, err)
+	defer s.Close()
+	MustBeTrue(t, s.Info().SelfName == "req")
+	v, err := s.GetOption(mangos.OptionRaw)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == false)
+
+	x, err := protocol.NewRawSocket("req")
+	MustSucceed(t, err)
+	defer x.Close()
+	v, err = x.GetOption(mangos.OptionRaw)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == true)
+
+	_, err = protocol.NewSocket("nope")
+	MustBeTrue(t, err == mangos.ErrBadProto)
+	_, err = mangos.NewProtocol("nope", true)
+	MustBeTrue(t, err == mangos.ErrBadProto)
+}
+
+func TestProtocolRegisterCustom(t *testing.T) {
+	protocol.RegisterProtocol("shout", false, newShout)
+	defer protocol.RegisterProtocol("shout", false, nil)
+
+	addr := AddrTestInp()
+	s, err := protocol.NewSocket("shout")
+	MustSucceed(t, err)
+	defer s.Close()
+	_, err = protocol.NewRawSocket("shout")
+	MustBeTrue(t, err == mangos.ErrBadProto)
+
+	peer, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer peer.Close()
+	MustSucceed(t, peer.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, peer.Listen(addr))
+	MustSucceed(t, s.Dial(addr))
+	waitPipes(t, peer, 1)
+
+	MustSucceed(t, s.Send([]byte("hello")))
+	b, err := peer.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "HELLO")
+
+	// Removing it leaves existing sockets alone.
+	protocol.RegisterProtocol("shout", false, nil)
+	_, err = protocol.NewSocket("shout")
+	MustBeTrue(t, err == mangos.ErrBadProto)
+	MustSucceed(t, s.Send([]byte("still")))
+	b, err = peer.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "STILL")
+}
+
+func TestProtocolRegisterDesc(t *testing.T) {
+	orig, ok := mangos.ProtocolByName("pair")
+	MustBeTrue(t, ok)
+	defer mangos.RegisterProtocolDesc(orig)
+	n := len(mangos.Protocols())
+
+	// A description replaces the one of the same name, but the options
+	// are those its implementation accepts.
+	d := orig
+	d.Options = []string{mangos.OptionRecvDeadline, mangos.OptionSubscribe}
+	mangos.RegisterProtocolDesc(d)
+	MustBeTrue(t, len(mangos.Protocols()) == n)
+	d2, ok := mangos.ProtocolByNumber(mangos.ProtoPair)
+	MustBeTrue(t, ok)
+	MustBeTrue(t, d2.ValidOption(mangos.OptionWriteQLen, false))
+	MustBeTrue(t, d2.ValidOption(mangos.OptionRecvDeadline, false))
+	MustBeFalse(t, d2.ValidOption(mangos.OptionSubscribe, false))
+
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionStrict, true))
+	var oe *mangos.OptionError
+	err = s.SetOption(mangos.OptionSubscribe, []byte{})
+	MustBeTrue(t, errors.As(err, &oe))
+	MustBeTrue(t, oe.Protocol == "pair")
+	found := false
+	for _, o := range oe.Valid {
+		MustBeFalse(t, o == mangos.OptionSubscribe)
+		found = found || o == mangos.OptionWriteQLen
+	}
+	MustBeTrue(t, found)
+
+	// Without an implementation, the description is all there is.
+	protocol.RegisterProtocol("pair", false, nil)
+	defer protocol.RegisterProtocol("pair", false, pair.NewProtocol)
+	d2, ok = mangos.ProtocolByName("pair")
+	MustBeTrue(t, ok)
+	MustBeFalse(t, d2.ValidOption(mangos.OptionWriteQLen, false))
+	MustBeTrue(t, d2.ValidOption(mangos.OptionSubscribe, false))
+}
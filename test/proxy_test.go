@@ -0,0 +1,232 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/ws"
+)
+
+// testProxy is a minimal SOCKS5 or HTTP CONNECT proxy.
+type testProxy struct {
+	l     net.Listener
+	http  bool
+	user  string
+	pass  string
+	count int32
+}
+
+func newTestProxy(t *testing.T, http bool) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	MustSucceed(t, err)
+	p := &testProxy{l: l, http: http}
+	go p.serve()
+	return p
+}
+
+func (p *testProxy) serve() {
+	for {
+		c, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(c)
+	}
+}
+
+func (p *testProxy) handle(c net.Conn) {
+	defer c.Close()
+	var addr string
+	if p.http {
+		// The bufio.Reader may only read up to the end of the
+		// request, as the client sends nothing more until we reply.
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != "CONNECT" {
+			return
+		}
+		if p.user != "" {
+			req.Header.Set("Authorization",
+				req.Header.Get("Proxy-Authorization"))
+			u, pw, ok := req.BasicAuth()
+			if !ok || u != p.user || pw != p.pass {
+				io.WriteString(c, "HTTP/1.1 407 Denied\r\n\r\n")
+				return
+			}
+		}
+		addr = req.Host
+	} else {
+		b := make([]byte, 262)
+		if _, err := io.ReadFull(c, b[:2]); err != nil || b[0] != 5 {
+			return
+		}
+		if _, err := io.ReadFull(c, b[:b[1]]); err != nil {
+			return
+		}
+		if p.user != "" {
+			c.Write([]byte{5, 2})
+			io.ReadFull(c, b[:2])
+			user := make([]byte, b[1])
+			io.ReadFull(c, user)
+			io.ReadFull(c, b[:1])
+			pass := make([]byte, b[0])
+			io.ReadFull(c, pass)
+			if string(user) != p.user || string(pass) != p.pass {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		} else {
+			c.Write([]byte{5, 0})
+		}
+		if _, err := io.ReadFull(c, b[:4]); err != nil {
+			return
+		}
+		var host string
+		switch b[3] {
+		case 1:
+			io.ReadFull(c, b[:4])
+			host = net.IP(b[:4]).String()
+		case 3:
+			io.ReadFull(c, b[:1])
+			n := int(b[0])
+			io.ReadFull(c, b[:n])
+			host = string(b[:n])
+		default:
+			return
+		}
+		io.ReadFull(c, b[:2])
+		port := int(b[0])<<8 | int(b[1])
+		addr = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	up, err := net.Dial("tcp", addr)
+	if err != nil {
+		if p.http {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		} else {
+			c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		}
+		return
+	}
+	defer up.Close()
+	atomic.AddInt32(&p.count, 1)
+	if p.http {
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else {
+		c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	}
+	go io.Copy(up, c)
+	io.Copy(c, up)
+}
+
+func (p *testProxy) url(scheme string) string {
+	if p.user != "" {
+		return scheme + "://" + p.user + ":" + p.pass + "@" + p.l.Addr().String()
+	}
+	return scheme + "://" + p.l.Addr().String()
+}
+
+func testProxyPair(t *testing.T, proxy, addr string) {
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionDialProxy: proxy,
+	}))
+	MustSucceed(t, cli.Send([]byte("ping")))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+	MustSucceed(t, srv.Send([]byte("pong")))
+	b, err = cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "pong")
+}
+
+func TestProxySOCKS5(t *testing.T) {
+	p := newTestProxy(t, false)
+	defer p.l.Close()
+	testProxyPair(t, p.url("socks5"), AddrTestTCP())
+	testProxyPair(t, p.url("socks5"), AddrTestWS())
+	MustBeTrue(t, atomic.LoadInt32(&p.count) == 2)
+}
+
+func TestProxySOCKS5Auth(t *testing.T) {
+	p := newTestProxy(t, false)
+	p.user, p.pass = "user", "secret"
+	defer p.l.Close()
+	testProxyPair(t, p.url("socks5"), AddrTestTCP())
+	MustBeTrue(t, atomic.LoadInt32(&p.count) == 1)
+}
+
+func TestProxyHTTP(t *testing.T) {
+	p := newTestProxy(t, true)
+	p.user, p.pass = "user", "secret"
+	defer p.l.Close()
+	testProxyPair(t, p.url("http"), AddrTestTCP())
+	testProxyPair(t, p.url("http"), AddrTestWS())
+	MustBeTrue(t, atomic.LoadInt32(&p.count) == 2)
+}
+
+func TestProxyFailures(t *testing.T) {
+	p := newTestProxy(t, true)
+	p.user, p.pass = "user", "secret"
+	defer p.l.Close()
+
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+
+	// Wrong password.
+	err = sock.DialOptions(AddrTestTCP(), map[string]interface{}{
+		mangos.OptionDialProxy: "http://user:wrong@" + p.l.Addr().String(),
+	})
+	MustBeTrue(t, err == mangos.ErrProxyFailed)
+
+	// Bad proxy values.
+	for _, v := range []interface{}{"ftp://127.0.0.1:1", "socks5://", 5} {
+		err = sock.DialOptions(AddrTestTCP(), map[string]interface{}{
+			mangos.OptionDialProxy: v,
+		})
+		MustBeTrue(t, err == mangos.ErrBadValue)
+	}
+
+	// The proxy cannot reach the target.
+	s := newTestProxy(t, false)
+	defer s.l.Close()
+	err = sock.DialOptions("tcp://127.0.0.1:1", map[string]interface{}{
+		mangos.OptionDialProxy: s.url("socks5"),
+	})
+	MustBeTrue(t, err == mangos.ErrConnRefused)
+}
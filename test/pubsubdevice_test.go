@@ -0,0 +1,240 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// waitSubs waits for the subscriptions of the PUB socket to be those
+// given.
+func waitSubs(t *testing.T, s mangos.Socket, topics ...string) {
+	want := fmtTopics(topics)
+	var have string
+	for i := 0; i < 100; i++ {
+		v, err := s.GetOption(mangos.OptionSubscriptions)
+		MustSucceed(t, err)
+		subs := v.([][]byte)
+		have = ""
+		for _, sub := range subs {
+			have += "[" + string(sub) + "]"
+		}
+		if have == want {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("subscriptions are %s, not %s", have, want)
+}
+
+func fmtTopics(topics []string) string {
+	s := ""
+	for _, t := range topics {
+		s += "[" + t + "]"
+	}
+	return s
+}
+
+func newSubFwd(t *testing.T, addr string, topics ...string) mangos.Socket {
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionSubForward, true))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline,
+		time.Millisecond*200))
+	for _, topic := range topics {
+		MustSucceed(t, s.SetOption(mangos.OptionSubscribe, topic))
+	}
+	MustSucceed(t, s.Dial(addr))
+	return s
+}
+
+func TestSubForwardNarrows(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.Listen(addr))
+	waitSubs(t, p)
+
+	s1 := newSubFwd(t, addr, "b", "a")
+	defer s1.Close()
+	s2 := newSubFwd(t, addr, "a")
+	defer s2.Close()
+	waitSubs(t, p, "a", "b")
+
+	v, err := s1.GetOption(mangos.OptionSubForward)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+	MustBeTrue(t, s1.SetOption(mangos.OptionSubForward, 1) ==
+		mangos.ErrBadValue)
+
+	// Unsubscribing is told to the publisher.
+	MustSucceed(t, s1.SetOption(mangos.OptionUnsubscribe, "b"))
+	waitSubs(t, p, "a")
+	MustSucceed(t, p.Send([]byte("a1")))
+	MustSucceed(t, p.Send([]byte("b1")))
+	MustBeTrue(t, fmtTopics(recvAll(s1)) == "[a1]")
+	MustBeTrue(t, fmtTopics(recvAll(s2)) == "[a1]")
+	MustBeTrue(t, p.Stats().Dropped == 0)
+
+	// A subscriber that does not say what it wants gets everything.
+	s3, err := sub.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s3.SetOption(mangos.OptionSubscribe, "c"))
+	MustSucceed(t, s3.Dial(addr))
+	waitSubs(t, p, "")
+	MustSucceed(t, s3.Close())
+	waitSubs(t, p, "a")
+
+	// Turning it off has the publisher send everything again.
+	MustSucceed(t, s1.SetOption(mangos.OptionSubForward, false))
+	waitSubs(t, p, "", "a")
+}
+
+func TestSubscriptionsChanged(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, p.Listen(addr))
+	v, err := p.GetOption(mangos.OptionSubscriptionsChanged)
+	MustSucceed(t, err)
+	changed := v.(<-chan struct{})
+	MustBeTrue(t, errors.Is(p.SetOption(mangos.OptionSubscriptions, nil),
+		mangos.ErrBadOption))
+
+	s := newSubFwd(t, addr, "x")
+	defer s.Close()
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatalf("no change notified")
+	}
+	waitSubs(t, p, "x")
+
+	MustSucceed(t, p.Close())
+	_, err = p.GetOption(mangos.OptionSubscriptions)
+	MustBeTrue(t, err == mangos.ErrClosed)
+}
+
+func TestPubSubDeviceCascade(t *testing.T) {
+	upAddr := AddrTestInp()
+	midAddr := AddrTestInp()
+	downAddr := AddrTestInp()
+
+	src, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer src.Close()
+	MustSucceed(t, src.Listen(upAddr))
+
+	// Two devices, one above the other.
+	devs := []struct{ up, down, addr string }{
+		{upAddr, midAddr, midAddr},
+		{midAddr, downAddr, downAddr},
+	}
+	var mid mangos.Socket
+	for _, d := range devs {
+		up, err := sub.NewSocket()
+		MustSucceed(t, err)
+		defer up.Close()
+		down, err := pub.NewSocket()
+		MustSucceed(t, err)
+		defer down.Close()
+		MustSucceed(t, down.Listen(d.down))
+		MustSucceed(t, mangos.PubSubDevice(up, down))
+		MustSucceed(t, up.Dial(d.up))
+		if mid == nil {
+			mid = down
+		}
+	}
+	// Nobody downstream, so nothing is wanted anywhere.
+	waitSubs(t, src)
+	waitSubs(t, mid)
+
+	s1 := newSubFwd(t, downAddr, "news")
+	defer s1.Close()
+	s2 := newSubFwd(t, downAddr, "weather")
+	defer s2.Close()
+	waitSubs(t, src, "news", "weather")
+
+	for _, b := range []string{"news1", "sport1", "weather1"} {
+		MustSucceed(t, src.Send([]byte(b)))
+	}
+	MustBeTrue(t, fmtTopics(recvAll(s1)) == "[news1]")
+	MustBeTrue(t, fmtTopics(recvAll(s2)) == "[weather1]")
+
+	MustSucceed(t, s2.Close())
+	waitSubs(t, src, "news")
+	MustSucceed(t, s1.SetOption(mangos.OptionSubscribe, "sport"))
+	waitSubs(t, src, "news", "sport")
+}
+
+func TestPubSubDeviceReplay(t *testing.T) {
+	upAddr := AddrTestInp()
+	downAddr := AddrTestInp()
+
+	src, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer src.Close()
+	MustSucceed(t, src.SetOption(mangos.OptionRetain, 1))
+	MustSucceed(t, src.SetOption(mangos.OptionRetainTopic,
+		mangos.RetainTopicFunc(func(b []byte) string {
+			return string(b[:1])
+		})))
+	MustSucceed(t, src.Listen(upAddr))
+	MustSucceed(t, src.Send([]byte("a-old")))
+	MustSucceed(t, src.Send([]byte("b-old")))
+
+	up, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer up.Close()
+	MustSucceed(t, up.SetOption(mangos.OptionReplay, true))
+	down, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer down.Close()
+	MustSucceed(t, down.Listen(downAddr))
+	MustSucceed(t, mangos.PubSubDevice(up, down))
+
+	s := newSubFwd(t, downAddr, "a")
+	defer s.Close()
+	waitSubs(t, down, "a")
+
+	// Only the wanted topic is replayed upstream.
+	MustSucceed(t, up.Dial(upAddr))
+	MustBeTrue(t, fmtTopics(recvAll(s)) == "[a-old]")
+}
+
+func TestPubSubDeviceBadSockets(t *testing.T) {
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	r, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+
+	MustBeTrue(t, mangos.PubSubDevice(p, s) == mangos.ErrBadProto)
+	MustBeTrue(t, mangos.PubSubDevice(s, r) == mangos.ErrBadProto)
+	MustBeTrue(t, mangos.PubSubDevice(nil, p) == mangos.ErrClosed)
+}
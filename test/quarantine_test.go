@@ -0,0 +1,152 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+)
+
+func TestQuarantineOption(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	v, err := s.GetOption(mangos.OptionHandshakeTimeout)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == 0)
+	MustSucceed(t, s.SetOption(mangos.OptionHandshakeTimeout, time.Second))
+	v, err = s.GetOption(mangos.OptionHandshakeTimeout)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Second)
+	MustBeTrue(t, s.SetOption(mangos.OptionHandshakeTimeout,
+		-time.Second) == mangos.ErrBadValue)
+
+	for _, addr := range []string{AddrTestTCP(), AddrTestTLS()} {
+		l, err := s.NewListener(addr, nil)
+		MustSucceed(t, err)
+		v, err := l.GetOption(mangos.OptionHandshakeTimeout)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(time.Duration) == time.Second)
+		v, err = l.GetOption(mangos.OptionQuarantine)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(mangos.Quarantine).Failures == 0)
+
+		q := mangos.Quarantine{Failures: 3, Window: time.Minute,
+			Time: time.Hour}
+		MustSucceed(t, l.SetOption(mangos.OptionQuarantine, q))
+		v, err = l.GetOption(mangos.OptionQuarantine)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(mangos.Quarantine) == q)
+		MustBeTrue(t, l.SetOption(mangos.OptionQuarantine,
+			mangos.Quarantine{Failures: -1}) == mangos.ErrBadValue)
+		MustBeTrue(t, l.SetOption(mangos.OptionQuarantine, 3) == mangos.ErrBadValue)
+	}
+}
+
+// hangsUp reports whether the server closes the connection within the
+// time given.
+func hangsUp(c net.Conn, d time.Duration) bool {
+	_ = c.SetReadDeadline(time.Now().Add(d))
+	b := make([]byte, 64)
+	for {
+		if _, err := c.Read(b); err != nil {
+			ne, ok := err.(net.Error)
+			return !ok || !ne.Timeout()
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionHandshakeTimeout: time.Millisecond * 100,
+	}))
+
+	// A peer that says nothing is dropped.
+	start := time.Now()
+	c, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer c.Close()
+	MustBeTrue(t, hangsUp(c, time.Second))
+	MustBeTrue(t, time.Since(start) >= time.Millisecond*90)
+
+	// One that does is unaffected, however long it then stays.
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.Dial(addr))
+	waitPipes(t, s, 1)
+	time.Sleep(time.Millisecond * 200)
+	MustSucceed(t, s.Send([]byte("still here")))
+	b, err := cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "still here")
+}
+
+func TestQuarantine(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionHandshakeTimeout: time.Millisecond * 100,
+		mangos.OptionQuarantine: mangos.Quarantine{
+			Failures: 2,
+			Window:   time.Second,
+			Time:     time.Millisecond * 500,
+		},
+	}))
+
+	// One bad header, and one silent peer.
+	host := strings.TrimPrefix(addr, "tcp://")
+	c, err := net.Dial("tcp", host)
+	MustSucceed(t, err)
+	_, err = c.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	MustSucceed(t, err)
+	MustBeTrue(t, hangsUp(c, time.Second))
+	c.Close()
+	c, err = net.Dial("tcp", host)
+	MustSucceed(t, err)
+	MustBeTrue(t, hangsUp(c, time.Second))
+	c.Close()
+
+	// Now even a good peer is refused, until the quarantine ends.
+	start := time.Now()
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime,
+		time.Millisecond*50))
+	MustSucceed(t, cli.SetOption(mangos.OptionMaxReconnectTime,
+		time.Millisecond*50))
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	}))
+	waitPipes(t, s, 1)
+	MustBeTrue(t, time.Since(start) >= time.Millisecond*300)
+	MustBeTrue(t, s.Stats().Rejected > 0)
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestQueueFullPolicyOptions(t *testing.T) {
+	defaults := []struct {
+		f      func() (mangos.Socket, error)
+		policy mangos.QueueFullPolicy
+	}{
+		{pub.NewSocket, mangos.QueueFullDropNewest},
+		{bus.NewSocket, mangos.QueueFullDropNewest},
+		{push.NewSocket, mangos.QueueFullBlock},
+		{pair.NewSocket, mangos.QueueFullBlock},
+	}
+	for _, d := range defaults {
+		s, err := d.f()
+		MustSucceed(t, err)
+		v, err := s.GetOption(mangos.OptionQueueFullPolicy)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(mangos.QueueFullPolicy) == d.policy)
+		MustSucceed(t, s.SetOption(mangos.OptionQueueFullPolicy, mangos.QueueFullDropOldest))
+		MustBeTrue(t, s.SetOption(mangos.OptionQueueFullPolicy, mangos.QueueFullPolicy(9)) == mangos.ErrBadValue)
+		MustBeTrue(t, s.SetOption(mangos.OptionQueueFullPolicy, 1) == mangos.ErrBadValue)
+		MustSucceed(t, s.Close())
+	}
+
+	// Protocols that have no queue of their kind do not know of it.
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustFail(t, s.SetOption(mangos.OptionQueueFullPolicy, mangos.QueueFullBlock))
+}
+
+// fillPush sends five messages to a PUSH socket with no peer, and a
+// queue of two, returning what a peer connected afterwards receives.
+func fillPush(t *testing.T, policy mangos.QueueFullPolicy) ([]string, uint64) {
+	addr := AddrTestTCP()
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 2))
+	MustSucceed(t, s.SetOption(mangos.OptionSendDeadline, time.Millisecond*50))
+	MustSucceed(t, s.SetOption(mangos.OptionQueueFullPolicy, policy))
+	for _, b := range []string{"1", "2", "3", "4", "5"} {
+		if err = s.Send([]byte(b)); err != nil {
+			MustBeTrue(t, err == mangos.ErrSendTimeout)
+		}
+	}
+	dropped := s.Stats().Dropped
+
+	r, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+	MustSucceed(t, r.Listen(addr))
+	MustSucceed(t, s.Dial(addr))
+	var got []string
+	for {
+		b, err := r.Recv()
+		if err != nil {
+			MustBeTrue(t, err == mangos.ErrRecvTimeout)
+			return got, dropped
+		}
+		got = append(got, string(b))
+	}
+}
+
+func TestQueueFullPushBlock(t *testing.T) {
+	got, dropped := fillPush(t, mangos.QueueFullBlock)
+	MustBeTrue(t, len(got) == 2 && got[0] == "1" && got[1] == "2")
+	MustBeTrue(t, dropped == 0)
+}
+
+func TestQueueFullPushDropNewest(t *testing.T) {
+	got, dropped := fillPush(t, mangos.QueueFullDropNewest)
+	MustBeTrue(t, len(got) == 2 && got[0] == "1" && got[1] == "2")
+	MustBeTrue(t, dropped == 3)
+}
+
+func TestQueueFullPushDropOldest(t *testing.T) {
+	got, dropped := fillPush(t, mangos.QueueFullDropOldest)
+	MustBeTrue(t, len(got) == 2 && got[0] == "4" && got[1] == "5")
+	MustBeTrue(t, dropped == 3)
+}
+
+func TestQueueFullPushBestEffort(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 1))
+	MustSucceed(t, s.SetOption(mangos.OptionBestEffort, true))
+	for i := 0; i < 3; i++ {
+		MustSucceed(t, s.Send([]byte("x")))
+	}
+	MustBeTrue(t, s.Stats().Dropped == 2)
+}
+
+// TestQueueFullPubDropOldest has a subscriber that stops reading, so
+// that its queue fills, and checks that it gets the latest message once
+// it starts again.
+func TestQueueFullPubDropOldest(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 2))
+	MustSucceed(t, s.SetOption(mangos.OptionQueueFullPolicy, mangos.QueueFullDropOldest))
+	MustSucceed(t, s.Listen(addr))
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	defer c.Close()
+	MustSucceed(t, c.SetDeadline(time.Now().Add(time.Second*5)))
+	_, err = c.Write([]byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoSub), 0, 0})
+	MustSucceed(t, err)
+	hdr := make([]byte, 8)
+	_, err = io.ReadFull(c, hdr)
+	MustSucceed(t, err)
+	waitPipes(t, s, 1)
+
+	// Large enough messages, and enough of them, to fill the kernel's
+	// buffers as well as the queue.
+	const n = 100
+	body := make([]byte, 256*1024)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint32(body, uint32(i))
+		MustSucceed(t, s.Send(body))
+	}
+	MustBeTrue(t, s.Stats().Dropped > 0)
+
+	last := -1
+	for last != n-1 {
+		_, err = io.ReadFull(c, hdr)
+		MustSucceed(t, err)
+		b := make([]byte, binary.BigEndian.Uint64(hdr))
+		_, err = io.ReadFull(c, b)
+		MustSucceed(t, err)
+		i := int(binary.BigEndian.Uint32(b))
+		MustBeTrue(t, i > last)
+		last = i
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+)
+
+func TestSendRateLimitOption(t *testing.T) {
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionSendRateLimit)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.RateLimit) == mangos.RateLimit{})
+
+	r := mangos.RateLimit{Messages: 100, Bytes: 1e6}
+	MustSucceed(t, s.SetOption(mangos.OptionSendRateLimit, r))
+	v, err = s.GetOption(mangos.OptionSendRateLimit)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.RateLimit) == r)
+
+	MustBeTrue(t, s.SetOption(mangos.OptionSendRateLimit,
+		mangos.RateLimit{Messages: -1}) == mangos.ErrBadValue)
+	MustBeTrue(t, s.SetOption(mangos.OptionSendRateLimit, 100) == mangos.ErrBadValue)
+}
+
+// timeSends returns how long it takes to send n messages of the size.
+func timeSends(t *testing.T, r mangos.RateLimit, n, size int) time.Duration {
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSendRateLimit, r))
+	body := make([]byte, size)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		MustSucceed(t, s.Send(body))
+	}
+	return time.Since(start)
+}
+
+func TestSendRateLimitMessages(t *testing.T) {
+	// A second's worth goes at once, and the rest at the rate.
+	d := timeSends(t, mangos.RateLimit{Messages: 50}, 75, 10)
+	MustBeTrue(t, d >= time.Millisecond*400)
+	MustBeTrue(t, d < time.Second*2)
+
+	d = timeSends(t, mangos.RateLimit{}, 1000, 10)
+	MustBeTrue(t, d < time.Millisecond*400)
+}
+
+func TestSendRateLimitBytes(t *testing.T) {
+	d := timeSends(t, mangos.RateLimit{Bytes: 40000}, 6, 10000)
+	MustBeTrue(t, d >= time.Millisecond*400)
+	MustBeTrue(t, d < time.Second*2)
+}
+
+func TestSendRateLimitBodies(t *testing.T) {
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSendRateLimit, mangos.RateLimit{Bytes: 40000}))
+
+	// Segments in Bodies count, as well as the Body.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		m := mangos.NewMessage(0)
+		m.Bodies = [][]byte{make([]byte, 5000), make([]byte, 5000)}
+		MustSucceed(t, s.SendMsg(m))
+	}
+	d := time.Since(start)
+	MustBeTrue(t, d >= time.Millisecond*400)
+	MustBeTrue(t, d < time.Second*2)
+}
+
+func TestSendRateLimitContext(t *testing.T) {
+	s, err := surveyor.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSendRateLimit, mangos.RateLimit{Messages: 50}))
+	c, err := s.OpenContext()
+	MustSucceed(t, err)
+	defer c.Close()
+
+	// Contexts share the socket's limit.
+	start := time.Now()
+	for i := 0; i < 75; i++ {
+		MustSucceed(t, c.Send([]byte("survey")))
+	}
+	d := time.Since(start)
+	MustBeTrue(t, d >= time.Millisecond*400)
+	MustBeTrue(t, d < time.Second*2)
+}
+
+func TestSendRateLimitClose(t *testing.T) {
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionSendRateLimit, mangos.RateLimit{Messages: 0.1}))
+	MustSucceed(t, s.Send([]byte("first")))
+
+	done := make(chan error)
+	go func() {
+		done <- s.Send([]byte("second"))
+	}()
+	time.Sleep(time.Millisecond * 50)
+	MustSucceed(t, s.Close())
+	select {
+	case err = <-done:
+		MustBeTrue(t, err == mangos.ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatalf("send not ended by close")
+	}
+}
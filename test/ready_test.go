@@ -0,0 +1,150 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func readyChan(t *testing.T, s mangos.Socket, name string) <-chan struct{} {
+	v, err := s.GetOption(name)
+	MustSucceed(t, err)
+	ch, ok := v.(<-chan struct{})
+	MustBeTrue(t, ok)
+	return ch
+}
+
+func isReady(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func waitReady(t *testing.T, ch <-chan struct{}) {
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("not ready")
+	}
+}
+
+func TestRecvReady(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	MustSucceed(t, s1.Listen(addr))
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.Dial(addr))
+
+	ready := readyChan(t, s1, mangos.OptionRecvReady)
+	MustBeFalse(t, isReady(ready))
+
+	MustSucceed(t, s2.Send([]byte("one")))
+	waitReady(t, ready)
+	MustSucceed(t, s2.Send([]byte("two")))
+	time.Sleep(time.Millisecond * 20)
+
+	// Each receive leaves the channel ready, while messages remain.
+	b, err := s1.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "one")
+	MustBeTrue(t, isReady(ready))
+	b, err = s1.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "two")
+	MustBeFalse(t, isReady(ready))
+}
+
+func TestRecvReadySub(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.Listen(addr))
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "a"))
+	MustSucceed(t, s.Dial(addr))
+	waitPipes(t, p, 1)
+
+	ready := readyChan(t, s, mangos.OptionRecvReady)
+	MustSucceed(t, p.Send([]byte("b filtered")))
+	time.Sleep(time.Millisecond * 20)
+	MustBeFalse(t, isReady(ready))
+	MustSucceed(t, p.Send([]byte("a wanted")))
+	waitReady(t, ready)
+	b, err := s.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "a wanted")
+}
+
+func TestSendReady(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 1))
+
+	ready := readyChan(t, s, mangos.OptionSendReady)
+	MustBeTrue(t, isReady(ready))
+
+	// With no peer, one message fills the queue.
+	MustSucceed(t, s.Send([]byte("one")))
+	MustBeFalse(t, isReady(ready))
+
+	r, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.Listen(addr))
+	MustSucceed(t, s.Dial(addr))
+	waitReady(t, ready)
+	b, err := r.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "one")
+}
+
+func TestSendReadyNeverBlocks(t *testing.T) {
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	ready := readyChan(t, s, mangos.OptionSendReady)
+	MustBeTrue(t, isReady(ready))
+	MustBeTrue(t, isReady(ready))
+}
+
+func TestReadyUnsupported(t *testing.T) {
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	_, err = s.GetOption(mangos.OptionRecvReady)
+	MustBeTrue(t, err == mangos.ErrBadOption)
+}
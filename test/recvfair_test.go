@@ -0,0 +1,238 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestRecvFairOptions(t *testing.T) {
+	for _, mk := range []func() (mangos.Socket, error){
+		pull.NewSocket, bus.NewSocket, rep.NewSocket, xrep.NewSocket,
+	} {
+		s, err := mk()
+		MustSucceed(t, err)
+		v, err := s.GetOption(mangos.OptionRecvFair)
+		MustSucceed(t, err)
+		MustBeFalse(t, v.(bool))
+		v, err = s.GetOption(mangos.OptionRecvPipeShare)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(int) == 0)
+
+		MustSucceed(t, s.SetOption(mangos.OptionRecvFair, true))
+		MustSucceed(t, s.SetOption(mangos.OptionRecvPipeShare, 5))
+		v, err = s.GetOption(mangos.OptionRecvFair)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(bool))
+		v, err = s.GetOption(mangos.OptionRecvPipeShare)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(int) == 5)
+
+		MustBeTrue(t, s.SetOption(mangos.OptionRecvFair, 1) == mangos.ErrBadValue)
+		MustBeTrue(t, s.SetOption(mangos.OptionRecvPipeShare, -1) == mangos.ErrBadValue)
+		MustBeTrue(t, s.SetOption(mangos.OptionRecvPipeShare, "5") == mangos.ErrBadValue)
+		MustSucceed(t, s.Close())
+	}
+
+	s, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustFail(t, s.SetOption(mangos.OptionRecvFair, true))
+}
+
+// recvFairRun has a chatty peer fill the receive queue as far as it is
+// allowed, and then a quiet peer send one message, returning how many
+// messages were received before the quiet peer's.
+func recvFairRun(t *testing.T, srv mangos.Socket, qlen int, opts map[string]interface{}) int {
+	addr := AddrTestInp()
+	MustSucceed(t, srv.SetOption(mangos.OptionReadQLen, qlen))
+	for name, v := range opts {
+		MustSucceed(t, srv.SetOption(name, v))
+	}
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	chatty, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer chatty.Close()
+	quiet, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer quiet.Close()
+	MustSucceed(t, chatty.Dial(addr))
+	MustSucceed(t, quiet.Dial(addr))
+	waitPipes(t, srv, 2)
+
+	for i := 0; i < qlen*2; i++ {
+		MustSucceed(t, chatty.Send([]byte("chatty")))
+	}
+	time.Sleep(time.Millisecond * 100)
+	MustSucceed(t, quiet.Send([]byte("quiet")))
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < qlen*2+1; i++ {
+		b, err := srv.Recv()
+		MustSucceed(t, err)
+		if string(b) == "quiet" {
+			return i
+		}
+	}
+	t.Fatalf("quiet message not received")
+	return 0
+}
+
+func TestRecvPipeShare(t *testing.T) {
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	n := recvFairRun(t, s, 10, map[string]interface{}{
+		mangos.OptionRecvPipeShare: 2,
+	})
+	MustBeTrue(t, n <= 2)
+}
+
+func TestRecvFair(t *testing.T) {
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	n := recvFairRun(t, s, 8, map[string]interface{}{
+		mangos.OptionRecvFair: true,
+	})
+	MustBeTrue(t, n <= 4)
+}
+
+// TestRecvFairUnset checks that without the options, the chatty peer
+// fills the whole queue, so that the quiet peer's message waits.
+func TestRecvFairUnset(t *testing.T) {
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	n := recvFairRun(t, s, 8, nil)
+	MustBeTrue(t, n >= 8)
+}
+
+// TestRecvFairRaise checks that raising the limit lets a pipe that was
+// held back deliver again.
+func TestRecvFairRaise(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvPipeShare, 1))
+	MustSucceed(t, srv.Listen(addr))
+	cli, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.Dial(addr))
+	waitPipes(t, srv, 1)
+
+	for i := 0; i < 3; i++ {
+		MustSucceed(t, cli.Send([]byte("hello")))
+	}
+	time.Sleep(time.Millisecond * 50)
+	MustBeTrue(t, srv.Stats().Received == 0)
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvPipeShare, 0))
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	for i := 0; i < 3; i++ {
+		_, err := srv.Recv()
+		MustSucceed(t, err)
+	}
+}
+
+// recvFairRep has a REQ send n requests at once, on contexts of its own,
+// to a REP with idle other peers, which takes them on contexts of its
+// own until one waits in vain.  It returns the REP, the contexts with
+// requests received, the one waiting, and the REQ.
+func recvFairRep(t *testing.T, opts map[string]interface{}, idle, n, ctxs int) (mangos.Socket, []mangos.Context, mangos.Context, mangos.Socket) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	for name, v := range opts {
+		MustSucceed(t, srv.SetOption(name, v))
+	}
+	MustSucceed(t, srv.Listen(addr))
+	var sc []mangos.Context
+	for i := 0; i < ctxs; i++ {
+		c, err := srv.OpenContext()
+		MustSucceed(t, err)
+		// REP waits ten times the deadline set.
+		MustSucceed(t, c.SetOption(mangos.OptionRecvDeadline, time.Millisecond*20))
+		sc = append(sc, c)
+	}
+	for i := 0; i < idle; i++ {
+		s, err := req.NewSocket()
+		MustSucceed(t, err)
+		t.Cleanup(func() { s.Close() })
+		MustSucceed(t, s.Dial(addr))
+	}
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, cli.Dial(addr))
+	waitPipes(t, srv, idle+1)
+	// Each waits until the REP takes its request.
+	for i := 0; i < n; i++ {
+		c, err := cli.OpenContext()
+		MustSucceed(t, err)
+		go func() { _ = c.Send([]byte("request")) }()
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	var got []mangos.Context
+	for _, c := range sc {
+		if _, err := c.Recv(); err != nil {
+			MustBeTrue(t, err == mangos.ErrRecvTimeout)
+			return srv, got, c, cli
+		}
+		got = append(got, c)
+	}
+	t.Fatalf("every request received")
+	return nil, nil, nil, nil
+}
+
+func TestRecvPipeShareRep(t *testing.T) {
+	srv, got, waiting, cli := recvFairRep(t, map[string]interface{}{
+		mangos.OptionRecvPipeShare: 2,
+	}, 0, 3, 3)
+	defer srv.Close()
+	defer cli.Close()
+	MustBeTrue(t, len(got) == 2)
+
+	// Answering one makes room for the next.
+	MustSucceed(t, got[0].Send([]byte("reply")))
+	MustSucceed(t, waiting.SetOption(mangos.OptionRecvDeadline, time.Millisecond*100))
+	_, err := waiting.Recv()
+	MustSucceed(t, err)
+}
+
+func TestRecvFairRep(t *testing.T) {
+	// Four contexts, counting the socket's own, and two pipes, allow
+	// two requests to each pipe.
+	srv, got, _, cli := recvFairRep(t, map[string]interface{}{
+		mangos.OptionRecvFair: true,
+	}, 1, 3, 3)
+	defer srv.Close()
+	defer cli.Close()
+	MustBeTrue(t, len(got) == 2)
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func keepOnly(header, body []byte) bool {
+	return len(body) < 1024 && bytes.HasPrefix(body, []byte("keep/"))
+}
+
+func TestRecvFilterBus(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	v, err := s2.GetOption(mangos.OptionRecvFilter)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.RecvFilterFunc) == nil)
+	MustBeTrue(t, s2.SetOption(mangos.OptionRecvFilter, keepOnly) == mangos.ErrBadValue)
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvFilter, mangos.RecvFilterFunc(keepOnly)))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s2.Listen(addr))
+	MustSucceed(t, s1.Dial(addr))
+	waitPipes(t, s2, 1)
+
+	MustSucceed(t, s1.Send([]byte("drop/1")))
+	MustSucceed(t, s1.Send(append([]byte("keep/"), make([]byte, 4096)...)))
+	MustSucceed(t, s1.Send([]byte("keep/1")))
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "keep/1")
+	st := s2.Stats()
+	MustBeTrue(t, st.Filtered == 2)
+	MustBeTrue(t, st.Received == 1)
+
+	// Nothing is filtered once it is taken away.
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvFilter, nil))
+	MustSucceed(t, s1.Send([]byte("drop/2")))
+	b, err = s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "drop/2")
+	MustBeTrue(t, s2.Stats().Filtered == 2)
+}
+
+func TestRecvFilterCredit(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	// What is filtered out gives back its credit, so that the sender
+	// is not held up by messages nobody will take.
+	MustSucceed(t, s2.SetOption(mangos.OptionCreditWindow, 2))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvFilter, mangos.RecvFilterFunc(keepOnly)))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s2.Listen(addr))
+	MustSucceed(t, s1.SetOption(mangos.OptionCreditWindow, 2))
+	MustSucceed(t, s1.Dial(addr))
+	waitPipes(t, s2, 1)
+
+	for i := 0; i < 10; i++ {
+		MustSucceed(t, s1.Send([]byte("drop")))
+	}
+	MustSucceed(t, s1.Send([]byte("keep/last")))
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "keep/last")
+	MustBeTrue(t, s2.Stats().Filtered == 10)
+}
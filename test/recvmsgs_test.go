@@ -0,0 +1,174 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func pushPull(t *testing.T) (mangos.Socket, mangos.Socket) {
+	addr := AddrTestInp()
+	tx, err := push.NewSocket()
+	MustSucceed(t, err)
+	rx, err := pull.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.Listen(addr))
+	MustSucceed(t, tx.Dial(addr))
+	waitPipes(t, rx, 1)
+	return tx, rx
+}
+
+func TestRecvMsgsBatch(t *testing.T) {
+	tx, rx := pushPull(t)
+	defer tx.Close()
+	defer rx.Close()
+
+	for i := 0; i < 10; i++ {
+		MustSucceed(t, tx.Send([]byte{byte(i)}))
+	}
+	// Let them all reach the queue, so that batches are full.
+	time.Sleep(time.Millisecond * 50)
+
+	var got []byte
+	for len(got) < 10 {
+		msgs, err := rx.RecvMsgs(4)
+		MustSucceed(t, err)
+		MustBeTrue(t, len(msgs) > 0 && len(msgs) <= 4)
+		for _, m := range msgs {
+			got = append(got, m.Body...)
+			m.Free()
+		}
+	}
+	for i := range got {
+		MustBeTrue(t, got[i] == byte(i))
+	}
+	MustBeTrue(t, rx.Stats().Received == 10)
+
+	msgs, err := rx.RecvMsgs(4)
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	MustBeTrue(t, msgs == nil)
+	_, err = rx.RecvMsgs(0)
+	MustBeTrue(t, err == mangos.ErrBadValue)
+}
+
+func TestRecvMsgsHooks(t *testing.T) {
+	tx, rx := pushPull(t)
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.AddRecvHook(func(m *mangos.Message) (*mangos.Message, error) {
+		if m.Body[0]%2 != 0 {
+			m.Free()
+			return nil, nil
+		}
+		return m, nil
+	})
+	for i := 0; i < 6; i++ {
+		MustSucceed(t, tx.Send([]byte{byte(i)}))
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	var got []byte
+	for len(got) < 3 {
+		msgs, err := rx.RecvMsgs(10)
+		MustSucceed(t, err)
+		for _, m := range msgs {
+			got = append(got, m.Body...)
+			m.Free()
+		}
+	}
+	MustBeTrue(t, string(got) == "\x00\x02\x04")
+	MustBeTrue(t, rx.Stats().Received == 3)
+	MustBeTrue(t, rx.Stats().HookDropped == 3)
+}
+
+func TestRecvMsgsHookFails(t *testing.T) {
+	tx, rx := pushPull(t)
+	defer tx.Close()
+	defer rx.Close()
+
+	bad := errors.New("bad message")
+	rx.AddRecvHook(func(m *mangos.Message) (*mangos.Message, error) {
+		if m.Body[0] == 3 {
+			m.Free()
+			return nil, bad
+		}
+		return m, nil
+	})
+	for i := 0; i < 10; i++ {
+		MustSucceed(t, tx.Send([]byte{byte(i)}))
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	msgs, err := rx.RecvMsgs(10)
+	MustBeTrue(t, err == bad)
+	MustBeTrue(t, len(msgs) == 3)
+	var got []byte
+	for _, m := range msgs {
+		got = append(got, m.Body...)
+		m.Free()
+	}
+
+	// Those behind the one refused are kept for the next calls.
+	m, err := rx.RecvMsg()
+	MustSucceed(t, err)
+	got = append(got, m.Body...)
+	m.Free()
+	for len(got) < 9 {
+		msgs, err = rx.RecvMsgs(2)
+		MustSucceed(t, err)
+		MustBeTrue(t, len(msgs) > 0 && len(msgs) <= 2)
+		for _, m := range msgs {
+			got = append(got, m.Body...)
+			m.Free()
+		}
+	}
+	MustBeTrue(t, string(got) == "\x00\x01\x02\x04\x05\x06\x07\x08\x09")
+	MustBeTrue(t, rx.Stats().Received == 9)
+}
+
+func TestRecvMsgsUnbatched(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+
+	// REP has no queue to drain, so messages come one at a time.
+	MustSucceed(t, cli.Send([]byte("ping")))
+	msgs, err := srv.RecvMsgs(8)
+	MustSucceed(t, err)
+	MustBeTrue(t, len(msgs) == 1)
+	MustBeTrue(t, string(msgs[0].Body) == "ping")
+	MustSucceed(t, srv.SendMsg(msgs[0]))
+	b, err := cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/star"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	"nanomsg.org/go/mangos/v2/protocol/xbus"
+	"nanomsg.org/go/mangos/v2/protocol/xpair"
+	"nanomsg.org/go/mangos/v2/protocol/xpub"
+	"nanomsg.org/go/mangos/v2/protocol/xpull"
+	"nanomsg.org/go/mangos/v2/protocol/xpush"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	"nanomsg.org/go/mangos/v2/protocol/xreq"
+	"nanomsg.org/go/mangos/v2/protocol/xrespondent"
+	"nanomsg.org/go/mangos/v2/protocol/xstar"
+	"nanomsg.org/go/mangos/v2/protocol/xsub"
+	"nanomsg.org/go/mangos/v2/protocol/xsurveyor"
+)
+
+var protoOptions = []string{
+	mangos.OptionRecvDeadline,
+	mangos.OptionSendDeadline,
+	mangos.OptionRetryTime,
+	mangos.OptionSubscribe,
+	mangos.OptionUnsubscribe,
+	mangos.OptionSurveyTime,
+	mangos.OptionWriteQLen,
+	mangos.OptionReadQLen,
+	mangos.OptionTTL,
+	mangos.OptionBestEffort,
+	mangos.OptionSynchronous,
+}
+
+func checkRegistry(t *testing.T, news func() (mangos.Socket, error), raw bool) {
+	s, err := news()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	info := s.Info()
+	d, ok := mangos.ProtocolByName(info.SelfName)
+	MustBeTrue(t, ok)
+	MustBeTrue(t, d.Number == info.Self)
+	MustBeTrue(t, d.PeerName == info.PeerName)
+	MustBeTrue(t, d.PeerNumber == info.Peer)
+	MustBeTrue(t, d.Compatible(info.Peer))
+	d2, ok := mangos.ProtocolByNumber(info.Self)
+	MustBeTrue(t, ok && d2.Name == d.Name)
+
+	for _, o := range protoOptions {
+		// A nil value is never valid, so a supported option reports
+		// a bad value rather than a bad option.
+		err := s.SetOption(o, nil)
+		if d.ValidOption(o, raw) {
+			if err != mangos.ErrBadValue {
+				t.Errorf("%s: %s should be supported: %v", d.Name, o, err)
+			}
+		} else if !errors.Is(err, mangos.ErrBadOption) {
+			t.Errorf("%s: %s should not be supported: %v", d.Name, o, err)
+		}
+	}
+}
+
+func TestProtocolRegistry(t *testing.T) {
+	cooked := []func() (mangos.Socket, error){
+		bus.NewSocket, pair.NewSocket, pub.NewSocket, sub.NewSocket,
+		pull.NewSocket, push.NewSocket, rep.NewSocket, req.NewSocket,
+		respondent.NewSocket, surveyor.NewSocket, star.NewSocket,
+	}
+	raw := []func() (mangos.Socket, error){
+		xbus.NewSocket, xpair.NewSocket, xpub.NewSocket, xsub.NewSocket,
+		xpull.NewSocket, xpush.NewSocket, xrep.NewSocket,
+		xreq.NewSocket, xrespondent.NewSocket, xsurveyor.NewSocket,
+		xstar.NewSocket,
+	}
+	for _, news := range cooked {
+		checkRegistry(t, news, false)
+	}
+	for _, news := range raw {
+		checkRegistry(t, news, true)
+	}
+	MustBeTrue(t, len(mangos.Protocols()) == len(cooked))
+
+	_, ok := mangos.ProtocolByName("nope")
+	MustBeFalse(t, ok)
+}
+
+// optionNames returns the names of all the options mangos defines.
+func optionNames(t *testing.T) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), "../options.go", nil, 0)
+	MustSucceed(t, err)
+	var names []string
+	for _, decl := range f.Decls {
+		g, ok := decl.(*ast.GenDecl)
+		if !ok || g.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range g.Specs {
+			for _, v := range spec.(*ast.ValueSpec).Values {
+				if lit, ok := v.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					name, err := strconv.Unquote(lit.Value)
+					MustSucceed(t, err)
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	MustBeTrue(t, len(names) > 50)
+	return names
+}
+
+// optionProbe is not a valid value for any option.
+type optionProbe struct{}
+
+// TestProtocolOptionLists walks every option on every protocol, checking
+// that a socket accepts exactly those its description lists, whether or
+// not it is strict, and that it can report them.
+func TestProtocolOptionLists(t *testing.T) {
+	names := optionNames(t)
+	for _, d := range mangos.Protocols() {
+		for _, raw := range []bool{false, true} {
+			news := protocol.NewSocket
+			if raw {
+				news = protocol.NewRawSocket
+			}
+			lax, err := news(d.Name)
+			MustSucceed(t, err)
+			strict, err := news(d.Name)
+			MustSucceed(t, err)
+			MustSucceed(t, strict.SetOption(mangos.OptionStrict, true))
+
+			for _, o := range names {
+				err1 := lax.SetOption(o, optionProbe{})
+				err2 := strict.SetOption(o, optionProbe{})
+				bad := errors.Is(err1, mangos.ErrBadOption)
+				if bad != errors.Is(err2, mangos.ErrBadOption) {
+					t.Errorf("%s raw %v: %s: %v, but strict %v",
+						d.Name, raw, o, err1, err2)
+				}
+				if bad == d.ValidOption(o, raw) {
+					t.Errorf("%s raw %v: %s: listed %v, but %v",
+						d.Name, raw, o, !bad, err1)
+				}
+				if bad || o == mangos.OptionSubscribe ||
+					o == mangos.OptionUnsubscribe {
+					continue
+				}
+				if _, err := lax.GetOption(o); err != nil {
+					t.Errorf("%s raw %v: %s cannot be read: %v",
+						d.Name, raw, o, err)
+				}
+			}
+			MustSucceed(t, lax.Close())
+			MustSucceed(t, strict.Close())
+		}
+	}
+}
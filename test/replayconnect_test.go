@@ -0,0 +1,142 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestReplayOnConnectOptions(t *testing.T) {
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+
+	v, err := p.GetOption(mangos.OptionRetainAge)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == 0)
+	MustFail(t, p.SetOption(mangos.OptionRetainAge, -time.Second))
+	MustFail(t, p.SetOption(mangos.OptionRetainAge, 1))
+	MustSucceed(t, p.SetOption(mangos.OptionRetainAge, time.Minute))
+	v, err = p.GetOption(mangos.OptionRetainAge)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Minute)
+
+	v, err = p.GetOption(mangos.OptionReplayOnConnect)
+	MustSucceed(t, err)
+	MustBeFalse(t, v.(bool))
+	MustFail(t, p.SetOption(mangos.OptionReplayOnConnect, 1))
+	MustSucceed(t, p.SetOption(mangos.OptionReplayOnConnect, true))
+	v, err = p.GetOption(mangos.OptionReplayOnConnect)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+
+	v, err = p.GetOption(mangos.OptionReplayMarker)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.([]byte) == nil)
+	MustFail(t, p.SetOption(mangos.OptionReplayMarker, 1))
+	MustSucceed(t, p.SetOption(mangos.OptionReplayMarker, "mark"))
+	v, err = p.GetOption(mangos.OptionReplayMarker)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(v.([]byte)) == "mark")
+	MustSucceed(t, p.SetOption(mangos.OptionReplayMarker, nil))
+}
+
+func TestReplayOnConnect(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.SetOption(mangos.OptionRetain, 2))
+	MustSucceed(t, p.SetOption(mangos.OptionRetainTopic, prefix))
+	MustSucceed(t, p.SetOption(mangos.OptionReplayOnConnect, true))
+	MustSucceed(t, p.SetOption(mangos.OptionReplayMarker, []byte("live")))
+	MustSucceed(t, p.Listen(addr))
+
+	for _, m := range []string{"a 1", "b 1", "a 2", "a 3", "b 2"} {
+		MustSucceed(t, p.Send([]byte(m)))
+	}
+
+	// Neither asks, but both get the replay, then the marker.  Those
+	// asking as well get it just once.
+	s1 := newReplaySub(t, addr, false, "")
+	defer s1.Close()
+	s2 := newReplaySub(t, addr, true, "")
+	defer s2.Close()
+	waitPipes(t, p, 2)
+	MustSucceed(t, p.Send([]byte("b 3")))
+
+	want := "b 1,a 2,a 3,b 2,live,b 3"
+	MustBeTrue(t, strings.Join(recvAll(s1), ",") == want)
+	MustBeTrue(t, strings.Join(recvAll(s2), ",") == want)
+}
+
+func TestReplayOnConnectWorkers(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.SetOption(mangos.OptionSendWorkers, 2))
+	MustSucceed(t, p.SetOption(mangos.OptionRetain, 100))
+	MustSucceed(t, p.SetOption(mangos.OptionReplayOnConnect, true))
+	MustSucceed(t, p.SetOption(mangos.OptionReplayMarker, "live"))
+	MustSucceed(t, p.Listen(addr))
+
+	// More than fit in a batch.
+	var want []string
+	for i := 0; i < 100; i++ {
+		m := string(rune('A' + i%26))
+		want = append(want, m)
+		MustSucceed(t, p.Send([]byte(m)))
+	}
+	want = append(want, "live")
+
+	s := newReplaySub(t, addr, false, "")
+	defer s.Close()
+	MustBeTrue(t, strings.Join(recvAll(s), ",") == strings.Join(want, ","))
+}
+
+func TestReplayRetainAge(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.SetOption(mangos.OptionRetainAge, time.Millisecond*100))
+	MustSucceed(t, p.SetOption(mangos.OptionRetainTopic, prefix))
+	MustSucceed(t, p.Listen(addr))
+
+	// With no limit on the number, all the recent ones are kept.
+	MustSucceed(t, p.Send([]byte("a 1")))
+	MustSucceed(t, p.Send([]byte("b 1")))
+	time.Sleep(time.Millisecond * 150)
+	for _, m := range []string{"a 2", "a 3", "a 4"} {
+		MustSucceed(t, p.Send([]byte(m)))
+	}
+
+	s := newReplaySub(t, addr, true, "")
+	defer s.Close()
+	MustBeTrue(t, strings.Join(recvAll(s), ",") == "a 2,a 3,a 4")
+
+	// Without either limit, nothing is kept.
+	MustSucceed(t, p.SetOption(mangos.OptionRetainAge, time.Duration(0)))
+	late := newReplaySub(t, addr, true, "")
+	defer late.Close()
+	MustBeTrue(t, len(recvAll(late)) == 0)
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestReqCancel(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := xrep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	strays := make(chan *mangos.Message, 4)
+	MustSucceed(t, cli.SetOption(mangos.OptionReplyMismatch,
+		mangos.ReplyMismatchFunc(func(m *mangos.Message) {
+			strays <- m
+		})))
+	MustSucceed(t, cli.SetOption(mangos.OptionRetryTime,
+		time.Millisecond*50))
+	MustSucceed(t, cli.Dial(addr))
+	waitPipes(t, srv, 1)
+
+	c, err := cli.OpenContext()
+	MustSucceed(t, err)
+	defer c.Close()
+	MustSucceed(t, c.Cancel()) // nothing to cancel yet
+	MustSucceed(t, c.Send([]byte("abandon")))
+	v, err := c.GetOption(mangos.OptionRequestID)
+	MustSucceed(t, err)
+	id := v.(uint32)
+
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Recv()
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	MustSucceed(t, c.Cancel())
+	select {
+	case err := <-done:
+		MustBeTrue(t, err == mangos.ErrCanceled)
+	case <-time.After(time.Second):
+		t.Fatalf("receive not canceled")
+	}
+
+	// It is not sent again.  Any copy resent before the cancel is
+	// taken first.
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline,
+		time.Millisecond*200))
+	for {
+		r, err := srv.RecvMsg()
+		if err != nil {
+			MustBeTrue(t, err == mangos.ErrRecvTimeout)
+			break
+		}
+		r.Free()
+	}
+
+	// A late reply is not taken for the answer to anything.
+	MustSucceed(t, srv.SendMsg(m))
+	select {
+	case stray := <-strays:
+		MustBeTrue(t, stray.RequestID == id)
+		stray.Free()
+	case <-time.After(time.Second):
+		t.Fatalf("late reply not discarded")
+	}
+	_, err = c.Recv()
+	MustBeTrue(t, err == mangos.ErrProtoState)
+
+	// The context can be used again.
+	MustSucceed(t, c.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, c.Send([]byte("again")))
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	m, err = srv.RecvMsg()
+	MustSucceed(t, err)
+	MustSucceed(t, srv.SendMsg(m))
+	b, err := c.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "again")
+
+	MustSucceed(t, c.Close())
+	MustBeTrue(t, c.Cancel() == mangos.ErrClosed)
+}
+
+func TestReqCancelUnsupported(t *testing.T) {
+	s, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	c, err := s.OpenContext()
+	MustSucceed(t, err)
+	defer c.Close()
+	MustBeTrue(t, c.Cancel() == mangos.ErrProtoOp)
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestReqIDMetadata(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := xrep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.Dial(addr))
+	waitPipes(t, srv, 1)
+
+	v, err := cli.GetOption(mangos.OptionRequestID)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(uint32) == 0)
+	MustBeTrue(t, errors.Is(cli.SetOption(mangos.OptionRequestID, uint32(1)),
+		mangos.ErrBadOption))
+
+	MustSucceed(t, cli.Send([]byte("ping")))
+	v, err = cli.GetOption(mangos.OptionRequestID)
+	MustSucceed(t, err)
+	id := v.(uint32)
+	MustBeTrue(t, id != 0)
+
+	// The raw server sees the same ID at the end of the header.
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, len(m.Header) >= 4)
+	MustBeTrue(t, binary.BigEndian.Uint32(m.Header[len(m.Header)-4:]) == id)
+	MustSucceed(t, srv.SendMsg(m))
+
+	r, err := cli.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, r.RequestID == id)
+	MustBeTrue(t, string(r.Body) == "ping")
+	r.Free()
+}
+
+func TestReqIDMismatch(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := xrep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	strays := make(chan *mangos.Message, 4)
+	MustBeTrue(t, errors.Is(cli.SetOption(mangos.OptionReplyMismatch, 1),
+		mangos.ErrBadValue))
+	MustSucceed(t, cli.SetOption(mangos.OptionReplyMismatch,
+		mangos.ReplyMismatchFunc(func(m *mangos.Message) {
+			strays <- m
+		})))
+	v, err := cli.GetOption(mangos.OptionReplyMismatch)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.ReplyMismatchFunc) != nil)
+	MustSucceed(t, cli.Dial(addr))
+	waitPipes(t, srv, 1)
+
+	MustSucceed(t, cli.Send([]byte("once")))
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	id := binary.BigEndian.Uint32(m.Header[len(m.Header)-4:])
+
+	// Answer it twice; the second is a duplicate.
+	MustSucceed(t, srv.SendMsg(m.Dup()))
+	b, err := cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "once")
+	MustSucceed(t, srv.SendMsg(m))
+
+	select {
+	case stray := <-strays:
+		MustBeTrue(t, stray.RequestID == id)
+		MustBeTrue(t, string(stray.Body) == "once")
+		stray.Free()
+	case <-time.After(time.Second):
+		t.Fatalf("no mismatch reported")
+	}
+
+	// With the function cleared, they are quietly dropped again.
+	MustSucceed(t, cli.SetOption(mangos.OptionReplyMismatch, nil))
+	MustSucceed(t, cli.Send([]byte("twice")))
+	m, err = srv.RecvMsg()
+	MustSucceed(t, err)
+	MustSucceed(t, srv.SendMsg(m.Dup()))
+	MustSucceed(t, srv.SendMsg(m))
+	b, err = cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "twice")
+	time.Sleep(time.Millisecond * 50)
+	MustBeTrue(t, len(strays) == 0)
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// prefix uses the first word of a message as its topic.
+func prefix(body []byte) string {
+	return strings.SplitN(string(body), " ", 2)[0]
+}
+
+func TestRetainOptions(t *testing.T) {
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+
+	v, err := p.GetOption(mangos.OptionRetain)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+	MustFail(t, p.SetOption(mangos.OptionRetain, -1))
+	MustFail(t, p.SetOption(mangos.OptionRetain, "2"))
+	MustSucceed(t, p.SetOption(mangos.OptionRetain, 2))
+	v, err = p.GetOption(mangos.OptionRetain)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 2)
+
+	MustSucceed(t, p.SetOption(mangos.OptionRetainTopic, prefix))
+	MustSucceed(t, p.SetOption(mangos.OptionRetainTopic, mangos.RetainTopicFunc(prefix)))
+	MustSucceed(t, p.SetOption(mangos.OptionRetainTopic, nil))
+	MustFail(t, p.SetOption(mangos.OptionRetainTopic, 1))
+
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err = s.GetOption(mangos.OptionReplay)
+	MustSucceed(t, err)
+	MustBeFalse(t, v.(bool))
+	MustFail(t, s.SetOption(mangos.OptionReplay, 1))
+	MustSucceed(t, s.SetOption(mangos.OptionReplay, true))
+	v, err = s.GetOption(mangos.OptionReplay)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+}
+
+func newReplaySub(t *testing.T, addr string, replay bool, topic string) mangos.Socket {
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionReplay, replay))
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte(topic)))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+	MustSucceed(t, s.Dial(addr))
+	return s
+}
+
+func recvAll(s mangos.Socket) []string {
+	var got []string
+	for {
+		b, err := s.Recv()
+		if err != nil {
+			return got
+		}
+		got = append(got, string(b))
+	}
+}
+
+func TestRetainReplay(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.SetOption(mangos.OptionRetain, 2))
+	MustSucceed(t, p.SetOption(mangos.OptionRetainTopic, prefix))
+	MustSucceed(t, p.Listen(addr))
+
+	for _, m := range []string{"a 1", "b 1", "a 2", "a 3", "b 2", "c 1", "b 3"} {
+		MustSucceed(t, p.Send([]byte(m)))
+	}
+
+	all := newReplaySub(t, addr, true, "")
+	defer all.Close()
+	some := newReplaySub(t, addr, true, "b")
+	defer some.Close()
+	none := newReplaySub(t, addr, false, "")
+	defer none.Close()
+	waitPipes(t, p, 3)
+
+	got := recvAll(all)
+	MustBeTrue(t, strings.Join(got, ",") == "a 2,a 3,b 2,c 1,b 3")
+	got = recvAll(some)
+	MustBeTrue(t, strings.Join(got, ",") == "b 2,b 3")
+	MustBeTrue(t, len(recvAll(none)) == 0)
+
+	// Live messages still arrive, and are not replayed twice.
+	MustSucceed(t, p.Send([]byte("b 4")))
+	MustBeTrue(t, strings.Join(recvAll(some), ",") == "b 4")
+
+	// Shrinking the limit discards the oldest.
+	MustSucceed(t, p.SetOption(mangos.OptionRetain, 1))
+	late := newReplaySub(t, addr, true, "")
+	defer late.Close()
+	got = recvAll(late)
+	MustBeTrue(t, strings.Join(got, ",") == "a 3,c 1,b 4")
+}
+
+func TestRetainBodies(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.SetOption(mangos.OptionRetain, 1))
+	MustSucceed(t, p.SetOption(mangos.OptionRetainTopic, prefix))
+	MustSucceed(t, p.Listen(addr))
+
+	// The topic is found in the whole body, segments and all, and the
+	// history keeps a copy of them, which later changes do not touch.
+	var bufs [][]byte
+	for _, s := range []string{"x 1", "y 1"} {
+		b := []byte(s)
+		bufs = append(bufs, b)
+		m := mangos.NewMessage(0)
+		m.Bodies = [][]byte{b}
+		MustSucceed(t, p.SendMsg(m))
+	}
+	for _, b := range bufs {
+		copy(b[2:], "9")
+	}
+
+	s := newReplaySub(t, addr, true, "")
+	defer s.Close()
+	MustBeTrue(t, strings.Join(recvAll(s), ",") == "x 1,y 1")
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// countingRetry records the attempts it is asked about.
+type countingRetry struct {
+	sync.Mutex
+	delay    time.Duration
+	attempts []int
+	resets   int
+}
+
+func (r *countingRetry) NextDelay(attempt int) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	r.attempts = append(r.attempts, attempt)
+	return r.delay
+}
+
+func (r *countingRetry) Reset() {
+	r.Lock()
+	r.resets++
+	r.Unlock()
+}
+
+func (r *countingRetry) state() ([]int, int) {
+	r.Lock()
+	defer r.Unlock()
+	return append([]int(nil), r.attempts...), r.resets
+}
+
+func TestRetryStock(t *testing.T) {
+	ms := time.Millisecond
+
+	c := mangos.ConstantRetry(ms * 5)
+	MustBeTrue(t, c.NextDelay(0) == ms*5)
+	MustBeTrue(t, c.NextDelay(100) == ms*5)
+
+	e := mangos.ExponentialRetry{Min: ms * 10, Max: ms * 50}
+	for i, want := range []time.Duration{10, 20, 40, 50, 50} {
+		MustBeTrue(t, e.NextDelay(i) == want*ms)
+	}
+	MustBeTrue(t, e.NextDelay(1<<30) == ms*50)
+	MustBeTrue(t, mangos.ExponentialRetry{Min: ms}.NextDelay(1000) > 0)
+
+	e.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := e.NextDelay(1)
+		MustBeTrue(t, d > ms*10 && d <= ms*20)
+	}
+
+	f := mangos.FibonacciRetry{Min: ms * 10, Max: ms * 60}
+	for i, want := range []time.Duration{10, 10, 20, 30, 50, 60, 60} {
+		MustBeTrue(t, f.NextDelay(i) == want*ms)
+	}
+	MustBeTrue(t, mangos.FibonacciRetry{}.NextDelay(10) == 0)
+}
+
+func TestRetryReconnectPolicy(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	MustBeTrue(t, s2.SetOption(mangos.OptionReconnectPolicy, 5) ==
+		mangos.ErrBadValue)
+	rp := &countingRetry{delay: time.Millisecond * 10}
+	MustSucceed(t, s2.SetOption(mangos.OptionReconnectPolicy, rp))
+	v, err := s2.GetOption(mangos.OptionReconnectPolicy)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == mangos.RetryPolicy(rp))
+
+	d, err := s2.NewDialer(addr, map[string]interface{}{
+		mangos.OptionDialAsynch: true,
+	})
+	MustSucceed(t, err)
+	MustSucceed(t, d.Dial())
+
+	// Nobody is listening, so the attempts pile up.
+	for i := 0; i < 100; i++ {
+		if a, _ := rp.state(); len(a) >= 3 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	attempts, resets := rp.state()
+	MustBeTrue(t, len(attempts) >= 3)
+	for i, a := range attempts {
+		MustBeTrue(t, a == i)
+	}
+	MustBeTrue(t, resets == 0)
+
+	MustSucceed(t, s1.Listen(addr))
+	waitPipes(t, s2, 1)
+	for i := 0; i < 100; i++ {
+		if _, n := rp.state(); n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_, resets = rp.state()
+	MustBeTrue(t, resets == 1)
+
+	MustSucceed(t, d.SetOption(mangos.OptionReconnectPolicy, nil))
+	v, err = d.GetOption(mangos.OptionReconnectPolicy)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == nil)
+}
+
+func TestRetryRequestPolicy(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	rp := &countingRetry{delay: time.Millisecond * 20}
+	MustSucceed(t, cli.SetOption(mangos.OptionRetryPolicy, rp))
+	MustBeTrue(t, cli.SetOption(mangos.OptionRetryPolicy, "x") ==
+		mangos.ErrBadValue)
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+
+	// Contexts start with the socket's policy.
+	ctx, err := cli.OpenContext()
+	MustSucceed(t, err)
+	v, err := ctx.GetOption(mangos.OptionRetryPolicy)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == mangos.RetryPolicy(rp))
+	MustSucceed(t, ctx.Close())
+
+	// The first copy goes unanswered, so it is sent again.
+	MustSucceed(t, cli.Send([]byte("ping")))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+	b, err = srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+	MustSucceed(t, srv.Send([]byte("pong")))
+	b, err = cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "pong")
+
+	attempts, resets := rp.state()
+	MustBeTrue(t, len(attempts) >= 2)
+	MustBeTrue(t, attempts[0] == 0 && attempts[1] == 1)
+	MustBeTrue(t, resets == 1)
+
+	// A new request counts from zero again.
+	MustSucceed(t, cli.Send([]byte("again")))
+	_, err = srv.Recv()
+	MustSucceed(t, err)
+	attempts, _ = rp.state()
+	MustBeTrue(t, attempts[len(attempts)-1] == 0)
+}
@@ -0,0 +1,386 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/revocation"
+)
+
+func leafCert(t *testing.T, c tls.Certificate) *x509.Certificate {
+	cert, err := x509.ParseCertificate(c.Certificate[0])
+	MustSucceed(t, err)
+	return cert
+}
+
+func (vc *verifyCerts) crl(t *testing.T, revoked ...*x509.Certificate) *x509.RevocationList {
+	return vc.crlAt(t, time.Now().Add(-time.Minute), time.Now().Add(time.Hour), revoked...)
+}
+
+func (vc *verifyCerts) crlAt(t *testing.T, this, next time.Time, revoked ...*x509.Certificate) *x509.RevocationList {
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: this,
+		NextUpdate: next,
+	}
+	for _, c := range revoked {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{
+				SerialNumber:   c.SerialNumber,
+				RevocationTime: time.Now(),
+			})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, vc.caCert, vc.caKey)
+	MustSucceed(t, err)
+	l, err := x509.ParseRevocationList(der)
+	MustSucceed(t, err)
+	return l
+}
+
+func (vc *verifyCerts) ocspResponse(t *testing.T, cert *x509.Certificate, status int) []byte {
+	return vc.ocspResponseAt(t, cert, status, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+}
+
+func (vc *verifyCerts) ocspResponseAt(t *testing.T, cert *x509.Certificate, status int, this, next time.Time) []byte {
+	b, err := ocsp.CreateResponse(vc.caCert, vc.caCert, ocsp.Response{
+		Status:       status,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   this,
+		NextUpdate:   next,
+		RevokedAt:    time.Now().Add(-time.Minute),
+	}, vc.caKey)
+	MustSucceed(t, err)
+	return b
+}
+
+type revTest struct {
+	t      *testing.T
+	vc     *verifyCerts
+	addr   string
+	srv    mangos.Socket
+	server tls.Certificate
+	reject chan struct{}
+}
+
+func newRevTest(t *testing.T, vc *verifyCerts, opts map[string]interface{}) *revTest {
+	rt := &revTest{
+		t:      t,
+		vc:     vc,
+		addr:   AddrTestTLS(),
+		server: vc.leaf(t, "server"),
+		reject: make(chan struct{}, 10),
+	}
+	// Include the issuer, for those that need it.
+	rt.server.Certificate = append(rt.server.Certificate, vc.caCert.Raw)
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventRejected {
+			rt.reject <- struct{}{}
+		}
+	})
+	lopts := map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{rt.server},
+			ClientCAs:    vc.pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+	}
+	for n, v := range opts {
+		lopts[n] = v
+	}
+	MustSucceed(t, srv.ListenOptions(rt.addr, lopts))
+	rt.srv = srv
+	return rt
+}
+
+func (rt *revTest) dial(cert tls.Certificate, opts map[string]interface{}) (mangos.Socket, error) {
+	cli, err := pair.NewSocket()
+	MustSucceed(rt.t, err)
+	dopts := map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      rt.vc.pool,
+			ServerName:   "127.0.0.1",
+		},
+	}
+	for n, v := range opts {
+		dopts[n] = v
+	}
+	return cli, cli.DialOptions(rt.addr, dopts)
+}
+
+func (rt *revTest) rejected() {
+	select {
+	case <-rt.reject:
+	case <-time.After(time.Second * 5):
+		rt.t.Fatalf("rejection not reported")
+	}
+}
+
+func TestTLSRevocationCRL(t *testing.T) {
+	vc := newVerifyCerts(t)
+	good := vc.leaf(t, "good")
+	bad := vc.leaf(t, "bad")
+	crl := revocation.NewCRL(vc.crl(t, leafCert(t, bad)))
+	rt := newRevTest(t, vc, map[string]interface{}{
+		mangos.OptionTLSRevocation: crl,
+	})
+	defer rt.srv.Close()
+
+	// The listener refuses a revoked client.
+	cli, err := rt.dial(bad, nil)
+	MustFail(t, err)
+	cli.Close()
+	rt.rejected()
+
+	cli, err = rt.dial(good, nil)
+	MustSucceed(t, err)
+	cli.Close()
+
+	// And a dialer refuses a revoked server.
+	crl.Add(vc.crl(t, leafCert(t, rt.server)))
+	cli, err = rt.dial(good, map[string]interface{}{
+		mangos.OptionTLSRevocation: crl,
+	})
+	MustBeTrue(t, err == mangos.ErrTLSRevoked)
+	cli.Close()
+
+	// Lists from elsewhere are only trusted when not strict.
+	other := newVerifyCerts(t)
+	c := revocation.NewCRL(other.crl(t))
+	MustSucceed(t, c.CheckRevocation(leafCert(t, good), vc.caCert, nil))
+	c.Strict = true
+	MustBeTrue(t, c.CheckRevocation(leafCert(t, good), vc.caCert, nil) == mangos.ErrTLSNoStatus)
+}
+
+func TestTLSRevocationStaple(t *testing.T) {
+	vc := newVerifyCerts(t)
+	var status int32 = ocsp.Good
+	rt := newRevTest(t, vc, map[string]interface{}{
+		mangos.OptionTLSOCSPStaple: func(c *tls.Certificate) ([]byte, error) {
+			return vc.ocspResponse(t, leafCert(t, *c), int(atomic.LoadInt32(&status))), nil
+		},
+	})
+	defer rt.srv.Close()
+	// No responder to ask, so only the staple can help us.
+	check := map[string]interface{}{
+		mangos.OptionTLSRevocation: &revocation.OCSP{Strict: true},
+	}
+
+	cli, err := rt.dial(vc.leaf(t, "client"), check)
+	MustSucceed(t, err)
+	cli.Close()
+
+	atomic.StoreInt32(&status, ocsp.Revoked)
+	cli, err = rt.dial(vc.leaf(t, "client"), check)
+	MustBeTrue(t, err == mangos.ErrTLSRevoked)
+	cli.Close()
+}
+
+func TestTLSRevocationResponder(t *testing.T) {
+	vc := newVerifyCerts(t)
+	var queries int32
+	var status int32 = ocsp.Good
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&queries, 1)
+		w.Write(vc.ocspResponse(t, &x509.Certificate{SerialNumber: req.SerialNumber},
+			int(atomic.LoadInt32(&status))))
+	}))
+	defer responder.Close()
+	vc.ocsp = responder.URL
+
+	// The listener staples what the responder tells it, and caches it.
+	stapler := &revocation.Stapler{}
+	rt := newRevTest(t, vc, map[string]interface{}{
+		mangos.OptionTLSOCSPStaple: mangos.OCSPStapleFunc(stapler.Staple),
+		mangos.OptionTLSRevocation: &revocation.OCSP{},
+	})
+	defer rt.srv.Close()
+	check := map[string]interface{}{
+		mangos.OptionTLSRevocation: &revocation.OCSP{Strict: true},
+	}
+	for i := 0; i < 3; i++ {
+		cli, err := rt.dial(vc.leaf(t, "client"), check)
+		MustSucceed(t, err)
+		cli.Close()
+	}
+	// One for the staple, and one for each client asked about by the
+	// listener.
+	MustBeTrue(t, atomic.LoadInt32(&queries) == 4)
+
+	// A revoked client is found out by asking.
+	atomic.StoreInt32(&status, ocsp.Revoked)
+	cli, err := rt.dial(vc.leaf(t, "client"), nil)
+	MustFail(t, err)
+	cli.Close()
+	rt.rejected()
+}
+
+func TestTLSRevocationCRLStale(t *testing.T) {
+	vc := newVerifyCerts(t)
+	good := leafCert(t, vc.leaf(t, "good"))
+	bad := leafCert(t, vc.leaf(t, "bad"))
+	now := time.Now()
+
+	// Lists that are out of date, or not yet in force, are believed
+	// only about what they revoke.
+	for _, l := range []*x509.RevocationList{
+		vc.crlAt(t, now.Add(-time.Hour*2), now.Add(-time.Hour), bad),
+		vc.crlAt(t, now.Add(time.Hour), now.Add(time.Hour*2), bad),
+	} {
+		c := revocation.NewCRL(l)
+		MustBeTrue(t, c.CheckRevocation(bad, vc.caCert, nil) == mangos.ErrTLSRevoked)
+		MustSucceed(t, c.CheckRevocation(good, vc.caCert, nil))
+		c.Strict = true
+		MustBeTrue(t, c.CheckRevocation(bad, vc.caCert, nil) == mangos.ErrTLSRevoked)
+		MustBeTrue(t, c.CheckRevocation(good, vc.caCert, nil) == mangos.ErrTLSNoStatus)
+	}
+
+	// Within the allowance for clock skew, a list is still current.
+	c := revocation.NewCRL(vc.crlAt(t, now.Add(-time.Hour), now.Add(-time.Minute), bad))
+	c.Strict = true
+	MustSucceed(t, c.CheckRevocation(good, vc.caCert, nil))
+}
+
+func TestTLSRevocationOCSPStale(t *testing.T) {
+	vc := newVerifyCerts(t)
+	cert := leafCert(t, vc.leaf(t, "client"))
+	now := time.Now()
+	o := &revocation.OCSP{Strict: true}
+
+	// An old response may not be replayed, nor one from the future
+	// used; with no responder to ask, there is no status.
+	old := vc.ocspResponseAt(t, cert, ocsp.Good, now.Add(-time.Hour*2), now.Add(-time.Hour))
+	MustBeTrue(t, o.CheckRevocation(cert, vc.caCert, old) == mangos.ErrTLSNoStatus)
+	early := vc.ocspResponseAt(t, cert, ocsp.Good, now.Add(time.Hour), now.Add(time.Hour*2))
+	MustBeTrue(t, o.CheckRevocation(cert, vc.caCert, early) == mangos.ErrTLSNoStatus)
+	MustSucceed(t, o.CheckRevocation(cert, vc.caCert, vc.ocspResponse(t, cert, ocsp.Good)))
+}
+
+func TestTLSRevocationOCSPExpiry(t *testing.T) {
+	vc := newVerifyCerts(t)
+	var queries int32
+	var life int64 = int64(time.Second * 2)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&queries, 1)
+		now := time.Now()
+		w.Write(vc.ocspResponseAt(t, &x509.Certificate{SerialNumber: req.SerialNumber},
+			ocsp.Good, now.Add(-time.Hour),
+			now.Add(time.Duration(atomic.LoadInt64(&life)))))
+	}))
+	defer responder.Close()
+	vc.ocsp = responder.URL
+	cert := leafCert(t, vc.leaf(t, "client"))
+	o := &revocation.OCSP{Strict: true}
+
+	// The response is cached until its NextUpdate time, which is
+	// given to the second.
+	MustSucceed(t, o.CheckRevocation(cert, vc.caCert, nil))
+	MustSucceed(t, o.CheckRevocation(cert, vc.caCert, nil))
+	MustBeTrue(t, atomic.LoadInt32(&queries) == 1)
+	time.Sleep(time.Millisecond * 2100)
+	MustSucceed(t, o.CheckRevocation(cert, vc.caCert, nil))
+	MustBeTrue(t, atomic.LoadInt32(&queries) == 2)
+
+	// A responder giving stale answers gives no status.
+	atomic.StoreInt64(&life, int64(-time.Hour))
+	o = &revocation.OCSP{Strict: true}
+	MustBeTrue(t, o.CheckRevocation(cert, vc.caCert, nil) == mangos.ErrTLSNoStatus)
+	MustBeTrue(t, o.CheckRevocation(cert, vc.caCert, nil) == mangos.ErrTLSNoStatus)
+	MustBeTrue(t, atomic.LoadInt32(&queries) == 4)
+
+	// And the stapler will not staple them.
+	server := vc.leaf(t, "server")
+	server.Certificate = append(server.Certificate, vc.caCert.Raw)
+	_, err := (&revocation.Stapler{}).Staple(&server)
+	MustFail(t, err)
+}
+
+type flipChecker struct {
+	revoked int32
+}
+
+func (f *flipChecker) CheckRevocation(_, _ *x509.Certificate, _ []byte) error {
+	if atomic.LoadInt32(&f.revoked) != 0 {
+		return mangos.ErrTLSRevoked
+	}
+	return nil
+}
+
+func TestTLSRevocationInterval(t *testing.T) {
+	vc := newVerifyCerts(t)
+	fc := &flipChecker{}
+	rt := newRevTest(t, vc, map[string]interface{}{
+		mangos.OptionTLSRevocation:         fc,
+		mangos.OptionTLSRevocationInterval: time.Millisecond * 20,
+	})
+	defer rt.srv.Close()
+
+	cli, err := rt.dial(vc.leaf(t, "client"), nil)
+	MustSucceed(t, err)
+	defer cli.Close()
+	for i := 0; rt.srv.Stats().Pipes == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 50)
+	MustBeTrue(t, rt.srv.Stats().Pipes == 1)
+
+	// Once revoked, the connection is dropped.
+	atomic.StoreInt32(&fc.revoked, 1)
+	for i := 0; rt.srv.Stats().Pipes != 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	MustBeTrue(t, rt.srv.Stats().Pipes == 0)
+}
+
+func TestTLSRevocationOptions(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	d, err := s.NewDialer(AddrTestTLS(), nil)
+	MustSucceed(t, err)
+	MustSucceed(t, d.SetOption(mangos.OptionTLSRevocation, &revocation.OCSP{}))
+	MustSucceed(t, d.SetOption(mangos.OptionTLSRevocationInterval, time.Minute))
+	MustBeTrue(t, errors.Is(d.SetOption(mangos.OptionTLSRevocation, "yes"), mangos.ErrBadValue))
+	MustBeTrue(t, errors.Is(d.SetOption(mangos.OptionTLSRevocationInterval, -time.Second), mangos.ErrBadValue))
+	MustBeTrue(t, errors.Is(d.SetOption(mangos.OptionTLSOCSPStaple, 3), mangos.ErrBadValue))
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/transport"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+	_ "nanomsg.org/go/mangos/v2/transport/ws"
+)
+
+func TestResolveTCPAddrs(t *testing.T) {
+	addrs, err := transport.ResolveTCPAddrs("tcp", "localhost:5555")
+	MustSucceed(t, err)
+	MustBeTrue(t, len(addrs) > 0)
+	for _, a := range addrs {
+		MustBeTrue(t, a.Port == 5555)
+	}
+	addrs, err = transport.ResolveTCPAddrs("tcp4", "127.0.0.1:5555")
+	MustSucceed(t, err)
+	MustBeTrue(t, len(addrs) == 1 && addrs[0].IP.Equal(net.IPv4(127, 0, 0, 1)))
+	_, err = transport.ResolveTCPAddrs("tcp6", "127.0.0.1:5555")
+	MustFail(t, err)
+	_, err = transport.ResolveTCPAddrs("tcp", "localhost")
+	MustFail(t, err)
+}
+
+func TestDialRotateOption(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	for _, addr := range []string{AddrTestTCP(), AddrTestTLS(), AddrTestWS()} {
+		d, err := s.NewDialer(addr, nil)
+		MustSucceed(t, err)
+		MustSucceed(t, d.SetOption(mangos.OptionDialRotate, true))
+		v, err := d.GetOption(mangos.OptionDialRotate)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(bool))
+		MustBeTrue(t, d.SetOption(mangos.OptionDialRotate, 1) == mangos.ErrBadValue)
+	}
+}
+
+// TestDialRotateReconnect dials a host name with rotation, and checks
+// that it connects, and connects again after the pipe is lost.
+func TestDialRotateReconnect(t *testing.T) {
+	for _, addr := range []string{AddrTestTCP(), AddrTestWS()} {
+		srv, err := pair.NewSocket()
+		MustSucceed(t, err)
+		MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+		MustSucceed(t, srv.Listen(addr))
+
+		cli, err := pair.NewSocket()
+		MustSucceed(t, err)
+		MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+		named := strings.Replace(addr, "127.0.0.1", "localhost", 1)
+		MustSucceed(t, cli.DialOptions(named, map[string]interface{}{
+			mangos.OptionDialRotate: true,
+		}))
+		for i := 0; i < 3; i++ {
+			MustSucceed(t, cli.Send([]byte("hello")))
+			m, err := srv.RecvMsg()
+			MustSucceed(t, err)
+			m.Pipe.Close()
+			m.Free()
+			for cli.Stats().Reconnects < uint64(i+1) {
+				time.Sleep(time.Millisecond * 10)
+			}
+		}
+		MustSucceed(t, cli.Close())
+		MustSucceed(t, srv.Close())
+	}
+}
+
+func TestDialStaggerOption(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	for _, addr := range []string{AddrTestTCP(), AddrTestTLS(), AddrTestWS()} {
+		d, err := s.NewDialer(addr, nil)
+		MustSucceed(t, err)
+		MustSucceed(t, d.SetOption(mangos.OptionDialStagger, time.Millisecond*250))
+		v, err := d.GetOption(mangos.OptionDialStagger)
+		MustSucceed(t, err)
+		MustBeTrue(t, v.(time.Duration) == time.Millisecond*250)
+		MustBeTrue(t, d.SetOption(mangos.OptionDialStagger, -time.Second) == mangos.ErrBadValue)
+		MustBeTrue(t, d.SetOption(mangos.OptionDialStagger, 1) == mangos.ErrBadValue)
+	}
+}
+
+// TestDialStaggerReconnect dials a host name with staggered attempts,
+// and checks that it connects, and connects again after the pipe is
+// lost.  Only the IPv4 loopback address is listened on, so where the
+// name also resolves to the IPv6 one, that attempt fails and the other
+// must be made.
+func TestDialStaggerReconnect(t *testing.T) {
+	for _, addr := range []string{AddrTestTCP(), AddrTestWS()} {
+		for _, rotate := range []bool{false, true} {
+			srv, err := pair.NewSocket()
+			MustSucceed(t, err)
+			MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+			MustSucceed(t, srv.Listen(addr))
+
+			cli, err := pair.NewSocket()
+			MustSucceed(t, err)
+			MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+			named := strings.Replace(addr, "127.0.0.1", "localhost", 1)
+			MustSucceed(t, cli.DialOptions(named, map[string]interface{}{
+				mangos.OptionDialStagger: time.Second * 5,
+				mangos.OptionDialRotate:  rotate,
+			}))
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				MustSucceed(t, cli.Send([]byte("hello")))
+				m, err := srv.RecvMsg()
+				MustSucceed(t, err)
+				m.Pipe.Close()
+				m.Free()
+				for cli.Stats().Reconnects < uint64(i+1) {
+					time.Sleep(time.Millisecond * 10)
+				}
+			}
+			// A failed attempt starts the next at once, rather than
+			// after the stagger interval.
+			MustBeTrue(t, time.Since(start) < time.Second*5)
+			MustSucceed(t, cli.Close())
+			MustSucceed(t, srv.Close())
+		}
+	}
+}
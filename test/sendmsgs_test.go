@@ -0,0 +1,195 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// batchMsg returns the i'th message of a batch; every tenth is large
+// enough to be compressed, if compression is on.
+func batchMsg(i int) []byte {
+	b := []byte{byte(i), byte(i >> 8)}
+	if i%10 == 0 {
+		b = append(b, bytes.Repeat([]byte("x"), 2000)...)
+	}
+	return b
+}
+
+func testSendMsgs(t *testing.T, addr string, comp string) {
+	tx, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	rx, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer rx.Close()
+	if comp != "" {
+		MustSucceed(t, tx.SetOption(mangos.OptionCompression, comp))
+		MustSucceed(t, rx.SetOption(mangos.OptionCompression, comp))
+	}
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.SetOption(mangos.OptionReadQLen, 1000))
+	MustSucceed(t, tx.SetOption(mangos.OptionWriteQLen, 1000))
+	MustSucceed(t, rx.Listen(addr))
+	MustSucceed(t, tx.Dial(addr))
+	waitPipes(t, tx, 1)
+
+	const count = 500
+	msgs := make([]*mangos.Message, 0, count)
+	for i := 0; i < count; i++ {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, batchMsg(i)...)
+		msgs = append(msgs, m)
+	}
+	MustSucceed(t, tx.SendMsgs(msgs))
+	MustBeTrue(t, tx.Stats().Sent == count)
+
+	for i := 0; i < count; i++ {
+		b, err := rx.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, bytes.Equal(b, batchMsg(i)))
+	}
+}
+
+func TestSendMsgsTCP(t *testing.T) {
+	testSendMsgs(t, AddrTestTCP(), "")
+}
+
+func TestSendMsgsCompressed(t *testing.T) {
+	testSendMsgs(t, AddrTestTCP(), "gzip")
+}
+
+func TestSendMsgsIPC(t *testing.T) {
+	testSendMsgs(t, AddrTestIPC(), "")
+}
+
+func TestSendMsgsInp(t *testing.T) {
+	testSendMsgs(t, AddrTestInp(), "")
+}
+
+func TestSendMsgsPub(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 1000))
+	MustSucceed(t, s.Listen(addr))
+
+	var subs []mangos.Socket
+	for i := 0; i < 3; i++ {
+		r, err := sub.NewSocket()
+		MustSucceed(t, err)
+		defer r.Close()
+		MustSucceed(t, r.SetOption(mangos.OptionSubscribe, []byte{}))
+		MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second))
+		MustSucceed(t, r.SetOption(mangos.OptionReadQLen, 1000))
+		MustSucceed(t, r.Dial(addr))
+		subs = append(subs, r)
+	}
+	waitPipes(t, s, len(subs))
+	time.Sleep(time.Millisecond * 50)
+
+	const count = 1000
+	msgs := make([]*mangos.Message, 0, count)
+	for i := 0; i < count; i++ {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, byte(i), byte(i>>8))
+		msgs = append(msgs, m)
+	}
+	MustSucceed(t, s.SendMsgs(msgs))
+	for _, r := range subs {
+		for i := 0; i < count; i++ {
+			b, err := r.Recv()
+			MustSucceed(t, err)
+			MustBeTrue(t, bytes.Equal(b, []byte{byte(i), byte(i >> 8)}))
+		}
+	}
+}
+
+func TestSendMsgsHooks(t *testing.T) {
+	tx, rx := hookPair(t)
+	defer tx.Close()
+	defer rx.Close()
+
+	errInvalid := errors.New("invalid message")
+	tx.AddSendHook(func(m *mangos.Message) (*mangos.Message, error) {
+		switch string(m.Body) {
+		case "bad":
+			return nil, errInvalid
+		case "skip":
+			m.Free()
+			return nil, nil
+		}
+		return m, nil
+	})
+	var msgs []*mangos.Message
+	for _, s := range []string{"one", "skip", "two", "bad", "three", "four"} {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, s...)
+		msgs = append(msgs, m)
+	}
+	// Those left unsent are freed, which a reference held shows.
+	msgs[4].Retain()
+	msgs[5].Retain()
+	MustBeTrue(t, tx.SendMsgs(msgs) == errInvalid)
+	MustBeTrue(t, tx.Stats().Sent == 2)
+	MustBeTrue(t, tx.Stats().HookDropped == 1)
+	MustBeFalse(t, msgs[4].Shared())
+	MustBeFalse(t, msgs[5].Shared())
+	msgs[4].Free()
+	msgs[5].Free()
+
+	for _, s := range []string{"one", "two"} {
+		b, err := rx.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == s)
+	}
+	MustSucceed(t, tx.SendMsgs(nil))
+}
+
+func TestSendMsgsTimeoutFrees(t *testing.T) {
+	tx, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer tx.Close()
+	MustSucceed(t, tx.SetOption(mangos.OptionWriteQLen, 1))
+	MustSucceed(t, tx.SetOption(mangos.OptionSendDeadline, time.Millisecond*10))
+
+	// With no peer, the first is queued, and the second times out.
+	var msgs []*mangos.Message
+	for i := 0; i < 3; i++ {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, byte(i))
+		msgs = append(msgs, m.Retain())
+	}
+	MustBeTrue(t, tx.SendMsgs(msgs) == mangos.ErrSendTimeout)
+	MustBeTrue(t, tx.Stats().Sent == 1)
+	MustBeTrue(t, msgs[0].Shared())
+	MustBeFalse(t, msgs[1].Shared())
+	MustBeFalse(t, msgs[2].Shared())
+	for _, m := range msgs {
+		m.Free()
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// settledGoroutines returns the number of goroutines, once those left
+// over from earlier tests have finished.
+func settledGoroutines() int {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		time.Sleep(time.Millisecond * 20)
+		m := runtime.NumGoroutine()
+		if m == n {
+			break
+		}
+		n = m
+	}
+	return n
+}
+
+// fanOut connects n subscribers to a publisher with the given number of
+// send workers, sends them count messages, and checks that each gets
+// them all, in order.  It returns how many goroutines were added.
+func fanOut(t *testing.T, workers, n, count int) int {
+	addr := AddrTestTCP()
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSendWorkers, workers))
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, count))
+	MustSucceed(t, s.Listen(addr))
+
+	before := settledGoroutines()
+	var subs []mangos.Socket
+	for i := 0; i < n; i++ {
+		r, err := sub.NewSocket()
+		MustSucceed(t, err)
+		defer r.Close()
+		MustSucceed(t, r.SetOption(mangos.OptionSubscribe, []byte{}))
+		MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+		MustSucceed(t, r.SetOption(mangos.OptionReadQLen, count))
+		MustSucceed(t, r.Dial(addr))
+		subs = append(subs, r)
+	}
+	waitPipes(t, s, n)
+	added := settledGoroutines() - before
+
+	for i := 0; i < count; i++ {
+		MustSucceed(t, s.Send([]byte{byte(i)}))
+	}
+	for _, r := range subs {
+		for i := 0; i < count; i++ {
+			b, err := r.Recv()
+			MustSucceed(t, err)
+			MustBeTrue(t, b[0] == byte(i))
+		}
+	}
+	return added
+}
+
+func TestSendWorkers(t *testing.T) {
+	own := fanOut(t, 0, 50, 100)
+	shared := fanOut(t, 2, 50, 100)
+	// One sender fewer for each subscriber.
+	MustBeTrue(t, own-shared >= 45)
+}
+
+func TestSendWorkersOption(t *testing.T) {
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	v, err := s.GetOption(mangos.OptionSendWorkers)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+	MustSucceed(t, s.SetOption(mangos.OptionSendWorkers, 4))
+	v, err = s.GetOption(mangos.OptionSendWorkers)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 4)
+	MustSucceed(t, s.SetOption(mangos.OptionSendWorkers, 1))
+	MustFail(t, s.SetOption(mangos.OptionSendWorkers, -1))
+	MustFail(t, s.SetOption(mangos.OptionSendWorkers, "many"))
+	MustSucceed(t, s.Close())
+	MustBeTrue(t, s.SetOption(mangos.OptionSendWorkers, 2) == mangos.ErrClosed)
+}
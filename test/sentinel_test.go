@@ -0,0 +1,90 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/transport"
+	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/ws"
+)
+
+func TestSentinelRefusedTCP(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	err = s.Dial(AddrTestTCP())
+	MustBeTrue(t, errors.Is(err, mangos.ErrConnRefused))
+}
+
+func TestSentinelRefusedIPC(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	err = s.Dial(AddrTestIPC())
+	MustBeTrue(t, errors.Is(err, mangos.ErrConnRefused))
+}
+
+func TestSentinelRefusedWS(t *testing.T) {
+	// An HTTP server that knows nothing of websockets.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	MustSucceed(t, err)
+	defer l.Close()
+	go http.Serve(l, http.NotFoundHandler())
+
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	err = s.Dial(fmt.Sprintf("ws://%s/", l.Addr()))
+	MustBeTrue(t, errors.Is(err, mangos.ErrConnRefused))
+}
+
+func TestSentinelBadAddr(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustBeTrue(t, errors.Is(s.Dial("tcp://127.0.0.1"), mangos.ErrBadAddr))
+	MustBeTrue(t, errors.Is(s.Listen("tcp://127.0.0.1"), mangos.ErrBadAddr))
+}
+
+func TestSentinelBadTransport(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	err = s.Dial("bogus://nowhere")
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadTransport))
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadTran))
+}
+
+func TestSentinelMapError(t *testing.T) {
+	MustSucceed(t, transport.MapError(nil))
+	op := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	MustBeTrue(t, transport.MapError(op) == mangos.ErrConnRefused)
+	op = &net.OpError{Op: "listen", Net: "tcp", Err: syscall.EADDRINUSE}
+	MustBeTrue(t, transport.MapError(op) == mangos.ErrAddrInUse)
+	MustBeTrue(t, transport.MapError(mangos.ErrClosed) == mangos.ErrClosed)
+	other := errors.New("something else")
+	MustBeTrue(t, transport.MapError(other) == other)
+	MustBeTrue(t, transport.MapDialError(syscall.ENOENT) == mangos.ErrConnRefused)
+}
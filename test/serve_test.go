@@ -0,0 +1,190 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	"nanomsg.org/go/mangos/v2/tracing"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestServeConcurrent(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+
+	v, err := srv.GetOption(mangos.OptionServeWorkers)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 1)
+	MustBeTrue(t, srv.SetOption(mangos.OptionServeWorkers, 0) == mangos.ErrBadValue)
+	MustSucceed(t, srv.SetOption(mangos.OptionServeWorkers, 4))
+
+	var busy, most int32
+	done := make(chan error)
+	go func() {
+		done <- srv.ServeReply(func(m *mangos.Message) *mangos.Message {
+			n := atomic.AddInt32(&busy, 1)
+			for {
+				old := atomic.LoadInt32(&most)
+				if n <= old || atomic.CompareAndSwapInt32(&most, old, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond * 50)
+			atomic.AddInt32(&busy, -1)
+			m.Body = append(m.Body, '!')
+			return m
+		})
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := cli.OpenContext()
+			MustSucceed(t, err)
+			defer c.Close()
+			MustSucceed(t, c.SetOption(mangos.OptionRecvDeadline, time.Second))
+			MustSucceed(t, c.Send([]byte{byte('a' + i)}))
+			b, err := c.Recv()
+			MustSucceed(t, err)
+			MustBeTrue(t, string(b) == string([]byte{byte('a' + i), '!'}))
+		}(i)
+	}
+	wg.Wait()
+	MustBeTrue(t, atomic.LoadInt32(&most) == 4)
+
+	MustSucceed(t, srv.Close())
+	select {
+	case err = <-done:
+		MustSucceed(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ServeReply did not return")
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- srv.ServeReply(func(m *mangos.Message) *mangos.Message {
+			close(started)
+			<-release
+			return m
+		})
+	}()
+	MustSucceed(t, cli.Send([]byte("last")))
+	<-started
+
+	// The request being handled is answered before the socket closes.
+	drained := make(chan error)
+	go func() { drained <- srv.Drain(context.Background()) }()
+	time.Sleep(time.Millisecond * 20)
+	close(release)
+	b, err := cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "last")
+	MustSucceed(t, <-drained)
+	MustSucceed(t, <-done)
+}
+
+func TestServeHandler(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	p, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, s.Listen(addr))
+	MustSucceed(t, p.Dial(addr))
+
+	// Receive timeouts, and messages a hook fails, do not stop it.
+	log := &testLogger{}
+	MustSucceed(t, s.SetOption(mangos.OptionLogger, log))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Millisecond))
+	s.AddRecvHook(func(m *mangos.Message) (*mangos.Message, error) {
+		if string(m.Body) == "bad" {
+			return nil, errors.New("bad message")
+		}
+		return m, nil
+	})
+
+	// A wrapped socket serves through its wrapper.
+	var traced int32
+	ws := tracing.Wrap(s, tracing.Hooks{
+		Recv: func(*mangos.Message, tracing.Carrier) { atomic.AddInt32(&traced, 1) },
+	})
+	tp := tracing.Wrap(p, tracing.Hooks{
+		Send: func(*mangos.Message) tracing.Carrier {
+			return tracing.Carrier{tracing.Traceparent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+		},
+	})
+
+	got := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- ws.Serve(func(m *mangos.Message) {
+			got <- string(m.Body)
+			m.Free()
+		})
+	}()
+	MustSucceed(t, tp.Send([]byte("one")))
+	MustSucceed(t, p.Send([]byte("bad")))
+	MustSucceed(t, tp.Send([]byte("two")))
+	MustBeTrue(t, <-got == "one")
+	MustBeTrue(t, <-got == "two")
+	MustBeTrue(t, log.wait("bad message"))
+	MustBeTrue(t, atomic.LoadInt32(&traced) == 2)
+
+	MustSucceed(t, s.Close())
+	MustSucceed(t, <-done)
+}
+
+func TestServeProtoState(t *testing.T) {
+	s, err := surveyor.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	err = s.Serve(func(m *mangos.Message) { m.Free() })
+	MustBeTrue(t, err == mangos.ErrProtoState)
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/ws"
+)
+
+func testSharedPort(t *testing.T, anon string) {
+	srvRep, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srvRep.Close()
+	MustSucceed(t, srvRep.SetOption(mangos.OptionRecvDeadline, time.Second))
+	srvPub, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer srvPub.Close()
+
+	addr := MustListen(t, srvRep, anon)
+	MustSucceed(t, srvPub.Listen(addr))
+
+	// Another socket of the same protocol cannot share the address.
+	dup, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer dup.Close()
+	MustBeTrue(t, dup.Listen(addr) == mangos.ErrAddrInUse)
+
+	cliReq, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cliReq.Close()
+	MustSucceed(t, cliReq.SetOption(mangos.OptionRecvDeadline, time.Second))
+	cliSub, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer cliSub.Close()
+	MustSucceed(t, cliSub.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cliSub.SetOption(mangos.OptionSubscribe, []byte{}))
+
+	MustSucceed(t, cliReq.Dial(addr))
+	MustSucceed(t, cliSub.Dial(addr))
+	time.Sleep(time.Second / 10)
+
+	MustSucceed(t, cliReq.Send([]byte("ping")))
+	m, err := srvRep.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "ping")
+	MustSucceed(t, srvRep.Send([]byte("pong")))
+	m, err = cliReq.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "pong")
+
+	MustSucceed(t, srvPub.Send([]byte("news")))
+	m, err = cliSub.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "news")
+
+	// Closing one socket leaves the other still listening.
+	MustSucceed(t, srvRep.Close())
+	other, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer other.Close()
+	MustSucceed(t, other.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, other.SetOption(mangos.OptionSubscribe, []byte{}))
+	MustSucceed(t, other.Dial(addr))
+	time.Sleep(time.Second / 10)
+	MustSucceed(t, srvPub.Send([]byte("more")))
+	m, err = other.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "more")
+}
+
+func TestSharedPortTCP(t *testing.T) {
+	testSharedPort(t, "tcp://127.0.0.1:0")
+}
+
+func TestSharedPortWS(t *testing.T) {
+	testSharedPort(t, "ws://127.0.0.1:0/sp")
+}
+
+func TestSharedPortReleased(t *testing.T) {
+	s1, err := rep.NewSocket()
+	MustSucceed(t, err)
+	s2, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	addr := MustListen(t, s1, "tcp://127.0.0.1:0")
+	MustSucceed(t, s1.Close())
+
+	// Once the last listener is gone, the address is free again.
+	MustSucceed(t, s2.Listen(addr))
+	s3, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer s3.Close()
+	MustSucceed(t, s3.Listen(addr))
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	"nanomsg.org/go/mangos/v2/shutdown"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// shutdownPeer acknowledges messages under name until closed, counting
+// them on got.
+func shutdownPeer(t *testing.T, s mangos.Socket, name string, got chan<- string) {
+	for {
+		b, err := shutdown.Acknowledge(s, name)
+		if err != nil {
+			return
+		}
+		if string(b) != "shutdown" {
+			t.Errorf("bad body %q", b)
+		}
+		got <- name
+	}
+}
+
+func TestShutdownSurvey(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := surveyor.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSurveyTime, time.Millisecond*100))
+	MustSucceed(t, s.Listen(addr))
+
+	got := make(chan string, 100)
+	names := []string{"alpha", "beta", "gamma"}
+	for i, name := range names {
+		r, err := respondent.NewSocket()
+		MustSucceed(t, err)
+		defer r.Close()
+		// Stagger the peers, so that some miss the first round.
+		if i > 0 {
+			time.Sleep(time.Millisecond * 150)
+		}
+		MustSucceed(t, r.Dial(addr))
+		go shutdownPeer(t, r, name, got)
+	}
+	MustSucceed(t, shutdown.Broadcast(s, []byte("shutdown"), names, time.Second*2))
+	seen := make(map[string]bool)
+	for len(seen) < len(names) {
+		seen[<-got] = true
+	}
+}
+
+func TestShutdownMissing(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := surveyor.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSurveyTime, time.Millisecond*50))
+	MustSucceed(t, s.Listen(addr))
+
+	r, err := respondent.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.Dial(addr))
+	go shutdownPeer(t, r, "here", make(chan string, 100))
+
+	start := time.Now()
+	err = shutdown.Broadcast(s, []byte("shutdown"), []string{"here", "gone", "away"}, time.Millisecond*300)
+	MustBeTrue(t, time.Since(start) < time.Second)
+	var e *shutdown.Error
+	MustBeTrue(t, errors.As(err, &e))
+	MustBeTrue(t, fmt.Sprint(e.Missing) == "[away gone]")
+	MustBeTrue(t, errors.Is(err, mangos.ErrRecvTimeout))
+
+	// The socket itself is still usable.
+	MustSucceed(t, s.Send([]byte("survey")))
+}
+
+func TestShutdownBus(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.Listen(addr))
+
+	got := make(chan string, 100)
+	names := []string{"one", "two"}
+	for _, name := range names {
+		b, err := bus.NewSocket()
+		MustSucceed(t, err)
+		defer b.Close()
+		MustSucceed(t, b.Dial(addr))
+		go shutdownPeer(t, b, name, got)
+	}
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Minute))
+	MustSucceed(t, shutdown.Broadcast(s, []byte("shutdown"), names, time.Second*3))
+
+	// Our deadline is put back.
+	v, err := s.GetOption(mangos.OptionRecvDeadline)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Minute)
+}
+
+func TestShutdownBadProto(t *testing.T) {
+	s, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustBeTrue(t, shutdown.Broadcast(s, nil, nil, time.Second) == mangos.ErrBadProto)
+	_, err = shutdown.Acknowledge(s, "me")
+	MustBeTrue(t, err == mangos.ErrBadProto)
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// fanIn connects producers to a PULL socket with the given source tag.
+func fanIn(t *testing.T, tag interface{}, n int) (mangos.Socket, []mangos.Socket) {
+	addr := AddrTestInp()
+	rx, err := pull.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, rx.SetOption(mangos.OptionSourceTag, tag))
+	MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, rx.Listen(addr))
+	var txs []mangos.Socket
+	for i := 0; i < n; i++ {
+		tx, err := push.NewSocket()
+		MustSucceed(t, err)
+		MustSucceed(t, tx.Dial(addr))
+		txs = append(txs, tx)
+	}
+	waitPipes(t, rx, n)
+	return rx, txs
+}
+
+func TestSourceTagPipeID(t *testing.T) {
+	rx, txs := fanIn(t, true, 3)
+	defer rx.Close()
+	for _, tx := range txs {
+		defer tx.Close()
+	}
+
+	for i, tx := range txs {
+		for j := 0; j < 3; j++ {
+			MustSucceed(t, tx.Send([]byte{byte(i)}))
+		}
+	}
+	sources := make(map[byte]string)
+	for k := 0; k < 9; k++ {
+		m, err := rx.RecvMsg()
+		MustSucceed(t, err)
+		tag, rest, ok := mangos.SplitSourceTag(m.Body)
+		MustBeTrue(t, ok)
+		MustBeTrue(t, len(tag) == 4)
+		MustBeTrue(t, binary.BigEndian.Uint32(tag) == m.Pipe.ID())
+		MustBeTrue(t, len(rest) == 1)
+		if s, ok := sources[rest[0]]; ok {
+			MustBeTrue(t, s == string(tag))
+		}
+		sources[rest[0]] = string(tag)
+		m.Free()
+	}
+	MustBeTrue(t, len(sources) == 3)
+	seen := make(map[string]bool)
+	for _, s := range sources {
+		MustBeFalse(t, seen[s])
+		seen[s] = true
+	}
+}
+
+func TestSourceTagFunc(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 300)
+	rx, txs := fanIn(t, func(p mangos.Pipe) []byte {
+		return long
+	}, 1)
+	defer rx.Close()
+	defer txs[0].Close()
+
+	MustSucceed(t, txs[0].Send([]byte("hello")))
+	b, err := rx.Recv()
+	MustSucceed(t, err)
+	tag, rest, ok := mangos.SplitSourceTag(b)
+	MustBeTrue(t, ok)
+	MustBeTrue(t, bytes.Equal(tag, long[:255]))
+	MustBeTrue(t, string(rest) == "hello")
+
+	// Turning it off affects only pipes connected later.
+	MustSucceed(t, rx.SetOption(mangos.OptionSourceTag, false))
+	v, err := rx.GetOption(mangos.OptionSourceTag)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.SourceTagFunc) == nil)
+}
+
+func TestSourceTagOption(t *testing.T) {
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionSourceTag)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.SourceTagFunc) == nil)
+	MustSucceed(t, s.SetOption(mangos.OptionSourceTag, true))
+	v, err = s.GetOption(mangos.OptionSourceTag)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.SourceTagFunc) != nil)
+	MustSucceed(t, s.SetOption(mangos.OptionSourceTag, nil))
+	MustFail(t, s.SetOption(mangos.OptionSourceTag, "tag"))
+
+	_, _, ok := mangos.SplitSourceTag(nil)
+	MustBeFalse(t, ok)
+	_, _, ok = mangos.SplitSourceTag([]byte{3, 'a'})
+	MustBeFalse(t, ok)
+	tag, rest, ok := mangos.SplitSourceTag([]byte{0, 'a'})
+	MustBeTrue(t, ok && len(tag) == 0 && string(rest) == "a")
+}
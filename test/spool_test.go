@@ -0,0 +1,223 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func spooled(t *testing.T, s mangos.Socket) uint64 {
+	v, err := s.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	return v.(map[string]uint64)[mangos.StatSpooled]
+}
+
+func newSpoolPull(t *testing.T, addr string) mangos.Socket {
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.Dial(addr))
+	return s
+}
+
+func TestSpoolOptions(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	v, err := s.GetOption(mangos.OptionSpoolDir)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(string) == "")
+	v, err = s.GetOption(mangos.OptionSpoolMaxBytes)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+
+	dir := t.TempDir()
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolDir, dir))
+	v, err = s.GetOption(mangos.OptionSpoolDir)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(string) == dir)
+	MustFail(t, s.SetOption(mangos.OptionSpoolDir, 1))
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolMaxBytes, 100))
+	MustFail(t, s.SetOption(mangos.OptionSpoolMaxBytes, -1))
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolDir, ""))
+
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.SetOption(mangos.OptionSpoolDir, t.TempDir()))
+
+	l, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer l.Close()
+	MustFail(t, l.SetOption(mangos.OptionSpoolDir, t.TempDir()))
+}
+
+func TestSpoolPush(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolDir, t.TempDir()))
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 4))
+	MustSucceed(t, s.Listen(addr))
+
+	// With nobody to take them, these all go to disk, rather than
+	// filling the queue and waiting.
+	for i := 0; i < 100; i++ {
+		MustSucceed(t, s.Send([]byte(fmt.Sprint(i))))
+	}
+	MustBeTrue(t, spooled(t, s) == 100)
+
+	l := newSpoolPull(t, addr)
+	defer l.Close()
+	for i := 0; i < 100; i++ {
+		b, err := l.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == fmt.Sprint(i))
+		if i == 50 {
+			// Newer messages wait their turn.
+			MustSucceed(t, s.Send([]byte("last")))
+		}
+	}
+	b, err := l.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "last")
+	MustBeTrue(t, spooled(t, s) == 0)
+}
+
+func TestSpoolRestart(t *testing.T) {
+	addr := AddrTestInp()
+	dir := t.TempDir()
+
+	// Large enough to need several segments.
+	body := make([]byte, 100*1024)
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolDir, dir))
+	for i := 0; i < 100; i++ {
+		body[0] = byte(i)
+		MustSucceed(t, s.Send(body))
+	}
+	MustSucceed(t, s.Close())
+
+	s, err = push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolDir, dir))
+	MustBeTrue(t, spooled(t, s) == 100)
+	MustSucceed(t, s.Listen(addr))
+	l := newSpoolPull(t, addr)
+	defer l.Close()
+	for i := 0; i < 100; i++ {
+		b, err := l.Recv()
+		MustSucceed(t, err)
+		body[0] = byte(i)
+		MustBeTrue(t, bytes.Equal(b, body))
+	}
+	MustBeTrue(t, spooled(t, s) == 0)
+}
+
+func TestSpoolBodies(t *testing.T) {
+	addr := AddrTestInp()
+	dir := t.TempDir()
+
+	// Every body segment is spooled, and survives a restart.
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolDir, dir))
+	for i := 0; i < 3; i++ {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, fmt.Sprint(i, ":")...)
+		m.Bodies = [][]byte{[]byte("scatter,"), []byte("gather")}
+		MustSucceed(t, s.SendMsg(m))
+	}
+	MustBeTrue(t, spooled(t, s) == 3)
+	MustSucceed(t, s.Close())
+
+	s, err = push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolDir, dir))
+	MustSucceed(t, s.Listen(addr))
+	l := newSpoolPull(t, addr)
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		b, err := l.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == fmt.Sprint(i, ":scatter,gather"))
+	}
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolMaxBytes, 1000))
+	MustSucceed(t, s.SetOption(mangos.OptionSpoolDir, t.TempDir()))
+	body := make([]byte, 100)
+	for i := 0; i < 20; i++ {
+		MustSucceed(t, s.Send(body))
+	}
+	MustBeTrue(t, spooled(t, s) < 10)
+	v, err := s.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	stats := v.(map[string]uint64)
+	MustBeTrue(t, stats[mangos.StatDropped]+stats[mangos.StatSpooled] == 20)
+}
+
+func TestSpoolPub(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustSucceed(t, p.SetOption(mangos.OptionSpoolDir, t.TempDir()))
+	MustSucceed(t, p.SetOption(mangos.OptionWriteQLen, 4))
+	MustSucceed(t, p.Listen(addr))
+	for i := 0; i < 50; i++ {
+		MustSucceed(t, p.Send([]byte(fmt.Sprint(i))))
+	}
+	MustBeTrue(t, spooled(t, p) == 50)
+
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte{}))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.Dial(addr))
+	for i := 0; i < 50; i++ {
+		b, err := s.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == fmt.Sprint(i))
+	}
+	MustBeTrue(t, spooled(t, p) == 0)
+
+	// Now that it is connected, messages go straight out.
+	MustSucceed(t, p.Send([]byte("live")))
+	MustBeTrue(t, spooled(t, p) == 0)
+	b, err := s.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "live")
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// srvRecords is a stand-in for DNS, holding the records for a name.
+type srvRecords struct {
+	sync.Mutex
+	name    string
+	records []*net.SRV
+	err     error
+}
+
+func (r *srvRecords) set(records []*net.SRV, err error) {
+	r.Lock()
+	r.records, r.err = records, err
+	r.Unlock()
+}
+
+func (r *srvRecords) lookup(name string) ([]*net.SRV, error) {
+	r.Lock()
+	defer r.Unlock()
+	if name != r.name {
+		return nil, &net.DNSError{Err: "no such host", Name: name}
+	}
+	return r.records, r.err
+}
+
+// srvTarget listens on a new port, returning the record for it.
+func srvTarget(t *testing.T) (mangos.Socket, *net.SRV) {
+	addr := AddrTestTCP()
+	s, err := pull.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.Listen(addr))
+	port, err := strconv.Atoi(addr[strings.LastIndex(addr, ":")+1:])
+	MustSucceed(t, err)
+	return s, &net.SRV{Target: "127.0.0.1.", Port: uint16(port), Weight: 1}
+}
+
+func srvDialer(t *testing.T, s mangos.Socket, r *srvRecords) mangos.Dialer {
+	d, err := s.NewDialer("tcp+srv://"+r.name, map[string]interface{}{
+		mangos.OptionSRVLookup:       mangos.SRVLookupFunc(r.lookup),
+		mangos.OptionResolveInterval: time.Millisecond * 20,
+	})
+	MustSucceed(t, err)
+	return d
+}
+
+func TestSRVDialFollowsRecords(t *testing.T) {
+	t1, r1 := srvTarget(t)
+	defer t1.Close()
+	t2, r2 := srvTarget(t)
+	defer t2.Close()
+	t3, r3 := srvTarget(t)
+	defer t3.Close()
+
+	r := &srvRecords{name: "_sp._tcp.service.example.com"}
+	r.set([]*net.SRV{r1, r2}, nil)
+
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	d := srvDialer(t, s, r)
+	MustBeTrue(t, d.Address() == "tcp+srv://"+r.name)
+	MustSucceed(t, d.Dial())
+	MustBeTrue(t, d.Dial() == mangos.ErrAddrInUse)
+	waitPipes(t, s, 2)
+	waitPipes(t, t1, 1)
+	waitPipes(t, t2, 1)
+
+	// A failed lookup leaves things as they were.
+	r.set(nil, errors.New("server failure"))
+	time.Sleep(time.Millisecond * 100)
+	MustBeTrue(t, s.Stats().Pipes == 2)
+
+	r.set([]*net.SRV{r2, r3}, nil)
+	waitPipes(t, t1, 0)
+	waitPipes(t, t3, 1)
+	waitPipes(t, s, 2)
+	MustBeTrue(t, s.Stats().Dialers == 2)
+
+	MustSucceed(t, d.Close())
+	waitPipes(t, s, 0)
+	MustBeTrue(t, s.Stats().Dialers == 0)
+	MustBeTrue(t, d.Close() == mangos.ErrClosed)
+	MustBeTrue(t, d.Dial() == mangos.ErrClosed)
+}
+
+func TestSRVDialSocketClose(t *testing.T) {
+	t1, r1 := srvTarget(t)
+	defer t1.Close()
+	r := &srvRecords{name: "_sp._tcp.closing.example.com"}
+	r.set([]*net.SRV{r1}, nil)
+
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, srvDialer(t, s, r).Dial())
+	waitPipes(t, t1, 1)
+	MustSucceed(t, s.Close())
+	waitPipes(t, t1, 0)
+}
+
+func TestSRVDialErrors(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	r := &srvRecords{name: "_sp._tcp.other.example.com"}
+	d, err := s.NewDialer("tcp+srv://_sp._tcp.missing.example.com",
+		map[string]interface{}{
+			mangos.OptionSRVLookup: mangos.SRVLookupFunc(r.lookup),
+		})
+	MustSucceed(t, err)
+	var de *net.DNSError
+	MustBeTrue(t, errors.As(d.Dial(), &de))
+
+	v, err := d.GetOption(mangos.OptionResolveInterval)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Second*30)
+	MustBeTrue(t, d.SetOption(mangos.OptionResolveInterval, time.Duration(0)) ==
+		mangos.ErrBadValue)
+	MustBeTrue(t, d.SetOption(mangos.OptionSRVLookup, "dns") == mangos.ErrBadValue)
+
+	_, err = s.NewDialer("tcp+srv://", nil)
+	MustBeTrue(t, err == mangos.ErrBadAddr)
+	MustBeTrue(t, s.Listen("tcp+srv://_sp._tcp.example.com") == mangos.ErrBadTran)
+}
@@ -138,7 +138,7 @@ func starTestCleanup(t *testing.T, bts []*starTester) {
 }
 
 func TestStar(t *testing.T) {
-	addr := "tcp://127.0.0.1:3538"
+	addr := AddrTestTCP()
 
 	num := 5
 	pkts := 7
@@ -0,0 +1,189 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	"nanomsg.org/go/mangos/v2/protocol/xbus"
+
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestStatsBasic(t *testing.T) {
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	MustSucceed(t, s1.Listen("inproc://statsbasic"))
+	MustSucceed(t, s2.Dial("inproc://statsbasic"))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	st := s1.Stats()
+	MustBeTrue(t, st.Listeners == 1)
+	MustBeTrue(t, st.Dialers == 0)
+	MustBeTrue(t, st.Sent == 0)
+	MustBeTrue(t, st.Protocol[mangos.StatQueued] == 0)
+
+	for i := 0; i < 3; i++ {
+		MustSucceed(t, s1.Send([]byte{byte(i)}))
+		_, err = s2.Recv()
+		MustSucceed(t, err)
+	}
+	MustBeTrue(t, s1.Stats().Sent == 3)
+	MustBeTrue(t, s1.Stats().Pipes == 1)
+	MustBeTrue(t, s2.Stats().Received == 3)
+	MustBeTrue(t, s2.Stats().Dialers == 1)
+
+
+	// Nothing to count for a socket that cannot send.
+	s3, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s3.Close()
+	_, err = s3.GetOption(mangos.OptionProtocolStats)
+	MustBeTrue(t, err == mangos.ErrBadOption)
+	MustBeTrue(t, s3.Stats().Protocol == nil)
+}
+
+func TestStatsBusEcho(t *testing.T) {
+	dev, err := xbus.NewSocket()
+	MustSucceed(t, err)
+	defer dev.Close()
+	MustSucceed(t, dev.Listen("inproc://statsbusecho"))
+	MustSucceed(t, mangos.Device(dev, dev))
+
+	c1, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer c1.Close()
+	c2, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer c2.Close()
+	MustSucceed(t, c2.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	MustSucceed(t, c1.Dial("inproc://statsbusecho"))
+	MustSucceed(t, c2.Dial("inproc://statsbusecho"))
+	time.Sleep(time.Millisecond * 100)
+
+	st := dev.Stats()
+	MustBeTrue(t, st.Pipes == 2)
+	MustBeTrue(t, st.Protocol[mangos.StatEchoSuppressed] == 0)
+
+	MustSucceed(t, c1.Send([]byte{1, 2, 3}))
+	_, err = c2.Recv()
+	MustSucceed(t, err)
+
+	// The device never sends the copy back to c1.
+	st = dev.Stats()
+	MustBeTrue(t, st.Protocol[mangos.StatEchoSuppressed] == 1)
+	MustBeTrue(t, st.Dropped == 0)
+
+	v, err := c1.GetOption(mangos.OptionProtocolStats)
+	MustSucceed(t, err)
+	m, ok := v.(map[string]uint64)
+	MustBeTrue(t, ok)
+	MustBeTrue(t, m[mangos.StatEchoSuppressed] == 0)
+	MustBeTrue(t, errors.Is(c1.SetOption(mangos.OptionProtocolStats, m),
+		mangos.ErrBadOption))
+}
+
+func TestStatsBusDropped(t *testing.T) {
+	s1, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	MustSucceed(t, s1.SetOption(mangos.OptionWriteQLen, 1))
+	MustSucceed(t, s2.SetOption(mangos.OptionReadQLen, 1))
+	MustSucceed(t, s1.Listen("inproc://statsbusdrop"))
+	MustSucceed(t, s2.Dial("inproc://statsbusdrop"))
+	// Messages sent before the pipe attaches are not drops.
+	for i := 0; s1.Stats().Pipes == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	MustBeTrue(t, s1.Stats().Pipes == 1)
+
+	// Nobody is receiving on s2, so most of these must be dropped.
+	for i := 0; i < 20; i++ {
+		MustSucceed(t, s1.Send([]byte{byte(i)}))
+	}
+	st := s1.Stats()
+	MustBeTrue(t, st.Sent == 20)
+	MustBeTrue(t, st.Dropped > 0)
+	MustBeTrue(t, st.Dropped == st.Protocol[mangos.StatDropped])
+}
+
+func TestStatsReconnects(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	MustSucceed(t, s2.SetOption(mangos.OptionMaxReconnectTime, time.Millisecond*10))
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	MustBeTrue(t, s2.Stats().Reconnects == 0)
+
+	// Replace the listening peer; the dialer finds the new one.
+	MustSucceed(t, s1.Close())
+	s1, err = pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	MustSucceed(t, s1.Listen(addr))
+	for i := 0; s2.Stats().Reconnects == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	MustBeTrue(t, s2.Stats().Reconnects == 1)
+}
+
+func TestStatsQueued(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	MustBeTrue(t, s1.Stats().Queued == 0)
+	_, ok := s1.Stats().Protocol[mangos.StatQueued]
+	MustBeTrue(t, ok)
+
+	s2, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s1.Listen(addr))
+	MustSucceed(t, s2.Dial(addr))
+	for i := 0; s1.Stats().Pipes == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// Nobody receives, so some messages wait in the queue, and the
+	// rest are dropped.
+	for i := 0; i < 300; i++ {
+		MustSucceed(t, s1.Send([]byte{byte(i)}))
+	}
+	st := s1.Stats()
+	MustBeTrue(t, st.Queued > 0)
+	MustBeTrue(t, st.Dropped > 0)
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/stream"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// streamPair returns two Conns over connected PAIR sockets.
+func streamPair(t *testing.T) (*stream.Conn, *stream.Conn) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s1.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+	MustSucceed(t, s1.Listen(addr))
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+	MustSucceed(t, s2.Dial(addr))
+	return stream.New(s1), stream.New(s2)
+}
+
+func TestStreamCopy(t *testing.T) {
+	c1, c2 := streamPair(t)
+	defer c1.Close()
+	defer c2.Close()
+	c1.SetChunkSize(1000)
+
+	data := make([]byte, 300*1024)
+	rand.Read(data)
+	go func() {
+		_, err := io.Copy(c1, bytes.NewReader(data))
+		MustSucceed(t, err)
+		MustSucceed(t, c1.CloseWrite())
+	}()
+	got, err := ioutil.ReadAll(c2)
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(got, data))
+
+	// Reading again still gives the end.
+	n, err := c2.Read(make([]byte, 10))
+	MustBeTrue(t, n == 0 && err == io.EOF)
+	_, err = c1.Write([]byte("late"))
+	MustBeTrue(t, err == mangos.ErrClosed)
+}
+
+func TestStreamSmallReads(t *testing.T) {
+	c1, c2 := streamPair(t)
+	defer c1.Close()
+	defer c2.Close()
+
+	n, err := c1.Write([]byte("hello, world"))
+	MustSucceed(t, err)
+	MustBeTrue(t, n == 12)
+	b := make([]byte, 5)
+	n, err = io.ReadFull(c2, b)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b[:n]) == "hello")
+	n, err = io.ReadFull(c2, b)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b[:n]) == ", wor")
+}
+
+func TestStreamGob(t *testing.T) {
+	c1, c2 := streamPair(t)
+	defer c1.Close()
+	defer c2.Close()
+
+	type request struct {
+		Name string
+		Args []int
+	}
+	enc := gob.NewEncoder(c1)
+	dec := gob.NewDecoder(c2)
+	for i := 0; i < 10; i++ {
+		MustSucceed(t, enc.Encode(request{Name: "sum", Args: []int{i, i + 1}}))
+	}
+	for i := 0; i < 10; i++ {
+		var r request
+		MustSucceed(t, dec.Decode(&r))
+		MustBeTrue(t, r.Name == "sum" && r.Args[1] == i+1)
+	}
+}
+
+func TestStreamPushPull(t *testing.T) {
+	up, down := AddrTestInp(), AddrTestInp()
+	newPair := func(listen bool) *stream.Conn {
+		r, err := pull.NewSocket()
+		MustSucceed(t, err)
+		MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second*2))
+		w, err := push.NewSocket()
+		MustSucceed(t, err)
+		if listen {
+			MustSucceed(t, r.Listen(up))
+			MustSucceed(t, w.Listen(down))
+		} else {
+			MustSucceed(t, w.Dial(up))
+			MustSucceed(t, r.Dial(down))
+		}
+		return stream.NewPair(r, w)
+	}
+	srv := newPair(true)
+	defer srv.Close()
+	cli := newPair(false)
+	defer cli.Close()
+
+	// An echo server.
+	go func() {
+		_, err := io.Copy(srv, srv)
+		MustSucceed(t, err)
+		MustSucceed(t, srv.CloseWrite())
+	}()
+	_, err := cli.Write([]byte("echo me"))
+	MustSucceed(t, err)
+	MustSucceed(t, cli.CloseWrite())
+	got, err := ioutil.ReadAll(cli)
+	MustSucceed(t, err)
+	MustBeTrue(t, string(got) == "echo me")
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/xsub"
+)
+
+func TestOptionErrorCooked(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	err = s.SetOption(mangos.OptionSubscribe, []byte{})
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadOption))
+	var oe *mangos.OptionError
+	MustBeTrue(t, errors.As(err, &oe))
+	MustBeTrue(t, oe.Option == mangos.OptionSubscribe)
+	MustBeTrue(t, oe.Protocol == "push")
+	MustBeFalse(t, oe.Raw)
+	d, _ := mangos.ProtocolByName("push")
+	MustBeTrue(t, strings.Join(oe.Valid, ",") ==
+		strings.Join(d.ValidOptions(false), ","))
+	MustBeTrue(t, strings.Contains(err.Error(), "push"))
+	MustBeTrue(t, strings.Contains(err.Error(), mangos.OptionSendDeadline))
+
+	// Unknown names are reported the same way.
+	err = s.SetOption("NO-SUCH-OPTION", 1)
+	MustBeTrue(t, errors.As(err, &oe))
+	MustBeTrue(t, oe.Option == "NO-SUCH-OPTION")
+
+	// Bad values are not option errors.
+	err = s.SetOption(mangos.OptionSendDeadline, "bogus")
+	MustBeTrue(t, err == mangos.ErrBadValue)
+	MustSucceed(t, s.SetOption(mangos.OptionSendDeadline, time.Second))
+}
+
+func TestOptionErrorRaw(t *testing.T) {
+	s, err := xsub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	// Raw SUB does not do subscriptions.
+	err = s.SetOption(mangos.OptionSubscribe, []byte{})
+	var oe *mangos.OptionError
+	MustBeTrue(t, errors.As(err, &oe))
+	MustBeTrue(t, oe.Raw)
+	MustBeTrue(t, oe.Protocol == "sub")
+}
+
+// laxProtocol accepts any option at all, to show strict mode.
+type laxProtocol struct {
+	protocol.Protocol
+}
+
+func (laxProtocol) SetOption(string, interface{}) error { return nil }
+
+func TestOptionStrict(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	v, err := s.GetOption(mangos.OptionStrict)
+	MustSucceed(t, err)
+	MustBeFalse(t, v.(bool))
+	MustBeTrue(t, s.SetOption(mangos.OptionStrict, 1) == mangos.ErrBadValue)
+	MustSucceed(t, s.SetOption(mangos.OptionStrict, true))
+	v, err = s.GetOption(mangos.OptionStrict)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 10))
+	MustSucceed(t, s.SetOption(mangos.OptionReconnectTime, time.Second))
+	err = s.SetOption(mangos.OptionSubscribe, []byte{})
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadOption))
+
+	// A protocol that accepts anything is held to the registry.
+	lax := protocol.MakeSocket(laxProtocol{xsub.NewProtocol()})
+	defer lax.Close()
+	MustSucceed(t, lax.SetOption(mangos.OptionSubscribe, []byte{}))
+	MustSucceed(t, lax.SetOption(mangos.OptionStrict, true))
+	err = lax.SetOption(mangos.OptionSubscribe, []byte{})
+	MustBeTrue(t, errors.Is(err, mangos.ErrBadOption))
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func nextSubEvent(t *testing.T, evq <-chan mangos.SubscriptionEvent) mangos.SubscriptionEvent {
+	select {
+	case ev := <-evq:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("no subscription event")
+	}
+	return mangos.SubscriptionEvent{}
+}
+
+func TestSubscriptionEvents(t *testing.T) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	evq := make(chan mangos.SubscriptionEvent, 16)
+	MustSucceed(t, p.SetOption(mangos.OptionSubscriptionFunc,
+		func(ev mangos.SubscriptionEvent) { evq <- ev }))
+	MustBeTrue(t, p.SetOption(mangos.OptionSubscriptionFunc, 1) ==
+		mangos.ErrBadValue)
+	MustSucceed(t, p.Listen(addr))
+
+	// The first subscriber to a topic.
+	s1 := newSubFwd(t, addr, "news")
+	defer s1.Close()
+	ev := nextSubEvent(t, evq)
+	MustBeTrue(t, string(ev.Topic) == "news")
+	MustBeTrue(t, ev.Subscribed)
+	MustBeTrue(t, ev.Subscribers == 1)
+	MustNotBeNil(t, ev.Pipe)
+	pipe1 := ev.Pipe.ID()
+
+	// A second, on another pipe.
+	s2 := newSubFwd(t, addr, "news")
+	ev = nextSubEvent(t, evq)
+	MustBeTrue(t, ev.Subscribed && ev.Subscribers == 2)
+	MustBeTrue(t, ev.Pipe.ID() != pipe1)
+
+	// Changes in what a peer wants.
+	MustSucceed(t, s1.SetOption(mangos.OptionSubscribe, "sport"))
+	ev = nextSubEvent(t, evq)
+	MustBeTrue(t, string(ev.Topic) == "sport")
+	MustBeTrue(t, ev.Subscribed && ev.Subscribers == 1)
+	MustBeTrue(t, ev.Pipe.ID() == pipe1)
+	MustSucceed(t, s1.SetOption(mangos.OptionUnsubscribe, "news"))
+	ev = nextSubEvent(t, evq)
+	MustBeTrue(t, string(ev.Topic) == "news")
+	MustBeTrue(t, !ev.Subscribed && ev.Subscribers == 1)
+
+	// A peer going away drops all it had, and the last one out
+	// leaves nobody.
+	MustSucceed(t, s2.Close())
+	ev = nextSubEvent(t, evq)
+	MustBeTrue(t, string(ev.Topic) == "news")
+	MustBeTrue(t, !ev.Subscribed && ev.Subscribers == 0)
+
+	// Nothing more is reported once the function is cleared.
+	MustSucceed(t, p.SetOption(mangos.OptionSubscriptionFunc, nil))
+	MustSucceed(t, s1.SetOption(mangos.OptionSubscribe, "weather"))
+	waitSubs(t, p, "sport", "weather")
+	select {
+	case ev := <-evq:
+		t.Fatalf("unexpected event %v", ev)
+	default:
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// wildcardPair returns a connected PUB and SUB, with the SUB using the
+// separator for wildcards and forwarding its subscriptions if fwd.
+func wildcardPair(t *testing.T, sep string, fwd bool) (mangos.Socket, mangos.Socket) {
+	addr := AddrTestInp()
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionSubWildcard, sep))
+	MustSucceed(t, s.SetOption(mangos.OptionSubForward, fwd))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline,
+		time.Millisecond*200))
+	MustSucceed(t, p.Listen(addr))
+	MustSucceed(t, s.Dial(addr))
+	waitPipes(t, p, 1)
+	return p, s
+}
+
+// wildcardRecv publishes each topic, and returns those received.
+func wildcardRecv(t *testing.T, p, s mangos.Socket, topics []string) []string {
+	for _, topic := range topics {
+		MustSucceed(t, p.Send([]byte(topic)))
+	}
+	var got []string
+	for {
+		b, err := s.Recv()
+		if err == mangos.ErrRecvTimeout {
+			return got
+		}
+		MustSucceed(t, err)
+		got = append(got, string(b))
+	}
+}
+
+func sameTopics(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var wildcardTopics = []string{
+	"metrics.host1.cpu",
+	"metrics.host2.cpu 0.5",
+	"metrics.host1.mem",
+	"metrics.cpu",
+	"metrics.a.b.cpu",
+	"alerts.host1",
+	"alerts",
+	"other",
+}
+
+func TestSubWildcardOne(t *testing.T) {
+	for _, fwd := range []bool{false, true} {
+		p, s := wildcardPair(t, ".", fwd)
+		MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "metrics.*.cpu"))
+		time.Sleep(time.Millisecond * 20)
+		got := wildcardRecv(t, p, s, wildcardTopics)
+		MustBeTrue(t, sameTopics(got, "metrics.host1.cpu",
+			"metrics.host2.cpu 0.5"))
+		MustSucceed(t, p.Close())
+		MustSucceed(t, s.Close())
+	}
+}
+
+func TestSubWildcardRest(t *testing.T) {
+	p, s := wildcardPair(t, ".", false)
+	defer p.Close()
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "alerts.#"))
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "+.+.mem"))
+	got := wildcardRecv(t, p, s, wildcardTopics)
+	MustBeTrue(t, sameTopics(got, "metrics.host1.mem", "alerts.host1",
+		"alerts"))
+
+	MustSucceed(t, s.SetOption(mangos.OptionUnsubscribe, "alerts.#"))
+	got = wildcardRecv(t, p, s, wildcardTopics)
+	MustBeTrue(t, sameTopics(got, "metrics.host1.mem"))
+}
+
+func TestSubWildcardPrefix(t *testing.T) {
+	// Without wildcards, subscriptions match just as prefixes would.
+	p, s := wildcardPair(t, "/", false)
+	defer p.Close()
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "/some/wh"))
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "/over/"))
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "The"))
+	got := wildcardRecv(t, p, s, publish)
+	MustBeTrue(t, sameTopics(got, "/some/where", "/over/the",
+		"The Quick Brown Fox"))
+
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "/*/like"))
+	got = wildcardRecv(t, p, s, publish)
+	MustBeTrue(t, sameTopics(got, "/some/like/it/hot", "/some/where",
+		"/over/the", "The Quick Brown Fox"))
+
+	// Turning wildcards off leaves "*" as just a character.
+	MustSucceed(t, s.SetOption(mangos.OptionSubWildcard, ""))
+	got = wildcardRecv(t, p, s, publish)
+	MustBeTrue(t, sameTopics(got, "/some/where", "/over/the",
+		"The Quick Brown Fox"))
+}
+
+func TestSubWildcardForward(t *testing.T) {
+	p, s := wildcardPair(t, ".", true)
+	defer p.Close()
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "metrics.*.cpu"))
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "alerts.#"))
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, "other"))
+
+	// The publisher is told only what it can filter on.
+	want := []string{"alerts.", "metrics.", "other"}
+	for i := 0; ; i++ {
+		v, err := p.GetOption(mangos.OptionSubscriptions)
+		MustSucceed(t, err)
+		topics := v.([][]byte)
+		var got []string
+		for _, topic := range topics {
+			got = append(got, string(topic))
+		}
+		if sameTopics(got, want...) {
+			break
+		}
+		MustBeTrue(t, i < 100)
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSubWildcardOption(t *testing.T) {
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionSubWildcard)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(string) == "")
+	MustSucceed(t, s.SetOption(mangos.OptionSubWildcard, "/"))
+	v, err = s.GetOption(mangos.OptionSubWildcard)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(string) == "/")
+	MustFail(t, s.SetOption(mangos.OptionSubWildcard, '/'))
+
+	// Contexts opened later use it too.
+	c, err := s.OpenContext()
+	MustSucceed(t, err)
+	defer c.Close()
+	MustSucceed(t, c.SetOption(mangos.OptionSubscribe, "a/+/c"))
+
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	MustFail(t, p.SetOption(mangos.OptionSubWildcard, "/"))
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestSurveyResponses(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := surveyor.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSurveyTime,
+		time.Millisecond*200))
+	MustSucceed(t, s.Listen(addr))
+
+	v, err := s.GetOption(mangos.OptionSurveyRespondents)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+
+	// One respondent never answers.
+	const answering = 3
+	for i := 0; i <= answering; i++ {
+		r, err := respondent.NewSocket()
+		MustSucceed(t, err)
+		defer r.Close()
+		MustSucceed(t, r.Dial(addr))
+		if i == answering {
+			continue
+		}
+		go func(r mangos.Socket) {
+			if b, err := r.Recv(); err == nil {
+				r.Send(append(b, '!'))
+			}
+		}(r)
+	}
+	waitPipes(t, s, answering+1)
+
+	start := time.Now()
+	MustSucceed(t, s.Send([]byte("who")))
+	v, err = s.GetOption(mangos.OptionSurveyRespondents)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == answering+1)
+
+	n := 0
+	for m := range surveyor.Responses(s) {
+		MustBeTrue(t, string(m.Body) == "who!")
+		m.Free()
+		n++
+	}
+	MustBeTrue(t, n == answering)
+	MustBeTrue(t, time.Since(start) >= time.Millisecond*200)
+	MustBeTrue(t, time.Since(start) < time.Second)
+}
+
+func TestSurveyResponsesContext(t *testing.T) {
+	s, err := surveyor.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	c, err := s.OpenContext()
+	MustSucceed(t, err)
+	MustSucceed(t, c.SetOption(mangos.OptionSurveyTime, time.Second))
+	MustSucceed(t, c.Send([]byte("anyone")))
+	v, err := c.GetOption(mangos.OptionSurveyRespondents)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+
+	// Closing the context ends the stream early.
+	ch := surveyor.Responses(c)
+	time.Sleep(time.Millisecond * 20)
+	MustSucceed(t, c.Close())
+	select {
+	case _, ok := <-ch:
+		MustBeFalse(t, ok)
+	case <-time.After(time.Millisecond * 500):
+		t.Fatalf("stream not closed")
+	}
+
+	// Nor is there a survey to stream before one is sent.
+	c, err = s.OpenContext()
+	MustSucceed(t, err)
+	defer c.Close()
+	_, ok := <-surveyor.Responses(c)
+	MustBeFalse(t, ok)
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+func TestSynchPair(t *testing.T) {
+	addr := AddrTestTCP()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+
+	MustBeTrue(t, s1.SetOption(mangos.OptionSynchronous, 1) == mangos.ErrBadValue)
+	MustSucceed(t, s1.SetOption(mangos.OptionSynchronous, true))
+	v, err := s1.GetOption(mangos.OptionSynchronous)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	// Without a peer, the message is queued, and delivered later.
+	MustSucceed(t, s1.Send([]byte("early")))
+
+	MustSucceed(t, s2.Listen(addr))
+	MustSucceed(t, s1.Dial(addr))
+
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "early")
+
+	for i := 0; i < 100; i++ {
+		MustSucceed(t, s1.Send([]byte{byte(i)}))
+		b, err = s2.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && b[0] == byte(i))
+	}
+}
+
+func TestSynchReqRep(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+
+	MustSucceed(t, cli.SetOption(mangos.OptionSynchronous, true))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+
+	ctx, err := cli.OpenContext()
+	MustSucceed(t, err)
+	v, err := ctx.GetOption(mangos.OptionSynchronous)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+	MustSucceed(t, ctx.Close())
+
+	for i := 0; i < 100; i++ {
+		MustSucceed(t, cli.Send([]byte{byte(i)}))
+		b, err := srv.Recv()
+		MustSucceed(t, err)
+		MustSucceed(t, srv.Send(b))
+		b, err = cli.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(b) == 1 && b[0] == byte(i))
+	}
+}
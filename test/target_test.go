@@ -0,0 +1,164 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// waitPipes waits for the socket to have n pipes.
+func waitPipes(t *testing.T, s mangos.Socket, n int) {
+	for i := 0; s.Stats().Pipes != n && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	MustBeTrue(t, s.Stats().Pipes == n)
+}
+
+func TestTargetBus(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := bus.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	var clients []mangos.Socket
+	for i := 0; i < 2; i++ {
+		c, err := bus.NewSocket()
+		MustSucceed(t, err)
+		defer c.Close()
+		MustSucceed(t, c.SetOption(mangos.OptionRecvDeadline, time.Millisecond*100))
+		MustSucceed(t, c.Dial(addr))
+		clients = append(clients, c)
+	}
+	waitPipes(t, srv, 2)
+
+	// Reply to just the client that spoke.
+	MustSucceed(t, clients[1].Send([]byte("hello")))
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	MustNotBeNil(t, m.Pipe)
+	r := mangos.NewMessage(0)
+	r.Body = append(r.Body, []byte("just you")...)
+	r.Target = m.Pipe
+	MustSucceed(t, srv.SendMsg(r))
+
+	b, err := clients[1].Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "just you")
+	_, err = clients[0].Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+
+	// Once the client is gone, messages for it are dropped.
+	MustSucceed(t, clients[1].Close())
+	waitPipes(t, srv, 1)
+	r = mangos.NewMessage(0)
+	r.Target = m.Pipe
+	MustSucceed(t, srv.SendMsg(r))
+	MustBeTrue(t, srv.Stats().Dropped == 1)
+	_, err = clients[0].Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+}
+
+func TestTargetPub(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.Listen(addr))
+
+	var subs []mangos.Socket
+	for i := 0; i < 2; i++ {
+		s, err := sub.NewSocket()
+		MustSucceed(t, err)
+		defer s.Close()
+		MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte{}))
+		MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Millisecond*100))
+		MustSucceed(t, s.Dial(addr))
+		subs = append(subs, s)
+	}
+	waitPipes(t, srv, 2)
+
+	// We learn a subscriber's pipe from the pipe event hook.
+	var target mangos.Pipe
+	got := make(chan mangos.Pipe, 1)
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventAttached {
+			got <- p
+		}
+	})
+	s, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte{}))
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s.Dial(addr))
+	target = <-got
+
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("private")...)
+	m.Target = target
+	MustSucceed(t, srv.SendMsg(m))
+	b, err := s.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "private")
+	for _, s := range subs {
+		_, err = s.Recv()
+		MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	}
+}
+
+func TestTargetPair(t *testing.T) {
+	addr := AddrTestInp()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	MustSucceed(t, s1.Listen(addr))
+
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s2.Dial(addr))
+	MustSucceed(t, s2.Send([]byte("first")))
+	MustSucceed(t, s1.SetOption(mangos.OptionRecvDeadline, time.Second))
+	m, err := s1.RecvMsg()
+	MustSucceed(t, err)
+	old := m.Pipe
+	MustSucceed(t, s2.Close())
+	waitPipes(t, s1, 0)
+
+	s3, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s3.Close()
+	MustSucceed(t, s3.SetOption(mangos.OptionRecvDeadline, time.Millisecond*100))
+	MustSucceed(t, s3.Dial(addr))
+	waitPipes(t, s1, 1)
+
+	// Meant for the old peer, so the new one does not get it.
+	m = mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("stale")...)
+	m.Target = old
+	MustSucceed(t, s1.SendMsg(m))
+	MustSucceed(t, s1.Send([]byte("fresh")))
+	b, err := s3.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "fresh")
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestTCPSocketOptions(t *testing.T) {
+	sock, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+
+	v, err := sock.GetOption(mangos.OptionNoDelay)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+	v, err = sock.GetOption(mangos.OptionSendBufferSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 0)
+
+	MustSucceed(t, sock.SetOption(mangos.OptionNoDelay, false))
+	MustSucceed(t, sock.SetOption(mangos.OptionKeepAliveTime, 5*time.Second))
+	MustSucceed(t, sock.SetOption(mangos.OptionSendBufferSize, 32768))
+	MustSucceed(t, sock.SetOption(mangos.OptionRecvBufferSize, 32768))
+	MustBeTrue(t, sock.SetOption(mangos.OptionNoDelay, 1) == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionKeepAliveTime, time.Duration(0)) == mangos.ErrBadValue)
+	MustBeTrue(t, sock.SetOption(mangos.OptionRecvBufferSize, -1) == mangos.ErrBadValue)
+
+	// New dialers pick up the socket's settings.
+	d, err := sock.NewDialer(AddrTestTCP(), nil)
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionNoDelay)
+	MustSucceed(t, err)
+	MustBeFalse(t, v.(bool))
+	v, err = d.GetOption(mangos.OptionSendBufferSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 32768)
+
+	// Unless they were given their own.
+	d, err = sock.NewDialer(AddrTestTCP(), map[string]interface{}{
+		mangos.OptionNoDelay: true,
+	})
+	MustSucceed(t, err)
+	v, err = d.GetOption(mangos.OptionNoDelay)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+
+	// Transports without TCP options are unaffected.
+	_, err = sock.NewDialer(AddrTestInp(), nil)
+	MustSucceed(t, err)
+}
+
+func TestTCPSocketOptionsTraffic(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvBufferSize, 4096))
+	MustSucceed(t, srv.SetOption(mangos.OptionKeepAliveTime, time.Second))
+	MustSucceed(t, srv.Listen(addr))
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionSendBufferSize, 4096))
+	MustSucceed(t, cli.SetOption(mangos.OptionNoDelay, true))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.Dial(addr))
+
+	body := make([]byte, 65536)
+	MustSucceed(t, cli.Send(body))
+	m, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, len(m) == len(body))
+	MustSucceed(t, srv.Send([]byte("ok")))
+	m, err = cli.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m) == "ok")
+}
+
+func TestTCPOptionsLivePipes(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	l, err := srv.NewListener(addr, nil)
+	MustSucceed(t, err)
+	MustSucceed(t, l.Listen())
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	d, err := cli.NewDialer(addr, map[string]interface{}{
+		mangos.OptionKeepAliveTime: time.Minute,
+	})
+	MustSucceed(t, err)
+	MustSucceed(t, d.Dial())
+
+	// roundTrip returns the server and client pipes.
+	roundTrip := func() (mangos.Pipe, mangos.Pipe) {
+		MustSucceed(t, cli.Send([]byte("ping")))
+		m, err := srv.RecvMsg()
+		MustSucceed(t, err)
+		sp := m.Pipe
+		MustSucceed(t, srv.SendMsg(m))
+		m, err = cli.RecvMsg()
+		MustSucceed(t, err)
+		cp := m.Pipe
+		m.Free()
+		return sp, cp
+	}
+	sp, cp := roundTrip()
+
+	// Changes on the socket reach the connected pipes.
+	MustSucceed(t, srv.SetOption(mangos.OptionNoDelay, false))
+	v, err := sp.GetOption(mangos.OptionNoDelay)
+	MustSucceed(t, err)
+	MustBeFalse(t, v.(bool))
+
+	// But not those of a dialer with its own setting.
+	MustSucceed(t, cli.SetOption(mangos.OptionKeepAliveTime, time.Hour))
+	v, err = cp.GetOption(mangos.OptionKeepAliveTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Minute)
+
+	// Changes on the dialer or listener reach their pipes too.
+	MustSucceed(t, d.SetOption(mangos.OptionKeepAliveTime, 2*time.Minute))
+	v, err = cp.GetOption(mangos.OptionKeepAliveTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == 2*time.Minute)
+	MustSucceed(t, l.SetOption(mangos.OptionRecvBufferSize, 8192))
+	v, err = sp.GetOption(mangos.OptionRecvBufferSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == 8192)
+
+	// And the pipes are still the same, still working.
+	sp2, cp2 := roundTrip()
+	MustBeTrue(t, sp2.ID() == sp.ID())
+	MustBeTrue(t, cp2.ID() == cp.ID())
+}
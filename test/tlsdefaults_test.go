@@ -0,0 +1,127 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+)
+
+// sniServer listens on addr with a certificate from vc, recording the
+// server names sent by dialers.
+func sniServer(t *testing.T, vc *verifyCerts, addr string) (mangos.Socket, chan string) {
+	cert := vc.leaf(t, "server")
+	names := make(chan string, 10)
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, srv.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{
+			GetCertificate: func(h *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				names <- h.ServerName
+				return &cert, nil
+			},
+		},
+	}))
+	return srv, names
+}
+
+func TestTLSDefaultServerName(t *testing.T) {
+	vc := newVerifyCerts(t)
+	addr := AddrTestTLS()
+	srv, _ := sniServer(t, vc, addr)
+	defer srv.Close()
+
+	// No ServerName; the address dialed is verified instead.
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{RootCAs: vc.pool},
+	}))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Send([]byte("verified")))
+	m, err := cli.RecvMsg()
+	MustSucceed(t, err)
+	v, err := m.Pipe.GetOption(mangos.OptionTLSInsecureSkipVerify)
+	MustSucceed(t, err)
+	MustBeFalse(t, v.(bool))
+	m.Free()
+	MustBeTrue(t, cli.Stats().Insecure == 0)
+}
+
+func TestTLSNoConfig(t *testing.T) {
+	vc := newVerifyCerts(t)
+	addr := AddrTestTLS()
+	srv, _ := sniServer(t, vc, addr)
+	defer srv.Close()
+
+	// The system's roots know nothing of our CA.
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustFail(t, cli.Dial(addr))
+	MustBeTrue(t, cli.Stats().Pipes == 0)
+
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionTLSInsecureSkipVerify: true,
+	}))
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, srv.Send([]byte("unverified")))
+	m, err := cli.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, cli.Stats().Insecure == 1)
+	v, err := m.Pipe.GetOption(mangos.OptionTLSInsecureSkipVerify)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(bool))
+	m.Free()
+}
+
+func TestTLSServerNameOverride(t *testing.T) {
+	vc := newVerifyCerts(t)
+	addr := AddrTestTLS()
+	srv, names := sniServer(t, vc, addr)
+	defer srv.Close()
+
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+
+	// The name overrides the one in the config, and the certificate
+	// does not carry it.
+	MustFail(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig: &tls.Config{
+			RootCAs:    vc.pool,
+			ServerName: "127.0.0.1",
+		},
+		mangos.OptionTLSServerName: "svc.mangos.example.com",
+	}))
+	MustBeTrue(t, <-names == "svc.mangos.example.com")
+
+	d, err := cli.NewDialer(addr, nil)
+	MustSucceed(t, err)
+	MustBeTrue(t, d.SetOption(mangos.OptionTLSServerName, 1) == mangos.ErrBadValue)
+	MustBeTrue(t, d.SetOption(mangos.OptionTLSInsecureSkipVerify, "yes") == mangos.ErrBadValue)
+	MustSucceed(t, d.SetOption(mangos.OptionTLSServerName, "svc.mangos.example.com"))
+	MustSucceed(t, d.SetOption(mangos.OptionTLSInsecureSkipVerify, true))
+	MustSucceed(t, d.Dial())
+	MustBeTrue(t, <-names == "svc.mangos.example.com")
+	waitPipes(t, cli, 1)
+	MustBeTrue(t, cli.Stats().Insecure == 1)
+}
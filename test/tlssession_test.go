@@ -0,0 +1,121 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
+)
+
+// tlsStates returns a pair of sockets, and a channel receiving the TLS
+// state of each connection the dialing one makes.
+func tlsStates(t *testing.T) (mangos.Socket, mangos.Socket, chan tls.ConnectionState) {
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s2.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	states := make(chan tls.ConnectionState, 10)
+	s2.SetAuthHook(func(p mangos.Pipe) error {
+		v, err := p.GetOption(mangos.OptionTLSConnState)
+		MustSucceed(t, err)
+		states <- v.(tls.ConnectionState)
+		return nil
+	})
+	return s1, s2, states
+}
+
+func TestTLSALPN(t *testing.T) {
+	addr := AddrTestTLS()
+	scfg, err := GetTLSConfig(true)
+	MustSucceed(t, err)
+	ccfg, err := GetTLSConfig(false)
+	MustSucceed(t, err)
+	s1, s2, states := tlsStates(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	MustSucceed(t, s1.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig: scfg,
+		mangos.OptionTLSALPN:   []string{"sp/2", "sp/1"},
+	}))
+	MustSucceed(t, s2.DialOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig: ccfg,
+		mangos.OptionTLSALPN:   []string{"sp/1"},
+	}))
+	MustBeTrue(t, (<-states).NegotiatedProtocol == "sp/1")
+
+	// Nothing in common.
+	s3, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s3.Close()
+	MustFail(t, s3.DialOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig: ccfg,
+		mangos.OptionTLSALPN:   []string{"other"},
+	}))
+	MustBeTrue(t, s3.DialOptions(addr, map[string]interface{}{
+		mangos.OptionTLSALPN: "sp/1",
+	}) == mangos.ErrBadValue)
+}
+
+func testTLSResume(t *testing.T, listenerResumes bool) {
+	addr := AddrTestTLS()
+	scfg, err := GetTLSConfig(true)
+	MustSucceed(t, err)
+	ccfg, err := GetTLSConfig(false)
+	MustSucceed(t, err)
+	s1, s2, states := tlsStates(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	MustSucceed(t, s1.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig:            scfg,
+		mangos.OptionTLSSessionResumption: listenerResumes,
+	}))
+	MustSucceed(t, s2.DialOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig:            ccfg,
+		mangos.OptionTLSSessionResumption: true,
+	}))
+	MustBeFalse(t, (<-states).DidResume)
+
+	// The session ticket arrives after the handshake, so exchange a
+	// message to be sure it has.
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, s1.Send([]byte("ticket")))
+	_, err = s2.Recv()
+	MustSucceed(t, err)
+
+	waitPipes(t, s1, 1)
+	MustSucceed(t, s1.ClosePipe(s1.Pipes()[0].ID))
+	select {
+	case state := <-states:
+		MustBeTrue(t, state.DidResume == listenerResumes)
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no reconnection")
+	}
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	testTLSResume(t, true)
+}
+
+func TestTLSSessionTicketsDisabled(t *testing.T) {
+	testTLSResume(t, false)
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+)
+
+type verifyCerts struct {
+	pool   *x509.CertPool
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+	ocsp   string // OCSP responder for new leaves
+}
+
+func newVerifyCerts(t *testing.T) *verifyCerts {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	MustSucceed(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca.mangos.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	MustSucceed(t, err)
+	cert, err := x509.ParseCertificate(der)
+	MustSucceed(t, err)
+	vc := &verifyCerts{pool: x509.NewCertPool(), caCert: cert, caKey: key, serial: 1}
+	vc.pool.AddCert(cert)
+	return vc
+}
+
+func (vc *verifyCerts) leaf(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	MustSucceed(t, err)
+	vc.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(vc.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+	if vc.ocsp != "" {
+		tmpl.OCSPServer = []string{vc.ocsp}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, vc.caCert, &key.PublicKey, vc.caKey)
+	MustSucceed(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func allowCN(cn string) mangos.TLSVerifyPeerFunc {
+	return func(chains [][]*x509.Certificate, _ net.Addr) error {
+		if len(chains) == 0 || chains[0][0].Subject.CommonName != cn {
+			return errors.New("peer not allowed")
+		}
+		return nil
+	}
+}
+
+func TestTLSVerifyPeer(t *testing.T) {
+	vc := newVerifyCerts(t)
+	addr := AddrTestTLS()
+
+	srvCfg := &tls.Config{
+		Certificates: []tls.Certificate{vc.leaf(t, "server")},
+		ClientCAs:    vc.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+
+	rejectq := make(chan net.Addr, 10)
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventRejected {
+			v, err := p.GetOption(mangos.OptionRemoteAddr)
+			MustSucceed(t, err)
+			rejectq <- v.(net.Addr)
+		}
+	})
+	MustSucceed(t, srv.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionTLSConfig:     srvCfg,
+		mangos.OptionTLSVerifyPeer: allowCN("good"),
+	}))
+
+	dial := func(cn string, verify mangos.TLSVerifyPeerFunc) (mangos.Socket, error) {
+		cli, err := pair.NewSocket()
+		MustSucceed(t, err)
+		opts := map[string]interface{}{
+			mangos.OptionTLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{vc.leaf(t, cn)},
+				RootCAs:      vc.pool,
+				ServerName:   "127.0.0.1",
+			},
+		}
+		if verify != nil {
+			opts[mangos.OptionTLSVerifyPeer] = verify
+		}
+		return cli, cli.DialOptions(addr, opts)
+	}
+
+	// A peer that fails verification is refused, and reported.
+	cli, err := dial("bad", nil)
+	MustFail(t, err)
+	cli.Close()
+	select {
+	case a := <-rejectq:
+		MustBeTrue(t, a.String() != "")
+	case <-time.After(time.Second * 5):
+		t.Fatalf("rejection not reported")
+	}
+
+	// The good peer can talk to us.
+	cli, err = dial("good", allowCN("server"))
+	MustSucceed(t, err)
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cli.Send([]byte("hello")))
+	b, err := srv.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "hello")
+	cli.Close()
+
+	// Dialers can check the server too.
+	cli, err = dial("good", allowCN("somebody-else"))
+	MustBeTrue(t, err != nil && err.Error() == "peer not allowed")
+	cli.Close()
+	MustBeTrue(t, len(rejectq) == 0)
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	"nanomsg.org/go/mangos/v2/protocol/xreq"
+	"nanomsg.org/go/mangos/v2/tracing"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTracingInjectExtract(t *testing.T) {
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("payload")...)
+	c := tracing.Carrier{}
+	c.Set("Traceparent", testTraceparent)
+	c.Set(tracing.Tracestate, "congo=t61rcWkgMzE")
+	tracing.Inject(m, c)
+	MustBeTrue(t, len(m.Body) > len("payload"))
+
+	got, ok := tracing.Extract(m)
+	MustBeTrue(t, ok)
+	MustBeTrue(t, string(m.Body) == "payload")
+	MustBeTrue(t, got.Get(tracing.Traceparent) == testTraceparent)
+	MustBeTrue(t, got.Get(tracing.Tracestate) == "congo=t61rcWkgMzE")
+	MustBeTrue(t, len(got.Keys()) == 2)
+
+	// Nothing more to extract.
+	_, ok = tracing.Extract(m)
+	MustBeFalse(t, ok)
+	MustBeTrue(t, string(m.Body) == "payload")
+
+	// Bad trace contexts are not sent at all.
+	for _, tp := range []string{"", "junk",
+		strings.Replace(testTraceparent, "4b", "zz", 1),
+		"ff" + testTraceparent[2:]} {
+		c = tracing.Carrier{tracing.Traceparent: tp}
+		tracing.Inject(m, c)
+		MustBeTrue(t, string(m.Body) == "payload")
+	}
+	m.Free()
+}
+
+func TestTracingDevice(t *testing.T) {
+	// REQ -> device -> REP, with the trace context carried through the
+	// device (which knows nothing about it) and back again.
+	front := AddrTestInp()
+	back := AddrTestInp()
+
+	s1, err := xrep.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	s2, err := xreq.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s1.Listen(front))
+	MustSucceed(t, s2.Listen(back))
+	MustSucceed(t, mangos.Device(s1, s2))
+
+	reqSock, err := req.NewSocket()
+	MustSucceed(t, err)
+	repSock, err := rep.NewSocket()
+	MustSucceed(t, err)
+
+	var reqGot, repGot string
+	client := tracing.Wrap(reqSock, tracing.Hooks{
+		Send: func(*mangos.Message) tracing.Carrier {
+			return tracing.Carrier{tracing.Traceparent: testTraceparent}
+		},
+		Recv: func(_ *mangos.Message, c tracing.Carrier) {
+			reqGot = c.Get(tracing.Traceparent)
+		},
+	})
+	defer client.Close()
+	server := tracing.Wrap(repSock, tracing.Hooks{
+		Send: func(*mangos.Message) tracing.Carrier {
+			// Reply as a child span.
+			return tracing.Carrier{tracing.Traceparent: strings.Replace(
+				repGot, "00f067aa0ba902b7", "b7ad6b7169203331", 1)}
+		},
+		Recv: func(_ *mangos.Message, c tracing.Carrier) {
+			repGot = c.Get(tracing.Traceparent)
+		},
+	})
+	defer server.Close()
+
+	MustSucceed(t, client.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, server.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, client.Dial(front))
+	MustSucceed(t, server.Dial(back))
+
+	MustSucceed(t, client.Send([]byte("ping")))
+	b, err := server.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+	MustBeTrue(t, repGot == testTraceparent)
+
+	MustSucceed(t, server.Send([]byte("pong")))
+	b, err = client.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "pong")
+	MustBeTrue(t, strings.HasSuffix(reqGot, "-b7ad6b7169203331-01"))
+	MustBeTrue(t, strings.HasPrefix(reqGot, testTraceparent[:35]))
+}
+
+func TestTracingContext(t *testing.T) {
+	addr := AddrTestInp()
+	var got string
+	s1, err := rep.NewSocket()
+	MustSucceed(t, err)
+	server := tracing.Wrap(s1, tracing.Hooks{
+		Recv: func(_ *mangos.Message, c tracing.Carrier) {
+			got = c.Get(tracing.Traceparent)
+		},
+	})
+	defer server.Close()
+	s2, err := req.NewSocket()
+	MustSucceed(t, err)
+	client := tracing.Wrap(s2, tracing.Hooks{
+		Send: func(*mangos.Message) tracing.Carrier {
+			return tracing.Carrier{tracing.Traceparent: testTraceparent}
+		},
+	})
+	defer client.Close()
+	MustSucceed(t, server.Listen(addr))
+	MustSucceed(t, client.Dial(addr))
+
+	cc, err := client.OpenContext()
+	MustSucceed(t, err)
+	sc, err := server.OpenContext()
+	MustSucceed(t, err)
+	MustSucceed(t, sc.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, cc.Send([]byte("ping")))
+	b, err := sc.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "ping")
+	MustBeTrue(t, got == testTraceparent)
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+)
+
+// fakeTran is a test double that refuses every connection, but
+// records the addresses it is asked to use.
+type fakeTran struct {
+	dialed   []string
+	listened []string
+}
+
+type fakeDialer struct {
+	t    *fakeTran
+	addr string
+}
+
+type fakeListener struct {
+	t    *fakeTran
+	addr string
+}
+
+func (*fakeTran) Scheme() string { return "fake" }
+
+func (t *fakeTran) NewDialer(addr string, _ mangos.Socket) (mangos.TranDialer, error) {
+	return &fakeDialer{t: t, addr: addr}, nil
+}
+
+func (t *fakeTran) NewListener(addr string, _ mangos.Socket) (mangos.TranListener, error) {
+	return &fakeListener{t: t, addr: addr}, nil
+}
+
+func (d *fakeDialer) Dial() (mangos.TranPipe, error) {
+	d.t.dialed = append(d.t.dialed, d.addr)
+	return nil, mangos.ErrConnRefused
+}
+
+func (*fakeDialer) SetOption(string, interface{}) error { return mangos.ErrBadOption }
+
+func (*fakeDialer) GetOption(string) (interface{}, error) { return nil, mangos.ErrBadOption }
+
+func (l *fakeListener) Listen() error {
+	l.t.listened = append(l.t.listened, l.addr)
+	return nil
+}
+
+func (*fakeListener) Accept() (mangos.TranPipe, error) { return nil, mangos.ErrClosed }
+
+func (*fakeListener) Close() error { return nil }
+
+func (*fakeListener) SetOption(string, interface{}) error { return mangos.ErrBadOption }
+
+func (*fakeListener) GetOption(string) (interface{}, error) { return nil, mangos.ErrBadOption }
+
+func (l *fakeListener) Address() string { return l.addr }
+
+func TestRegisterTransport(t *testing.T) {
+	ft := &fakeTran{}
+	mangos.RegisterTransport("fake+test", ft)
+	defer mangos.RegisterTransport("fake+test", nil)
+
+	MustBeTrue(t, mangos.GetTransport("fake+test") == ft)
+	found := false
+	for _, scheme := range mangos.RegisteredTransports() {
+		if scheme == "fake+test" {
+			found = true
+		}
+	}
+	MustBeTrue(t, found)
+
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	MustSucceed(t, s.Listen("fake+test://here"))
+	MustBeTrue(t, s.Dial("fake+test://there") == mangos.ErrConnRefused)
+	MustBeTrue(t, len(ft.listened) == 1 && ft.listened[0] == "fake+test://here")
+	MustBeTrue(t, len(ft.dialed) == 1 && ft.dialed[0] == "fake+test://there")
+
+	mangos.RegisterTransport("fake+test", nil)
+	MustBeTrue(t, mangos.GetTransport("fake+test") == nil)
+	MustBeTrue(t, s.Dial("fake+test://there") == mangos.ErrBadTran)
+}
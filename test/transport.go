@@ -42,7 +42,8 @@ type TranTest struct {
 // NewTranTest creates a TranTest.
 func NewTranTest(tran mangos.Transport, addr string) *TranTest {
 	tt := &TranTest{addr: addr, tran: tran}
-	if strings.HasPrefix(tt.addr, "tls+tcp://") || strings.HasPrefix(tt.addr, "wss://") {
+	if strings.HasPrefix(tt.addr, "tls+tcp://") || strings.HasPrefix(tt.addr, "wss://") ||
+		strings.HasPrefix(tt.addr, "quic://") {
 		tt.cliCfg, _ = GetTLSConfig(false)
 		tt.srvCfg, _ = GetTLSConfig(true)
 	}
@@ -152,7 +153,9 @@ func (tt *TranTest) TestDuplicateListen(t *testing.T) {
 		return
 	}
 
-	l2, err := tt.tran.NewListener(tt.addr, tt.sockReq)
+	// Transports may let a socket of another protocol share the
+	// address, but never another of the same protocol.
+	l2, err := tt.tran.NewListener(tt.addr, tt.sockRep)
 	if err != nil {
 		t.Errorf("NewListener faield: %v", err)
 		return
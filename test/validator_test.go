@@ -0,0 +1,135 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+var errNotJSON = errors.New("not JSON")
+
+func jsonOnly(m *mangos.Message) error {
+	if !json.Valid(m.Body) {
+		return errNotJSON
+	}
+	return nil
+}
+
+func TestValidatorRejects(t *testing.T) {
+	s1, s2 := hookPair(t)
+	defer s1.Close()
+	defer s2.Close()
+
+	v, err := s2.GetOption(mangos.OptionValidator)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(mangos.ValidatorFunc) == nil)
+	MustBeTrue(t, s2.SetOption(mangos.OptionValidator, jsonOnly) == mangos.ErrBadValue)
+
+	log := &testLogger{}
+	MustSucceed(t, s2.SetOption(mangos.OptionLogger, log))
+	MustSucceed(t, s2.SetOption(mangos.OptionValidator, mangos.ValidatorFunc(jsonOnly)))
+	// Validation sees what the hooks make of the message.
+	s1.AddSendHook(xor)
+	s2.AddRecvHook(xor)
+
+	MustSucceed(t, s1.Send([]byte("not json")))
+	MustSucceed(t, s1.Send([]byte(`{"ok": true}`)))
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == `{"ok": true}`)
+	MustBeTrue(t, s2.Stats().Invalid == 1)
+	MustBeTrue(t, s2.Stats().Received == 1)
+	MustBeTrue(t, log.wait("rejected: not JSON"))
+
+	// Nothing is checked once it is taken away.
+	MustSucceed(t, s2.SetOption(mangos.OptionValidator, nil))
+	MustSucceed(t, s1.Send([]byte("anything")))
+	b, err = s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "anything")
+	MustBeTrue(t, s2.Stats().Invalid == 1)
+}
+
+func TestValidatorContext(t *testing.T) {
+	addr := AddrTestInp()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, srv.Listen(addr))
+	MustSucceed(t, cli.Dial(addr))
+	MustSucceed(t, srv.SetOption(mangos.OptionValidator, mangos.ValidatorFunc(jsonOnly)))
+
+	sc, err := srv.OpenContext()
+	MustSucceed(t, err)
+	MustSucceed(t, sc.SetOption(mangos.OptionRecvDeadline, time.Millisecond*100))
+	c1, err := cli.OpenContext()
+	MustSucceed(t, err)
+	c2, err := cli.OpenContext()
+	MustSucceed(t, err)
+
+	MustSucceed(t, c1.Send([]byte("garbage")))
+	MustSucceed(t, c2.Send([]byte("[1, 2]")))
+	b, err := sc.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "[1, 2]")
+	_, err = sc.Recv()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	MustBeTrue(t, srv.Stats().Invalid == 1)
+}
+
+func TestValidatorNack(t *testing.T) {
+	addr := AddrTestInp()
+	s := newAckPush(t, addr, time.Millisecond*50)
+	defer s.Close()
+	l := newAckPull(t, addr)
+	defer l.Close()
+	MustSucceed(t, l.SetOption(mangos.OptionValidator, mangos.ValidatorFunc(jsonOnly)))
+	waitPipes(t, s, 1)
+
+	MustSucceed(t, s.Send([]byte("{broken")))
+	MustSucceed(t, s.Send([]byte(`"fine"`)))
+	m, err := l.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(m.Body) == `"fine"`)
+	MustSucceed(t, m.Ack())
+	m.Free()
+
+	// Neither is sent again: one was accepted, the other refused.
+	for i := 0; s.Stats().Protocol[mangos.StatNacked] == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	MustBeTrue(t, s.Stats().Protocol[mangos.StatNacked] == 1)
+	MustSucceed(t, l.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+	_, err = l.RecvMsg()
+	MustBeTrue(t, err == mangos.ErrRecvTimeout)
+	MustBeTrue(t, s.Stats().Protocol[mangos.StatRedelivered] == 0)
+	MustBeTrue(t, l.Stats().Invalid == 1)
+
+	// Nack is harmless on other messages.
+	m = mangos.NewMessage(0)
+	MustSucceed(t, m.Nack())
+	m.Free()
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestVerifySeal(t *testing.T) {
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("hello")...)
+	MustBeTrue(t, m.Verify())
+	m.Seal()
+	MustBeTrue(t, m.Verify())
+
+	// Headers are for protocols to change.
+	m.Header = append(m.Header, 1, 2, 3, 4)
+	MustBeTrue(t, m.Verify())
+
+	dup := m.Dup()
+	m.Body[0] = 'j'
+	MustBeFalse(t, m.Verify())
+	MustBeTrue(t, dup.Verify())
+	dup.Bodies = [][]byte{[]byte("more")}
+	MustBeFalse(t, dup.Verify())
+	dup.Free()
+	m.Free()
+
+	// Recycled messages start out unsealed.
+	m = mangos.NewMessage(0)
+	MustBeTrue(t, m.Verify())
+	m.Free()
+}
+
+func TestVerifyOption(t *testing.T) {
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	v, err := s.GetOption(mangos.OptionVerifyMessages)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == false)
+	MustSucceed(t, s.SetOption(mangos.OptionVerifyMessages, true))
+	v, err = s.GetOption(mangos.OptionVerifyMessages)
+	MustSucceed(t, err)
+	MustBeTrue(t, v == true)
+	MustBeTrue(t, s.SetOption(mangos.OptionVerifyMessages, 1) ==
+		mangos.ErrBadValue)
+	MustSucceed(t, s.SetOption(mangos.OptionStrict, true))
+	MustSucceed(t, s.SetOption(mangos.OptionVerifyMessages, false))
+}
+
+func TestVerifyModified(t *testing.T) {
+	addr := AddrTestInp()
+	log := &testLogger{}
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionLogger, log))
+	MustSucceed(t, s.SetOption(mangos.OptionVerifyMessages, true))
+	MustSucceed(t, s.Listen(addr))
+
+	// With no peer yet, these wait in the queue.
+	bad := mangos.NewMessage(0)
+	bad.Body = append(bad.Body, []byte("before")...)
+	MustSucceed(t, s.SendMsg(bad))
+	copy(bad.Body, "after!")
+	MustSucceed(t, s.Send([]byte("good")))
+
+	r, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, r.Dial(addr))
+
+	b, err := r.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "good")
+	MustBeTrue(t, log.wait("message modified after SendMsg"))
+	MustBeTrue(t, s.Stats().Modified == 1)
+}
+
+func TestVerifyModifiedNoLogger(t *testing.T) {
+	addr := AddrTestInp()
+	s, err := push.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	MustSucceed(t, s.SetOption(mangos.OptionVerifyMessages, true))
+	MustSucceed(t, s.Listen(addr))
+
+	// Without a logger, the message is still only dropped.
+	bad := mangos.NewMessage(0)
+	bad.Body = append(bad.Body, []byte("before")...)
+	MustSucceed(t, s.SendMsg(bad))
+	copy(bad.Body, "after!")
+	MustSucceed(t, s.Send([]byte("good")))
+
+	r, err := pull.NewSocket()
+	MustSucceed(t, err)
+	defer r.Close()
+	MustSucceed(t, r.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustSucceed(t, r.Dial(addr))
+
+	b, err := r.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "good")
+	MustBeTrue(t, s.Stats().Modified == 1)
+}
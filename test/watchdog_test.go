@@ -0,0 +1,56 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+)
+
+func TestWatchdogStall(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+
+	firedq := make(chan mangos.Socket, 1)
+	MustBeNil(t, s.SetWatchdogHook(func(ws mangos.Socket) {
+		firedq <- ws
+	}))
+	MustSucceed(t, s.SetOption(mangos.OptionWriteQLen, 0))
+	MustSucceed(t, s.SetOption(mangos.OptionWatchdogTime, time.Millisecond*20))
+	v, err := s.GetOption(mangos.OptionWatchdogTime)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(time.Duration) == time.Millisecond*20)
+
+	// Idle sockets must not trigger the watchdog.
+	select {
+	case <-firedq:
+		t.Fatalf("Watchdog fired on idle socket")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// With no peer, and no queue, this send cannot complete.
+	go s.Send([]byte("stuck"))
+
+	select {
+	case ws := <-firedq:
+		MustBeTrue(t, ws == s)
+	case <-time.After(time.Second):
+		t.Fatalf("Watchdog did not fire")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/transport/ws"
+)
+
+// wsPair has s2 dial s1, with the options given to each, and returns the
+// error from dialing.
+func wsPair(t *testing.T, lopts, dopts map[string]interface{}) (mangos.Socket, mangos.Socket, error) {
+	addr := AddrTestWS()
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s1.ListenOptions(addr, lopts))
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	return s1, s2, s2.DialOptions(addr, dopts)
+}
+
+func TestWSHeaderGateway(t *testing.T) {
+	s1, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s1.Close()
+	l, err := s1.NewListener("ws://127.0.0.1:0/sp", nil)
+	MustSucceed(t, err)
+	v, err := l.GetOption(ws.OptionWebSocketHandler)
+	MustSucceed(t, err)
+	MustSucceed(t, l.Listen())
+
+	// A gateway admitting only those bearing the token.
+	handler := v.(http.Handler)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sesame" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer gw.Close()
+	addr := "ws" + strings.TrimPrefix(gw.URL, "http") + "/sp"
+
+	s2, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s2.Close()
+	MustSucceed(t, s2.SetOption(mangos.OptionRecvDeadline, time.Second))
+	MustBeTrue(t, s2.Dial(addr) == mangos.ErrConnRefused)
+
+	d, err := s2.NewDialer(addr, nil)
+	MustSucceed(t, err)
+	MustBeTrue(t, d.SetOption(ws.OptionWebSocketHeader, "token") == mangos.ErrBadValue)
+	MustSucceed(t, d.SetOption(ws.OptionWebSocketHeader,
+		http.Header{"Authorization": {"Bearer sesame"}}))
+	MustSucceed(t, d.Dial())
+	MustSucceed(t, s1.Send([]byte("admitted")))
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "admitted")
+}
+
+func TestWSSubprotocol(t *testing.T) {
+	opts := map[string]interface{}{ws.OptionWebSocketSubprotocol: "chat.example.com"}
+	s1, s2, err := wsPair(t, opts, opts)
+	defer s1.Close()
+	defer s2.Close()
+	MustSucceed(t, err)
+	MustSucceed(t, s1.Send([]byte("custom")))
+	b, err := s2.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(b) == "custom")
+
+	// The default no longer matches, so the listener hangs up.
+	s3, s4, _ := wsPair(t, opts, nil)
+	defer s3.Close()
+	defer s4.Close()
+	time.Sleep(time.Millisecond * 100)
+	MustBeTrue(t, s3.Stats().Pipes == 0)
+
+	l, err := s3.NewListener(AddrTestWS(), nil)
+	MustSucceed(t, err)
+	MustBeTrue(t, l.SetOption(ws.OptionWebSocketSubprotocol, "") == mangos.ErrBadValue)
+}
+
+func TestWSOriginFunc(t *testing.T) {
+	allow := ws.OriginFunc(func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "https://app.example.com"
+	})
+	lopts := map[string]interface{}{ws.OptionWebSocketOriginFunc: allow}
+
+	s1, s2, err := wsPair(t, lopts, map[string]interface{}{
+		ws.OptionWebSocketHeader: http.Header{
+			"Origin": {"https://evil.example.com"}},
+	})
+	defer s1.Close()
+	defer s2.Close()
+	MustBeTrue(t, err == mangos.ErrConnRefused)
+
+	s3, s4, err := wsPair(t, lopts, map[string]interface{}{
+		ws.OptionWebSocketHeader: http.Header{
+			"Origin": {"https://app.example.com"}},
+	})
+	defer s3.Close()
+	defer s4.Close()
+	MustSucceed(t, err)
+
+	// The default check refuses an origin other than the host.
+	s5, s6, err := wsPair(t, map[string]interface{}{
+		ws.OptionWebSocketOriginFunc: nil,
+	}, map[string]interface{}{
+		ws.OptionWebSocketHeader: http.Header{
+			"Origin": {"https://app.example.com"}},
+	})
+	defer s5.Close()
+	defer s6.Close()
+	MustBeTrue(t, err == mangos.ErrConnRefused)
+
+	l, err := s5.NewListener(AddrTestWS(), nil)
+	MustSucceed(t, err)
+	MustBeTrue(t, l.SetOption(ws.OptionWebSocketOriginFunc, true) == mangos.ErrBadValue)
+	MustSucceed(t, l.SetOption(ws.OptionWebSocketOriginFunc,
+		func(*http.Request) bool { return true }))
+}
@@ -0,0 +1,244 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/bridge/zmq"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+// zmqAddr returns the ZeroMQ address of a listening bridge.
+func zmqAddr(b *zmq.Bridge) string {
+	return "tcp://" + b.Addr().String()
+}
+
+// TestZmqBridgePubSub runs SP publish/subscribe over ZeroMQ, from an SP
+// publisher to a bridge that is a ZeroMQ PUB, to one that is a ZeroMQ
+// SUB, and on to an SP subscriber.
+func TestZmqBridgePubSub(t *testing.T) {
+	srcAddr := AddrTestInp()
+	dstAddr := AddrTestInp()
+
+	src, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer src.Close()
+	MustSucceed(t, src.Listen(srcAddr))
+	in, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer in.Close()
+	MustSucceed(t, in.Dial(srcAddr))
+	zpub, err := zmq.Listen(in, "tcp://127.0.0.1:0")
+	MustSucceed(t, err)
+	defer zpub.Close()
+
+	out, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer out.Close()
+	MustSucceed(t, out.Listen(dstAddr))
+	zsub, err := zmq.Dial(out, zmqAddr(zpub))
+	MustSucceed(t, err)
+	defer zsub.Close()
+
+	dst := newSubFwd(t, dstAddr, "a")
+	defer dst.Close()
+	// Only what is wanted at the end is subscribed to at the start.
+	waitSubs(t, out, "a")
+	waitPipes(t, src, 1)
+	v, err := src.GetOption(mangos.OptionSubscriptions)
+	MustSucceed(t, err)
+	MustBeTrue(t, len(v.([][]byte)) == 1)
+
+	for i := 0; i < 100; i++ {
+		if got := recvAll(dst); len(got) != 0 {
+			break
+		}
+		MustSucceed(t, src.Send([]byte("a0")))
+	}
+	for _, b := range []string{"a1", "b1", "a2"} {
+		MustSucceed(t, src.Send([]byte(b)))
+	}
+	got := recvAll(dst)
+	MustBeTrue(t, strings.Join(got, " ") == "a1 a2")
+
+	MustSucceed(t, zsub.Close())
+	MustBeTrue(t, zsub.Close() == mangos.ErrClosed)
+}
+
+// TestZmqBridgeReqRep runs SP request/reply over ZeroMQ, from an SP
+// client to a bridge that is a ZeroMQ REQ, to one that is a ZeroMQ REP,
+// and on to an SP server.
+func TestZmqBridgeReqRep(t *testing.T) {
+	cliAddr := AddrTestInp()
+	srvAddr := AddrTestInp()
+
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.Listen(srvAddr))
+	go func() {
+		for {
+			b, err := srv.Recv()
+			if err != nil {
+				return
+			}
+			if srv.Send(append([]byte("re: "), b...)) != nil {
+				return
+			}
+		}
+	}()
+	out, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer out.Close()
+	MustSucceed(t, out.Dial(srvAddr))
+	zrep, err := zmq.Listen(out, "tcp://127.0.0.1:0")
+	MustSucceed(t, err)
+	defer zrep.Close()
+
+	in, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer in.Close()
+	MustSucceed(t, in.Listen(cliAddr))
+	zreq, err := zmq.Dial(in, zmqAddr(zrep))
+	MustSucceed(t, err)
+	defer zreq.Close()
+
+	cli, err := req.NewSocket()
+	MustSucceed(t, err)
+	defer cli.Close()
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, cli.Dial(cliAddr))
+	for i := 0; i < 3; i++ {
+		MustSucceed(t, cli.Send([]byte("hello")))
+		b, err := cli.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "re: hello")
+	}
+}
+
+// zmtpPeer is just enough of a ZeroMQ peer to check the wire protocol.
+type zmtpPeer struct {
+	t *testing.T
+	c net.Conn
+}
+
+func dialZmtp(t *testing.T, addr string, self string) *zmtpPeer {
+	c, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	MustSucceed(t, err)
+	MustSucceed(t, c.SetDeadline(time.Now().Add(time.Second*5)))
+	p := &zmtpPeer{t: t, c: c}
+
+	g := make([]byte, 64)
+	g[0], g[9], g[10], g[11] = 0xff, 0x7f, 3, 1
+	copy(g[12:], "NULL")
+	_, err = c.Write(g)
+	MustSucceed(t, err)
+	_, err = io.ReadFull(c, g)
+	MustSucceed(t, err)
+	MustBeTrue(t, g[0] == 0xff && g[9] == 0x7f && g[10] == 3)
+	MustBeTrue(t, string(g[12:16]) == "NULL")
+
+	ready := []byte("\x05READY\x0bSocket-Type\x00\x00\x00")
+	ready = append(ready, byte(len(self)))
+	ready = append(ready, self...)
+	p.write(0x04, ready)
+	flags, body := p.read()
+	MustBeTrue(t, flags == 0x04)
+	MustBeTrue(t, bytes.HasPrefix(body, []byte("\x05READY")))
+	return p
+}
+
+func (p *zmtpPeer) write(flags byte, body []byte) {
+	_, err := p.c.Write(append([]byte{flags, byte(len(body))}, body...))
+	MustSucceed(p.t, err)
+}
+
+func (p *zmtpPeer) read() (byte, []byte) {
+	hdr := make([]byte, 2)
+	_, err := io.ReadFull(p.c, hdr)
+	MustSucceed(p.t, err)
+	body := make([]byte, hdr[1])
+	_, err = io.ReadFull(p.c, body)
+	MustSucceed(p.t, err)
+	return hdr[0], body
+}
+
+func TestZmqBridgeWire(t *testing.T) {
+	srcAddr := AddrTestInp()
+	src, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer src.Close()
+	MustSucceed(t, src.Listen(srcAddr))
+	in, err := sub.NewSocket()
+	MustSucceed(t, err)
+	defer in.Close()
+	MustSucceed(t, in.Dial(srcAddr))
+	b, err := zmq.Listen(in, "tcp://127.0.0.1:0")
+	MustSucceed(t, err)
+	defer b.Close()
+
+	p := dialZmtp(t, zmqAddr(b), "SUB")
+	defer p.c.Close()
+	// A ZMTP 3.0 subscription, and a 3.1 one.
+	p.write(0, []byte("\x01a"))
+	p.write(0x04, []byte("\x09SUBSCRIBEc"))
+	time.Sleep(time.Millisecond * 100)
+	for _, m := range []string{"a1", "b1", "c1"} {
+		MustSucceed(t, src.Send([]byte(m)))
+	}
+	flags, body := p.read()
+	MustBeTrue(t, flags == 0 && string(body) == "a1")
+	flags, body = p.read()
+	MustBeTrue(t, flags == 0 && string(body) == "c1")
+
+	// A peer of the wrong type is turned away.
+	c, err := net.Dial("tcp", b.Addr().String())
+	MustSucceed(t, err)
+	defer c.Close()
+	MustSucceed(t, c.SetDeadline(time.Now().Add(time.Second*5)))
+	g := make([]byte, 64)
+	g[0], g[9], g[10] = 0xff, 0x7f, 3
+	copy(g[12:], "NULL")
+	_, err = c.Write(append(g, []byte("\x04\x19\x05READY\x0bSocket-Type\x00\x00\x00\x03REP")...))
+	MustSucceed(t, err)
+	_, err = io.ReadAll(c)
+	MustSucceed(t, err)
+}
+
+func TestZmqBridgeBad(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	_, err = zmq.Dial(s, "tcp://127.0.0.1:1")
+	MustBeTrue(t, err == mangos.ErrBadProto)
+
+	p, err := pub.NewSocket()
+	MustSucceed(t, err)
+	defer p.Close()
+	_, err = zmq.Dial(p, "inproc://nowhere")
+	MustBeTrue(t, err == mangos.ErrBadTran)
+}
@@ -0,0 +1,302 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package tracing carries distributed trace context (the W3C traceparent
+// and tracestate fields) along with messages, so that request chains
+// through REQ/REP devices and the like can be traced end to end.
+//
+// SP has no room in its headers for application data, so the trace
+// context travels in a short binary envelope at the front of the message
+// body.  Both ends must therefore use this package (devices forward the
+// envelope untouched, and need not).  A peer that does not will see the
+// envelope as part of the payload.
+//
+// The Carrier type has the Get, Set and Keys methods of OpenTelemetry's
+// propagation.TextMapCarrier, so a propagator can fill it in or read it
+// directly:
+//
+//	c := tracing.Carrier{}
+//	otel.GetTextMapPropagator().Inject(ctx, c)
+//	tracing.Inject(msg, c)
+//
+//	c, _ := tracing.Extract(msg)
+//	ctx = otel.GetTextMapPropagator().Extract(ctx, c)
+//
+// Alternatively, Wrap a socket to have this done for every message.
+package tracing
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/internal/core"
+)
+
+// Carrier field names, as defined by the W3C Trace Context specification.
+const (
+	Traceparent = "traceparent"
+	Tracestate  = "tracestate"
+)
+
+// Carrier holds the trace context fields sent with a message.  Only the
+// traceparent and tracestate fields are carried; others are discarded.
+type Carrier map[string]string
+
+// Get returns the value of a field, or "" if it is not present.
+func (c Carrier) Get(key string) string {
+	return c[strings.ToLower(key)]
+}
+
+// Set sets the value of a field.
+func (c Carrier) Set(key, value string) {
+	c[strings.ToLower(key)] = value
+}
+
+// Keys returns the names of the fields present.
+func (c Carrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// The envelope is a magic number, a version byte, the 16 byte trace ID,
+// the 8 byte parent (span) ID, the trace flags, and a two byte length
+// followed by the tracestate.  The magic number starts with a byte that
+// cannot start UTF-8 text, to make collisions with payloads less likely.
+var magic = []byte{0xff, 'T', 'C'}
+
+const (
+	version    = 0
+	fixedLen   = 3 + 1 + 16 + 8 + 1 + 2
+	maxState   = 512 // the specification's limit
+	parentLen  = 55  // "00-" + 32 + "-" + 16 + "-" + 2
+	traceIDEnd = 3 + 32
+	spanIDEnd  = traceIDEnd + 1 + 16
+)
+
+// encode returns the envelope for c, or nil if c does not hold a valid
+// traceparent.
+func encode(c Carrier) []byte {
+	tp := c.Get(Traceparent)
+	if len(tp) < parentLen || tp[2] != '-' || tp[traceIDEnd] != '-' ||
+		tp[spanIDEnd] != '-' {
+		return nil
+	}
+	if ver, err := hex.DecodeString(tp[:2]); err != nil || ver[0] == 0xff {
+		return nil
+	}
+	ts := c.Get(Tracestate)
+	if len(ts) > maxState {
+		ts = ""
+	}
+	b := make([]byte, fixedLen, fixedLen+len(ts))
+	copy(b, magic)
+	b[3] = version
+	if _, err := hex.Decode(b[4:20], []byte(tp[3:traceIDEnd])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(b[20:28], []byte(tp[traceIDEnd+1:spanIDEnd])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(b[28:29], []byte(tp[spanIDEnd+1:parentLen])); err != nil {
+		return nil
+	}
+	binary.BigEndian.PutUint16(b[29:], uint16(len(ts)))
+	return append(b, ts...)
+}
+
+// decode parses an envelope from the front of b, returning the carrier
+// and the length of the envelope, or zero if there is none.
+func decode(b []byte) (Carrier, int) {
+	if len(b) < fixedLen || b[0] != magic[0] || b[1] != magic[1] ||
+		b[2] != magic[2] || b[3] != version {
+		return nil, 0
+	}
+	n := fixedLen + int(binary.BigEndian.Uint16(b[29:]))
+	if len(b) < n {
+		return nil, 0
+	}
+	c := Carrier{
+		Traceparent: "00-" + hex.EncodeToString(b[4:20]) + "-" +
+			hex.EncodeToString(b[20:28]) + "-" +
+			hex.EncodeToString(b[28:29]),
+	}
+	if n > fixedLen {
+		c[Tracestate] = string(b[fixedLen:n])
+	}
+	return c, n
+}
+
+// Inject places the trace context in c at the front of the message body.
+// If c has no valid traceparent, the message is left alone.
+func Inject(m *mangos.Message, c Carrier) {
+	if env := encode(c); env != nil {
+		m.Body = append(env, m.Body...)
+	}
+}
+
+// Extract removes the trace context from the front of the message body,
+// and returns it.  If the message has none, the result is false, and the
+// message is left alone.
+func Extract(m *mangos.Message) (Carrier, bool) {
+	c, n := decode(m.Body)
+	if n == 0 {
+		return nil, false
+	}
+	m.Body = m.Body[n:]
+	return c, true
+}
+
+// Hooks connect a wrapped socket to a tracing system.  Either may be nil.
+type Hooks struct {
+	// Send is called for each message about to be sent, and returns
+	// the trace context to send with it, or nil for none.
+	Send func(m *mangos.Message) Carrier
+
+	// Recv is called for each message received that carries a trace
+	// context, before it is returned to the application.
+	Recv func(m *mangos.Message, c Carrier)
+}
+
+// Wrap returns a socket that calls the hooks for every message sent or
+// received with it (including by way of contexts opened on it), adding
+// and removing the trace context as it goes.  Messages received without
+// a trace context are passed through unchanged.
+func Wrap(s mangos.Socket, h Hooks) mangos.Socket {
+	return &socket{Socket: s, h: h}
+}
+
+type socket struct {
+	mangos.Socket
+	h Hooks
+}
+
+type context struct {
+	mangos.Context
+	h Hooks
+}
+
+func (h Hooks) send(m *mangos.Message) {
+	if h.Send != nil {
+		if c := h.Send(m); c != nil {
+			Inject(m, c)
+		}
+	}
+}
+
+func (h Hooks) recv(m *mangos.Message) {
+	if c, ok := Extract(m); ok && h.Recv != nil {
+		h.Recv(m, c)
+	}
+}
+
+func (s *socket) SendMsg(m *mangos.Message) error {
+	s.h.send(m)
+	return s.Socket.SendMsg(m)
+}
+
+func (s *socket) SendMsgs(msgs []*mangos.Message) error {
+	for _, m := range msgs {
+		s.h.send(m)
+	}
+	return s.Socket.SendMsgs(msgs)
+}
+
+func (s *socket) Send(b []byte) error {
+	m := mangos.NewMessage(len(b))
+	m.Body = append(m.Body, b...)
+	return s.SendMsg(m)
+}
+
+func (s *socket) RecvMsg() (*mangos.Message, error) {
+	m, err := s.Socket.RecvMsg()
+	if err == nil {
+		s.h.recv(m)
+	}
+	return m, err
+}
+
+func (s *socket) RecvMsgs(max int) ([]*mangos.Message, error) {
+	msgs, err := s.Socket.RecvMsgs(max)
+	for _, m := range msgs {
+		s.h.recv(m)
+	}
+	return msgs, err
+}
+
+func (s *socket) Recv() ([]byte, error) {
+	m, err := s.RecvMsg()
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(nil), m.Body...)
+	m.Free()
+	return b, nil
+}
+
+func (s *socket) Serve(h mangos.Handler) error {
+	return core.Serve(s, h)
+}
+
+func (s *socket) ServeReply(h mangos.ReplyHandler) error {
+	return core.ServeReply(s, h)
+}
+
+func (s *socket) ReaderOnly() mangos.SocketReader {
+	return core.ReaderOnly(s)
+}
+
+func (s *socket) WriterOnly() mangos.SocketWriter {
+	return core.WriterOnly(s)
+}
+
+func (s *socket) OpenContext() (mangos.Context, error) {
+	c, err := s.Socket.OpenContext()
+	if err != nil {
+		return nil, err
+	}
+	return &context{Context: c, h: s.h}, nil
+}
+
+func (c *context) SendMsg(m *mangos.Message) error {
+	c.h.send(m)
+	return c.Context.SendMsg(m)
+}
+
+func (c *context) Send(b []byte) error {
+	m := mangos.NewMessage(len(b))
+	m.Body = append(m.Body, b...)
+	return c.SendMsg(m)
+}
+
+func (c *context) RecvMsg() (*mangos.Message, error) {
+	m, err := c.Context.RecvMsg()
+	if err == nil {
+		c.h.recv(m)
+	}
+	return m, err
+}
+
+func (c *context) Recv() ([]byte, error) {
+	m, err := c.RecvMsg()
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(nil), m.Body...)
+	m.Free()
+	return b, nil
+}
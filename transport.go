@@ -14,6 +14,11 @@
 
 package mangos
 
+import (
+	"sort"
+	"sync"
+)
+
 // XXX: The interfaces listed here will eventually move to the Transport
 // package, to be named without the Tran prefix, and then this file will
 // go away.
@@ -64,6 +69,45 @@ type TranPipe interface {
 	GetOption(string) (interface{}, error)
 }
 
+// TranPipeSetter is implemented by a TranPipe whose settings can be
+// changed while it is connected.  When an option such as OptionKeepAlive
+// is changed on a socket, dialer, or listener, the socket applies it to
+// the affected pipes that implement this, so that the change takes
+// effect without a reconnect.  ErrBadOption should be returned for
+// options that cannot be changed on a live pipe.
+type TranPipeSetter interface {
+	SetOption(name string, value interface{}) error
+}
+
+// TranPipeBatchSender is implemented by a TranPipe that can send several
+// messages together, coalescing them into fewer writes than sending each
+// in turn would take.  The pipe owns the messages, whether or not it
+// succeeds, and frees them.
+type TranPipeBatchSender interface {
+	SendMsgs([]*Message) error
+}
+
+// TranPipeFlusher is implemented by a TranPipe that may hold back what
+// is sent, to coalesce it into fewer writes, as for OptionCoalesceTime.
+// Flush writes what is held back at once.
+type TranPipeFlusher interface {
+	Flush() error
+}
+
+// TranPipeCredit is implemented by a TranPipe that can limit what its
+// peer sends with credits, for OptionCreditWindow.  The socket calls
+// Grant as each message received on the pipe is consumed (or discarded),
+// so that the peer may send another.
+type TranPipeCredit interface {
+	// Grant returns credit for n messages to the peer.
+	Grant(n int)
+
+	// Credit returns the number of messages that may yet be sent to
+	// the peer, and that the peer may yet send, before more credit is
+	// granted, each being -1 if there is no limit.
+	Credit() (send, recv int)
+}
+
 // TranDialer represents the client side of a connection.  Clients initiate
 // the connection.
 //
@@ -71,6 +115,10 @@ type TranPipe interface {
 // not be directly used in applications.
 type TranDialer interface {
 	// Dial is used to initiate a connection to a remote peer.
+	// If a connection was established, but refused by a policy
+	// check such as TLS peer verification, both the pipe and the
+	// error may be returned.  The socket reports such a pipe with
+	// PipeEventRejected, and then closes it.
 	Dial() (TranPipe, error)
 
 	// SetOption sets a local option on the dialer.
@@ -97,7 +145,9 @@ type TranListener interface {
 
 	// Accept completes the server side of a connection.  Once the
 	// connection is established and initial handshaking is complete,
-	// the resulting connection is returned to the client.
+	// the resulting connection is returned to the client.  As with
+	// TranDialer.Dial, a pipe that was refused by a policy check may
+	// be returned along with the error.
 	Accept() (TranPipe, error)
 
 	// Close ceases any listening activity, and will specifically close
@@ -122,6 +172,17 @@ type TranListener interface {
 }
 
 // Transport is the interface for transport suppliers to implement.
+// Third parties can supply their own transports (shared memory, RDMA,
+// or test doubles, for example) by implementing this, along with the
+// TranDialer, TranListener, and TranPipe interfaces, and then calling
+// RegisterTransport.  Sockets select the transport to use for Dial and
+// Listen based upon the scheme of the address.
+//
+// Pipes must deliver whole messages, and must preserve message
+// boundaries.  The pipe Send method owns the message, and should Free
+// it if it succeeds.  Transports must also exchange the SP protocol
+// numbers with the peer, and refuse the connection with a
+// ProtocolError if the peer's protocol is not the expected one.
 type Transport interface {
 	// Scheme returns a string used as the prefix for SP "addresses".
 	// This is similar to a URI scheme.  For example, schemes can be
@@ -137,3 +198,43 @@ type Transport interface {
 	// any "listen" backlog.
 	NewListener(url string, sock Socket) (TranListener, error)
 }
+
+var tranLock sync.RWMutex
+var transports = map[string]Transport{}
+
+// RegisterTransport registers the transport globally, for addresses
+// starting with the given scheme (without the trailing "://").  After
+// this, it is available for all sockets.  This will override any other
+// transport registered for the same scheme.  If t is nil, then any
+// transport registered for the scheme is removed.  Note that the
+// transport is handed the entire address, including the scheme.
+func RegisterTransport(scheme string, t Transport) {
+	tranLock.Lock()
+	if t == nil {
+		delete(transports, scheme)
+	} else {
+		transports[scheme] = t
+	}
+	tranLock.Unlock()
+}
+
+// GetTransport returns the transport registered for the given scheme,
+// or nil if there is none.
+func GetTransport(scheme string) Transport {
+	tranLock.RLock()
+	defer tranLock.RUnlock()
+	return transports[scheme]
+}
+
+// RegisteredTransports returns the schemes of all registered
+// transports, in sorted order.
+func RegisteredTransports() []string {
+	tranLock.RLock()
+	schemes := make([]string, 0, len(transports))
+	for scheme := range transports {
+		schemes = append(schemes, scheme)
+	}
+	tranLock.RUnlock()
+	sort.Strings(schemes)
+	return schemes
+}
@@ -21,8 +21,14 @@ import (
 	"nanomsg.org/go/mangos/v2"
 
 	// import transports
+	_ "nanomsg.org/go/mangos/v2/transport/fdpass"
 	_ "nanomsg.org/go/mangos/v2/transport/inproc"
 	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+	_ "nanomsg.org/go/mangos/v2/transport/mcast"
+	_ "nanomsg.org/go/mangos/v2/transport/noise"
+	_ "nanomsg.org/go/mangos/v2/transport/quic"
+	_ "nanomsg.org/go/mangos/v2/transport/serial"
+	_ "nanomsg.org/go/mangos/v2/transport/shm"
 	_ "nanomsg.org/go/mangos/v2/transport/tcp"
 	_ "nanomsg.org/go/mangos/v2/transport/tlstcp"
 	_ "nanomsg.org/go/mangos/v2/transport/ws"
@@ -0,0 +1,73 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// HasTLSCert reports whether a listener's TLS configuration has a way
+// to present a certificate: Certificates, GetCertificate, or
+// GetConfigForClient.
+func HasTLSCert(config *tls.Config) bool {
+	return len(config.Certificates) > 0 ||
+		config.GetCertificate != nil ||
+		config.GetConfigForClient != nil
+}
+
+// CertReloader holds a certificate loaded from a pair of PEM files,
+// which can be loaded again when they are replaced, as when they are
+// renewed, without closing the listeners that present it.  Use it by
+// setting the GetCertificate field of the listener's tls.Config to the
+// reloader's GetCertificate method.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	sync.RWMutex
+}
+
+// NewCertReloader returns a CertReloader holding the certificate and key
+// in the given files.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again.  The new certificate is presented by
+// handshakes from then on; established connections are unaffected.  If
+// the files cannot be loaded, the certificate held before is kept.
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	r.cert = &cert
+	r.Unlock()
+	return nil
+}
+
+// GetCertificate returns the certificate most recently loaded, for use
+// as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
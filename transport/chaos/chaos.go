@@ -0,0 +1,342 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chaos wraps a real transport, so that it misbehaves like a
+// poor network: messages are delayed, bandwidth is limited, and
+// connections are dropped at random.  It is meant for soak tests of
+// reconnect and retry logic.
+//
+// A wrapped transport must be registered.  Its scheme is that of the
+// wrapped one with "chaos+" in front, so for example:
+//
+//	t := chaos.New(tcp.Transport)
+//	transport.RegisterTransport(t)
+//	sock.Dial("chaos+tcp://127.0.0.1:5555")
+//
+// The misbehavior is set with SetConfig, which may be called at any
+// time, and applies to connections already made as well as new ones.
+// The zero Config, which is the initial one, passes everything through
+// untouched.  Delays are applied to messages as they are received, so
+// they do not limit throughput, and the order of messages is kept.
+package chaos
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// Config describes how a wrapped transport misbehaves.
+type Config struct {
+	// Latency is added to the delivery of every message.
+	Latency time.Duration
+
+	// Jitter is the most that is added to Latency, at random, for
+	// each message.  Delivery stays in order, so a message is never
+	// delivered before the one ahead of it.
+	Jitter time.Duration
+
+	// Bandwidth limits the bytes per second sent on each pipe.  Zero
+	// means no limit.
+	Bandwidth int
+
+	// MeanUptime is the average time that a pipe stays connected,
+	// before it is closed at random.  The time for each pipe is
+	// drawn from an exponential distribution, as failures often are.
+	// Zero means that pipes are never closed.
+	MeanUptime time.Duration
+}
+
+// Transport is a transport that wraps another.  It is safe to use
+// from multiple goroutines.
+type Transport struct {
+	base  transport.Transport
+	cfg   Config
+	rng   *rand.Rand
+	pipes map[*pipe]struct{}
+	sync.Mutex
+}
+
+// New returns a Transport that wraps base.
+func New(base transport.Transport) *Transport {
+	return &Transport{
+		base:  base,
+		rng:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		pipes: make(map[*pipe]struct{}),
+	}
+}
+
+// Scheme implements transport.Transport.
+func (t *Transport) Scheme() string {
+	return "chaos+" + t.base.Scheme()
+}
+
+// SetConfig changes the misbehavior.  It applies at once to the pipes
+// already connected, which are given new uptimes.
+func (t *Transport) SetConfig(c Config) {
+	t.Lock()
+	defer t.Unlock()
+	t.cfg = c
+	for p := range t.pipes {
+		p.arm(t.uptime())
+	}
+}
+
+// Config returns the current misbehavior.
+func (t *Transport) Config() Config {
+	t.Lock()
+	defer t.Unlock()
+	return t.cfg
+}
+
+// Disconnect closes every connected pipe now.
+func (t *Transport) Disconnect() {
+	t.Lock()
+	pipes := make([]*pipe, 0, len(t.pipes))
+	for p := range t.pipes {
+		pipes = append(pipes, p)
+	}
+	t.Unlock()
+	for _, p := range pipes {
+		p.Close()
+	}
+}
+
+// uptime returns how long a pipe should stay up.  The caller must
+// hold the lock.
+func (t *Transport) uptime() time.Duration {
+	if t.cfg.MeanUptime <= 0 {
+		return 0
+	}
+	d := time.Duration(t.rng.ExpFloat64() * float64(t.cfg.MeanUptime))
+	if d <= 0 {
+		d = 1
+	}
+	return d
+}
+
+// delay returns the latency for a message.
+func (t *Transport) delay() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	d := t.cfg.Latency
+	if t.cfg.Jitter > 0 {
+		d += time.Duration(t.rng.Int63n(int64(t.cfg.Jitter) + 1))
+	}
+	return d
+}
+
+func (t *Transport) bandwidth() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.cfg.Bandwidth
+}
+
+func (t *Transport) wrap(tp transport.Pipe) *pipe {
+	p := &pipe{
+		Pipe:   tp,
+		t:      t,
+		rq:     make(chan item, 64),
+		closeq: make(chan struct{}),
+	}
+	t.Lock()
+	t.pipes[p] = struct{}{}
+	p.arm(t.uptime())
+	t.Unlock()
+	go p.reader()
+	return p
+}
+
+func (t *Transport) unwrap(addr string) (string, error) {
+	if !strings.HasPrefix(addr, "chaos+") {
+		return "", mangos.ErrBadTran
+	}
+	return addr[len("chaos+"):], nil
+}
+
+// NewDialer implements transport.Transport.
+func (t *Transport) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, error) {
+	addr, err := t.unwrap(addr)
+	if err != nil {
+		return nil, err
+	}
+	d, err := t.base.NewDialer(addr, sock)
+	if err != nil {
+		return nil, err
+	}
+	return &dialer{Dialer: d, t: t}, nil
+}
+
+// NewListener implements transport.Transport.
+func (t *Transport) NewListener(addr string, sock mangos.Socket) (transport.Listener, error) {
+	addr, err := t.unwrap(addr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := t.base.NewListener(addr, sock)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: l, t: t}, nil
+}
+
+type dialer struct {
+	transport.Dialer
+	t *Transport
+}
+
+func (d *dialer) Dial() (transport.Pipe, error) {
+	p, err := d.Dialer.Dial()
+	if p == nil {
+		return nil, err
+	}
+	return d.t.wrap(p), err
+}
+
+type listener struct {
+	transport.Listener
+	t *Transport
+}
+
+func (l *listener) Accept() (transport.Pipe, error) {
+	p, err := l.Listener.Accept()
+	if p == nil {
+		return nil, err
+	}
+	return l.t.wrap(p), err
+}
+
+func (l *listener) Address() string {
+	return "chaos+" + l.Listener.Address()
+}
+
+// item is a message received, waiting to be delivered.
+type item struct {
+	m   *mangos.Message
+	err error
+	due time.Time
+}
+
+type pipe struct {
+	transport.Pipe
+	t      *Transport
+	rq     chan item
+	closeq chan struct{}
+	timer  *time.Timer
+	once   sync.Once
+	sync.Mutex
+}
+
+// arm sets the time for the pipe to be closed, zero for never.
+func (p *pipe) arm(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if d > 0 {
+		p.timer = time.AfterFunc(d, func() { p.Close() })
+	}
+}
+
+// reader receives ahead of the caller, so that each message's delay
+// runs from when it arrived, rather than from when the one before it
+// was delivered.
+func (p *pipe) reader() {
+	var last time.Time
+	for {
+		m, err := p.Pipe.Recv()
+		due := time.Now().Add(p.t.delay())
+		if due.Before(last) {
+			due = last
+		}
+		last = due
+		select {
+		case p.rq <- item{m: m, err: err, due: due}:
+		case <-p.closeq:
+			if m != nil {
+				m.Free()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *pipe) Recv() (*mangos.Message, error) {
+	var it item
+	select {
+	case it = <-p.rq:
+	case <-p.closeq:
+		return nil, mangos.ErrClosed
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	if d := time.Until(it.due); d > 0 {
+		tm := time.NewTimer(d)
+		defer tm.Stop()
+		select {
+		case <-tm.C:
+		case <-p.closeq:
+			it.m.Free()
+			return nil, mangos.ErrClosed
+		}
+	}
+	return it.m, nil
+}
+
+func (p *pipe) Send(m *mangos.Message) error {
+	bw := p.t.bandwidth()
+	size := len(m.Header) + m.BodyLen()
+	if err := p.Pipe.Send(m); err != nil {
+		return err
+	}
+	if bw > 0 {
+		// Pace the sender, as a slow link would.
+		tm := time.NewTimer(time.Duration(int64(size) * int64(time.Second) / int64(bw)))
+		defer tm.Stop()
+		select {
+		case <-tm.C:
+		case <-p.closeq:
+		}
+	}
+	return nil
+}
+
+func (p *pipe) Close() error {
+	p.once.Do(func() {
+		close(p.closeq)
+		p.arm(0)
+		p.t.Lock()
+		delete(p.t.pipes, p)
+		p.t.Unlock()
+	})
+	return p.Pipe.Close()
+}
+
+// SetOption passes changes on to the wrapped pipe, if it allows them.
+func (p *pipe) SetOption(name string, value interface{}) error {
+	if tp, ok := p.Pipe.(mangos.TranPipeSetter); ok {
+		return tp.SetOption(name, value)
+	}
+	return mangos.ErrBadOption
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaos
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/test"
+	"nanomsg.org/go/mangos/v2/transport"
+	"nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+var tran = New(tcp.Transport)
+
+func init() {
+	transport.RegisterTransport(tran)
+}
+
+var tt = test.NewTranTest(tran, "chaos+"+test.AddrTestTCP())
+
+func TestChaosTransport(t *testing.T) {
+	tt.TestListenAndAccept(t)
+	tt.TestSendRecv(t)
+	tt.TestScheme(t)
+	tt.TestDialerBadScheme(t)
+	tt.TestListenerBadScheme(t)
+}
+
+// connect returns a pair of sockets connected by a chaos transport,
+// and a count of the pipes the client has attached.
+func connect(t *testing.T, tr *Transport) (mangos.Socket, mangos.Socket, *int32) {
+	srv, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	addr := test.MustListen(t, srv, tr.Scheme()+"://127.0.0.1:0")
+
+	cli, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+	test.MustSucceed(t, cli.SetOption(mangos.OptionReconnectTime, time.Millisecond*10))
+	var attached int32
+	cli.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventAttached {
+			atomic.AddInt32(&attached, 1)
+		}
+	})
+	test.MustSucceed(t, cli.Dial(addr))
+	time.Sleep(time.Millisecond * 50)
+	return srv, cli, &attached
+}
+
+func TestChaosLatency(t *testing.T) {
+	tr := New(tcp.Transport)
+	transport.RegisterTransport(tr)
+	srv, cli, _ := connect(t, tr)
+	defer srv.Close()
+	defer cli.Close()
+
+	tr.SetConfig(Config{Latency: time.Millisecond * 200, Jitter: time.Millisecond * 20})
+	test.MustBeTrue(t, tr.Config().Latency == time.Millisecond*200)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		test.MustSucceed(t, cli.Send([]byte{byte(i)}))
+	}
+	for i := 0; i < 5; i++ {
+		b, err := srv.Recv()
+		test.MustSucceed(t, err)
+		test.MustBeTrue(t, b[0] == byte(i))
+	}
+	// Each is delayed, but the delays overlap.
+	elapsed := time.Since(start)
+	test.MustBeTrue(t, elapsed >= time.Millisecond*200)
+	test.MustBeTrue(t, elapsed < time.Millisecond*600)
+
+	tr.SetConfig(Config{})
+	start = time.Now()
+	test.MustSucceed(t, cli.Send([]byte("fast")))
+	_, err := srv.Recv()
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, time.Since(start) < time.Millisecond*100)
+}
+
+func TestChaosBandwidth(t *testing.T) {
+	tr := New(tcp.Transport)
+	transport.RegisterTransport(tr)
+	srv, cli, _ := connect(t, tr)
+	defer srv.Close()
+	defer cli.Close()
+
+	tr.SetConfig(Config{Bandwidth: 10000})
+	start := time.Now()
+	go func() {
+		for i := 0; i < 5; i++ {
+			_ = cli.Send(make([]byte, 1000))
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		_, err := srv.Recv()
+		test.MustSucceed(t, err)
+	}
+	test.MustBeTrue(t, time.Since(start) >= time.Millisecond*400)
+}
+
+func TestChaosDisconnect(t *testing.T) {
+	tr := New(tcp.Transport)
+	transport.RegisterTransport(tr)
+	srv, cli, attached := connect(t, tr)
+	defer srv.Close()
+	defer cli.Close()
+	test.MustBeTrue(t, atomic.LoadInt32(attached) == 1)
+
+	tr.Disconnect()
+	time.Sleep(time.Millisecond * 200)
+	test.MustBeTrue(t, atomic.LoadInt32(attached) == 2)
+
+	tr.SetConfig(Config{MeanUptime: time.Millisecond * 20})
+	time.Sleep(time.Millisecond * 500)
+	tr.SetConfig(Config{})
+	n := atomic.LoadInt32(attached)
+	test.MustBeTrue(t, n > 3)
+
+	// Once calm again, the connection stays up.
+	time.Sleep(time.Millisecond * 200)
+	n = atomic.LoadInt32(attached)
+	time.Sleep(time.Millisecond * 200)
+	test.MustBeTrue(t, atomic.LoadInt32(attached) == n)
+	test.MustSucceed(t, cli.Send([]byte("still here")))
+	b, err := srv.Recv()
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, string(b) == "still here")
+}
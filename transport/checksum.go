@@ -0,0 +1,109 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// ParseChecksum checks a value for mangos.OptionChecksum.
+func ParseChecksum(v interface{}) (bool, error) {
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return false, mangos.ErrBadValue
+}
+
+// crcTable is for CRC32C, which most processors compute in hardware.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumExt negotiates checksums.  The dialer offers a single byte,
+// one, and the listener accepts by repeating it.  Every frame then ends
+// with the CRC32C of its type and payload, counted in its length.
+var checksumExt = &extension{
+	typ: extChecksum,
+	offer: func(p *conn) ([]byte, bool) {
+		if !p.crcWant {
+			return nil, false
+		}
+		return []byte{1}, true
+	},
+	answer: func(p *conn, v []byte) []byte {
+		if len(v) != 1 || v[0] != 1 {
+			return nil
+		}
+		p.setChecksum()
+		return v
+	},
+	accept: func(p *conn, v []byte) error {
+		if len(v) != 1 || v[0] != 1 {
+			return mangos.ErrBadHeader
+		}
+		p.setChecksum()
+		return nil
+	},
+}
+
+// setChecksum records that checksums were agreed with the peer.
+func (p *conn) setChecksum() {
+	p.Lock()
+	p.crc = true
+	p.framed = true
+	p.options[mangos.OptionChecksum] = true
+	p.Unlock()
+}
+
+// checksum returns the CRC32C of a frame, less its length, which is the
+// first eight bytes of hdr, followed by the segments.
+func checksum(hdr []byte, segs [][]byte) uint32 {
+	c := crc32.Checksum(hdr[8:], crcTable)
+	for _, b := range segs {
+		c = crc32.Update(c, crcTable, b)
+	}
+	return c
+}
+
+// writeFrame writes a frame, the first buffer of which holds its length
+// and type, adding the checksum if agreed.  The length is adjusted for
+// it, so it must be set afresh for every frame.  The frame may be held
+// back to coalesce it with others; see write.  The caller must hold
+// slock.
+func (p *conn) writeFrame(buff net.Buffers) error {
+	if p.crc {
+		hdr := buff[0]
+		binary.BigEndian.PutUint64(hdr, binary.BigEndian.Uint64(hdr)+4)
+		binary.BigEndian.PutUint32(p.strl[:], checksum(hdr, buff[1:]))
+		buff = append(buff, p.strl[:])
+	}
+	return p.write(buff)
+}
+
+// verify checks, and removes, the checksum of a received frame.  One
+// that does not match means the frame, and so the connection, cannot be
+// trusted, and the message is freed.
+func (p *conn) verify(msg *Message) (*Message, error) {
+	n := len(msg.Body) - 4
+	if n < 1 || crc32.Checksum(msg.Body[:n], crcTable) !=
+		binary.BigEndian.Uint32(msg.Body[n:]) {
+		msg.Free()
+		return nil, mangos.ErrChecksum
+	}
+	msg.Body = msg.Body[:n]
+	return msg, nil
+}
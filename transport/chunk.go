@@ -0,0 +1,185 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// ParseChunkSize checks a value for mangos.OptionChunkSize.
+func ParseChunkSize(v interface{}) (int, error) {
+	if n, ok := v.(int); ok && (n == 0 || n >= MinChunkSize) {
+		return n, nil
+	}
+	return 0, mangos.ErrBadValue
+}
+
+// MinChunkSize is the smallest chunk size allowed, below which the
+// framing costs too much.
+const MinChunkSize = 1024
+
+// chunkExt negotiates chunking.  The dialer offers its chunk size, and
+// the listener answers with the size agreed, which is the smaller of
+// the two, ignoring zero.  Both ends then split messages larger than
+// that, and put together the chunks they receive.
+var chunkExt = &extension{
+	typ: extChunk,
+	offer: func(p *conn) ([]byte, bool) {
+		return chunkValue(p.chunkWant), p.chunkWant > 0
+	},
+	answer: func(p *conn, v []byte) []byte {
+		if len(v) != 4 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint32(v))
+		if n != 0 && n < MinChunkSize {
+			return nil
+		}
+		if p.chunkWant > 0 && (n == 0 || p.chunkWant < n) {
+			n = p.chunkWant
+		}
+		p.setChunkSize(n)
+		return chunkValue(n)
+	},
+	accept: func(p *conn, v []byte) error {
+		if len(v) != 4 {
+			return mangos.ErrBadHeader
+		}
+		n := int(binary.BigEndian.Uint32(v))
+		if n != 0 && n < MinChunkSize {
+			return mangos.ErrBadHeader
+		}
+		p.setChunkSize(n)
+		return nil
+	},
+}
+
+func chunkValue(n int) []byte {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(n))
+	return v
+}
+
+// setChunkSize records the chunk size agreed with the peer.
+func (p *conn) setChunkSize(n int) {
+	if n <= 0 {
+		return
+	}
+	p.Lock()
+	p.chunk = n
+	p.framed = true
+	p.options[mangos.OptionChunkSize] = n
+	p.Unlock()
+}
+
+// chunked returns true if the message must be sent in chunks.
+func (p *conn) chunked(size int) bool {
+	return p.chunk > 0 && size > p.chunk
+}
+
+// sendChunks sends a message as a series of frames of at most the agreed
+// chunk size, the last marked as such.  Unless the caller holds slock,
+// as when sending a batch, it is taken for each chunk alone, so that
+// other messages (and heartbeats) can go between them.  Only one message
+// is chunked at a time, so that the receiver can put it back together.
+// Chunked messages are not compressed.
+func (p *conn) sendChunks(msg *Message, locked bool) error {
+	p.clock.Lock()
+	defer p.clock.Unlock()
+
+	segs := append([][]byte{msg.Header, msg.Body}, msg.Bodies...)
+	var hdr [9]byte
+	for len(segs) > 0 {
+		// Gather up to a chunk's worth from the segments left.
+		var buff net.Buffers
+		n := 0
+		for len(segs) > 0 && n < p.chunk {
+			seg := segs[0]
+			if room := p.chunk - n; len(seg) > room {
+				buff = append(buff, seg[:room])
+				segs[0] = seg[room:]
+				n += room
+				break
+			}
+			buff = append(buff, seg)
+			segs = segs[1:]
+			n += len(seg)
+		}
+		for len(segs) > 0 && len(segs[0]) == 0 {
+			segs = segs[1:]
+		}
+		binary.BigEndian.PutUint64(hdr[:8], uint64(n+1))
+		hdr[8] = frameChunk
+		if len(segs) == 0 {
+			hdr[8] = frameChunkLast
+		}
+		buff = append(net.Buffers{hdr[:]}, buff...)
+		if !locked {
+			p.slock.Lock()
+		}
+		err := p.writeFrame(buff)
+		if !locked {
+			p.slock.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	msg.Free()
+	return nil
+}
+
+// reassemble adds a received chunk to the message being put together,
+// returning the message once its last chunk has arrived, or nil until
+// then.  The chunk is freed.
+func (p *conn) reassemble(chunk *Message) (*Message, error) {
+	last := chunk.Body[0] == frameChunkLast
+	b := chunk.Body[1:]
+	if p.chunk <= 0 {
+		chunk.Free()
+		return nil, mangos.ErrBadHeader
+	}
+	size := len(b)
+	if p.partial != nil {
+		size += len(p.partial.Body)
+	}
+	if p.maxrx > 0 && size > p.maxrx {
+		chunk.Free()
+		p.dropPartial()
+		return nil, mangos.ErrTooLong
+	}
+	if p.partial == nil {
+		p.partial = mangos.NewMessage(len(b))
+	}
+	p.partial.Body = append(p.partial.Body, b...)
+	chunk.Free()
+	if !last {
+		return nil, nil
+	}
+	msg := p.partial
+	p.partial = nil
+	return msg, nil
+}
+
+// dropPartial discards any message partly put together.
+func (p *conn) dropPartial() {
+	if p.partial != nil {
+		p.partial.Free()
+		p.partial = nil
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// DefaultCoalesceBytes is the most held back to coalesce, unless
+// mangos.OptionCoalesceBytes says otherwise.
+const DefaultCoalesceBytes = 64 * 1024
+
+// ParseCoalesceTime checks a value for mangos.OptionCoalesceTime.
+func ParseCoalesceTime(v interface{}) (time.Duration, error) {
+	if d, ok := v.(time.Duration); ok && d >= 0 {
+		return d, nil
+	}
+	return 0, mangos.ErrBadValue
+}
+
+// ParseCoalesceBytes checks a value for mangos.OptionCoalesceBytes.
+func ParseCoalesceBytes(v interface{}) (int, error) {
+	if n, ok := v.(int); ok && n > 0 {
+		return n, nil
+	}
+	return 0, mangos.ErrBadValue
+}
+
+// write writes a frame, or, if OptionCoalesceTime asks for it, holds it
+// back so that it goes out in the same write as those that follow.
+// What is held back is written once the time passes, or once there is
+// too much to add the frame to, or when the pipe is flushed.  The frame
+// is copied, so the caller may reuse its buffers.  The caller must hold
+// slock.
+func (p *conn) write(buff net.Buffers) error {
+	if p.cerr != nil {
+		return p.cerr
+	}
+	if p.cwait > 0 {
+		n := 0
+		for _, b := range buff {
+			n += len(b)
+		}
+		if len(p.cbuf)+n < p.cmax {
+			if len(p.cbuf) == 0 {
+				p.ctimer = p.hbClock.AfterFunc(p.cwait, p.expire)
+			}
+			for _, b := range buff {
+				p.cbuf = append(p.cbuf, b...)
+			}
+			return nil
+		}
+	}
+	if len(p.cbuf) > 0 {
+		p.ctimer.Stop()
+		buff = append(net.Buffers{p.cbuf}, buff...)
+		p.cbuf = p.cbuf[:0]
+	}
+	if _, err := buff.WriteTo(p.c); err != nil {
+		p.cerr = err
+		return err
+	}
+	return nil
+}
+
+// flushHeld writes what write has held back.  The caller must hold slock.
+func (p *conn) flushHeld() error {
+	if p.cerr != nil || len(p.cbuf) == 0 {
+		return p.cerr
+	}
+	p.ctimer.Stop()
+	_, err := p.c.Write(p.cbuf)
+	p.cbuf = p.cbuf[:0]
+	if err != nil {
+		p.cerr = err
+	}
+	return err
+}
+
+// expire writes what was held back, once OptionCoalesceTime has passed.
+// As nobody is waiting to hear of a failure, the connection is closed,
+// so that the socket notices when it next reads.
+func (p *conn) expire() {
+	p.slock.Lock()
+	err := p.flushHeld()
+	p.slock.Unlock()
+	if err != nil {
+		p.Close()
+	}
+}
+
+// Flush implements mangos.TranPipeFlusher.
+func (p *conn) Flush() error {
+	p.slock.Lock()
+	defer p.slock.Unlock()
+	return p.flushHeld()
+}
+
+// setCoalesce changes OptionCoalesceTime or OptionCoalesceBytes on a
+// live connection.  Turning coalescing off writes what is held back.
+func (p *conn) setCoalesce(n string, v interface{}) error {
+	p.slock.Lock()
+	defer p.slock.Unlock()
+	switch n {
+	case mangos.OptionCoalesceTime:
+		d, err := ParseCoalesceTime(v)
+		if err != nil {
+			return err
+		}
+		p.cwait = d
+		if d == 0 {
+			_ = p.flushHeld()
+		}
+	default:
+		max, err := ParseCoalesceBytes(v)
+		if err != nil {
+			return err
+		}
+		p.cmax = max
+	}
+	p.Lock()
+	p.options[n] = v
+	p.Unlock()
+	return nil
+}
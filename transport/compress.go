@@ -0,0 +1,171 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// DefaultCompressionThreshold is the default for
+// mangos.OptionCompressionThreshold.
+const DefaultCompressionThreshold = 512
+
+// compressor compresses and expands message payloads.
+type compressor interface {
+	name() string
+	compress(dst *bytes.Buffer, src [][]byte) error
+	expand(src []byte, max int) ([]byte, error)
+}
+
+var compressors = []compressor{gzipCompressor{}, snappyCompressor{}}
+
+func compressorByName(name string) compressor {
+	for _, c := range compressors {
+		if c.name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// ParseCompression checks a value for mangos.OptionCompression.
+func ParseCompression(v interface{}) (string, error) {
+	if s, ok := v.(string); ok && (s == "" || compressorByName(s) != nil) {
+		return s, nil
+	}
+	return "", mangos.ErrBadValue
+}
+
+// ParseCompressionThreshold checks a value for
+// mangos.OptionCompressionThreshold.
+func ParseCompressionThreshold(v interface{}) (int, error) {
+	if n, ok := v.(int); ok && n >= 0 {
+		return n, nil
+	}
+	return 0, mangos.ErrBadValue
+}
+
+// compressionExt negotiates compression.  The dialer offers the name
+// of its algorithm, and the listener accepts by repeating it, if it is
+// the one it has set itself.
+var compressionExt = &extension{
+	typ: extCompression,
+	offer: func(p *conn) ([]byte, bool) {
+		if compressorByName(p.want) == nil {
+			return nil, false
+		}
+		return []byte(p.want), true
+	},
+	answer: func(p *conn, v []byte) []byte {
+		c := compressorByName(p.want)
+		if c == nil || string(v) != c.name() {
+			return nil
+		}
+		p.agree(c)
+		return v
+	},
+	accept: func(p *conn, v []byte) error {
+		c := compressorByName(string(v))
+		if c == nil || c.name() != p.want {
+			return mangos.ErrBadHeader
+		}
+		p.agree(c)
+		return nil
+	},
+}
+
+type gzipCompressor struct{}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+func (gzipCompressor) name() string { return "gzip" }
+
+func (gzipCompressor) compress(dst *bytes.Buffer, src [][]byte) error {
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(dst)
+	for _, b := range src {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func (gzipCompressor) expand(src []byte, max int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	var rd io.Reader = r
+	if max > 0 {
+		rd = io.LimitReader(r, int64(max)+1)
+	}
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(b) > max {
+		return nil, mangos.ErrTooLong
+	}
+	return b, nil
+}
+
+type snappyCompressor struct{}
+
+// snappyMaxRatio bounds the expansion of snappy data: the best it does
+// is a three byte copy of 64 bytes.
+const snappyMaxRatio = 32
+
+func (snappyCompressor) name() string { return "snappy" }
+
+func (snappyCompressor) compress(dst *bytes.Buffer, src [][]byte) error {
+	var in []byte
+	if len(src) == 1 {
+		in = src[0]
+	} else {
+		for _, b := range src {
+			in = append(in, b...)
+		}
+	}
+	dst.Write(snappy.Encode(nil, in))
+	return nil
+}
+
+func (snappyCompressor) expand(src []byte, max int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && n > max {
+		return nil, mangos.ErrTooLong
+	}
+	// No snappy data expands by more than this, so a larger length
+	// is a lie, and allocating it would only waste memory.
+	if n > len(src)*snappyMaxRatio {
+		return nil, snappy.ErrCorrupt
+	}
+	return snappy.Decode(nil, src)
+}
@@ -15,10 +15,13 @@
 package transport
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"nanomsg.org/go/mangos/v2"
 )
@@ -27,43 +30,199 @@ import (
 // assumption is that transports using this have similar wire protocols,
 // and conn is meant to be used as a building block.
 type conn struct {
-	c       net.Conn
-	proto   ProtocolInfo
-	open    bool
-	options map[string]interface{}
-	maxrx   int
+	c         net.Conn
+	proto     ProtocolInfo
+	open      bool
+	options   map[string]interface{}
+	maxrx     int
+	role      int
+	want      string     // compression to offer or accept
+	comp      compressor // agreed in the handshake, if any
+	thresh    int
+	framed    bool // messages start with a frame type
+	peerMax   int  // the peer's OptionMaxRecvSize, if it told us
+	hbWant    time.Duration
+	hb        time.Duration // heartbeat interval agreed, if any
+	hbTimeout time.Duration
+	hbClock   mangos.Clock  // OptionClock, to pace heartbeats and coalescing
+	hsTimeout time.Duration // OptionHandshakeTimeout
+	chunkWant int           // OptionChunkSize, to offer or accept
+	chunk     int           // chunk size agreed, if any
+	clock     sync.Mutex    // held while sending a message in chunks
+	partial   *Message      // being put together from chunks
+	crcWant   bool          // OptionChecksum, to offer
+	crc       bool          // checksums agreed
+
+	// Coalescing, for OptionCoalesceTime, protected by slock.
+	cwait  time.Duration // OptionCoalesceTime
+	cmax   int           // OptionCoalesceBytes
+	cbuf   []byte        // frames held back
+	ctimer mangos.Timer  // to write cbuf once cwait passes
+	cerr   error         // a failed write, after which none are tried
+
+	// Credit, for OptionCreditWindow.  The credits count messages, and
+	// sendCredit is -1 when what we send is not limited.
+	creditWant int           // OptionCreditWindow, to offer or answer
+	window     int           // our window agreed, if any
+	sendCredit int           // messages we may yet send
+	recvCredit int           // messages the peer may yet send
+	granted    int           // credit consumed, not yet returned
+	granting   bool          // grants are being sent
+	creditq    chan struct{} // closed when credit arrives
+	closeq     chan struct{}
 	sync.Mutex
+
+	// Scratch space, reused for every message so that the framing
+	// does not cost an allocation.  The send side is protected by
+	// slock, while there is only ever a single reader.
+	slock sync.Mutex
+	shdr  [9]byte
+	strl  [4]byte // checksum trailer
+	svec  [5][]byte
+	rhdr  [9]byte
 }
 
+// Roles of a conn in the handshake.  Only pipes made knowing their role
+// can negotiate extensions.
+const (
+	roleNone = iota
+	roleDialer
+	roleListener
+)
+
 // connipc is *almost* like a regular conn, but the IPC protocol insists
 // on stuffing a leading byte (valued 1) in front of messages.  This is for
 // compatibility with nanomsg -- the value cannot ever be anything but 1.
 type connipc struct {
 	conn
+	oob []byte // for receiving files, on Unix
 }
 
 // Recv implements the TranPipe Recv method.  The message received is expected
 // as a 64-bit size (network byte order) followed by the message itself.
 func (p *conn) Recv() (*Message, error) {
+	for {
+		if p.hb > 0 {
+			// Only the wait for a message is limited, not its
+			// transfer, which on a slow link may take a while.
+			_ = p.c.SetReadDeadline(time.Now().Add(p.hbTimeout))
+		}
+		if _, err := io.ReadFull(p.c, p.rhdr[:8]); err != nil {
+			if p.hb > 0 && isTimeout(err) {
+				err = mangos.ErrPeerDead
+			}
+			return nil, err
+		}
+		if p.hb > 0 {
+			_ = p.c.SetReadDeadline(time.Time{})
+		}
+		msg, err := p.recvBody(int64(binary.BigEndian.Uint64(p.rhdr[:8])))
+		if err != nil || !p.framed {
+			return msg, err
+		}
+		if p.crc {
+			if msg, err = p.verify(msg); err != nil {
+				return nil, err
+			}
+		}
+		if len(msg.Body) == 1 && msg.Body[0] == frameHeartbeat {
+			msg.Free()
+			continue
+		}
+		if len(msg.Body) == 5 && msg.Body[0] == frameCredit {
+			p.credited(int(binary.BigEndian.Uint32(msg.Body[1:])))
+			msg.Free()
+			continue
+		}
+		if len(msg.Body) > 0 &&
+			(msg.Body[0] == frameChunk || msg.Body[0] == frameChunkLast) {
+			if msg, err = p.reassemble(msg); msg == nil && err == nil {
+				continue
+			}
+		} else {
+			msg, err = p.unframe(msg)
+		}
+		if err == nil {
+			p.spent()
+		}
+		return msg, err
+	}
+}
 
-	var sz int64
-	var err error
-	var msg *Message
+// Frame types.  When an extension that needs it is agreed, every
+// message starts with a byte giving the type of the frame.
+const (
+	framePlain      = 0
+	frameCompressed = 1
+	frameHeartbeat  = 2
+	frameChunk      = 3 // part of a message, more to follow
+	frameChunkLast  = 4 // the last part of a message
+	frameCredit     = 5 // credit granted, a 32-bit count of messages
+)
 
-	if err = binary.Read(p.c, binary.BigEndian, &sz); err != nil {
-		return nil, err
+// unframe decodes a received frame.
+func (p *conn) unframe(msg *Message) (*Message, error) {
+	if len(msg.Body) == 0 {
+		msg.Free()
+		return nil, mangos.ErrBadHeader
+	}
+	switch msg.Body[0] {
+	case framePlain:
+		msg.Body = msg.Body[1:]
+		return msg, nil
+	case frameCompressed:
+		if p.comp == nil {
+			break
+		}
+		b, err := p.comp.expand(msg.Body[1:], p.maxrx)
+		msg.Free()
+		if err != nil {
+			return nil, err
+		}
+		msg = mangos.NewMessage(len(b))
+		msg.Body = append(msg.Body, b...)
+		return msg, nil
 	}
+	msg.Free()
+	return nil, mangos.ErrBadHeader
+}
+
+// recvChunk is the most allocated for a message before its data arrives.
+// Larger messages grow as they are read, so that a peer cannot have us
+// allocate memory by merely claiming to send a lot.
+const recvChunk = 1 << 20
+
+// recvBody reads a message of the given size directly into the buffer of
+// a cached Message, so that there is no extra copy.
+func (p *conn) recvBody(sz int64) (*Message, error) {
 
 	// Limit messages to the maximum receive value, if not
 	// unlimited.  This avoids a potential denaial of service.
-	if sz < 0 || (p.maxrx > 0 && sz > int64(p.maxrx)) {
+	if sz < 0 || (p.maxrx > 0 && sz > int64(p.maxrx)) ||
+		sz > int64(^uint(0)>>1) {
 		return nil, mangos.ErrTooLong
 	}
-	msg = mangos.NewMessage(int(sz))
-	msg.Body = msg.Body[0:sz]
-	if _, err = io.ReadFull(p.c, msg.Body); err != nil {
-		msg.Free()
-		return nil, err
+	if sz <= recvChunk {
+		msg := mangos.NewMessage(int(sz))
+		msg.Body = msg.Body[0:sz]
+		if _, err := io.ReadFull(p.c, msg.Body); err != nil {
+			msg.Free()
+			return nil, err
+		}
+		return msg, nil
+	}
+	msg := mangos.NewMessage(recvChunk)
+	for int64(len(msg.Body)) < sz {
+		n := sz - int64(len(msg.Body))
+		if n > recvChunk {
+			n = recvChunk
+		}
+		start := len(msg.Body)
+		msg.Body = append(msg.Body, make([]byte, n)...)
+		if _, err := io.ReadFull(p.c, msg.Body[start:]); err != nil {
+			msg.Free()
+			return nil, err
+		}
 	}
 	return msg, nil
 }
@@ -71,17 +230,185 @@ func (p *conn) Recv() (*Message, error) {
 // Send implements the Pipe Send method.  The message is sent as a 64-bit
 // size (network byte order) followed by the message itself.
 func (p *conn) Send(msg *Message) error {
-	var buff = net.Buffers{}
+	l := len(msg.Header) + msg.BodyLen()
+	if err := p.takeCredit(l); err != nil {
+		return err
+	}
+	if p.chunked(l) && (p.peerMax == 0 || l <= p.peerMax) {
+		return p.sendChunks(msg, false)
+	}
+	p.slock.Lock()
+	defer p.slock.Unlock()
+	return p.send(msg)
+}
 
+// send does the work of Send.  The caller must hold slock.
+func (p *conn) send(msg *Message) error {
 	// Serialize the length header
-	l := uint64(len(msg.Header) + len(msg.Body))
-	lbyte := make([]byte, 8)
-	binary.BigEndian.PutUint64(lbyte, l)
+	l := uint64(len(msg.Header) + msg.BodyLen())
+	if p.peerMax > 0 && l > uint64(p.peerMax) {
+		// The peer would only hang up on us.  The socket discards
+		// such messages before they get here.
+		return mangos.ErrTooLong
+	}
+	if p.chunked(int(l)) {
+		return p.sendChunks(msg, true)
+	}
+	if p.framed {
+		return p.sendFramed(msg, int(l))
+	}
+	binary.BigEndian.PutUint64(p.shdr[:8], l)
+
+	return p.sendVec(msg, p.shdr[:8])
+}
+
+// SendMsgs implements mangos.TranPipeBatchSender.  When credit limits
+// what we send, the messages are sent one at a time, as the credit for
+// each must be had before sending it.
+func (p *conn) SendMsgs(msgs []*Message) error {
+	if p.limited() {
+		for i, msg := range msgs {
+			if err := p.Send(msg); err != nil {
+				freeMsgs(msgs[i:])
+				return err
+			}
+		}
+		return nil
+	}
+	p.slock.Lock()
+	defer p.slock.Unlock()
+	return p.sendBatch(msgs, p.frame, p.send)
+}
+
+// frame appends to b the framing for a message sent in a batch, or
+// returns nil if the message must be sent on its own, as it must if it
+// is too large for the peer, must be chunked, or may be compressed.
+func (p *conn) frame(b []byte, msg *Message) []byte {
+	l := len(msg.Header) + msg.BodyLen()
+	if (p.peerMax > 0 && l > p.peerMax) || p.chunked(l) {
+		return nil
+	}
+	var hdr [9]byte
+	if !p.framed {
+		binary.BigEndian.PutUint64(hdr[:8], uint64(l))
+		return append(b, hdr[:8]...)
+	}
+	if p.comp != nil && msg.Compress != mangos.CompressNever {
+		return nil
+	}
+	if p.crc {
+		l += 4
+	}
+	binary.BigEndian.PutUint64(hdr[:8], uint64(l+1))
+	hdr[8] = framePlain
+	return append(b, hdr[:]...)
+}
+
+// sendBatch sends the messages in order, gathering those that frame can
+// frame into a single vectored write, and sending any others alone with
+// single, which works as Send does.  Every message is freed, even if
+// sending fails.  The caller must hold slock.
+func (p *conn) sendBatch(msgs []*Message, frame func([]byte, *Message) []byte,
+	single func(*Message) error) error {
+
+	// There is room for the framing of every message up front, so that
+	// appending to it never moves what buff already refers to.
+	// So too for their checksums, if agreed.
+	hdrs := make([]byte, 0, len(p.shdr)*len(msgs))
+	var sums []byte
+	if p.crc {
+		sums = make([]byte, 0, len(p.strl)*len(msgs))
+	}
+	buff := make(net.Buffers, 0, 3*len(msgs))
+	first := 0 // the first message not yet written
+	for i, msg := range msgs {
+		n := len(hdrs)
+		if h := frame(hdrs, msg); h != nil {
+			hdrs = h
+			start := len(buff)
+			buff = append(buff, hdrs[n:], msg.Header, msg.Body)
+			buff = append(buff, msg.Bodies...)
+			if p.crc {
+				c := checksum(hdrs[n:], buff[start+1:])
+				sums = sums[:len(sums)+4]
+				binary.BigEndian.PutUint32(sums[len(sums)-4:], c)
+				buff = append(buff, sums[len(sums)-4:])
+			}
+			continue
+		}
+		err := p.flush(&buff, msgs[first:i])
+		if err == nil {
+			if err = single(msg); err != nil {
+				msg.Free()
+			}
+		}
+		if err != nil {
+			freeMsgs(msgs[i+1:])
+			return err
+		}
+		first = i + 1
+	}
+	return p.flush(&buff, msgs[first:])
+}
+
+// flush writes what has been gathered in buff, and frees the messages it
+// came from.  The caller must hold slock.
+func (p *conn) flush(buff *net.Buffers, msgs []*Message) error {
+	var err error
+	if len(*buff) > 0 {
+		err = p.write(*buff)
+		*buff = (*buff)[:0]
+	}
+	freeMsgs(msgs)
+	return err
+}
+
+func freeMsgs(msgs []*Message) {
+	for _, m := range msgs {
+		m.Free()
+	}
+}
 
-	// Attach the length header along with the actual header and body
-	buff = append(buff, lbyte, msg.Header, msg.Body)
+// sendFramed sends a message with its frame type, compressing it if
+// compression was agreed, and it is large enough and shrinks.
+// The caller must hold slock.
+func (p *conn) sendFramed(msg *Message, size int) error {
+	compress := p.comp != nil && size >= p.thresh
+	switch msg.Compress {
+	case mangos.CompressAlways:
+		compress = p.comp != nil
+	case mangos.CompressNever:
+		compress = false
+	}
+	if compress {
+		var b bytes.Buffer
+		src := append([][]byte{msg.Header, msg.Body}, msg.Bodies...)
+		if err := p.comp.compress(&b, src); err == nil && b.Len() < size {
+			binary.BigEndian.PutUint64(p.shdr[:8], uint64(b.Len()+1))
+			p.shdr[8] = frameCompressed
+			buff := net.Buffers{p.shdr[:9], b.Bytes()}
+			if err := p.writeFrame(buff); err != nil {
+				return err
+			}
+			msg.Free()
+			return nil
+		}
+	}
+	binary.BigEndian.PutUint64(p.shdr[:8], uint64(size+1))
+	p.shdr[8] = framePlain
+	return p.sendVec(msg, p.shdr[:9])
+}
 
-	if _, err := buff.WriteTo(p.c); err != nil {
+// sendVec sends the framing, header and body with a single vectored
+// write (writev on most platforms), avoiding any copy of the payload,
+// including any additional body segments.
+// The caller must hold slock.
+func (p *conn) sendVec(msg *Message, frame []byte) error {
+	buff := net.Buffers(p.svec[:0])
+	buff = append(buff, frame, msg.Header, msg.Body)
+	buff = append(buff, msg.Bodies...)
+
+	if err := p.writeFrame(buff); err != nil {
 		return err
 	}
 
@@ -105,18 +432,63 @@ func (p *conn) Close() error {
 	defer p.Unlock()
 	if p.open {
 		p.open = false
+		close(p.closeq)
 		return p.c.Close()
 	}
 	return nil
 }
 
 func (p *conn) GetOption(n string) (interface{}, error) {
+	p.Lock()
+	defer p.Unlock()
 	if v, ok := p.options[n]; ok {
 		return v, nil
 	}
 	return nil, mangos.ErrBadProperty
 }
 
+// SetOption implements mangos.TranPipeSetter.  Only the TCP options,
+// the buffer sizes, the compression threshold, and coalescing can be
+// changed on a live connection, and the TCP options only when there is a TCP
+// connection underneath (possibly beneath TLS).
+func (p *conn) SetOption(n string, v interface{}) error {
+	if n == mangos.OptionCompressionThreshold {
+		thresh, err := ParseCompressionThreshold(v)
+		if err != nil {
+			return err
+		}
+		p.slock.Lock()
+		p.thresh = thresh
+		p.slock.Unlock()
+		p.Lock()
+		p.options[n] = thresh
+		p.Unlock()
+		return nil
+	}
+	if n == mangos.OptionCoalesceTime || n == mangos.OptionCoalesceBytes {
+		return p.setCoalesce(n, v)
+	}
+	if n == mangos.OptionBusyPoll {
+		if d, ok := v.(time.Duration); !ok || d < 0 {
+			return mangos.ErrBadValue
+		}
+	} else if err := ParseTCPOption(n, v); err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	opts := make(map[string]interface{}, len(p.options)+1)
+	for k, x := range p.options {
+		opts[k] = x
+	}
+	opts[n] = v
+	if err := setConnOption(p.c, n, opts); err != nil {
+		return err
+	}
+	p.options[n] = v
+	return nil
+}
+
 // NewConnPipe allocates a new Pipe using the supplied net.Conn, and
 // initializes it.  It performs no negotiation -- use a Handshaker to
 // arrange for that.
@@ -127,10 +499,35 @@ func (p *conn) GetOption(n string) (interface{}, error) {
 // the implementation needn't bother concerning itself with passing actual
 // SP messages once the lower layer connection is established.
 func NewConnPipe(c net.Conn, proto ProtocolInfo, options map[string]interface{}) (Pipe, error) {
+	return newConn(c, proto, options, roleNone), nil
+}
+
+// NewConnPipeDialer is like NewConnPipe, for a connection that was
+// dialed.  The pipe offers extensions in the handshake, such as
+// compression, if the options ask for them.  The peer must be a pipe
+// made with NewConnPipeListener, or one that does not know of them.
+func NewConnPipeDialer(c net.Conn, proto ProtocolInfo, options map[string]interface{}) (Pipe, error) {
+	return newConn(c, proto, options, roleDialer), nil
+}
+
+// NewConnPipeListener is like NewConnPipe, for a connection that was
+// accepted.  The pipe answers an offer of extensions from the dialer.
+// To do that, it waits for the dialer's half of the handshake before
+// sending its own, which is safe as dialers always send first.
+func NewConnPipeListener(c net.Conn, proto ProtocolInfo, options map[string]interface{}) (Pipe, error) {
+	return newConn(c, proto, options, roleListener), nil
+}
+
+func newConn(c net.Conn, proto ProtocolInfo, options map[string]interface{}, role int) *conn {
 	p := &conn{
 		c:       c,
 		proto:   proto,
+		role:    role,
 		options: make(map[string]interface{}),
+		closeq:  make(chan struct{}),
+		creditq: make(chan struct{}),
+
+		sendCredit: -1,
 	}
 
 	p.options[mangos.OptionMaxRecvSize] = int(0)
@@ -140,8 +537,38 @@ func NewConnPipe(c net.Conn, proto ProtocolInfo, options map[string]interface{})
 		p.options[n] = v
 	}
 	p.maxrx = p.options[mangos.OptionMaxRecvSize].(int)
+	p.hsTimeout, _ = p.options[mangos.OptionHandshakeTimeout].(time.Duration)
+	p.hbClock, _ = p.options[mangos.OptionClock].(mangos.Clock)
+	if p.hbClock == nil {
+		p.hbClock = mangos.SystemClock
+	}
+	delete(p.options, mangos.OptionClock)
+	p.thresh = DefaultCompressionThreshold
+	if v, ok := p.options[mangos.OptionCompressionThreshold].(int); ok {
+		p.thresh = v
+	}
+	p.cwait, _ = p.options[mangos.OptionCoalesceTime].(time.Duration)
+	p.cmax = DefaultCoalesceBytes
+	if v, ok := p.options[mangos.OptionCoalesceBytes].(int); ok && v > 0 {
+		p.cmax = v
+	}
+	if role != roleNone {
+		// Until agreed, there is no compression, heartbeat,
+		// chunking or credit on the pipe.
+		p.want, _ = p.options[mangos.OptionCompression].(string)
+		p.options[mangos.OptionCompression] = ""
+		p.hbWant, _ = p.options[mangos.OptionHeartbeatTime].(time.Duration)
+		p.hbTimeout, _ = p.options[mangos.OptionHeartbeatTimeout].(time.Duration)
+		p.options[mangos.OptionHeartbeatTime] = time.Duration(0)
+		p.chunkWant, _ = p.options[mangos.OptionChunkSize].(int)
+		p.options[mangos.OptionChunkSize] = 0
+		p.creditWant, _ = p.options[mangos.OptionCreditWindow].(int)
+		p.options[mangos.OptionCreditWindow] = 0
+		p.crcWant, _ = p.options[mangos.OptionChecksum].(bool)
+		p.options[mangos.OptionChecksum] = false
+	}
 
-	return p, nil
+	return p
 }
 
 // connHeader is exchanged during the initial handshake.
@@ -157,37 +584,164 @@ type connHeader struct {
 // handshake establishes an SP connection between peers.  Both sides must
 // send the header, then both sides must wait for the peer's header.
 // As a side effect, the peer's protocol number is stored in the conn.
-// Also, various properties are initialized.
+// Also, various properties are initialized.  A listener that may have
+// to answer an offer of extensions waits for the dialer's header before
+// sending its own.
 func (p *conn) handshake() error {
 	var err error
 
+	if p.hsTimeout > 0 {
+		// Cleared again once opened.
+		_ = p.c.SetDeadline(time.Now().Add(p.hsTimeout))
+	}
+
+	if p.role == roleListener {
+		return p.answer()
+	}
+
+	var offers extBlock
+	if p.role == roleDialer {
+		offers = p.offers()
+	}
+
 	h := connHeader{S: 'S', P: 'P', Proto: p.proto.Self}
+	if offers != nil {
+		h.Rsvd = rsvdExt
+	}
 	if err = binary.Write(p.c, binary.BigEndian, &h); err != nil {
 		return err
 	}
+	if offers != nil {
+		if err = offers.write(p.c); err != nil {
+			p.c.Close()
+			return err
+		}
+	}
 	if err = binary.Read(p.c, binary.BigEndian, &h); err != nil {
 		p.c.Close()
 		return err
 	}
-	if h.Zero != 0 || h.S != 'S' || h.P != 'P' || h.Rsvd != 0 {
+	if err = p.checkHeader(&h, offers != nil); err != nil {
 		p.c.Close()
-		return mangos.ErrBadHeader
+		return err
 	}
-	// The only version number we support at present is "0", at offset 3.
-	if h.Version != 0 {
-		p.c.Close()
-		return mangos.ErrBadVersion
+	if offers != nil {
+		if h.Rsvd != rsvdExt {
+			// The peer will hang up on us, as it does not know of
+			// extensions.  Next time, do not offer them.
+			setLegacy(p.c.RemoteAddr().String())
+			p.c.Close()
+			return mangos.ErrBadHeader
+		}
+		replies, err := readExtBlock(p.c)
+		if err == nil {
+			err = p.accept(offers, replies)
+		}
+		if err != nil {
+			p.c.Close()
+			return err
+		}
 	}
+	p.opened()
+	return nil
+}
 
+// answer is the listener's side of the handshake.
+func (p *conn) answer() error {
+	var err error
+
+	h := connHeader{}
+	if err = binary.Read(p.c, binary.BigEndian, &h); err != nil {
+		p.c.Close()
+		return err
+	}
+	if err = p.checkHeader(&h, true); err != nil {
+		p.c.Close()
+		return err
+	}
+	peer := h.Proto
+	var replies extBlock
+	if h.Rsvd == rsvdExt {
+		offers, err := readExtBlock(p.c)
+		if err != nil {
+			p.c.Close()
+			return err
+		}
+		replies = p.answers(offers)
+	}
+	h = connHeader{S: 'S', P: 'P', Proto: p.proto.Self}
+	if replies != nil {
+		h.Rsvd = rsvdExt
+	}
+	if err = binary.Write(p.c, binary.BigEndian, &h); err != nil {
+		p.c.Close()
+		return err
+	}
+	if replies != nil {
+		if err = replies.write(p.c); err != nil {
+			p.c.Close()
+			return err
+		}
+	}
 	// The protocol number lives as 16-bits (big-endian) at offset 4.
-	if h.Proto != p.proto.Peer {
+	if peer != p.proto.Peer {
 		p.c.Close()
-		return mangos.ErrBadProto
+		return p.mismatch(peer)
 	}
+	p.opened()
+	return nil
+}
+
+// opened marks the end of a successful handshake.
+func (p *conn) opened() {
+	if p.hsTimeout > 0 {
+		_ = p.c.SetDeadline(time.Time{})
+	}
+	p.Lock()
 	p.open = true
+	p.Unlock()
+	if p.hb > 0 {
+		go p.heartbeat()
+	}
+}
+
+// checkHeader validates the peer's header.  The reserved field may only
+// mark extensions, and then only when they are in play.
+func (p *conn) checkHeader(h *connHeader, ext bool) error {
+	if h.Zero != 0 || h.S != 'S' || h.P != 'P' {
+		return mangos.ErrBadHeader
+	}
+	if h.Rsvd != 0 && (!ext || h.Rsvd != rsvdExt) {
+		return mangos.ErrBadHeader
+	}
+	// The only version number we support at present is "0", at offset 3.
+	if h.Version != 0 {
+		return mangos.ErrBadVersion
+	}
+	if p.role != roleListener && h.Proto != p.proto.Peer {
+		return p.mismatch(h.Proto)
+	}
 	return nil
 }
 
+// mismatch returns the error for a peer with the wrong protocol.
+func (p *conn) mismatch(peer uint16) error {
+	return &mangos.ProtocolError{
+		Self: p.proto.Self,
+		Peer: p.proto.Peer,
+		Got:  peer,
+	}
+}
+
+// agree records the compression agreed with the peer.
+func (p *conn) agree(c compressor) {
+	p.Lock()
+	p.comp = c
+	p.framed = true
+	p.options[mangos.OptionCompression] = c.name()
+	p.Unlock()
+}
+
 type connHandshakerPipe interface {
 	handshake() error
 
@@ -203,6 +757,7 @@ type connHandshaker struct {
 	doneq  []*connHandshakerItem
 	closed bool
 	cv     *sync.Cond
+	q      *Quarantine // told of failures, if not nil
 	sync.Mutex
 }
 
@@ -217,6 +772,14 @@ func NewConnHandshaker() Handshaker {
 	return h
 }
 
+// NewListenerHandshaker is like NewConnHandshaker, but also tells the
+// Quarantine of each handshake that fails.
+func NewListenerHandshaker(q *Quarantine) Handshaker {
+	h := NewConnHandshaker().(*connHandshaker)
+	h.q = q
+	return h
+}
+
 func (h *connHandshaker) Wait() (Pipe, error) {
 	h.Lock()
 	defer h.Unlock()
@@ -248,8 +811,21 @@ func (h *connHandshaker) Start(p Pipe) error {
 	return nil
 }
 
+func (h *connHandshaker) Reject(p Pipe, err error) {
+	conn, ok := p.(connHandshakerPipe)
+	h.Lock()
+	defer h.Unlock()
+	if !ok || h.closed {
+		p.Close()
+		return
+	}
+	h.doneq = append(h.doneq, &connHandshakerItem{c: conn, e: err})
+	h.cv.Broadcast()
+}
+
 func (h *connHandshaker) Close() error {
 	h.Lock()
+	defer h.Unlock()
 	h.closed = true
 	h.cv.Broadcast()
 	for conn := range h.workq {
@@ -258,7 +834,9 @@ func (h *connHandshaker) Close() error {
 	for len(h.doneq) != 0 {
 		item := h.doneq[0]
 		h.doneq = h.doneq[1:]
-		item.c.Close()
+		if item.c != nil {
+			item.c.Close()
+		}
 	}
 	return nil
 }
@@ -271,9 +849,19 @@ func (h *connHandshaker) worker(conn connHandshakerPipe) {
 
 	delete(h.workq, conn)
 
+	var pe *mangos.ProtocolError
 	if item.e != nil {
+		if h.q != nil && !h.closed {
+			if a, err := conn.GetOption(mangos.OptionRemoteAddr); err == nil {
+				h.q.Failed(a.(net.Addr))
+			}
+		}
 		item.c.Close()
-		item.c = nil
+		if !errors.As(item.e, &pe) || h.closed {
+			item.c = nil
+		}
+		// Otherwise the closed pipe goes with the error, so that the
+		// socket can report which peer it was.
 	} else if h.closed {
 		item.e = mangos.ErrClosed
 		item.c.Close()
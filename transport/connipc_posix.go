@@ -1,3 +1,4 @@
+//go:build !windows
 // +build !windows
 
 // Copyright 2019 The Mangos Authors
@@ -20,6 +21,8 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"os"
+	"syscall"
 
 	"nanomsg.org/go/mangos/v2"
 )
@@ -31,66 +34,142 @@ func NewConnPipeIPC(c net.Conn, proto ProtocolInfo, options map[string]interface
 			c:       c,
 			proto:   proto,
 			options: make(map[string]interface{}),
+			closeq:  make(chan struct{}),
 		},
 	}
-	p.options[mangos.OptionMaxRecvSize] = int64(0)
+	p.options[mangos.OptionMaxRecvSize] = int(0)
 	for n, v := range options {
 		p.options[n] = v
 	}
 	p.maxrx = p.options[mangos.OptionMaxRecvSize].(int)
+	if uc, ok := c.(*net.UnixConn); ok {
+		if cred, ok := peerCred(uc); ok {
+			p.options[mangos.OptionPeerCred] = cred
+		}
+	}
 
 	return p, nil
 }
 
 func (p *connipc) Send(msg *Message) error {
+	p.slock.Lock()
+	defer p.slock.Unlock()
+	return p.send(msg)
+}
 
-	l := uint64(len(msg.Header) + len(msg.Body))
-	var err error
+// SendMsgs implements mangos.TranPipeBatchSender.
+func (p *connipc) SendMsgs(msgs []*Message) error {
+	p.slock.Lock()
+	defer p.slock.Unlock()
+	return p.sendBatch(msgs, p.frame, p.send)
+}
 
-	// send length header
-	header := make([]byte, 9)
-	header[0] = 1
-	binary.BigEndian.PutUint64(header[1:], l)
+// frame appends to b the length header for a message sent in a batch,
+// or returns nil for one with files, which must be sent on its own.
+func (p *connipc) frame(b []byte, msg *Message) []byte {
+	if len(msg.Files) > 0 {
+		return nil
+	}
+	var hdr [9]byte
+	hdr[0] = 1
+	binary.BigEndian.PutUint64(hdr[1:], uint64(len(msg.Header)+msg.BodyLen()))
+	return append(b, hdr[:]...)
+}
 
-	if _, err = p.c.Write(header[:]); err != nil {
-		return err
+// send does the work of Send.  The caller must hold slock.
+func (p *connipc) send(msg *Message) error {
+	l := uint64(len(msg.Header) + msg.BodyLen())
+
+	// The length header carries a leading byte, always 1.
+	p.shdr[0] = 1
+	binary.BigEndian.PutUint64(p.shdr[1:], l)
+
+	if uc, ok := p.c.(*net.UnixConn); ok && len(msg.Files) > 0 {
+		return p.sendFiles(uc, msg)
 	}
+	return p.sendVec(msg, p.shdr[:])
+}
 
-	if _, err = p.c.Write(msg.Header); err != nil {
-		return err
+// maxFiles is the most files that may be received with one message.
+const maxFiles = 64
+
+// sendFiles sends a message with files attached to the length header.
+// The caller must hold slock.
+func (p *connipc) sendFiles(uc *net.UnixConn, msg *Message) error {
+	if len(msg.Files) > maxFiles {
+		return mangos.ErrTooLong
+	}
+	fds := make([]int, 0, len(msg.Files))
+	for _, f := range msg.Files {
+		fds = append(fds, int(f.Fd()))
 	}
-	// hope this works
-	if _, err = p.c.Write(msg.Body); err != nil {
+	if _, _, err := uc.WriteMsgUnix(p.shdr[:], syscall.UnixRights(fds...), nil); err != nil {
 		return err
 	}
-	msg.Free()
-	return nil
+	return p.sendVec(msg, nil)
 }
 
 func (p *connipc) Recv() (*Message, error) {
 
-	var sz int64
-	var err error
-	var msg *Message
-	var one [1]byte
+	uc, ok := p.c.(*net.UnixConn)
+	if !ok {
+		if _, err := io.ReadFull(p.c, p.rhdr[:]); err != nil {
+			return nil, err
+		}
+		return p.recvBody(int64(binary.BigEndian.Uint64(p.rhdr[1:])))
+	}
 
-	if _, err = p.c.Read(one[:]); err != nil {
-		return nil, err
+	// Any files come with the header, which is read so as to get them.
+	var files []*os.File
+	if p.oob == nil {
+		p.oob = make([]byte, syscall.CmsgSpace(maxFiles*4))
+	}
+	for n := 0; n < len(p.rhdr); {
+		rn, oobn, _, _, err := uc.ReadMsgUnix(p.rhdr[n:], p.oob)
+		files = append(files, parseFiles(p.oob[:oobn])...)
+		if err == nil && rn == 0 {
+			err = io.EOF
+		}
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		n += rn
 	}
-	if err = binary.Read(p.c, binary.BigEndian, &sz); err != nil {
+	msg, err := p.recvBody(int64(binary.BigEndian.Uint64(p.rhdr[1:])))
+	if err != nil {
+		closeFiles(files)
 		return nil, err
 	}
+	msg.Files = files
+	return msg, nil
+}
 
-	// Limit messages to the maximum receive value, if not
-	// unlimited.  This avoids a potential denaial of service.
-	if sz < 0 || (p.maxrx > 0 && sz > int64(p.maxrx)) {
-		return nil, mangos.ErrTooLong
+// parseFiles returns the files passed in the control messages.
+func parseFiles(oob []byte) []*os.File {
+	if len(oob) == 0 {
+		return nil
 	}
-	msg = mangos.NewMessage(int(sz))
-	msg.Body = msg.Body[0:sz]
-	if _, err = io.ReadFull(p.c, msg.Body); err != nil {
-		msg.Free()
-		return nil, err
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	var files []*os.File
+	for i := range cmsgs {
+		fds, err := syscall.ParseUnixRights(&cmsgs[i])
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "ipc"))
+		}
+	}
+	return files
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
 	}
-	return msg, nil
 }
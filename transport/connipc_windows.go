@@ -1,3 +1,4 @@
+//go:build windows
 // +build windows
 
 // Copyright 2019 The Mangos Authors
@@ -31,6 +32,7 @@ func NewConnPipeIPC(c net.Conn, proto ProtocolInfo, options map[string]interface
 			c:       c,
 			proto:   proto,
 			options: make(map[string]interface{}),
+			closeq:  make(chan struct{}),
 		},
 	}
 	p.options[mangos.OptionMaxRecvSize] = int64(0)
@@ -44,7 +46,7 @@ func NewConnPipeIPC(c net.Conn, proto ProtocolInfo, options map[string]interface
 
 func (p *connipc) Send(msg *Message) error {
 
-	l := uint64(len(msg.Header) + len(msg.Body))
+	l := uint64(len(msg.Header) + msg.BodyLen())
 	var err error
 
 	// On Windows, we have to put everything into a contiguous buffer.
@@ -59,6 +61,9 @@ func (p *connipc) Send(msg *Message) error {
 	binary.BigEndian.PutUint64(buf[1:], l)
 	buf = append(buf, msg.Header...)
 	buf = append(buf, msg.Body...)
+	for _, b := range msg.Bodies {
+		buf = append(buf, b...)
+	}
 
 	if _, err = p.c.Write(buf[:]); err != nil {
 		return err
@@ -67,6 +72,18 @@ func (p *connipc) Send(msg *Message) error {
 	return nil
 }
 
+// SendMsgs implements mangos.TranPipeBatchSender.  Each message is
+// sent with its own write, as the one from conn would frame them wrongly.
+func (p *connipc) SendMsgs(msgs []*Message) error {
+	for i, msg := range msgs {
+		if err := p.Send(msg); err != nil {
+			freeMsgs(msgs[i:])
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *connipc) Recv() (*Message, error) {
 
 	var sz int64
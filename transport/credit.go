@@ -0,0 +1,198 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// ParseCreditWindow checks a value for mangos.OptionCreditWindow.
+func ParseCreditWindow(v interface{}) (int, error) {
+	if n, ok := v.(int); ok && n >= 0 && int64(n) <= maxCreditWindow {
+		return n, nil
+	}
+	return 0, mangos.ErrBadValue
+}
+
+// maxCreditWindow is the largest window that fits in the handshake.
+const maxCreditWindow = 1<<31 - 1
+
+// creditExt negotiates credit based flow control.  The dialer offers its
+// receive window, and the listener answers with its own.  Each end then
+// sends the other no more than the other's window, waiting for credit to
+// send more, and grants credit as the messages it receives are consumed.
+// A window of zero leaves that direction unlimited.
+var creditExt = &extension{
+	typ: extCredit,
+	offer: func(p *conn) ([]byte, bool) {
+		return creditValue(p.creditWant), p.creditWant > 0
+	},
+	answer: func(p *conn, v []byte) []byte {
+		if len(v) != 4 {
+			return nil
+		}
+		p.setCredit(creditWindow(v))
+		return creditValue(p.creditWant)
+	},
+	accept: func(p *conn, v []byte) error {
+		if len(v) != 4 {
+			return mangos.ErrBadHeader
+		}
+		p.setCredit(creditWindow(v))
+		return nil
+	},
+}
+
+func creditValue(n int) []byte {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(n))
+	return v
+}
+
+func creditWindow(v []byte) int {
+	return int(binary.BigEndian.Uint32(v) & maxCreditWindow)
+}
+
+// setCredit applies the windows agreed, the peer's limiting what we send,
+// and ours what the peer sends.
+func (p *conn) setCredit(peer int) {
+	p.Lock()
+	defer p.Unlock()
+	if peer > 0 {
+		p.sendCredit = peer
+		p.framed = true
+	}
+	if p.creditWant > 0 {
+		p.window = p.creditWant
+		p.recvCredit = p.creditWant
+		p.framed = true
+		p.options[mangos.OptionCreditWindow] = p.window
+	}
+}
+
+// Credit implements mangos.TranPipeCredit.
+func (p *conn) Credit() (int, int) {
+	p.Lock()
+	defer p.Unlock()
+	if p.window == 0 {
+		return p.sendCredit, -1
+	}
+	return p.sendCredit, p.recvCredit
+}
+
+// limited returns true if what we send is limited by credit.
+func (p *conn) limited() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.sendCredit >= 0
+}
+
+// takeCredit waits for credit to send a message, and takes it.  Messages
+// too large for the peer cost nothing, as they are not sent.
+func (p *conn) takeCredit(size int) error {
+	if p.peerMax > 0 && size > p.peerMax {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	for p.sendCredit == 0 {
+		q := p.creditq
+		p.Unlock()
+		select {
+		case <-q:
+		case <-p.closeq:
+			p.Lock()
+			return mangos.ErrClosed
+		}
+		p.Lock()
+	}
+	if p.sendCredit > 0 {
+		p.sendCredit--
+	}
+	return nil
+}
+
+// credited adds the credit granted by the peer, waking any sender
+// waiting for it.
+func (p *conn) credited(n int) {
+	p.Lock()
+	if p.sendCredit >= 0 {
+		p.sendCredit += n
+	}
+	close(p.creditq)
+	p.creditq = make(chan struct{})
+	p.Unlock()
+}
+
+// spent counts a message received against the peer's credit.
+func (p *conn) spent() {
+	p.Lock()
+	if p.window > 0 {
+		p.recvCredit--
+	}
+	p.Unlock()
+}
+
+// Grant implements mangos.TranPipeCredit.  Credit is returned to the
+// peer in batches of half the window, so as not to send a frame for
+// every message.  The frames are sent by a goroutine of their own, as
+// Grant may be called from anywhere that frees a message.
+func (p *conn) Grant(n int) {
+	p.Lock()
+	defer p.Unlock()
+	if p.window == 0 || !p.open {
+		return
+	}
+	p.granted += n
+	if p.granting || p.granted < (p.window+1)/2 {
+		return
+	}
+	p.granting = true
+	go p.grants()
+}
+
+// grants sends the credit granted until there is none left to send.
+func (p *conn) grants() {
+	var frame [13]byte
+	for {
+		p.Lock()
+		n := p.granted
+		if n < (p.window+1)/2 || !p.open {
+			p.granting = false
+			p.Unlock()
+			return
+		}
+		p.granted = 0
+		p.recvCredit += n
+		p.Unlock()
+
+		binary.BigEndian.PutUint64(frame[:8], 5)
+		frame[8] = frameCredit
+		binary.BigEndian.PutUint32(frame[9:], uint32(n))
+		p.slock.Lock()
+		err := p.writeFrame(net.Buffers{frame[:]})
+		p.slock.Unlock()
+		if err != nil {
+			// The receiver will find out soon enough.
+			p.Lock()
+			p.granting = false
+			p.Unlock()
+			return
+		}
+	}
+}
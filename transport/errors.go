@@ -0,0 +1,56 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// MapError returns the mangos error for an error from the network or
+// the operating system, so that applications can test for it with
+// errors.Is, whichever transport was used.  Errors with no equivalent,
+// and those that are already mangos errors, are returned unchanged.
+// The core applies this to what Dial and Listen return, so transports
+// need not, though they may.
+func MapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var ae *net.AddrError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return mangos.ErrConnRefused
+	case errors.Is(err, syscall.EADDRINUSE):
+		return mangos.ErrAddrInUse
+	case errors.As(err, &ae):
+		return mangos.ErrBadAddr
+	}
+	return err
+}
+
+// MapDialError is MapError for dialing, where a missing path (as for an
+// ipc socket nobody is listening on) means that the connection is
+// refused.
+func MapDialError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return mangos.ErrConnRefused
+	}
+	return MapError(err)
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Extensions are optional features, negotiated in the SP handshake.
+//
+// A dialer with extensions to offer sets rsvdExt in the reserved field
+// of its header, and follows the header with a block of them.  A
+// listener that understands reads the block, and answers with rsvdExt
+// and a block of its own, holding its reply to each extension that it
+// knows of and accepts.  Extensions it does not know are ignored, so
+// that new ones can be added without breaking older peers.
+//
+// A listener that predates extensions answers without rsvdExt, and
+// hangs up, as it sees a reserved field that is not zero.  The dialer
+// then remembers the address, and connects again without offering.
+//
+// The block is a 16-bit length, followed by that many bytes of
+// extensions, each being a 16-bit type, a 16-bit length, and a value of
+// that length.  All are in network byte order.
+const rsvdExt = 0x8000
+
+// maxExtBlock limits the size of an extension block, as a defense
+// against abuse.
+const maxExtBlock = 4096
+
+// These are the types of the extensions.
+const (
+	extCompression = 1
+	extHeartbeat   = 2
+	extMaxRecvSize = 3
+	extChunk       = 4
+	extCredit      = 5
+	extChecksum    = 6
+)
+
+// extension describes how an extension is negotiated.
+type extension struct {
+	typ uint16
+
+	// offer returns the dialer's offer, or nil for none, and whether
+	// the offer is needed.  Offers that are not needed are sent when
+	// others are, but do not by themselves cause a dialer to offer
+	// extensions, as most peers predate them, and must be dialed twice
+	// when offered any.
+	offer func(p *conn) ([]byte, bool)
+
+	// answer returns the listener's reply to an offer, or nil to
+	// decline.  It applies the extension to the listener's pipe, if
+	// it is accepted.
+	answer func(p *conn, v []byte) []byte
+
+	// accept applies the listener's reply to the dialer's pipe.
+	accept func(p *conn, v []byte) error
+}
+
+var extensions = []*extension{
+	compressionExt,
+	heartbeatExt,
+	maxRecvSizeExt,
+	chunkExt,
+	creditExt,
+	checksumExt,
+}
+
+func extensionByType(typ uint16) *extension {
+	for _, e := range extensions {
+		if e.typ == typ {
+			return e
+		}
+	}
+	return nil
+}
+
+// legacyPeers are the addresses of listeners found not to understand
+// extensions, with when they were found, so that we do not offer them
+// again for a while.  Peers may be upgraded, and addresses reused, so
+// they are forgotten after legacyTime, and there are at most maxLegacy
+// of them, the oldest going first.
+var legacyPeers = struct {
+	sync.Mutex
+	found map[string]time.Time
+}{found: make(map[string]time.Time)}
+
+const (
+	maxLegacy  = 1024
+	legacyTime = time.Hour
+)
+
+// setLegacy records that the listener at addr does not understand
+// extensions.
+func setLegacy(addr string) {
+	legacyPeers.Lock()
+	defer legacyPeers.Unlock()
+	if _, ok := legacyPeers.found[addr]; !ok &&
+		len(legacyPeers.found) >= maxLegacy {
+		oldest := ""
+		var when time.Time
+		for a, t := range legacyPeers.found {
+			if oldest == "" || t.Before(when) {
+				oldest, when = a, t
+			}
+		}
+		delete(legacyPeers.found, oldest)
+	}
+	legacyPeers.found[addr] = time.Now()
+}
+
+// isLegacy returns true if the listener at addr was lately found not to
+// understand extensions.
+func isLegacy(addr string) bool {
+	legacyPeers.Lock()
+	defer legacyPeers.Unlock()
+	t, ok := legacyPeers.found[addr]
+	if ok && time.Since(t) > legacyTime {
+		delete(legacyPeers.found, addr)
+		return false
+	}
+	return ok
+}
+
+// extBlock is a block of extensions, by type.
+type extBlock map[uint16][]byte
+
+func (b extBlock) write(w io.Writer) error {
+	var buf bytes.Buffer
+	var hdr [4]byte
+	for _, e := range extensions {
+		v, ok := b[e.typ]
+		if !ok {
+			continue
+		}
+		binary.BigEndian.PutUint16(hdr[0:], e.typ)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(v)))
+		buf.Write(hdr[:])
+		buf.Write(v)
+	}
+	if buf.Len() > maxExtBlock {
+		return mangos.ErrTooLong
+	}
+	binary.BigEndian.PutUint16(hdr[0:], uint16(buf.Len()))
+	_, err := w.Write(append(hdr[:2], buf.Bytes()...))
+	return err
+}
+
+func readExtBlock(r io.Reader) (extBlock, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > maxExtBlock {
+		return nil, mangos.ErrBadHeader
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	b := make(extBlock)
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, mangos.ErrBadHeader
+		}
+		typ := binary.BigEndian.Uint16(buf[0:])
+		l := int(binary.BigEndian.Uint16(buf[2:]))
+		buf = buf[4:]
+		if l > len(buf) {
+			return nil, mangos.ErrBadHeader
+		}
+		b[typ] = buf[:l]
+		buf = buf[l:]
+	}
+	return b, nil
+}
+
+// offers returns the extensions the dialer offers, or nil if there are
+// none worth offering.
+func (p *conn) offers() extBlock {
+	if isLegacy(p.c.RemoteAddr().String()) {
+		return nil
+	}
+	b := make(extBlock)
+	needed := false
+	for _, e := range extensions {
+		if v, need := e.offer(p); v != nil {
+			b[e.typ] = v
+			needed = needed || need
+		}
+	}
+	if !needed {
+		return nil
+	}
+	return b
+}
+
+// answers returns the listener's replies to the dialer's offers.
+func (p *conn) answers(offers extBlock) extBlock {
+	b := make(extBlock)
+	for typ, v := range offers {
+		if e := extensionByType(typ); e != nil {
+			if r := e.answer(p, v); r != nil {
+				b[typ] = r
+			}
+		}
+	}
+	return b
+}
+
+// accept applies the listener's replies.  A reply to something that was
+// not offered is a protocol error.
+func (p *conn) accept(offers, replies extBlock) error {
+	for typ, v := range replies {
+		e := extensionByType(typ)
+		if _, ok := offers[typ]; !ok || e == nil {
+			return mangos.ErrBadHeader
+		}
+		if err := e.accept(p, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxRecvSizeExt tells the peer our limit on the size of messages, so
+// that it can drop those that are too large, rather than send them only
+// to have the connection closed.
+var maxRecvSizeExt = &extension{
+	typ: extMaxRecvSize,
+	offer: func(p *conn) ([]byte, bool) {
+		return p.maxRecvSizeValue(), false
+	},
+	answer: func(p *conn, v []byte) []byte {
+		if p.setPeerMaxRecvSize(v) != nil {
+			return nil
+		}
+		return p.maxRecvSizeValue()
+	},
+	accept: func(p *conn, v []byte) error {
+		return p.setPeerMaxRecvSize(v)
+	},
+}
+
+func (p *conn) maxRecvSizeValue() []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(p.maxrx))
+	return v
+}
+
+func (p *conn) setPeerMaxRecvSize(v []byte) error {
+	if len(v) != 8 {
+		return mangos.ErrBadHeader
+	}
+	n := binary.BigEndian.Uint64(v)
+	if n > uint64(int(^uint(0)>>1)) {
+		n = 0
+	}
+	p.Lock()
+	p.peerMax = int(n)
+	p.options[mangos.OptionPeerMaxRecvSize] = int(n)
+	p.Unlock()
+	return nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fdpass implements a transport that adopts connections handed
+// over from another process.  This permits broker architectures where a
+// front process accepts connections (for example on a public TCP port)
+// and passes each connected file descriptor to a worker process, which
+// then runs the SP protocol on it.
+//
+// The worker listens on a control socket, using an address of the form
+// "fdpass:///path/to/control.sock".  The front process uses a Sender to
+// pass connections to it.  Connections are handed over before any SP
+// handshaking is done; the worker performs the handshake.  This transport
+// cannot be used for dialing.
+//
+// File descriptor passing relies upon UNIX domain sockets, and so this
+// is not available on Windows or Plan 9.
+package fdpass
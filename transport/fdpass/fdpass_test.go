@@ -0,0 +1,102 @@
+// +build !windows,!nacl,!plan9
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fdpass
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/test"
+	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func testHandoff(t *testing.T, network, front, dial string) {
+	dir, err := os.MkdirTemp("", "fdpass")
+	test.MustSucceed(t, err)
+	defer os.RemoveAll(dir)
+	ctl := filepath.Join(dir, "ctl.sock")
+
+	worker, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer worker.Close()
+	test.MustSucceed(t, worker.SetOption(mangos.OptionRecvDeadline, time.Second))
+	test.MustSucceed(t, worker.Listen("fdpass://"+ctl))
+
+	if network == "unix" {
+		front = filepath.Join(dir, front)
+		dial += front
+	}
+	fl, err := net.Listen(network, front)
+	test.MustSucceed(t, err)
+	defer fl.Close()
+	if network == "tcp" {
+		dial += fl.Addr().String()
+	}
+
+	sender, err := NewSender("fdpass://" + ctl)
+	test.MustSucceed(t, err)
+	defer sender.Close()
+
+	go func() {
+		c, err := fl.Accept()
+		if err != nil {
+			return
+		}
+		if err := sender.Send(c); err != nil {
+			t.Errorf("Send failed: %v", err)
+		}
+		c.Close()
+	}()
+
+	client, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer client.Close()
+	test.MustSucceed(t, client.SetOption(mangos.OptionRecvDeadline, time.Second))
+	test.MustSucceed(t, client.Dial(dial))
+
+	test.MustSucceed(t, client.Send([]byte("ping")))
+	b, err := worker.Recv()
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, string(b) == "ping")
+	test.MustSucceed(t, worker.Send([]byte("pong")))
+	b, err = client.Recv()
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, string(b) == "pong")
+}
+
+func TestFdpassTCP(t *testing.T) {
+	testHandoff(t, "tcp", "127.0.0.1:0", "tcp://")
+}
+
+func TestFdpassIPC(t *testing.T) {
+	testHandoff(t, "unix", "front.sock", "ipc://")
+}
+
+func TestFdpassNoDial(t *testing.T) {
+	s, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer s.Close()
+	err = s.Dial(fmt.Sprintf("fdpass:///tmp/nope%d.sock", os.Getpid()))
+	test.MustBeTrue(t, err == mangos.ErrBadTran)
+}
@@ -0,0 +1,292 @@
+// +build !windows,!nacl,!plan9
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fdpass
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// Transport is a transport.Transport for adopting passed connections.
+const Transport = fdpassTran(0)
+
+func init() {
+	transport.RegisterTransport(Transport)
+}
+
+// The single data byte sent with each descriptor says how the connection
+// is framed.  Stream connections (TCP) use plain SP framing, whereas UNIX
+// domain connections use the IPC framing with its extra leading byte.
+const (
+	kindStream = 's'
+	kindIPC    = 'i'
+)
+
+type options map[string]interface{}
+
+func (o options) get(name string) (interface{}, error) {
+	v, ok := o[name]
+	if !ok {
+		return nil, mangos.ErrBadOption
+	}
+	return v, nil
+}
+
+func (o options) set(name string, val interface{}) error {
+	switch name {
+	case mangos.OptionMaxRecvSize:
+		if v, ok := val.(int); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+
+	return mangos.ErrBadOption
+}
+
+// Sender hands connections over to a worker process that is listening
+// with this transport.
+type Sender struct {
+	c *net.UnixConn
+	sync.Mutex
+}
+
+// NewSender connects to the control socket of a worker at the given path.
+// The path may also be given as an "fdpass://" address.
+func NewSender(path string) (*Sender, error) {
+	if a, err := transport.StripScheme(Transport, path); err == nil {
+		path = a
+	}
+	addr, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.DialUnix("unix", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{c: c}, nil
+}
+
+// Send passes the connection to the worker, which will adopt it as a
+// new pipe.  The connection must be a TCP or UNIX domain connection, on
+// which no SP handshaking has been done yet.  On success the caller
+// should close its own copy of the connection.
+func (s *Sender) Send(c net.Conn) error {
+	var kind byte
+	switch c.(type) {
+	case *net.TCPConn:
+		kind = kindStream
+	case *net.UnixConn:
+		kind = kindIPC
+	default:
+		return mangos.ErrBadTran
+	}
+	raw, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		rights := syscall.UnixRights(int(fd))
+		_, _, serr = s.c.WriteMsgUnix([]byte{kind}, rights, nil)
+	})
+	if err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Close closes the control connection.
+func (s *Sender) Close() error {
+	return s.c.Close()
+}
+
+type listener struct {
+	addr       *net.UnixAddr
+	proto      transport.ProtocolInfo
+	listener   *net.UnixListener
+	opts       options
+	handshaker transport.Handshaker
+	closeq     chan struct{}
+	ctls       map[*net.UnixConn]struct{}
+	sync.Mutex
+}
+
+// Listen implements the PipeListener Listen method.
+func (l *listener) Listen() error {
+	listener, err := net.ListenUnix("unix", l.addr)
+	if err != nil {
+		return err
+	}
+	closeq := make(chan struct{})
+	l.closeq = closeq
+	l.listener = listener
+	go func() {
+		for {
+			ctl, err := listener.AcceptUnix()
+			if err != nil {
+				select {
+				case <-closeq:
+					return
+				default:
+					continue
+				}
+			}
+			l.Lock()
+			l.ctls[ctl] = struct{}{}
+			l.Unlock()
+			go l.receive(ctl)
+		}
+	}()
+	return nil
+}
+
+// receive adopts each descriptor passed over the control connection.
+// Only a single byte is read at a time, so that each read returns at most
+// the one descriptor that accompanies it.
+func (l *listener) receive(ctl *net.UnixConn) {
+	defer func() {
+		l.Lock()
+		delete(l.ctls, ctl)
+		l.Unlock()
+		ctl.Close()
+	}()
+
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	for {
+		n, oobn, _, _, err := ctl.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return
+		}
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		for i := range msgs {
+			fds, err := syscall.ParseUnixRights(&msgs[i])
+			if err != nil {
+				continue
+			}
+			for _, fd := range fds {
+				kind := byte(kindStream)
+				if n == 1 {
+					kind = buf[0]
+				}
+				l.adopt(fd, kind)
+			}
+		}
+	}
+}
+
+func (l *listener) adopt(fd int, kind byte) {
+	f := os.NewFile(uintptr(fd), "fdpass")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	var p transport.Pipe
+	if kind == kindIPC {
+		p, err = transport.NewConnPipeIPC(conn, l.proto, l.opts)
+	} else {
+		p, err = transport.NewConnPipe(conn, l.proto, l.opts)
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if err = l.handshaker.Start(p); err != nil {
+		conn.Close()
+	}
+}
+
+func (l *listener) Address() string {
+	return "fdpass://" + l.addr.String()
+}
+
+// Accept implements the the PipeListener Accept method.
+func (l *listener) Accept() (transport.Pipe, error) {
+	return l.handshaker.Wait()
+}
+
+// Close implements the PipeListener Close method.
+func (l *listener) Close() error {
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	l.Lock()
+	for ctl := range l.ctls {
+		ctl.Close()
+	}
+	l.Unlock()
+	l.handshaker.Close()
+	return nil
+}
+
+// SetOption implements a stub PipeListener SetOption method.
+func (l *listener) SetOption(n string, v interface{}) error {
+	return l.opts.set(n, v)
+}
+
+// GetOption implements a stub PipeListener GetOption method.
+func (l *listener) GetOption(n string) (interface{}, error) {
+	return l.opts.get(n)
+}
+
+type fdpassTran int
+
+// Scheme implements the Transport Scheme method.
+func (fdpassTran) Scheme() string {
+	return "fdpass"
+}
+
+// NewDialer implements the Transport NewDialer method.  Connections can
+// only be adopted, so this always fails.
+func (fdpassTran) NewDialer(string, mangos.Socket) (transport.Dialer, error) {
+	return nil, mangos.ErrBadTran
+}
+
+// NewListener implements the Transport NewListener method.
+func (t fdpassTran) NewListener(addr string, sock mangos.Socket) (transport.Listener, error) {
+	var err error
+	l := &listener{
+		proto: sock.Info(),
+		opts:  make(map[string]interface{}),
+		ctls:  make(map[*net.UnixConn]struct{}),
+	}
+	l.opts[mangos.OptionMaxRecvSize] = 0
+
+	if addr, err = transport.StripScheme(t, addr); err != nil {
+		return nil, err
+	}
+	if l.addr, err = net.ResolveUnixAddr("unix", addr); err != nil {
+		return nil, err
+	}
+	l.handshaker = transport.NewConnHandshaker()
+	return l, nil
+}
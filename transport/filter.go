@@ -0,0 +1,107 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// AddrFilter is the parsed form of a mangos.AcceptFilter, which
+// listeners consult as they accept connections.  A nil AddrFilter
+// permits everything.
+type AddrFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// ParseAcceptFilter checks a value for mangos.OptionAcceptFilter,
+// returning the filter it describes, or nil if it permits everything.
+func ParseAcceptFilter(v interface{}) (*AddrFilter, error) {
+	af, ok := v.(mangos.AcceptFilter)
+	if !ok {
+		return nil, mangos.ErrBadValue
+	}
+	if len(af.Allow) == 0 && len(af.Deny) == 0 {
+		return nil, nil
+	}
+	f := &AddrFilter{}
+	var err error
+	if f.allow, err = parseNets(af.Allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseNets(af.Deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, mangos.ErrBadValue
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// Permit reports whether a connection from the address may be accepted.
+// Addresses that are not IP addresses are always permitted.
+func (f *AddrFilter) Permit(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return true
+		}
+		if ip = net.ParseIP(host); ip == nil {
+			return true
+		}
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -29,6 +29,11 @@ type Handshaker interface {
 	// handshaking and returns it.
 	Wait() (Pipe, error)
 
+	// Reject queues a pipe that was refused by a policy check, so
+	// that Wait returns it together with the error.  This lets the
+	// socket report the rejection before the pipe is closed.
+	Reject(Pipe, error)
+
 	// Close is used to close the handshaker.  Any existing
 	// negotiations will be canceled, and the underlying
 	// transport sockets will be closed.  Any new attempts
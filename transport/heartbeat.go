@@ -0,0 +1,127 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// ParseHeartbeatTime checks a value for mangos.OptionHeartbeatTime or
+// mangos.OptionHeartbeatTimeout.
+func ParseHeartbeatTime(v interface{}) (time.Duration, error) {
+	if d, ok := v.(time.Duration); ok && d >= 0 {
+		return d, nil
+	}
+	return 0, mangos.ErrBadValue
+}
+
+// ParseClock checks a value for mangos.OptionClock, which paces the
+// heartbeats sent.  Nil stands for mangos.SystemClock.
+func ParseClock(v interface{}) (mangos.Clock, error) {
+	if c, ok := v.(mangos.Clock); ok || v == nil {
+		return c, nil
+	}
+	return nil, mangos.ErrBadValue
+}
+
+// heartbeatExt negotiates heartbeats.  The dialer offers its interval in
+// milliseconds, and the listener answers with the interval agreed,
+// which is the shorter of the two, ignoring zero.  Zero agreed means no
+// heartbeats.
+var heartbeatExt = &extension{
+	typ: extHeartbeat,
+	offer: func(p *conn) ([]byte, bool) {
+		return heartbeatValue(p.hbWant), p.hbWant > 0
+	},
+	answer: func(p *conn, v []byte) []byte {
+		if len(v) != 4 {
+			return nil
+		}
+		d := heartbeatTime(v)
+		if p.hbWant > 0 && (d == 0 || p.hbWant < d) {
+			d = p.hbWant
+		}
+		p.setHeartbeat(d)
+		return heartbeatValue(d)
+	},
+	accept: func(p *conn, v []byte) error {
+		if len(v) != 4 {
+			return mangos.ErrBadHeader
+		}
+		p.setHeartbeat(heartbeatTime(v))
+		return nil
+	},
+}
+
+func heartbeatValue(d time.Duration) []byte {
+	ms := d / time.Millisecond
+	if d > 0 && ms == 0 {
+		ms = 1
+	}
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(ms))
+	return v
+}
+
+func heartbeatTime(v []byte) time.Duration {
+	return time.Duration(binary.BigEndian.Uint32(v)) * time.Millisecond
+}
+
+// setHeartbeat records the heartbeat interval agreed with the peer.
+func (p *conn) setHeartbeat(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	p.Lock()
+	p.hb = d
+	p.framed = true
+	if p.hbTimeout <= 0 {
+		p.hbTimeout = d * 3
+	}
+	p.options[mangos.OptionHeartbeatTime] = d
+	p.options[mangos.OptionHeartbeatTimeout] = p.hbTimeout
+	p.Unlock()
+}
+
+// heartbeat sends heartbeats until the pipe is closed.  They are sent
+// even when there are messages, which is simpler, and costs little.
+func (p *conn) heartbeat() {
+	for {
+		select {
+		case <-p.hbClock.After(p.hb):
+		case <-p.closeq:
+			return
+		}
+		p.slock.Lock()
+		binary.BigEndian.PutUint64(p.shdr[:8], 1)
+		p.shdr[8] = frameHeartbeat
+		err := p.writeFrame(net.Buffers{p.shdr[:9]})
+		p.slock.Unlock()
+		if err != nil {
+			// The receiver will find out soon enough.
+			return
+		}
+	}
+}
+
+// isTimeout returns true if the error is from a deadline passing.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -108,9 +108,18 @@ func (p *inproc) Send(m *mangos.Message) error {
 	// Upper protocols expect to have to pick header and body part.
 	// Also we need to have a fresh copy of the message for receiver, to
 	// break ownership.
-	nmsg := mangos.NewMessage(len(m.Header) + len(m.Body))
+	nmsg := mangos.NewMessage(len(m.Header) + m.BodyLen())
 	nmsg.Body = append(nmsg.Body, m.Header...)
 	nmsg.Body = append(nmsg.Body, m.Body...)
+	for _, b := range m.Bodies {
+		nmsg.Body = append(nmsg.Body, b...)
+	}
+	// The files are handed over, not copied.  Messages carrying them
+	// are never shared, and others must not be written to, as they
+	// may be.
+	if len(m.Files) > 0 {
+		nmsg.Files, m.Files = m.Files, nil
+	}
 	select {
 	case p.wq <- nmsg:
 		return nil
@@ -183,7 +192,12 @@ func (d *dialer) Dial() (transport.Pipe, error) {
 
 		if (client.selfProto != l.peerProto) ||
 			(client.peerProto != l.selfProto) {
-			return nil, mangos.ErrBadProto
+			listeners.mx.Unlock()
+			return nil, &mangos.ProtocolError{
+				Self: client.selfProto,
+				Peer: client.peerProto,
+				Got:  l.selfProto,
+			}
 		}
 
 		if len(l.accepters) != 0 {
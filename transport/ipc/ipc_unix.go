@@ -1,3 +1,4 @@
+//go:build !windows && !nacl && !plan9
 // +build !windows,!nacl,!plan9
 
 // Copyright 2019 The Mangos Authors
@@ -58,6 +59,13 @@ func (o options) set(name string, val interface{}) error {
 			return nil
 		}
 		return mangos.ErrBadValue
+
+	case mangos.OptionSendBufferSize, mangos.OptionRecvBufferSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
 	}
 
 	return mangos.ErrBadOption
@@ -77,6 +85,10 @@ func (d *dialer) Dial() (transport.Pipe, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = transport.ConfigBuffers(conn, d.opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
 	p, err := transport.NewConnPipeIPC(conn, d.proto, d.opts)
 	if err != nil {
 		conn.Close()
@@ -128,6 +140,10 @@ func (l *listener) Listen() error {
 					continue
 				}
 			}
+			if err = transport.ConfigBuffers(conn, l.opts); err != nil {
+				conn.Close()
+				continue
+			}
 			p, err := transport.NewConnPipeIPC(conn, l.proto, l.opts)
 			if err != nil {
 				conn.Close()
@@ -155,6 +171,7 @@ func (l *listener) Accept() (transport.Pipe, error) {
 // Close implements the PipeListener Close method.
 func (l *listener) Close() error {
 	if l.listener != nil {
+		close(l.closeq)
 		l.listener.Close()
 	}
 	l.handshaker.Close()
@@ -192,6 +209,8 @@ func (t ipcTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, e
 		handshaker: transport.NewConnHandshaker(),
 	}
 	d.opts[mangos.OptionMaxRecvSize] = 0
+	d.opts[mangos.OptionSendBufferSize] = 0
+	d.opts[mangos.OptionRecvBufferSize] = 0
 	if d.addr, err = net.ResolveUnixAddr("unix", addr); err != nil {
 		return nil, err
 	}
@@ -206,6 +225,8 @@ func (t ipcTran) NewListener(addr string, sock mangos.Socket) (transport.Listene
 		opts:  make(map[string]interface{}),
 	}
 	l.opts[mangos.OptionMaxRecvSize] = 0
+	l.opts[mangos.OptionSendBufferSize] = 0
+	l.opts[mangos.OptionRecvBufferSize] = 0
 
 	if addr, err = transport.StripScheme(t, addr); err != nil {
 		return nil, err
@@ -1,3 +1,4 @@
+//go:build windows
 // +build windows
 
 // Copyright 2019 The Mangos Authors
@@ -19,6 +20,7 @@
 package ipc
 
 import (
+	"math"
 	"net"
 
 	"github.com/Microsoft/go-winio"
@@ -54,6 +56,9 @@ const (
 	OptionOutputBufferSize = "WIN-IPC-OUTPUT-BUFFER-SIZE"
 )
 
+// defaultBufferSize is the size of the named pipe buffers unless set.
+const defaultBufferSize = 4096
+
 type dialer struct {
 	path       string
 	proto      transport.ProtocolInfo
@@ -80,13 +85,26 @@ func (d *dialer) Dial() (transport.Pipe, error) {
 	return d.handshaker.Wait()
 }
 
-// SetOption implements a stub PipeDialer SetOption method.
+// SetOption implements the PipeDialer SetOption method.  The buffer
+// sizes of a named pipe are the server's to choose, so only listeners
+// have them.
 func (d *dialer) SetOption(n string, v interface{}) error {
+	switch n {
+	case mangos.OptionMaxRecvSize:
+		if v, ok := v.(int); ok {
+			d.opts[n] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
 	return mangos.ErrBadOption
 }
 
-// GetOption implements a stub PipeDialer GetOption method.
+// GetOption implements the PipeDialer GetOption method.
 func (d *dialer) GetOption(n string) (interface{}, error) {
+	if v, ok := d.opts[n]; ok {
+		return v, nil
+	}
 	return nil, mangos.ErrBadOption
 }
 
@@ -172,6 +190,23 @@ func (l *listener) SetOption(name string, val interface{}) error {
 		}
 		return mangos.ErrBadValue
 
+	case mangos.OptionSendBufferSize, mangos.OptionRecvBufferSize:
+		// These are the common names for the buffer sizes.
+		v, ok := val.(int)
+		if !ok || v < 0 || int64(v) > math.MaxInt32 {
+			return mangos.ErrBadValue
+		}
+		l.opts[name] = v
+		if v == 0 {
+			v = defaultBufferSize
+		}
+		if name == mangos.OptionSendBufferSize {
+			l.opts[OptionOutputBufferSize] = int32(v)
+		} else {
+			l.opts[OptionInputBufferSize] = int32(v)
+		}
+		return nil
+
 	case OptionSecurityDescriptor:
 		if v, ok := val.(string); ok {
 			l.opts[name] = v
@@ -240,8 +275,10 @@ func (t ipcTran) NewListener(address string, sock mangos.Socket) (transport.List
 		handshaker: transport.NewConnHandshaker(),
 	}
 
-	l.opts[OptionInputBufferSize] = int32(4096)
-	l.opts[OptionOutputBufferSize] = int32(4096)
+	l.opts[OptionInputBufferSize] = int32(defaultBufferSize)
+	l.opts[OptionOutputBufferSize] = int32(defaultBufferSize)
+	l.opts[mangos.OptionSendBufferSize] = 0
+	l.opts[mangos.OptionRecvBufferSize] = 0
 	l.opts[OptionSecurityDescriptor] = ""
 	l.opts[mangos.OptionMaxRecvSize] = 0
 
@@ -0,0 +1,91 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package transport
+
+import (
+	"net"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// ParseLocalAddr checks a value for mangos.OptionDialLocalAddr,
+// returning the parsed address (nil for the empty string, meaning the
+// system chooses).
+func ParseLocalAddr(v interface{}) (*net.TCPAddr, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, mangos.ErrBadValue
+	}
+	if s == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil, mangos.ErrBadValue
+	}
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, mangos.ErrBadValue
+	}
+	return addr, nil
+}
+
+// localAddr returns the address to bind when connecting to raddr, as
+// given by mangos.OptionDialLocalAddr or mangos.OptionDialInterface in
+// the options.  It returns nil if neither is set.
+func localAddr(options map[string]interface{}, raddr *net.TCPAddr) (*net.TCPAddr, error) {
+	if v, ok := options[mangos.OptionDialLocalAddr]; ok {
+		laddr, err := ParseLocalAddr(v)
+		if err != nil || laddr != nil {
+			return laddr, err
+		}
+	}
+	name, _ := options[mangos.OptionDialInterface].(string)
+	if name == "" {
+		return nil, nil
+	}
+	ifc, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	v4 := raddr.IP.To4() != nil
+	var found net.IP
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || (ipn.IP.To4() != nil) != v4 {
+			continue
+		}
+		if ipn.IP.IsGlobalUnicast() {
+			return &net.TCPAddr{IP: ipn.IP}, nil
+		}
+		if found == nil {
+			found = ipn.IP
+		}
+	}
+	if found == nil {
+		return nil, &net.AddrError{Err: "no suitable address on interface", Addr: name}
+	}
+	laddr := &net.TCPAddr{IP: found}
+	if found.IsLinkLocalUnicast() {
+		laddr.Zone = name
+	}
+	return laddr, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mcast implements a UDP multicast transport for PUB/SUB.  A PUB
+// socket sends each message once, to a multicast group, and every SUB
+// socket that has joined the group receives it.  On a LAN this takes
+// the cost of fanning out to many subscribers off the publisher.  To
+// enable it simply import it.
+//
+// Addresses are of the form "mcast://239.1.2.3:5555", or for IPv6,
+// "mcast://[ff15::1234]:5555".  Either side may dial or listen; in both
+// cases the socket gets a single pipe, which for PUB sends to the group,
+// and for SUB joins it.  Only PUB and SUB sockets (cooked or raw) may use
+// this transport, as there is no way for a peer to reply.
+//
+// There is no reliability of any kind.  Messages may be lost, duplicated,
+// or reordered, and there is no indication of this to either side.  A
+// publisher cannot tell whether anyone is subscribed, and a subscriber
+// cannot tell whether a publisher is present.  Each message is sent as
+// one datagram, and messages that do not fit in one (about 64 KB, less
+// headers) are silently dropped.  Replay requests (OptionReplay) are
+// dropped as well, as a subscriber cannot talk back.  Applications that
+// need any of these should use tcp instead, or add their own sequence
+// numbers to detect loss.
+//
+// The options OptionInterface, OptionTTL and OptionLoopback control how
+// multicast traffic is sent and received, and mangos.OptionRecvBufferSize
+// may be used to make the receive buffer larger, reducing loss when a
+// subscriber falls behind a burst.
+package mcast
@@ -0,0 +1,465 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mcast
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// Transport is a transport.Transport for UDP multicast.
+const Transport = mcastTran(0)
+
+// Options specific to multicast.  They are valid on both dialers and
+// listeners.
+const (
+	// OptionInterface names the network interface, such as "eth1", to
+	// send and receive multicast traffic on.  The default, an empty
+	// string, leaves the choice to the system.
+	OptionInterface = "MCAST-INTERFACE"
+
+	// OptionTTL is the number of hops that multicast messages may make
+	// (the IP time to live, or IPv6 hop limit).  The value is an int,
+	// from 1, the default, which keeps them on the local network, to
+	// 255.
+	OptionTTL = "MCAST-TTL"
+
+	// OptionLoopback determines whether messages sent are also received
+	// by subscribers on the same host.  The value is a bool, and the
+	// default is true.
+	OptionLoopback = "MCAST-LOOPBACK"
+)
+
+// Each datagram starts with a header much like the one exchanged by the
+// stream transports when connecting: a zero, 'S', 'P', a version of
+// zero, and the sender's protocol number.  The last two bytes are
+// reserved.  Subscribers ignore datagrams from anything but a publisher.
+const hdrSize = 8
+
+// maxDatagram is the largest UDP payload that IPv4 permits.  IPv6 can
+// carry a little more, but not much, and it is simpler to use one limit.
+const maxDatagram = 65507
+
+func init() {
+	transport.RegisterTransport(Transport)
+}
+
+type options map[string]interface{}
+
+func (o options) get(name string) (interface{}, error) {
+	v, ok := o[name]
+	if !ok {
+		return nil, mangos.ErrBadOption
+	}
+	return v, nil
+}
+
+func (o options) set(name string, val interface{}) error {
+	switch name {
+	case mangos.OptionMaxRecvSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionRecvBufferSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case OptionInterface:
+		if v, ok := val.(string); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case OptionTTL:
+		if v, ok := val.(int); ok && v >= 1 && v <= 255 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case OptionLoopback:
+		if v, ok := val.(bool); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+	return mangos.ErrBadOption
+}
+
+func newOptions() options {
+	o := make(map[string]interface{})
+	o[mangos.OptionMaxRecvSize] = 0
+	o[mangos.OptionRecvBufferSize] = 0
+	o[OptionInterface] = ""
+	o[OptionTTL] = 1
+	o[OptionLoopback] = true
+	return options(o)
+}
+
+// iface returns the interface named by OptionInterface, if any.
+func (o options) iface() (*net.Interface, error) {
+	name := o[OptionInterface].(string)
+	if name == "" {
+		return nil, nil
+	}
+	return net.InterfaceByName(name)
+}
+
+// pipe is a multicast pipe.  Publishers have one that only sends, and
+// subscribers one that only receives.
+type pipe struct {
+	c       *net.UDPConn
+	proto   transport.ProtocolInfo
+	sender  bool
+	maxrx   int
+	options map[string]interface{}
+	closeq  chan struct{}
+	once    sync.Once
+	closed  func() // called once the pipe is closed, if not nil
+
+	slock sync.Mutex
+	sbuf  []byte
+	rbuf  []byte
+}
+
+// newPipe opens a pipe to the group.  What kind of pipe depends on the
+// protocol.
+func newPipe(group *net.UDPAddr, proto transport.ProtocolInfo, o options) (*pipe, error) {
+	ifi, err := o.iface()
+	if err != nil {
+		return nil, err
+	}
+	if ifi != nil && group.Zone == "" && group.IP.IsLinkLocalMulticast() {
+		g := *group
+		g.Zone = ifi.Name
+		group = &g
+	}
+	p := &pipe{
+		proto:   proto,
+		sender:  proto.Self == mangos.ProtoPub,
+		maxrx:   o[mangos.OptionMaxRecvSize].(int),
+		options: make(map[string]interface{}),
+		closeq:  make(chan struct{}),
+	}
+	if p.sender {
+		var laddr *net.UDPAddr
+		if ifi != nil {
+			// Binding to an address of the interface makes the
+			// system send from it.
+			if laddr, err = ifaceAddr(ifi, group); err != nil {
+				return nil, err
+			}
+		}
+		if p.c, err = net.DialUDP("udp", laddr, group); err != nil {
+			return nil, err
+		}
+		err = setMulticast(p.c, group.IP.To4() == nil,
+			o[OptionTTL].(int), o[OptionLoopback].(bool))
+		if err != nil {
+			p.c.Close()
+			return nil, err
+		}
+		p.sbuf = make([]byte, 0, maxDatagram)
+	} else {
+		if p.c, err = net.ListenMulticastUDP("udp", ifi, group); err != nil {
+			return nil, err
+		}
+		if sz := o[mangos.OptionRecvBufferSize].(int); sz > 0 {
+			if err = p.c.SetReadBuffer(sz); err != nil {
+				p.c.Close()
+				return nil, err
+			}
+		}
+		p.rbuf = make([]byte, maxDatagram)
+	}
+	for n, v := range o {
+		p.options[n] = v
+	}
+	p.options[mangos.OptionLocalAddr] = p.c.LocalAddr()
+	p.options[mangos.OptionRemoteAddr] = group
+	return p, nil
+}
+
+// ifaceAddr returns an address on the interface of the same IP version
+// as the group.
+func ifaceAddr(ifi *net.Interface, group *net.UDPAddr) (*net.UDPAddr, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	v4 := group.IP.To4() != nil
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && (ipn.IP.To4() != nil) == v4 {
+			laddr := &net.UDPAddr{IP: ipn.IP}
+			if ipn.IP.IsLinkLocalUnicast() {
+				laddr.Zone = ifi.Name
+			}
+			return laddr, nil
+		}
+	}
+	return nil, &net.AddrError{Err: "no suitable address on interface", Addr: ifi.Name}
+}
+
+// Send sends the message to the group, as a single datagram.  Messages
+// that are too large for that are dropped.  Subscribers have nothing
+// to send to, so they drop everything.
+func (p *pipe) Send(msg *transport.Message) error {
+	if !p.sender {
+		msg.Free()
+		return nil
+	}
+	p.slock.Lock()
+	defer p.slock.Unlock()
+
+	b := append(p.sbuf[:0], 0, 'S', 'P', 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[4:], p.proto.Self)
+	size := len(b) + len(msg.Header) + msg.BodyLen()
+	if size > maxDatagram {
+		msg.Free()
+		return nil
+	}
+	b = append(b, msg.Header...)
+	b = append(b, msg.Body...)
+	for _, body := range msg.Bodies {
+		b = append(b, body...)
+	}
+	if _, err := p.c.Write(b); err != nil {
+		select {
+		case <-p.closeq:
+			return mangos.ErrClosed
+		default:
+		}
+		// Multicast is best effort, so transient failures (such
+		// as no route, while an interface comes up) are loss.
+		msg.Free()
+		return nil
+	}
+	msg.Free()
+	return nil
+}
+
+// Recv receives the next message from a publisher in the group.  Since
+// publishers never receive anything, for them it just waits until the
+// pipe is closed.
+func (p *pipe) Recv() (*transport.Message, error) {
+	if p.sender {
+		<-p.closeq
+		return nil, mangos.ErrClosed
+	}
+	for {
+		n, _, err := p.c.ReadFromUDP(p.rbuf)
+		if err != nil {
+			select {
+			case <-p.closeq:
+				return nil, mangos.ErrClosed
+			default:
+			}
+			return nil, err
+		}
+		b := p.rbuf[:n]
+		if n < hdrSize || b[0] != 0 || b[1] != 'S' || b[2] != 'P' ||
+			b[3] != 0 || binary.BigEndian.Uint16(b[4:]) != p.proto.Peer {
+			continue
+		}
+		b = b[hdrSize:]
+		if p.maxrx > 0 && len(b) > p.maxrx {
+			continue
+		}
+		msg := mangos.NewMessage(len(b))
+		msg.Body = append(msg.Body, b...)
+		return msg, nil
+	}
+}
+
+func (p *pipe) Close() error {
+	p.once.Do(func() {
+		close(p.closeq)
+		p.c.Close()
+		if p.closed != nil {
+			p.closed()
+		}
+	})
+	return nil
+}
+
+func (p *pipe) LocalProtocol() uint16 {
+	return p.proto.Self
+}
+
+func (p *pipe) RemoteProtocol() uint16 {
+	return p.proto.Peer
+}
+
+func (p *pipe) GetOption(n string) (interface{}, error) {
+	if v, ok := p.options[n]; ok {
+		return v, nil
+	}
+	return nil, mangos.ErrBadProperty
+}
+
+type dialer struct {
+	group *net.UDPAddr
+	proto transport.ProtocolInfo
+	opts  options
+}
+
+func (d *dialer) Dial() (transport.Pipe, error) {
+	return newPipe(d.group, d.proto, d.opts)
+}
+
+func (d *dialer) SetOption(n string, v interface{}) error {
+	return d.opts.set(n, v)
+}
+
+func (d *dialer) GetOption(n string) (interface{}, error) {
+	return d.opts.get(n)
+}
+
+// listener hands out a single pipe at a time, as there is only ever the
+// one group to send to or receive from.  Once that pipe is closed, the
+// next Accept opens another.
+type listener struct {
+	group     *net.UDPAddr
+	proto     transport.ProtocolInfo
+	opts      options
+	listening bool
+	closed    bool
+	active    bool
+	cv        *sync.Cond
+	sync.Mutex
+}
+
+func (l *listener) Listen() error {
+	// Check the interface now, so that mistakes are reported early.
+	if _, err := l.opts.iface(); err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return mangos.ErrClosed
+	}
+	l.listening = true
+	return nil
+}
+
+func (l *listener) Accept() (transport.Pipe, error) {
+	l.Lock()
+	defer l.Unlock()
+	for l.active && !l.closed {
+		l.cv.Wait()
+	}
+	if l.closed || !l.listening {
+		return nil, mangos.ErrClosed
+	}
+	p, err := newPipe(l.group, l.proto, l.opts)
+	if err != nil {
+		return nil, err
+	}
+	l.active = true
+	p.closed = func() {
+		l.Lock()
+		l.active = false
+		l.cv.Broadcast()
+		l.Unlock()
+	}
+	return p, nil
+}
+
+func (l *listener) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	l.closed = true
+	l.cv.Broadcast()
+	return nil
+}
+
+func (l *listener) SetOption(n string, v interface{}) error {
+	return l.opts.set(n, v)
+}
+
+func (l *listener) GetOption(n string) (interface{}, error) {
+	return l.opts.get(n)
+}
+
+func (l *listener) Address() string {
+	return "mcast://" + l.group.String()
+}
+
+type mcastTran int
+
+func (mcastTran) Scheme() string {
+	return "mcast"
+}
+
+// resolve checks the address and the protocol, returning the group.
+func (t mcastTran) resolve(addr string, sock mangos.Socket) (*net.UDPAddr, error) {
+	switch sock.Info().Self {
+	case mangos.ProtoPub, mangos.ProtoSub:
+	default:
+		return nil, mangos.ErrBadProto
+	}
+	addr, err := transport.StripScheme(t, addr)
+	if err != nil {
+		return nil, err
+	}
+	group, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IP.IsMulticast() || group.Port == 0 {
+		return nil, mangos.ErrBadAddr
+	}
+	return group, nil
+}
+
+func (t mcastTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, error) {
+	group, err := t.resolve(addr, sock)
+	if err != nil {
+		return nil, err
+	}
+	d := &dialer{
+		group: group,
+		proto: sock.Info(),
+		opts:  newOptions(),
+	}
+	return d, nil
+}
+
+func (t mcastTran) NewListener(addr string, sock mangos.Socket) (transport.Listener, error) {
+	group, err := t.resolve(addr, sock)
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{
+		group: group,
+		proto: sock.Info(),
+		opts:  newOptions(),
+	}
+	l.cv = sync.NewCond(l)
+	return l, nil
+}
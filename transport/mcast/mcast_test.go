@@ -0,0 +1,172 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mcast
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	"nanomsg.org/go/mangos/v2/test"
+)
+
+func groupAddr() string {
+	return fmt.Sprintf("mcast://239.255.77.1:%d", test.NextPort())
+}
+
+// needMulticast skips the test if multicast does not reach this host.
+func needMulticast(t *testing.T) {
+	g := &net.UDPAddr{IP: net.IPv4(239, 255, 77, 2), Port: int(test.NextPort())}
+	r, err := net.ListenMulticastUDP("udp", nil, g)
+	if err != nil {
+		t.Skipf("no multicast: %v", err)
+	}
+	defer r.Close()
+	s, err := net.DialUDP("udp", nil, g)
+	if err != nil {
+		t.Skipf("no multicast: %v", err)
+	}
+	defer s.Close()
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 3; i++ {
+		s.Write([]byte("probe"))
+	}
+	if _, _, err = r.ReadFromUDP(make([]byte, 16)); err != nil {
+		t.Skipf("no multicast loopback: %v", err)
+	}
+}
+
+func newSub(t *testing.T, addr string) mangos.Socket {
+	s, err := sub.NewSocket()
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, s.SetOption(mangos.OptionSubscribe, []byte{}))
+	test.MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second))
+	test.MustSucceed(t, s.Listen(addr))
+	return s
+}
+
+func TestMcastPubSub(t *testing.T) {
+	needMulticast(t)
+	addr := groupAddr()
+
+	s1 := newSub(t, addr)
+	defer s1.Close()
+	s2 := newSub(t, addr)
+	defer s2.Close()
+
+	p, err := pub.NewSocket()
+	test.MustSucceed(t, err)
+	defer p.Close()
+	test.MustSucceed(t, p.Dial(addr))
+	time.Sleep(time.Second / 10)
+
+	// Multicast is lossy, even on loopback, so allow for some loss.
+	for i := 0; i < 10; i++ {
+		test.MustSucceed(t, p.Send([]byte(fmt.Sprintf("msg %d", i))))
+	}
+	for _, s := range []mangos.Socket{s1, s2} {
+		m, err := s.RecvMsg()
+		test.MustSucceed(t, err)
+		test.MustBeTrue(t, len(m.Body) > 4 && string(m.Body[:4]) == "msg ")
+		info, ok := m.PipeInfo()
+		test.MustBeTrue(t, ok)
+		test.MustBeTrue(t, info.Scheme == "mcast")
+		m.Free()
+	}
+}
+
+func TestMcastTooLong(t *testing.T) {
+	needMulticast(t)
+	addr := groupAddr()
+	s := newSub(t, addr)
+	defer s.Close()
+
+	p, err := pub.NewSocket()
+	test.MustSucceed(t, err)
+	defer p.Close()
+	test.MustSucceed(t, p.Dial(addr))
+	time.Sleep(time.Second / 10)
+
+	// The large message is dropped, but the pipe carries on.
+	test.MustSucceed(t, p.Send(make([]byte, maxDatagram)))
+	for i := 0; i < 5; i++ {
+		test.MustSucceed(t, p.Send([]byte("small")))
+	}
+	m, err := s.Recv()
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, string(m) == "small")
+}
+
+func TestMcastProtocols(t *testing.T) {
+	addr := groupAddr()
+	for _, f := range []func() (mangos.Socket, error){
+		push.NewSocket, pull.NewSocket,
+	} {
+		s, err := f()
+		test.MustSucceed(t, err)
+		test.MustBeTrue(t, s.Dial(addr) == mangos.ErrBadProto)
+		test.MustBeTrue(t, s.Listen(addr) == mangos.ErrBadProto)
+		s.Close()
+	}
+}
+
+func TestMcastBadAddr(t *testing.T) {
+	s, err := sub.NewSocket()
+	test.MustSucceed(t, err)
+	defer s.Close()
+	for _, addr := range []string{
+		"mcast://127.0.0.1:5555",
+		"mcast://239.255.77.1:0",
+		"mcast://239.255.77.1",
+	} {
+		test.MustFail(t, s.Listen(addr))
+	}
+}
+
+func TestMcastOptions(t *testing.T) {
+	s, err := pub.NewSocket()
+	test.MustSucceed(t, err)
+	defer s.Close()
+	d, err := s.NewDialer(groupAddr(), nil)
+	test.MustSucceed(t, err)
+
+	v, err := d.GetOption(OptionTTL)
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, v.(int) == 1)
+	test.MustSucceed(t, d.SetOption(OptionTTL, 4))
+	test.MustBeTrue(t, d.SetOption(OptionTTL, 0) == mangos.ErrBadValue)
+	test.MustBeTrue(t, d.SetOption(OptionTTL, 256) == mangos.ErrBadValue)
+
+	v, err = d.GetOption(OptionLoopback)
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, v.(bool))
+	test.MustSucceed(t, d.SetOption(OptionLoopback, false))
+	test.MustBeTrue(t, d.SetOption(OptionLoopback, 1) == mangos.ErrBadValue)
+
+	test.MustSucceed(t, d.SetOption(OptionInterface, "no-such-interface"))
+	test.MustBeTrue(t, d.SetOption(OptionInterface, 1) == mangos.ErrBadValue)
+
+	l, err := s.NewListener(groupAddr(), map[string]interface{}{
+		OptionInterface: "no-such-interface",
+	})
+	test.MustSucceed(t, err)
+	test.MustFail(t, l.Listen())
+}
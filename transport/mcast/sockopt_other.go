@@ -0,0 +1,33 @@
+// +build !linux,!windows
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mcast
+
+import (
+	"net"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// setMulticast sets the TTL (hop limit) and loopback for sending.  The
+// socket option types vary among the other systems, so only the
+// defaults, which are also the system's, are supported there.
+func setMulticast(c *net.UDPConn, v6 bool, ttl int, loop bool) error {
+	if ttl != 1 || !loop {
+		return mangos.ErrBadOption
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mcast
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticast sets the TTL (hop limit) and loopback for sending.
+func setMulticast(c *net.UDPConn, v6 bool, ttl int, loop bool) error {
+	level, ttlOpt, loopOpt := syscall.IPPROTO_IP,
+		syscall.IP_MULTICAST_TTL, syscall.IP_MULTICAST_LOOP
+	if v6 {
+		level, ttlOpt, loopOpt = syscall.IPPROTO_IPV6,
+			syscall.IPV6_MULTICAST_HOPS, syscall.IPV6_MULTICAST_LOOP
+	}
+	on := 0
+	if loop {
+		on = 1
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptInt(syscall.Handle(fd), level, ttlOpt, ttl); serr == nil {
+			serr = syscall.SetsockoptInt(syscall.Handle(fd), level, loopOpt, on)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,479 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mock implements an in-memory transport for testing, which can
+// inject faults.  To enable it simply import it.
+//
+// Addresses are of the form "test://name", and like inproc, connect
+// sockets in the same process, without using any system resources.
+// Unlike inproc, the frames sent by a pipe can be dropped, delayed,
+// duplicated, reordered or corrupted, as chosen by a Faults function
+// set with OptionFaults, and connection attempts can be made to fail
+// with OptionHandshakeError.  As the faults are chosen by frame number,
+// failure paths can be tested deterministically.
+package mock
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// Transport is a transport.Transport for testing, with fault injection.
+const Transport = mockTran(0)
+
+const (
+	// OptionFaults sets the faults injected into the frames sent by
+	// the pipes of a dialer or listener.  The value is a Faults, or nil
+	// for none.  It may be changed while pipes are connected, and
+	// applies to them at once.
+	OptionFaults = "MOCK-FAULTS"
+
+	// OptionDelay is how long frames are held back by the Delay
+	// fault.  The value is a time.Duration, and the default is 100ms.
+	OptionDelay = "MOCK-DELAY"
+
+	// OptionHandshakeError makes connecting fail with the given error,
+	// as though the SP handshake had.  Set on a dialer, its dials fail;
+	// set on a listener, dials to it fail.  The value is an error, or
+	// nil (the default) for success.
+	OptionHandshakeError = "MOCK-HANDSHAKE-ERROR"
+)
+
+// Fault is what is done to a frame in flight.
+type Fault int
+
+// These are the faults that may be injected.
+const (
+	Pass      Fault = iota // delivered normally
+	Drop                   // never delivered
+	Duplicate              // delivered twice
+	Corrupt                // delivered with the bits of the last byte inverted
+	Delay                  // delivered after OptionDelay, out of order
+	Reorder                // held back, and delivered after the next frame
+)
+
+// Faults chooses the fault for each frame sent by a pipe, given its
+// number (counting from zero, for each pipe) and its contents, which
+// include the protocol header.  It may be called concurrently for
+// different pipes.
+type Faults func(seq int, frame []byte) Fault
+
+// Frames returns Faults that applies f to the numbered frames.
+func Frames(f Fault, seqs ...int) Faults {
+	return func(seq int, _ []byte) Fault {
+		for _, n := range seqs {
+			if n == seq {
+				return f
+			}
+		}
+		return Pass
+	}
+}
+
+// Every returns Faults that applies f to every nth frame, starting
+// with the nth.
+func Every(n int, f Fault) Faults {
+	return func(seq int, _ []byte) Fault {
+		if n > 0 && seq%n == n-1 {
+			return f
+		}
+		return Pass
+	}
+}
+
+const defaultDelay = time.Millisecond * 100
+
+type addr string
+
+func (a addr) String() string {
+	return strings.TrimPrefix(string(a), "test://")
+}
+
+func (addr) Network() string {
+	return "test"
+}
+
+type options map[string]interface{}
+
+func (o options) get(name string) (interface{}, error) {
+	if v, ok := o[name]; ok {
+		return v, nil
+	}
+	return nil, mangos.ErrBadOption
+}
+
+func (o options) set(name string, val interface{}) error {
+	switch name {
+	case OptionFaults:
+		switch v := val.(type) {
+		case nil:
+			o[name] = Faults(nil)
+		case Faults:
+			o[name] = v
+		case func(int, []byte) Fault:
+			o[name] = Faults(v)
+		default:
+			return mangos.ErrBadValue
+		}
+		return nil
+	case OptionDelay:
+		if v, ok := val.(time.Duration); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case OptionHandshakeError:
+		if val == nil {
+			o[name] = error(nil)
+			return nil
+		}
+		if v, ok := val.(error); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+	return mangos.ErrBadOption
+}
+
+func newOptions() options {
+	o := make(map[string]interface{})
+	o[OptionFaults] = Faults(nil)
+	o[OptionDelay] = defaultDelay
+	o[OptionHandshakeError] = error(nil)
+	return options(o)
+}
+
+// pipe is one end of a connection.  Frames are handed over on
+// unbuffered channels, so a sender waits for its peer, as with inproc.
+type pipe struct {
+	addr   addr
+	proto  transport.ProtocolInfo
+	rq     chan []byte
+	wq     chan []byte
+	closeq chan struct{}
+	peerq  chan struct{}
+	faults Faults
+	delay  time.Duration
+	seq    int
+	held   []byte
+	once   sync.Once
+	sync.Mutex
+}
+
+func newPipe(a string, proto transport.ProtocolInfo, opts options) *pipe {
+	p := &pipe{
+		addr:   addr(a),
+		proto:  proto,
+		closeq: make(chan struct{}),
+	}
+	p.faults = opts[OptionFaults].(Faults)
+	p.delay = opts[OptionDelay].(time.Duration)
+	return p
+}
+
+// connect joins two pipes together.
+func connect(p1, p2 *pipe) {
+	q1 := make(chan []byte)
+	q2 := make(chan []byte)
+	p1.rq, p1.wq, p1.peerq = q1, q2, p2.closeq
+	p2.rq, p2.wq, p2.peerq = q2, q1, p1.closeq
+}
+
+func (p *pipe) Recv() (*transport.Message, error) {
+	select {
+	case f := <-p.rq:
+		m := mangos.NewMessage(len(f))
+		m.Body = append(m.Body, f...)
+		return m, nil
+	case <-p.closeq:
+		return nil, mangos.ErrClosed
+	case <-p.peerq:
+		return nil, mangos.ErrClosed
+	}
+}
+
+func (p *pipe) Send(m *transport.Message) error {
+	frame := make([]byte, 0, len(m.Header)+m.BodyLen())
+	frame = append(frame, m.Header...)
+	frame = append(frame, m.Body...)
+	for _, b := range m.Bodies {
+		frame = append(frame, b...)
+	}
+
+	p.Lock()
+	fault := Pass
+	if p.faults != nil {
+		fault = p.faults(p.seq, frame)
+	}
+	p.seq++
+	delay := p.delay
+	switch fault {
+	case Drop:
+		p.Unlock()
+		m.Free()
+		return nil
+	case Reorder:
+		if p.held == nil {
+			p.held = frame
+			p.Unlock()
+			m.Free()
+			return nil
+		}
+	}
+	held := p.held
+	p.held = nil
+	p.Unlock()
+
+	var err error
+	switch fault {
+	case Duplicate:
+		dup := append([]byte{}, frame...)
+		if err = p.deliver(frame); err == nil {
+			err = p.deliver(dup)
+		}
+	case Corrupt:
+		if len(frame) > 0 {
+			frame[len(frame)-1] ^= 0xff
+		}
+		err = p.deliver(frame)
+	case Delay:
+		go func() {
+			time.Sleep(delay)
+			_ = p.deliver(frame)
+		}()
+	default:
+		err = p.deliver(frame)
+	}
+	if err == nil && held != nil {
+		err = p.deliver(held)
+	}
+	if err == nil {
+		m.Free()
+	}
+	return err
+}
+
+func (p *pipe) deliver(frame []byte) error {
+	select {
+	case p.wq <- frame:
+		return nil
+	case <-p.closeq:
+		return mangos.ErrClosed
+	case <-p.peerq:
+		return mangos.ErrClosed
+	}
+}
+
+func (p *pipe) LocalProtocol() uint16 {
+	return p.proto.Self
+}
+
+func (p *pipe) RemoteProtocol() uint16 {
+	return p.proto.Peer
+}
+
+func (p *pipe) Close() error {
+	p.once.Do(func() { close(p.closeq) })
+	return nil
+}
+
+func (p *pipe) GetOption(name string) (interface{}, error) {
+	switch name {
+	case mangos.OptionRemoteAddr, mangos.OptionLocalAddr:
+		return p.addr, nil
+	case OptionFaults:
+		p.Lock()
+		defer p.Unlock()
+		return p.faults, nil
+	case OptionDelay:
+		p.Lock()
+		defer p.Unlock()
+		return p.delay, nil
+	}
+	return nil, mangos.ErrBadProperty
+}
+
+// SetOption implements mangos.TranPipeSetter, so that changes to the
+// faults on a dialer or listener reach its connected pipes.
+func (p *pipe) SetOption(name string, val interface{}) error {
+	o := options{}
+	if err := o.set(name, val); err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	switch name {
+	case OptionFaults:
+		p.faults = o[name].(Faults)
+	case OptionDelay:
+		p.delay = o[name].(time.Duration)
+	}
+	return nil
+}
+
+var listeners = struct {
+	byAddr map[string]*listener
+	sync.Mutex
+}{byAddr: make(map[string]*listener)}
+
+type dialer struct {
+	addr  string
+	proto transport.ProtocolInfo
+	opts  options
+	sync.Mutex
+}
+
+func (d *dialer) Dial() (transport.Pipe, error) {
+	d.Lock()
+	client := newPipe(d.addr, d.proto, d.opts)
+	err, _ := d.opts[OptionHandshakeError].(error)
+	d.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	listeners.Lock()
+	l, ok := listeners.byAddr[d.addr]
+	listeners.Unlock()
+	if !ok {
+		return nil, mangos.ErrConnRefused
+	}
+	if d.proto.Self != l.proto.Peer || d.proto.Peer != l.proto.Self {
+		return nil, mangos.ErrBadProto
+	}
+
+	l.Lock()
+	server := newPipe(l.addr, l.proto, l.opts)
+	err, _ = l.opts[OptionHandshakeError].(error)
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	connect(client, server)
+
+	select {
+	case l.connq <- server:
+		return client, nil
+	case <-l.closeq:
+		return nil, mangos.ErrConnRefused
+	}
+}
+
+func (d *dialer) SetOption(n string, v interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+	return d.opts.set(n, v)
+}
+
+func (d *dialer) GetOption(n string) (interface{}, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.opts.get(n)
+}
+
+type listener struct {
+	addr   string
+	proto  transport.ProtocolInfo
+	opts   options
+	connq  chan *pipe
+	closeq chan struct{}
+	once   sync.Once
+	sync.Mutex
+}
+
+func (l *listener) Listen() error {
+	listeners.Lock()
+	defer listeners.Unlock()
+	if _, ok := listeners.byAddr[l.addr]; ok {
+		return mangos.ErrAddrInUse
+	}
+	listeners.byAddr[l.addr] = l
+	return nil
+}
+
+func (l *listener) Accept() (transport.Pipe, error) {
+	select {
+	case p := <-l.connq:
+		return p, nil
+	case <-l.closeq:
+		return nil, mangos.ErrClosed
+	}
+}
+
+func (l *listener) Address() string {
+	return l.addr
+}
+
+func (l *listener) Close() error {
+	listeners.Lock()
+	if listeners.byAddr[l.addr] == l {
+		delete(listeners.byAddr, l.addr)
+	}
+	listeners.Unlock()
+	l.once.Do(func() { close(l.closeq) })
+	return nil
+}
+
+func (l *listener) SetOption(n string, v interface{}) error {
+	l.Lock()
+	defer l.Unlock()
+	return l.opts.set(n, v)
+}
+
+func (l *listener) GetOption(n string) (interface{}, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.opts.get(n)
+}
+
+type mockTran int
+
+func init() {
+	transport.RegisterTransport(Transport)
+}
+
+func (mockTran) Scheme() string {
+	return "test"
+}
+
+func (t mockTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, error) {
+	if _, err := transport.StripScheme(t, addr); err != nil {
+		return nil, err
+	}
+	d := &dialer{
+		addr:  addr,
+		proto: sock.Info(),
+		opts:  newOptions(),
+	}
+	return d, nil
+}
+
+func (t mockTran) NewListener(addr string, sock mangos.Socket) (transport.Listener, error) {
+	if _, err := transport.StripScheme(t, addr); err != nil {
+		return nil, err
+	}
+	l := &listener{
+		addr:   addr,
+		proto:  sock.Info(),
+		opts:   newOptions(),
+		connq:  make(chan *pipe),
+		closeq: make(chan struct{}),
+	}
+	return l, nil
+}
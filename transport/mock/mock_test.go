@@ -0,0 +1,183 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/test"
+)
+
+var tt = test.NewTranTest(Transport, test.AddrTestMock())
+
+func TestMockAll(t *testing.T) {
+	tt.TestListenAndAccept(t)
+	tt.TestDuplicateListen(t)
+	tt.TestConnRefused(t)
+	tt.TestSendRecv(t)
+	tt.TestScheme(t)
+	tt.TestDialerBadScheme(t)
+	tt.TestListenerBadScheme(t)
+}
+
+// pushPull connects a PUSH to a PULL, with the faults on the PUSH side.
+func pushPull(t *testing.T, f Faults) (mangos.Socket, mangos.Socket, mangos.Dialer) {
+	addr := test.AddrTestMock()
+	rx, err := pull.NewSocket()
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, rx.SetOption(mangos.OptionRecvDeadline, time.Second/2))
+	test.MustSucceed(t, rx.Listen(addr))
+
+	tx, err := push.NewSocket()
+	test.MustSucceed(t, err)
+	d, err := tx.NewDialer(addr, map[string]interface{}{
+		OptionFaults:            f,
+		OptionDelay:             time.Millisecond * 50,
+		mangos.OptionDialAsynch: false,
+	})
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, d.Dial())
+	return tx, rx, d
+}
+
+func sendN(t *testing.T, s mangos.Socket, n int) {
+	for i := 0; i < n; i++ {
+		test.MustSucceed(t, s.Send([]byte(fmt.Sprintf("%d", i))))
+	}
+}
+
+func recvAll(s mangos.Socket) []string {
+	var got []string
+	for {
+		b, err := s.Recv()
+		if err != nil {
+			return got
+		}
+		got = append(got, string(b))
+	}
+}
+
+func mustGet(t *testing.T, got []string, want ...string) {
+	test.MustBeTrue(t, len(got) == len(want))
+	for i := range want {
+		test.MustBeTrue(t, got[i] == want[i])
+	}
+}
+
+func TestMockDrop(t *testing.T) {
+	tx, rx, _ := pushPull(t, Frames(Drop, 1, 3))
+	defer tx.Close()
+	defer rx.Close()
+	sendN(t, tx, 5)
+	mustGet(t, recvAll(rx), "0", "2", "4")
+}
+
+func TestMockDuplicate(t *testing.T) {
+	tx, rx, _ := pushPull(t, Every(2, Duplicate))
+	defer tx.Close()
+	defer rx.Close()
+	sendN(t, tx, 4)
+	mustGet(t, recvAll(rx), "0", "1", "1", "2", "3", "3")
+}
+
+func TestMockReorder(t *testing.T) {
+	tx, rx, _ := pushPull(t, Frames(Reorder, 0, 2))
+	defer tx.Close()
+	defer rx.Close()
+	sendN(t, tx, 4)
+	mustGet(t, recvAll(rx), "1", "0", "3", "2")
+}
+
+func TestMockCorrupt(t *testing.T) {
+	tx, rx, _ := pushPull(t, Frames(Corrupt, 0))
+	defer tx.Close()
+	defer rx.Close()
+	sendN(t, tx, 2)
+	mustGet(t, recvAll(rx), string([]byte{'0' ^ 0xff}), "1")
+}
+
+func TestMockDelay(t *testing.T) {
+	tx, rx, _ := pushPull(t, Frames(Delay, 0))
+	defer tx.Close()
+	defer rx.Close()
+	sendN(t, tx, 2)
+	mustGet(t, recvAll(rx), "1", "0")
+}
+
+func TestMockLiveFaults(t *testing.T) {
+	tx, rx, d := pushPull(t, nil)
+	defer tx.Close()
+	defer rx.Close()
+	sendN(t, tx, 1)
+	// Frame numbers carry on from those already sent.
+	test.MustSucceed(t, d.SetOption(OptionFaults, Frames(Drop, 1)))
+	sendN(t, tx, 2)
+	mustGet(t, recvAll(rx), "0", "1")
+	test.MustSucceed(t, d.SetOption(OptionFaults, nil))
+	sendN(t, tx, 1)
+	mustGet(t, recvAll(rx), "0")
+}
+
+func TestMockHandshakeError(t *testing.T) {
+	bad := errors.New("handshake failed")
+	addr := test.AddrTestMock()
+	rx, err := pull.NewSocket()
+	test.MustSucceed(t, err)
+	defer rx.Close()
+	l, err := rx.NewListener(addr, nil)
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, l.SetOption(OptionHandshakeError, bad))
+	test.MustSucceed(t, l.Listen())
+
+	tx, err := push.NewSocket()
+	test.MustSucceed(t, err)
+	defer tx.Close()
+	dial := func(opts map[string]interface{}) error {
+		opts[mangos.OptionDialAsynch] = false
+		d, err := tx.NewDialer(addr, opts)
+		test.MustSucceed(t, err)
+		return d.Dial()
+	}
+	test.MustBeTrue(t, dial(map[string]interface{}{}) == bad)
+
+	test.MustSucceed(t, l.SetOption(OptionHandshakeError, nil))
+	test.MustBeTrue(t, dial(map[string]interface{}{
+		OptionHandshakeError: bad,
+	}) == bad)
+	test.MustSucceed(t, dial(map[string]interface{}{}))
+}
+
+func TestMockOptions(t *testing.T) {
+	tx, err := push.NewSocket()
+	test.MustSucceed(t, err)
+	defer tx.Close()
+	d, err := tx.NewDialer(test.AddrTestMock(), nil)
+	test.MustSucceed(t, err)
+	v, err := d.GetOption(OptionDelay)
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, v.(time.Duration) == defaultDelay)
+	test.MustBeTrue(t, d.SetOption(OptionDelay, -time.Second) == mangos.ErrBadValue)
+	test.MustBeTrue(t, d.SetOption(OptionFaults, 1) == mangos.ErrBadValue)
+	test.MustBeTrue(t, d.SetOption(OptionHandshakeError, "x") == mangos.ErrBadValue)
+	test.MustSucceed(t, d.SetOption(OptionFaults, func(int, []byte) Fault {
+		return Pass
+	}))
+}
@@ -0,0 +1,321 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// This is the Noise XX pattern, from revision 34 of the Noise Protocol
+// Framework specification, using X25519, AES-256-GCM and SHA-256:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// Each handshake message is carried in the body of a single SP message,
+// over a pipe that has already completed the SP handshake.  No payloads
+// are sent with the handshake.  Once complete, each SP message (header
+// and body together) is sealed as a single AEAD ciphertext.
+
+const protocolName = "Noise_XX_25519_AESGCM_SHA256"
+
+const (
+	keyLen = 32 // X25519 public key
+	tagLen = 16 // AES-GCM tag
+)
+
+// cipherState is the CipherState of the specification.
+type cipherState struct {
+	aead  cipher.AEAD
+	n     uint64
+	nonce [12]byte
+}
+
+func newCipherState(k []byte) *cipherState {
+	b, err := aes.NewCipher(k)
+	if err != nil {
+		panic(err) // only if the key length is wrong
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		panic(err)
+	}
+	return &cipherState{aead: aead}
+}
+
+func (c *cipherState) setNonce() {
+	binary.BigEndian.PutUint64(c.nonce[4:], c.n)
+	c.n++
+}
+
+func (c *cipherState) seal(dst, ad, pt []byte) []byte {
+	c.setNonce()
+	return c.aead.Seal(dst, c.nonce[:], pt, ad)
+}
+
+func (c *cipherState) open(dst, ad, ct []byte) ([]byte, error) {
+	c.setNonce()
+	return c.aead.Open(dst, c.nonce[:], ct, ad)
+}
+
+// symmetricState is the SymmetricState of the specification.
+type symmetricState struct {
+	ck [32]byte
+	h  [32]byte
+	cs *cipherState
+}
+
+func newSymmetricState() *symmetricState {
+	s := &symmetricState{}
+	copy(s.h[:], protocolName) // shorter than the hash, so padded
+	s.ck = s.h
+	s.mixHash(nil) // empty prologue
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h[:])
+	h.Write(data)
+	h.Sum(s.h[:0])
+}
+
+// hkdf is the two output HKDF of the specification.
+func hkdf(ck, ikm []byte) (k1, k2 []byte) {
+	h := hmac.New(sha256.New, ck)
+	h.Write(ikm)
+	prk := h.Sum(nil)
+
+	h = hmac.New(sha256.New, prk)
+	h.Write([]byte{1})
+	k1 = h.Sum(nil)
+
+	h.Reset()
+	h.Write(k1)
+	h.Write([]byte{2})
+	k2 = h.Sum(nil)
+	return k1, k2
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	ck, k := hkdf(s.ck[:], ikm)
+	copy(s.ck[:], ck)
+	s.cs = newCipherState(k)
+}
+
+func (s *symmetricState) encryptAndHash(dst, pt []byte) []byte {
+	off := len(dst)
+	if s.cs == nil {
+		dst = append(dst, pt...)
+	} else {
+		dst = s.cs.seal(dst, s.h[:], pt)
+	}
+	s.mixHash(dst[off:])
+	return dst
+}
+
+func (s *symmetricState) decryptAndHash(ct []byte) ([]byte, error) {
+	var pt []byte
+	if s.cs == nil {
+		pt = ct
+	} else {
+		var err error
+		if pt, err = s.cs.open(nil, s.h[:], ct); err != nil {
+			return nil, err
+		}
+	}
+	s.mixHash(ct)
+	return pt, nil
+}
+
+func (s *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf(s.ck[:], nil)
+	return newCipherState(k1), newCipherState(k2)
+}
+
+// handshake holds the HandshakeState of the specification.
+type handshake struct {
+	ss        *symmetricState
+	s         *ecdh.PrivateKey
+	e         *ecdh.PrivateKey
+	rs        *ecdh.PublicKey
+	re        *ecdh.PublicKey
+	initiator bool
+}
+
+func (hs *handshake) dh(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return mangos.ErrNoiseFailed
+	}
+	hs.ss.mixKey(secret)
+	return nil
+}
+
+func (hs *handshake) readKey(b []byte, enc bool) (*ecdh.PublicKey, []byte, error) {
+	n := keyLen
+	if enc {
+		n += tagLen
+	}
+	if len(b) < n {
+		return nil, nil, mangos.ErrNoiseFailed
+	}
+	var raw []byte
+	var err error
+	if enc {
+		if raw, err = hs.ss.decryptAndHash(b[:n]); err != nil {
+			return nil, nil, mangos.ErrNoiseFailed
+		}
+	} else {
+		raw = b[:n]
+		hs.ss.mixHash(raw)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, nil, mangos.ErrNoiseFailed
+	}
+	return pub, b[n:], nil
+}
+
+// readPayload consumes the (empty) payload at the end of a message.
+func (hs *handshake) readPayload(b []byte) error {
+	if pt, err := hs.ss.decryptAndHash(b); err != nil || len(pt) != 0 {
+		return mangos.ErrNoiseFailed
+	}
+	return nil
+}
+
+func (hs *handshake) send(p transport.Pipe, b []byte) error {
+	b = hs.ss.encryptAndHash(b, nil) // empty payload
+	m := mangos.NewMessage(len(b))
+	m.Body = append(m.Body, b...)
+	if err := p.Send(m); err != nil {
+		m.Free()
+		return err
+	}
+	return nil
+}
+
+func (hs *handshake) recv(p transport.Pipe) ([]byte, error) {
+	m, err := p.Recv()
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte{}, m.Body...)
+	m.Free()
+	return b, nil
+}
+
+// run performs the handshake over the pipe, returning the cipher states
+// to use for sending and receiving.
+func (hs *handshake) run(p transport.Pipe) (tx, rx *cipherState, err error) {
+	var b []byte
+	hs.ss = newSymmetricState()
+	if hs.e, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return nil, nil, err
+	}
+	epub := hs.e.PublicKey().Bytes()
+	spub := hs.s.PublicKey().Bytes()
+
+	if hs.initiator {
+		// -> e
+		hs.ss.mixHash(epub)
+		if err = hs.send(p, epub); err != nil {
+			return nil, nil, err
+		}
+
+		// <- e, ee, s, es
+		if b, err = hs.recv(p); err != nil {
+			return nil, nil, err
+		}
+		if hs.re, b, err = hs.readKey(b, false); err != nil {
+			return nil, nil, err
+		}
+		if err = hs.dh(hs.e, hs.re); err != nil {
+			return nil, nil, err
+		}
+		if hs.rs, b, err = hs.readKey(b, true); err != nil {
+			return nil, nil, err
+		}
+		if err = hs.dh(hs.e, hs.rs); err != nil {
+			return nil, nil, err
+		}
+		if err = hs.readPayload(b); err != nil {
+			return nil, nil, err
+		}
+
+		// -> s, se
+		b = hs.ss.encryptAndHash(nil, spub)
+		if err = hs.dh(hs.s, hs.re); err != nil {
+			return nil, nil, err
+		}
+		if err = hs.send(p, b); err != nil {
+			return nil, nil, err
+		}
+		tx, rx = hs.ss.split()
+		return tx, rx, nil
+	}
+
+	// -> e
+	if b, err = hs.recv(p); err != nil {
+		return nil, nil, err
+	}
+	if hs.re, b, err = hs.readKey(b, false); err != nil {
+		return nil, nil, err
+	}
+	if err = hs.readPayload(b); err != nil {
+		return nil, nil, err
+	}
+
+	// <- e, ee, s, es
+	hs.ss.mixHash(epub)
+	b = append([]byte{}, epub...)
+	if err = hs.dh(hs.e, hs.re); err != nil {
+		return nil, nil, err
+	}
+	b = hs.ss.encryptAndHash(b, spub)
+	if err = hs.dh(hs.s, hs.re); err != nil {
+		return nil, nil, err
+	}
+	if err = hs.send(p, b); err != nil {
+		return nil, nil, err
+	}
+
+	// -> s, se
+	if b, err = hs.recv(p); err != nil {
+		return nil, nil, err
+	}
+	if hs.rs, b, err = hs.readKey(b, true); err != nil {
+		return nil, nil, err
+	}
+	if err = hs.dh(hs.e, hs.rs); err != nil {
+		return nil, nil, err
+	}
+	if err = hs.readPayload(b); err != nil {
+		return nil, nil, err
+	}
+	rx, tx = hs.ss.split()
+	return tx, rx, nil
+}
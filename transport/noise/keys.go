@@ -0,0 +1,118 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package noise
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"math/big"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Ed25519 keys are converted to their X25519 equivalents, as the
+// handshake only uses Diffie-Hellman.  This is the same birational map
+// used by libsodium (crypto_sign_ed25519_pk_to_curve25519 and friends).
+
+// fieldPrime is 2^255 - 19.
+var fieldPrime, _ = new(big.Int).SetString(
+	"7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// privateKey converts an ed25519 private key to X25519.  The X25519
+// function clamps the scalar itself, so we need not do so here.
+func privateKey(k ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	if len(k) != ed25519.PrivateKeySize {
+		return nil, mangos.ErrBadValue
+	}
+	h := sha512.Sum512(k.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+// publicKey converts an ed25519 public key to X25519, using the
+// relation u = (1 + y) / (1 - y) between the curves.
+func publicKey(k ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(k) != ed25519.PublicKeySize {
+		return nil, mangos.ErrBadValue
+	}
+
+	// The point is stored as little endian y, with the sign of x
+	// in the top bit, which we do not need.
+	b := make([]byte, len(k))
+	for i := range k {
+		b[len(k)-1-i] = k[i]
+	}
+	b[0] &= 0x7f
+	y := new(big.Int).SetBytes(b)
+	if y.Cmp(fieldPrime) >= 0 {
+		return nil, mangos.ErrBadValue
+	}
+
+	one := big.NewInt(1)
+	num := new(big.Int).Add(one, y)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, fieldPrime)
+	if den.Sign() == 0 {
+		return nil, mangos.ErrBadValue
+	}
+	den.ModInverse(den, fieldPrime)
+	u := num.Mul(num, den)
+	u.Mod(u, fieldPrime)
+
+	out := make([]byte, keyLen)
+	ub := u.Bytes()
+	for i := range ub {
+		out[i] = ub[len(ub)-1-i]
+	}
+	return ecdh.X25519().NewPublicKey(out)
+}
+
+// staticKey returns the X25519 key for an OptionNoiseKey value.
+func staticKey(v interface{}) (*ecdh.PrivateKey, error) {
+	switch k := v.(type) {
+	case ed25519.PrivateKey:
+		return privateKey(k)
+	case *ecdh.PrivateKey:
+		if k != nil && k.Curve() == ecdh.X25519() {
+			return k, nil
+		}
+	}
+	return nil, mangos.ErrBadValue
+}
+
+// peerKeys returns the X25519 keys for an OptionNoisePeerKeys value.
+func peerKeys(v interface{}) ([]*ecdh.PublicKey, error) {
+	var keys []*ecdh.PublicKey
+	switch l := v.(type) {
+	case []ed25519.PublicKey:
+		for _, k := range l {
+			pk, err := publicKey(k)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, pk)
+		}
+	case []*ecdh.PublicKey:
+		for _, k := range l {
+			if k == nil || k.Curve() != ecdh.X25519() {
+				return nil, mangos.ErrBadValue
+			}
+			keys = append(keys, k)
+		}
+	default:
+		return nil, mangos.ErrBadValue
+	}
+	return keys, nil
+}
@@ -0,0 +1,387 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package noise implements encrypted transports for mangos, using the
+// Noise Protocol Framework.  This provides encryption and mutual
+// authentication from static keys, for deployments where managing TLS
+// certificates is impractical.  The handshake (Noise XX, with X25519,
+// AES-GCM and SHA-256) takes place on top of another transport, after
+// the SP handshake, so any of tcp, ipc or ws can be used underneath,
+// with addresses such as "noise+tcp://127.0.0.1:4000".  The underlying
+// transport must also be registered (imported).
+//
+// Each dialer and listener must be given a static key with
+// OptionNoiseKey, and will normally be given the keys of permitted
+// peers with OptionNoisePeerKeys.
+package noise
+
+import (
+	"crypto/ecdh"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// handshakeTime limits how long a peer may take to complete the
+// handshake, so that a silent peer cannot hold on to resources.
+const handshakeTime = time.Second * 10
+
+func init() {
+	for _, inner := range []string{"tcp", "ipc", "ws"} {
+		transport.RegisterTransport(NewTransport(inner))
+	}
+}
+
+// NewTransport returns a Transport that layers the Noise handshake and
+// encryption over the transport registered for the inner scheme.  Its
+// scheme is "noise+" followed by the inner scheme.  This is only needed
+// for inner transports other than tcp, ipc and ws, which are registered
+// automatically.  The inner transport must carry messages in order.
+func NewTransport(inner string) transport.Transport {
+	return noiseTran(inner)
+}
+
+// options is used for shared GetOption/SetOption logic.  Anything we do
+// not know is passed down to the inner transport.
+type options struct {
+	key      *ecdh.PrivateKey
+	keyVal   interface{}
+	peers    []*ecdh.PublicKey
+	peersVal interface{}
+	sync.Mutex
+}
+
+func (o *options) get(name string) (interface{}, error) {
+	o.Lock()
+	defer o.Unlock()
+	switch name {
+	case mangos.OptionNoiseKey:
+		if o.keyVal != nil {
+			return o.keyVal, nil
+		}
+	case mangos.OptionNoisePeerKeys:
+		if o.peersVal != nil {
+			return o.peersVal, nil
+		}
+	}
+	return nil, mangos.ErrBadOption
+}
+
+func (o *options) set(name string, val interface{}) error {
+	switch name {
+	case mangos.OptionNoiseKey:
+		k, err := staticKey(val)
+		if err != nil {
+			return mangos.ErrBadValue
+		}
+		o.Lock()
+		o.key, o.keyVal = k, val
+		o.Unlock()
+		return nil
+
+	case mangos.OptionNoisePeerKeys:
+		keys, err := peerKeys(val)
+		if err != nil {
+			return mangos.ErrBadValue
+		}
+		o.Lock()
+		o.peers, o.peersVal = keys, val
+		o.Unlock()
+		return nil
+	}
+	return mangos.ErrBadOption
+}
+
+func (o *options) keys() (*ecdh.PrivateKey, []*ecdh.PublicKey) {
+	o.Lock()
+	defer o.Unlock()
+	return o.key, o.peers
+}
+
+// setInner passes an option down to the inner transport.  The inner
+// transport sees sealed messages, which are bigger than the original.
+func setInner(set func(string, interface{}) error, n string, v interface{}) error {
+	if sz, ok := v.(int); ok && n == mangos.OptionMaxRecvSize && sz > 0 {
+		v = sz + tagLen
+	}
+	return set(n, v)
+}
+
+// pipe wraps a pipe of the inner transport.
+type pipe struct {
+	p     transport.Pipe
+	rs    *ecdh.PublicKey
+	tx    *cipherState
+	rx    *cipherState
+	slock sync.Mutex
+}
+
+// newPipe performs the handshake on an inner pipe, returning the
+// wrapped pipe.  If the peer is not permitted, the pipe is returned
+// along with ErrNoisePeer, so that the socket can report it.
+func newPipe(p transport.Pipe, key *ecdh.PrivateKey, peers []*ecdh.PublicKey, initiator bool) (transport.Pipe, error) {
+	hs := &handshake{s: key, initiator: initiator}
+	timer := time.AfterFunc(handshakeTime, func() { p.Close() })
+	tx, rx, err := hs.run(p)
+	if !timer.Stop() && err == nil {
+		err = mangos.ErrNoiseFailed
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	np := &pipe{p: p, rs: hs.rs, tx: tx, rx: rx}
+	if peers == nil {
+		return np, nil
+	}
+	for _, k := range peers {
+		if k.Equal(hs.rs) {
+			return np, nil
+		}
+	}
+	return np, mangos.ErrNoisePeer
+}
+
+// Send seals the header and body together, as a single message body
+// for the inner pipe.
+func (p *pipe) Send(m *transport.Message) error {
+	sz := len(m.Header) + m.BodyLen()
+	nm := mangos.NewMessage(sz + tagLen)
+	b := append(nm.Body, m.Header...)
+	b = append(b, m.Body...)
+	for _, seg := range m.Bodies {
+		b = append(b, seg...)
+	}
+
+	p.slock.Lock()
+	defer p.slock.Unlock()
+
+	// The nonces must be used in the order sent.
+	nm.Body = p.tx.seal(b[:0], nil, b)
+	if err := p.p.Send(nm); err != nil {
+		nm.Free()
+		return err
+	}
+	m.Free()
+	return nil
+}
+
+func (p *pipe) Recv() (*transport.Message, error) {
+	m, err := p.p.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if m.Body, err = p.rx.open(m.Body[:0], nil, m.Body); err != nil {
+		m.Free()
+		return nil, mangos.ErrNoiseFailed
+	}
+	return m, nil
+}
+
+func (p *pipe) Close() error {
+	return p.p.Close()
+}
+
+func (p *pipe) LocalProtocol() uint16 {
+	return p.p.LocalProtocol()
+}
+
+func (p *pipe) RemoteProtocol() uint16 {
+	return p.p.RemoteProtocol()
+}
+
+func (p *pipe) GetOption(n string) (interface{}, error) {
+	if n == mangos.OptionNoisePeerKey {
+		return p.rs, nil
+	}
+	return p.p.GetOption(n)
+}
+
+type dialer struct {
+	d    transport.Dialer
+	opts *options
+}
+
+func (d *dialer) Dial() (transport.Pipe, error) {
+	key, peers := d.opts.keys()
+	if key == nil {
+		return nil, mangos.ErrNoiseNoKey
+	}
+	p, err := d.d.Dial()
+	if err != nil {
+		return p, err
+	}
+	return newPipe(p, key, peers, true)
+}
+
+func (d *dialer) SetOption(n string, v interface{}) error {
+	if err := d.opts.set(n, v); err != mangos.ErrBadOption {
+		return err
+	}
+	return setInner(d.d.SetOption, n, v)
+}
+
+func (d *dialer) GetOption(n string) (interface{}, error) {
+	if v, err := d.opts.get(n); err == nil {
+		return v, nil
+	}
+	return d.d.GetOption(n)
+}
+
+type acceptItem struct {
+	p   transport.Pipe
+	err error
+}
+
+type listener struct {
+	l       transport.Listener
+	opts    *options
+	acceptq chan acceptItem
+	closeq  chan struct{}
+	once    sync.Once
+}
+
+func (l *listener) Listen() error {
+	key, _ := l.opts.keys()
+	if key == nil {
+		return mangos.ErrNoiseNoKey
+	}
+	if err := l.l.Listen(); err != nil {
+		return err
+	}
+	go l.serve()
+	return nil
+}
+
+func (l *listener) serve() {
+	for {
+		p, err := l.l.Accept()
+		if err == mangos.ErrClosed {
+			return
+		}
+		if p == nil {
+			select {
+			case <-l.closeq:
+				return
+			default:
+				continue
+			}
+		}
+		if err != nil {
+			// Refused by the inner transport, pass it up.
+			l.deliver(p, err)
+			continue
+		}
+
+		// The handshake is done in the background, so that a slow
+		// peer cannot stall others.
+		go func(p transport.Pipe) {
+			key, peers := l.opts.keys()
+			np, err := newPipe(p, key, peers, false)
+			if np != nil {
+				l.deliver(np, err)
+			}
+		}(p)
+	}
+}
+
+func (l *listener) deliver(p transport.Pipe, err error) {
+	select {
+	case l.acceptq <- acceptItem{p: p, err: err}:
+	case <-l.closeq:
+		p.Close()
+	}
+}
+
+func (l *listener) Accept() (transport.Pipe, error) {
+	select {
+	case item := <-l.acceptq:
+		return item.p, item.err
+	case <-l.closeq:
+		return nil, mangos.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.closeq) })
+	return l.l.Close()
+}
+
+func (l *listener) Address() string {
+	return "noise+" + l.l.Address()
+}
+
+func (l *listener) SetOption(n string, v interface{}) error {
+	if err := l.opts.set(n, v); err != mangos.ErrBadOption {
+		return err
+	}
+	return setInner(l.l.SetOption, n, v)
+}
+
+func (l *listener) GetOption(n string) (interface{}, error) {
+	if v, err := l.opts.get(n); err == nil {
+		return v, nil
+	}
+	return l.l.GetOption(n)
+}
+
+type noiseTran string
+
+func (t noiseTran) Scheme() string {
+	return "noise+" + string(t)
+}
+
+// inner returns the inner transport, and the address to use with it.
+func (t noiseTran) inner(addr string) (transport.Transport, string, error) {
+	addr, err := transport.StripScheme(t, addr)
+	if err != nil {
+		return nil, "", err
+	}
+	it := transport.GetTransport(string(t))
+	if it == nil {
+		return nil, "", mangos.ErrBadTran
+	}
+	return it, string(t) + "://" + addr, nil
+}
+
+func (t noiseTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, error) {
+	it, addr, err := t.inner(addr)
+	if err != nil {
+		return nil, err
+	}
+	d, err := it.NewDialer(addr, sock)
+	if err != nil {
+		return nil, err
+	}
+	return &dialer{d: d, opts: &options{}}, nil
+}
+
+func (t noiseTran) NewListener(addr string, sock mangos.Socket) (transport.Listener, error) {
+	it, addr, err := t.inner(addr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := it.NewListener(addr, sock)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{
+		l:       l,
+		opts:    &options{},
+		acceptq: make(chan acceptItem),
+		closeq:  make(chan struct{}),
+	}, nil
+}
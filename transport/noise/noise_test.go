@@ -0,0 +1,220 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package noise
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/test"
+	_ "nanomsg.org/go/mangos/v2/transport/ipc"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+	_ "nanomsg.org/go/mangos/v2/transport/ws"
+)
+
+func newEdKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	test.MustSucceed(t, err)
+	return pub, priv
+}
+
+func TestNoiseKeyConversion(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		pub, priv := newEdKey(t)
+		xpriv, err := privateKey(priv)
+		test.MustSucceed(t, err)
+		xpub, err := publicKey(pub)
+		test.MustSucceed(t, err)
+		test.MustBeTrue(t, xpriv.PublicKey().Equal(xpub))
+	}
+	_, err := publicKey(ed25519.PublicKey{1, 2, 3})
+	test.MustFail(t, err)
+}
+
+func testNoisePair(t *testing.T, addr string) {
+	spub, spriv := newEdKey(t)
+	cpub, cpriv := newEdKey(t)
+
+	srv, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer cli.Close()
+	test.MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	test.MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	pipes := make(chan mangos.Pipe, 1)
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventAttached {
+			pipes <- p
+		}
+	})
+
+	l, err := srv.NewListener(addr, map[string]interface{}{
+		mangos.OptionNoiseKey:      spriv,
+		mangos.OptionNoisePeerKeys: []ed25519.PublicKey{cpub},
+	})
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, l.Listen())
+
+	test.MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionNoiseKey:      cpriv,
+		mangos.OptionNoisePeerKeys: []ed25519.PublicKey{spub},
+	}))
+
+	for i := 0; i < 10; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, i*100)
+		test.MustSucceed(t, cli.Send(msg))
+		b, err := srv.Recv()
+		test.MustSucceed(t, err)
+		test.MustBeTrue(t, bytes.Equal(b, msg))
+
+		test.MustSucceed(t, srv.Send(msg))
+		b, err = cli.Recv()
+		test.MustSucceed(t, err)
+		test.MustBeTrue(t, bytes.Equal(b, msg))
+	}
+
+	p := <-pipes
+	v, err := p.GetOption(mangos.OptionNoisePeerKey)
+	test.MustSucceed(t, err)
+	xpub, err := publicKey(cpub)
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, v.(*ecdh.PublicKey).Equal(xpub))
+}
+
+func TestNoiseTCP(t *testing.T) {
+	testNoisePair(t, "noise+"+test.AddrTestTCP())
+}
+
+func TestNoiseIPC(t *testing.T) {
+	testNoisePair(t, "noise+"+test.AddrTestIPC())
+}
+
+func TestNoiseWS(t *testing.T) {
+	testNoisePair(t, "noise+"+test.AddrTestWS()+"noise")
+}
+
+func TestNoiseX25519Key(t *testing.T) {
+	skey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	test.MustSucceed(t, err)
+	ckey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	test.MustSucceed(t, err)
+	addr := "noise+" + test.AddrTestTCP()
+
+	srv, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer cli.Close()
+	test.MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+
+	test.MustSucceed(t, srv.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionNoiseKey: skey,
+	}))
+	test.MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionNoiseKey:      ckey,
+		mangos.OptionNoisePeerKeys: []*ecdh.PublicKey{skey.PublicKey()},
+	}))
+	test.MustSucceed(t, cli.Send([]byte("hello")))
+	b, err := srv.Recv()
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, string(b) == "hello")
+}
+
+func TestNoiseRejectPeer(t *testing.T) {
+	_, spriv := newEdKey(t)
+	_, cpriv := newEdKey(t)
+	opub, _ := newEdKey(t)
+	addr := "noise+" + test.AddrTestTCP()
+
+	srv, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer srv.Close()
+	cli, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer cli.Close()
+	test.MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Millisecond*200))
+
+	rejected := make(chan bool, 10)
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventRejected {
+			rejected <- true
+		}
+	})
+
+	test.MustSucceed(t, srv.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionNoiseKey:      spriv,
+		mangos.OptionNoisePeerKeys: []ed25519.PublicKey{opub},
+	}))
+	test.MustSucceed(t, cli.SetOption(mangos.OptionDialAsynch, true))
+	test.MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		mangos.OptionNoiseKey: cpriv,
+	}))
+
+	select {
+	case <-rejected:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("peer not rejected")
+	}
+	test.MustSucceed(t, cli.Send([]byte("hello")))
+	_, err = srv.Recv()
+	test.MustBeTrue(t, err == mangos.ErrRecvTimeout)
+}
+
+func TestNoiseOptions(t *testing.T) {
+	sock, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer sock.Close()
+	tran := NewTransport("tcp")
+	test.MustBeTrue(t, tran.Scheme() == "noise+tcp")
+
+	d, err := tran.NewDialer("noise+"+test.AddrTestTCP(), sock)
+	test.MustSucceed(t, err)
+	_, err = d.Dial()
+	test.MustBeTrue(t, err == mangos.ErrNoiseNoKey)
+
+	test.MustBeTrue(t, d.SetOption(mangos.OptionNoiseKey, "bogus") ==
+		mangos.ErrBadValue)
+	test.MustBeTrue(t, d.SetOption(mangos.OptionNoisePeerKeys,
+		[]ed25519.PublicKey{{1}}) == mangos.ErrBadValue)
+	_, priv := newEdKey(t)
+	test.MustSucceed(t, d.SetOption(mangos.OptionNoiseKey, priv))
+	v, err := d.GetOption(mangos.OptionNoiseKey)
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, bytes.Equal(v.(ed25519.PrivateKey), priv))
+
+	// Options for the inner transport pass through.
+	test.MustSucceed(t, d.SetOption(mangos.OptionNoDelay, false))
+	v, err = d.GetOption(mangos.OptionNoDelay)
+	test.MustSucceed(t, err)
+	test.MustBeFalse(t, v.(bool))
+
+	l, err := tran.NewListener("noise+"+test.AddrTestTCP(), sock)
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, l.Listen() == mangos.ErrNoiseNoKey)
+	l.Close()
+
+	_, err = NewTransport("bogus").NewDialer("noise+bogus://x", sock)
+	test.MustBeTrue(t, err == mangos.ErrBadTran)
+}
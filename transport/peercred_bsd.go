@@ -0,0 +1,50 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+	"nanomsg.org/go/mangos/v2"
+)
+
+// peerCred returns the credentials of the peer of a UNIX domain socket.
+func peerCred(c *net.UnixConn) (mangos.PeerCred, bool) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return mangos.PeerCred{}, false
+	}
+	var xc *unix.Xucred
+	var pid int
+	err = rc.Control(func(fd uintptr) {
+		xc, err = unix.GetsockoptXucred(int(fd),
+			unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		if err == nil {
+			pid = peerPID(int(fd))
+		}
+	})
+	if err != nil || xc == nil || xc.Ngroups < 1 {
+		return mangos.PeerCred{}, false
+	}
+	return mangos.PeerCred{
+		PID: pid,
+		UID: int(xc.Uid),
+		GID: int(xc.Groups[0]),
+	}, true
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"syscall"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// peerCred returns the credentials of the peer of a UNIX domain socket.
+func peerCred(c *net.UnixConn) (mangos.PeerCred, bool) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return mangos.PeerCred{}, false
+	}
+	var uc *syscall.Ucred
+	err = rc.Control(func(fd uintptr) {
+		uc, err = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || uc == nil {
+		return mangos.PeerCred{}, false
+	}
+	return mangos.PeerCred{
+		PID: int(uc.Pid),
+		UID: int(uc.Uid),
+		GID: int(uc.Gid),
+	}, true
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// proxyTime limits how long the proxy may take to set up the tunnel.
+const proxyTime = time.Second * 10
+
+// ParseProxy checks a value for mangos.OptionDialProxy, returning the
+// parsed URL (nil for the empty string, meaning no proxy).
+func ParseProxy(v interface{}) (*url.URL, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, mangos.ErrBadValue
+	}
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, mangos.ErrBadValue
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, mangos.ErrBadValue
+	}
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "8080"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// DialTCP connects to addr (in host:port form, as for ResolveTCPAddr),
+// using the proxy given by mangos.OptionDialProxy in the options, if
+// there is one.  The local end is bound as mangos.OptionDialLocalAddr
+// or mangos.OptionDialInterface say, and mangos.OptionIPVersion limits
+// the addresses a hostname may resolve to.  The hostname is resolved
+// again on every call, so that a dialer reconnecting follows changes to
+// its records; with mangos.OptionDialRotate, successive calls take turns
+// among all of its addresses, and with mangos.OptionDialStagger, they
+// are tried in parallel.
+func DialTCP(addr string, options map[string]interface{}) (*net.TCPConn, error) {
+	if v, ok := options[mangos.OptionDialProxy]; ok {
+		proxy, err := ParseProxy(v)
+		if err != nil {
+			return nil, err
+		}
+		if proxy != nil {
+			return dialProxy(proxy, addr, options)
+		}
+	}
+	network := TCPNetwork(options)
+	rotate, _ := options[mangos.OptionDialRotate].(bool)
+	if stagger, _ := options[mangos.OptionDialStagger].(time.Duration); stagger > 0 {
+		return dialStagger(network, addr, stagger, rotate, options)
+	}
+	if rotate {
+		return dialRotate(network, addr, options)
+	}
+	raddr, err := ResolveTCPAddrNetwork(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := localAddr(options, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTCP(network, laddr, raddr)
+}
+
+// DialProxy returns a TCP connection to addr (in host:port form),
+// tunneled through the given proxy.  Once established, the connection
+// carries only the tunneled stream, so it can be used exactly as a
+// direct connection would be.
+func DialProxy(proxy *url.URL, addr string) (*net.TCPConn, error) {
+	return dialProxy(proxy, addr, nil)
+}
+
+func dialProxy(proxy *url.URL, addr string, options map[string]interface{}) (*net.TCPConn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, mangos.ErrBadAddr
+	}
+	pn, err := strconv.Atoi(port)
+	if err != nil || pn < 0 || pn > 0xffff {
+		return nil, mangos.ErrBadAddr
+	}
+
+	raddr, err := net.ResolveTCPAddr("tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := localAddr(options, raddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTCP("tcp", laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxyTime))
+	if proxy.Scheme == "http" {
+		err = proxyHTTP(conn, proxy, addr)
+	} else {
+		err = proxySOCKS5(conn, proxy, host, uint16(pn))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyHTTP uses the HTTP CONNECT method (RFC 7231).  The response is
+// read a byte at a time, so that nothing from the tunnel is consumed.
+func proxyHTTP(conn net.Conn, proxy *url.URL, addr string) error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString(
+			[]byte(u.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return err
+	}
+
+	var resp []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		resp = append(resp, b[0])
+		if n := len(resp); n >= 4 && string(resp[n-4:]) == "\r\n\r\n" {
+			break
+		}
+		if len(resp) > 8192 {
+			return mangos.ErrProxyFailed
+		}
+	}
+
+	// We only need the status code, from "HTTP/1.x NNN reason".
+	if len(resp) < 12 || string(resp[:7]) != "HTTP/1." ||
+		resp[8] != ' ' || resp[9] != '2' {
+		return mangos.ErrProxyFailed
+	}
+	return nil
+}
+
+// proxySOCKS5 uses SOCKS version 5 (RFC 1928), with user name and
+// password authentication (RFC 1929) if credentials were supplied.
+func proxySOCKS5(conn net.Conn, proxy *url.URL, host string, port uint16) error {
+	methods := []byte{5, 1, 0}
+	if proxy.User != nil {
+		methods = []byte{5, 2, 0, 2}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return mangos.ErrProxyFailed
+	}
+	switch reply[1] {
+	case 0:
+	case 2:
+		if proxy.User == nil {
+			return mangos.ErrProxyFailed
+		}
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return mangos.ErrProxyFailed
+		}
+		auth := []byte{1, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(pass)))
+		auth = append(auth, pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return mangos.ErrProxyFailed
+		}
+	default:
+		return mangos.ErrProxyFailed
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return mangos.ErrBadAddr
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// The reply carries the bound address and port, which we must
+	// consume, but otherwise have no use for.
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return err
+	}
+	if hdr[0] != 5 {
+		return mangos.ErrProxyFailed
+	}
+	if hdr[1] != 0 {
+		if hdr[1] == 5 {
+			return mangos.ErrConnRefused
+		}
+		return mangos.ErrProxyFailed
+	}
+	var skip int
+	switch hdr[3] {
+	case 1:
+		skip = net.IPv4len - 1
+	case 3:
+		skip = int(hdr[4])
+	case 4:
+		skip = net.IPv6len - 1
+	default:
+		return mangos.ErrProxyFailed
+	}
+	rest := make([]byte, skip+2)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// ParseHandshakeTimeout checks a value for mangos.OptionHandshakeTimeout.
+func ParseHandshakeTimeout(v interface{}) (time.Duration, error) {
+	if d, ok := v.(time.Duration); ok && d >= 0 {
+		return d, nil
+	}
+	return 0, mangos.ErrBadValue
+}
+
+// Quarantine keeps count of the handshakes failed by each host
+// connecting to a listener, and refuses the hosts that fail too often,
+// as set by mangos.OptionQuarantine.
+type Quarantine struct {
+	policy mangos.Quarantine
+	hosts  map[string]*quarantined
+	swept  time.Time
+	sync.Mutex
+}
+
+type quarantined struct {
+	failures int
+	last     time.Time // of the last failure
+	until    time.Time // refused until then, if in quarantine
+}
+
+// NewQuarantine returns a Quarantine that refuses nobody, until given a
+// policy with SetPolicy.
+func NewQuarantine() *Quarantine {
+	return &Quarantine{hosts: make(map[string]*quarantined)}
+}
+
+// SetPolicy checks and applies a value for mangos.OptionQuarantine.
+// Hosts are forgiven their past failures.
+func (q *Quarantine) SetPolicy(v interface{}) error {
+	p, ok := v.(mangos.Quarantine)
+	if !ok || p.Failures < 0 || p.Window < 0 || p.Time < 0 {
+		return mangos.ErrBadValue
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.policy = p
+	q.hosts = make(map[string]*quarantined)
+	return nil
+}
+
+// Policy returns the policy in force.
+func (q *Quarantine) Policy() mangos.Quarantine {
+	q.Lock()
+	defer q.Unlock()
+	return q.policy
+}
+
+// Permit reports whether a connection from the address may be accepted,
+// which it may unless its host is in quarantine.
+func (q *Quarantine) Permit(addr net.Addr) bool {
+	host := hostOf(addr)
+	q.Lock()
+	defer q.Unlock()
+	if q.policy.Failures == 0 || host == "" {
+		return true
+	}
+	h, ok := q.hosts[host]
+	return !ok || !time.Now().Before(h.until)
+}
+
+// Failed records a failed handshake from the address, putting its host
+// in quarantine if that is one too many.
+func (q *Quarantine) Failed(addr net.Addr) {
+	host := hostOf(addr)
+	q.Lock()
+	defer q.Unlock()
+	if q.policy.Failures == 0 || host == "" {
+		return
+	}
+	now := time.Now()
+	q.sweep(now)
+	h, ok := q.hosts[host]
+	if !ok {
+		h = &quarantined{}
+		q.hosts[host] = h
+	}
+	if now.Sub(h.last) > q.policy.Window {
+		h.failures = 0
+	}
+	h.failures++
+	h.last = now
+	if h.failures >= q.policy.Failures {
+		h.failures = 0
+		h.until = now.Add(q.policy.Time)
+	}
+}
+
+// sweep forgets the hosts that are neither in quarantine nor have
+// failed recently, so that a scan from many addresses does not leave
+// them all behind.  It is done at most once a window.
+func (q *Quarantine) sweep(now time.Time) {
+	if now.Sub(q.swept) < q.policy.Window {
+		return
+	}
+	q.swept = now
+	for host, h := range q.hosts {
+		if now.Sub(h.last) > q.policy.Window && !now.Before(h.until) {
+			delete(q.hosts, host)
+		}
+	}
+}
+
+// hostOf returns the IP address of addr as a string, or "" if it is
+// not an IP address.
+func hostOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,33 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quic implements an SP transport over QUIC.  To enable it
+// simply import it.
+//
+// Addresses are of the form "quic://127.0.0.1:5555", and name a UDP
+// port.  Each dialer makes its own QUIC connection, and opens a single
+// stream on it, which carries the pipe using the same framing as tcp.
+// A listener makes a pipe of every stream that a peer opens, so many
+// pipes can share one connection, and so one UDP flow.
+//
+// QUIC always uses TLS 1.3, so mangos.OptionTLSConfig must be set on
+// both sides, as for tls+tcp, and the listener's configuration must
+// have a certificate.  Unless the configuration lists application
+// protocols (NextProtos), ALPN is used.  The TLS state is available
+// from the pipe, with mangos.OptionTLSConnState.
+//
+// Idle connections are kept alive with QUIC pings, every 15 seconds
+// or as set with mangos.OptionKeepAliveTime.  If mangos.OptionKeepAlive
+// is false, an idle connection is closed after 30 seconds.
+package quic
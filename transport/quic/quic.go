@@ -0,0 +1,405 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// Transport is a transport.Transport for SP over QUIC.
+const Transport = quicTran(0)
+
+// ALPN is the application protocol negotiated by default, when the
+// TLS configuration does not name any (tls.Config.NextProtos).
+const ALPN = "mangos"
+
+// defaultKeepAlive is how often an otherwise idle connection is pinged,
+// so that it does not hit the QUIC idle timeout.
+const defaultKeepAlive = time.Second * 15
+
+func init() {
+	transport.RegisterTransport(Transport)
+}
+
+type options map[string]interface{}
+
+func (o options) get(name string) (interface{}, error) {
+	if v, ok := o[name]; ok {
+		return v, nil
+	}
+	return nil, mangos.ErrBadOption
+}
+
+func (o options) set(name string, val interface{}) error {
+	switch name {
+	case mangos.OptionTLSConfig:
+		if v, ok := val.(*tls.Config); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionMaxRecvSize:
+		if v, ok := val.(int); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionCompression:
+		v, err := transport.ParseCompression(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCompressionThreshold:
+		v, err := transport.ParseCompressionThreshold(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionHeartbeatTime, mangos.OptionHeartbeatTimeout:
+		v, err := transport.ParseHeartbeatTime(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionChunkSize:
+		v, err := transport.ParseChunkSize(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCreditWindow:
+		v, err := transport.ParseCreditWindow(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionChecksum:
+		v, err := transport.ParseChecksum(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionKeepAlive:
+		if v, ok := val.(bool); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionKeepAliveTime:
+		if v, ok := val.(time.Duration); ok && v.Nanoseconds() > 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+	return mangos.ErrBadOption
+}
+
+// tlsConfig returns the TLS configuration to use, with our ALPN added
+// if the application did not choose one.  QUIC requires TLS 1.3.
+func (o options) tlsConfig() *tls.Config {
+	config, _ := o[mangos.OptionTLSConfig].(*tls.Config)
+	if config == nil {
+		return nil
+	}
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{ALPN}
+	}
+	config.MinVersion = tls.VersionTLS13
+	return config
+}
+
+func (o options) quicConfig() *quicgo.Config {
+	config := &quicgo.Config{}
+	if v, ok := o[mangos.OptionKeepAlive]; ok && v.(bool) {
+		config.KeepAlivePeriod = defaultKeepAlive
+		if v, ok := o[mangos.OptionKeepAliveTime]; ok {
+			config.KeepAlivePeriod = v.(time.Duration)
+		}
+	}
+	return config
+}
+
+// pipeOptions returns the options for a new pipe on conn.
+func (o options) pipeOptions(conn *quicgo.Conn) map[string]interface{} {
+	opts := make(map[string]interface{})
+	for n, v := range o {
+		opts[n] = v
+	}
+	opts[mangos.OptionTLSConnState] = conn.ConnectionState().TLS
+	return opts
+}
+
+func newOptions() options {
+	o := make(map[string]interface{})
+	o[mangos.OptionTLSConfig] = nil
+	o[mangos.OptionMaxRecvSize] = 0
+	o[mangos.OptionCompression] = ""
+	o[mangos.OptionCompressionThreshold] = transport.DefaultCompressionThreshold
+	o[mangos.OptionHeartbeatTime] = time.Duration(0)
+	o[mangos.OptionHeartbeatTimeout] = time.Duration(0)
+	o[mangos.OptionChunkSize] = 0
+	o[mangos.OptionCreditWindow] = 0
+	o[mangos.OptionChecksum] = false
+	o[mangos.OptionKeepAlive] = true
+	return options(o)
+}
+
+// stream adapts a QUIC stream to a net.Conn, so that the usual SP
+// framing and handshake can be used on it.  The dialing side owns the
+// connection, and closes it along with its stream.
+type stream struct {
+	*quicgo.Stream
+	conn *quicgo.Conn
+	own  bool
+}
+
+func (s *stream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *stream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *stream) Close() error {
+	s.Stream.CancelRead(0)
+	err := s.Stream.Close()
+	if s.own {
+		s.conn.CloseWithError(0, "")
+	}
+	return err
+}
+
+type dialer struct {
+	addr       string
+	proto      transport.ProtocolInfo
+	opts       options
+	handshaker transport.Handshaker
+}
+
+func (d *dialer) Dial() (transport.Pipe, error) {
+	config := d.opts.tlsConfig()
+	if config == nil {
+		return nil, mangos.ErrTLSNoConfig
+	}
+	ctx := context.Background()
+	conn, err := quicgo.DialAddr(ctx, d.addr, config, d.opts.quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	s, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	c := &stream{Stream: s, conn: conn, own: true}
+	p, err := transport.NewConnPipeDialer(c, d.proto, d.opts.pipeOptions(conn))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err = d.handshaker.Start(p); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return d.handshaker.Wait()
+}
+
+func (d *dialer) SetOption(n string, v interface{}) error {
+	return d.opts.set(n, v)
+}
+
+func (d *dialer) GetOption(n string) (interface{}, error) {
+	return d.opts.get(n)
+}
+
+type listener struct {
+	addr       string
+	bound      net.Addr
+	udp        *net.UDPConn
+	tran       *quicgo.Transport
+	listener   *quicgo.Listener
+	proto      transport.ProtocolInfo
+	opts       options
+	handshaker transport.Handshaker
+	closeq     chan struct{}
+}
+
+func (l *listener) Listen() error {
+	config := l.opts.tlsConfig()
+	if config == nil {
+		return mangos.ErrTLSNoConfig
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return mangos.ErrTLSNoCert
+	}
+	addr, err := net.ResolveUDPAddr("udp", l.addr)
+	if err != nil {
+		return err
+	}
+	// We own the UDP socket and QUIC transport, rather than letting
+	// quic-go make them, so that closing releases the port at once,
+	// along with all the connections accepted on it.
+	udp, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	tran := &quicgo.Transport{Conn: udp}
+	ql, err := tran.Listen(config, l.opts.quicConfig())
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	l.udp = udp
+	l.tran = tran
+	l.listener = ql
+	l.bound = udp.LocalAddr()
+	l.closeq = make(chan struct{})
+
+	go func(closeq chan struct{}) {
+		for {
+			conn, err := ql.Accept(context.Background())
+			if err != nil {
+				select {
+				case <-closeq:
+					return
+				default:
+					continue
+				}
+			}
+			go l.serve(conn)
+		}
+	}(l.closeq)
+
+	return nil
+}
+
+// serve makes a pipe of each stream the peer opens on conn.
+func (l *listener) serve(conn *quicgo.Conn) {
+	for {
+		s, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			return
+		}
+		c := &stream{Stream: s, conn: conn}
+		p, err := transport.NewConnPipeListener(c, l.proto, l.opts.pipeOptions(conn))
+		if err != nil {
+			c.Close()
+			continue
+		}
+		if err = l.handshaker.Start(p); err != nil {
+			c.Close()
+		}
+	}
+}
+
+func (l *listener) Address() string {
+	if b := l.bound; b != nil {
+		return "quic://" + b.String()
+	}
+	return "quic://" + l.addr
+}
+
+func (l *listener) Accept() (transport.Pipe, error) {
+	return l.handshaker.Wait()
+}
+
+func (l *listener) Close() error {
+	if l.listener != nil {
+		close(l.closeq)
+		l.listener.Close()
+		l.tran.Close()
+		l.udp.Close()
+	}
+	l.handshaker.Close()
+	return nil
+}
+
+func (l *listener) SetOption(n string, v interface{}) error {
+	return l.opts.set(n, v)
+}
+
+func (l *listener) GetOption(n string) (interface{}, error) {
+	return l.opts.get(n)
+}
+
+type quicTran int
+
+func (t quicTran) Scheme() string {
+	return "quic"
+}
+
+func (t quicTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, error) {
+	var err error
+
+	if addr, err = transport.StripScheme(t, addr); err != nil {
+		return nil, err
+	}
+
+	// check to ensure the provided addr resolves correctly.
+	if _, err = net.ResolveUDPAddr("udp", addr); err != nil {
+		return nil, err
+	}
+
+	d := &dialer{
+		proto:      sock.Info(),
+		opts:       newOptions(),
+		addr:       addr,
+		handshaker: transport.NewConnHandshaker(),
+	}
+	return d, nil
+}
+
+func (t quicTran) NewListener(addr string, sock mangos.Socket) (transport.Listener, error) {
+	var err error
+
+	if addr, err = transport.StripScheme(t, addr); err != nil {
+		return nil, err
+	}
+	if _, err = net.ResolveUDPAddr("udp", addr); err != nil {
+		return nil, err
+	}
+
+	l := &listener{
+		addr:       addr,
+		proto:      sock.Info(),
+		opts:       newOptions(),
+		handshaker: transport.NewConnHandshaker(),
+	}
+	return l, nil
+}
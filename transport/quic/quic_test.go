@@ -0,0 +1,115 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quic
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/test"
+)
+
+var tt = test.NewTranTest(Transport, test.AddrTestQUIC())
+
+func TestQUICListenAndAccept(t *testing.T) {
+	tt.TestListenAndAccept(t)
+}
+
+func TestQUICDuplicateListen(t *testing.T) {
+	tt.TestDuplicateListen(t)
+}
+
+func TestQUICSendRecv(t *testing.T) {
+	tt.TestSendRecv(t)
+}
+
+func TestQUICAll(t *testing.T) {
+	tt.TestAll(t)
+}
+
+func TestQUICPair(t *testing.T) {
+	srvCfg, err := test.GetTLSConfig(true)
+	test.MustSucceed(t, err)
+	cliCfg, err := test.GetTLSConfig(false)
+	test.MustSucceed(t, err)
+
+	srv, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer srv.Close()
+	test.MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second))
+	l, err := srv.NewListener("quic://127.0.0.1:0", nil)
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, l.SetOption(mangos.OptionTLSConfig, srvCfg))
+	test.MustSucceed(t, l.Listen())
+
+	cli, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer cli.Close()
+	test.MustSucceed(t, cli.DialOptions(l.Address(), map[string]interface{}{
+		mangos.OptionTLSConfig: cliCfg,
+	}))
+
+	test.MustSucceed(t, cli.Send([]byte("hello")))
+	m, err := srv.RecvMsg()
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, string(m.Body) == "hello")
+	info, ok := m.PipeInfo()
+	test.MustBeTrue(t, ok)
+	test.MustBeTrue(t, info.Scheme == "quic")
+
+	v, err := m.Pipe.GetOption(mangos.OptionTLSConnState)
+	test.MustSucceed(t, err)
+	cs := v.(tls.ConnectionState)
+	test.MustBeTrue(t, cs.Version == tls.VersionTLS13)
+	test.MustBeTrue(t, cs.NegotiatedProtocol == ALPN)
+	m.Free()
+}
+
+func TestQUICNoConfig(t *testing.T) {
+	s, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer s.Close()
+	test.MustBeTrue(t, s.Listen(test.AddrTestQUIC()) == mangos.ErrTLSNoConfig)
+
+	d, err := s.NewDialer(test.AddrTestQUIC(), nil)
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, d.SetOption(mangos.OptionDialAsynch, false))
+	test.MustBeTrue(t, d.Dial() == mangos.ErrTLSNoConfig)
+
+	l, err := s.NewListener(test.AddrTestQUIC(), nil)
+	test.MustSucceed(t, err)
+	test.MustSucceed(t, l.SetOption(mangos.OptionTLSConfig, &tls.Config{}))
+	test.MustBeTrue(t, l.Listen() == mangos.ErrTLSNoCert)
+}
+
+func TestQUICOptions(t *testing.T) {
+	s, err := pair.NewSocket()
+	test.MustSucceed(t, err)
+	defer s.Close()
+	d, err := s.NewDialer(test.AddrTestQUIC(), nil)
+	test.MustSucceed(t, err)
+
+	v, err := d.GetOption(mangos.OptionKeepAlive)
+	test.MustSucceed(t, err)
+	test.MustBeTrue(t, v.(bool))
+	test.MustSucceed(t, d.SetOption(mangos.OptionKeepAliveTime, time.Second))
+	test.MustBeTrue(t, d.SetOption(mangos.OptionKeepAliveTime, 0) == mangos.ErrBadValue)
+	test.MustBeTrue(t, d.SetOption(mangos.OptionKeepAlive, 1) == mangos.ErrBadValue)
+	test.MustBeTrue(t, d.SetOption(mangos.OptionTLSConfig, 1) == mangos.ErrBadValue)
+	test.MustBeTrue(t, d.SetOption(mangos.OptionNoDelay, true) == mangos.ErrBadOption)
+}
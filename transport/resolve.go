@@ -0,0 +1,217 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// ResolveTCPAddrs resolves addr (in host:port form) to all of the
+// addresses its host has, in the order the resolver gives them, keeping
+// only those of the family network ("tcp4" or "tcp6") asks for.
+func ResolveTCPAddrs(network, addr string) ([]*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	pn, err := net.LookupPort(network, port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*net.TCPAddr
+	for _, ip := range ips {
+		if (network == "tcp4" && ip.IP.To4() == nil) ||
+			(network == "tcp6" && ip.IP.To4() != nil) {
+			continue
+		}
+		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: pn, Zone: ip.Zone})
+	}
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return addrs, nil
+}
+
+// rotations holds, for each address dialed with mangos.OptionDialRotate,
+// how many times it has been dialed, which picks the resolved address
+// to try first.
+var rotations struct {
+	sync.Mutex
+	next map[string]int
+}
+
+func nextRotation(key string) int {
+	rotations.Lock()
+	defer rotations.Unlock()
+	if rotations.next == nil {
+		rotations.next = make(map[string]int)
+	}
+	n := rotations.next[key]
+	rotations.next[key] = n + 1
+	return n
+}
+
+// dialRotate connects to one of the addresses addr resolves to, trying
+// first the one after that tried first last time, and then the others
+// in turn.
+func dialRotate(network, addr string, options map[string]interface{}) (*net.TCPConn, error) {
+	raddrs, err := ResolveTCPAddrs(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	start := nextRotation(network + " " + addr)
+	for i := range raddrs {
+		raddr := raddrs[(start+i)%len(raddrs)]
+		laddr, e := localAddr(options, raddr)
+		if e != nil {
+			return nil, e
+		}
+		var conn *net.TCPConn
+		if conn, err = net.DialTCP(network, laddr, raddr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialStagger connects to the addresses addr resolves to in parallel,
+// taking them alternately from each family, and starting each attempt
+// once the one before has failed, or stagger has passed since it
+// started.  The first connection made is returned, and the others are
+// canceled, or closed if they connect anyway.
+func dialStagger(network, addr string, stagger time.Duration, rotate bool, options map[string]interface{}) (*net.TCPConn, error) {
+	raddrs, err := ResolveTCPAddrs(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if rotate {
+		start := nextRotation(network + " " + addr)
+		n := start % len(raddrs)
+		raddrs = append(raddrs[n:], raddrs[:n]...)
+	}
+	raddrs = interleave(raddrs)
+
+	type result struct {
+		conn *net.TCPConn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan result, len(raddrs))
+	dial := func(raddr *net.TCPAddr) {
+		var d net.Dialer
+		laddr, err := localAddr(options, raddr)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		if laddr != nil {
+			d.LocalAddr = laddr
+		}
+		conn, err := d.DialContext(ctx, network, raddr.String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		results <- result{conn: conn.(*net.TCPConn)}
+	}
+
+	next, pending := 1, 1
+	go dial(raddrs[0])
+	timer := time.After(stagger)
+	for pending > 0 {
+		var tq <-chan time.Time
+		if next < len(raddrs) {
+			tq = timer
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if err == nil {
+				err = r.err
+			}
+			if next == len(raddrs) {
+				continue
+			}
+		case <-tq:
+		}
+		go dial(raddrs[next])
+		next++
+		pending++
+		timer = time.After(stagger)
+	}
+	return nil, err
+}
+
+// interleave orders addresses alternating between the families, starting
+// with that of the first, so that one which cannot be reached delays
+// trying the other by no more than one attempt.  The order within each
+// family is kept.
+func interleave(addrs []*net.TCPAddr) []*net.TCPAddr {
+	first4 := addrs[0].IP.To4() != nil
+	var same, other []*net.TCPAddr
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == first4 {
+			same = append(same, a)
+		} else {
+			other = append(other, a)
+		}
+	}
+	out := make([]*net.TCPAddr, 0, len(addrs))
+	for i := 0; i < len(same) || i < len(other); i++ {
+		if i < len(same) {
+			out = append(out, same[i])
+		}
+		if i < len(other) {
+			out = append(out, other[i])
+		}
+	}
+	return out
+}
+
+// ParseDialStagger checks a value for mangos.OptionDialStagger.
+func ParseDialStagger(v interface{}) (time.Duration, error) {
+	if d, ok := v.(time.Duration); ok && d >= 0 {
+		return d, nil
+	}
+	return 0, mangos.ErrBadValue
+}
+
+// ParseDialRotate checks a value for mangos.OptionDialRotate.
+func ParseDialRotate(v interface{}) (bool, error) {
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return false, mangos.ErrBadValue
+}
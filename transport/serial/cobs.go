@@ -0,0 +1,61 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serial
+
+import (
+	"nanomsg.org/go/mangos/v2"
+)
+
+// cobsEncode appends the COBS encoding of src to dst, and the zero that
+// ends it.  Each run of up to 254 bytes that are not zero is preceded
+// by a code, one more than its length, standing for the run and the
+// zero after it, or for just the run when the code is 255.
+func cobsEncode(dst, src []byte) []byte {
+	code := len(dst)
+	dst = append(dst, 0)
+	n := byte(1)
+	for _, b := range src {
+		if b != 0 {
+			dst = append(dst, b)
+			n++
+			if n != 0xff {
+				continue
+			}
+		}
+		dst[code] = n
+		code = len(dst)
+		dst = append(dst, 0)
+		n = 1
+	}
+	dst[code] = n
+	return append(dst, 0)
+}
+
+// cobsDecode appends the decoding of src, without its final zero, to
+// dst.
+func cobsDecode(dst, src []byte) ([]byte, error) {
+	for len(src) > 0 {
+		n := int(src[0])
+		if n == 0 || n > len(src) {
+			return nil, mangos.ErrGarbled
+		}
+		dst = append(dst, src[1:n]...)
+		src = src[n:]
+		if n != 0xff && len(src) > 0 {
+			dst = append(dst, 0)
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package serial implements a transport over serial ports (UARTs), for
+// PAIR and REQ/REP links to microcontrollers and field equipment that
+// have nothing else.  To enable it simply import it.
+//
+// Addresses name the device, with the speed as a parameter, as in
+// "serial:///dev/ttyUSB0?baud=115200".  The speed defaults to 115200
+// baud, and the line is always set to eight data bits, no parity, one
+// stop bit, and no flow control.  Either side may dial or listen; in
+// both cases the port is opened, and the socket gets a single pipe on
+// it, as there is only the one peer at the other end of the wire.  A
+// listener opens the port again once its pipe is closed.
+//
+// A serial line has no framing of its own, so each packet is encoded
+// with COBS (Consistent Overhead Byte Stuffing), which removes every
+// zero byte at a cost of at most one byte in 254, and is followed by a
+// zero.  A receiver that starts part way through a packet, or hears
+// noise, finds the start of the next at the following zero.  Every
+// packet also ends with its CRC32C, and damaged ones are discarded, as
+// a lossy network would, so protocols that retry, such as REQ, recover.
+//
+// There is no connection to make, so in place of the SP handshake each
+// side repeats its header every so often, until it has both heard the
+// peer's and been heard.  A dialer waits for this for as long as
+// mangos.OptionHandshakeTimeout allows (five seconds, if that is zero),
+// then tries again as it would after a refused connection; a listener
+// waits for as long as it takes.  A header that arrives once connected
+// means that the peer started over, and the pipe is closed, to be
+// opened afresh.  A peer that just goes away is not noticed, there
+// being nothing like a hangup on the line.
+//
+// Serial ports are supported on Linux, macOS and the BSDs.  Elsewhere
+// dialers and listeners cannot be made, failing with ErrBadTran.
+package serial
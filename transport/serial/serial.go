@@ -0,0 +1,541 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serial
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// Transport is a transport.Transport for serial ports.
+const Transport = serialTran(0)
+
+// DefaultBaud is the speed of a port whose address does not give one.
+const DefaultBaud = 115200
+
+// Each packet starts with its type, and ends with the CRC32C of the
+// type and what follows it.  A hello holds the SP header, then a byte
+// that is one if the sender has heard the peer's hello.
+const (
+	pktHello   = 1
+	pktMessage = 2
+)
+
+const (
+	hdrSize = 8
+	sumSize = 4
+)
+
+// helloInterval is how often hellos are repeated until the peer answers.
+const helloInterval = time.Second / 4
+
+// dialTimeout is how long a dialer waits for the peer, if
+// mangos.OptionHandshakeTimeout does not say.
+const dialTimeout = time.Second * 5
+
+// retryTime is how long a listener waits before trying again to open a
+// port that it could not.
+const retryTime = time.Second
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func init() {
+	transport.RegisterTransport(Transport)
+}
+
+// addr is the address of a serial port, the path of its device.
+type addr string
+
+func (addr) Network() string  { return "serial" }
+func (a addr) String() string { return string(a) }
+
+type options map[string]interface{}
+
+func (o options) get(name string) (interface{}, error) {
+	v, ok := o[name]
+	if !ok {
+		return nil, mangos.ErrBadOption
+	}
+	return v, nil
+}
+
+func (o options) set(name string, val interface{}) error {
+	switch name {
+	case mangos.OptionMaxRecvSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionHandshakeTimeout:
+		if v, ok := val.(time.Duration); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+	return mangos.ErrBadOption
+}
+
+func newOptions() options {
+	o := make(map[string]interface{})
+	o[mangos.OptionMaxRecvSize] = 0
+	o[mangos.OptionHandshakeTimeout] = time.Duration(0)
+	return options(o)
+}
+
+// port is where a pipe is to be opened.
+type port struct {
+	path  string
+	baud  int
+	proto transport.ProtocolInfo
+}
+
+// pipe is a serial pipe.
+type pipe struct {
+	f       *os.File
+	proto   transport.ProtocolInfo
+	maxrx   int
+	options map[string]interface{}
+	once    sync.Once
+	closed  func() // called once the pipe is closed, if not nil
+
+	slock sync.Mutex
+	sbuf  []byte // a packet, before encoding
+	ebuf  []byte // and after
+
+	// Only ever used by one reader at a time.
+	r    *bufio.Reader
+	raw  []byte // received, not yet decoded
+	skip bool   // discarding a packet that is too large
+	dbuf []byte // decoded
+}
+
+// openPipe opens the port, but does not yet say hello.
+func openPipe(pt *port, o options) (*pipe, error) {
+	f, err := openPort(pt.path, pt.baud)
+	if err != nil {
+		return nil, err
+	}
+	p := &pipe{
+		f:       f,
+		proto:   pt.proto,
+		maxrx:   o[mangos.OptionMaxRecvSize].(int),
+		options: make(map[string]interface{}),
+		r:       bufio.NewReader(f),
+	}
+	for n, v := range o {
+		p.options[n] = v
+	}
+	p.options[mangos.OptionLocalAddr] = addr(pt.path)
+	p.options[mangos.OptionRemoteAddr] = addr(pt.path)
+	return p, nil
+}
+
+// handshake exchanges hellos with the peer, until each has heard the
+// other, or until the deadline, if there is one.  Closing the pipe
+// stops it too.
+func (p *pipe) handshake(deadline time.Time) error {
+	heard := false // we have heard the peer
+	acked := false // and it has heard us
+	next := time.Now()
+	for !heard || !acked {
+		now := time.Now()
+		if !deadline.IsZero() && !now.Before(deadline) {
+			return mangos.ErrConnRefused
+		}
+		if !now.Before(next) {
+			if err := p.hello(heard); err != nil {
+				return err
+			}
+			next = now.Add(helloInterval)
+		}
+		wait := next
+		if !deadline.IsZero() && deadline.Before(wait) {
+			wait = deadline
+		}
+		_ = p.f.SetReadDeadline(wait)
+		typ, b, err := p.readPacket()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if typ != pktHello {
+			// Left over from an earlier connection.
+			continue
+		}
+		if err = p.checkHello(b); err != nil {
+			return err
+		}
+		if !heard || b[hdrSize] == 0 {
+			// Answer at once, so that the peer need not wait.
+			next = time.Now()
+		}
+		heard = true
+		acked = acked || b[hdrSize] != 0
+	}
+	if !next.After(time.Now()) {
+		if err := p.hello(true); err != nil {
+			return err
+		}
+	}
+	_ = p.f.SetReadDeadline(time.Time{})
+	return nil
+}
+
+// hello sends our header, saying whether we have heard the peer's.
+func (p *pipe) hello(heard bool) error {
+	b := []byte{0, 'S', 'P', 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(b[4:], p.proto.Self)
+	if heard {
+		b[hdrSize] = 1
+	}
+	p.slock.Lock()
+	defer p.slock.Unlock()
+	return p.write(pktHello, b)
+}
+
+// checkHello validates the peer's hello.
+func (p *pipe) checkHello(b []byte) error {
+	if len(b) != hdrSize+1 || b[0] != 0 || b[1] != 'S' || b[2] != 'P' {
+		return mangos.ErrBadHeader
+	}
+	if b[3] != 0 {
+		return mangos.ErrBadVersion
+	}
+	if peer := binary.BigEndian.Uint16(b[4:]); peer != p.proto.Peer {
+		return &mangos.ProtocolError{
+			Self: p.proto.Self,
+			Peer: p.proto.Peer,
+			Got:  peer,
+		}
+	}
+	return nil
+}
+
+// write sends a packet.  The caller must hold slock.
+func (p *pipe) write(typ byte, segs ...[]byte) error {
+	b := append(p.sbuf[:0], typ)
+	for _, seg := range segs {
+		b = append(b, seg...)
+	}
+	var sum [sumSize]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(b, crcTable))
+	b = append(b, sum[:]...)
+	p.sbuf = b
+	p.ebuf = cobsEncode(p.ebuf[:0], b)
+	_, err := p.f.Write(p.ebuf)
+	return err
+}
+
+// readPacket returns the type and contents of the next packet that is
+// intact.  Damaged packets, and those larger than the limit, are
+// skipped.  If reading times out, what was read is kept for next time.
+func (p *pipe) readPacket() (byte, []byte, error) {
+	limit := 0
+	if p.maxrx > 0 {
+		// Allow for the type, the checksum, and the stuffing.
+		limit = p.maxrx + 1 + sumSize
+		limit += limit/254 + 2
+	}
+	for {
+		b, err := p.r.ReadSlice(0)
+		if !p.skip {
+			p.raw = append(p.raw, b...)
+		}
+		if limit > 0 && len(p.raw) > limit {
+			p.raw = p.raw[:0]
+			p.skip = true
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if p.skip {
+			p.skip = false
+			continue
+		}
+		enc := p.raw[:len(p.raw)-1]
+		p.raw = p.raw[:0]
+		if p.dbuf, err = cobsDecode(p.dbuf[:0], enc); err != nil {
+			continue
+		}
+		n := len(p.dbuf) - sumSize
+		if n < 1 || crc32.Checksum(p.dbuf[:n], crcTable) !=
+			binary.BigEndian.Uint32(p.dbuf[n:]) {
+			continue
+		}
+		return p.dbuf[0], p.dbuf[1:n], nil
+	}
+}
+
+// Send sends the message as a single packet.
+func (p *pipe) Send(msg *transport.Message) error {
+	p.slock.Lock()
+	defer p.slock.Unlock()
+	segs := append([][]byte{msg.Header, msg.Body}, msg.Bodies...)
+	if err := p.write(pktMessage, segs...); err != nil {
+		return err
+	}
+	msg.Free()
+	return nil
+}
+
+// Recv receives the next message.  A hello from a peer that has not
+// heard us means that it started over, and ends the pipe, as the end of
+// a connection would.
+func (p *pipe) Recv() (*transport.Message, error) {
+	for {
+		typ, b, err := p.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case pktHello:
+			if len(b) == hdrSize+1 && b[hdrSize] == 0 {
+				return nil, io.EOF
+			}
+		case pktMessage:
+			if p.maxrx > 0 && len(b) > p.maxrx {
+				continue
+			}
+			msg := mangos.NewMessage(len(b))
+			msg.Body = append(msg.Body, b...)
+			return msg, nil
+		}
+	}
+}
+
+func (p *pipe) Close() error {
+	p.once.Do(func() {
+		p.f.Close()
+		if p.closed != nil {
+			p.closed()
+		}
+	})
+	return nil
+}
+
+func (p *pipe) LocalProtocol() uint16 {
+	return p.proto.Self
+}
+
+func (p *pipe) RemoteProtocol() uint16 {
+	return p.proto.Peer
+}
+
+func (p *pipe) GetOption(n string) (interface{}, error) {
+	if v, ok := p.options[n]; ok {
+		return v, nil
+	}
+	return nil, mangos.ErrBadProperty
+}
+
+type dialer struct {
+	port *port
+	opts options
+}
+
+func (d *dialer) Dial() (transport.Pipe, error) {
+	p, err := openPipe(d.port, d.opts)
+	if err != nil {
+		return nil, err
+	}
+	wait := d.opts[mangos.OptionHandshakeTimeout].(time.Duration)
+	if wait == 0 {
+		wait = dialTimeout
+	}
+	if err = p.handshake(time.Now().Add(wait)); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (d *dialer) SetOption(n string, v interface{}) error {
+	return d.opts.set(n, v)
+}
+
+func (d *dialer) GetOption(n string) (interface{}, error) {
+	return d.opts.get(n)
+}
+
+// listener hands out a single pipe at a time, as there is only ever the
+// one peer.  Once that pipe is closed, the next Accept opens another.
+type listener struct {
+	port      *port
+	opts      options
+	listening bool
+	closed    bool
+	active    bool
+	pending   *pipe // saying hello
+	cv        *sync.Cond
+	sync.Mutex
+}
+
+func (l *listener) Listen() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return mangos.ErrClosed
+	}
+	l.listening = true
+	return nil
+}
+
+func (l *listener) Accept() (transport.Pipe, error) {
+	l.Lock()
+	for l.active && !l.closed {
+		l.cv.Wait()
+	}
+	if l.closed || !l.listening {
+		l.Unlock()
+		return nil, mangos.ErrClosed
+	}
+	p, err := openPipe(l.port, l.opts)
+	if err != nil {
+		l.Unlock()
+		// The device may be missing only until it is plugged in.
+		time.Sleep(retryTime)
+		return nil, err
+	}
+	l.active = true
+	l.pending = p
+	p.closed = func() {
+		l.Lock()
+		l.active = false
+		l.cv.Broadcast()
+		l.Unlock()
+	}
+	l.Unlock()
+
+	var deadline time.Time
+	if wait := l.opts[mangos.OptionHandshakeTimeout].(time.Duration); wait > 0 {
+		deadline = time.Now().Add(wait)
+	}
+	err = p.handshake(deadline)
+	l.Lock()
+	l.pending = nil
+	closed := l.closed
+	l.Unlock()
+	if err != nil || closed {
+		p.Close()
+		if closed {
+			err = mangos.ErrClosed
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// Close stops the listener, and also the pipe it may be waiting to say
+// hello on.
+func (l *listener) Close() error {
+	l.Lock()
+	l.closed = true
+	p := l.pending
+	l.cv.Broadcast()
+	l.Unlock()
+	if p != nil {
+		p.Close()
+	}
+	return nil
+}
+
+func (l *listener) SetOption(n string, v interface{}) error {
+	return l.opts.set(n, v)
+}
+
+func (l *listener) GetOption(n string) (interface{}, error) {
+	return l.opts.get(n)
+}
+
+func (l *listener) Address() string {
+	return "serial://" + l.port.path + "?baud=" + strconv.Itoa(l.port.baud)
+}
+
+type serialTran int
+
+func (serialTran) Scheme() string {
+	return "serial"
+}
+
+// resolve parses an address, such as "serial:///dev/ttyS0?baud=9600".
+func (t serialTran) resolve(a string, sock mangos.Socket) (*port, error) {
+	if !supported {
+		return nil, mangos.ErrBadTran
+	}
+	a, err := transport.StripScheme(t, a)
+	if err != nil {
+		return nil, err
+	}
+	pt := &port{baud: DefaultBaud, proto: sock.Info()}
+	pt.path = a
+	if i := strings.IndexByte(a, '?'); i >= 0 {
+		pt.path = a[:i]
+		q, err := url.ParseQuery(a[i+1:])
+		if err != nil {
+			return nil, mangos.ErrBadAddr
+		}
+		for k, v := range q {
+			if k != "baud" || len(v) != 1 {
+				return nil, mangos.ErrBadAddr
+			}
+			if pt.baud, err = strconv.Atoi(v[0]); err != nil ||
+				!validBaud(pt.baud) {
+				return nil, mangos.ErrBadAddr
+			}
+		}
+	}
+	if pt.path == "" {
+		return nil, mangos.ErrBadAddr
+	}
+	return pt, nil
+}
+
+func (t serialTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, error) {
+	pt, err := t.resolve(addr, sock)
+	if err != nil {
+		return nil, err
+	}
+	return &dialer{port: pt, opts: newOptions()}, nil
+}
+
+func (t serialTran) NewListener(addr string, sock mangos.Socket) (transport.Listener, error) {
+	pt, err := t.resolve(addr, sock)
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{port: pt, opts: newOptions()}
+	l.cv = sync.NewCond(l)
+	return l, nil
+}
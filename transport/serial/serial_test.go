@@ -0,0 +1,235 @@
+//go:build linux
+// +build linux
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serial
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	. "nanomsg.org/go/mangos/v2/test"
+)
+
+// wire stands in for a serial cable, joining two pseudo terminals, whose
+// device paths are ends.
+type wire struct {
+	ends    [2]string
+	masters [2]*os.File
+	slaves  [2]*os.File
+}
+
+func openPty(t *testing.T) (*os.File, string) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("no pseudo terminals: %v", err)
+	}
+	MustSucceed(t, unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0))
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	MustSucceed(t, err)
+	return os.NewFile(uintptr(fd), "ptmx"), fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func newWire(t *testing.T) *wire {
+	w := &wire{}
+	for i := range w.ends {
+		w.masters[i], w.ends[i] = openPty(t)
+		// Holding the far side open keeps the master from failing
+		// while no socket has the port open.
+		s, err := os.OpenFile(w.ends[i], os.O_RDWR|unix.O_NOCTTY, 0)
+		MustSucceed(t, err)
+		w.slaves[i] = s
+	}
+	go func() { _, _ = io.Copy(w.masters[0], w.masters[1]) }()
+	go func() { _, _ = io.Copy(w.masters[1], w.masters[0]) }()
+	return w
+}
+
+// inject sends bytes to whoever has end i open.
+func (w *wire) inject(t *testing.T, i int, b []byte) {
+	_, err := w.masters[i].Write(b)
+	MustSucceed(t, err)
+}
+
+func (w *wire) Close() {
+	for i := range w.ends {
+		w.masters[i].Close()
+		w.slaves[i].Close()
+	}
+}
+
+func pairOn(t *testing.T, addr string, listen bool) mangos.Socket {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, s.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	if listen {
+		MustSucceed(t, s.Listen(addr))
+	} else {
+		MustSucceed(t, s.DialOptions(addr, map[string]interface{}{
+			mangos.OptionDialAsynch: true,
+		}))
+	}
+	return s
+}
+
+func TestSerialCOBS(t *testing.T) {
+	long := bytes.Repeat([]byte{7}, 600)
+	for _, b := range [][]byte{
+		{}, {0}, {0, 0}, {1, 0, 2}, long[:253], long[:254], long[:255],
+		append(long, 0), append([]byte{0}, long...),
+	} {
+		enc := cobsEncode(nil, b)
+		MustBeTrue(t, bytes.IndexByte(enc, 0) == len(enc)-1)
+		MustBeTrue(t, len(enc) <= len(b)+len(b)/254+2)
+		dec, err := cobsDecode(nil, enc[:len(enc)-1])
+		MustSucceed(t, err)
+		MustBeTrue(t, bytes.Equal(dec, b))
+	}
+	_, err := cobsDecode(nil, []byte{5, 1})
+	MustBeTrue(t, err == mangos.ErrGarbled)
+}
+
+func TestSerialPair(t *testing.T) {
+	w := newWire(t)
+	defer w.Close()
+	a := pairOn(t, "serial://"+w.ends[0]+"?baud=9600", true)
+	defer a.Close()
+	b := pairOn(t, "serial://"+w.ends[1], false)
+	defer b.Close()
+
+	// Zeros, and long runs without them, exercise the stuffing.
+	big := make([]byte, 5000)
+	for i := range big {
+		big[i] = byte(i % 300)
+	}
+	MustSucceed(t, b.Send(big))
+	m, err := a.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(m.Body, big))
+	v, err := m.Pipe.GetOption(mangos.OptionRemoteAddr)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(fmt.Stringer).String() == w.ends[0])
+	m.Free()
+
+	MustSucceed(t, a.Send([]byte("back")))
+	got, err := b.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(got) == "back")
+}
+
+func TestSerialNoise(t *testing.T) {
+	w := newWire(t)
+	defer w.Close()
+	a := pairOn(t, "serial://"+w.ends[0], true)
+	defer a.Close()
+	b := pairOn(t, "serial://"+w.ends[1], false)
+	defer b.Close()
+	MustSucceed(t, b.Send([]byte("first")))
+	got, err := a.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(got) == "first")
+
+	// Garbage, a packet with a bad checksum, and a partial packet are
+	// all passed over.
+	w.inject(t, 0, []byte{0x13, 0x37, 0})
+	bad := cobsEncode(nil, []byte{pktMessage, 'x', 1, 2, 3, 4})
+	w.inject(t, 0, bad)
+	w.inject(t, 0, []byte{9, 'p', 'a'})
+	w.inject(t, 0, []byte{0})
+	MustSucceed(t, b.Send([]byte("second")))
+	got, err = a.Recv()
+	MustSucceed(t, err)
+	MustBeTrue(t, string(got) == "second")
+}
+
+func TestSerialRestart(t *testing.T) {
+	w := newWire(t)
+	defer w.Close()
+	srv, err := rep.NewSocket()
+	MustSucceed(t, err)
+	defer srv.Close()
+	MustSucceed(t, srv.Listen("serial://"+w.ends[0]))
+
+	for i := 0; i < 2; i++ {
+		cli, err := req.NewSocket()
+		MustSucceed(t, err)
+		MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+		MustSucceed(t, cli.Dial("serial://"+w.ends[1]))
+		go func() {
+			b, err := srv.Recv()
+			if err == nil {
+				_ = srv.Send(append(b, '!'))
+			}
+		}()
+		MustSucceed(t, cli.Send([]byte("ping")))
+		b, err := cli.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "ping!")
+		MustSucceed(t, cli.Close())
+	}
+}
+
+func TestSerialNoPeer(t *testing.T) {
+	w := newWire(t)
+	defer w.Close()
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	start := time.Now()
+	err = s.DialOptions("serial://"+w.ends[0], map[string]interface{}{
+		mangos.OptionHandshakeTimeout: time.Millisecond * 300,
+	})
+	MustBeTrue(t, err == mangos.ErrConnRefused)
+	MustBeTrue(t, time.Since(start) >= time.Millisecond*300)
+
+	// A listener can be closed while it waits for a peer.
+	MustSucceed(t, s.Listen("serial://"+w.ends[1]))
+	time.Sleep(time.Millisecond * 100)
+	MustSucceed(t, s.Close())
+}
+
+func TestSerialAddress(t *testing.T) {
+	s, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer s.Close()
+	for _, a := range []string{
+		"serial://",
+		"serial://?baud=9600",
+		"serial:///dev/ttyS0?baud=fast",
+		"serial:///dev/ttyS0?baud=12345",
+		"serial:///dev/ttyS0?parity=even",
+		"serial:///dev/ttyS0?baud=9600&baud=4800",
+	} {
+		_, err = s.NewDialer(a, nil)
+		MustBeTrue(t, err == mangos.ErrBadAddr)
+	}
+	l, err := s.NewListener("serial:///dev/ttyS0", nil)
+	MustSucceed(t, err)
+	MustBeTrue(t, l.Address() == "serial:///dev/ttyS0?baud=115200")
+
+	err = s.Dial("serial:///dev/no-such-port")
+	MustBeTrue(t, err == mangos.ErrConnRefused)
+}
@@ -0,0 +1,27 @@
+//go:build netbsd || openbsd
+// +build netbsd openbsd
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serial
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func setSpeed(t *unix.Termios, baud int) {
+	t.Ispeed = int32(baud)
+	t.Ospeed = int32(baud)
+}
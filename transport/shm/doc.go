@@ -0,0 +1,37 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shm implements a transport for processes on the same host,
+// passing messages through rings in shared memory rather than through
+// the kernel, for workloads where the cost of system calls on ipc or
+// tcp loopback connections dominates.  To enable it simply import it.
+//
+// Addresses name a UNIX domain socket, as ipc addresses do, as in
+// "shm:///tmp/feed.shm".  The socket is used only to meet: the dialer
+// makes two rings, one for each direction, and passes them to the
+// listener over it.  The files holding the rings are removed at once,
+// so that nothing is left behind however the processes end.
+//
+// The socket also carries the doorbells that wake a side waiting for
+// data, or for room to write.  A side that finds its ring empty (or
+// full) polls for a short while before it rings for them, so that a
+// busy link makes no system calls at all, while one that is idle
+// costs nothing.
+//
+// The size of each ring is set with OptionRingSize, on the dialer.
+// Messages larger than the ring are passed through it in pieces.
+//
+// Shared memory is supported on Linux, macOS and the BSDs.  Elsewhere
+// dialers and listeners cannot be made, failing with ErrBadTran.
+package shm
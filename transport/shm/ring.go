@@ -0,0 +1,120 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shm
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// A ring is laid out with a header of two cache lines, the first
+// written by the writer, and the second by the reader, followed by the
+// data.  Positions only ever grow, and are taken modulo the size of the
+// data, which is a power of two.
+const (
+	offHead     = 0   // uint64, bytes ever written
+	offReadWait = 8   // uint32, set by a reader waiting for data
+	offTail     = 64  // uint64, bytes ever read
+	offRoomWait = 72  // uint32, set by a writer waiting for room
+	ringHdr     = 128 // where the data starts
+)
+
+// ring is one direction of a pipe, in memory shared with the peer.
+type ring struct {
+	mem      []byte // the whole mapping
+	data     []byte
+	mask     uint64
+	head     *uint64
+	tail     *uint64
+	readWait *uint32
+	roomWait *uint32
+}
+
+// newRing lays out a ring over mem, which must be ringHdr bytes longer
+// than a power of two, and aligned as a mapping is.
+func newRing(mem []byte) *ring {
+	return &ring{
+		mem:      mem,
+		data:     mem[ringHdr:],
+		mask:     uint64(len(mem)-ringHdr) - 1,
+		head:     (*uint64)(unsafe.Pointer(&mem[offHead])),
+		tail:     (*uint64)(unsafe.Pointer(&mem[offTail])),
+		readWait: (*uint32)(unsafe.Pointer(&mem[offReadWait])),
+		roomWait: (*uint32)(unsafe.Pointer(&mem[offRoomWait])),
+	}
+}
+
+// put copies as much of b as there is room for, and returns how much
+// that was.  Only the writer calls this.
+func (r *ring) put(b []byte) int {
+	head := atomic.LoadUint64(r.head)
+	room := uint64(len(r.data)) - (head - atomic.LoadUint64(r.tail))
+	if room < uint64(len(b)) {
+		b = b[:room]
+	}
+	if len(b) == 0 {
+		return 0
+	}
+	n := copy(r.data[head&r.mask:], b)
+	copy(r.data, b[n:])
+	atomic.StoreUint64(r.head, head+uint64(len(b)))
+	return len(b)
+}
+
+// get copies as much into b as there is, and returns how much that was.
+// Only the reader calls this.
+func (r *ring) get(b []byte) int {
+	tail := atomic.LoadUint64(r.tail)
+	avail := atomic.LoadUint64(r.head) - tail
+	if avail < uint64(len(b)) {
+		b = b[:avail]
+	}
+	if len(b) == 0 {
+		return 0
+	}
+	n := copy(b, r.data[tail&r.mask:])
+	copy(b[n:], r.data)
+	atomic.StoreUint64(r.tail, tail+uint64(len(b)))
+	return len(b)
+}
+
+// empty and full are checked by a side about to wait, after it has set
+// its flag, so that what the other side did meanwhile is not missed.
+func (r *ring) empty() bool {
+	return atomic.LoadUint64(r.head) == atomic.LoadUint64(r.tail)
+}
+
+func (r *ring) full() bool {
+	return atomic.LoadUint64(r.head)-atomic.LoadUint64(r.tail) ==
+		uint64(len(r.data))
+}
+
+// wanted clears a flag, returning true if it was set, in which case the
+// caller must ring the doorbell for it.
+func wanted(flag *uint32) bool {
+	return atomic.LoadUint32(flag) != 0 &&
+		atomic.CompareAndSwapUint32(flag, 1, 0)
+}
+
+// want sets a flag, before waiting.
+func want(flag *uint32) {
+	atomic.StoreUint32(flag, 1)
+}
+
+// unwant clears a flag that turned out not to be needed.  If the other
+// side cleared it first, a doorbell is on its way, and does no harm.
+func unwant(flag *uint32) {
+	atomic.CompareAndSwapUint32(flag, 1, 0)
+}
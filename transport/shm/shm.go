@@ -0,0 +1,107 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shm
+
+import (
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// Transport is a transport.Transport for shared memory.
+const Transport = shmTran(0)
+
+// OptionRingSize is the size in bytes of each of the two rings of a
+// pipe.  The value is an int, a power of two from MinRingSize to
+// MaxRingSize.  It is set on the dialer, which makes the rings; on a
+// listener it has no effect.  On a Pipe, it reports the size used.
+const OptionRingSize = "SHM-RING-SIZE"
+
+// Limits on OptionRingSize, and its default.
+const (
+	MinRingSize     = 4096
+	MaxRingSize     = 1 << 30
+	DefaultRingSize = 1 << 20
+)
+
+// handshakeTime limits the time a new connection has to pass its rings.
+const handshakeTime = time.Second * 10
+
+func init() {
+	transport.RegisterTransport(Transport)
+}
+
+type options map[string]interface{}
+
+func (o options) get(name string) (interface{}, error) {
+	v, ok := o[name]
+	if !ok {
+		return nil, mangos.ErrBadOption
+	}
+	return v, nil
+}
+
+func (o options) set(name string, val interface{}) error {
+	switch name {
+	case mangos.OptionMaxRecvSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case OptionRingSize:
+		if v, ok := val.(int); ok && validRingSize(uint64(v)) {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+	return mangos.ErrBadOption
+}
+
+func newOptions() options {
+	o := make(map[string]interface{})
+	o[mangos.OptionMaxRecvSize] = 0
+	o[OptionRingSize] = DefaultRingSize
+	return options(o)
+}
+
+func validRingSize(n uint64) bool {
+	return n >= MinRingSize && n <= MaxRingSize && n&(n-1) == 0
+}
+
+type shmTran int
+
+func (shmTran) Scheme() string {
+	return "shm"
+}
+
+func (t shmTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, error) {
+	addr, err := transport.StripScheme(t, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newDialer(addr, sock.Info())
+}
+
+func (t shmTran) NewListener(addr string, sock mangos.Socket) (transport.Listener, error) {
+	addr, err := transport.StripScheme(t, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newListener(addr, sock.Info())
+}
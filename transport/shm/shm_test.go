@@ -0,0 +1,154 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shm
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	. "nanomsg.org/go/mangos/v2/test"
+)
+
+var tt = NewTranTest(Transport, AddrTestSHM())
+
+func TestShmAll(t *testing.T) {
+	tt.TestAll(t)
+}
+
+func shmPair(t *testing.T, ring int) (mangos.Socket, mangos.Socket) {
+	addr := AddrTestSHM()
+	srv, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, srv.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, srv.Listen(addr))
+	cli, err := pair.NewSocket()
+	MustSucceed(t, err)
+	MustSucceed(t, cli.SetOption(mangos.OptionRecvDeadline, time.Second*5))
+	MustSucceed(t, cli.DialOptions(addr, map[string]interface{}{
+		OptionRingSize: ring,
+	}))
+	return srv, cli
+}
+
+func TestShmOptions(t *testing.T) {
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+	d, err := sock.NewDialer(AddrTestSHM(), nil)
+	MustSucceed(t, err)
+	v, err := d.GetOption(OptionRingSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == DefaultRingSize)
+	for _, bad := range []interface{}{"big", 1024, 5000, MaxRingSize * 2} {
+		MustBeTrue(t, d.SetOption(OptionRingSize, bad) == mangos.ErrBadValue)
+	}
+	MustSucceed(t, d.SetOption(OptionRingSize, MinRingSize))
+}
+
+// TestShmLarge sends messages larger than the ring, which pass through
+// it in pieces, and many small ones, that wrap around it.
+func TestShmLarge(t *testing.T) {
+	srv, cli := shmPair(t, MinRingSize)
+	defer srv.Close()
+	defer cli.Close()
+
+	big := make([]byte, 100000)
+	rand.Read(big)
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, big[:7]...)
+	m.Bodies = [][]byte{big[7:50000], big[50000:]}
+	MustSucceed(t, cli.SendMsg(m))
+	m, err := srv.RecvMsg()
+	MustSucceed(t, err)
+	MustBeTrue(t, bytes.Equal(m.Body, big))
+	v, err := m.Pipe.GetOption(OptionRingSize)
+	MustSucceed(t, err)
+	MustBeTrue(t, v.(int) == MinRingSize)
+	m.Free()
+
+	go func() {
+		for i := 0; i < 2000; i++ {
+			b := big[:i%300]
+			if err := srv.Send(b); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		b, err := cli.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, bytes.Equal(b, big[:i%300]))
+	}
+}
+
+// TestShmIdle checks that a side that has waited long enough to ring
+// for the peer is woken.
+func TestShmIdle(t *testing.T) {
+	srv, cli := shmPair(t, MinRingSize)
+	defer srv.Close()
+	defer cli.Close()
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond * 50)
+		MustSucceed(t, cli.Send([]byte("wake")))
+		b, err := srv.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, string(b) == "wake")
+	}
+}
+
+// TestShmHangup checks that what was sent before the peer went away
+// is still received, and that the pipe then fails.
+func TestShmHangup(t *testing.T) {
+	addr := AddrTestSHM()
+	sock, err := pair.NewSocket()
+	MustSucceed(t, err)
+	defer sock.Close()
+	l, err := Transport.NewListener(addr, sock)
+	MustSucceed(t, err)
+	defer l.Close()
+	MustSucceed(t, l.Listen())
+	d, err := Transport.NewDialer(addr, sock)
+	MustSucceed(t, err)
+
+	cli, err := d.Dial()
+	MustSucceed(t, err)
+	srv, err := l.Accept()
+	MustSucceed(t, err)
+	defer srv.Close()
+	for i := 0; i < 5; i++ {
+		m := mangos.NewMessage(1)
+		m.Body = append(m.Body, byte(i))
+		MustSucceed(t, cli.Send(m))
+	}
+	MustSucceed(t, cli.Close())
+	for i := 0; i < 5; i++ {
+		m, err := srv.Recv()
+		MustSucceed(t, err)
+		MustBeTrue(t, len(m.Body) == 1 && int(m.Body[0]) == i)
+		m.Free()
+	}
+	_, err = srv.Recv()
+	MustBeTrue(t, err == io.EOF)
+	m := mangos.NewMessage(0)
+	MustFail(t, srv.Send(m))
+}
@@ -0,0 +1,602 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shm
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/transport"
+)
+
+// Doorbells, sent over the socket to wake the peer.
+var (
+	dataBell = []byte{'d'} // there is data in the ring you read
+	roomBell = []byte{'r'} // there is room in the ring you write
+)
+
+// spins is how many times a side looks again at a ring that is empty
+// (or full), yielding in between, before it rings for the peer.
+const spins = 100
+
+// recvChunk is the most allocated for a message before its data arrives,
+// so that a peer cannot have us allocate memory by merely claiming to
+// send a lot.
+const recvChunk = 1 << 20
+
+// pipe is a shared memory pipe.
+type pipe struct {
+	c       *net.UnixConn
+	proto   transport.ProtocolInfo
+	tx      *ring
+	rx      *ring
+	maxrx   int
+	options map[string]interface{}
+	dataq   chan struct{} // rung when there is data in rx
+	roomq   chan struct{} // rung when there is room in tx
+	goneq   chan struct{} // closed when the peer hangs up
+	closeq  chan struct{}
+	once    sync.Once
+
+	// Held for reading while the rings are used, so that they are
+	// not unmapped from under a sender or receiver.
+	mlock sync.RWMutex
+
+	slock sync.Mutex
+	shdr  [8]byte
+	rhdr  [8]byte
+}
+
+func newPipe(c *net.UnixConn, proto transport.ProtocolInfo, tx, rx []byte, o options) *pipe {
+	p := &pipe{
+		c:       c,
+		proto:   proto,
+		tx:      newRing(tx),
+		rx:      newRing(rx),
+		maxrx:   o[mangos.OptionMaxRecvSize].(int),
+		options: make(map[string]interface{}),
+		dataq:   make(chan struct{}, 1),
+		roomq:   make(chan struct{}, 1),
+		goneq:   make(chan struct{}),
+		closeq:  make(chan struct{}),
+	}
+	for n, v := range o {
+		p.options[n] = v
+	}
+	p.options[OptionRingSize] = len(tx) - ringHdr
+	p.options[mangos.OptionLocalAddr] = c.LocalAddr()
+	p.options[mangos.OptionRemoteAddr] = c.RemoteAddr()
+	go p.doorbells()
+	return p
+}
+
+// doorbells answers the peer's doorbells, until it hangs up.
+func (p *pipe) doorbells() {
+	var b [64]byte
+	for {
+		n, err := p.c.Read(b[:])
+		if err != nil {
+			close(p.goneq)
+			return
+		}
+		for _, x := range b[:n] {
+			switch x {
+			case dataBell[0]:
+				signal(p.dataq)
+			case roomBell[0]:
+				signal(p.roomq)
+			}
+		}
+	}
+}
+
+func signal(q chan struct{}) {
+	select {
+	case q <- struct{}{}:
+	default:
+	}
+}
+
+// ring rings a doorbell.  Should that fail, the peer is gone, which the
+// doorbells goroutine finds out.
+func (p *pipe) ring(bell []byte) {
+	_, _ = p.c.Write(bell)
+}
+
+// write puts all of b in the ring we write, waiting for room as needed.
+// The caller must hold slock, and mlock for reading.
+func (p *pipe) write(b []byte) error {
+	spin := 0
+	for len(b) > 0 {
+		if n := p.tx.put(b); n > 0 {
+			b = b[n:]
+			spin = 0
+			if wanted(p.tx.readWait) {
+				p.ring(dataBell)
+			}
+			continue
+		}
+		if spin < spins {
+			spin++
+			runtime.Gosched()
+			continue
+		}
+		want(p.tx.roomWait)
+		if !p.tx.full() {
+			unwant(p.tx.roomWait)
+			continue
+		}
+		select {
+		case <-p.roomq:
+		case <-p.goneq:
+			return io.EOF
+		case <-p.closeq:
+			return mangos.ErrClosed
+		}
+	}
+	return nil
+}
+
+// read fills b from the ring we read, waiting for data as needed.
+// Data the peer wrote before hanging up is still read.  There is only
+// ever one reader, which must hold mlock for reading.
+func (p *pipe) read(b []byte) error {
+	spin := 0
+	for len(b) > 0 {
+		if n := p.rx.get(b); n > 0 {
+			b = b[n:]
+			spin = 0
+			if wanted(p.rx.roomWait) {
+				p.ring(roomBell)
+			}
+			continue
+		}
+		if spin < spins {
+			spin++
+			runtime.Gosched()
+			continue
+		}
+		want(p.rx.readWait)
+		if !p.rx.empty() {
+			unwant(p.rx.readWait)
+			continue
+		}
+		select {
+		case <-p.dataq:
+		case <-p.goneq:
+			if p.rx.empty() {
+				return io.EOF
+			}
+		case <-p.closeq:
+			return mangos.ErrClosed
+		}
+	}
+	return nil
+}
+
+func (p *pipe) isClosed() bool {
+	select {
+	case <-p.closeq:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send writes the message to the ring, as a 64-bit size (network byte
+// order) followed by the message itself.
+func (p *pipe) Send(msg *transport.Message) error {
+	p.mlock.RLock()
+	defer p.mlock.RUnlock()
+	p.slock.Lock()
+	defer p.slock.Unlock()
+	if p.isClosed() {
+		return mangos.ErrClosed
+	}
+	select {
+	case <-p.goneq:
+		// There is nobody to read it.
+		return io.EOF
+	default:
+	}
+	binary.BigEndian.PutUint64(p.shdr[:], uint64(len(msg.Header)+msg.BodyLen()))
+	segs := append([][]byte{p.shdr[:], msg.Header, msg.Body}, msg.Bodies...)
+	for _, b := range segs {
+		if err := p.write(b); err != nil {
+			return err
+		}
+	}
+	msg.Free()
+	return nil
+}
+
+// Recv reads the next message from the ring.
+func (p *pipe) Recv() (*transport.Message, error) {
+	p.mlock.RLock()
+	defer p.mlock.RUnlock()
+	if p.isClosed() {
+		return nil, mangos.ErrClosed
+	}
+	if err := p.read(p.rhdr[:]); err != nil {
+		return nil, err
+	}
+	sz := binary.BigEndian.Uint64(p.rhdr[:])
+	if (p.maxrx > 0 && sz > uint64(p.maxrx)) || sz > uint64(^uint(0)>>1) {
+		return nil, mangos.ErrTooLong
+	}
+	n := int(sz)
+	if n > recvChunk {
+		n = recvChunk
+	}
+	msg := mangos.NewMessage(n)
+	for uint64(len(msg.Body)) < sz {
+		n := sz - uint64(len(msg.Body))
+		if n > recvChunk {
+			n = recvChunk
+		}
+		start := len(msg.Body)
+		if uint64(cap(msg.Body)-start) >= n {
+			msg.Body = msg.Body[:start+int(n)]
+		} else {
+			msg.Body = append(msg.Body, make([]byte, n)...)
+		}
+		if err := p.read(msg.Body[start:]); err != nil {
+			msg.Free()
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// Close hangs up, and once the rings are no longer in use, unmaps them.
+func (p *pipe) Close() error {
+	p.once.Do(func() {
+		close(p.closeq)
+		p.c.Close()
+		p.mlock.Lock()
+		_ = unix.Munmap(p.tx.mem)
+		_ = unix.Munmap(p.rx.mem)
+		p.mlock.Unlock()
+	})
+	return nil
+}
+
+func (p *pipe) LocalProtocol() uint16 {
+	return p.proto.Self
+}
+
+func (p *pipe) RemoteProtocol() uint16 {
+	return p.proto.Peer
+}
+
+func (p *pipe) GetOption(n string) (interface{}, error) {
+	if v, ok := p.options[n]; ok {
+		return v, nil
+	}
+	return nil, mangos.ErrBadProperty
+}
+
+// shmDir is where the files holding rings are made, preferring a file
+// system in memory, where there is one.
+func shmDir() string {
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// makeRing makes the file for a ring, and maps it.  The file is removed
+// at once, and is only reachable by the descriptor returned.
+func makeRing(size int) ([]byte, *os.File, error) {
+	f, err := os.CreateTemp(shmDir(), "mangos-shm-")
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = os.Remove(f.Name())
+	if err = f.Truncate(int64(ringHdr + size)); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	mem, err := mapRing(int(f.Fd()), size)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return mem, f, nil
+}
+
+// mapRing maps a ring passed by the peer, which must be large enough, as
+// touching memory past the end of a file is fatal.
+func mapRing(fd int, size int) ([]byte, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil, err
+	}
+	if st.Size < int64(ringHdr+size) {
+		return nil, mangos.ErrBadHeader
+	}
+	return unix.Mmap(fd, 0, ringHdr+size,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+// header returns our SP header, followed by room for the ring size.
+func header(proto transport.ProtocolInfo) []byte {
+	h := []byte{0, 'S', 'P', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(h[4:], proto.Self)
+	return h
+}
+
+// checkHeader validates the peer's SP header.
+func checkHeader(h []byte, proto transport.ProtocolInfo) error {
+	if h[0] != 0 || h[1] != 'S' || h[2] != 'P' {
+		return mangos.ErrBadHeader
+	}
+	if h[3] != 0 {
+		return mangos.ErrBadVersion
+	}
+	if peer := binary.BigEndian.Uint16(h[4:]); peer != proto.Peer {
+		return &mangos.ProtocolError{
+			Self: proto.Self,
+			Peer: proto.Peer,
+			Got:  peer,
+		}
+	}
+	return nil
+}
+
+type dialer struct {
+	addr  *net.UnixAddr
+	proto transport.ProtocolInfo
+	opts  options
+}
+
+func newDialer(addr string, proto transport.ProtocolInfo) (transport.Dialer, error) {
+	a, err := net.ResolveUnixAddr("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dialer{addr: a, proto: proto, opts: newOptions()}, nil
+}
+
+// Dial connects, and passes the listener the rings, ours to write
+// first, with our header and their size.
+func (d *dialer) Dial() (transport.Pipe, error) {
+	c, err := net.DialUnix("unix", nil, d.addr)
+	if err != nil {
+		return nil, err
+	}
+	size := d.opts[OptionRingSize].(int)
+	tx, txf, err := makeRing(size)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	defer txf.Close()
+	rx, rxf, err := makeRing(size)
+	if err != nil {
+		_ = unix.Munmap(tx)
+		c.Close()
+		return nil, err
+	}
+	defer rxf.Close()
+
+	if err = d.handshake(c, txf, rxf); err != nil {
+		_ = unix.Munmap(tx)
+		_ = unix.Munmap(rx)
+		c.Close()
+		return nil, err
+	}
+	return newPipe(c, d.proto, tx, rx, d.opts), nil
+}
+
+func (d *dialer) handshake(c *net.UnixConn, tx, rx *os.File) error {
+	_ = c.SetDeadline(time.Now().Add(handshakeTime))
+	h := header(d.proto)
+	binary.BigEndian.PutUint64(h[8:], uint64(d.opts[OptionRingSize].(int)))
+	rights := syscall.UnixRights(int(tx.Fd()), int(rx.Fd()))
+	if _, _, err := c.WriteMsgUnix(h, rights, nil); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, h[:8]); err != nil {
+		return err
+	}
+	if err := checkHeader(h, d.proto); err != nil {
+		return err
+	}
+	return c.SetDeadline(time.Time{})
+}
+
+func (d *dialer) SetOption(n string, v interface{}) error {
+	return d.opts.set(n, v)
+}
+
+func (d *dialer) GetOption(n string) (interface{}, error) {
+	return d.opts.get(n)
+}
+
+type listener struct {
+	addr   *net.UnixAddr
+	proto  transport.ProtocolInfo
+	opts   options
+	ul     *net.UnixListener
+	pipeq  chan *pipe
+	closeq chan struct{}
+	once   sync.Once
+}
+
+func newListener(addr string, proto transport.ProtocolInfo) (transport.Listener, error) {
+	a, err := net.ResolveUnixAddr("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{
+		addr:   a,
+		proto:  proto,
+		opts:   newOptions(),
+		pipeq:  make(chan *pipe),
+		closeq: make(chan struct{}),
+	}
+	return l, nil
+}
+
+func (l *listener) Listen() error {
+	ul, err := net.ListenUnix("unix", l.addr)
+	if err != nil {
+		return err
+	}
+	l.ul = ul
+	go l.serve()
+	return nil
+}
+
+func (l *listener) serve() {
+	for {
+		c, err := l.ul.AcceptUnix()
+		if err != nil {
+			select {
+			case <-l.closeq:
+				return
+			default:
+				continue
+			}
+		}
+		go l.admit(c)
+	}
+}
+
+// admit takes the rings from a new connection, and hands the pipe over
+// to Accept.
+func (l *listener) admit(c *net.UnixConn) {
+	tx, rx, err := l.handshake(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+	p := newPipe(c, l.proto, tx, rx, l.opts)
+	select {
+	case l.pipeq <- p:
+	case <-l.closeq:
+		p.Close()
+	}
+}
+
+func (l *listener) handshake(c *net.UnixConn) ([]byte, []byte, error) {
+	_ = c.SetDeadline(time.Now().Add(handshakeTime))
+	h := make([]byte, 16)
+	oob := make([]byte, syscall.CmsgSpace(2*4))
+	n, oobn, _, _, err := c.ReadMsgUnix(h, oob)
+	var fds []int
+	if err == nil {
+		fds, err = parseRights(oob[:oobn])
+	}
+	defer func() {
+		for _, fd := range fds {
+			_ = unix.Close(fd)
+		}
+	}()
+	if err == nil && n < len(h) {
+		_, err = io.ReadFull(c, h[n:])
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	size := binary.BigEndian.Uint64(h[8:])
+	if len(fds) != 2 || !validRingSize(size) {
+		return nil, nil, mangos.ErrBadHeader
+	}
+	rx, err := mapRing(fds[0], int(size))
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := mapRing(fds[1], int(size))
+	if err != nil {
+		_ = unix.Munmap(rx)
+		return nil, nil, err
+	}
+	if err = checkHeader(h, l.proto); err == nil {
+		_, err = c.Write(header(l.proto)[:8])
+	} else {
+		// Tell the dialer who we are, so that it knows why.
+		_, _ = c.Write(header(l.proto)[:8])
+	}
+	if err == nil {
+		err = c.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = unix.Munmap(rx)
+		_ = unix.Munmap(tx)
+		return nil, nil, err
+	}
+	return tx, rx, nil
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		f, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, f...)
+	}
+	return fds, nil
+}
+
+func (l *listener) Accept() (transport.Pipe, error) {
+	select {
+	case p := <-l.pipeq:
+		return p, nil
+	case <-l.closeq:
+		return nil, mangos.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.closeq)
+		if l.ul != nil {
+			l.ul.Close()
+		}
+	})
+	return nil
+}
+
+func (l *listener) SetOption(n string, v interface{}) error {
+	return l.opts.set(n, v)
+}
+
+func (l *listener) GetOption(n string) (interface{}, error) {
+	return l.opts.get(n)
+}
+
+func (l *listener) Address() string {
+	return "shm://" + l.addr.String()
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// ParseTCPOption checks a value for one of the TCP options that tune
+// the connection itself, such as mangos.OptionKeepAliveTime, which are
+// common to the transports over TCP.  It returns mangos.ErrBadOption for
+// other options, and mangos.ErrUnsupported for an option that cannot
+// be set on this platform, so that it is refused rather than ignored.
+func ParseTCPOption(name string, v interface{}) error {
+	ok := false
+	switch name {
+	case mangos.OptionNoDelay, mangos.OptionKeepAlive:
+		_, ok = v.(bool)
+	case mangos.OptionKeepAliveTime:
+		d, isDur := v.(time.Duration)
+		ok = isDur && d > 0
+	case mangos.OptionKeepAliveInterval:
+		d, isDur := v.(time.Duration)
+		ok = isDur && d >= 0
+	case mangos.OptionKeepAliveCount, mangos.OptionSendBufferSize,
+		mangos.OptionRecvBufferSize:
+		n, isInt := v.(int)
+		ok = isInt && n >= 0
+	default:
+		return mangos.ErrBadOption
+	}
+	if !ok {
+		return mangos.ErrBadValue
+	}
+	if !tcpOptionSupported(name) {
+		return mangos.ErrUnsupported
+	}
+	return nil
+}
+
+// ConfigTCP applies the TCP options in opts to a new connection.
+func ConfigTCP(c *net.TCPConn, opts map[string]interface{}) error {
+	if v, ok := opts[mangos.OptionNoDelay].(bool); ok {
+		if err := c.SetNoDelay(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := opts[mangos.OptionBusyPoll].(time.Duration); ok && v > 0 {
+		if err := c.SetNoDelay(true); err != nil {
+			return err
+		}
+	}
+	if err := c.SetKeepAliveConfig(keepAliveConfig(opts)); err != nil {
+		return err
+	}
+	return ConfigBuffers(c, opts)
+}
+
+// ConfigBuffers applies mangos.OptionSendBufferSize and
+// mangos.OptionRecvBufferSize to a new connection, if it has kernel
+// buffers to size, as TCP and UNIX domain sockets do.
+func ConfigBuffers(c net.Conn, opts map[string]interface{}) error {
+	bc, ok := c.(bufferConn)
+	if !ok {
+		return nil
+	}
+	if v, ok := opts[mangos.OptionSendBufferSize].(int); ok && v > 0 {
+		if err := bc.SetWriteBuffer(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := opts[mangos.OptionRecvBufferSize].(int); ok && v > 0 {
+		if err := bc.SetReadBuffer(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bufferConn is a connection with kernel buffers, such as *net.TCPConn
+// and *net.UnixConn.
+type bufferConn interface {
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}
+
+// keepAliveConfig returns the keep-alive settings in opts.  Those not
+// given are left as they are, which is the OS default for a new
+// connection.
+func keepAliveConfig(opts map[string]interface{}) net.KeepAliveConfig {
+	ka := net.KeepAliveConfig{Enable: true, Idle: -1, Interval: -1, Count: -1}
+	if v, ok := opts[mangos.OptionKeepAlive].(bool); ok {
+		ka.Enable = v
+	}
+	if v, ok := opts[mangos.OptionKeepAliveTime].(time.Duration); ok && v > 0 {
+		ka.Idle = v
+		ka.Interval = v
+	}
+	if v, ok := opts[mangos.OptionKeepAliveInterval].(time.Duration); ok && v > 0 {
+		ka.Interval = v
+	}
+	if v, ok := opts[mangos.OptionKeepAliveCount].(int); ok && v > 0 {
+		ka.Count = v
+	}
+	return ka
+}
+
+// setConnOption applies one of the TCP options to a live connection,
+// given all of its options, including the one changed.
+func setConnOption(c net.Conn, n string, opts map[string]interface{}) error {
+	switch n {
+	case mangos.OptionSendBufferSize, mangos.OptionRecvBufferSize:
+		// The OS default cannot be restored once changed, so zero
+		// leaves the buffer as it is.
+		if _, ok := c.(bufferConn); !ok {
+			return mangos.ErrBadOption
+		}
+		return ConfigBuffers(c, map[string]interface{}{n: opts[n]})
+	}
+	tc := tcpConn(c)
+	if tc == nil {
+		return mangos.ErrBadOption
+	}
+	switch n {
+	case mangos.OptionNoDelay:
+		return tc.SetNoDelay(opts[n].(bool))
+	case mangos.OptionBusyPoll:
+		if opts[n].(time.Duration) == 0 {
+			// Nagle stays off; OptionNoDelay restores it.
+			return nil
+		}
+		return tc.SetNoDelay(true)
+	case mangos.OptionKeepAlive, mangos.OptionKeepAliveTime,
+		mangos.OptionKeepAliveInterval, mangos.OptionKeepAliveCount:
+		return tc.SetKeepAliveConfig(keepAliveConfig(opts))
+	}
+	return mangos.ErrBadOption
+}
+
+// tcpConn returns the TCP connection beneath c, looking through
+// wrappers such as TLS, or nil if there is none.
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import "nanomsg.org/go/mangos/v2"
+
+// tcpOptionSupported reports whether a TCP option can be set.  OpenBSD
+// has no per-connection keep-alive timing, only system-wide settings.
+func tcpOptionSupported(name string) bool {
+	switch name {
+	case mangos.OptionKeepAliveTime, mangos.OptionKeepAliveInterval,
+		mangos.OptionKeepAliveCount:
+		return false
+	}
+	return true
+}
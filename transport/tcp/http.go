@@ -0,0 +1,131 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tcp
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sniffTime is how long we wait for a new connection to send its first
+// byte, when we need to see it to know what sort of connection it is.
+const sniffTime = time.Second * 10
+
+// spHeaderSize is the size of the header that starts an SP connection.
+const spHeaderSize = 8
+
+// sniffedConn is a connection that we have already read from.  It
+// embeds only net.Conn, so that io.Copy and the like cannot get past
+// Read to the underlying connection (by way of WriteTo).
+type sniffedConn struct {
+	net.Conn
+	first []byte
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if len(c.first) > 0 && len(b) > 0 {
+		n := copy(b, c.first)
+		c.first = c.first[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// NetConn returns the underlying connection, so that TCP options can
+// still be changed on the pipe.
+func (c *sniffedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// sniff reads the start of a connection.  Every SP connection starts
+// with a header that begins with a zero byte, which no HTTP request
+// does.  For SP, the whole header is read, so that the peer's protocol
+// is known; otherwise just the one byte.  The connection is returned
+// with what was read put back.
+func sniff(conn *net.TCPConn) (net.Conn, []byte, error) {
+	b := make([]byte, spHeaderSize)
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTime))
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return nil, nil, err
+	}
+	if b[0] == 0 {
+		if _, err := io.ReadFull(conn, b[1:]); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		b = b[:1]
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return &sniffedConn{Conn: conn, first: b}, b, nil
+}
+
+// httpServer serves the HTTP connections arriving on a listener.  It
+// is fed connections one at a time, by way of a net.Listener of its own.
+type httpServer struct {
+	srv    *http.Server
+	addr   net.Addr
+	connq  chan net.Conn
+	closeq chan struct{}
+	once   sync.Once
+}
+
+func newHTTPServer(h http.Handler, addr net.Addr) *httpServer {
+	s := &httpServer{
+		srv:    &http.Server{Handler: h},
+		addr:   addr,
+		connq:  make(chan net.Conn),
+		closeq: make(chan struct{}),
+	}
+	go s.srv.Serve(s)
+	return s
+}
+
+// serve hands a connection to the HTTP server.
+func (s *httpServer) serve(conn net.Conn) {
+	select {
+	case s.connq <- conn:
+	case <-s.closeq:
+		conn.Close()
+	}
+}
+
+// Accept implements net.Listener for http.Server.
+func (s *httpServer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.connq:
+		return conn, nil
+	case <-s.closeq:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener.  It only stops new connections.
+func (s *httpServer) Close() error {
+	s.once.Do(func() { close(s.closeq) })
+	return nil
+}
+
+// Addr implements net.Listener.
+func (s *httpServer) Addr() net.Addr {
+	return s.addr
+}
+
+// shutdown stops the server, closing any connections it has.
+func (s *httpServer) shutdown() {
+	s.Close()
+	s.srv.Close()
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// port is a TCP listening socket, shared by all the listeners in this
+// process that listen on the same address.  Each of them accepts peers
+// of a different protocol, and new connections are handed to the one
+// that accepts the protocol number in the peer's SP header.
+type port struct {
+	key      string
+	listener *net.TCPListener
+	members  map[uint16]*listener // by the protocol of peers accepted
+	http     *httpServer
+	closeq   chan struct{}
+	sync.Mutex
+}
+
+var ports = struct {
+	m map[string]*port
+	sync.Mutex
+}{m: make(map[string]*port)}
+
+// join adds l to the port for its address, listening on the address
+// first if nobody is yet.  An address with port zero always gets a new
+// port, whose actual address others may then share.
+func join(network string, l *listener) error {
+	ports.Lock()
+	defer ports.Unlock()
+
+	if l.addr.Port != 0 {
+		if p, ok := ports.m[network+"://"+l.addr.String()]; ok {
+			return p.add(l)
+		}
+	}
+	tl, err := net.ListenTCP(network, l.addr)
+	if err != nil {
+		return err
+	}
+	p := &port{
+		key:      network + "://" + tl.Addr().String(),
+		listener: tl,
+		members:  make(map[uint16]*listener),
+		closeq:   make(chan struct{}),
+	}
+	if err = p.add(l); err != nil {
+		tl.Close()
+		return err
+	}
+	ports.m[p.key] = p
+	go p.serve()
+	return nil
+}
+
+// add makes l a member.  There can only be one member for each peer
+// protocol, and only one of them may have an HTTP handler.
+func (p *port) add(l *listener) error {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.members[l.proto.Peer]; ok {
+		return mangos.ErrAddrInUse
+	}
+	if l.handler != nil {
+		if p.http != nil {
+			return mangos.ErrAddrInUse
+		}
+		p.http = newHTTPServer(l.handler, p.listener.Addr())
+	}
+	p.members[l.proto.Peer] = l
+	l.port = p
+	l.bound = p.listener.Addr()
+	return nil
+}
+
+// leave removes l, and stops listening when it was the last member.
+func (p *port) leave(l *listener) {
+	ports.Lock()
+	defer ports.Unlock()
+	p.Lock()
+	defer p.Unlock()
+	if p.members[l.proto.Peer] != l {
+		return
+	}
+	delete(p.members, l.proto.Peer)
+	if l.handler != nil && p.http != nil {
+		p.http.shutdown()
+		p.http = nil
+	}
+	if len(p.members) == 0 {
+		delete(ports.m, p.key)
+		close(p.closeq)
+		p.listener.Close()
+	}
+}
+
+func (p *port) serve() {
+	for {
+		conn, err := p.listener.AcceptTCP()
+		if err != nil {
+			select {
+			case <-p.closeq:
+				return
+			default:
+				continue
+			}
+		}
+		p.Lock()
+		var only *listener
+		if len(p.members) == 1 && p.http == nil {
+			for _, l := range p.members {
+				only = l
+			}
+		}
+		p.Unlock()
+		if only == nil {
+			// Sniffing waits for the peer, so not here.
+			go p.route(conn)
+			continue
+		}
+		if err = only.opts.configTCP(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		only.start(conn)
+	}
+}
+
+// route sends a new connection to the member for the peer's protocol,
+// or to the HTTP server if it is not SP at all.
+func (p *port) route(tc *net.TCPConn) {
+	conn, hdr, err := sniff(tc)
+	if err != nil {
+		tc.Close()
+		return
+	}
+	p.Lock()
+	h := p.http
+	var l *listener
+	if len(hdr) == spHeaderSize {
+		l = p.members[binary.BigEndian.Uint16(hdr[4:])]
+	}
+	p.Unlock()
+
+	switch {
+	case hdr[0] != 0 && h != nil:
+		h.serve(conn)
+	case l == nil:
+		tc.Close()
+	default:
+		if err = l.opts.configTCP(tc); err != nil {
+			tc.Close()
+			return
+		}
+		l.start(conn)
+	}
+}
@@ -13,11 +13,19 @@
 // limitations under the License.
 
 // Package tcp implements the TCP transport for mangos. To enable it simply
-// import it.
+// import it.  Besides tcp://, it registers the tcp4:// and tcp6:// schemes,
+// which are limited to IPv4 and IPv6 respectively.
+//
+// Sockets of different protocols in one process may listen on the same
+// address, for example a REP socket and a PUB socket, where only one
+// port can be opened.  Each new connection goes to the socket that
+// accepts the protocol the peer names in its SP header.  Sockets whose
+// peers use the same protocol cannot share an address.
 package tcp
 
 import (
 	"net"
+	"net/http"
 	"time"
 
 	"nanomsg.org/go/mangos/v2"
@@ -27,10 +35,32 @@ import (
 const (
 	// Transport is a transport.Transport for TCP.
 	Transport = tcpTran(0)
+
+	// Transport4 is the TCP transport for the "tcp4" scheme, which
+	// uses only IPv4.
+	Transport4 = tcpTran(4)
+
+	// Transport6 is the TCP transport for the "tcp6" scheme, which
+	// uses only IPv6.  A wildcard listener ("tcp6://*:port") does not
+	// accept IPv4 connections.
+	Transport6 = tcpTran(6)
+)
+
+// Some special options
+const (
+	// OptionHTTPHandler supplies an http.Handler for a listener.  When
+	// set, connections that do not begin with an SP header are served
+	// by the handler instead, so that one port can carry both SP traffic
+	// and plain HTTP (for example, a health check at /healthz).  This
+	// option is only valid on a Listener, and must be set before
+	// Listen is called.
+	OptionHTTPHandler = "TCP-HTTP-HANDLER"
 )
 
 func init() {
 	transport.RegisterTransport(Transport)
+	transport.RegisterTransport(Transport4)
+	transport.RegisterTransport(Transport6)
 }
 
 // options is used for shared GetOption/SetOption logic.
@@ -48,57 +78,184 @@ func (o options) get(name string) (interface{}, error) {
 // SetOption sets an option.
 func (o options) set(name string, val interface{}) error {
 	switch name {
-	case mangos.OptionNoDelay:
-		fallthrough
-	case mangos.OptionKeepAlive:
-		if v, ok := val.(bool); ok {
+	case mangos.OptionNoDelay, mangos.OptionKeepAlive,
+		mangos.OptionKeepAliveTime, mangos.OptionKeepAliveInterval,
+		mangos.OptionKeepAliveCount, mangos.OptionSendBufferSize,
+		mangos.OptionRecvBufferSize:
+		if err := transport.ParseTCPOption(name, val); err != nil {
+			return err
+		}
+		o[name] = val
+		return nil
+
+	case mangos.OptionBusyPoll:
+		if v, ok := val.(time.Duration); ok && v >= 0 {
 			o[name] = v
 			return nil
 		}
 		return mangos.ErrBadValue
 
-	case mangos.OptionKeepAliveTime:
-		if v, ok := val.(time.Duration); ok && v.Nanoseconds() > 0 {
+	case mangos.OptionDialProxy:
+		if _, err := transport.ParseProxy(val); err != nil {
+			return err
+		}
+		o[name] = val
+		return nil
+
+	case mangos.OptionDialLocalAddr:
+		if _, err := transport.ParseLocalAddr(val); err != nil {
+			return err
+		}
+		o[name] = val
+		return nil
+
+	case mangos.OptionDialInterface:
+		if v, ok := val.(string); ok {
 			o[name] = v
 			return nil
 		}
 		return mangos.ErrBadValue
 
+	case mangos.OptionDialRotate:
+		v, err := transport.ParseDialRotate(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionDialStagger:
+		v, err := transport.ParseDialStagger(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionIPVersion:
+		v, err := transport.ParseIPVersion(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
 	case mangos.OptionMaxRecvSize:
 		if v, ok := val.(int); ok {
 			o[name] = v
 			return nil
 		}
 		return mangos.ErrBadValue
+
+	case mangos.OptionCompression:
+		v, err := transport.ParseCompression(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCompressionThreshold:
+		v, err := transport.ParseCompressionThreshold(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionHeartbeatTime, mangos.OptionHeartbeatTimeout:
+		v, err := transport.ParseHeartbeatTime(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionClock:
+		v, err := transport.ParseClock(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionHandshakeTimeout:
+		v, err := transport.ParseHandshakeTimeout(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionChunkSize:
+		v, err := transport.ParseChunkSize(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCreditWindow:
+		v, err := transport.ParseCreditWindow(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionChecksum:
+		v, err := transport.ParseChecksum(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCoalesceTime:
+		v, err := transport.ParseCoalesceTime(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCoalesceBytes:
+		v, err := transport.ParseCoalesceBytes(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
 	}
 	return mangos.ErrBadOption
 }
 
-func newOptions() options {
+func newOptions(t tcpTran) options {
 	o := make(map[string]interface{})
+	o[mangos.OptionIPVersion] = int(t)
 	o[mangos.OptionNoDelay] = true
 	o[mangos.OptionKeepAlive] = true
 	o[mangos.OptionMaxRecvSize] = 0
+	o[mangos.OptionCompression] = ""
+	o[mangos.OptionCompressionThreshold] = transport.DefaultCompressionThreshold
+	o[mangos.OptionHeartbeatTime] = time.Duration(0)
+	o[mangos.OptionHeartbeatTimeout] = time.Duration(0)
+	o[mangos.OptionHandshakeTimeout] = time.Duration(0)
+	o[mangos.OptionChunkSize] = 0
+	o[mangos.OptionCreditWindow] = 0
+	o[mangos.OptionChecksum] = false
+	o[mangos.OptionCoalesceTime] = time.Duration(0)
+	o[mangos.OptionCoalesceBytes] = transport.DefaultCoalesceBytes
+	o[mangos.OptionBusyPoll] = time.Duration(0)
+	o[mangos.OptionKeepAliveInterval] = time.Duration(0)
+	o[mangos.OptionKeepAliveCount] = 0
+	o[mangos.OptionSendBufferSize] = 0
+	o[mangos.OptionRecvBufferSize] = 0
 	return options(o)
 }
 
 func (o options) configTCP(conn *net.TCPConn) error {
-	if v, ok := o[mangos.OptionNoDelay]; ok {
-		if err := conn.SetNoDelay(v.(bool)); err != nil {
-			return err
-		}
-	}
-	if v, ok := o[mangos.OptionKeepAlive]; ok {
-		if err := conn.SetKeepAlive(v.(bool)); err != nil {
-			return err
-		}
-	}
-	if v, ok := o[mangos.OptionKeepAliveTime]; ok {
-		if err := conn.SetKeepAlivePeriod(v.(time.Duration)); err != nil {
-			return err
-		}
-	}
-	return nil
+	return transport.ConfigTCP(conn, o)
 }
 
 type dialer struct {
@@ -109,15 +266,8 @@ type dialer struct {
 }
 
 func (d *dialer) Dial() (_ transport.Pipe, err error) {
-	var (
-		addr *net.TCPAddr
-	)
 
-	if addr, err = transport.ResolveTCPAddr(d.addr); err != nil {
-		return nil, err
-	}
-
-	conn, err := net.DialTCP("tcp", nil, addr)
+	conn, err := transport.DialTCP(d.addr, d.opts)
 	if err != nil {
 		return nil, err
 	}
@@ -126,7 +276,7 @@ func (d *dialer) Dial() (_ transport.Pipe, err error) {
 		return nil, err
 	}
 
-	p, err := transport.NewConnPipe(conn, d.proto, d.opts)
+	p, err := transport.NewConnPipeDialer(conn, d.proto, d.opts)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -147,87 +297,115 @@ func (d *dialer) GetOption(n string) (interface{}, error) {
 }
 
 type listener struct {
+	t          tcpTran
+	host       string
 	addr       *net.TCPAddr
 	bound      net.Addr
 	proto      transport.ProtocolInfo
-	listener   *net.TCPListener
+	port       *port
 	opts       options
 	handshaker transport.Handshaker
-	closeq     chan struct{}
+	handler    http.Handler
+	filter     *transport.AddrFilter
+	quarantine *transport.Quarantine
 }
 
 func (l *listener) Accept() (transport.Pipe, error) {
 
-	if l.listener == nil {
+	if l.port == nil {
 		return nil, mangos.ErrClosed
 	}
 	return l.handshaker.Wait()
 }
 
 func (l *listener) Listen() (err error) {
-	l.listener, err = net.ListenTCP("tcp", l.addr)
+	// Resolve again, as OptionIPVersion may have changed since.
+	network := transport.TCPNetwork(l.opts)
+	if l.addr, err = transport.ResolveTCPAddrNetwork(network, l.host); err != nil {
+		return
+	}
+	return join(network, l)
+}
+
+// start begins the SP handshake on a new connection.
+func (l *listener) start(conn net.Conn) {
+	p, err := transport.NewConnPipeListener(conn, l.proto, l.opts)
 	if err != nil {
+		conn.Close()
 		return
 	}
-	closeq := make(chan struct{})
-	l.closeq = closeq
-	l.bound = l.listener.Addr()
-	go func() {
-		for {
-			conn, err := l.listener.AcceptTCP()
-			if err != nil {
-				select {
-				case <-closeq:
-					return
-				default:
-					continue
-				}
-			}
-			if err = l.opts.configTCP(conn); err != nil {
-				conn.Close()
-				continue
-			}
-			p, err := transport.NewConnPipe(conn, l.proto, l.opts)
-			if err != nil {
-				conn.Close()
-				continue
-			}
-			if err = l.handshaker.Start(p); err != nil {
-				conn.Close()
-				continue
-			}
-		}
-	}()
-	return
+	if !l.filter.Permit(conn.RemoteAddr()) {
+		conn.Close()
+		l.handshaker.Reject(p, mangos.ErrAddrDenied)
+		return
+	}
+	if !l.quarantine.Permit(conn.RemoteAddr()) {
+		conn.Close()
+		l.handshaker.Reject(p, mangos.ErrQuarantined)
+		return
+	}
+	if err = l.handshaker.Start(p); err != nil {
+		conn.Close()
+	}
 }
 
 func (l *listener) Address() string {
 	if b := l.bound; b != nil {
-		return "tcp://" + b.String()
+		return l.t.Scheme() + "://" + b.String()
 	}
-	return "tcp://" + l.addr.String()
+	return l.t.Scheme() + "://" + l.addr.String()
 }
 
 func (l *listener) Close() error {
-	if l.listener != nil {
-		close(l.closeq)
-		l.listener.Close()
+	if l.port != nil {
+		l.port.leave(l)
 	}
 	l.handshaker.Close()
 	return nil
 }
 
 func (l *listener) SetOption(n string, v interface{}) error {
+	if n == OptionHTTPHandler {
+		if h, ok := v.(http.Handler); ok {
+			l.handler = h
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+	if n == mangos.OptionAcceptFilter {
+		f, err := transport.ParseAcceptFilter(v)
+		if err != nil {
+			return err
+		}
+		l.filter = f
+		l.opts[n] = v
+		return nil
+	}
+	if n == mangos.OptionQuarantine {
+		return l.quarantine.SetPolicy(v)
+	}
 	return l.opts.set(n, v)
 }
 
 func (l *listener) GetOption(n string) (interface{}, error) {
+	switch n {
+	case OptionHTTPHandler:
+		return l.handler, nil
+	case mangos.OptionQuarantine:
+		return l.quarantine.Policy(), nil
+	}
 	return l.opts.get(n)
 }
 
 type tcpTran int
 
 func (t tcpTran) Scheme() string {
+	switch t {
+	case Transport4:
+		return "tcp4"
+	case Transport6:
+		return "tcp6"
+	}
 	return "tcp"
 }
 
@@ -238,13 +416,14 @@ func (t tcpTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, e
 	}
 
 	// check to ensure the provided addr resolves correctly.
-	if _, err = transport.ResolveTCPAddr(addr); err != nil {
+	opts := newOptions(t)
+	if _, err = transport.ResolveTCPAddrNetwork(transport.TCPNetwork(opts), addr); err != nil {
 		return nil, err
 	}
 
 	d := &dialer{addr: addr,
 		proto:      sock.Info(),
-		opts:       newOptions(),
+		opts:       opts,
 		handshaker: transport.NewConnHandshaker(),
 	}
 
@@ -253,16 +432,19 @@ func (t tcpTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, e
 
 func (t tcpTran) NewListener(addr string, sock mangos.Socket) (transport.Listener, error) {
 	var err error
-	l := &listener{proto: sock.Info(), opts: newOptions()}
+	l := &listener{t: t, proto: sock.Info(), opts: newOptions(t)}
+	l.opts[mangos.OptionAcceptFilter] = mangos.AcceptFilter{}
 
 	if addr, err = transport.StripScheme(t, addr); err != nil {
 		return nil, err
 	}
 
-	if l.addr, err = transport.ResolveTCPAddr(addr); err != nil {
+	l.host = addr
+	if l.addr, err = transport.ResolveTCPAddrNetwork(transport.TCPNetwork(l.opts), addr); err != nil {
 		return nil, err
 	}
 
-	l.handshaker = transport.NewConnHandshaker()
+	l.quarantine = transport.NewQuarantine()
+	l.handshaker = transport.NewListenerHandshaker(l.quarantine)
 	return l, nil
 }
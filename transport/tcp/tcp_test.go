@@ -16,12 +16,16 @@ package tcp
 
 import (
 	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"nanomsg.org/go/mangos/v2"
 	"nanomsg.org/go/mangos/v2/protocol/rep"
 	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/test"
 )
 
 var tran = Transport
@@ -29,7 +33,7 @@ var sockRep, _ = rep.NewSocket()
 var sockReq, _ = req.NewSocket()
 
 func TestTCPListenAndAccept(t *testing.T) {
-	addr := "tcp://127.0.0.1:3333"
+	addr := test.AddrTestTCP()
 	t.Logf("Establishing accepter")
 	l, err := tran.NewListener(addr, sockRep)
 	if err != nil {
@@ -113,7 +117,7 @@ func TestTCPAnonymousPort(t *testing.T) {
 }
 
 func TestTCPDuplicateListen(t *testing.T) {
-	addr := "tcp://127.0.0.1:3333"
+	addr := test.AddrTestTCP()
 	var err error
 	l1, err := tran.NewListener(addr, sockRep)
 	if err != nil {
@@ -126,7 +130,9 @@ func TestTCPDuplicateListen(t *testing.T) {
 		return
 	}
 
-	l2, err := tran.NewListener(addr, sockReq)
+	// A socket of another protocol could share the port, but not
+	// another of the same protocol.
+	l2, err := tran.NewListener(addr, sockRep)
 	if err != nil {
 		t.Errorf("NewListener failed: %v", err)
 		return
@@ -140,7 +146,7 @@ func TestTCPDuplicateListen(t *testing.T) {
 }
 
 func TestTCPConnRefused(t *testing.T) {
-	addr := "tcp://127.0.0.1:19" // Port 19 is chargen, rarely in use
+	addr := test.AddrTestTCP() // Free when chosen, so likely refused
 	var err error
 	d, err := tran.NewDialer(addr, sockReq)
 	if err != nil || d == nil {
@@ -156,7 +162,7 @@ func TestTCPConnRefused(t *testing.T) {
 }
 
 func TestTCPSendRecv(t *testing.T) {
-	addr := "tcp://127.0.0.1:3333"
+	addr := test.AddrTestTCP()
 	ping := []byte("REQUEST_MESSAGE")
 	ack := []byte("RESPONSE_MESSAGE")
 
@@ -281,7 +287,7 @@ func TestTCPSendRecv(t *testing.T) {
 }
 
 func TestTCPOptions(t *testing.T) {
-	addr := "tcp://127.0.0.1:19" // Port 19 is chargen, rarely in use
+	addr := test.AddrTestTCP()
 	var err error
 	d, err := tran.NewDialer(addr, sockReq)
 	if err != nil || d == nil {
@@ -331,9 +337,85 @@ func TestTCPOptions(t *testing.T) {
 		t.Errorf("Expected ErrBadOption, but did not get it")
 	}
 
+	// Buffer sizes
+	for _, n := range []string{mangos.OptionSendBufferSize, mangos.OptionRecvBufferSize} {
+		if val, err := d.GetOption(n); err != nil || val.(int) != 0 {
+			t.Errorf("Default for %s wrong: %v %v", n, val, err)
+		}
+		if err := d.SetOption(n, 65536); err != nil {
+			t.Errorf("Set option %s failed: %v", n, err)
+		}
+		if err := d.SetOption(n, -1); err != mangos.ErrBadValue {
+			t.Errorf("Expected ErrBadValue, but got %v", err)
+		}
+		if err := d.SetOption(n, "big"); err != mangos.ErrBadValue {
+			t.Errorf("Expected ErrBadValue, but got %v", err)
+		}
+	}
+
 	// Negative test: try a bad option
 	if err = d.SetOption("NO-SUCH-OPTION", 0); err != mangos.ErrBadOption {
 		t.Errorf("Expected ErrBadOption, but did not get it")
 		return
 	}
 }
+
+func TestTCPHTTPHandler(t *testing.T) {
+	l, err := tran.NewListener("tcp://127.0.0.1:0", sockRep)
+	if err != nil {
+		t.Errorf("NewListener failed: %v", err)
+		return
+	}
+	defer l.Close()
+	if err = l.SetOption(OptionHTTPHandler, "junk"); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, but got %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	if err = l.SetOption(OptionHTTPHandler, mux); err != nil {
+		t.Errorf("Set option failed: %v", err)
+		return
+	}
+	if err = l.Listen(); err != nil {
+		t.Errorf("Listen failed: %v", err)
+		return
+	}
+	addr := l.Address()
+
+	// Both sorts of connection, on the same port.
+	resp, err := http.Get("http://" + strings.TrimPrefix(addr, "tcp://") + "/healthz")
+	if err != nil {
+		t.Errorf("HTTP get failed: %v", err)
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("Bad HTTP response: %s %q", resp.Status, body)
+		return
+	}
+
+	go func() {
+		d, err := tran.NewDialer(addr, sockReq)
+		if err != nil {
+			t.Errorf("NewDialer failed: %v", err)
+			return
+		}
+		client, err := d.Dial()
+		if err != nil {
+			t.Errorf("Dial failed: %v", err)
+			return
+		}
+		client.Send(mangos.NewMessage(0))
+		client.Close()
+	}()
+	server, err := l.Accept()
+	if err != nil {
+		t.Errorf("Accept failed: %v", err)
+		return
+	}
+	server.Close()
+}
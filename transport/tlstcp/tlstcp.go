@@ -18,7 +18,9 @@ package tlstcp
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net"
+	"sync"
 	"time"
 
 	"nanomsg.org/go/mangos/v2"
@@ -55,17 +57,199 @@ func (o options) set(name string, val interface{}) error {
 			return nil
 		}
 		return mangos.ErrBadValue
-	case mangos.OptionNoDelay:
-		fallthrough
-	case mangos.OptionKeepAlive:
+	case mangos.OptionIPVersion:
+		v, err := transport.ParseIPVersion(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+	case mangos.OptionNoDelay, mangos.OptionKeepAlive,
+		mangos.OptionKeepAliveTime, mangos.OptionKeepAliveInterval,
+		mangos.OptionKeepAliveCount, mangos.OptionSendBufferSize,
+		mangos.OptionRecvBufferSize:
+		if err := transport.ParseTCPOption(name, val); err != nil {
+			return err
+		}
+		o[name] = val
+		return nil
+
+	case mangos.OptionBusyPoll:
+		if v, ok := val.(time.Duration); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionCompression:
+		v, err := transport.ParseCompression(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCompressionThreshold:
+		v, err := transport.ParseCompressionThreshold(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionHeartbeatTime, mangos.OptionHeartbeatTimeout:
+		v, err := transport.ParseHeartbeatTime(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionClock:
+		v, err := transport.ParseClock(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionHandshakeTimeout:
+		v, err := transport.ParseHandshakeTimeout(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionChunkSize:
+		v, err := transport.ParseChunkSize(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCreditWindow:
+		v, err := transport.ParseCreditWindow(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionChecksum:
+		v, err := transport.ParseChecksum(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCoalesceTime:
+		v, err := transport.ParseCoalesceTime(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionCoalesceBytes:
+		v, err := transport.ParseCoalesceBytes(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionDialProxy:
+		if _, err := transport.ParseProxy(val); err != nil {
+			return err
+		}
+		o[name] = val
+		return nil
+
+	case mangos.OptionDialLocalAddr:
+		if _, err := transport.ParseLocalAddr(val); err != nil {
+			return err
+		}
+		o[name] = val
+		return nil
+
+	case mangos.OptionDialInterface:
+		if v, ok := val.(string); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionDialRotate:
+		v, err := transport.ParseDialRotate(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionDialStagger:
+		v, err := transport.ParseDialStagger(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionTLSVerifyPeer:
+		if v, ok := val.(mangos.TLSVerifyPeerFunc); ok {
+			o[name] = v
+			return nil
+		}
+		if v, ok := val.(func([][]*x509.Certificate, net.Addr) error); ok {
+			o[name] = mangos.TLSVerifyPeerFunc(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionTLSRevocation:
+		if v, ok := val.(mangos.RevocationChecker); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionTLSRevocationInterval:
+		if v, ok := val.(time.Duration); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionTLSOCSPStaple:
+		if v, ok := val.(mangos.OCSPStapleFunc); ok {
+			o[name] = v
+			return nil
+		}
+		if v, ok := val.(func(*tls.Certificate) ([]byte, error)); ok {
+			o[name] = mangos.OCSPStapleFunc(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionTLSALPN:
+		if v, ok := val.([]string); ok {
+			o[name] = append([]string(nil), v...)
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionTLSSessionResumption, mangos.OptionTLSInsecureSkipVerify:
 		if v, ok := val.(bool); ok {
 			o[name] = v
 			return nil
 		}
 		return mangos.ErrBadValue
 
-	case mangos.OptionKeepAliveTime:
-		if v, ok := val.(time.Duration); ok && v.Nanoseconds() > 0 {
+	case mangos.OptionTLSServerName:
+		if v, ok := val.(string); ok {
 			o[name] = v
 			return nil
 		}
@@ -75,24 +259,196 @@ func (o options) set(name string, val interface{}) error {
 	return mangos.ErrBadOption
 }
 
-func (o options) configTCP(conn *net.TCPConn) error {
-	if v, ok := o[mangos.OptionNoDelay]; ok {
-		if err := conn.SetNoDelay(v.(bool)); err != nil {
-			return err
+// sessions returns a configuration with the ALPN protocols and session
+// resumption asked for, if any.  The cache is used by dialers that keep
+// their sessions.
+func (o options) sessions(config *tls.Config, cache tls.ClientSessionCache) *tls.Config {
+	alpn, hasALPN := o[mangos.OptionTLSALPN]
+	resume, hasResume := o[mangos.OptionTLSSessionResumption]
+	if !hasALPN && !hasResume {
+		return config
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if hasALPN {
+		config.NextProtos = alpn.([]string)
+	}
+	if hasResume {
+		if cache == nil {
+			config.SessionTicketsDisabled = !resume.(bool)
+		} else if resume.(bool) {
+			config.ClientSessionCache = cache
+		} else {
+			config.ClientSessionCache = nil
 		}
 	}
-	if v, ok := o[mangos.OptionKeepAlive]; ok {
-		if err := conn.SetKeepAlive(v.(bool)); err != nil {
-			return err
+	return config
+}
+
+// clientConfig returns the configuration for a dialer, which by default
+// verifies the listener's certificate, against the system's roots unless
+// the tls.Config has others, for the host dialed.  OptionTLSServerName
+// and OptionTLSInsecureSkipVerify override this.
+func (o options) clientConfig(config *tls.Config, addr string) *tls.Config {
+	name, _ := o[mangos.OptionTLSServerName].(string)
+	skip, _ := o[mangos.OptionTLSInsecureSkipVerify].(bool)
+	if config != nil && config.ServerName != "" && name == "" && !skip {
+		return config
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if name != "" {
+		config.ServerName = name
+	} else if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if skip {
+		config.InsecureSkipVerify = true
+	}
+	return config
+}
+
+// handshake performs the TLS handshake, within OptionHandshakeTimeout if
+// that is set.  The deadline is left for the SP handshake to replace.
+func (o options) handshake(conn *tls.Conn) error {
+	if d, _ := o[mangos.OptionHandshakeTimeout].(time.Duration); d > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d))
+	}
+	return conn.Handshake()
+}
+
+// verifyPeer runs the application's peer verification, and revocation
+// check, if any.
+func (o options) verifyPeer(conn *tls.Conn) error {
+	if v, ok := o[mangos.OptionTLSVerifyPeer]; ok {
+		if fn := v.(mangos.TLSVerifyPeerFunc); fn != nil {
+			state := conn.ConnectionState()
+			if err := fn(state.VerifiedChains, conn.RemoteAddr()); err != nil {
+				return err
+			}
 		}
 	}
-	if v, ok := o[mangos.OptionKeepAliveTime]; ok {
-		if err := conn.SetKeepAlivePeriod(v.(time.Duration)); err != nil {
-			return err
+	return o.checkRevocation(conn)
+}
+
+// checkRevocation checks the peer's own certificate with the revocation
+// checker, if there is one.  The issuer comes from the verified chain
+// if there is one, or else from what the peer sent.
+func (o options) checkRevocation(conn *tls.Conn) error {
+	v, ok := o[mangos.OptionTLSRevocation]
+	if !ok || v == nil {
+		return nil
+	}
+	state := conn.ConnectionState()
+	chain := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		chain = state.VerifiedChains[0]
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+	return v.(mangos.RevocationChecker).CheckRevocation(chain[0], issuer,
+		state.OCSPResponse)
+}
+
+// monitored wraps the connection of a pipe whose peer certificate is
+// checked periodically (OptionTLSRevocationInterval).
+type monitored struct {
+	*tls.Conn
+	closeq chan struct{}
+	once   sync.Once
+}
+
+func (c *monitored) Close() error {
+	c.once.Do(func() { close(c.closeq) })
+	return c.Conn.Close()
+}
+
+// monitor returns the connection to use for the pipe, starting the
+// periodic revocation check if one was asked for.
+func (o options) monitor(conn *tls.Conn) net.Conn {
+	v, ok := o[mangos.OptionTLSRevocationInterval]
+	if !ok || v.(time.Duration) == 0 {
+		return conn
+	}
+	if _, ok := o[mangos.OptionTLSRevocation]; !ok {
+		return conn
+	}
+	c := &monitored{Conn: conn, closeq: make(chan struct{})}
+	go func(interval time.Duration) {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-c.closeq:
+				return
+			case <-tick.C:
+				if o.checkRevocation(conn) != nil {
+					c.Close()
+					return
+				}
+			}
+		}
+	}(v.(time.Duration))
+	return c
+}
+
+// stapling returns a configuration which staples OCSP responses from
+// the application to the handshake, if it asked for that.
+func (o options) stapling(config *tls.Config) *tls.Config {
+	v, ok := o[mangos.OptionTLSOCSPStaple]
+	if !ok {
+		return config
+	}
+	staple := v.(mangos.OCSPStapleFunc)
+	config = config.Clone()
+	// GetCertificate is not consulted when there are Certificates,
+	// unless the peer sent a server name, so we choose from them.
+	certs := config.Certificates
+	getCert := config.GetCertificate
+	config.Certificates = nil
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		var cert *tls.Certificate
+		if getCert != nil {
+			c, err := getCert(hello)
+			if err != nil {
+				return nil, err
+			}
+			cert = c
+		}
+		if cert == nil {
+			if len(certs) == 0 {
+				return nil, mangos.ErrTLSNoCert
+			}
+			cert = &certs[0]
+			for i := range certs {
+				if hello.SupportsCertificate(&certs[i]) == nil {
+					cert = &certs[i]
+					break
+				}
+			}
+		}
+		dup := *cert
+		if b, err := staple(cert); err == nil {
+			dup.OCSPStaple = b
 		}
+		return &dup, nil
 	}
+	return config
+}
 
-	return nil
+func (o options) configTCP(conn *net.TCPConn) error {
+	return transport.ConfigTCP(conn, o)
 }
 
 func newOptions(t tlsTran) options {
@@ -101,6 +457,22 @@ func newOptions(t tlsTran) options {
 	o[mangos.OptionKeepAlive] = true
 	o[mangos.OptionNoDelay] = true
 	o[mangos.OptionMaxRecvSize] = 0
+	o[mangos.OptionCompression] = ""
+	o[mangos.OptionCompressionThreshold] = transport.DefaultCompressionThreshold
+	o[mangos.OptionHeartbeatTime] = time.Duration(0)
+	o[mangos.OptionHeartbeatTimeout] = time.Duration(0)
+	o[mangos.OptionHandshakeTimeout] = time.Duration(0)
+	o[mangos.OptionChunkSize] = 0
+	o[mangos.OptionCreditWindow] = 0
+	o[mangos.OptionChecksum] = false
+	o[mangos.OptionCoalesceTime] = time.Duration(0)
+	o[mangos.OptionCoalesceBytes] = transport.DefaultCoalesceBytes
+	o[mangos.OptionBusyPoll] = time.Duration(0)
+	o[mangos.OptionIPVersion] = 0
+	o[mangos.OptionKeepAliveInterval] = time.Duration(0)
+	o[mangos.OptionKeepAliveCount] = 0
+	o[mangos.OptionSendBufferSize] = 0
+	o[mangos.OptionRecvBufferSize] = 0
 	return options(o)
 }
 
@@ -109,20 +481,16 @@ type dialer struct {
 	proto      transport.ProtocolInfo
 	opts       options
 	handshaker transport.Handshaker
+	cache      tls.ClientSessionCache // see OptionTLSSessionResumption
 }
 
 func (d *dialer) Dial() (transport.Pipe, error) {
 	var (
-		addr   *net.TCPAddr
 		config *tls.Config
 		err    error
 	)
 
-	if addr, err = transport.ResolveTCPAddr(d.addr); err != nil {
-		return nil, err
-	}
-
-	tconn, err := net.DialTCP("tcp", nil, addr)
+	tconn, err := transport.DialTCP(d.addr, d.opts)
 	if err != nil {
 		return nil, err
 	}
@@ -130,11 +498,10 @@ func (d *dialer) Dial() (transport.Pipe, error) {
 		tconn.Close()
 		return nil, err
 	}
-	if v, ok := d.opts[mangos.OptionTLSConfig]; ok {
-		config = v.(*tls.Config)
-	}
+	config, _ = d.opts[mangos.OptionTLSConfig].(*tls.Config)
+	config = d.opts.sessions(d.opts.clientConfig(config, d.addr), d.cache)
 	conn := tls.Client(tconn, config)
-	if err = conn.Handshake(); err != nil {
+	if err = d.opts.handshake(conn); err != nil {
 		conn.Close()
 		return nil, err
 	}
@@ -143,7 +510,16 @@ func (d *dialer) Dial() (transport.Pipe, error) {
 		opts[n] = v
 	}
 	opts[mangos.OptionTLSConnState] = conn.ConnectionState()
-	p, err := transport.NewConnPipe(conn, d.proto, opts)
+	opts[mangos.OptionTLSInsecureSkipVerify] = config.InsecureSkipVerify
+	if err = d.opts.verifyPeer(conn); err != nil {
+		p, e := transport.NewConnPipe(conn, d.proto, opts)
+		conn.Close()
+		if e != nil {
+			return nil, err
+		}
+		return p, err
+	}
+	p, err := transport.NewConnPipeDialer(d.opts.monitor(conn), d.proto, opts)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -164,6 +540,7 @@ func (d *dialer) GetOption(n string) (interface{}, error) {
 }
 
 type listener struct {
+	host       string
 	addr       *net.TCPAddr
 	bound      net.Addr
 	listener   *net.TCPListener
@@ -171,6 +548,8 @@ type listener struct {
 	opts       options
 	config     *tls.Config
 	handshaker transport.Handshaker
+	filter     *transport.AddrFilter
+	quarantine *transport.Quarantine
 	closeq     chan struct{}
 }
 
@@ -184,12 +563,19 @@ func (l *listener) Listen() error {
 	if l.config == nil {
 		return mangos.ErrTLSNoConfig
 	}
-	if l.config.Certificates == nil || len(l.config.Certificates) == 0 {
+	if !transport.HasTLSCert(l.config) {
 		return mangos.ErrTLSNoCert
 	}
+	l.config = l.opts.stapling(l.config)
+	l.config = l.opts.sessions(l.config, nil)
 
+	// Resolve again, as OptionIPVersion may have changed since.
+	network := transport.TCPNetwork(l.opts)
+	if l.addr, err = transport.ResolveTCPAddrNetwork(network, l.host); err != nil {
+		return err
+	}
 	closeq := make(chan struct{})
-	if l.listener, err = net.ListenTCP("tcp", l.addr); err != nil {
+	if l.listener, err = net.ListenTCP(network, l.addr); err != nil {
 		return err
 	}
 	l.closeq = closeq
@@ -207,13 +593,31 @@ func (l *listener) Listen() error {
 				}
 			}
 
+			if !l.filter.Permit(tconn.RemoteAddr()) {
+				p, e := transport.NewConnPipe(tconn, l.proto, l.opts)
+				tconn.Close()
+				if e == nil {
+					l.handshaker.Reject(p, mangos.ErrAddrDenied)
+				}
+				continue
+			}
+			if !l.quarantine.Permit(tconn.RemoteAddr()) {
+				p, e := transport.NewConnPipe(tconn, l.proto, l.opts)
+				tconn.Close()
+				if e == nil {
+					l.handshaker.Reject(p, mangos.ErrQuarantined)
+				}
+				continue
+			}
+
 			if err = l.opts.configTCP(tconn); err != nil {
 				tconn.Close()
 				continue
 			}
 
 			conn := tls.Server(tconn, l.config)
-			if err = conn.Handshake(); err != nil {
+			if err = l.opts.handshake(conn); err != nil {
+				l.quarantine.Failed(tconn.RemoteAddr())
 				conn.Close()
 				continue
 			}
@@ -222,7 +626,16 @@ func (l *listener) Listen() error {
 				opts[n] = v
 			}
 			opts[mangos.OptionTLSConnState] = conn.ConnectionState()
-			p, err := transport.NewConnPipe(conn, l.proto, opts)
+			if err = l.opts.verifyPeer(conn); err != nil {
+				p, e := transport.NewConnPipe(conn, l.proto, opts)
+				conn.Close()
+				if e == nil {
+					l.handshaker.Reject(p, err)
+				}
+				continue
+			}
+			p, err := transport.NewConnPipeListener(l.opts.monitor(conn),
+				l.proto, opts)
 			if err != nil {
 				conn.Close()
 				continue
@@ -251,6 +664,7 @@ func (l *listener) Accept() (transport.Pipe, error) {
 
 func (l *listener) Close() error {
 	if l.listener != nil {
+		close(l.closeq)
 		l.listener.Close()
 	}
 	l.handshaker.Close()
@@ -258,10 +672,25 @@ func (l *listener) Close() error {
 }
 
 func (l *listener) SetOption(n string, v interface{}) error {
+	if n == mangos.OptionAcceptFilter {
+		f, err := transport.ParseAcceptFilter(v)
+		if err != nil {
+			return err
+		}
+		l.filter = f
+		l.opts[n] = v
+		return nil
+	}
+	if n == mangos.OptionQuarantine {
+		return l.quarantine.SetPolicy(v)
+	}
 	return l.opts.set(n, v)
 }
 
 func (l *listener) GetOption(n string) (interface{}, error) {
+	if n == mangos.OptionQuarantine {
+		return l.quarantine.Policy(), nil
+	}
 	return l.opts.get(n)
 }
 
@@ -288,6 +717,7 @@ func (t tlsTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, e
 		opts:       newOptions(t),
 		addr:       addr,
 		handshaker: transport.NewConnHandshaker(),
+		cache:      tls.NewLRUClientSessionCache(0),
 	}
 	return d, nil
 }
@@ -298,15 +728,18 @@ func (t tlsTran) NewListener(addr string, sock mangos.Socket) (transport.Listene
 		proto: sock.Info(),
 		opts:  newOptions(t),
 	}
+	l.opts[mangos.OptionAcceptFilter] = mangos.AcceptFilter{}
 
 	var err error
 	if addr, err = transport.StripScheme(t, addr); err != nil {
 		return nil, err
 	}
+	l.host = addr
 	if l.addr, err = transport.ResolveTCPAddr(addr); err != nil {
 		return nil, err
 	}
-	l.handshaker = transport.NewConnHandshaker()
+	l.quarantine = transport.NewQuarantine()
+	l.handshaker = transport.NewListenerHandshaker(l.quarantine)
 
 	return l, nil
 }
@@ -17,7 +17,6 @@ package transport
 import (
 	"net"
 	"strings"
-	"sync"
 
 	"nanomsg.org/go/mangos/v2"
 )
@@ -58,32 +57,51 @@ func StripScheme(t Transport, addr string) (string, error) {
 // wildcard used in nanomsg URLs, replacing it with an empty
 // string to indicate that all local interfaces be used.
 func ResolveTCPAddr(addr string) (*net.TCPAddr, error) {
+	return ResolveTCPAddrNetwork("tcp", addr)
+}
+
+// ResolveTCPAddrNetwork is like ResolveTCPAddr, but for the given
+// network, which is "tcp4" or "tcp6" to resolve to just addresses of
+// that IP version, or "tcp" for either.  IPv6 addresses are written in
+// brackets, and may have a zone, as in "[fe80::1%eth0]:5555".
+func ResolveTCPAddrNetwork(network, addr string) (*net.TCPAddr, error) {
 	if strings.HasPrefix(addr, "*") {
 		addr = addr[1:]
 	}
-	return net.ResolveTCPAddr("tcp", addr)
+	return net.ResolveTCPAddr(network, addr)
+}
+
+// ParseIPVersion checks a value for mangos.OptionIPVersion.
+func ParseIPVersion(v interface{}) (int, error) {
+	if n, ok := v.(int); ok && (n == 0 || n == 4 || n == 6) {
+		return n, nil
+	}
+	return 0, mangos.ErrBadValue
 }
 
-var lock sync.RWMutex
-var transports = map[string]Transport{}
+// TCPNetwork returns the network ("tcp", "tcp4" or "tcp6") selected by
+// mangos.OptionIPVersion in the options, for use with the net package.
+func TCPNetwork(options map[string]interface{}) string {
+	switch options[mangos.OptionIPVersion] {
+	case 4:
+		return "tcp4"
+	case 6:
+		return "tcp6"
+	}
+	return "tcp"
+}
 
 // RegisterTransport is used to register the transport globally,
 // after which it will be available for all sockets.  The
 // transport will override any others registered for the same
-// scheme.
+// scheme.  This is the same as mangos.RegisterTransport, using
+// the transport's own Scheme.
 func RegisterTransport(t Transport) {
-	lock.Lock()
-	transports[t.Scheme()] = t
-	lock.Unlock()
+	mangos.RegisterTransport(t.Scheme(), t)
 }
 
 // GetTransport is used by a socket to lookup the transport
 // for a given scheme.
 func GetTransport(scheme string) Transport {
-	lock.RLock()
-	defer lock.RUnlock()
-	if t, ok := transports[scheme]; ok {
-		return t
-	}
-	return nil
+	return mangos.GetTransport(scheme)
 }
@@ -0,0 +1,145 @@
+// Copyright 2019 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ws
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// port is an HTTP server, shared by all the listeners in this process
+// that listen on the same address.  Requests go to the listener with
+// the most specific match for the path, preferring those whose
+// protocol is the one the client asks for, so that sockets of different
+// protocols can share a path.
+type port struct {
+	key      string
+	listener net.Listener
+	htsvr    *http.Server
+	members  []*listener
+	sync.Mutex
+}
+
+var ports = struct {
+	m map[string]*port
+	sync.Mutex
+}{m: make(map[string]*port)}
+
+// join adds l to the port for its address, listening on the address
+// first if nobody is yet.  For wss, the TLS configuration of the first
+// listener is the one used.
+func join(taddr *net.TCPAddr, tcfg *tls.Config, l *listener) error {
+	ports.Lock()
+	defer ports.Unlock()
+
+	scheme := "ws://"
+	if l.iswss {
+		scheme = "wss://"
+	}
+	if taddr.Port != 0 {
+		if p, ok := ports.m[scheme+taddr.String()]; ok {
+			return p.add(l)
+		}
+	}
+	tlist, err := net.ListenTCP("tcp", taddr)
+	if err != nil {
+		return err
+	}
+	p := &port{key: scheme + tlist.Addr().String()}
+	if l.iswss {
+		p.listener = tls.NewListener(tlist, tcfg)
+	} else {
+		p.listener = tlist
+	}
+	if err = p.add(l); err != nil {
+		tlist.Close()
+		return err
+	}
+	p.htsvr = &http.Server{Addr: tlist.Addr().String(), Handler: p}
+	ports.m[p.key] = p
+	go p.htsvr.Serve(p.listener)
+	return nil
+}
+
+// add makes l a member.  Only one listener may serve a given protocol
+// on a given path.
+func (p *port) add(l *listener) error {
+	p.Lock()
+	defer p.Unlock()
+	for _, m := range p.members {
+		if m.url.Path == l.url.Path && m.proto.Self == l.proto.Self {
+			return mangos.ErrAddrInUse
+		}
+	}
+	p.members = append(p.members, l)
+	l.port = p
+	return nil
+}
+
+// leave removes l, and stops listening when it was the last member.
+func (p *port) leave(l *listener) {
+	ports.Lock()
+	defer ports.Unlock()
+	p.Lock()
+	defer p.Unlock()
+	for i, m := range p.members {
+		if m == l {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			break
+		}
+	}
+	if len(p.members) == 0 && ports.m[p.key] == p {
+		delete(ports.m, p.key)
+		p.listener.Close()
+	}
+}
+
+func (p *port) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	want := make(map[string]bool)
+	for _, s := range websocket.Subprotocols(r) {
+		want[s] = true
+	}
+
+	var best *listener
+	bestLen, bestProto := -1, false
+	p.Lock()
+	for _, m := range p.members {
+		_, pattern := m.mux.Handler(r)
+		if pattern == "" {
+			continue
+		}
+		proto := want[m.opts.subprotocol(m.proto.SelfName)]
+		if proto == bestProto && len(pattern) <= bestLen {
+			continue
+		}
+		if bestProto && !proto {
+			continue
+		}
+		best, bestLen, bestProto = m, len(pattern), proto
+	}
+	p.Unlock()
+
+	if best == nil {
+		http.NotFound(w, r)
+		return
+	}
+	best.mux.ServeHTTP(w, r)
+}
@@ -14,6 +14,11 @@
 
 // Package ws implements a simple WebSocket transport for mangos.
 // To enable it simply import it.
+//
+// Listeners in one process may share an address, for example to serve
+// different sockets on different paths of one port.  Sockets of
+// different protocols may even share a path, as the client names the
+// protocol it wants when it connects.
 package ws
 
 import (
@@ -23,6 +28,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 
@@ -73,10 +79,38 @@ const (
 	// before calling Upgrade.
 	OptionWebSocketCheckOrigin = "WEBSOCKET-CHECKORIGIN"
 
+	// OptionWebSocketOriginFunc supplies an OriginFunc, which a listener
+	// calls with each request to upgrade, to decide whether to accept
+	// its origin.  This is for serving browsers on other origins, as it
+	// takes the place of the check that OptionWebSocketCheckOrigin
+	// controls.  A nil function restores the default check.
+	OptionWebSocketOriginFunc = "WEBSOCKET-ORIGIN-FUNC"
+
+	// OptionWebSocketHeader supplies an http.Header.  A dialer adds it
+	// to its request to upgrade, for example to carry an authorization
+	// token or cookie through a gateway, and a listener adds it to its
+	// response.  Headers that the WebSocket handshake sets itself, such
+	// as Sec-WebSocket-Protocol, cannot be given.
+	OptionWebSocketHeader = "WEBSOCKET-HEADER"
+
+	// OptionWebSocketSubprotocol replaces the subprotocol (in the
+	// Sec-WebSocket-Protocol header) that names the SP protocol, as a
+	// string.  By default it is the name of the protocol followed by
+	// ".sp.nanomsg.org", for example "rep.sp.nanomsg.org" for a REQ
+	// dialer and REP listener.  Both ends must use the same value, and
+	// the dialer names its peer's protocol, as the listener does its
+	// own.  Listeners sharing a path must each have a different one.
+	OptionWebSocketSubprotocol = "WEBSOCKET-SUBPROTOCOL"
+
 	// Transport is a transport.Transport for WebSocket
 	Transport = wsTran(0)
 )
 
+// OriginFunc is the type of function used with OptionWebSocketOriginFunc.
+// It returns true to accept the origin of the request (in its Origin
+// header).
+type OriginFunc func(r *http.Request) bool
+
 type options map[string]interface{}
 
 func init() {
@@ -119,10 +153,51 @@ func (o options) set(name string, val interface{}) error {
 			return nil
 		}
 		return mangos.ErrBadValue
+	case mangos.OptionDialProxy:
+		if _, err := transport.ParseProxy(val); err != nil {
+			return err
+		}
+		o[name] = val
+		return nil
+	case mangos.OptionDialRotate:
+		v, err := transport.ParseDialRotate(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+
+	case mangos.OptionDialStagger:
+		v, err := transport.ParseDialStagger(val)
+		if err != nil {
+			return err
+		}
+		o[name] = v
+		return nil
+	case OptionWebSocketHeader:
+		if v, ok := val.(http.Header); ok {
+			o[name] = v.Clone()
+			return nil
+		}
+		return mangos.ErrBadValue
+	case OptionWebSocketSubprotocol:
+		if v, ok := val.(string); ok && v != "" {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
 	}
 	return mangos.ErrBadOption
 }
 
+// subprotocol returns the subprotocol for the SP protocol named.
+func (o options) subprotocol(proto string) string {
+	if v, ok := o[OptionWebSocketSubprotocol].(string); ok {
+		return v
+	}
+	return proto + ".sp.nanomsg.org"
+}
+
 // wsPipe implements the Pipe interface on a websocket
 type wsPipe struct {
 	ws      *websocket.Conn
@@ -154,10 +229,13 @@ func (w *wsPipe) Send(m *mangos.Message) error {
 
 	var buf []byte
 
-	if len(m.Header) > 0 {
-		buf = make([]byte, 0, len(m.Header)+len(m.Body))
+	if len(m.Header) > 0 || len(m.Bodies) > 0 {
+		buf = make([]byte, 0, len(m.Header)+m.BodyLen())
 		buf = append(buf, m.Header...)
 		buf = append(buf, m.Body...)
+		for _, b := range m.Bodies {
+			buf = append(buf, b...)
+		}
 	} else {
 		buf = m.Body
 	}
@@ -206,10 +284,22 @@ func (d *dialer) Dial() (transport.Pipe, error) {
 
 	wd := &websocket.Dialer{}
 
-	wd.Subprotocols = []string{d.proto.PeerName + ".sp.nanomsg.org"}
+	wd.Subprotocols = []string{d.opts.subprotocol(d.proto.PeerName)}
 	if v, ok := d.opts[mangos.OptionTLSConfig]; ok {
 		wd.TLSClientConfig = v.(*tls.Config)
 	}
+	_, proxy := d.opts[mangos.OptionDialProxy]
+	rotate, _ := d.opts[mangos.OptionDialRotate].(bool)
+	stagger, _ := d.opts[mangos.OptionDialStagger].(time.Duration)
+	if proxy || rotate || stagger > 0 {
+		wd.NetDial = func(_, addr string) (net.Conn, error) {
+			conn, err := transport.DialTCP(addr, d.opts)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
 
 	w = &wsPipe{
 		addr:    d.addr,
@@ -224,7 +314,12 @@ func (d *dialer) Dial() (transport.Pipe, error) {
 	if err == nil {
 		maxrx, _ = v.(int)
 	}
-	if w.ws, _, err = wd.Dial(d.addr, nil); err != nil {
+	header, _ := d.opts[OptionWebSocketHeader].(http.Header)
+	if w.ws, _, err = wd.Dial(d.addr, header); err != nil {
+		if err == websocket.ErrBadHandshake {
+			// The server answered, but would not upgrade.
+			err = mangos.ErrConnRefused
+		}
 		return nil, err
 	}
 	w.ws.SetReadLimit(int64(maxrx))
@@ -247,20 +342,21 @@ func (d *dialer) GetOption(n string) (interface{}, error) {
 }
 
 type listener struct {
-	pending  []*wsPipe
-	lock     sync.Mutex
-	cv       sync.Cond
-	running  bool
-	noserve  bool
-	addr     string
-	ug       websocket.Upgrader
-	htsvr    *http.Server
-	mux      *http.ServeMux
-	url      *url.URL
-	listener net.Listener
-	proto    transport.ProtocolInfo
-	opts     options
-	iswss    bool
+	pending []*wsPipe
+	lock    sync.Mutex
+	cv      sync.Cond
+	running bool
+	noserve bool
+	addr    string
+	ug      websocket.Upgrader
+	mux     *http.ServeMux
+	url     *url.URL
+	port    *port
+	proto   transport.ProtocolInfo
+	opts    options
+	iswss   bool
+	filter  *transport.AddrFilter
+	refused []net.Addr // peers turned away by the filter
 }
 
 func (l *listener) SetOption(n string, v interface{}) error {
@@ -271,6 +367,34 @@ func (l *listener) SetOption(n string, v interface{}) error {
 				l.ug.CheckOrigin = func(r *http.Request) bool { return true }
 			}
 		}
+	case OptionWebSocketOriginFunc:
+		fn, ok := v.(OriginFunc)
+		if !ok {
+			f, isFunc := v.(func(*http.Request) bool)
+			if !isFunc && v != nil {
+				return mangos.ErrBadValue
+			}
+			fn = f
+		}
+		l.ug.CheckOrigin = fn
+		l.opts[n] = fn
+		return nil
+	case OptionWebSocketSubprotocol:
+		if err := l.opts.set(n, v); err != nil {
+			return err
+		}
+		l.ug.Subprotocols = []string{l.opts.subprotocol(l.proto.SelfName)}
+		return nil
+	case mangos.OptionAcceptFilter:
+		f, err := transport.ParseAcceptFilter(v)
+		if err != nil {
+			return err
+		}
+		l.lock.Lock()
+		l.filter = f
+		l.lock.Unlock()
+		l.opts[n] = v
+		return nil
 	}
 	return l.opts.set(n, v)
 }
@@ -315,32 +439,30 @@ func (l *listener) Listen() error {
 			return mangos.ErrTLSNoConfig
 		}
 		tcfg = v.(*tls.Config)
-		if tcfg.Certificates == nil || len(tcfg.Certificates) == 0 {
+		if !transport.HasTLSCert(tcfg) {
 			return mangos.ErrTLSNoCert
 		}
 	}
 
 	// We listen separately, that way we can catch and deal with the
 	// case of a port already in use.  This also lets us configure
-	// properties of the underlying TCP connection.
+	// properties of the underlying TCP connection.  Listeners for
+	// the same address share the one server.
 
 	if taddr, err = transport.ResolveTCPAddr(l.url.Host); err != nil {
 		return err
 	}
-
-	if tlist, err := net.ListenTCP("tcp", taddr); err != nil {
+	if err = join(taddr, tcfg, l); err != nil {
 		return err
-	} else if l.iswss {
-		l.listener = tls.NewListener(tlist, tcfg)
-	} else {
-		l.listener = tlist
 	}
+	if taddr.Port == 0 {
+		// The system chose the port, so report that one.
+		l.url.Host = l.port.htsvr.Addr
+	}
+	l.lock.Lock()
 	l.pending = nil
 	l.running = true
-
-	l.htsvr = &http.Server{Addr: l.url.Host, Handler: l.mux}
-
-	go l.htsvr.Serve(l.listener)
+	l.lock.Unlock()
 
 	return nil
 }
@@ -355,6 +477,17 @@ func (l *listener) Accept() (transport.Pipe, error) {
 		if !l.running {
 			return nil, mangos.ErrClosed
 		}
+		if len(l.refused) != 0 {
+			// Report it, as a pipe that is already closed.
+			w = &wsPipe{
+				addr:    l.addr,
+				proto:   l.proto,
+				iswss:   l.iswss,
+				options: map[string]interface{}{mangos.OptionRemoteAddr: l.refused[0]},
+			}
+			l.refused = l.refused[1:]
+			return w, mangos.ErrAddrDenied
+		}
 		if len(l.pending) == 0 {
 			l.cv.Wait()
 			continue
@@ -376,7 +509,7 @@ func (l *listener) handler(ws *websocket.Conn, req *http.Request) {
 		return
 	}
 
-	if ws.Subprotocol() != l.proto.SelfName+".sp.nanomsg.org" {
+	if ws.Subprotocol() != l.opts.subprotocol(l.proto.SelfName) {
 		ws.Close()
 		l.lock.Unlock()
 		return
@@ -429,8 +562,8 @@ func (l *listener) Close() error {
 	if !l.running {
 		return mangos.ErrClosed
 	}
-	if l.listener != nil {
-		l.listener.Close()
+	if l.port != nil {
+		l.port.leave(l)
 	}
 	l.running = false
 	l.cv.Broadcast()
@@ -442,7 +575,21 @@ func (l *listener) Close() error {
 }
 
 func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ws, err := l.ug.Upgrade(w, r, nil)
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		l.lock.Lock()
+		if !l.filter.Permit(addr) {
+			if l.running {
+				l.refused = append(l.refused, addr)
+				l.cv.Broadcast()
+			}
+			l.lock.Unlock()
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		l.lock.Unlock()
+	}
+	header, _ := l.opts[OptionWebSocketHeader].(http.Header)
+	ws, err := l.ug.Upgrade(w, r, header)
 	if err != nil {
 		return
 	}
@@ -488,8 +635,9 @@ func (wsTran) listener(addr string, sock mangos.Socket) (*listener, error) {
 		proto: sock.Info(),
 		opts:  make(map[string]interface{}),
 	}
+	l.opts[mangos.OptionAcceptFilter] = mangos.AcceptFilter{}
 	l.cv.L = &l.lock
-	l.ug.Subprotocols = []string{l.proto.SelfName + ".sp.nanomsg.org"}
+	l.ug.Subprotocols = []string{l.opts.subprotocol(l.proto.SelfName)}
 
 	if strings.HasPrefix(addr, "wss://") {
 		l.iswss = true
@@ -503,7 +651,5 @@ func (wsTran) listener(addr string, sock mangos.Socket) (*listener, error) {
 	}
 	l.mux = http.NewServeMux()
 
-	l.htsvr = &http.Server{Addr: l.url.Host, Handler: l.mux}
-
 	return l, nil
 }
@@ -23,19 +23,20 @@ import (
 
 	"nanomsg.org/go/mangos/v2/protocol/rep"
 	"nanomsg.org/go/mangos/v2/protocol/req"
-	//"nanomsg.org/go-mangos/test"
+	"nanomsg.org/go/mangos/v2/test"
 )
 
 func TestWebsockPath(t *testing.T) {
 	sockReq, _ := req.NewSocket()
 	sockRep, _ := rep.NewSocket()
 	tran := Transport
-	l, e := tran.NewListener("ws://127.0.0.1:3335/mysock", sockReq)
+	addr := fmt.Sprintf("127.0.0.1:%d", test.NextPort())
+	l, e := tran.NewListener("ws://"+addr+"/mysock", sockReq)
 	if e != nil {
 		t.Errorf("Failed new Listener: %v", e)
 		return
 	}
-	d, e := tran.NewDialer("ws://127.0.0.1:3335/boguspath", sockRep)
+	d, e := tran.NewDialer("ws://"+addr+"/boguspath", sockRep)
 	if e != nil {
 		t.Errorf("Failed new Dialer: %v", e)
 		return
@@ -61,14 +62,15 @@ func TestWebsockPath(t *testing.T) {
 var bogusstr = "THIS IS BOGUS"
 
 func bogusHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, bogusstr)
+	fmt.Fprint(w, bogusstr)
 }
 
 func TestWebsockMux(t *testing.T) {
 	sockReq, _ := req.NewSocket()
 	sockRep, _ := rep.NewSocket()
 	tran := Transport
-	l, e := tran.NewListener("ws://127.0.0.1:3336/mysock", sockReq)
+	addr := fmt.Sprintf("127.0.0.1:%d", test.NextPort())
+	l, e := tran.NewListener("ws://"+addr+"/mysock", sockReq)
 	if e != nil {
 		t.Errorf("Failed new Listener: %v", e)
 		return
@@ -79,7 +81,7 @@ func TestWebsockMux(t *testing.T) {
 	}
 	mux := muxi.(*http.ServeMux)
 	mux.HandleFunc("/bogus", bogusHandler)
-	d, e := tran.NewDialer("ws://127.0.0.1:3336/bogus", sockRep)
+	d, e := tran.NewDialer("ws://"+addr+"/bogus", sockRep)
 	if e != nil {
 		t.Errorf("Failed new Dialer: %v", e)
 		return
@@ -102,7 +104,7 @@ func TestWebsockMux(t *testing.T) {
 	t.Logf("Got expected error %v", e)
 
 	// Now let's try to use http client.
-	resp, err := http.Get("http://127.0.0.1:3336/bogus")
+	resp, err := http.Get("http://" + addr + "/bogus")
 
 	if err != nil {
 		t.Errorf("Get of boguspath failed: %v", err)
@@ -131,7 +133,8 @@ func TestWebsockHandler(t *testing.T) {
 	sockReq, _ := req.NewSocket()
 	sockRep, _ := rep.NewSocket()
 	tran := Transport
-	l, e := tran.NewListener("ws://127.0.0.1:3337/mysock", sockReq)
+	addr := fmt.Sprintf("127.0.0.1:%d", test.NextPort())
+	l, e := tran.NewListener("ws://"+addr+"/mysock", sockReq)
 	if e != nil {
 		t.Errorf("Failed new Listener: %v", e)
 		return
@@ -149,12 +152,12 @@ func TestWebsockHandler(t *testing.T) {
 	// Note that we are *counting* on this to die gracefully when our
 	// program exits. There appears to be no way to shutdown http
 	// instances gracefully.
-	go http.ListenAndServe("127.0.0.1:3337", mux)
+	go http.ListenAndServe(addr, mux)
 
 	// Give the server a chance to startup, as we are running it asynch
 	time.Sleep(time.Second / 10)
 
-	d, e := tran.NewDialer("ws://127.0.0.1:3337/bogus", sockRep)
+	d, e := tran.NewDialer("ws://"+addr+"/bogus", sockRep)
 	if e != nil {
 		t.Errorf("Failed new Dialer: %v", e)
 		return
@@ -173,7 +176,7 @@ func TestWebsockHandler(t *testing.T) {
 	t.Logf("Got expected error %v", e)
 
 	// Now let's try to use http client.
-	resp, err := http.Get("http://127.0.0.1:3337/bogus")
+	resp, err := http.Get("http://" + addr + "/bogus")
 
 	if err != nil {
 		t.Errorf("Get of boguspath failed: %v", err)
@@ -20,7 +20,7 @@ import (
 	"nanomsg.org/go/mangos/v2/test"
 )
 
-var tt = test.NewTranTest(Transport, "ws://127.0.0.1:3395/mysock")
+var tt = test.NewTranTest(Transport, test.AddrTestWS()+"mysock")
 
 func TestWebsockListenAndAccept(t *testing.T) {
 	tt.TestListenAndAccept(t)
@@ -20,7 +20,7 @@ import (
 	"nanomsg.org/go/mangos/v2/test"
 )
 
-var tt = test.NewTranTest(Transport, "wss://127.0.0.1:3346/mysock")
+var tt = test.NewTranTest(Transport, test.AddrTestWSS()+"mysock")
 
 func TestWSSListenAndAccept(t *testing.T) {
 	tt.TestListenAndAccept(t)